@@ -17,11 +17,17 @@
 package pob
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/common/hexutil"
 	"github.com/probechain/go-probe/consensus"
 	"github.com/probechain/go-probe/core/types"
+	"github.com/probechain/go-probe/crypto/dilithium"
+	"github.com/probechain/go-probe/params"
 	"github.com/probechain/go-probe/rpc"
 )
 
@@ -132,6 +138,354 @@ func (api *API) Discard(address common.Address) {
 	delete(api.pob.proposals, address)
 }
 
+// GetScoringRule retrieves the scoring rule in effect at the specified block, or
+// nil if the validators are scored with the default weights.
+func (api *API) GetScoringRule(number *rpc.BlockNumber) (*params.PobScoringRule, error) {
+	var header *types.Header
+	if number == nil || *number == rpc.LatestBlockNumber {
+		header = api.chain.CurrentHeader()
+	} else {
+		header = api.chain.GetHeaderByNumber(uint64(number.Int64()))
+	}
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	snap, err := api.pob.snapshot(api.chain, header.Number.Uint64(), header.Hash(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return snap.scoringRule(header.Number.Uint64()), nil
+}
+
+// ScoringProposal returns the scoring rule the node currently votes for.
+func (api *API) ScoringProposal() *params.PobScoringRule {
+	api.pob.lock.RLock()
+	defer api.pob.lock.RUnlock()
+
+	return api.pob.scoring
+}
+
+// ProposeScoring injects a scoring rule the validator will vote for until it is
+// put into effect. The decay is only used by the decayed model.
+func (api *API) ProposeScoring(model string, weights [5]uint64, decay uint64) error {
+	return api.pob.ProposeScoring(&params.PobScoringRule{Model: model, Weights: weights, Decay: decay})
+}
+
+// DiscardScoring drops the currently proposed scoring rule.
+func (api *API) DiscardScoring() {
+	api.pob.DiscardScoring()
+}
+
+// SubmitEvidence queues a proof of validator misbehavior for inclusion into the
+// next locally sealed block. The conflicting objects are RLP encoded headers for
+// double-sign evidence, or RLP encoded acks for equivocating ACK evidence.
+func (api *API) SubmitEvidence(kind EvidenceType, first, second hexutil.Bytes) (common.Hash, error) {
+	ev := &Evidence{Type: kind, First: first, Second: second}
+	if err := api.pob.SubmitEvidence(api.chain, ev); err != nil {
+		return common.Hash{}, err
+	}
+	return ev.Hash(), nil
+}
+
+// GetDilithiumKey retrieves the Dilithium public key registered for a validator
+// at the specified block, or nil if it has not registered one.
+func (api *API) GetDilithiumKey(address common.Address, number *rpc.BlockNumber) (hexutil.Bytes, error) {
+	var header *types.Header
+	if number == nil || *number == rpc.LatestBlockNumber {
+		header = api.chain.CurrentHeader()
+	} else {
+		header = api.chain.GetHeaderByNumber(uint64(number.Int64()))
+	}
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	snap, err := api.pob.snapshot(api.chain, header.Number.Uint64(), header.Hash(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return snap.PubKeys[address], nil
+}
+
+// SubmitKeyRegistration queues a Dilithium key registration or rotation signed
+// elsewhere for inclusion into the next locally sealed block.
+func (api *API) SubmitKeyRegistration(reg KeyRegistration) (common.Hash, error) {
+	if err := api.pob.SubmitKeyRegistration(api.chain, &reg); err != nil {
+		return common.Hash{}, err
+	}
+	return reg.Hash(), nil
+}
+
+// RegisterDilithiumKey authorizes the local validator to sign with the given
+// Dilithium private key and queues the registration of its public key.
+func (api *API) RegisterDilithiumKey(key hexutil.Bytes) (common.Hash, error) {
+	priv, err := dilithium.UnmarshalPrivateKey(key)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	reg, err := api.pob.RegisterDilithiumKey(api.chain, priv)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return reg.Hash(), nil
+}
+
+const (
+	// maxHistoryRange is the maximum number of blocks a validator history query
+	// may replay.
+	maxHistoryRange = 1024
+
+	// maxTimelineEpochs is the maximum number of epochs a score timeline query
+	// may cover.
+	maxTimelineEpochs = 256
+)
+
+// scoreChangesInterval is the interval at which score change subscriptions poll
+// the chain for a new head.
+var scoreChangesInterval = time.Second
+
+var (
+	errInvalidRange  = errors.New("invalid block range")
+	errRangeTooLarge = errors.New("block range too large")
+)
+
+// ValidatorActivity is the block production record of a validator over a range
+// of blocks.
+type ValidatorActivity struct {
+	Validator   common.Address    `json:"validator"`
+	From        uint64            `json:"from"`        // First block of the range
+	To          uint64            `json:"to"`          // Last block of the range
+	Proposed    []uint64          `json:"proposed"`    // Blocks sealed by the validator
+	MissedTurns []uint64          `json:"missedTurns"` // Blocks the validator was selected for but did not seal
+	History     *ValidatorHistory `json:"history"`     // Cumulative history at the last block, nil if not a validator
+	Score       *BehaviorScore    `json:"score"`       // Behavior score at the last block, nil if not a validator
+}
+
+// ScorePoint is the behavior score of a validator at an epoch boundary.
+type ScorePoint struct {
+	Epoch   uint64            `json:"epoch"`
+	Number  uint64            `json:"number"`
+	Score   *BehaviorScore    `json:"score"`   // Nil if not a validator at the epoch
+	History *ValidatorHistory `json:"history"` // Nil if not a validator at the epoch
+}
+
+// ScoreChange is the notification sent to score change subscribers whenever the
+// behavior score of a validator changes, or it joins or leaves the set.
+type ScoreChange struct {
+	Number    uint64         `json:"number"`
+	Hash      common.Hash    `json:"hash"`
+	Validator common.Address `json:"validator"`
+	Previous  *BehaviorScore `json:"previous"` // Nil if the validator joined the set
+	Current   *BehaviorScore `json:"current"`  // Nil if the validator left the set
+}
+
+// GetValidatorHistory replays the given range of blocks, at most the latest
+// maxHistoryRange ones if from is omitted, and returns the blocks the validator
+// sealed and the turns it missed.
+func (api *API) GetValidatorHistory(address common.Address, from, to *rpc.BlockNumber) (*ValidatorActivity, error) {
+	last := api.chain.CurrentHeader()
+	if to != nil && *to != rpc.LatestBlockNumber && *to != rpc.PendingBlockNumber {
+		last = api.chain.GetHeaderByNumber(uint64(to.Int64()))
+	}
+	if last == nil {
+		return nil, errUnknownBlock
+	}
+	end := last.Number.Uint64()
+
+	var start uint64 = 1
+	if from != nil {
+		start = uint64(from.Int64())
+	} else if end >= maxHistoryRange {
+		start = end - maxHistoryRange + 1
+	}
+	if start == 0 || start > end {
+		return nil, errInvalidRange
+	}
+	if end-start >= maxHistoryRange {
+		return nil, errRangeTooLarge
+	}
+	// Collect the headers of the range backwards so they all belong to one chain
+	headers := make([]*types.Header, end-start+1)
+	for i, header := len(headers)-1, last; i >= 0; i-- {
+		if header == nil {
+			return nil, errUnknownBlock
+		}
+		headers[i] = header
+		header = api.chain.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+	}
+	snap, err := api.pob.snapshot(api.chain, start-1, headers[0].ParentHash, nil)
+	if err != nil {
+		return nil, err
+	}
+	activity := &ValidatorActivity{
+		Validator:   address,
+		From:        start,
+		To:          end,
+		Proposed:    []uint64{},
+		MissedTurns: []uint64{},
+	}
+	for _, header := range headers {
+		number := header.Number.Uint64()
+		expected := snap.selectProducer(number, header.ParentHash)
+		switch {
+		case header.ValidatorAddr == address && !header.IsVisual():
+			activity.Proposed = append(activity.Proposed, number)
+		case expected == address:
+			activity.MissedTurns = append(activity.MissedTurns, number)
+		}
+		if snap, err = snap.apply([]*types.Header{header}, api.chain.Config()); err != nil {
+			return nil, err
+		}
+	}
+	if hist, ok := snap.Histories[address]; ok {
+		histCopy := *hist
+		activity.History = &histCopy
+	}
+	if score, ok := snap.Validators[address]; ok {
+		scoreCopy := *score
+		activity.Score = &scoreCopy
+	}
+	return activity, nil
+}
+
+// GetScoreTimeline retrieves the behavior score of a validator at every epoch
+// boundary of the given range of epochs, up to the current head.
+func (api *API) GetScoreTimeline(address common.Address, fromEpoch, toEpoch uint64) ([]*ScorePoint, error) {
+	if fromEpoch > toEpoch {
+		return nil, errInvalidRange
+	}
+	if toEpoch-fromEpoch >= maxTimelineEpochs {
+		return nil, errRangeTooLarge
+	}
+	var (
+		epoch = api.pob.pobConfig.Epoch
+		head  = api.chain.CurrentHeader()
+	)
+	if head == nil {
+		return nil, errUnknownBlock
+	}
+	timeline := []*ScorePoint{}
+	for e := fromEpoch; e <= toEpoch; e++ {
+		number := e * epoch
+		if number > head.Number.Uint64() {
+			break
+		}
+		header := api.chain.GetHeaderByNumber(number)
+		if header == nil {
+			return nil, errUnknownBlock
+		}
+		snap, err := api.pob.snapshot(api.chain, number, header.Hash(), nil)
+		if err != nil {
+			return nil, err
+		}
+		point := &ScorePoint{Epoch: e, Number: number}
+		if score, ok := snap.Validators[address]; ok {
+			scoreCopy, histCopy := *score, *snap.Histories[address]
+			point.Score, point.History = &scoreCopy, &histCopy
+		}
+		timeline = append(timeline, point)
+	}
+	return timeline, nil
+}
+
+// GetExpectedProducer retrieves the validator selected to seal the given block,
+// which defaults to the next block on top of the current head.
+func (api *API) GetExpectedProducer(number *rpc.BlockNumber) (common.Address, error) {
+	var parent *types.Header
+	if number == nil || *number == rpc.PendingBlockNumber {
+		parent = api.chain.CurrentHeader()
+	} else if *number == rpc.LatestBlockNumber {
+		if head := api.chain.CurrentHeader(); head != nil && head.Number.Uint64() > 0 {
+			parent = api.chain.GetHeader(head.ParentHash, head.Number.Uint64()-1)
+		}
+	} else if number.Int64() > 0 {
+		parent = api.chain.GetHeaderByNumber(uint64(number.Int64()) - 1)
+	}
+	if parent == nil {
+		return common.Address{}, errUnknownBlock
+	}
+	snap, err := api.pob.snapshot(api.chain, parent.Number.Uint64(), parent.Hash(), nil)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return snap.selectProducer(parent.Number.Uint64()+1, parent.Hash()), nil
+}
+
+// ScoreChanges creates a subscription that is notified whenever the behavior
+// score of a validator changes as the chain head moves, including validators
+// joining or leaving the set.
+func (api *API) ScoreChanges(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	rpcSub := notifier.CreateSubscription()
+
+	go func() {
+		ticker := time.NewTicker(scoreChangesInterval)
+		defer ticker.Stop()
+
+		var last *Snapshot
+		for {
+			select {
+			case <-ticker.C:
+				head := api.chain.CurrentHeader()
+				if head == nil || (last != nil && last.Hash == head.Hash()) {
+					continue
+				}
+				snap, err := api.pob.snapshot(api.chain, head.Number.Uint64(), head.Hash(), nil)
+				if err != nil {
+					continue
+				}
+				if last != nil {
+					for _, change := range scoreChanges(last, snap) {
+						notifier.Notify(rpcSub.ID, change)
+					}
+				}
+				last = snap
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+	return rpcSub, nil
+}
+
+// scoreChanges returns the validators whose behavior score differs between two
+// snapshots, in ascending order. Refreshed update heights alone don't count as
+// a change.
+func scoreChanges(prev, next *Snapshot) []*ScoreChange {
+	seen := make(map[common.Address]struct{})
+	for addr := range prev.Validators {
+		seen[addr] = struct{}{}
+	}
+	for addr := range next.Validators {
+		seen[addr] = struct{}{}
+	}
+	var changes []*ScoreChange
+	for _, addr := range sortedKeys(seen) {
+		change := &ScoreChange{Number: next.Number, Hash: next.Hash, Validator: addr}
+		if score, ok := prev.Validators[addr]; ok {
+			scoreCopy := *score
+			change.Previous = &scoreCopy
+		}
+		if score, ok := next.Validators[addr]; ok {
+			scoreCopy := *score
+			change.Current = &scoreCopy
+		}
+		if change.Previous != nil && change.Current != nil {
+			a, b := *change.Previous, *change.Current
+			a.LastUpdate, b.LastUpdate = 0, 0
+			if a == b {
+				continue
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
 type status struct {
 	InturnPercent float64                `json:"inturnPercent"`
 	SigningStatus map[common.Address]int `json:"sealerActivity"`
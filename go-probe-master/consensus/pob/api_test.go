@@ -0,0 +1,246 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package pob
+
+import (
+	"context"
+	"math/big"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/core/rawdb"
+	"github.com/probechain/go-probe/core/types"
+	"github.com/probechain/go-probe/params"
+	"github.com/probechain/go-probe/rpc"
+)
+
+// lockedChainReader is a test chain that can be extended while an API
+// subscription is reading it.
+type lockedChainReader struct {
+	*testChainReader
+	lock sync.RWMutex
+}
+
+func (c *lockedChainReader) add(header *types.Header) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.headers[header.Hash()] = header
+	c.numbers[header.Number.Uint64()] = header
+}
+
+func (c *lockedChainReader) CurrentHeader() *types.Header {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.testChainReader.CurrentHeader()
+}
+func (c *lockedChainReader) GetHeader(hash common.Hash, number uint64) *types.Header {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.testChainReader.GetHeader(hash, number)
+}
+func (c *lockedChainReader) GetHeaderByNumber(number uint64) *types.Header {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.testChainReader.GetHeaderByNumber(number)
+}
+func (c *lockedChainReader) GetHeaderByHash(hash common.Hash) *types.Header {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.testChainReader.GetHeaderByHash(hash)
+}
+
+// newMonitoringAPI creates an engine and API over a chain of n blocks sealed by
+// their expected producers, apart from the out of turn blocks which are sealed
+// by the next validator instead. It returns the blocks each validator sealed
+// and missed.
+func newMonitoringAPI(t *testing.T, addrs []common.Address, n uint64, outOfTurn map[uint64]bool) (*API, *lockedChainReader, map[common.Address][]uint64, map[common.Address][]uint64) {
+	t.Helper()
+
+	var list []common.Validator
+	for _, addr := range addrs {
+		list = append(list, common.Validator{Owner: addr})
+	}
+	engine := New(&params.PobConfig{Epoch: 4, ValidatorList: list}, rawdb.NewMemoryDatabase(), params.AllPobProtocolChanges)
+	genesis := &types.Header{Number: big.NewInt(0), Difficulty: big.NewInt(1)}
+	chain := &lockedChainReader{testChainReader: newTestChainReader(genesis)}
+	chain.config = behaviorForkConfig(0)
+	api := &API{chain: chain, pob: engine}
+
+	var (
+		proposed = make(map[common.Address][]uint64)
+		missed   = make(map[common.Address][]uint64)
+	)
+	for number := uint64(1); number <= n; number++ {
+		expected, err := api.GetExpectedProducer(nil)
+		if err != nil {
+			t.Fatalf("block %d: failed to retrieve expected producer: %v", number, err)
+		}
+		producer := expected
+		if outOfTurn[number] {
+			for i, addr := range addrs {
+				if addr == expected {
+					producer = addrs[(i+1)%len(addrs)]
+				}
+			}
+			missed[expected] = append(missed[expected], number)
+		}
+		proposed[producer] = append(proposed[producer], number)
+		chain.add(newTestHeader(number, chain.CurrentHeader().Hash(), producer))
+	}
+	return api, chain, proposed, missed
+}
+
+// Tests that validator histories report the sealed blocks and missed turns of
+// validators over arbitrary block ranges.
+func TestValidatorHistoryAPI(t *testing.T) {
+	addrs := testAddresses(3)
+	api, _, proposed, missed := newMonitoringAPI(t, addrs, 12, map[uint64]bool{5: true, 9: true, 10: true})
+
+	from, to := rpc.BlockNumber(1), rpc.BlockNumber(12)
+	for _, addr := range addrs {
+		activity, err := api.GetValidatorHistory(addr, &from, &to)
+		if err != nil {
+			t.Fatalf("failed to retrieve history: %v", err)
+		}
+		if want := append([]uint64{}, proposed[addr]...); !reflect.DeepEqual(activity.Proposed, want) {
+			t.Errorf("validator %x: proposed mismatch: have %v, want %v", addr, activity.Proposed, want)
+		}
+		if want := append([]uint64{}, missed[addr]...); !reflect.DeepEqual(activity.MissedTurns, want) {
+			t.Errorf("validator %x: missed turns mismatch: have %v, want %v", addr, activity.MissedTurns, want)
+		}
+		if activity.History == nil || activity.History.BlocksMissed != uint64(len(missed[addr])) {
+			t.Errorf("validator %x: history mismatch: %+v", addr, activity.History)
+		}
+	}
+	// Sub ranges only report the blocks within the range
+	from, to = 6, 9
+	activity, err := api.GetValidatorHistory(addrs[0], &from, &to)
+	if err != nil {
+		t.Fatalf("failed to retrieve history: %v", err)
+	}
+	for _, number := range append(activity.Proposed, activity.MissedTurns...) {
+		if number < 6 || number > 9 {
+			t.Errorf("block %d reported outside of range", number)
+		}
+	}
+	// Invalid ranges are rejected
+	if _, err := api.GetValidatorHistory(addrs[0], &to, &from); err != errInvalidRange {
+		t.Errorf("inverted range error mismatch: have %v, want %v", err, errInvalidRange)
+	}
+	unknown := rpc.BlockNumber(13)
+	if _, err := api.GetValidatorHistory(addrs[0], &from, &unknown); err != errUnknownBlock {
+		t.Errorf("unknown block error mismatch: have %v, want %v", err, errUnknownBlock)
+	}
+}
+
+// Tests that score timelines report the scores of the epoch boundary snapshots.
+func TestScoreTimelineAPI(t *testing.T) {
+	addrs := testAddresses(3)
+	api, chain, _, _ := newMonitoringAPI(t, addrs, 10, map[uint64]bool{3: true})
+
+	timeline, err := api.GetScoreTimeline(addrs[1], 1, 5)
+	if err != nil {
+		t.Fatalf("failed to retrieve timeline: %v", err)
+	}
+	if len(timeline) != 2 {
+		t.Fatalf("timeline length mismatch: have %d, want 2", len(timeline))
+	}
+	for i, point := range timeline {
+		header := chain.GetHeaderByNumber(uint64(i+1) * 4)
+		snap, err := api.pob.snapshot(chain, header.Number.Uint64(), header.Hash(), nil)
+		if err != nil {
+			t.Fatalf("failed to retrieve snapshot: %v", err)
+		}
+		if point.Epoch != uint64(i+1) || point.Number != header.Number.Uint64() {
+			t.Errorf("point %d: position mismatch: have %d/%d", i, point.Epoch, point.Number)
+		}
+		if *point.Score != *snap.Validators[addrs[1]] {
+			t.Errorf("point %d: score mismatch: have %+v, want %+v", i, point.Score, snap.Validators[addrs[1]])
+		}
+	}
+	if _, err := api.GetScoreTimeline(addrs[1], 0, maxTimelineEpochs); err != errRangeTooLarge {
+		t.Errorf("large range error mismatch: have %v, want %v", err, errRangeTooLarge)
+	}
+}
+
+// Tests that score changes are computed between snapshots and delivered to
+// subscribers as the chain head moves.
+func TestScoreChanges(t *testing.T) {
+	addrs := testAddresses(4)
+	prev := newTestSnapshot(&params.PobConfig{Epoch: 1000}, addrs[:3])
+	next := prev.copy()
+	next.Validators[addrs[0]].LastUpdate = 10
+	next.Validators[addrs[1]].Total = 4000
+	next.removeValidator(addrs[2], 10)
+	next.Validators[addrs[3]] = DefaultBehaviorScore(5000, 10)
+
+	changes := scoreChanges(prev, next)
+	if len(changes) != 3 {
+		t.Fatalf("change count mismatch: have %d, want 3", len(changes))
+	}
+	if changes[0].Validator != addrs[1] || changes[0].Previous.Total != 5000 || changes[0].Current.Total != 4000 {
+		t.Errorf("score change mismatch: %+v", changes[0])
+	}
+	if changes[1].Validator != addrs[2] || changes[1].Current != nil {
+		t.Errorf("removal mismatch: %+v", changes[1])
+	}
+	if changes[2].Validator != addrs[3] || changes[2].Previous != nil {
+		t.Errorf("addition mismatch: %+v", changes[2])
+	}
+	// Subscribers are notified about the rescoring on the epoch boundary
+	defer func(interval time.Duration) { scoreChangesInterval = interval }(scoreChangesInterval)
+	scoreChangesInterval = 10 * time.Millisecond
+
+	api, chain, _, _ := newMonitoringAPI(t, addrs[:3], 7, map[uint64]bool{5: true, 6: true})
+
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("pob", api); err != nil {
+		t.Fatalf("failed to register API: %v", err)
+	}
+	client := rpc.DialInProc(server)
+	defer client.Close()
+
+	ch := make(chan *ScoreChange, 16)
+	sub, err := client.Subscribe(context.Background(), "pob", ch, "scoreChanges")
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	time.Sleep(10 * scoreChangesInterval)
+	expected, err := api.GetExpectedProducer(nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve expected producer: %v", err)
+	}
+	chain.add(newTestHeader(8, chain.CurrentHeader().Hash(), expected))
+
+	select {
+	case change := <-ch:
+		if change.Number != 8 || change.Previous == nil || change.Current == nil || change.Current.LastUpdate != 8 {
+			t.Errorf("notification mismatch: %+v", change)
+		}
+	case err := <-sub.Err():
+		t.Fatalf("subscription failed: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no score change notification")
+	}
+}
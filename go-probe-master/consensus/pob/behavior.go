@@ -58,23 +58,49 @@ type BehaviorAgent struct {
 	// Weights for each dimension: [liveness, correctness, cooperation, consistency, signalSovereignty].
 	// Each is expressed as a percentage out of 100 (must sum to 100).
 	weights [5]uint64
+
+	// model derives the per-dimension scores from a validator's history.
+	model ScoringModel
 }
 
+// defaultWeights are the dimension weights of the default scoring rule.
+var defaultWeights = [5]uint64{25, 25, 18, 17, 15} // liveness, correctness, cooperation, consistency, signalSovereignty
+
 // NewBehaviorAgent creates a new BehaviorAgent with the default dimension weights.
 func NewBehaviorAgent() *BehaviorAgent {
+	return NewBehaviorAgentWithModel(DefaultScoringModel{}, defaultWeights)
+}
+
+// NewBehaviorAgentWithModel creates a new BehaviorAgent scoring with the given
+// model and dimension weights. The weights must sum to 100.
+func NewBehaviorAgentWithModel(model ScoringModel, weights [5]uint64) *BehaviorAgent {
 	return &BehaviorAgent{
-		weights: [5]uint64{25, 25, 18, 17, 15}, // liveness, correctness, cooperation, consistency, signalSovereignty
+		weights: weights,
+		model:   model,
 	}
 }
 
+// Model returns the scoring model of the agent.
+func (ba *BehaviorAgent) Model() ScoringModel {
+	return ba.model
+}
+
+// Weights returns the dimension weights of the agent.
+func (ba *BehaviorAgent) Weights() [5]uint64 {
+	return ba.weights
+}
+
 // EvaluateValidator scores a validator based on its history.
 // Returns a BehaviorScore with per-dimension and total scores in basis points (0-10000).
 func (ba *BehaviorAgent) EvaluateValidator(addr common.Address, history *ValidatorHistory, blockNumber uint64) *BehaviorScore {
-	liveness := ba.calcLiveness(history)
-	correctness := ba.calcCorrectness(history)
-	cooperation := ba.calcCooperation(history)
-	consistency := ba.calcConsistency(history)
-	signalSovereignty := ba.calcSignalSovereignty(history)
+	return ba.EvaluateWindow(addr, history, nil, blockNumber)
+}
+
+// EvaluateWindow scores a validator based on its history and the scoring window
+// the agent's model maintains for it, which may be nil.
+func (ba *BehaviorAgent) EvaluateWindow(addr common.Address, history *ValidatorHistory, window *ScoringWindow, blockNumber uint64) *BehaviorScore {
+	dims := ba.model.Dimensions(history, window)
+	liveness, correctness, cooperation, consistency, signalSovereignty := dims[0], dims[1], dims[2], dims[3], dims[4]
 
 	total := (liveness*ba.weights[0] + correctness*ba.weights[1] +
 		cooperation*ba.weights[2] + consistency*ba.weights[3] +
@@ -97,7 +123,7 @@ func (ba *BehaviorAgent) EvaluateValidator(addr common.Address, history *Validat
 
 // calcLiveness scores based on block production rate.
 // Perfect production = maxScore, deducted for misses.
-func (ba *BehaviorAgent) calcLiveness(h *ValidatorHistory) uint64 {
+func calcLiveness(h *ValidatorHistory) uint64 {
 	totalOpportunities := h.BlocksProposed + h.BlocksMissed
 	if totalOpportunities == 0 {
 		return maxScore // No opportunities yet, assume perfect
@@ -106,7 +132,7 @@ func (ba *BehaviorAgent) calcLiveness(h *ValidatorHistory) uint64 {
 }
 
 // calcCorrectness scores based on valid vs invalid proposals.
-func (ba *BehaviorAgent) calcCorrectness(h *ValidatorHistory) uint64 {
+func calcCorrectness(h *ValidatorHistory) uint64 {
 	totalProposals := h.BlocksProposed + h.InvalidProposals
 	if totalProposals == 0 {
 		return maxScore
@@ -115,7 +141,7 @@ func (ba *BehaviorAgent) calcCorrectness(h *ValidatorHistory) uint64 {
 }
 
 // calcCooperation scores based on acknowledgment participation.
-func (ba *BehaviorAgent) calcCooperation(h *ValidatorHistory) uint64 {
+func calcCooperation(h *ValidatorHistory) uint64 {
 	totalAcks := h.AcksGiven + h.AcksMissed
 	if totalAcks == 0 {
 		return maxScore
@@ -125,7 +151,7 @@ func (ba *BehaviorAgent) calcCooperation(h *ValidatorHistory) uint64 {
 
 // calcConsistency scores inversely proportional to slash count.
 // No slashes = maxScore. Each slash reduces by 1000 bp.
-func (ba *BehaviorAgent) calcConsistency(h *ValidatorHistory) uint64 {
+func calcConsistency(h *ValidatorHistory) uint64 {
 	penalty := h.SlashCount * 1000
 	if penalty >= maxScore {
 		return 0
@@ -137,7 +163,7 @@ func (ba *BehaviorAgent) calcConsistency(h *ValidatorHistory) uint64 {
 // Rydberg-verified blocks, radio-based time syncs, and AtomicTime block production.
 // Validators without stellar capabilities receive a neutral baseline score (5000)
 // so they are not penalized below the default starting point.
-func (ba *BehaviorAgent) calcSignalSovereignty(h *ValidatorHistory) uint64 {
+func calcSignalSovereignty(h *ValidatorHistory) uint64 {
 	totalStellarOps := h.RydbergVerified + h.RadioSyncs + h.StellarBlocks
 	if totalStellarOps == 0 {
 		return defaultInitialScore // Neutral baseline — no penalty for non-stellar nodes
@@ -202,8 +228,10 @@ func (ba *BehaviorAgent) EvaluateValidatorFast(addr common.Address, history *Val
 }
 
 // UpdateScores re-evaluates all validators in the snapshot and returns updated scores.
+// The windows hold the scoring windows of the agent's model and may be nil.
 func (ba *BehaviorAgent) UpdateScores(validators map[common.Address]*BehaviorScore,
-	histories map[common.Address]*ValidatorHistory, blockNumber uint64) map[common.Address]*BehaviorScore {
+	histories map[common.Address]*ValidatorHistory, windows map[common.Address]*ScoringWindow,
+	blockNumber uint64) map[common.Address]*BehaviorScore {
 
 	updated := make(map[common.Address]*BehaviorScore, len(validators))
 	for addr := range validators {
@@ -211,7 +239,7 @@ func (ba *BehaviorAgent) UpdateScores(validators map[common.Address]*BehaviorSco
 		if !ok {
 			history = &ValidatorHistory{}
 		}
-		updated[addr] = ba.EvaluateValidator(addr, history, blockNumber)
+		updated[addr] = ba.EvaluateWindow(addr, history, windows[addr], blockNumber)
 	}
 	return updated
 }
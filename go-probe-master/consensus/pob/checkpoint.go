@@ -0,0 +1,237 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package pob
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/crypto"
+	"github.com/probechain/go-probe/rlp"
+)
+
+const (
+	// checkpointVersion1 is the first versioned checkpoint payload layout:
+	//
+	//	[1B: version][uvarint: count N]
+	//	[N × (20B address + 8B score + 32B Dilithium pubkey hash)]
+	//	[32B: Merkle root of the validator histories]
+	checkpointVersion1 = byte(1)
+
+	checkpointEntrySize = common.AddressLength + 8 + common.HashLength
+)
+
+// Domain separators for the validator history Merkle tree.
+var (
+	historyLeafPrefix = []byte{0x00}
+	historyNodePrefix = []byte{0x01}
+)
+
+// checkpointValidator is a single validator commitment in a checkpoint payload.
+type checkpointValidator struct {
+	Address    common.Address
+	Score      uint64
+	PubKeyHash common.Hash // Keccak256 of the Dilithium public key, zero if none
+}
+
+// checkpointData is the validator set commitment carried by checkpoint headers.
+// It describes the snapshot the checkpoint block was sealed on top of.
+type checkpointData struct {
+	Version     byte
+	Validators  []checkpointValidator
+	HistoryRoot common.Hash
+}
+
+// newCheckpointData assembles the checkpoint commitment of a snapshot.
+func newCheckpointData(snap *Snapshot) *checkpointData {
+	vals := snap.validators()
+	data := &checkpointData{
+		Version:     checkpointVersion1,
+		Validators:  make([]checkpointValidator, 0, len(vals)),
+		HistoryRoot: historyRoot(snap),
+	}
+	for _, v := range vals {
+		entry := checkpointValidator{Address: v, Score: snap.Validators[v].Total}
+		if pubkey := snap.PubKeys[v]; len(pubkey) > 0 {
+			entry.PubKeyHash = crypto.Keccak256Hash(pubkey)
+		}
+		data.Validators = append(data.Validators, entry)
+	}
+	return data
+}
+
+// encodeBehaviorData encodes the validator set, scores, key commitments and the
+// history root of a snapshot for checkpoint blocks.
+func encodeBehaviorData(snap *Snapshot) []byte {
+	return newCheckpointData(snap).encode()
+}
+
+// encode serializes the checkpoint commitment in its versioned layout.
+func (d *checkpointData) encode() []byte {
+	var count [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(count[:], uint64(len(d.Validators)))
+
+	data := make([]byte, 0, 1+n+len(d.Validators)*checkpointEntrySize+common.HashLength)
+	data = append(data, d.Version)
+	data = append(data, count[:n]...)
+	for _, v := range d.Validators {
+		var score [8]byte
+		binary.BigEndian.PutUint64(score[:], v.Score)
+
+		data = append(data, v.Address[:]...)
+		data = append(data, score[:]...)
+		data = append(data, v.PubKeyHash[:]...)
+	}
+	return append(data, d.HistoryRoot[:]...)
+}
+
+// decodeBehaviorData decodes the validator set commitment from checkpoint extra-data.
+func decodeBehaviorData(data []byte) (*checkpointData, error) {
+	if len(data) < 1 || data[0] != checkpointVersion1 {
+		return nil, errInvalidCheckpointValidators
+	}
+	count, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return nil, errInvalidCheckpointValidators
+	}
+	body := data[1+n:]
+	if count > uint64(len(body)/checkpointEntrySize) || uint64(len(body)) != count*checkpointEntrySize+common.HashLength {
+		return nil, errInvalidCheckpointValidators
+	}
+	result := &checkpointData{
+		Version:    data[0],
+		Validators: make([]checkpointValidator, count),
+	}
+	for i := range result.Validators {
+		entry := body[i*checkpointEntrySize : (i+1)*checkpointEntrySize]
+
+		copy(result.Validators[i].Address[:], entry[:common.AddressLength])
+		result.Validators[i].Score = binary.BigEndian.Uint64(entry[common.AddressLength : common.AddressLength+8])
+		copy(result.Validators[i].PubKeyHash[:], entry[common.AddressLength+8:])
+
+		if i > 0 && bytes.Compare(result.Validators[i-1].Address[:], result.Validators[i].Address[:]) >= 0 {
+			return nil, errInvalidCheckpointValidators
+		}
+	}
+	copy(result.HistoryRoot[:], body[count*checkpointEntrySize:])
+	return result, nil
+}
+
+// historyLeaf hashes a single validator history into a Merkle leaf.
+func historyLeaf(addr common.Address, hist *ValidatorHistory) common.Hash {
+	if hist == nil {
+		hist = new(ValidatorHistory)
+	}
+	blob, err := rlp.EncodeToBytes(hist)
+	if err != nil {
+		panic("can't encode: " + err.Error())
+	}
+	return crypto.Keccak256Hash(historyLeafPrefix, addr[:], blob)
+}
+
+// historyLeaves returns the Merkle leaves of the snapshot's validator histories
+// in ascending validator order.
+func historyLeaves(snap *Snapshot) []common.Hash {
+	vals := snap.validators()
+	leaves := make([]common.Hash, len(vals))
+	for i, v := range vals {
+		leaves[i] = historyLeaf(v, snap.Histories[v])
+	}
+	return leaves
+}
+
+// historyRoot computes the Merkle root over the histories of all active
+// validators. An odd node at any level is promoted unchanged.
+func historyRoot(snap *Snapshot) common.Hash {
+	level := historyLeaves(snap)
+	if len(level) == 0 {
+		return common.Hash{}
+	}
+	for len(level) > 1 {
+		next := make([]common.Hash, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, crypto.Keccak256Hash(historyNodePrefix, level[i][:], level[i+1][:]))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// historyProof returns the Merkle proof for the history of the given validator,
+// or nil if it is not an active validator in the snapshot.
+func historyProof(snap *Snapshot, addr common.Address) []common.Hash {
+	vals := snap.validators()
+	index := -1
+	for i, v := range vals {
+		if v == addr {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil
+	}
+	var (
+		level = historyLeaves(snap)
+		proof = make([]common.Hash, 0)
+	)
+	for len(level) > 1 {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		next := make([]common.Hash, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, crypto.Keccak256Hash(historyNodePrefix, level[i][:], level[i+1][:]))
+		}
+		level, index = next, index/2
+	}
+	return proof
+}
+
+// VerifyHistoryProof checks that the history of the validator at the given index
+// of a checkpoint of the given size is committed to by the history root. It can
+// be used by light clients to trust validator histories without replaying headers.
+func VerifyHistoryProof(root common.Hash, index, size int, addr common.Address, hist *ValidatorHistory, proof []common.Hash) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	hash := historyLeaf(addr, hist)
+	for width := size; width > 1; width = (width + 1) / 2 {
+		if sibling := index ^ 1; sibling < width {
+			if len(proof) == 0 {
+				return false
+			}
+			if index%2 == 0 {
+				hash = crypto.Keccak256Hash(historyNodePrefix, hash[:], proof[0][:])
+			} else {
+				hash = crypto.Keccak256Hash(historyNodePrefix, proof[0][:], hash[:])
+			}
+			proof = proof[1:]
+		}
+		index /= 2
+	}
+	return len(proof) == 0 && hash == root
+}
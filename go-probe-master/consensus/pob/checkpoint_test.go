@@ -0,0 +1,261 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package pob
+
+import (
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/core/rawdb"
+	"github.com/probechain/go-probe/core/types"
+	"github.com/probechain/go-probe/crypto"
+	"github.com/probechain/go-probe/params"
+)
+
+// testChainReader is a minimal header chain used to drive the engine in tests.
+type testChainReader struct {
+	config  *params.ChainConfig
+	headers map[common.Hash]*types.Header
+	numbers map[uint64]*types.Header
+}
+
+func newTestChainReader(headers ...*types.Header) *testChainReader {
+	chain := &testChainReader{
+		config:  params.AllPobProtocolChanges,
+		headers: make(map[common.Hash]*types.Header),
+		numbers: make(map[uint64]*types.Header),
+	}
+	for _, header := range headers {
+		chain.headers[header.Hash()] = header
+		chain.numbers[header.Number.Uint64()] = header
+	}
+	return chain
+}
+
+func (c *testChainReader) Config() *params.ChainConfig { return c.config }
+func (c *testChainReader) CurrentHeader() *types.Header {
+	return c.numbers[uint64(len(c.numbers)-1)]
+}
+func (c *testChainReader) GetHeader(hash common.Hash, number uint64) *types.Header {
+	return c.headers[hash]
+}
+func (c *testChainReader) GetHeaderByNumber(number uint64) *types.Header {
+	return c.numbers[number]
+}
+func (c *testChainReader) GetHeaderByHash(hash common.Hash) *types.Header {
+	return c.headers[hash]
+}
+
+// testAddresses generates n distinct, ascending addresses.
+func testAddresses(n int) []common.Address {
+	addrs := make([]common.Address, n)
+	for i := range addrs {
+		binary.BigEndian.PutUint32(addrs[i][16:], uint32(i+1))
+	}
+	return addrs
+}
+
+// Tests that checkpoint payloads round trip for validator sets larger than the
+// legacy single byte count allowed.
+func TestCheckpointEncoding(t *testing.T) {
+	addrs := testAddresses(300)
+	snap := newTestSnapshot(&params.PobConfig{Epoch: 1000}, addrs)
+	for i, addr := range addrs {
+		snap.Validators[addr].Total = uint64(i)
+		snap.Histories[addr].BlocksProposed = uint64(i * 2)
+		if i%2 == 0 {
+			snap.PubKeys[addr] = []byte{byte(i), 0x01}
+		}
+	}
+	blob := encodeBehaviorData(snap)
+	data, err := decodeBehaviorData(blob)
+	if err != nil {
+		t.Fatalf("failed to decode checkpoint: %v", err)
+	}
+	if len(data.Validators) != len(addrs) {
+		t.Fatalf("validator count mismatch: have %d, want %d", len(data.Validators), len(addrs))
+	}
+	for i, v := range data.Validators {
+		if v.Address != addrs[i] || v.Score != uint64(i) {
+			t.Errorf("validator %d mismatch: have %x/%d, want %x/%d", i, v.Address, v.Score, addrs[i], i)
+		}
+		if (i%2 == 0) == (v.PubKeyHash == common.Hash{}) {
+			t.Errorf("validator %d: pubkey hash mismatch: %x", i, v.PubKeyHash)
+		}
+	}
+	if data.HistoryRoot != historyRoot(snap) {
+		t.Errorf("history root mismatch: have %x, want %x", data.HistoryRoot, historyRoot(snap))
+	}
+	// Any modification of the histories must change the commitment
+	snap.Histories[addrs[7]].AcksMissed++
+	if data.HistoryRoot == historyRoot(snap) {
+		t.Errorf("history root unchanged after history modification")
+	}
+	// Malformed payloads must be rejected
+	for i, bad := range [][]byte{
+		nil,
+		{0x00},
+		append([]byte{0x02}, blob[1:]...),
+		blob[:len(blob)-1],
+		append(blob, 0x00),
+	} {
+		if _, err := decodeBehaviorData(bad); err != errInvalidCheckpointValidators {
+			t.Errorf("payload %d: error mismatch: have %v, want %v", i, err, errInvalidCheckpointValidators)
+		}
+	}
+}
+
+// Tests that history proofs verify for every validator of various set sizes.
+func TestHistoryProofs(t *testing.T) {
+	for size := 1; size <= 9; size++ {
+		addrs := testAddresses(size)
+		snap := newTestSnapshot(&params.PobConfig{Epoch: 1000}, addrs)
+		for i, addr := range addrs {
+			snap.Histories[addr].AcksGiven = uint64(i + 1)
+		}
+		root := historyRoot(snap)
+		for i, addr := range addrs {
+			proof := historyProof(snap, addr)
+			if !VerifyHistoryProof(root, i, size, addr, snap.Histories[addr], proof) {
+				t.Errorf("size %d, index %d: valid proof rejected", size, i)
+			}
+			forged := *snap.Histories[addr]
+			forged.SlashCount++
+			if VerifyHistoryProof(root, i, size, addr, &forged, proof) {
+				t.Errorf("size %d, index %d: forged history accepted", size, i)
+			}
+		}
+	}
+	if proof := historyProof(newTestSnapshot(&params.PobConfig{Epoch: 1000}, nil), common.Address{}); proof != nil {
+		t.Errorf("proof generated for unknown validator")
+	}
+}
+
+// Tests that checkpoint headers are verified against the local snapshot.
+func TestCheckpointVerification(t *testing.T) {
+	addrs := testAddresses(3)
+
+	var list []common.Validator
+	for _, addr := range addrs {
+		list = append(list, common.Validator{Owner: addr})
+	}
+	engine := New(&params.PobConfig{Epoch: 2, ValidatorList: list}, rawdb.NewMemoryDatabase(), params.AllPobProtocolChanges)
+
+	genesis := &types.Header{Number: big.NewInt(0), Difficulty: big.NewInt(1)}
+	block1 := newTestHeader(1, genesis.Hash(), addrs[0])
+	chain := newTestChainReader(genesis, block1)
+	chain.config = behaviorForkConfig(0)
+
+	header := newTestHeader(2, block1.Hash(), addrs[1])
+	if err := engine.Prepare(chain, header); err != nil {
+		t.Fatalf("failed to prepare checkpoint: %v", err)
+	}
+	if err := engine.verifyCheckpoint(chain, header, nil); err != nil {
+		t.Fatalf("valid checkpoint rejected: %v", err)
+	}
+	// Tamper with a committed score
+	tampered := types.CopyHeader(header)
+	tampered.Extra[extraVanity+2+common.AddressLength+7]++
+	if err := engine.verifyCheckpoint(chain, tampered, nil); err != errMismatchingCheckpointValidators {
+		t.Fatalf("tampered checkpoint error mismatch: have %v, want %v", err, errMismatchingCheckpointValidators)
+	}
+	// Checkpoints without a commitment are invalid
+	tampered.Extra = make([]byte, extraVanity+extraSeal)
+	if err := engine.verifyCheckpoint(chain, tampered, nil); err != errInvalidCheckpointValidators {
+		t.Fatalf("missing checkpoint error mismatch: have %v, want %v", err, errInvalidCheckpointValidators)
+	}
+}
+
+// behaviorForkConfig returns a PoB chain config with the behavior fork at the
+// given block and London disabled, so test headers need no base fee.
+func behaviorForkConfig(fork int64) *params.ChainConfig {
+	config := *params.AllPobProtocolChanges
+	config.LondonBlock = nil
+	config.PobBehaviorBlock = big.NewInt(fork)
+	return &config
+}
+
+// Tests that checkpoints before the behavior fork, which carry no validator
+// commitment, are imported, while checkpoints after it must carry one.
+func TestCheckpointFork(t *testing.T) {
+	vals := newTestValidators(t, 2)
+
+	var list []common.Validator
+	for _, addr := range vals.addrs {
+		list = append(list, common.Validator{Owner: addr})
+	}
+	engine := New(&params.PobConfig{Epoch: 2, ValidatorList: list}, rawdb.NewMemoryDatabase(), params.AllPobProtocolChanges)
+
+	genesis := &types.Header{Number: big.NewInt(0), Difficulty: big.NewInt(1), GasLimit: 8000000}
+	chain := newTestChainReader(genesis)
+	chain.config = behaviorForkConfig(4)
+
+	seal := func(header *types.Header, i int) {
+		sig, err := crypto.Sign(crypto.Keccak256(PobRLP(header)), vals.keys[i])
+		if err != nil {
+			t.Fatalf("failed to seal header: %v", err)
+		}
+		header.ValidatorSig = sig
+	}
+	var headers []*types.Header
+	parent := genesis
+	for number := uint64(1); number <= 4; number++ {
+		header := newTestHeader(number, parent.Hash(), vals.addrs[number%2])
+		header.GasLimit = 8000000
+		header.Extra = make([]byte, extraVanity+extraSeal)
+		if err := engine.Prepare(chain, header); err != nil {
+			t.Fatalf("block %d: failed to prepare header: %v", number, err)
+		}
+		if number == 2 && len(header.Extra) != extraVanity+extraSeal {
+			t.Fatalf("pre-fork checkpoint carries a commitment")
+		}
+		if number == 4 && len(header.Extra) == extraVanity+extraSeal {
+			t.Fatalf("post-fork checkpoint carries no commitment")
+		}
+		seal(header, int(number%2))
+		headers = append(headers, header)
+		parent = header
+		chain.headers[header.Hash()] = header
+		chain.numbers[number] = header
+	}
+	// Import the batch on top of a chain that only knows the genesis
+	verify := func(headers []*types.Header) error {
+		importer := newTestChainReader(genesis)
+		importer.config = chain.config
+		engine := New(&params.PobConfig{Epoch: 2, ValidatorList: list}, rawdb.NewMemoryDatabase(), params.AllPobProtocolChanges)
+
+		_, results := engine.VerifyHeaders(importer, headers, make([]bool, len(headers)))
+		for range headers {
+			if err := <-results; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := verify(headers); err != nil {
+		t.Fatalf("failed to import checkpoints: %v", err)
+	}
+	// A post-fork checkpoint without a commitment is rejected
+	stripped := types.CopyHeader(headers[3])
+	stripped.Extra = make([]byte, extraVanity+extraSeal)
+	seal(stripped, 0)
+	if err := verify(append(headers[:3:3], stripped)); err != errInvalidCheckpointValidators {
+		t.Fatalf("stripped checkpoint error mismatch: have %v, want %v", err, errInvalidCheckpointValidators)
+	}
+}
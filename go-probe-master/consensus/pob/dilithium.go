@@ -0,0 +1,227 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package pob
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/common/hexutil"
+	"github.com/probechain/go-probe/core/types"
+	"github.com/probechain/go-probe/crypto"
+	"github.com/probechain/go-probe/crypto/dilithium"
+	"github.com/probechain/go-probe/rlp"
+)
+
+const (
+	// maxKeyRegistrationsPerBlock is the maximum number of key registrations a
+	// single header may carry.
+	maxKeyRegistrationsPerBlock = 2
+
+	// dilithiumAckSigLen is the length of a Dilithium signed ACK witness
+	// signature: the 20 byte signer address followed by the ML-DSA-44 signature.
+	dilithiumAckSigLen = common.AddressLength + dilithium.SignatureSize
+)
+
+// keyRegistrationPrefix domain separates key registration digests from any
+// other message signed by validator keys.
+var keyRegistrationPrefix = []byte("pob-dilithium-key")
+
+var (
+	errUnknownDilithiumKey     = errors.New("no Dilithium key registered for validator")
+	errInvalidDilithiumSeal    = errors.New("invalid Dilithium seal")
+	errDilithiumSealRequired   = errors.New("validator with registered Dilithium key sealed with ECDSA")
+	errDilithiumBeforeFork     = errors.New("Dilithium seal or key registration before fork")
+	errInvalidKeyRegistration  = errors.New("invalid Dilithium key registration")
+	errTooManyKeyRegistrations = errors.New("too many key registrations in header")
+	errNoDilithiumKey          = errors.New("no authorized Dilithium key for registered public key")
+)
+
+// KeyRegistration publishes or rotates the ML-DSA-44 key a validator uses to
+// seal headers and sign ACKs. It must be authorized by the validator's current
+// Dilithium key, or by its ECDSA key if none is registered yet, and prove
+// possession of the new key.
+type KeyRegistration struct {
+	Validator common.Address `json:"validator"`
+	PubKey    hexutil.Bytes  `json:"pubkey"` // ML-DSA-44 public key to register
+	Proof     hexutil.Bytes  `json:"proof"`  // Signature of the digest by the new key
+	Auth      hexutil.Bytes  `json:"auth"`   // Signature of the digest by the current key
+}
+
+// KeyRegistrationDigest returns the message signed by both the new and the
+// current key of a registration. Binding the current key makes registrations
+// authorized by a rotated-out key unusable.
+func KeyRegistrationDigest(validator common.Address, current, pubkey []byte) common.Hash {
+	return crypto.Keccak256Hash(keyRegistrationPayload(validator, current, pubkey))
+}
+
+// keyRegistrationPayload returns the preimage of the registration digest, which
+// is what account signers hash and sign when authorizing with an ECDSA key.
+func keyRegistrationPayload(validator common.Address, current, pubkey []byte) []byte {
+	var currentHash common.Hash
+	if len(current) > 0 {
+		currentHash = crypto.Keccak256Hash(current)
+	}
+	payload := make([]byte, 0, len(keyRegistrationPrefix)+common.AddressLength+common.HashLength+len(pubkey))
+	payload = append(payload, keyRegistrationPrefix...)
+	payload = append(payload, validator[:]...)
+	payload = append(payload, currentHash[:]...)
+	return append(payload, pubkey...)
+}
+
+// NewKeyRegistration creates a registration of key for validator, signing the
+// proof of possession. The returned registration still needs to be authorized
+// by signing KeyRegistrationDigest with the validator's current key into Auth.
+func NewKeyRegistration(validator common.Address, current []byte, key *dilithium.PrivateKey) *KeyRegistration {
+	pubkey := dilithium.MarshalPublicKey(key.Public())
+	digest := KeyRegistrationDigest(validator, current, pubkey)
+	return &KeyRegistration{
+		Validator: validator,
+		PubKey:    pubkey,
+		Proof:     dilithium.Sign(key, digest[:]),
+	}
+}
+
+// Hash returns the keccak256 hash of the RLP encoded registration.
+func (r *KeyRegistration) Hash() common.Hash {
+	blob, _ := rlp.EncodeToBytes(r)
+	return crypto.Keccak256Hash(blob)
+}
+
+// verify checks the registration against the validator's currently registered
+// key, which is nil if the validator never registered one.
+func (r *KeyRegistration) verify(current []byte) error {
+	if len(r.PubKey) != dilithium.PublicKeySize || bytes.Equal(r.PubKey, current) {
+		return errInvalidKeyRegistration
+	}
+	digest := KeyRegistrationDigest(r.Validator, current, r.PubKey)
+	if !verifyDilithium(r.PubKey, digest[:], r.Proof) {
+		return errInvalidKeyRegistration
+	}
+	if len(current) > 0 {
+		if !verifyDilithium(current, digest[:], r.Auth) {
+			return errInvalidKeyRegistration
+		}
+		return nil
+	}
+	pubkey, err := crypto.Ecrecover(digest[:], r.Auth)
+	if err != nil {
+		return errInvalidKeyRegistration
+	}
+	var signer common.Address
+	copy(signer[:], crypto.Keccak256(pubkey[1:])[12:])
+	if signer != r.Validator {
+		return errInvalidKeyRegistration
+	}
+	return nil
+}
+
+// encodeKeyRegistrations encodes a list of registrations for inclusion into a header.
+func encodeKeyRegistrations(regs []*KeyRegistration) ([]byte, error) {
+	if len(regs) == 0 {
+		return nil, nil
+	}
+	return rlp.EncodeToBytes(regs)
+}
+
+// decodeKeyRegistrations decodes the list of registrations carried by a header.
+func decodeKeyRegistrations(data []byte) ([]*KeyRegistration, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var regs []*KeyRegistration
+	if err := rlp.DecodeBytes(data, &regs); err != nil {
+		return nil, err
+	}
+	if len(regs) > maxKeyRegistrationsPerBlock {
+		return nil, errTooManyKeyRegistrations
+	}
+	return regs, nil
+}
+
+// verifyDilithium checks an ML-DSA-44 signature of msg by the serialized key.
+func verifyDilithium(key, msg, sig []byte) bool {
+	pub, err := dilithium.UnmarshalPublicKey(key)
+	if err != nil {
+		return false
+	}
+	return dilithium.Verify(pub, msg, sig)
+}
+
+// sealSigner returns the validator that sealed the header. Headers carrying a
+// bare ML-DSA-44 signature are verified against the key registered for their
+// declared validator in keys; anything else goes through recoverValidator.
+func sealSigner(header *types.Header, keys map[common.Address][]byte) (common.Address, error) {
+	if len(header.ValidatorSig) != dilithium.SignatureSize {
+		return recoverValidator(header)
+	}
+	key, ok := keys[header.ValidatorAddr]
+	if !ok {
+		return common.Address{}, errUnknownDilithiumKey
+	}
+	if !verifyDilithium(key, crypto.Keccak256(PobRLP(header)), header.ValidatorSig) {
+		return common.Address{}, errInvalidDilithiumSeal
+	}
+	return header.ValidatorAddr, nil
+}
+
+// ackSigner returns the validator that signed an ack. Dilithium signed acks are
+// verified against the key registered for their declared signer in keys; once a
+// validator registered a key, ECDSA acks of it are no longer accepted.
+func ackSigner(ack *types.Ack, keys map[common.Address][]byte) (common.Address, error) {
+	if len(ack.WitnessSig) == dilithiumAckSigLen {
+		signer := common.BytesToAddress(ack.WitnessSig[:common.AddressLength])
+		key, ok := keys[signer]
+		if !ok {
+			return common.Address{}, errUnknownDilithiumKey
+		}
+		if !verifyDilithium(key, crypto.Keccak256(PobAckRLP(ack)), ack.WitnessSig[common.AddressLength:]) {
+			return common.Address{}, errInvalidDilithiumSeal
+		}
+		return signer, nil
+	}
+	pubkey, err := crypto.Ecrecover(crypto.Keccak256(PobAckRLP(ack)), ack.WitnessSig)
+	if err != nil {
+		return common.Address{}, err
+	}
+	var signer common.Address
+	copy(signer[:], crypto.Keccak256(pubkey[1:])[12:])
+	if _, ok := keys[signer]; ok {
+		return common.Address{}, errDilithiumSealRequired
+	}
+	return signer, nil
+}
+
+// applyKeyRegistrations registers the Dilithium keys carried by a header. Every
+// registration must be valid against the keys registered so far.
+func (s *Snapshot) applyKeyRegistrations(header *types.Header) error {
+	regs, err := decodeKeyRegistrations(header.KeyRegistrations)
+	if err != nil {
+		return err
+	}
+	for _, reg := range regs {
+		if _, ok := s.Validators[reg.Validator]; !ok {
+			return errUnauthorizedValidator
+		}
+		if err := reg.verify(s.PubKeys[reg.Validator]); err != nil {
+			return err
+		}
+		s.PubKeys[reg.Validator] = common.CopyBytes(reg.PubKey)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package pob
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/probechain/go-probe/accounts"
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/core/rawdb"
+	"github.com/probechain/go-probe/core/types"
+	"github.com/probechain/go-probe/crypto"
+	"github.com/probechain/go-probe/crypto/dilithium"
+	"github.com/probechain/go-probe/params"
+)
+
+func newDilithiumKey(t *testing.T) *dilithium.PrivateKey {
+	t.Helper()
+	key, err := dilithium.GenerateKey()
+	if err != nil {
+		t.Fatalf("failed to generate Dilithium key: %v", err)
+	}
+	return key
+}
+
+// register creates a registration of key for the i-th validator authorized by
+// its ECDSA key, or by the current Dilithium key if one is given.
+func (v *testValidators) register(t *testing.T, i int, key *dilithium.PrivateKey, current *dilithium.PrivateKey) *KeyRegistration {
+	t.Helper()
+	var currentPub []byte
+	if current != nil {
+		currentPub = dilithium.MarshalPublicKey(current.Public())
+	}
+	reg := NewKeyRegistration(v.addrs[i], currentPub, key)
+	digest := KeyRegistrationDigest(v.addrs[i], currentPub, reg.PubKey)
+	if current != nil {
+		reg.Auth = dilithium.Sign(current, digest[:])
+	} else {
+		sig, err := crypto.Sign(digest[:], v.keys[i])
+		if err != nil {
+			t.Fatalf("failed to authorize registration: %v", err)
+		}
+		reg.Auth = sig
+	}
+	return reg
+}
+
+// Tests that key registrations and rotations are only accepted when authorized
+// by the validator's current key.
+func TestKeyRegistration(t *testing.T) {
+	vals := newTestValidators(t, 2)
+	snap := newTestSnapshot(&params.PobConfig{Epoch: 1000}, vals.addrs)
+
+	first, second := newDilithiumKey(t), newDilithiumKey(t)
+
+	apply := func(number uint64, regs ...*KeyRegistration) error {
+		t.Helper()
+		header := newTestHeader(number, snap.Hash, vals.addrs[0])
+		header.KeyRegistrations, _ = encodeKeyRegistrations(regs)
+
+		next, err := snap.apply([]*types.Header{header}, behaviorForkConfig(0))
+		if err == nil {
+			snap = next
+		}
+		return err
+	}
+	// Registrations authorized by somebody else's ECDSA key are rejected
+	forged := vals.register(t, 0, first, nil)
+	forged.Validator = vals.addrs[1]
+	if err := apply(1, forged); err != errInvalidKeyRegistration {
+		t.Fatalf("forged registration error mismatch: have %v, want %v", err, errInvalidKeyRegistration)
+	}
+	// The initial registration is authorized by the ECDSA key
+	if err := apply(1, vals.register(t, 0, first, nil)); err != nil {
+		t.Fatalf("failed to register key: %v", err)
+	}
+	if have, want := snap.PubKeys[vals.addrs[0]], dilithium.MarshalPublicKey(first.Public()); string(have) != string(want) {
+		t.Fatalf("registered key mismatch")
+	}
+	// Once registered, the ECDSA key can no longer rotate
+	if err := apply(2, vals.register(t, 0, second, nil)); err != errInvalidKeyRegistration {
+		t.Fatalf("ECDSA rotation error mismatch: have %v, want %v", err, errInvalidKeyRegistration)
+	}
+	// Rotations authorized by the current key are accepted
+	if err := apply(2, vals.register(t, 0, second, first)); err != nil {
+		t.Fatalf("failed to rotate key: %v", err)
+	}
+	if have, want := snap.PubKeys[vals.addrs[0]], dilithium.MarshalPublicKey(second.Public()); string(have) != string(want) {
+		t.Fatalf("rotated key mismatch")
+	}
+	// Replaying a rotation authorized by a rotated-out key is rejected
+	if err := apply(3, vals.register(t, 0, first, first)); err != errInvalidKeyRegistration {
+		t.Fatalf("stale rotation error mismatch: have %v, want %v", err, errInvalidKeyRegistration)
+	}
+	// Non-validators can't register keys
+	outsider := newTestValidators(t, 1)
+	if err := apply(3, outsider.register(t, 0, first, nil)); err != errUnauthorizedValidator {
+		t.Fatalf("outsider registration error mismatch: have %v, want %v", err, errUnauthorizedValidator)
+	}
+}
+
+// Tests that Dilithium signed seals and acks are verified against the registered
+// keys, and that ECDSA signatures are refused once a key is registered.
+func TestDilithiumSignatures(t *testing.T) {
+	vals := newTestValidators(t, 2)
+	key := newDilithiumKey(t)
+	keys := map[common.Address][]byte{vals.addrs[0]: dilithium.MarshalPublicKey(key.Public())}
+
+	// Dilithium sealed headers
+	header := newTestHeader(5, common.Hash{}, vals.addrs[0])
+	header.Extra = make([]byte, extraVanity+extraSeal)
+	header.ValidatorSig = dilithium.Sign(key, crypto.Keccak256(PobRLP(header)))
+
+	if signer, err := sealSigner(header, keys); err != nil || signer != vals.addrs[0] {
+		t.Fatalf("Dilithium seal mismatch: have %x/%v, want %x/nil", signer, err, vals.addrs[0])
+	}
+	if _, err := sealSigner(header, nil); err != errUnknownDilithiumKey {
+		t.Errorf("unregistered seal error mismatch: have %v, want %v", err, errUnknownDilithiumKey)
+	}
+	tampered := types.CopyHeader(header)
+	tampered.GasUsed++
+	if _, err := sealSigner(tampered, keys); err != errInvalidDilithiumSeal {
+		t.Errorf("tampered seal error mismatch: have %v, want %v", err, errInvalidDilithiumSeal)
+	}
+	// Dilithium signed acks
+	ack := &types.Ack{Number: big.NewInt(4), BlockHash: common.Hash{0x01}, AckType: types.AckTypeAgree}
+	ack.WitnessSig = append(vals.addrs[0].Bytes(), dilithium.Sign(key, crypto.Keccak256(PobAckRLP(ack)))...)
+
+	if signer, err := ackSigner(ack, keys); err != nil || signer != vals.addrs[0] {
+		t.Fatalf("Dilithium ack mismatch: have %x/%v, want %x/nil", signer, err, vals.addrs[0])
+	}
+	keys[vals.addrs[1]] = dilithium.MarshalPublicKey(newDilithiumKey(t).Public())
+
+	impersonated := *ack
+	impersonated.WitnessSig = append(vals.addrs[1].Bytes(), ack.WitnessSig[common.AddressLength:]...)
+	if _, err := ackSigner(&impersonated, keys); err != errInvalidDilithiumSeal {
+		t.Errorf("impersonated ack error mismatch: have %v, want %v", err, errInvalidDilithiumSeal)
+	}
+	delete(keys, vals.addrs[1])
+
+	// ECDSA acks are refused from validators with a registered key only
+	if _, err := ackSigner(vals.ack(t, 0, 4, common.Hash{0x01}), keys); err != errDilithiumSealRequired {
+		t.Errorf("ECDSA ack error mismatch: have %v, want %v", err, errDilithiumSealRequired)
+	}
+	if signer, err := ackSigner(vals.ack(t, 1, 4, common.Hash{0x01}), keys); err != nil || signer != vals.addrs[1] {
+		t.Errorf("ECDSA ack mismatch: have %x/%v, want %x/nil", signer, err, vals.addrs[1])
+	}
+}
+
+// Tests the end-to-end Dilithium path of the engine: registering the key of the
+// local validator, sealing with it and verifying the seal after the fork.
+func TestDilithiumSealing(t *testing.T) {
+	vals := newTestValidators(t, 1)
+
+	config := *params.AllPobProtocolChanges
+	config.DilithiumBlock = big.NewInt(1)
+
+	engine := New(&params.PobConfig{Epoch: 1000, ValidatorList: []common.Validator{{Owner: vals.addrs[0]}}}, rawdb.NewMemoryDatabase(), &config)
+	engine.Authorize(vals.addrs[0], func(account accounts.Account, mimeType string, message []byte) ([]byte, error) {
+		return crypto.Sign(crypto.Keccak256(message), vals.keys[0])
+	})
+	genesis := &types.Header{Number: big.NewInt(0), Difficulty: big.NewInt(1)}
+	chain := newTestChainReader(genesis)
+	chain.config = &config
+
+	seal := func(header *types.Header) *types.Header {
+		t.Helper()
+		header.Extra = make([]byte, extraVanity+extraSeal)
+		block := types.NewBlockWithHeader(header)
+		if err := engine.Seal(chain, block, nil, nil); err != nil {
+			t.Fatalf("block %d: failed to seal: %v", header.Number, err)
+		}
+		return block.Header()
+	}
+	// Register the key, which has to be sealed with ECDSA still
+	key := newDilithiumKey(t)
+	if _, err := engine.RegisterDilithiumKey(chain, key); err != nil {
+		t.Fatalf("failed to register key: %v", err)
+	}
+	header := newTestHeader(1, genesis.Hash(), vals.addrs[0])
+	if err := engine.Prepare(chain, header); err != nil {
+		t.Fatalf("failed to prepare header: %v", err)
+	}
+	if len(header.KeyRegistrations) == 0 {
+		t.Fatalf("pending registration not included")
+	}
+	block1 := seal(header)
+	if len(block1.ValidatorSig) != crypto.SignatureLength {
+		t.Fatalf("registration block seal length mismatch: have %d, want %d", len(block1.ValidatorSig), crypto.SignatureLength)
+	}
+	if _, err := engine.verifySeal(chain, block1, nil); err != nil {
+		t.Fatalf("registration block rejected: %v", err)
+	}
+	chain = newTestChainReader(genesis, block1)
+	chain.config = &config
+
+	// Subsequent blocks must be sealed with the registered key
+	block2 := seal(newTestHeader(2, block1.Hash(), vals.addrs[0]))
+	if len(block2.ValidatorSig) != dilithium.SignatureSize {
+		t.Fatalf("Dilithium seal length mismatch: have %d, want %d", len(block2.ValidatorSig), dilithium.SignatureSize)
+	}
+	if _, err := engine.verifySeal(chain, block2, nil); err != nil {
+		t.Fatalf("Dilithium sealed block rejected: %v", err)
+	}
+	ecdsa := newTestHeader(2, block1.Hash(), vals.addrs[0])
+	ecdsa.Extra = make([]byte, extraVanity+extraSeal)
+	ecdsa.ValidatorSig, _ = crypto.Sign(crypto.Keccak256(PobRLP(ecdsa)), vals.keys[0])
+	if _, err := engine.verifySeal(chain, ecdsa, nil); err != errDilithiumSealRequired {
+		t.Fatalf("ECDSA sealed block error mismatch: have %v, want %v", err, errDilithiumSealRequired)
+	}
+	// Acks are signed with the registered key as well
+	ack := &types.Ack{Number: big.NewInt(1), BlockHash: block1.Hash(), AckType: types.AckTypeAgree}
+	sig, err := engine.AckSig(chain, ack)
+	if err != nil {
+		t.Fatalf("failed to sign ack: %v", err)
+	}
+	ack.WitnessSig = sig
+	if signer, err := engine.AckSigner(chain, ack); err != nil || signer != vals.addrs[0] {
+		t.Fatalf("ack signer mismatch: have %x/%v, want %x/nil", signer, err, vals.addrs[0])
+	}
+	// Dilithium seals are invalid before the fork
+	config.DilithiumBlock = big.NewInt(10)
+	if _, err := engine.verifySeal(chain, block2, nil); err != errDilithiumBeforeFork {
+		t.Fatalf("pre-fork Dilithium seal error mismatch: have %v, want %v", err, errDilithiumBeforeFork)
+	}
+}
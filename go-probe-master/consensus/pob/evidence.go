@@ -0,0 +1,216 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package pob
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/core/types"
+	"github.com/probechain/go-probe/crypto"
+	"github.com/probechain/go-probe/rlp"
+)
+
+const (
+	// maxEvidencePerBlock is the maximum number of misbehavior proofs a single
+	// header may carry.
+	maxEvidencePerBlock = 4
+
+	// doubleSignSeverity is the slash severity (basis points) for sealing two
+	// conflicting blocks at the same height.
+	doubleSignSeverity = maxScore
+	// equivocatingAckSeverity is the slash severity (basis points) for signing
+	// two conflicting ACKs for the same height.
+	equivocatingAckSeverity = maxScore / 2
+)
+
+var (
+	errUnknownEvidence       = errors.New("unknown evidence type")
+	errTooMuchEvidence       = errors.New("too much evidence in header")
+	errEvidenceNotConflict   = errors.New("evidence does not conflict")
+	errEvidenceSignerInvalid = errors.New("evidence signed by different validators")
+)
+
+// EvidenceType identifies the kind of misbehavior proven by an Evidence.
+type EvidenceType uint8
+
+const (
+	EvidenceDoubleSign      EvidenceType = iota + 1 // Two distinct headers sealed for the same height
+	EvidenceEquivocatingAck                         // Two conflicting ACKs signed for the same height
+)
+
+// Evidence is a self-contained proof of validator misbehavior. It is carried in
+// the Evidence field of a block header and applied deterministically when the
+// header is processed by the snapshot.
+type Evidence struct {
+	Type   EvidenceType `json:"type"`
+	First  []byte       `json:"first"`  // RLP of the first conflicting header or ack
+	Second []byte       `json:"second"` // RLP of the second conflicting header or ack
+}
+
+// NewDoubleSignEvidence creates evidence that the validator sealing both headers
+// produced two distinct blocks for the same height.
+func NewDoubleSignEvidence(first, second *types.Header) (*Evidence, error) {
+	a, err := rlp.EncodeToBytes(first)
+	if err != nil {
+		return nil, err
+	}
+	b, err := rlp.EncodeToBytes(second)
+	if err != nil {
+		return nil, err
+	}
+	return &Evidence{Type: EvidenceDoubleSign, First: a, Second: b}, nil
+}
+
+// NewEquivocatingAckEvidence creates evidence that a validator signed two
+// conflicting acknowledgements for the same height.
+func NewEquivocatingAckEvidence(first, second *types.Ack) (*Evidence, error) {
+	a, err := rlp.EncodeToBytes(first)
+	if err != nil {
+		return nil, err
+	}
+	b, err := rlp.EncodeToBytes(second)
+	if err != nil {
+		return nil, err
+	}
+	return &Evidence{Type: EvidenceEquivocatingAck, First: a, Second: b}, nil
+}
+
+// Hash returns the keccak256 hash of the RLP encoded evidence.
+func (e *Evidence) Hash() common.Hash {
+	blob, _ := rlp.EncodeToBytes(e)
+	return crypto.Keccak256Hash(blob)
+}
+
+// severity returns the slash severity in basis points of the proven offence.
+func (e *Evidence) severity() uint64 {
+	if e.Type == EvidenceDoubleSign {
+		return doubleSignSeverity
+	}
+	return equivocatingAckSeverity
+}
+
+// verify checks that the evidence proves misbehavior, returning the offending
+// validator and the height at which the offence was committed. Dilithium signed
+// headers and acks are checked against the registered validator keys.
+func (e *Evidence) verify(keys map[common.Address][]byte) (common.Address, uint64, error) {
+	switch e.Type {
+	case EvidenceDoubleSign:
+		return verifyDoubleSign(e.First, e.Second, keys)
+	case EvidenceEquivocatingAck:
+		return verifyEquivocatingAck(e.First, e.Second, keys)
+	default:
+		return common.Address{}, 0, errUnknownEvidence
+	}
+}
+
+// verifyDoubleSign checks that two headers of the same height with different
+// sealed contents were both sealed by their declared validator.
+func verifyDoubleSign(first, second []byte, keys map[common.Address][]byte) (common.Address, uint64, error) {
+	var a, b types.Header
+	if err := rlp.DecodeBytes(first, &a); err != nil {
+		return common.Address{}, 0, err
+	}
+	if err := rlp.DecodeBytes(second, &b); err != nil {
+		return common.Address{}, 0, err
+	}
+	if a.Number == nil || b.Number == nil || a.Number.Cmp(b.Number) != 0 {
+		return common.Address{}, 0, errEvidenceNotConflict
+	}
+	if len(a.Extra) == 0 || len(b.Extra) == 0 {
+		return common.Address{}, 0, errMissingVanity
+	}
+	// Only the sealed content counts: fields outside the seal, such as the
+	// atomic timestamp or a malleated signature, can be rewritten by anyone.
+	if SealHash(&a) == SealHash(&b) {
+		return common.Address{}, 0, errEvidenceNotConflict
+	}
+	signerA, err := sealSigner(&a, keys)
+	if err != nil {
+		return common.Address{}, 0, err
+	}
+	signerB, err := sealSigner(&b, keys)
+	if err != nil {
+		return common.Address{}, 0, err
+	}
+	if signerA != a.ValidatorAddr || signerB != b.ValidatorAddr || signerA != signerB {
+		return common.Address{}, 0, errEvidenceSignerInvalid
+	}
+	return signerA, a.Number.Uint64(), nil
+}
+
+// verifyEquivocatingAck checks that two acknowledgements for the same height
+// disagree on the block or vote and were signed by the same validator.
+func verifyEquivocatingAck(first, second []byte, keys map[common.Address][]byte) (common.Address, uint64, error) {
+	var a, b types.Ack
+	if err := rlp.DecodeBytes(first, &a); err != nil {
+		return common.Address{}, 0, err
+	}
+	if err := rlp.DecodeBytes(second, &b); err != nil {
+		return common.Address{}, 0, err
+	}
+	if a.Number == nil || b.Number == nil || a.Number.Cmp(b.Number) != 0 {
+		return common.Address{}, 0, errEvidenceNotConflict
+	}
+	if a.BlockHash == b.BlockHash && a.AckType == b.AckType {
+		return common.Address{}, 0, errEvidenceNotConflict
+	}
+	signerA, err := ackSigner(&a, keys)
+	if err != nil {
+		return common.Address{}, 0, err
+	}
+	signerB, err := ackSigner(&b, keys)
+	if err != nil {
+		return common.Address{}, 0, err
+	}
+	if signerA != signerB {
+		return common.Address{}, 0, errEvidenceSignerInvalid
+	}
+	return signerA, a.Number.Uint64(), nil
+}
+
+// offenceKey returns the identifier of an offence, used to make sure a single
+// misbehavior is only ever punished once regardless of the proof submitted.
+func offenceKey(offender common.Address, number uint64, kind EvidenceType) common.Hash {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], number)
+	return crypto.Keccak256Hash(offender[:], buf[:], []byte{byte(kind)})
+}
+
+// encodeEvidence encodes a list of evidence for inclusion into a header.
+func encodeEvidence(evidence []*Evidence) ([]byte, error) {
+	if len(evidence) == 0 {
+		return nil, nil
+	}
+	return rlp.EncodeToBytes(evidence)
+}
+
+// decodeEvidence decodes the list of evidence carried by a header.
+func decodeEvidence(data []byte) ([]*Evidence, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var evidence []*Evidence
+	if err := rlp.DecodeBytes(data, &evidence); err != nil {
+		return nil, err
+	}
+	if len(evidence) > maxEvidencePerBlock {
+		return nil, errTooMuchEvidence
+	}
+	return evidence, nil
+}
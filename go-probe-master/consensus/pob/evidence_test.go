@@ -0,0 +1,240 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package pob
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/core/rawdb"
+	"github.com/probechain/go-probe/core/types"
+	"github.com/probechain/go-probe/crypto"
+	"github.com/probechain/go-probe/params"
+)
+
+// sealed creates a header at the given height sealed by the i-th validator.
+func (v *testValidators) sealed(t *testing.T, i int, number uint64, extra byte) *types.Header {
+	t.Helper()
+	header := newTestHeader(number, common.Hash{}, v.addrs[i])
+	header.Extra = []byte{extra, 0x00}
+
+	sig, err := crypto.Sign(crypto.Keccak256(PobRLP(header)), v.keys[i])
+	if err != nil {
+		t.Fatalf("failed to seal header: %v", err)
+	}
+	header.ValidatorSig = sig
+	return header
+}
+
+func TestEvidenceVerification(t *testing.T) {
+	vals := newTestValidators(t, 2)
+
+	// Two distinct headers sealed by the same validator are a double sign
+	ev, err := NewDoubleSignEvidence(vals.sealed(t, 0, 5, 1), vals.sealed(t, 0, 5, 2))
+	if err != nil {
+		t.Fatalf("failed to create evidence: %v", err)
+	}
+	if offender, number, err := ev.verify(nil); err != nil || offender != vals.addrs[0] || number != 5 {
+		t.Errorf("double sign mismatch: have %x/%d/%v, want %x/5/nil", offender, number, err, vals.addrs[0])
+	}
+	// Identical headers, different heights or different sealers are not
+	header := vals.sealed(t, 0, 5, 1)
+	for i, pair := range [][2]*types.Header{
+		{header, header},
+		{vals.sealed(t, 0, 5, 1), vals.sealed(t, 0, 6, 1)},
+		{vals.sealed(t, 0, 5, 1), vals.sealed(t, 1, 5, 2)},
+	} {
+		ev, _ := NewDoubleSignEvidence(pair[0], pair[1])
+		if _, _, err := ev.verify(nil); err == nil {
+			t.Errorf("pair %d: invalid double sign evidence accepted", i)
+		}
+	}
+	// Two ACKs for the same height on different blocks are an equivocation
+	ev, err = NewEquivocatingAckEvidence(vals.ack(t, 1, 7, common.Hash{0x01}), vals.ack(t, 1, 7, common.Hash{0x02}))
+	if err != nil {
+		t.Fatalf("failed to create evidence: %v", err)
+	}
+	if offender, number, err := ev.verify(nil); err != nil || offender != vals.addrs[1] || number != 7 {
+		t.Errorf("equivocation mismatch: have %x/%d/%v, want %x/7/nil", offender, number, err, vals.addrs[1])
+	}
+	ev, _ = NewEquivocatingAckEvidence(vals.ack(t, 0, 7, common.Hash{0x01}), vals.ack(t, 1, 7, common.Hash{0x02}))
+	if _, _, err := ev.verify(nil); err == nil {
+		t.Errorf("equivocation by distinct signers accepted")
+	}
+	// Re-encodings of a single sealed header are not a double sign
+	honest := vals.sealed(t, 0, 5, 1)
+	honest.AtomicTime = []byte{0x01, 0x02, 0x03}
+	retimed := types.CopyHeader(honest)
+	retimed.AtomicTime = []byte{0x04, 0x05, 0x06}
+	if honest.Hash() == retimed.Hash() {
+		t.Fatalf("retimed header has the same hash")
+	}
+	ev, _ = NewDoubleSignEvidence(honest, retimed)
+	if _, _, err := ev.verify(nil); err != errEvidenceNotConflict {
+		t.Errorf("retimed header error mismatch: have %v, want %v", err, errEvidenceNotConflict)
+	}
+	// Unknown evidence must be rejected
+	if _, _, err := (&Evidence{Type: 0xff}).verify(nil); err != errUnknownEvidence {
+		t.Errorf("unknown evidence error mismatch: have %v, want %v", err, errUnknownEvidence)
+	}
+}
+
+// Tests that evidence carried in a header slashes the offender exactly once and
+// demotes it once its score drops below the threshold.
+func TestEvidenceSlashingAndDemotion(t *testing.T) {
+	vals := newTestValidators(t, 3)
+	config := &params.PobConfig{Epoch: 1000, SlashFraction: 5000, DemotionThreshold: 2000}
+	snap := newTestSnapshot(config, vals.addrs)
+
+	doubleSign, _ := NewDoubleSignEvidence(vals.sealed(t, 2, 1, 1), vals.sealed(t, 2, 1, 2))
+	equivocation, _ := NewEquivocatingAckEvidence(vals.ack(t, 2, 1, common.Hash{0x01}), vals.ack(t, 2, 1, common.Hash{0x02}))
+
+	apply := func(number uint64, evidence ...*Evidence) {
+		t.Helper()
+		header := newTestHeader(number, snap.Hash, vals.addrs[0])
+		header.Evidence, _ = encodeEvidence(evidence)
+
+		var err error
+		if snap, err = snap.apply([]*types.Header{header}, behaviorForkConfig(0)); err != nil {
+			t.Fatalf("block %d: failed to apply header: %v", number, err)
+		}
+	}
+	// Double signing slashes the full fraction of the score
+	apply(1, doubleSign)
+	if have, want := snap.Validators[vals.addrs[2]].Total, defaultInitialScore/2; have != want {
+		t.Fatalf("slashed score mismatch: have %d, want %d", have, want)
+	}
+	if have := snap.Histories[vals.addrs[2]].SlashCount; have != 1 {
+		t.Fatalf("slash count mismatch: have %d, want 1", have)
+	}
+	// Resubmitting the same offence must be a noop
+	apply(2, doubleSign)
+	if have, want := snap.Validators[vals.addrs[2]].Total, defaultInitialScore/2; have != want {
+		t.Fatalf("replayed evidence slashed again: have %d, want %d", have, want)
+	}
+	// Equivocating ACKs are slashed at half severity, dropping below the threshold
+	apply(3, equivocation)
+	if _, ok := snap.Validators[vals.addrs[2]]; ok {
+		t.Fatalf("offender not demoted")
+	}
+	if _, ok := snap.Histories[vals.addrs[2]]; ok {
+		t.Fatalf("offender history not dropped")
+	}
+	if len(snap.Validators) != 2 {
+		t.Fatalf("validator count mismatch: have %d, want 2", len(snap.Validators))
+	}
+	// Stale evidence must be ignored
+	stale, _ := NewDoubleSignEvidence(vals.sealed(t, 1, 1, 1), vals.sealed(t, 1, 1, 2))
+	snap.Number = 1500
+	apply(1501, stale)
+	if have := snap.Histories[vals.addrs[1]].SlashCount; have != 0 {
+		t.Fatalf("stale evidence slashed validator")
+	}
+	if len(snap.Offences) != 0 {
+		t.Fatalf("stale offences not pruned: %d left", len(snap.Offences))
+	}
+}
+
+func TestEvidenceEncoding(t *testing.T) {
+	vals := newTestValidators(t, 1)
+
+	var evidence []*Evidence
+	for i := 0; i <= maxEvidencePerBlock; i++ {
+		ev, _ := NewEquivocatingAckEvidence(vals.ack(t, 0, uint64(i), common.Hash{0x01}), vals.ack(t, 0, uint64(i), common.Hash{0x02}))
+		evidence = append(evidence, ev)
+	}
+	blob, err := encodeEvidence(evidence[:maxEvidencePerBlock])
+	if err != nil {
+		t.Fatalf("failed to encode evidence: %v", err)
+	}
+	decoded, err := decodeEvidence(blob)
+	if err != nil {
+		t.Fatalf("failed to decode evidence: %v", err)
+	}
+	for i, ev := range decoded {
+		if ev.Hash() != evidence[i].Hash() {
+			t.Errorf("evidence %d: hash mismatch", i)
+		}
+	}
+	blob, _ = encodeEvidence(evidence)
+	if _, err := decodeEvidence(blob); err != errTooMuchEvidence {
+		t.Errorf("oversized evidence error mismatch: have %v, want %v", err, errTooMuchEvidence)
+	}
+	if blob, _ := encodeEvidence(nil); blob != nil {
+		t.Errorf("empty evidence encoded to %x", blob)
+	}
+}
+
+// Tests that evidence is neither included, accepted nor punished before the
+// behavior fork.
+func TestEvidenceFork(t *testing.T) {
+	vals := newTestValidators(t, 2)
+	doubleSign, _ := NewDoubleSignEvidence(vals.sealed(t, 1, 1, 1), vals.sealed(t, 1, 1, 2))
+	encoded, _ := encodeEvidence([]*Evidence{doubleSign})
+
+	// Snapshots only slash from the fork on
+	snap := newTestSnapshot(&params.PobConfig{Epoch: 1000, SlashFraction: 5000}, vals.addrs)
+	for _, tt := range []struct {
+		number uint64
+		score  uint64
+	}{{1, defaultInitialScore}, {2, defaultInitialScore / 2}} {
+		header := newTestHeader(tt.number, snap.Hash, vals.addrs[0])
+		header.Evidence = encoded
+
+		var err error
+		if snap, err = snap.apply([]*types.Header{header}, behaviorForkConfig(2)); err != nil {
+			t.Fatalf("block %d: failed to apply header: %v", tt.number, err)
+		}
+		if have := snap.Validators[vals.addrs[1]].Total; have != tt.score {
+			t.Errorf("block %d: score mismatch: have %d, want %d", tt.number, have, tt.score)
+		}
+	}
+	// Producers keep evidence queued until the fork
+	var list []common.Validator
+	for _, addr := range vals.addrs {
+		list = append(list, common.Validator{Owner: addr})
+	}
+	engine := New(&params.PobConfig{Epoch: 1000, ValidatorList: list}, rawdb.NewMemoryDatabase(), params.AllPobProtocolChanges)
+	engine.evidence[doubleSign.Hash()] = doubleSign
+
+	genesis := &types.Header{Number: big.NewInt(0), Difficulty: big.NewInt(1), GasLimit: 8000000}
+	chain := newTestChainReader(genesis)
+	chain.config = behaviorForkConfig(2)
+
+	header := newTestHeader(1, genesis.Hash(), vals.addrs[1])
+	header.GasLimit = 8000000
+	header.Extra = make([]byte, extraVanity+extraSeal)
+	if err := engine.Prepare(chain, header); err != nil {
+		t.Fatalf("failed to prepare header: %v", err)
+	}
+	if len(header.Evidence) != 0 || len(engine.evidence) != 1 {
+		t.Fatalf("evidence included before the fork")
+	}
+	// Headers carrying evidence before the fork are rejected
+	header.Evidence = encoded
+	sig, err := crypto.Sign(crypto.Keccak256(PobRLP(header)), vals.keys[1])
+	if err != nil {
+		t.Fatalf("failed to seal header: %v", err)
+	}
+	header.ValidatorSig = sig
+
+	_, results := engine.VerifyHeaders(chain, []*types.Header{header}, []bool{false})
+	if err := <-results; err != errEvidenceBeforeFork {
+		t.Fatalf("pre-fork evidence error mismatch: have %v, want %v", err, errEvidenceBeforeFork)
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"io"
 	"math/big"
 	"runtime"
+	"sort"
 	"sync"
 	"time"
 
@@ -106,6 +107,10 @@ var (
 	errUncleIsAncestor = errors.New("uncle is ancestor")
 	errDanglingUncle   = errors.New("uncle's parent is not ancestor")
 	errInvalidPoW      = errors.New("invalid proof-of-work")
+
+	errAckSignersBeforeFork  = errors.New("ACK signers in header before the PoB behavior fork")
+	errEvidenceBeforeFork    = errors.New("evidence in header before the PoB behavior fork")
+	errMismatchingAckSigners = errors.New("ACK signers do not match the ACKs in the block")
 )
 
 type Mode uint
@@ -168,11 +173,15 @@ type ProofOfBehavior struct {
 	recents    *lru.ARCCache // Snapshots for recent block to speed up reorgs
 	signatures *lru.ARCCache // Signatures of recent blocks to speed up mining
 
-	proposals map[common.Address]bool // Current list of proposals we are pushing
+	proposals     map[common.Address]bool          // Current list of proposals we are pushing
+	scoring       *params.PobScoringRule           // Scoring rule we are voting for, if any
+	evidence      map[common.Hash]*Evidence        // Pending misbehavior proofs to include in sealed headers
+	registrations map[common.Hash]*KeyRegistration // Pending Dilithium key registrations to include in sealed headers
 
-	signer common.Address // ProbeChain address of the signing key
-	signFn SignerFn       // Signer function to authorize hashes with
-	lock   sync.RWMutex   // Protects the signer fields
+	signer        common.Address                       // ProbeChain address of the signing key
+	signFn        SignerFn                             // Signer function to authorize hashes with
+	dilithiumKeys map[common.Hash]*dilithium.PrivateKey // Dilithium signing keys, keyed by public key hash
+	lock          sync.RWMutex                         // Protects the signer fields
 
 	// The fields below are for testing only
 	fakeDiff bool // Skip difficulty verifications
@@ -246,18 +255,35 @@ func New(config *params.PobConfig, db probedb.Database, chainConfig *params.Chai
 	if conf.DemotionThreshold == 0 {
 		conf.DemotionThreshold = 1000 // Default: score below 1000 demotes
 	}
+	if conf.BlockReward == nil {
+		conf.BlockReward = new(big.Int).Set(BlockRewardPobValidator)
+	}
+	if conf.AckRewardShare > maxScore {
+		conf.AckRewardShare = maxScore
+	}
+	conf.Scoring = nil
+	for _, rule := range config.Scoring {
+		if err := validateScoringRule(&rule); err != nil {
+			log.Error("Ignoring invalid PoB scoring rule", "block", rule.Block, "model", rule.Model, "err", err)
+			continue
+		}
+		conf.Scoring = append(conf.Scoring, rule)
+	}
 
 	recents, _ := lru.NewARC(inmemorySnapshots)
 	signatures, _ := lru.NewARC(inmemorySignatures)
 
 	return &ProofOfBehavior{
-		pobConfig:   &conf,
-		chainConfig: chainConfig,
-		db:          db,
-		agent:       NewBehaviorAgent(),
-		recents:     recents,
-		signatures:  signatures,
-		proposals:   make(map[common.Address]bool),
+		pobConfig:     &conf,
+		chainConfig:   chainConfig,
+		db:            db,
+		agent:         NewBehaviorAgent(),
+		recents:       recents,
+		signatures:    signatures,
+		proposals:     make(map[common.Address]bool),
+		evidence:      make(map[common.Hash]*Evidence),
+		registrations: make(map[common.Hash]*KeyRegistration),
+		dilithiumKeys: make(map[common.Hash]*dilithium.PrivateKey),
 	}
 }
 
@@ -280,7 +306,7 @@ func (c *ProofOfBehavior) VerifyHeader(chain consensus.ChainHeaderReader, header
 	if err != nil {
 		return err
 	}
-	return c.verifyHeader(chain, header, parent, false, seal, time.Now().Unix(), diff)
+	return c.verifyHeader(chain, header, parent, nil, false, seal, time.Now().Unix(), diff)
 }
 
 // FindRealParentHeader walks backwards through visual blocks to find the real parent.
@@ -375,17 +401,23 @@ func (c *ProofOfBehavior) verifyHeaderWorker(chain consensus.ChainHeaderReader,
 	if err != nil {
 		return err
 	}
-	return c.verifyHeader(chain, headers[index], parent, false, seals[index], unixNow, diff)
+	return c.verifyHeader(chain, headers[index], parent, headers[:index], false, seals[index], unixNow, diff)
 }
 
-// verifyHeader checks whether a header conforms to the consensus rules.
-func (c *ProofOfBehavior) verifyHeader(chain consensus.ChainHeaderReader, header, parent *types.Header, uncle bool, seal bool, unixNow int64, diff int64) error {
+// verifyHeader checks whether a header conforms to the consensus rules. The
+// caller may optionally pass in a batch of parents (ascending order) to avoid
+// looking those up from the database when verifying checkpoint commitments.
+func (c *ProofOfBehavior) verifyHeader(chain consensus.ChainHeaderReader, header, parent *types.Header, parents []*types.Header, uncle bool, seal bool, unixNow int64, diff int64) error {
 	log.Trace("pob verifyHeader", "block number", header.Number, "seal", seal)
 
 	// Verify the ValidatorSig matches ValidatorAddr
-	addr, err := c.RecoverOwner(header)
-	if err != nil || addr != header.ValidatorAddr {
-		return fmt.Errorf("ValidatorAddr err : %s > %s", addr.String(), header.ValidatorAddr.String())
+	snap, err := c.verifySeal(chain, header, parents)
+	if err != nil {
+		return err
+	}
+	var keys map[common.Address][]byte
+	if snap != nil {
+		keys = snap.PubKeys
 	}
 
 	// Ensure that the extra-data contains behavior data on checkpoint, but none otherwise
@@ -398,6 +430,11 @@ func (c *ProofOfBehavior) verifyHeader(chain consensus.ChainHeaderReader, header
 	if !checkpoint && behaviorDataLen != 0 {
 		return errExtraValidators
 	}
+	if checkpoint && !header.IsVisual() && chain.Config().IsPobBehavior(header.Number) {
+		if err := c.verifyCheckpoint(chain, header, parents); err != nil {
+			return err
+		}
+	}
 
 	// Verify the header's timestamp
 	if !uncle {
@@ -452,6 +489,36 @@ func (c *ProofOfBehavior) verifyHeader(chain consensus.ChainHeaderReader, header
 
 	// In PoB, behavior proofs are verified separately; no PoW seal check needed.
 
+	// ACK signers are only committed to from the behavior fork on, they are
+	// checked against the ACKs once the body is available
+	if len(header.AckSigners) > 0 && !chain.Config().IsPobBehavior(header.Number) {
+		return errAckSignersBeforeFork
+	}
+
+	// Any misbehavior evidence carried by the header must be a valid proof,
+	// and is only punished from the behavior fork on
+	if len(header.Evidence) > 0 && !chain.Config().IsPobBehavior(header.Number) {
+		return errEvidenceBeforeFork
+	}
+	if len(header.Evidence) > 0 {
+		evidence, err := decodeEvidence(header.Evidence)
+		if err != nil {
+			return fmt.Errorf("invalid evidence encoding: %v", err)
+		}
+		for _, ev := range evidence {
+			if _, _, err := ev.verify(keys); err != nil {
+				return fmt.Errorf("invalid evidence %x: %v", ev.Hash(), err)
+			}
+		}
+	}
+
+	// Any key registrations must be valid against the keys registered so far
+	if len(header.KeyRegistrations) > 0 && snap != nil {
+		if err := snap.copy().applyKeyRegistrations(header); err != nil {
+			return fmt.Errorf("invalid key registration: %v", err)
+		}
+	}
+
 	// Optional AtomicTime validation: if present, verify it is well-formed
 	// and not unreasonably far from the header timestamp. Don't reject blocks
 	// without AtomicTime for backward compatibility.
@@ -473,6 +540,60 @@ func (c *ProofOfBehavior) verifyHeader(chain consensus.ChainHeaderReader, header
 	return nil
 }
 
+// verifySeal checks that the header was sealed by its declared validator. From
+// the Dilithium fork on, validators that registered an ML-DSA-44 key must seal
+// with it, verified against the key in the parent snapshot, which is returned.
+// Before the fork, or in fake mode, the returned snapshot is nil.
+func (c *ProofOfBehavior) verifySeal(chain consensus.ChainHeaderReader, header *types.Header, parents []*types.Header) (*Snapshot, error) {
+	fork := chain.Config().IsDilithium(header.Number)
+	if !fork && (len(header.ValidatorSig) == dilithium.SignatureSize || len(header.KeyRegistrations) > 0) {
+		return nil, errDilithiumBeforeFork
+	}
+	var (
+		snap *Snapshot
+		keys map[common.Address][]byte
+	)
+	if fork && c.config.PowMode != ModeFake {
+		var err error
+		if snap, err = c.snapshot(chain, header.Number.Uint64()-1, header.ParentHash, parents); err != nil {
+			return nil, err
+		}
+		keys = snap.PubKeys
+	}
+	addr, err := sealSigner(header, keys)
+	if err != nil || addr != header.ValidatorAddr {
+		return nil, fmt.Errorf("ValidatorAddr err : %s > %s", addr.String(), header.ValidatorAddr.String())
+	}
+	if _, ok := keys[addr]; ok && len(header.ValidatorSig) != dilithium.SignatureSize {
+		return nil, errDilithiumSealRequired
+	}
+	return snap, nil
+}
+
+// verifyCheckpoint checks that the validator set commitment carried by a
+// checkpoint header matches the snapshot it was sealed on top of. Checkpoints
+// only carry the commitment from the PoB behavior fork on.
+func (c *ProofOfBehavior) verifyCheckpoint(chain consensus.ChainHeaderReader, header *types.Header, parents []*types.Header) error {
+	if c.config.PowMode == ModeFake {
+		return nil
+	}
+	if len(header.Extra) <= extraVanity+extraSeal {
+		return errInvalidCheckpointValidators
+	}
+	data, err := decodeBehaviorData(header.Extra[extraVanity : len(header.Extra)-extraSeal])
+	if err != nil {
+		return err
+	}
+	snap, err := c.snapshot(chain, header.Number.Uint64()-1, header.ParentHash, parents)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data.encode(), encodeBehaviorData(snap)) {
+		return errMismatchingCheckpointValidators
+	}
+	return nil
+}
+
 // VerifyUncles implements consensus.Engine.
 func (c *ProofOfBehavior) VerifyUncles(chain consensus.ChainReader, block *types.Block) error {
 	if len(block.Uncles()) > 0 {
@@ -521,10 +642,44 @@ func (c *ProofOfBehavior) VerifyValidatorInfo(chain consensus.ChainReader, block
 	if !chain.CheckAcks(block) {
 		return fmt.Errorf("acks not legal")
 	}
-
+	if chain.Config().IsPobBehavior(block.Number()) && c.config.PowMode != ModeFake && c.config.PowMode != ModeFullFake {
+		signers, err := c.AckSigners(chain, block.Header(), block.Acks())
+		if err != nil {
+			return err
+		}
+		if !sameAddresses(signers, block.Header().AckSigners) {
+			return errMismatchingAckSigners
+		}
+	}
 	return nil
 }
 
+// AckSigners returns the validators whose ACKs are carried in the block with
+// the given header, in ascending order, as committed to by the header's
+// AckSigners from the PoB behavior fork on. Before the fork it returns nil.
+func (c *ProofOfBehavior) AckSigners(chain consensus.ChainHeaderReader, header *types.Header, acks []*types.Ack) ([]common.Address, error) {
+	if !chain.Config().IsPobBehavior(header.Number) {
+		return nil, nil
+	}
+	snap, err := c.snapshot(chain, header.Number.Uint64()-1, header.ParentHash, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ackWitnesses(snap, acks), nil
+}
+
+func sameAddresses(a, b []common.Address) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // snapshot retrieves the authorization snapshot at a given point in time.
 func (c *ProofOfBehavior) snapshot(chain consensus.ChainHeaderReader, number uint64, hash common.Hash, parents []*types.Header) (*Snapshot, error) {
 	var (
@@ -539,7 +694,7 @@ func (c *ProofOfBehavior) snapshot(chain consensus.ChainHeaderReader, number uin
 		}
 		// If an on-disk checkpoint snapshot can be found, use that
 		if number%checkpointInterval == 0 {
-			if s, err := loadSnapshot(c.pobConfig, c.signatures, c.db, hash); err == nil {
+			if s, err := loadSnapshot(c.pobConfig, c.signatures, c.agent, c.db, number, hash); err == nil {
 				log.Trace("Loaded voting snapshot from disk", "number", number, "hash", hash)
 				snap = s
 				break
@@ -556,7 +711,7 @@ func (c *ProofOfBehavior) snapshot(chain consensus.ChainHeaderReader, number uin
 			for _, v := range c.pobConfig.ValidatorList {
 				validators = append(validators, v.Owner)
 			}
-			snap = newSnapshot(c.pobConfig, c.signatures, 0, genesis.Hash(), validators)
+			snap = newSnapshot(c.pobConfig, c.signatures, c.agent, 0, genesis.Hash(), validators)
 			if err := snap.store(c.db); err != nil {
 				return nil, err
 			}
@@ -584,7 +739,7 @@ func (c *ProofOfBehavior) snapshot(chain consensus.ChainHeaderReader, number uin
 	for i := 0; i < len(headers)/2; i++ {
 		headers[i], headers[len(headers)-1-i] = headers[len(headers)-1-i], headers[i]
 	}
-	snap, err := snap.apply(headers)
+	snap, err := snap.apply(headers, chain.Config())
 	if err != nil {
 		return nil, err
 	}
@@ -601,15 +756,268 @@ func (c *ProofOfBehavior) snapshot(chain consensus.ChainHeaderReader, number uin
 }
 
 // Prepare implements consensus.Engine, preparing all the consensus fields of the
-// header for running the transactions on top.
+// header for running the transactions on top. From the PoB behavior fork on,
+// checkpoint headers get the validator set commitment of their parent
+// snapshot. Any pending misbehavior evidence that has not been punished yet
+// is attached to the header, and the scoring rule voted for is written into
+// the extra-data vanity.
 func (c *ProofOfBehavior) Prepare(chain consensus.ChainHeaderReader, header *types.Header) error {
+	if c.config.PowMode == ModeFake || c.config.PowMode == ModeFullFake {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	number := header.Number.Uint64()
+	if number%c.pobConfig.Epoch != 0 && len(c.evidence) == 0 && len(c.registrations) == 0 && c.scoring == nil {
+		return nil
+	}
+	snap, err := c.snapshot(chain, number-1, header.ParentHash, nil)
+	if err != nil {
+		return err
+	}
+	if number%c.pobConfig.Epoch == 0 && !header.IsVisual() && chain.Config().IsPobBehavior(header.Number) {
+		data := encodeBehaviorData(snap)
+		extra := make([]byte, extraVanity, extraVanity+len(data)+extraSeal)
+		copy(extra, header.Extra)
+		extra = append(extra, data...)
+		header.Extra = append(extra, make([]byte, extraSeal)...)
+	}
+	// Vote for our scoring rule until the validators put it into effect
+	if c.scoring != nil && snap.Scoring != nil && sameScoringRule(c.scoring, snap.Scoring) {
+		c.scoring = nil
+	}
+	if c.scoring != nil {
+		if len(header.Extra) < extraVanity+extraSeal {
+			extra := make([]byte, extraVanity+extraSeal)
+			copy(extra, header.Extra)
+			header.Extra = extra
+		}
+		copy(header.Extra, encodeScoringVote(c.scoring))
+	}
+	// Evidence is only included from the behavior fork on, it stays queued until then
+	var included []*Evidence
+	if chain.Config().IsPobBehavior(header.Number) {
+		for hash, ev := range c.evidence {
+			offender, height, err := ev.verify(snap.PubKeys)
+			if err != nil || height+c.pobConfig.Epoch < number {
+				delete(c.evidence, hash)
+				continue
+			}
+			if _, ok := snap.Validators[offender]; !ok {
+				delete(c.evidence, hash)
+				continue
+			}
+			if _, ok := snap.Offences[offenceKey(offender, height, ev.Type)]; ok {
+				delete(c.evidence, hash)
+				continue
+			}
+			if len(included) < maxEvidencePerBlock {
+				included = append(included, ev)
+			}
+		}
+	}
+	if header.Evidence, err = encodeEvidence(included); err != nil {
+		return err
+	}
+	if chain.Config().IsDilithium(header.Number) {
+		header.KeyRegistrations, err = encodeKeyRegistrations(c.pendingKeyRegistrations(snap))
+	}
+	return err
+}
+
+// pendingKeyRegistrations returns the queued key registrations that are valid
+// on top of the given snapshot, dropping the ones that never will be again.
+// At most one registration is returned per validator.
+func (c *ProofOfBehavior) pendingKeyRegistrations(snap *Snapshot) []*KeyRegistration {
+	var (
+		included []*KeyRegistration
+		seen     = make(map[common.Address]bool)
+	)
+	for hash, reg := range c.registrations {
+		if _, ok := snap.Validators[reg.Validator]; !ok {
+			delete(c.registrations, hash)
+			continue
+		}
+		if err := reg.verify(snap.PubKeys[reg.Validator]); err != nil {
+			delete(c.registrations, hash)
+			continue
+		}
+		if !seen[reg.Validator] && len(included) < maxKeyRegistrationsPerBlock {
+			seen[reg.Validator] = true
+			included = append(included, reg)
+		}
+	}
+	sort.Slice(included, func(i, j int) bool {
+		return bytes.Compare(included[i].Validator[:], included[j].Validator[:]) < 0
+	})
+	return included
+}
+
+// ProposeScoring makes the local validator vote for the given scoring rule in
+// the blocks it seals, until a majority of the validators put it into effect.
+func (c *ProofOfBehavior) ProposeScoring(rule *params.PobScoringRule) error {
+	if err := validateScoringRule(rule); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cpy := *rule
+	c.scoring = &cpy
+	return nil
+}
+
+// DiscardScoring stops voting for the currently proposed scoring rule.
+func (c *ProofOfBehavior) DiscardScoring() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.scoring = nil
+}
+
+// SubmitEvidence verifies a proof of validator misbehavior and queues it for
+// inclusion into the next locally sealed block.
+func (c *ProofOfBehavior) SubmitEvidence(chain consensus.ChainHeaderReader, ev *Evidence) error {
+	keys, err := c.currentKeys(chain)
+	if err != nil {
+		return err
+	}
+	if _, _, err := ev.verify(keys); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.evidence[ev.Hash()] = ev
 	return nil
 }
 
-// accumulateRewards distributes rewards proportional to behavior scores.
-func accumulateRewards(config *params.ChainConfig, statedb *state.StateDB, header *types.Header, powUncles []*types.BehaviorProof) {
-	// Base reward to the PoB validator
+// SubmitKeyRegistration verifies a Dilithium key registration against the keys
+// registered at the chain head and queues it for inclusion into the next locally
+// sealed block.
+func (c *ProofOfBehavior) SubmitKeyRegistration(chain consensus.ChainHeaderReader, reg *KeyRegistration) error {
+	keys, err := c.currentKeys(chain)
+	if err != nil {
+		return err
+	}
+	if err := reg.verify(keys[reg.Validator]); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.registrations[reg.Hash()] = reg
+	return nil
+}
+
+// RegisterDilithiumKey authorizes the engine to sign with the given Dilithium
+// key and queues its registration for the local validator. The registration is
+// authorized by the currently registered Dilithium key of the validator, or by
+// its ECDSA account if none is registered yet.
+func (c *ProofOfBehavior) RegisterDilithiumKey(chain consensus.ChainHeaderReader, key *dilithium.PrivateKey) (*KeyRegistration, error) {
+	keys, err := c.currentKeys(chain)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.RLock()
+	signer, signFn := c.signer, c.signFn
+	c.lock.RUnlock()
+
+	current := keys[signer]
+	reg := NewKeyRegistration(signer, current, key)
+	if len(current) > 0 {
+		priv := c.dilithiumKey(current)
+		if priv == nil {
+			return nil, errNoDilithiumKey
+		}
+		digest := KeyRegistrationDigest(signer, current, reg.PubKey)
+		reg.Auth = dilithium.Sign(priv, digest[:])
+	} else {
+		if signFn == nil {
+			return nil, errUnauthorizedValidator
+		}
+		if reg.Auth, err = signFn(accounts.Account{Address: signer}, accounts.MimetypeDataWithValidator, keyRegistrationPayload(signer, current, reg.PubKey)); err != nil {
+			return nil, err
+		}
+	}
+	c.AuthorizeDilithium(key)
+	if err := c.SubmitKeyRegistration(chain, reg); err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
+// currentKeys returns the Dilithium keys registered at the chain head.
+func (c *ProofOfBehavior) currentKeys(chain consensus.ChainHeaderReader) (map[common.Address][]byte, error) {
+	if c.recents == nil {
+		return nil, nil
+	}
+	head := chain.CurrentHeader()
+	if head == nil {
+		return nil, errUnknownBlock
+	}
+	snap, err := c.snapshot(chain, head.Number.Uint64(), head.Hash(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return snap.PubKeys, nil
+}
+
+// accumulateRewards distributes rewards proportional to behavior scores. The
+// block reward is split between the producer and the ACK witnesses of the block,
+// each portion being scaled by the recipient's behavior score in the parent
+// snapshot. Whatever is withheld is credited to the treasury, if configured.
+// A nil snapshot pays every recipient as if it had a perfect score.
+func accumulateRewards(config *params.PobConfig, statedb *state.StateDB, header *types.Header, powUncles []*types.BehaviorProof, snap *Snapshot, witnesses []common.Address) {
+	base := config.BlockReward
+	if base == nil {
+		base = BlockRewardPobValidator
+	}
+	var (
+		witnessPool  = new(big.Int)
+		producerPool = new(big.Int).Set(base)
+		paid         = new(big.Int)
+	)
+	if len(witnesses) > 0 {
+		witnessPool.Mul(base, new(big.Int).SetUint64(config.AckRewardShare))
+		witnessPool.Div(witnessPool, new(big.Int).SetUint64(maxScore))
+		producerPool.Sub(producerPool, witnessPool)
+	}
+	// Reward the producer and the witnesses according to their behavior
+	if reward := scaleReward(producerPool, rewardScore(snap, header.ValidatorAddr)); reward.Sign() > 0 {
+		statedb.AddBalance(header.ValidatorAddr, reward)
+		paid.Add(paid, reward)
+	}
+
+	if len(witnesses) > 0 {
+		share := new(big.Int).Div(witnessPool, big.NewInt(int64(len(witnesses))))
+		for _, witness := range witnesses {
+			if reward := scaleReward(share, rewardScore(snap, witness)); reward.Sign() > 0 {
+				statedb.AddBalance(witness, reward)
+				paid.Add(paid, reward)
+			}
+		}
+	}
+	// Send anything withheld to the treasury
+	if config.Treasury != (common.Address{}) {
+		if withheld := new(big.Int).Sub(base, paid); withheld.Sign() > 0 {
+			statedb.AddBalance(config.Treasury, withheld)
+		}
+	}
+	accumulatePowRewards(statedb, header, powUncles)
+}
+
+// accumulateFlatRewards pays the producer the flat validator reward, as
+// blocks before the behavior fork were rewarded.
+func accumulateFlatRewards(statedb *state.StateDB, header *types.Header, powUncles []*types.BehaviorProof) {
 	statedb.AddBalance(header.ValidatorAddr, new(big.Int).Set(BlockRewardPobValidator))
+	accumulatePowRewards(statedb, header, powUncles)
+}
+
+// accumulatePowRewards pays the miners of the behavior proofs of a block and
+// of its behavior proof uncles.
+func accumulatePowRewards(statedb *state.StateDB, header *types.Header, powUncles []*types.BehaviorProof) {
 	// Rewards for PoW miners
 	for _, answer := range header.BehaviorProofs {
 		statedb.AddBalance(answer.Miner, new(big.Int).Set(BlockRewardPowMiner))
@@ -620,10 +1028,76 @@ func accumulateRewards(config *params.ChainConfig, statedb *state.StateDB, heade
 	}
 }
 
+// rewardScore returns the behavior score a reward should be scaled by.
+func rewardScore(snap *Snapshot, addr common.Address) uint64 {
+	if snap == nil {
+		return maxScore
+	}
+	if score, ok := snap.Validators[addr]; ok {
+		return score.Total
+	}
+	return 0
+}
+
+// scaleReward scales a reward by a behavior score expressed in basis points.
+func scaleReward(reward *big.Int, score uint64) *big.Int {
+	if score > maxScore {
+		score = maxScore
+	}
+	scaled := new(big.Int).Mul(reward, new(big.Int).SetUint64(score))
+	return scaled.Div(scaled, new(big.Int).SetUint64(maxScore))
+}
+
+// ackWitnesses returns the distinct validators that signed the given acks, in
+// ascending order. If a snapshot is given, non-validators are filtered out.
+func ackWitnesses(snap *Snapshot, acks []*types.Ack) []common.Address {
+	var keys map[common.Address][]byte
+	if snap != nil {
+		keys = snap.PubKeys
+	}
+	seen := make(map[common.Address]struct{}, len(acks))
+	witnesses := make([]common.Address, 0, len(acks))
+	for _, ack := range acks {
+		signer, err := ackSigner(ack, keys)
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[signer]; ok {
+			continue
+		}
+		if snap != nil {
+			if _, ok := snap.Validators[signer]; !ok {
+				continue
+			}
+		}
+		seen[signer] = struct{}{}
+		witnesses = append(witnesses, signer)
+	}
+	sort.Sort(validatorsAscending(witnesses))
+	return witnesses
+}
+
 // PobFinalize runs post-transaction state modifications including behavior-score-weighted rewards.
-func (c *ProofOfBehavior) PobFinalize(chain consensus.ChainHeaderReader, header *types.Header, statedb *state.StateDB, txs []*types.Transaction, powUncles []*types.BehaviorProof) {
-	accumulateRewards(chain.Config(), statedb, header, powUncles)
+// Blocks before the behavior fork are paid the flat validator reward. From
+// the fork on the rewards depend on the parent snapshot, so failing to
+// retrieve it fails the block rather than paying out rewards every other node
+// would disagree on.
+func (c *ProofOfBehavior) PobFinalize(chain consensus.ChainHeaderReader, header *types.Header, statedb *state.StateDB, txs []*types.Transaction, powUncles []*types.BehaviorProof, acks []*types.Ack) error {
+	if !chain.Config().IsPobBehavior(header.Number) {
+		accumulateFlatRewards(statedb, header, powUncles)
+		header.Root = statedb.IntermediateRoot(chain.Config().IsEIP158(header.Number))
+		return nil
+	}
+	var snap *Snapshot
+	if c.config.PowMode != ModeFake && c.config.PowMode != ModeFullFake {
+		var err error
+		if snap, err = c.snapshot(chain, header.Number.Uint64()-1, header.ParentHash, nil); err != nil {
+			return fmt.Errorf("failed to retrieve PoB snapshot for rewards: %w", err)
+		}
+	}
+	accumulateRewards(c.pobConfig, statedb, header, powUncles, snap, ackWitnesses(snap, acks))
 	header.Root = statedb.IntermediateRoot(chain.Config().IsEIP158(header.Number))
+	return nil
 }
 
 // Finalize implements consensus.Engine.
@@ -646,6 +1120,47 @@ func (c *ProofOfBehavior) Authorize(signer common.Address, signFn SignerFn) {
 	c.signFn = signFn
 }
 
+// AuthorizeDilithium injects a Dilithium private key into the consensus engine.
+// Once its public key is registered for the local validator, it is used to seal
+// blocks and sign ACKs from the Dilithium fork on.
+func (c *ProofOfBehavior) AuthorizeDilithium(key *dilithium.PrivateKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.dilithiumKeys == nil {
+		c.dilithiumKeys = make(map[common.Hash]*dilithium.PrivateKey)
+	}
+	c.dilithiumKeys[crypto.Keccak256Hash(dilithium.MarshalPublicKey(key.Public()))] = key
+}
+
+// dilithiumKey returns the authorized private key of a registered public key.
+func (c *ProofOfBehavior) dilithiumKey(pubkey []byte) *dilithium.PrivateKey {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.dilithiumKeys[crypto.Keccak256Hash(pubkey)]
+}
+
+// signingKey returns the Dilithium key the local validator must sign with at
+// the given snapshot, or nil if it still signs with its ECDSA key.
+func (c *ProofOfBehavior) signingKey(chain consensus.ChainHeaderReader, number uint64, snap *Snapshot) (*dilithium.PrivateKey, error) {
+	if !chain.Config().IsDilithium(new(big.Int).SetUint64(number)) || snap == nil {
+		return nil, nil
+	}
+	c.lock.RLock()
+	signer := c.signer
+	c.lock.RUnlock()
+
+	pubkey, ok := snap.PubKeys[signer]
+	if !ok {
+		return nil, nil
+	}
+	if key := c.dilithiumKey(pubkey); key != nil {
+		return key, nil
+	}
+	return nil, errNoDilithiumKey
+}
+
 // Seal implements consensus.Engine, signing the block with the validator's key.
 func (c *ProofOfBehavior) Seal(chain consensus.ChainHeaderReader, block *types.Block, results chan<- *types.Block, stop <-chan struct{}) error {
 	header := block.Header()
@@ -654,8 +1169,28 @@ func (c *ProofOfBehavior) Seal(chain consensus.ChainHeaderReader, block *types.B
 		return errUnknownBlock
 	}
 
+	// Validators with a registered Dilithium key must seal with it
+	var snap *Snapshot
+	if chain.Config().IsDilithium(header.Number) && c.recents != nil {
+		var err error
+		if snap, err = c.snapshot(chain, number-1, header.ParentHash, nil); err != nil {
+			return err
+		}
+	}
+	key, err := c.signingKey(chain, number, snap)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		block.SetValidatorSig(dilithium.Sign(key, crypto.Keccak256(PobRLP(header))))
+		return nil
+	}
 	// Sign the block
-	sighash, err := c.signFn(accounts.Account{Address: c.signer}, accounts.MimetypeDataWithValidator, PobRLP(header))
+	c.lock.RLock()
+	signer, signFn := c.signer, c.signFn
+	c.lock.RUnlock()
+
+	sighash, err := signFn(accounts.Account{Address: signer}, accounts.MimetypeDataWithValidator, PobRLP(header))
 	if err != nil {
 		return err
 	}
@@ -663,15 +1198,48 @@ func (c *ProofOfBehavior) Seal(chain consensus.ChainHeaderReader, block *types.B
 	return nil
 }
 
-// AckSig signs a PoB acknowledgment.
-func (c *ProofOfBehavior) AckSig(ack *types.Ack) ([]byte, error) {
-	sighash, err := c.signFn(accounts.Account{Address: c.signer}, accounts.MimetypeDataWithValidator, PobAckRLP(ack))
+// AckSig signs a PoB acknowledgment. From the Dilithium fork on, validators with
+// a registered Dilithium key sign with it, prefixing the signature with their
+// address as the signer cannot be recovered from it.
+func (c *ProofOfBehavior) AckSig(chain consensus.ChainHeaderReader, ack *types.Ack) ([]byte, error) {
+	var snap *Snapshot
+	if chain.Config().IsDilithium(ack.Number) && c.recents != nil {
+		head := chain.CurrentHeader()
+		var err error
+		if snap, err = c.snapshot(chain, head.Number.Uint64(), head.Hash(), nil); err != nil {
+			return nil, err
+		}
+	}
+	key, err := c.signingKey(chain, ack.Number.Uint64(), snap)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.RLock()
+	signer, signFn := c.signer, c.signFn
+	c.lock.RUnlock()
+
+	if key != nil {
+		sig := make([]byte, 0, dilithiumAckSigLen)
+		sig = append(sig, signer[:]...)
+		return append(sig, dilithium.Sign(key, crypto.Keccak256(PobAckRLP(ack)))...), nil
+	}
+	sighash, err := signFn(accounts.Account{Address: signer}, accounts.MimetypeDataWithValidator, PobAckRLP(ack))
 	if err != nil {
 		return nil, err
 	}
 	return sighash, nil
 }
 
+// AckSigner returns the validator that signed an ack, verifying Dilithium
+// signatures against the keys registered at the chain head.
+func (c *ProofOfBehavior) AckSigner(chain consensus.ChainHeaderReader, ack *types.Ack) (common.Address, error) {
+	keys, err := c.currentKeys(chain)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return ackSigner(ack, keys)
+}
+
 // CalcDifficulty is the difficulty adjustment algorithm.
 // In PoB, difficulty reflects behavior score: higher score -> lower difficulty (in-turn).
 func (c *ProofOfBehavior) CalcDifficulty(chain consensus.ChainHeaderReader, time uint64, parent *types.Header) *big.Int {
@@ -708,6 +1276,11 @@ func (c *ProofOfBehavior) APIs(chain consensus.ChainHeaderReader) []rpc.API {
 // RecoverOwner recovers the signer address from the ValidatorSig.
 // Supports both ECDSA (65-byte sig) and Dilithium (pubkey+sig) signatures.
 func (c *ProofOfBehavior) RecoverOwner(header *types.Header) (common.Address, error) {
+	return recoverValidator(header)
+}
+
+// recoverValidator recovers the signer address from the ValidatorSig of a header.
+func recoverValidator(header *types.Header) (common.Address, error) {
 	sigLen := len(header.ValidatorSig)
 	dilithiumSigLen := dilithium.PublicKeySize + dilithium.SignatureSize // 1312 + 2420 = 3732
 
@@ -777,6 +1350,13 @@ func encodeSigHeader(w io.Writer, header *types.Header) {
 	if header.BaseFee != nil {
 		enc = append(enc, header.BaseFee)
 	}
+	if len(header.AckSigners) > 0 {
+		enc = append(enc, header.Evidence, header.KeyRegistrations, header.AckSigners)
+	} else if len(header.KeyRegistrations) > 0 {
+		enc = append(enc, header.Evidence, header.KeyRegistrations)
+	} else if len(header.Evidence) > 0 {
+		enc = append(enc, header.Evidence)
+	}
 	if err := rlp.Encode(w, enc); err != nil {
 		panic("can't encode: " + err.Error())
 	}
@@ -0,0 +1,140 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package pob
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/core/rawdb"
+	"github.com/probechain/go-probe/core/state"
+	"github.com/probechain/go-probe/core/types"
+	"github.com/probechain/go-probe/params"
+)
+
+func newTestState(t *testing.T) *state.StateDB {
+	t.Helper()
+	statedb, err := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	if err != nil {
+		t.Fatalf("failed to create state: %v", err)
+	}
+	return statedb
+}
+
+// Tests that block rewards are scaled by the behavior scores of the producer
+// and the ACK witnesses, with the withheld portion sent to the treasury.
+func TestScoreWeightedRewards(t *testing.T) {
+	vals := newTestValidators(t, 3)
+	treasury := common.HexToAddress("0x7777777777777777777777777777777777777777")
+	config := &params.PobConfig{
+		Epoch:          1000,
+		BlockReward:    big.NewInt(1000000),
+		AckRewardShare: 2000, // 20% to witnesses
+		Treasury:       treasury,
+	}
+	snap := newTestSnapshot(config, vals.addrs)
+	snap.Validators[vals.addrs[0]].Total = 8000
+	snap.Validators[vals.addrs[1]].Total = 10000
+	snap.Validators[vals.addrs[2]].Total = 2500
+
+	header := newTestHeader(1, common.Hash{}, vals.addrs[0])
+	acks := []*types.Ack{
+		vals.ack(t, 1, 0, common.Hash{}),
+		vals.ack(t, 2, 0, common.Hash{}),
+		vals.ack(t, 2, 0, common.Hash{}), // duplicate witness, paid once
+	}
+	statedb := newTestState(t)
+	accumulateRewards(config, statedb, header, nil, snap, ackWitnesses(snap, acks))
+
+	// Producer: 800000 * 80% = 640000
+	// Witnesses: 100000 * 100% = 100000 and 100000 * 25% = 25000
+	// Treasury: 1000000 - 765000 = 235000
+	expected := newTestState(t)
+	expected.AddBalance(vals.addrs[0], big.NewInt(640000))
+	expected.AddBalance(vals.addrs[1], big.NewInt(100000))
+	expected.AddBalance(vals.addrs[2], big.NewInt(25000))
+	expected.AddBalance(treasury, big.NewInt(235000))
+
+	for _, addr := range append(vals.addrs, treasury) {
+		if have, want := statedb.GetBalance(addr), expected.GetBalance(addr); have.Cmp(want) != 0 {
+			t.Errorf("%x: balance mismatch: have %v, want %v", addr, have, want)
+		}
+	}
+	if have, want := statedb.IntermediateRoot(true), expected.IntermediateRoot(true); have != want {
+		t.Errorf("state root mismatch: have %x, want %x", have, want)
+	}
+}
+
+// Tests that without witnesses, a snapshot or a treasury the producer is paid
+// according to its score and nothing else is minted.
+func TestProducerOnlyRewards(t *testing.T) {
+	vals := newTestValidators(t, 2)
+	config := &params.PobConfig{Epoch: 1000, BlockReward: big.NewInt(1000000), AckRewardShare: 2000}
+	snap := newTestSnapshot(config, vals.addrs)
+	snap.Validators[vals.addrs[0]].Total = 5000
+
+	header := newTestHeader(1, common.Hash{}, vals.addrs[0])
+
+	// Scored producer without witnesses gets the whole reward, scaled
+	statedb := newTestState(t)
+	accumulateRewards(config, statedb, header, nil, snap, nil)
+
+	expected := newTestState(t)
+	expected.AddBalance(vals.addrs[0], big.NewInt(500000))
+	if have, want := statedb.IntermediateRoot(true), expected.IntermediateRoot(true); have != want {
+		t.Errorf("state root mismatch: have %x, want %x", have, want)
+	}
+	// Missing snapshot pays the flat reward
+	statedb = newTestState(t)
+	accumulateRewards(config, statedb, header, nil, nil, nil)
+
+	expected = newTestState(t)
+	expected.AddBalance(vals.addrs[0], big.NewInt(1000000))
+	if have, want := statedb.IntermediateRoot(true), expected.IntermediateRoot(true); have != want {
+		t.Errorf("state root mismatch: have %x, want %x", have, want)
+	}
+	// Unknown producers are not rewarded at all
+	header = newTestHeader(1, common.Hash{}, common.HexToAddress("0xdead"))
+	statedb = newTestState(t)
+	accumulateRewards(config, statedb, header, nil, snap, nil)
+
+	if have, want := statedb.IntermediateRoot(true), newTestState(t).IntermediateRoot(true); have != want {
+		t.Errorf("state root mismatch: have %x, want %x", have, want)
+	}
+}
+
+// Tests that blocks before the behavior fork pay the producer the flat
+// validator reward, and the configured, scaled reward from the fork on.
+func TestRewardsFork(t *testing.T) {
+	producer := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	engine := NewFaker()
+	engine.pobConfig.BlockReward = big.NewInt(1000000)
+
+	chain := newTestChainReader()
+	chain.config = behaviorForkConfig(2)
+
+	for number, want := range map[uint64]*big.Int{1: BlockRewardPobValidator, 2: big.NewInt(1000000)} {
+		statedb := newTestState(t)
+		if err := engine.PobFinalize(chain, newTestHeader(number, common.Hash{}, producer), statedb, nil, nil, nil); err != nil {
+			t.Fatalf("block %d: failed to finalize: %v", number, err)
+		}
+		if have := statedb.GetBalance(producer); have.Cmp(want) != 0 {
+			t.Errorf("block %d: reward mismatch: have %v, want %v", number, have, want)
+		}
+	}
+}
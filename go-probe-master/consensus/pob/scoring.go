@@ -0,0 +1,299 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package pob
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/params"
+)
+
+// Names of the supported scoring models.
+const (
+	ScoringModelDefault = "default" // Lifetime history ratios
+	ScoringModelDecayed = "decayed" // Exponentially decayed history ratios
+)
+
+const (
+	// windowUnit is the fixed point scale of the decayed history counters, so
+	// that decaying small counts does not immediately round them down to zero.
+	windowUnit = 1000
+
+	// scoringVoteLen is the length of a scoring rule vote in the extra-data
+	// vanity: magic, model, five weights and the big endian decay.
+	scoringVoteLen = 4 + 1 + 5 + 2
+)
+
+// scoringVoteMagic marks the extra-data vanity of a header as carrying a vote
+// for a scoring rule.
+var scoringVoteMagic = []byte("PoBs")
+
+// scoringModelIDs maps the scoring models to their identifier in votes.
+var scoringModelIDs = []string{ScoringModelDefault, ScoringModelDecayed}
+
+var errInvalidScoringRule = errors.New("invalid scoring rule")
+
+// ScoringModel derives the per-dimension behavior scores of a validator from its
+// history. Models must be fully deterministic, as every node re-scores the
+// validators independently while applying headers.
+type ScoringModel interface {
+	// Dimensions returns the liveness, correctness, cooperation, consistency and
+	// signal sovereignty scores in basis points. The window is the one returned
+	// by the last Fold for the validator, or nil if there was none.
+	Dimensions(history *ValidatorHistory, window *ScoringWindow) [5]uint64
+
+	// Fold is called on every epoch boundary before re-scoring and returns the
+	// window to keep for the validator, or nil if the model needs none.
+	Fold(history *ValidatorHistory, window *ScoringWindow) *ScoringWindow
+}
+
+// ScoringWindow is the per-validator state of a windowed scoring model.
+type ScoringWindow struct {
+	Folded  ValidatorHistory `json:"folded"`  // History counters at the last fold
+	Decayed ValidatorHistory `json:"decayed"` // Decayed counters up to the last fold, scaled by windowUnit
+}
+
+// counters returns pointers to all history counters, in declaration order.
+func (h *ValidatorHistory) counters() []*uint64 {
+	return []*uint64{
+		&h.BlocksProposed, &h.BlocksMissed, &h.InvalidProposals,
+		&h.AcksGiven, &h.AcksMissed, &h.SlashCount,
+		&h.RydbergVerified, &h.RadioSyncs, &h.StellarBlocks,
+	}
+}
+
+// DefaultScoringModel scores validators by the ratios of their lifetime history.
+type DefaultScoringModel struct{}
+
+// Dimensions implements ScoringModel.
+func (DefaultScoringModel) Dimensions(history *ValidatorHistory, window *ScoringWindow) [5]uint64 {
+	return [5]uint64{
+		calcLiveness(history),
+		calcCorrectness(history),
+		calcCooperation(history),
+		calcConsistency(history),
+		calcSignalSovereignty(history),
+	}
+}
+
+// Fold implements ScoringModel. The default model keeps no window.
+func (DefaultScoringModel) Fold(history *ValidatorHistory, window *ScoringWindow) *ScoringWindow {
+	return nil
+}
+
+// DecayedScoringModel scores validators like the default model, but on a history
+// whose counters decay exponentially every epoch, so that old misbehavior ages
+// out of the score.
+type DecayedScoringModel struct {
+	Retain uint64 // Share of the history retained per epoch in basis points
+}
+
+// Fold implements ScoringModel, decaying the counters accumulated so far and
+// adding the ones of the epoch just ended at full weight.
+func (m DecayedScoringModel) Fold(history *ValidatorHistory, window *ScoringWindow) *ScoringWindow {
+	next := new(ScoringWindow)
+	if window != nil {
+		*next = *window
+	}
+	current := *history
+	folded, decayed := next.Folded.counters(), next.Decayed.counters()
+	for i, count := range current.counters() {
+		delta := *count - *folded[i]
+		if *count < *folded[i] {
+			// History was reset underneath the window, start over
+			delta, *decayed[i] = *count, 0
+		}
+		*decayed[i] = *decayed[i]*m.Retain/maxScore + delta*windowUnit
+		*folded[i] = *count
+	}
+	return next
+}
+
+// Dimensions implements ScoringModel, scoring the decayed history plus anything
+// recorded since the last fold at full weight.
+func (m DecayedScoringModel) Dimensions(history *ValidatorHistory, window *ScoringWindow) [5]uint64 {
+	if window == nil {
+		return DefaultScoringModel{}.Dimensions(history, nil)
+	}
+	var (
+		view    ValidatorHistory
+		current = *history
+		w       = *window
+		counts  = current.counters()
+		folded  = w.Folded.counters()
+		decayed = w.Decayed.counters()
+	)
+	for i, count := range view.counters() {
+		scaled := *decayed[i]
+		if *counts[i] >= *folded[i] {
+			scaled += (*counts[i] - *folded[i]) * windowUnit
+		}
+		*count = (scaled + windowUnit/2) / windowUnit
+	}
+	return DefaultScoringModel{}.Dimensions(&view, nil)
+}
+
+// validateScoringRule checks that a scoring rule names a known model and that
+// its parameters are in range.
+func validateScoringRule(rule *params.PobScoringRule) error {
+	var sum uint64
+	for _, weight := range rule.Weights {
+		sum += weight
+	}
+	if sum != 100 {
+		return errInvalidScoringRule
+	}
+	switch rule.Model {
+	case ScoringModelDefault:
+		if rule.Decay != 0 {
+			return errInvalidScoringRule
+		}
+	case ScoringModelDecayed:
+		if rule.Decay > maxScore {
+			return errInvalidScoringRule
+		}
+	default:
+		return errInvalidScoringRule
+	}
+	return nil
+}
+
+// newScoringAgent creates the behavior agent scoring according to a rule.
+func newScoringAgent(rule *params.PobScoringRule) (*BehaviorAgent, error) {
+	if err := validateScoringRule(rule); err != nil {
+		return nil, err
+	}
+	var model ScoringModel = DefaultScoringModel{}
+	if rule.Model == ScoringModelDecayed {
+		model = DecayedScoringModel{Retain: rule.Decay}
+	}
+	return NewBehaviorAgentWithModel(model, rule.Weights), nil
+}
+
+// sameScoringRule returns whether two rules score identically, regardless of
+// the block they were activated at.
+func sameScoringRule(a, b *params.PobScoringRule) bool {
+	return a.Model == b.Model && a.Weights == b.Weights && a.Decay == b.Decay
+}
+
+// encodeScoringVote encodes a vote for a scoring rule into the form carried in
+// the extra-data vanity of a header.
+func encodeScoringVote(rule *params.PobScoringRule) []byte {
+	vote := make([]byte, scoringVoteLen)
+	copy(vote, scoringVoteMagic)
+	for id, name := range scoringModelIDs {
+		if name == rule.Model {
+			vote[4] = byte(id)
+		}
+	}
+	for i, weight := range rule.Weights {
+		vote[5+i] = byte(weight)
+	}
+	binary.BigEndian.PutUint16(vote[10:], uint16(rule.Decay))
+	return vote
+}
+
+// decodeScoringVote decodes the scoring rule vote carried in the extra-data of
+// a header, returning nil if there is none or it is invalid.
+func decodeScoringVote(extra []byte) *params.PobScoringRule {
+	if len(extra) < scoringVoteLen || !bytes.Equal(extra[:len(scoringVoteMagic)], scoringVoteMagic) {
+		return nil
+	}
+	if int(extra[4]) >= len(scoringModelIDs) {
+		return nil
+	}
+	rule := &params.PobScoringRule{
+		Model: scoringModelIDs[extra[4]],
+		Decay: uint64(binary.BigEndian.Uint16(extra[10:])),
+	}
+	for i := range rule.Weights {
+		rule.Weights[i] = uint64(extra[5+i])
+	}
+	if validateScoringRule(rule) != nil {
+		return nil
+	}
+	return rule
+}
+
+// scoringRule returns the scoring rule in effect at the given block: the most
+// recently activated one of the rules scheduled in the config and the rule voted
+// in by the validators, or nil if neither applies yet.
+func (s *Snapshot) scoringRule(number uint64) *params.PobScoringRule {
+	var rule *params.PobScoringRule
+	for i := range s.config.Scoring {
+		if s.config.Scoring[i].Block <= number && (rule == nil || s.config.Scoring[i].Block >= rule.Block) {
+			rule = &s.config.Scoring[i]
+		}
+	}
+	if s.Scoring != nil && s.Scoring.Block <= number && (rule == nil || s.Scoring.Block >= rule.Block) {
+		rule = s.Scoring
+	}
+	return rule
+}
+
+// scoringAgent returns the behavior agent scoring according to the rule in
+// effect at the given block, falling back to the engine's agent.
+func (s *Snapshot) scoringAgent(number uint64) *BehaviorAgent {
+	rule := s.scoringRule(number)
+	if rule == nil {
+		return s.agent
+	}
+	agent, err := newScoringAgent(rule)
+	if err != nil {
+		return s.agent
+	}
+	return agent
+}
+
+// foldWindows advances the scoring windows of all validators to the current
+// histories using the model of the given agent.
+func (s *Snapshot) foldWindows(agent *BehaviorAgent) {
+	for _, addr := range s.validators() {
+		hist, ok := s.Histories[addr]
+		if !ok {
+			hist = &ValidatorHistory{}
+		}
+		if window := agent.model.Fold(hist, s.Windows[addr]); window != nil {
+			s.Windows[addr] = window
+		} else {
+			delete(s.Windows, addr)
+		}
+	}
+}
+
+// castScoringVote records the scoring rule voted for by a validator and puts it
+// into effect once a majority of the validators voted for the same rule.
+func (s *Snapshot) castScoringVote(validator common.Address, rule *params.PobScoringRule, number uint64) {
+	s.ScoringVotes[validator] = rule
+
+	var votes int
+	for _, vote := range s.ScoringVotes {
+		if sameScoringRule(vote, rule) {
+			votes++
+		}
+	}
+	if votes <= len(s.Validators)/2 {
+		return
+	}
+	passed := *rule
+	passed.Block = number
+	s.Scoring = &passed
+	s.ScoringVotes = make(map[common.Address]*params.PobScoringRule)
+}
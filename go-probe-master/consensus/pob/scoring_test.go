@@ -0,0 +1,270 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package pob
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/core/rawdb"
+	"github.com/probechain/go-probe/core/types"
+	"github.com/probechain/go-probe/params"
+)
+
+// Tests that the default scoring model and weights produce exactly the scores
+// of the original hard-coded formulas.
+func TestDefaultScoringModel(t *testing.T) {
+	history := &ValidatorHistory{
+		BlocksProposed: 30,
+		BlocksMissed:   10,
+		AcksGiven:      45,
+		AcksMissed:     5,
+		SlashCount:     1,
+	}
+	score := NewBehaviorAgent().EvaluateValidator(common.Address{}, history, 7)
+	want := BehaviorScore{
+		Total:             8275,
+		Liveness:          7500,
+		Correctness:       10000,
+		Cooperation:       9000,
+		Consistency:       9000,
+		SignalSovereignty: 5000,
+		LastUpdate:        7,
+	}
+	if *score != want {
+		t.Fatalf("score mismatch: have %+v, want %+v", *score, want)
+	}
+	agent, err := newScoringAgent(&params.PobScoringRule{Model: ScoringModelDefault, Weights: [5]uint64{100, 0, 0, 0, 0}})
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	if total := agent.EvaluateValidator(common.Address{}, history, 7).Total; total != 7500 {
+		t.Fatalf("reweighted total mismatch: have %d, want %d", total, 7500)
+	}
+}
+
+// Tests that the decayed scoring model ages out old history epoch by epoch.
+func TestDecayedScoringModel(t *testing.T) {
+	var (
+		model   = DecayedScoringModel{Retain: 5000}
+		history = new(ValidatorHistory)
+		window  *ScoringWindow
+	)
+	// Every step adds to the history, folds it at the epoch boundary and checks
+	// the resulting liveness
+	for i, step := range []struct {
+		proposed, missed uint64
+		liveness         uint64
+	}{
+		{0, 10, 0},    // 0 out of 10
+		{10, 0, 6666}, // 10 out of 10+5
+		{10, 0, 8333}, // 15 out of 15+2.5 (rounded to 3)
+		{0, 0, 8888},  // 7.5 (rounded to 8) out of 8+1.25 (rounded to 1)
+		{20, 0, 9600}, // 23.75 (rounded to 24) out of 24+0.625 (rounded to 1)
+	} {
+		history.BlocksProposed += step.proposed
+		history.BlocksMissed += step.missed
+		window = model.Fold(history, window)
+
+		if have := model.Dimensions(history, window)[0]; have != step.liveness {
+			t.Errorf("epoch %d: liveness mismatch: have %d, want %d", i, have, step.liveness)
+		}
+	}
+	// Anything recorded since the last fold counts at full weight
+	history.BlocksMissed += 24
+	if have, want := model.Dimensions(history, window)[0], uint64(4897); have != want {
+		t.Errorf("unfolded liveness mismatch: have %d, want %d", have, want)
+	}
+	// Without a window the model scores like the default one
+	if have, want := model.Dimensions(history, nil), (DefaultScoringModel{}).Dimensions(history, nil); have != want {
+		t.Errorf("windowless dimensions mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that scoring rules scheduled in the chain config and voted in by the
+// validators take effect at the right blocks.
+func TestScoringRuleSchedule(t *testing.T) {
+	addrs := testAddresses(2)
+	config := &params.PobConfig{Epoch: 10, Scoring: []params.PobScoringRule{
+		{Block: 20, Model: ScoringModelDefault, Weights: [5]uint64{100, 0, 0, 0, 0}},
+		{Block: 40, Model: ScoringModelDecayed, Weights: [5]uint64{0, 0, 100, 0, 0}, Decay: 5000},
+	}}
+	snap := newTestSnapshot(config, addrs)
+	for _, addr := range addrs {
+		*snap.Histories[addr] = ValidatorHistory{BlocksProposed: 30, BlocksMissed: 10, AcksGiven: 45, AcksMissed: 5}
+	}
+	for _, tt := range []struct {
+		number uint64
+		total  uint64
+		window bool
+	}{
+		{10, 8445, false}, // Default weights
+		{20, 7500, false}, // Liveness only
+		{30, 7500, false},
+		{40, 9000, true}, // Cooperation only, decayed
+	} {
+		snap.rescore(addrs[0], tt.number)
+		if have := snap.Validators[addrs[0]].Total; have != tt.total {
+			t.Errorf("block %d: total mismatch: have %d, want %d", tt.number, have, tt.total)
+		}
+		if _, ok := snap.Windows[addrs[0]]; ok != tt.window {
+			t.Errorf("block %d: window presence mismatch: have %v, want %v", tt.number, ok, tt.window)
+		}
+	}
+	// A voted in rule overrides older config rules, but not newer ones
+	snap.Scoring = &params.PobScoringRule{Block: 45, Model: ScoringModelDefault, Weights: defaultWeights}
+	if rule := snap.scoringRule(50); rule != snap.Scoring {
+		t.Errorf("voted rule not in effect: %+v", rule)
+	}
+	snap.Scoring.Block = 35
+	if rule := snap.scoringRule(50); rule != &config.Scoring[1] {
+		t.Errorf("newer config rule not in effect: %+v", rule)
+	}
+	if rule := snap.scoringRule(19); rule != nil {
+		t.Errorf("rule in effect before its block: %+v", rule)
+	}
+}
+
+// Tests that scoring rule votes are tallied, passed, cleared on epochs, and that
+// the resulting snapshots are identical however the headers are applied.
+func TestScoringVotes(t *testing.T) {
+	vals := newTestValidators(t, 3)
+	outsider := newTestValidators(t, 1)
+	genesis := newTestSnapshot(&params.PobConfig{Epoch: 4}, vals.addrs)
+
+	var (
+		decayed = &params.PobScoringRule{Model: ScoringModelDecayed, Weights: [5]uint64{30, 30, 20, 10, 10}, Decay: 8000}
+		other   = &params.PobScoringRule{Model: ScoringModelDefault, Weights: [5]uint64{20, 20, 20, 20, 20}}
+		headers []*types.Header
+		parent  common.Hash
+	)
+	for i, vote := range []struct {
+		producer common.Address
+		rule     *params.PobScoringRule
+	}{
+		{vals.addrs[0], decayed},
+		{vals.addrs[2], other},
+		{vals.addrs[1], decayed}, // Majority reached, rule passes
+		{vals.addrs[2], nil},     // Epoch boundary, rescored with the voted rule
+		{outsider.addrs[0], other},
+		{vals.addrs[0], other},
+		{vals.addrs[1], nil},
+		{vals.addrs[2], nil}, // Epoch boundary, votes cleared
+	} {
+		header := newTestHeader(uint64(i+1), parent, vote.producer)
+		header.Extra = make([]byte, extraVanity+extraSeal)
+		if vote.rule != nil {
+			copy(header.Extra, encodeScoringVote(vote.rule))
+		}
+		headers = append(headers, header)
+		parent = header.Hash()
+	}
+	snap, err := genesis.apply(headers[:2], behaviorForkConfig(0))
+	if err != nil {
+		t.Fatalf("failed to apply headers: %v", err)
+	}
+	if snap.Scoring != nil || len(snap.ScoringVotes) != 2 {
+		t.Fatalf("split vote state mismatch: rule %+v, votes %d", snap.Scoring, len(snap.ScoringVotes))
+	}
+	if snap, err = snap.apply(headers[2:4], behaviorForkConfig(0)); err != nil {
+		t.Fatalf("failed to apply headers: %v", err)
+	}
+	if snap.Scoring == nil || !sameScoringRule(snap.Scoring, decayed) || snap.Scoring.Block != 3 {
+		t.Fatalf("voted rule mismatch: have %+v, want %+v at 3", snap.Scoring, decayed)
+	}
+	if len(snap.ScoringVotes) != 0 {
+		t.Errorf("votes not cleared after passing: %d", len(snap.ScoringVotes))
+	}
+	if len(snap.Windows) != len(vals.addrs) {
+		t.Errorf("window count mismatch: have %d, want %d", len(snap.Windows), len(vals.addrs))
+	}
+	if snap, err = snap.apply(headers[4:6], behaviorForkConfig(0)); err != nil {
+		t.Fatalf("failed to apply headers: %v", err)
+	}
+	if len(snap.ScoringVotes) != 1 {
+		t.Errorf("vote count mismatch: have %d, want 1", len(snap.ScoringVotes))
+	}
+	if snap, err = snap.apply(headers[6:], behaviorForkConfig(0)); err != nil {
+		t.Fatalf("failed to apply headers: %v", err)
+	}
+	if len(snap.ScoringVotes) != 0 {
+		t.Errorf("votes not cleared on epoch: %d", len(snap.ScoringVotes))
+	}
+	// Applying all headers at once and round tripping through the database must
+	// yield the very same snapshot
+	batch, err := genesis.apply(headers, behaviorForkConfig(0))
+	if err != nil {
+		t.Fatalf("failed to apply headers: %v", err)
+	}
+	checkSnapshotEqual(t, batch, snap)
+
+	db := rawdb.NewMemoryDatabase()
+	if err := snap.store(db); err != nil {
+		t.Fatalf("failed to store snapshot: %v", err)
+	}
+	loaded, err := loadSnapshot(genesis.config, nil, nil, db, snap.Number, snap.Hash)
+	if err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	checkSnapshotEqual(t, loaded, snap)
+}
+
+// Tests that the engine writes the proposed scoring rule into the headers it
+// prepares until the rule is in effect, and rejects invalid proposals.
+func TestScoringProposal(t *testing.T) {
+	addrs := testAddresses(2)
+	engine := New(&params.PobConfig{
+		Epoch:         1000,
+		ValidatorList: []common.Validator{{Owner: addrs[0]}, {Owner: addrs[1]}},
+		Scoring:       []params.PobScoringRule{{Block: 5, Model: "unknown", Weights: defaultWeights}},
+	}, rawdb.NewMemoryDatabase(), params.AllPobProtocolChanges)
+
+	if len(engine.pobConfig.Scoring) != 0 {
+		t.Errorf("invalid config rule not dropped")
+	}
+	if err := engine.ProposeScoring(&params.PobScoringRule{Model: ScoringModelDefault, Weights: [5]uint64{50, 50, 50, 0, 0}}); err != errInvalidScoringRule {
+		t.Errorf("invalid proposal error mismatch: have %v, want %v", err, errInvalidScoringRule)
+	}
+	rule := &params.PobScoringRule{Model: ScoringModelDecayed, Weights: [5]uint64{40, 20, 20, 10, 10}, Decay: 9000}
+	if err := engine.ProposeScoring(rule); err != nil {
+		t.Fatalf("failed to propose rule: %v", err)
+	}
+	genesis := &types.Header{Number: big.NewInt(0), Difficulty: big.NewInt(1)}
+	chain := newTestChainReader(genesis)
+
+	header := newTestHeader(1, genesis.Hash(), addrs[0])
+	header.Extra = []byte("vanity")
+	if err := engine.Prepare(chain, header); err != nil {
+		t.Fatalf("failed to prepare header: %v", err)
+	}
+	if vote := decodeScoringVote(header.Extra); vote == nil || !sameScoringRule(vote, rule) {
+		t.Fatalf("vote mismatch: have %+v, want %+v", vote, rule)
+	}
+	if len(header.Extra) != extraVanity+extraSeal {
+		t.Errorf("extra-data length mismatch: have %d, want %d", len(header.Extra), extraVanity+extraSeal)
+	}
+	engine.DiscardScoring()
+
+	header = newTestHeader(1, genesis.Hash(), addrs[0])
+	if err := engine.Prepare(chain, header); err != nil {
+		t.Fatalf("failed to prepare header: %v", err)
+	}
+	if vote := decodeScoringVote(header.Extra); vote != nil {
+		t.Errorf("discarded rule still voted for: %+v", vote)
+	}
+}
@@ -19,16 +19,15 @@ package pob
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"math/big"
 	"sort"
 	"time"
 
 	"github.com/probechain/go-probe/common"
+	atomicClock "github.com/probechain/go-probe/core/atomic"
 	"github.com/probechain/go-probe/core/types"
 	"github.com/probechain/go-probe/log"
 	"github.com/probechain/go-probe/params"
-	"github.com/probechain/go-probe/probedb"
 	lru "github.com/hashicorp/golang-lru"
 	"golang.org/x/crypto/sha3"
 )
@@ -52,6 +51,9 @@ type Tally struct {
 type Snapshot struct {
 	config   *params.PobConfig // Consensus engine parameters
 	sigcache *lru.ARCCache     // Cache of recent block signatures
+	agent    *BehaviorAgent    // Behavior scoring agent used to re-score validators
+
+	persisted *Snapshot // Most recent snapshot of this chain written to disk, base for diffs
 
 	Number     uint64                              `json:"number"`     // Block number where the snapshot was created
 	Hash       common.Hash                         `json:"hash"`       // Block hash where the snapshot was created
@@ -61,6 +63,11 @@ type Snapshot struct {
 	Votes      []*Vote                              `json:"votes"`      // List of votes cast in chronological order
 	Tally      map[common.Address]Tally             `json:"tally"`      // Current vote tally
 	PubKeys    map[common.Address][]byte            `json:"pubkeys"`    // Dilithium public keys for validators (optional)
+	Offences   map[common.Hash]uint64               `json:"offences"`   // Recently punished offences and their heights
+
+	Windows      map[common.Address]*ScoringWindow         `json:"windows,omitempty"`      // Scoring windows of windowed scoring models
+	Scoring      *params.PobScoringRule                    `json:"scoring,omitempty"`      // Scoring rule voted in by the validators
+	ScoringVotes map[common.Address]*params.PobScoringRule `json:"scoringVotes,omitempty"` // Scoring rules the validators currently vote for
 }
 
 // validatorsAscending implements the sort interface to allow sorting a list of addresses.
@@ -71,7 +78,7 @@ func (s validatorsAscending) Less(i, j int) bool { return bytes.Compare(s[i][:],
 func (s validatorsAscending) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 
 // newSnapshot creates a new snapshot with the specified startup parameters.
-func newSnapshot(config *params.PobConfig, sigcache *lru.ARCCache, number uint64, hash common.Hash, validators []common.Address) *Snapshot {
+func newSnapshot(config *params.PobConfig, sigcache *lru.ARCCache, agent *BehaviorAgent, number uint64, hash common.Hash, validators []common.Address) *Snapshot {
 	initialScore := config.InitialScore
 	if initialScore == 0 {
 		initialScore = defaultInitialScore
@@ -79,6 +86,7 @@ func newSnapshot(config *params.PobConfig, sigcache *lru.ARCCache, number uint64
 	snap := &Snapshot{
 		config:     config,
 		sigcache:   sigcache,
+		agent:      agent,
 		Number:     number,
 		Hash:       hash,
 		Validators: make(map[common.Address]*BehaviorScore),
@@ -86,6 +94,10 @@ func newSnapshot(config *params.PobConfig, sigcache *lru.ARCCache, number uint64
 		Recents:    make(map[uint64]common.Address),
 		Tally:      make(map[common.Address]Tally),
 		PubKeys:    make(map[common.Address][]byte),
+		Offences:   make(map[common.Hash]uint64),
+
+		Windows:      make(map[common.Address]*ScoringWindow),
+		ScoringVotes: make(map[common.Address]*params.PobScoringRule),
 	}
 	for _, v := range validators {
 		snap.Validators[v] = DefaultBehaviorScore(initialScore, number)
@@ -94,35 +106,13 @@ func newSnapshot(config *params.PobConfig, sigcache *lru.ARCCache, number uint64
 	return snap
 }
 
-// loadSnapshot loads an existing snapshot from the database.
-func loadSnapshot(config *params.PobConfig, sigcache *lru.ARCCache, db probedb.Database, hash common.Hash) (*Snapshot, error) {
-	blob, err := db.Get(append([]byte("pob-"), hash[:]...))
-	if err != nil {
-		return nil, err
-	}
-	snap := new(Snapshot)
-	if err := json.Unmarshal(blob, snap); err != nil {
-		return nil, err
-	}
-	snap.config = config
-	snap.sigcache = sigcache
-	return snap, nil
-}
-
-// store inserts the snapshot into the database.
-func (s *Snapshot) store(db probedb.Database) error {
-	blob, err := json.Marshal(s)
-	if err != nil {
-		return err
-	}
-	return db.Put(append([]byte("pob-"), s.Hash[:]...), blob)
-}
-
 // copy creates a deep copy of the snapshot.
 func (s *Snapshot) copy() *Snapshot {
 	cpy := &Snapshot{
 		config:     s.config,
 		sigcache:   s.sigcache,
+		agent:      s.agent,
+		persisted:  s.persisted,
 		Number:     s.Number,
 		Hash:       s.Hash,
 		Validators: make(map[common.Address]*BehaviorScore),
@@ -130,6 +120,12 @@ func (s *Snapshot) copy() *Snapshot {
 		Recents:    make(map[uint64]common.Address),
 		Votes:      make([]*Vote, len(s.Votes)),
 		Tally:      make(map[common.Address]Tally),
+		PubKeys:    make(map[common.Address][]byte),
+		Offences:   make(map[common.Hash]uint64),
+
+		Scoring:      s.Scoring,
+		Windows:      make(map[common.Address]*ScoringWindow),
+		ScoringVotes: make(map[common.Address]*params.PobScoringRule),
 	}
 	for addr, score := range s.Validators {
 		scoreCopy := *score
@@ -145,6 +141,19 @@ func (s *Snapshot) copy() *Snapshot {
 	for address, tally := range s.Tally {
 		cpy.Tally[address] = tally
 	}
+	for addr, pubkey := range s.PubKeys {
+		cpy.PubKeys[addr] = pubkey
+	}
+	for key, number := range s.Offences {
+		cpy.Offences[key] = number
+	}
+	for addr, window := range s.Windows {
+		windowCopy := *window
+		cpy.Windows[addr] = &windowCopy
+	}
+	for addr, rule := range s.ScoringVotes {
+		cpy.ScoringVotes[addr] = rule
+	}
 	copy(cpy.Votes, s.Votes)
 	return cpy
 }
@@ -189,7 +198,9 @@ func (s *Snapshot) uncast(address common.Address, authorize bool) bool {
 }
 
 // apply creates a new authorization snapshot by applying the given headers to the original one.
-func (s *Snapshot) apply(headers []*types.Header) (*Snapshot, error) {
+// ACK participation is taken from the signers committed to by the headers, so
+// the result does not depend on which block bodies are available locally.
+func (s *Snapshot) apply(headers []*types.Header, config *params.ChainConfig) (*Snapshot, error) {
 	if len(headers) == 0 {
 		return s, nil
 	}
@@ -209,11 +220,13 @@ func (s *Snapshot) apply(headers []*types.Header) (*Snapshot, error) {
 	)
 	for i, header := range headers {
 		number := header.Number.Uint64()
+		fork := config.IsPobBehavior(header.Number)
 
 		// Remove any votes on checkpoint blocks
 		if number%s.config.Epoch == 0 {
 			snap.Votes = nil
 			snap.Tally = make(map[common.Address]Tally)
+			snap.ScoringVotes = make(map[common.Address]*params.PobScoringRule)
 		}
 
 		// Delete the oldest validator from the recent list
@@ -221,15 +234,25 @@ func (s *Snapshot) apply(headers []*types.Header) (*Snapshot, error) {
 			delete(snap.Recents, number-limit)
 		}
 
-		// Track the block producer
+		// Track the block producer and charge the selected one for a missed turn
 		producer := header.ValidatorAddr
+		expected := snap.selectProducer(number, header.ParentHash)
 		if _, ok := snap.Validators[producer]; ok {
 			snap.Recents[number] = producer
-			// Update history: block proposed
-			if hist, ok := snap.Histories[producer]; ok {
-				hist.BlocksProposed++
+			if !header.IsVisual() {
+				snap.recordProposal(producer, header)
+			}
+		}
+		if fork && (expected != producer || header.IsVisual()) {
+			if hist, ok := snap.Histories[expected]; ok {
+				hist.BlocksMissed++
 			}
 		}
+		// Account for the ACK round on the parent block carried by this one.
+		// Headers before the behavior fork do not commit to the signers.
+		if len(header.AckCountList) > 0 && len(header.AckSigners) > 0 {
+			snap.recordAcks(header.AckSigners)
+		}
 
 		// Header authorized, discard any previous votes from the signer
 		for j, vote := range snap.Votes {
@@ -261,19 +284,7 @@ func (s *Snapshot) apply(headers []*types.Header) (*Snapshot, error) {
 				snap.Validators[header.Coinbase] = DefaultBehaviorScore(initialScore, number)
 				snap.Histories[header.Coinbase] = &ValidatorHistory{}
 			} else {
-				delete(snap.Validators, header.Coinbase)
-				delete(snap.Histories, header.Coinbase)
-
-				if limit := uint64(len(snap.Validators)/2 + 1); number >= limit {
-					delete(snap.Recents, number-limit)
-				}
-				for j := 0; j < len(snap.Votes); j++ {
-					if snap.Votes[j].Signer == header.Coinbase {
-						snap.uncast(snap.Votes[j].Address, snap.Votes[j].Authorize)
-						snap.Votes = append(snap.Votes[:j], snap.Votes[j+1:]...)
-						j--
-					}
-				}
+				snap.removeValidator(header.Coinbase, number)
 			}
 			for j := 0; j < len(snap.Votes); j++ {
 				if snap.Votes[j].Address == header.Coinbase {
@@ -284,6 +295,33 @@ func (s *Snapshot) apply(headers []*types.Header) (*Snapshot, error) {
 			delete(snap.Tally, header.Coinbase)
 		}
 
+		// Tally up the scoring rule the producer votes for, if any
+		if rule := decodeScoringVote(header.Extra); rule != nil {
+			if _, ok := snap.Validators[producer]; ok {
+				snap.castScoringVote(producer, rule, number)
+			}
+		}
+
+		// Punish any proven misbehavior carried by the header
+		if fork {
+			snap.applyEvidence(header)
+		}
+
+		// Register any Dilithium keys published by the header
+		if err := snap.applyKeyRegistrations(header); err != nil {
+			return nil, err
+		}
+
+		// Refresh the behavior scores, fully re-evaluating everyone on epoch boundaries
+		if fork {
+			snap.rescore(producer, number)
+		}
+
+		// Demote any validator whose score dropped below the threshold
+		if fork {
+			snap.demote(number)
+		}
+
 		if time.Since(logged) > 8*time.Second {
 			log.Info("Reconstructing voting history", "processed", i, "total", len(headers), "elapsed", common.PrettyDuration(time.Since(start)))
 			logged = time.Now()
@@ -298,6 +336,154 @@ func (s *Snapshot) apply(headers []*types.Header) (*Snapshot, error) {
 	return snap, nil
 }
 
+// recordProposal updates the producer's history with a block it has sealed,
+// including the Stellar-Class time source the block was stamped with.
+func (s *Snapshot) recordProposal(producer common.Address, header *types.Header) {
+	hist, ok := s.Histories[producer]
+	if !ok {
+		return
+	}
+	hist.BlocksProposed++
+
+	if len(header.AtomicTime) == 0 {
+		return
+	}
+	at, err := atomicClock.DecodeAtomicTimestamp(header.AtomicTime)
+	if err != nil {
+		return
+	}
+	hist.StellarBlocks++
+	switch at.ClockSource {
+	case atomicClock.ClockSourceRydberg:
+		hist.RydbergVerified++
+	case atomicClock.ClockSourceGNSS:
+		hist.RadioSyncs++
+	}
+}
+
+// recordAcks credits every validator that acknowledged the parent block and
+// charges the remaining validators with a missed ACK.
+func (s *Snapshot) recordAcks(ackSigners []common.Address) {
+	signers := make(map[common.Address]struct{}, len(ackSigners))
+	for _, signer := range ackSigners {
+		signers[signer] = struct{}{}
+	}
+	for addr, hist := range s.Histories {
+		if _, ok := s.Validators[addr]; !ok {
+			continue
+		}
+		if _, ok := signers[addr]; ok {
+			hist.AcksGiven++
+		} else {
+			hist.AcksMissed++
+		}
+	}
+}
+
+// rescore refreshes the behavior scores after a block has been applied. On
+// epoch boundaries every validator is re-evaluated from its history using the
+// scoring rule in effect, otherwise only the producer's cached score is carried
+// forward.
+func (s *Snapshot) rescore(producer common.Address, number uint64) {
+	if s.agent == nil {
+		return
+	}
+	if number%s.config.Epoch == 0 {
+		agent := s.scoringAgent(number)
+		s.foldWindows(agent)
+		s.Validators = agent.UpdateScores(s.Validators, s.Histories, s.Windows, number)
+		return
+	}
+	if cached, ok := s.Validators[producer]; ok {
+		s.Validators[producer] = s.agent.EvaluateValidatorFast(producer, s.Histories[producer], number, s.config.Epoch, cached)
+	}
+}
+
+// applyEvidence slashes the validators proven to have misbehaved by the evidence
+// carried in the header. Evidence that is malformed, stale, already punished or
+// targets a non-validator is ignored.
+func (s *Snapshot) applyEvidence(header *types.Header) {
+	number := header.Number.Uint64()
+
+	// Forget offences that are too old to be submitted again
+	for key, height := range s.Offences {
+		if height+s.config.Epoch < number {
+			delete(s.Offences, key)
+		}
+	}
+	evidence, err := decodeEvidence(header.Evidence)
+	if err != nil {
+		return
+	}
+	for _, ev := range evidence {
+		offender, height, err := ev.verify(s.PubKeys)
+		if err != nil || height > number || height+s.config.Epoch < number {
+			continue
+		}
+		if _, ok := s.Validators[offender]; !ok {
+			continue
+		}
+		key := offenceKey(offender, height, ev.Type)
+		if _, ok := s.Offences[key]; ok {
+			continue
+		}
+		s.Offences[key] = height
+		s.slash(offender, ev.severity(), number)
+
+		log.Debug("Slashed PoB validator", "validator", offender, "offence", height, "type", ev.Type, "score", s.Validators[offender].Total)
+	}
+}
+
+// slash proportionally reduces the score of a validator and records the slash
+// in its history.
+func (s *Snapshot) slash(offender common.Address, severity uint64, number uint64) {
+	score, ok := s.Validators[offender]
+	if !ok {
+		return
+	}
+	s.agent.ProportionalSlash(score, severity, s.config.SlashFraction)
+	score.LastUpdate = number
+
+	if hist, ok := s.Histories[offender]; ok {
+		hist.SlashCount++
+	}
+}
+
+// demote removes every validator whose behavior score dropped below the
+// demotion threshold. The last remaining validator is never demoted so that
+// the chain is always able to make progress.
+func (s *Snapshot) demote(number uint64) {
+	for _, v := range s.validators() {
+		if len(s.Validators) <= 1 {
+			return
+		}
+		if s.Validators[v].Total < s.config.DemotionThreshold {
+			s.removeValidator(v, number)
+			log.Debug("Demoted PoB validator", "validator", v, "number", number)
+		}
+	}
+}
+
+// removeValidator drops a validator from the active set along with its history
+// and any votes it has cast.
+func (s *Snapshot) removeValidator(validator common.Address, number uint64) {
+	delete(s.Validators, validator)
+	delete(s.Histories, validator)
+	delete(s.Windows, validator)
+	delete(s.ScoringVotes, validator)
+
+	if limit := uint64(len(s.Validators)/2 + 1); number >= limit {
+		delete(s.Recents, number-limit)
+	}
+	for j := 0; j < len(s.Votes); j++ {
+		if s.Votes[j].Signer == validator {
+			s.uncast(s.Votes[j].Address, s.Votes[j].Authorize)
+			s.Votes = append(s.Votes[:j], s.Votes[j+1:]...)
+			j--
+		}
+	}
+}
+
 // validators retrieves the list of active validators in ascending order.
 func (s *Snapshot) validators() []common.Address {
 	vals := make([]common.Address, 0, len(s.Validators))
@@ -366,38 +552,3 @@ func makeSeed(parentHash common.Hash, number uint64) uint64 {
 	hasher.(interface{ Sum([]byte) []byte }).Sum(hash[:0])
 	return new(big.Int).SetBytes(hash[:8]).Uint64()
 }
-
-// encodeBehaviorData encodes the validator set and scores for checkpoint blocks.
-// Layout: [1B: count N][N × (20B address + 8B score)]
-func encodeBehaviorData(snap *Snapshot) []byte {
-	vals := snap.validators()
-	n := len(vals)
-	data := make([]byte, 1+n*28)
-	data[0] = byte(n)
-	for i, v := range vals {
-		offset := 1 + i*28
-		copy(data[offset:offset+20], v[:])
-		binary.BigEndian.PutUint64(data[offset+20:offset+28], snap.Validators[v].Total)
-	}
-	return data
-}
-
-// decodeBehaviorData decodes the validator set and scores from checkpoint extra-data.
-func decodeBehaviorData(data []byte) (map[common.Address]uint64, error) {
-	if len(data) < 1 {
-		return nil, errInvalidCheckpointValidators
-	}
-	n := int(data[0])
-	if len(data) != 1+n*28 {
-		return nil, errInvalidCheckpointValidators
-	}
-	result := make(map[common.Address]uint64, n)
-	for i := 0; i < n; i++ {
-		offset := 1 + i*28
-		var addr common.Address
-		copy(addr[:], data[offset:offset+20])
-		score := binary.BigEndian.Uint64(data[offset+20 : offset+28])
-		result[addr] = score
-	}
-	return result, nil
-}
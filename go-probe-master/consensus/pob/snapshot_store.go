@@ -0,0 +1,423 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package pob
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/core/rawdb"
+	"github.com/probechain/go-probe/log"
+	"github.com/probechain/go-probe/params"
+	"github.com/probechain/go-probe/probedb"
+	"github.com/probechain/go-probe/rlp"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	// snapshotVersion1 is the first binary snapshot record layout.
+	snapshotVersion1 = 1
+
+	// fullSnapshotInterval is the number of blocks after which a full snapshot
+	// is persisted instead of a diff against the previous stored snapshot. It
+	// bounds the number of diffs that need to be replayed on load.
+	fullSnapshotInterval = 8 * checkpointInterval
+
+	// defaultSnapshotRetention is the number of blocks of snapshots kept on disk
+	// if the chain configuration does not specify a retention.
+	defaultSnapshotRetention = 64 * checkpointInterval
+)
+
+var (
+	errUnknownSnapshot        = errors.New("unknown snapshot")
+	errInvalidSnapshotVersion = errors.New("invalid snapshot version")
+	errSnapshotBaseMismatch   = errors.New("snapshot diff base mismatch")
+)
+
+// Snapshot record kinds.
+const (
+	snapshotFull = iota // Record contains the complete snapshot
+	snapshotDiff        // Record contains the changes against its base snapshot
+)
+
+// storedSnapshot is the binary on-disk representation of a snapshot. Maps are
+// flattened into lists sorted by key so the encoding is deterministic. In diff
+// records the score, history and public key lists only hold entries that were
+// added or changed since the base, with deletions listed separately; the small
+// recents, votes, tally, offence and scoring sets are always stored in full.
+type storedSnapshot struct {
+	Version    uint8
+	Kind       uint8
+	Number     uint64
+	Hash       common.Hash
+	BaseNumber uint64
+	BaseHash   common.Hash
+
+	Scores           []storedScore
+	Histories        []storedHistory
+	PubKeys          []storedPubKey
+	RemovedScores    []common.Address
+	RemovedHistories []common.Address
+	RemovedPubKeys   []common.Address
+
+	Recents  []storedRecent
+	Votes    []*Vote
+	Tally    []storedTally
+	Offences []storedOffence
+
+	Windows      []storedWindow          `rlp:"optional"`
+	Scoring      []params.PobScoringRule `rlp:"optional"` // Empty or the voted in rule
+	ScoringVotes []storedScoringVote     `rlp:"optional"`
+}
+
+type storedScore struct {
+	Address common.Address
+	Score   BehaviorScore
+}
+
+type storedHistory struct {
+	Address common.Address
+	History ValidatorHistory
+}
+
+type storedPubKey struct {
+	Address common.Address
+	Key     []byte
+}
+
+type storedRecent struct {
+	Number    uint64
+	Validator common.Address
+}
+
+type storedTally struct {
+	Address   common.Address
+	Authorize bool
+	Votes     uint64
+}
+
+type storedOffence struct {
+	Key    common.Hash
+	Number uint64
+}
+
+type storedWindow struct {
+	Address common.Address
+	Window  ScoringWindow
+}
+
+type storedScoringVote struct {
+	Address common.Address
+	Rule    params.PobScoringRule
+}
+
+// snapshotRetention returns the number of blocks of snapshots kept on disk.
+func snapshotRetention(config *params.PobConfig) uint64 {
+	if config.SnapshotRetention != 0 {
+		return config.SnapshotRetention
+	}
+	return defaultSnapshotRetention
+}
+
+// loadSnapshot loads an existing snapshot from the database, replaying any diff
+// records on top of their base. Snapshots stored in the legacy JSON format are
+// migrated to the binary format on first access.
+func loadSnapshot(config *params.PobConfig, sigcache *lru.ARCCache, agent *BehaviorAgent, db probedb.Database, number uint64, hash common.Hash) (*Snapshot, error) {
+	snap, err := readSnapshot(db, number, hash)
+	if err == errUnknownSnapshot {
+		if snap, err = readLegacySnapshot(db, hash); err == nil {
+			snap.config, snap.sigcache, snap.agent = config, sigcache, agent
+			if err := snap.store(db); err != nil {
+				return nil, err
+			}
+			rawdb.DeleteLegacyPobSnapshot(db, hash)
+			log.Debug("Migrated legacy PoB snapshot", "number", number, "hash", hash)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	snap.config, snap.sigcache, snap.agent = config, sigcache, agent
+	snap.persisted = snap
+	return snap, nil
+}
+
+// readSnapshot reads and decodes the binary snapshot record of the given block,
+// resolving diff records against their bases.
+func readSnapshot(db probedb.KeyValueReader, number uint64, hash common.Hash) (*Snapshot, error) {
+	blob := rawdb.ReadPobSnapshot(db, number, hash)
+	if len(blob) == 0 {
+		return nil, errUnknownSnapshot
+	}
+	stored := new(storedSnapshot)
+	if err := rlp.DecodeBytes(blob, stored); err != nil {
+		return nil, err
+	}
+	if stored.Version != snapshotVersion1 {
+		return nil, errInvalidSnapshotVersion
+	}
+	var snap *Snapshot
+	switch stored.Kind {
+	case snapshotFull:
+		snap = &Snapshot{
+			Validators: make(map[common.Address]*BehaviorScore),
+			Histories:  make(map[common.Address]*ValidatorHistory),
+			PubKeys:    make(map[common.Address][]byte),
+		}
+	case snapshotDiff:
+		if stored.BaseNumber >= stored.Number {
+			return nil, errSnapshotBaseMismatch
+		}
+		base, err := readSnapshot(db, stored.BaseNumber, stored.BaseHash)
+		if err != nil {
+			return nil, err
+		}
+		snap = base
+	default:
+		return nil, errInvalidSnapshotVersion
+	}
+	stored.applyTo(snap)
+	return snap, nil
+}
+
+// readLegacySnapshot reads a snapshot stored in the legacy JSON format.
+func readLegacySnapshot(db probedb.KeyValueReader, hash common.Hash) (*Snapshot, error) {
+	blob := rawdb.ReadLegacyPobSnapshot(db, hash)
+	if len(blob) == 0 {
+		return nil, errUnknownSnapshot
+	}
+	snap := new(Snapshot)
+	if err := json.Unmarshal(blob, snap); err != nil {
+		return nil, err
+	}
+	if snap.Validators == nil {
+		snap.Validators = make(map[common.Address]*BehaviorScore)
+	}
+	if snap.Histories == nil {
+		snap.Histories = make(map[common.Address]*ValidatorHistory)
+	}
+	if snap.PubKeys == nil {
+		snap.PubKeys = make(map[common.Address][]byte)
+	}
+	if snap.Recents == nil {
+		snap.Recents = make(map[uint64]common.Address)
+	}
+	if snap.Tally == nil {
+		snap.Tally = make(map[common.Address]Tally)
+	}
+	if snap.Offences == nil {
+		snap.Offences = make(map[common.Hash]uint64)
+	}
+	if snap.Windows == nil {
+		snap.Windows = make(map[common.Address]*ScoringWindow)
+	}
+	if snap.ScoringVotes == nil {
+		snap.ScoringVotes = make(map[common.Address]*params.PobScoringRule)
+	}
+	return snap, nil
+}
+
+// store inserts the snapshot into the database. A full record is written if the
+// snapshot starts a new full snapshot interval or no earlier snapshot of its
+// chain was persisted, otherwise only the diff against the previously persisted
+// snapshot is written. Snapshots older than the configured retention are pruned.
+func (s *Snapshot) store(db probedb.Database) error {
+	base := s.persisted
+	if base != nil && (base.Number >= s.Number || base.Number/fullSnapshotInterval != s.Number/fullSnapshotInterval) {
+		base = nil
+	}
+	blob, err := rlp.EncodeToBytes(newStoredSnapshot(s, base))
+	if err != nil {
+		return err
+	}
+	rawdb.WritePobSnapshot(db, s.Number, s.Hash, blob)
+	s.persisted = s
+
+	pruneSnapshots(db, s.Number, snapshotRetention(s.config))
+	return nil
+}
+
+// pruneSnapshots deletes all snapshot records that are older than the retention
+// window ending at the given block. Records are only dropped below the start of
+// a full snapshot interval so retained diffs always keep their bases.
+func pruneSnapshots(db probedb.Database, number uint64, retention uint64) {
+	if number <= retention {
+		return
+	}
+	limit := (number - retention) / fullSnapshotInterval * fullSnapshotInterval
+	if limit == 0 {
+		return
+	}
+	numbers, hashes := rawdb.ReadPobSnapshotKeys(db, limit)
+	if len(numbers) == 0 {
+		return
+	}
+	batch := db.NewBatch()
+	for i := range numbers {
+		rawdb.DeletePobSnapshot(batch, numbers[i], hashes[i])
+	}
+	if err := batch.Write(); err != nil {
+		log.Crit("Failed to prune PoB snapshots", "err", err)
+	}
+	log.Debug("Pruned PoB snapshots", "count", len(numbers), "limit", limit)
+}
+
+// newStoredSnapshot flattens a snapshot into its on-disk record, as a diff
+// against base if one is given or in full otherwise.
+func newStoredSnapshot(s *Snapshot, base *Snapshot) *storedSnapshot {
+	stored := &storedSnapshot{
+		Version: snapshotVersion1,
+		Kind:    snapshotFull,
+		Number:  s.Number,
+		Hash:    s.Hash,
+		Votes:   s.Votes,
+	}
+	var (
+		baseScores    map[common.Address]*BehaviorScore
+		baseHistories map[common.Address]*ValidatorHistory
+		basePubKeys   map[common.Address][]byte
+	)
+	if base != nil {
+		stored.Kind = snapshotDiff
+		stored.BaseNumber, stored.BaseHash = base.Number, base.Hash
+		baseScores, baseHistories, basePubKeys = base.Validators, base.Histories, base.PubKeys
+	}
+	for _, addr := range sortedKeys(s.Validators) {
+		if old, ok := baseScores[addr]; !ok || *old != *s.Validators[addr] {
+			stored.Scores = append(stored.Scores, storedScore{addr, *s.Validators[addr]})
+		}
+	}
+	for _, addr := range sortedKeys(s.Histories) {
+		if old, ok := baseHistories[addr]; !ok || *old != *s.Histories[addr] {
+			stored.Histories = append(stored.Histories, storedHistory{addr, *s.Histories[addr]})
+		}
+	}
+	for _, addr := range sortedKeys(s.PubKeys) {
+		if old, ok := basePubKeys[addr]; !ok || !bytes.Equal(old, s.PubKeys[addr]) {
+			stored.PubKeys = append(stored.PubKeys, storedPubKey{addr, s.PubKeys[addr]})
+		}
+	}
+	stored.RemovedScores = removedKeys(baseScores, s.Validators)
+	stored.RemovedHistories = removedKeys(baseHistories, s.Histories)
+	stored.RemovedPubKeys = removedKeys(basePubKeys, s.PubKeys)
+
+	for number, validator := range s.Recents {
+		stored.Recents = append(stored.Recents, storedRecent{number, validator})
+	}
+	sort.Slice(stored.Recents, func(i, j int) bool { return stored.Recents[i].Number < stored.Recents[j].Number })
+
+	for _, addr := range sortedKeys(s.Tally) {
+		tally := s.Tally[addr]
+		stored.Tally = append(stored.Tally, storedTally{addr, tally.Authorize, uint64(tally.Votes)})
+	}
+	for key, number := range s.Offences {
+		stored.Offences = append(stored.Offences, storedOffence{key, number})
+	}
+	sort.Slice(stored.Offences, func(i, j int) bool {
+		return bytes.Compare(stored.Offences[i].Key[:], stored.Offences[j].Key[:]) < 0
+	})
+	for _, addr := range sortedKeys(s.Windows) {
+		stored.Windows = append(stored.Windows, storedWindow{addr, *s.Windows[addr]})
+	}
+	if s.Scoring != nil {
+		stored.Scoring = []params.PobScoringRule{*s.Scoring}
+	}
+	for _, addr := range sortedKeys(s.ScoringVotes) {
+		stored.ScoringVotes = append(stored.ScoringVotes, storedScoringVote{addr, *s.ScoringVotes[addr]})
+	}
+	return stored
+}
+
+// sortedKeys returns the addresses keying m in ascending order.
+func sortedKeys[V any](m map[common.Address]V) []common.Address {
+	addrs := make([]common.Address, 0, len(m))
+	for addr := range m {
+		addrs = append(addrs, addr)
+	}
+	sort.Sort(validatorsAscending(addrs))
+	return addrs
+}
+
+// removedKeys returns the addresses keying base but not current, in ascending order.
+func removedKeys[V any](base, current map[common.Address]V) []common.Address {
+	var addrs []common.Address
+	for addr := range base {
+		if _, ok := current[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Sort(validatorsAscending(addrs))
+	return addrs
+}
+
+// applyTo overlays the record on top of snap, which must either be empty for
+// full records or hold the decoded base snapshot for diff records.
+func (stored *storedSnapshot) applyTo(snap *Snapshot) {
+	snap.Number, snap.Hash = stored.Number, stored.Hash
+
+	for _, addr := range stored.RemovedScores {
+		delete(snap.Validators, addr)
+	}
+	for _, addr := range stored.RemovedHistories {
+		delete(snap.Histories, addr)
+	}
+	for _, addr := range stored.RemovedPubKeys {
+		delete(snap.PubKeys, addr)
+	}
+	for _, entry := range stored.Scores {
+		score := entry.Score
+		snap.Validators[entry.Address] = &score
+	}
+	for _, entry := range stored.Histories {
+		hist := entry.History
+		snap.Histories[entry.Address] = &hist
+	}
+	for _, entry := range stored.PubKeys {
+		snap.PubKeys[entry.Address] = entry.Key
+	}
+	snap.Recents = make(map[uint64]common.Address, len(stored.Recents))
+	for _, entry := range stored.Recents {
+		snap.Recents[entry.Number] = entry.Validator
+	}
+	snap.Votes = stored.Votes
+	snap.Tally = make(map[common.Address]Tally, len(stored.Tally))
+	for _, entry := range stored.Tally {
+		snap.Tally[entry.Address] = Tally{Authorize: entry.Authorize, Votes: int(entry.Votes)}
+	}
+	snap.Offences = make(map[common.Hash]uint64, len(stored.Offences))
+	for _, entry := range stored.Offences {
+		snap.Offences[entry.Key] = entry.Number
+	}
+	snap.Windows = make(map[common.Address]*ScoringWindow, len(stored.Windows))
+	for _, entry := range stored.Windows {
+		window := entry.Window
+		snap.Windows[entry.Address] = &window
+	}
+	snap.Scoring = nil
+	if len(stored.Scoring) > 0 {
+		rule := stored.Scoring[0]
+		snap.Scoring = &rule
+	}
+	snap.ScoringVotes = make(map[common.Address]*params.PobScoringRule, len(stored.ScoringVotes))
+	for _, entry := range stored.ScoringVotes {
+		rule := entry.Rule
+		snap.ScoringVotes[entry.Address] = &rule
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package pob
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/core/rawdb"
+	"github.com/probechain/go-probe/params"
+	"github.com/probechain/go-probe/rlp"
+)
+
+// checkSnapshotEqual fails the test if the two snapshots differ in content.
+func checkSnapshotEqual(t *testing.T, have, want *Snapshot) {
+	t.Helper()
+	a, _ := rlp.EncodeToBytes(newStoredSnapshot(have, nil))
+	b, _ := rlp.EncodeToBytes(newStoredSnapshot(want, nil))
+	if !bytes.Equal(a, b) {
+		t.Fatalf("snapshot %d mismatch:\nhave %+v\nwant %+v", want.Number, newStoredSnapshot(have, nil), newStoredSnapshot(want, nil))
+	}
+}
+
+// advance returns a copy of the snapshot moved to the given checkpoint.
+func advance(snap *Snapshot, number uint64) *Snapshot {
+	cpy := snap.copy()
+	cpy.Number = number
+	cpy.Hash = common.BytesToHash([]byte{byte(number >> 16), byte(number >> 8), byte(number)})
+	return cpy
+}
+
+// Tests that snapshots round trip through full and diff records, including
+// validator removals, key rotations and vote state.
+func TestSnapshotStoreDiffs(t *testing.T) {
+	var (
+		db     = rawdb.NewMemoryDatabase()
+		config = &params.PobConfig{Epoch: 1000}
+		addrs  = testAddresses(4)
+		snap   = newTestSnapshot(config, addrs)
+	)
+	snap.PubKeys[addrs[0]] = []byte{0x01}
+	if err := snap.store(db); err != nil {
+		t.Fatalf("failed to store genesis snapshot: %v", err)
+	}
+	stored := []*Snapshot{snap}
+
+	next := advance(snap, checkpointInterval)
+	next.Histories[addrs[1]].BlocksProposed = 10
+	next.Validators[addrs[1]].Total = 6000
+	next.removeValidator(addrs[3], checkpointInterval)
+	next.PubKeys[addrs[0]] = []byte{0x02, 0x03}
+	next.PubKeys[addrs[2]] = []byte{0x04}
+	next.Recents[checkpointInterval] = addrs[1]
+	next.Votes = append(next.Votes, &Vote{Signer: addrs[0], Block: checkpointInterval, Address: addrs[3], Authorize: true})
+	next.Tally[addrs[3]] = Tally{Authorize: true, Votes: 1}
+	next.Offences[common.Hash{0xff}] = 7
+	if err := next.store(db); err != nil {
+		t.Fatalf("failed to store snapshot: %v", err)
+	}
+	stored = append(stored, next)
+
+	next = advance(next, 2*checkpointInterval)
+	delete(next.PubKeys, addrs[0])
+	next.Histories[addrs[2]].AcksMissed = 3
+	if err := next.store(db); err != nil {
+		t.Fatalf("failed to store snapshot: %v", err)
+	}
+	stored = append(stored, next)
+
+	for i, want := range stored {
+		blob := rawdb.ReadPobSnapshot(db, want.Number, want.Hash)
+		record := new(storedSnapshot)
+		if err := rlp.DecodeBytes(blob, record); err != nil {
+			t.Fatalf("snapshot %d: failed to decode record: %v", i, err)
+		}
+		if i == 0 {
+			if record.Kind != snapshotFull {
+				t.Errorf("snapshot %d: kind mismatch: have %d, want %d", i, record.Kind, snapshotFull)
+			}
+		} else if record.Kind != snapshotDiff || record.BaseHash != stored[i-1].Hash {
+			t.Errorf("snapshot %d: expected diff against %x, have kind %d base %x", i, stored[i-1].Hash, record.Kind, record.BaseHash)
+		}
+		have, err := loadSnapshot(config, nil, nil, db, want.Number, want.Hash)
+		if err != nil {
+			t.Fatalf("snapshot %d: failed to load: %v", i, err)
+		}
+		checkSnapshotEqual(t, have, want)
+	}
+	// Crossing a full snapshot interval must write a full record again
+	full := advance(stored[len(stored)-1], fullSnapshotInterval)
+	if err := full.store(db); err != nil {
+		t.Fatalf("failed to store snapshot: %v", err)
+	}
+	record := new(storedSnapshot)
+	if err := rlp.DecodeBytes(rawdb.ReadPobSnapshot(db, full.Number, full.Hash), record); err != nil {
+		t.Fatalf("failed to decode record: %v", err)
+	}
+	if record.Kind != snapshotFull {
+		t.Errorf("interval boundary kind mismatch: have %d, want %d", record.Kind, snapshotFull)
+	}
+	if _, err := loadSnapshot(config, nil, nil, db, checkpointInterval, common.Hash{0xde, 0xad}); err != errUnknownSnapshot {
+		t.Errorf("unknown snapshot error mismatch: have %v, want %v", err, errUnknownSnapshot)
+	}
+}
+
+// Tests that snapshots in the legacy JSON format are migrated on load.
+func TestSnapshotLegacyMigration(t *testing.T) {
+	var (
+		db     = rawdb.NewMemoryDatabase()
+		config = &params.PobConfig{Epoch: 1000}
+		addrs  = testAddresses(3)
+		snap   = advance(newTestSnapshot(config, addrs), checkpointInterval)
+	)
+	snap.Histories[addrs[0]].AcksGiven = 42
+	snap.Recents[checkpointInterval] = addrs[0]
+
+	blob, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatalf("failed to encode legacy snapshot: %v", err)
+	}
+	if err := db.Put(append([]byte("pob-"), snap.Hash[:]...), blob); err != nil {
+		t.Fatalf("failed to write legacy snapshot: %v", err)
+	}
+	have, err := loadSnapshot(config, nil, nil, db, snap.Number, snap.Hash)
+	if err != nil {
+		t.Fatalf("failed to load legacy snapshot: %v", err)
+	}
+	checkSnapshotEqual(t, have, snap)
+
+	if blob := rawdb.ReadLegacyPobSnapshot(db, snap.Hash); len(blob) != 0 {
+		t.Errorf("legacy snapshot not deleted after migration")
+	}
+	if blob := rawdb.ReadPobSnapshot(db, snap.Number, snap.Hash); len(blob) == 0 {
+		t.Fatalf("migrated snapshot not stored")
+	}
+	have, err = loadSnapshot(config, nil, nil, db, snap.Number, snap.Hash)
+	if err != nil {
+		t.Fatalf("failed to load migrated snapshot: %v", err)
+	}
+	checkSnapshotEqual(t, have, snap)
+}
+
+// Tests that snapshots beyond the retention window are pruned without breaking
+// the diff chains of retained snapshots.
+func TestSnapshotPruning(t *testing.T) {
+	var (
+		db     = rawdb.NewMemoryDatabase()
+		config = &params.PobConfig{Epoch: 1000, SnapshotRetention: fullSnapshotInterval}
+		snap   = newTestSnapshot(config, testAddresses(2))
+	)
+	if err := snap.store(db); err != nil {
+		t.Fatalf("failed to store snapshot: %v", err)
+	}
+	var all []*Snapshot
+	for number := uint64(checkpointInterval); number <= 3*fullSnapshotInterval+2*checkpointInterval; number += checkpointInterval {
+		snap = advance(snap, number)
+		snap.Histories[snap.validators()[0]].BlocksProposed = number
+		if err := snap.store(db); err != nil {
+			t.Fatalf("failed to store snapshot %d: %v", number, err)
+		}
+		all = append(all, snap)
+	}
+	// Everything before the interval containing head-retention must be gone
+	limit := (snap.Number - fullSnapshotInterval) / fullSnapshotInterval * fullSnapshotInterval
+	if numbers, _ := rawdb.ReadPobSnapshotKeys(db, limit); len(numbers) != 0 {
+		t.Errorf("stale snapshots not pruned: %v", numbers)
+	}
+	for _, want := range all {
+		have, err := loadSnapshot(config, nil, nil, db, want.Number, want.Hash)
+		if want.Number < limit {
+			if err == nil {
+				t.Errorf("snapshot %d: pruned snapshot still loadable", want.Number)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("snapshot %d: failed to load retained snapshot: %v", want.Number, err)
+		}
+		checkSnapshotEqual(t, have, want)
+	}
+}
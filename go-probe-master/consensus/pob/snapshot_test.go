@@ -0,0 +1,238 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package pob
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"sort"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/probechain/go-probe/common"
+	atomicClock "github.com/probechain/go-probe/core/atomic"
+	"github.com/probechain/go-probe/core/types"
+	"github.com/probechain/go-probe/crypto"
+	"github.com/probechain/go-probe/params"
+)
+
+// testValidators is a deterministic set of validator keys, sorted by address.
+type testValidators struct {
+	keys  []*ecdsa.PrivateKey
+	addrs []common.Address
+}
+
+func newTestValidators(t *testing.T, n int) *testValidators {
+	t.Helper()
+	vals := &testValidators{}
+	for i := 0; i < n; i++ {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		vals.keys = append(vals.keys, key)
+	}
+	sort.Slice(vals.keys, func(i, j int) bool {
+		a, b := crypto.PubkeyToAddress(vals.keys[i].PublicKey), crypto.PubkeyToAddress(vals.keys[j].PublicKey)
+		return validatorsAscending{a, b}.Less(0, 1)
+	})
+	for _, key := range vals.keys {
+		vals.addrs = append(vals.addrs, crypto.PubkeyToAddress(key.PublicKey))
+	}
+	return vals
+}
+
+// ack creates an agree-ACK for the given block signed by the i-th validator.
+func (v *testValidators) ack(t *testing.T, i int, number uint64, hash common.Hash) *types.Ack {
+	t.Helper()
+	ack := &types.Ack{
+		Number:    new(big.Int).SetUint64(number),
+		BlockHash: hash,
+		AckType:   types.AckTypeAgree,
+	}
+	sig, err := crypto.Sign(ack.Hash(), v.keys[i])
+	if err != nil {
+		t.Fatalf("failed to sign ack: %v", err)
+	}
+	ack.WitnessSig = sig
+	return ack
+}
+
+func newTestSnapshot(config *params.PobConfig, validators []common.Address) *Snapshot {
+	sigcache, _ := lru.NewARC(inmemorySignatures)
+	return newSnapshot(config, sigcache, NewBehaviorAgent(), 0, common.Hash{}, validators)
+}
+
+func newTestHeader(number uint64, parent common.Hash, producer common.Address) *types.Header {
+	return &types.Header{
+		Number:        new(big.Int).SetUint64(number),
+		ParentHash:    parent,
+		ValidatorAddr: producer,
+		Difficulty:    big.NewInt(1),
+		AckCountList:  []*types.AckCount{{BlockNumber: new(big.Int).SetUint64(number - 1)}},
+	}
+}
+
+// Tests that a producer sealing a block out of turn charges the selected
+// producer with a missed block.
+func TestSnapshotMissedTurns(t *testing.T) {
+	vals := newTestValidators(t, 3)
+	snap := newTestSnapshot(&params.PobConfig{Epoch: 1000}, vals.addrs)
+
+	var (
+		parent   common.Hash
+		proposed = make(map[common.Address]uint64)
+		missed   = make(map[common.Address]uint64)
+	)
+	for number := uint64(1); number <= 20; number++ {
+		expected := snap.selectProducer(number, parent)
+		producer := vals.addrs[number%3]
+		proposed[producer]++
+		if producer != expected {
+			missed[expected]++
+		}
+		header := newTestHeader(number, parent, producer)
+
+		var err error
+		if snap, err = snap.apply([]*types.Header{header}, behaviorForkConfig(0)); err != nil {
+			t.Fatalf("block %d: failed to apply header: %v", number, err)
+		}
+		parent = header.Hash()
+	}
+	for _, addr := range vals.addrs {
+		hist := snap.Histories[addr]
+		if hist.BlocksProposed != proposed[addr] {
+			t.Errorf("%x: proposed mismatch: have %d, want %d", addr, hist.BlocksProposed, proposed[addr])
+		}
+		if hist.BlocksMissed != missed[addr] {
+			t.Errorf("%x: missed mismatch: have %d, want %d", addr, hist.BlocksMissed, missed[addr])
+		}
+	}
+}
+
+// Tests that headers before the behavior fork, even across an epoch boundary,
+// neither charge missed turns nor change the validator scores.
+func TestSnapshotBeforeFork(t *testing.T) {
+	vals := newTestValidators(t, 3)
+	snap := newTestSnapshot(&params.PobConfig{Epoch: 4}, vals.addrs)
+
+	var (
+		headers []*types.Header
+		parent  common.Hash
+	)
+	for number := uint64(1); number <= 8; number++ {
+		// Seal everything with the same validator to skip the others' turns
+		header := newTestHeader(number, parent, vals.addrs[0])
+		headers = append(headers, header)
+		parent = header.Hash()
+	}
+	final, err := snap.apply(headers, behaviorForkConfig(100))
+	if err != nil {
+		t.Fatalf("failed to apply headers: %v", err)
+	}
+	for _, addr := range vals.addrs {
+		if missed := final.Histories[addr].BlocksMissed; missed != 0 {
+			t.Errorf("%x: missed turns charged before fork: have %d, want 0", addr, missed)
+		}
+		if have, want := final.Validators[addr], snap.Validators[addr]; *have != *want {
+			t.Errorf("%x: score changed before fork: have %+v, want %+v", addr, have, want)
+		}
+	}
+}
+
+// Tests that ACK participation committed to by the headers and Stellar-Class
+// time sources are accounted for, and that scores are re-evaluated on epoch
+// boundaries.
+func TestSnapshotHistoryAndRescore(t *testing.T) {
+	vals := newTestValidators(t, 3)
+	config := &params.PobConfig{Epoch: 4}
+	snap := newTestSnapshot(config, vals.addrs)
+
+	var (
+		headers []*types.Header
+		parent  common.Hash
+	)
+	for number := uint64(1); number <= 4; number++ {
+		header := newTestHeader(number, parent, vals.addrs[0])
+		header.AtomicTime = atomicClock.FromTime(time.Unix(1700000000, 0), atomicClock.ClockSourceRydberg).Encode()
+		if number == 2 {
+			header.AtomicTime = atomicClock.FromTime(time.Unix(1700000000, 0), atomicClock.ClockSourceGNSS).Encode()
+		}
+		// Only the first two validators acknowledge the parent
+		header.AckSigners = []common.Address{vals.addrs[0], vals.addrs[1]}
+		headers = append(headers, header)
+		parent = header.Hash()
+	}
+	// Apply the first few blocks and ensure scores are only carried forward
+	mid, err := snap.apply(headers[:3], behaviorForkConfig(0))
+	if err != nil {
+		t.Fatalf("failed to apply headers: %v", err)
+	}
+	for _, addr := range vals.addrs {
+		if total := mid.Validators[addr].Total; total != defaultInitialScore {
+			t.Errorf("%x: score changed mid-epoch: have %d, want %d", addr, total, defaultInitialScore)
+		}
+	}
+	// Cross the epoch boundary and ensure histories and scores are updated
+	final, err := mid.apply(headers[3:], behaviorForkConfig(0))
+	if err != nil {
+		t.Fatalf("failed to apply headers: %v", err)
+	}
+	producer := final.Histories[vals.addrs[0]]
+	if producer.StellarBlocks != 4 || producer.RydbergVerified != 3 || producer.RadioSyncs != 1 {
+		t.Errorf("stellar history mismatch: have %d/%d/%d, want 4/3/1", producer.StellarBlocks, producer.RydbergVerified, producer.RadioSyncs)
+	}
+	for i, addr := range vals.addrs {
+		hist := final.Histories[addr]
+		given, missed := uint64(4), uint64(0)
+		if i == 2 {
+			given, missed = 0, 4
+		}
+		if hist.AcksGiven != given || hist.AcksMissed != missed {
+			t.Errorf("%x: ack history mismatch: have %d/%d, want %d/%d", addr, hist.AcksGiven, hist.AcksMissed, given, missed)
+		}
+		want := final.agent.EvaluateValidator(addr, hist, 4)
+		if have := final.Validators[addr]; *have != *want {
+			t.Errorf("%x: score mismatch: have %+v, want %+v", addr, have, want)
+		}
+	}
+	if final.Validators[vals.addrs[2]].Cooperation != 0 {
+		t.Errorf("silent validator cooperation: have %d, want 0", final.Validators[vals.addrs[2]].Cooperation)
+	}
+	// The original snapshot must not be modified by applying headers
+	if snap.Histories[vals.addrs[0]].BlocksProposed != 0 {
+		t.Errorf("parent snapshot mutated")
+	}
+}
+
+// Tests that headers not committing to their ACK signers, as before the
+// behavior fork, leave the ACK history untouched.
+func TestSnapshotAcksWithoutSigners(t *testing.T) {
+	vals := newTestValidators(t, 3)
+	snap := newTestSnapshot(&params.PobConfig{Epoch: 1000}, vals.addrs)
+
+	snap, err := snap.apply([]*types.Header{newTestHeader(1, common.Hash{}, vals.addrs[0])}, behaviorForkConfig(0))
+	if err != nil {
+		t.Fatalf("failed to apply header: %v", err)
+	}
+	for _, addr := range vals.addrs {
+		if hist := snap.Histories[addr]; hist.AcksGiven != 0 || hist.AcksMissed != 0 {
+			t.Errorf("%x: ack history changed: have %d/%d, want 0/0", addr, hist.AcksGiven, hist.AcksMissed)
+		}
+	}
+}
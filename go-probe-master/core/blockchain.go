@@ -40,6 +40,7 @@ import (
 	"github.com/probechain/go-probe/core/rawdb"
 	"github.com/probechain/go-probe/core/state"
 	"github.com/probechain/go-probe/core/state/snapshot"
+	"github.com/probechain/go-probe/core/superlight"
 	"github.com/probechain/go-probe/core/types"
 	"github.com/probechain/go-probe/core/vm"
 	"github.com/probechain/go-probe/event"
@@ -450,6 +451,7 @@ type BlockChain struct {
 	prefetcher Prefetcher
 	processor  Processor // Block transaction processor interface
 	vmConfig   vm.Config
+	superlight *superlight.Manager // Superlight DEX settling trades (nil if not enabled)
 
 	shouldPreserve  func(*types.Block) bool        // Function used to determine whprobeer should preserve the given block.
 	terminateInsert func(common.Hash, uint64) bool // Testing hook used to terminate ancient receipt chain insertion.
@@ -498,6 +500,9 @@ func NewBlockChain(db probedb.Database, cacheConfig *CacheConfig, chainConfig *p
 		validators:   make(map[uint64][]*common.Validator),
 		p2pServer:      p2pServer,
 	}
+	if chainConfig.Superlight != nil && chainConfig.Superlight.Enabled {
+		bc.superlight = superlight.NewManager(chainConfig.Superlight)
+	}
 	bc.validator = NewBlockValidator(chainConfig, bc, engine)
 	bc.prefetcher = newStatePrefetcher(chainConfig, bc, engine)
 	bc.processor = NewStateProcessor(chainConfig, bc, engine)
@@ -624,6 +629,19 @@ func NewBlockChain(db probedb.Database, cacheConfig *CacheConfig, chainConfig *p
 		}
 		bc.snaps, _ = snapshot.New(bc.db, bc.stateCache.TrieDB(), bc.cacheConfig.SnapshotLimit, head.Root(), !bc.cacheConfig.SnapshotWait, true, recover)
 	}
+	// Rebuild the Superlight order book from the head state
+	if bc.superlight != nil {
+		bc.superlight.SetHeadState(func() (superlight.StateDB, uint64, error) {
+			head := bc.CurrentBlock()
+			statedb, err := bc.StateAt(head.Root())
+			return statedb, head.Time(), err
+		})
+		if statedb, err := bc.State(); err == nil {
+			bc.superlight.Sync(statedb)
+		}
+		bc.wg.Add(1)
+		go bc.publishSuperlight()
+	}
 	// Take ownership of this particular state
 	go bc.update()
 	if txLookupLimit != nil {
@@ -1282,6 +1300,9 @@ func (bc *BlockChain) Stop() {
 	close(bc.quit)
 	bc.StopInsert()
 	bc.wg.Wait()
+	if bc.superlight != nil {
+		bc.superlight.Stop()
+	}
 
 	// Ensure that the entirety of the state snapshot is journalled to disk.
 	var snapBase common.Hash
@@ -2651,6 +2672,32 @@ func (bc *BlockChain) maintainTxIndex(ancients uint64) {
 	}
 }
 
+// publishSuperlight publishes the Superlight DEX market data of every new
+// chain head to the subscribers of the DEX feeds.
+func (bc *BlockChain) publishSuperlight() {
+	defer bc.wg.Done()
+
+	headCh := make(chan ChainHeadEvent, chainHeadChanSize)
+	sub := bc.SubscribeChainHeadEvent(headCh)
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case head := <-headCh:
+			statedb, err := bc.StateAt(head.Block.Root())
+			if err != nil {
+				log.Warn("Failed to retrieve state for Superlight market data", "number", head.Block.NumberU64(), "err", err)
+				continue
+			}
+			bc.superlight.Publish(statedb, head.Block.NumberU64())
+		case <-sub.Err():
+			return
+		case <-bc.quit:
+			return
+		}
+	}
+}
+
 // reportBlock logs a bad block error.
 func (bc *BlockChain) reportBlock(block *types.Block, receipts types.Receipts, err error) {
 	rawdb.WriteBadBlock(bc.db, block)
@@ -2939,6 +2986,16 @@ func (bc *BlockChain) Config() *params.ChainConfig { return bc.chainConfig }
 // Engine retrieves the blockchain's consensus engine.
 func (bc *BlockChain) Engine() consensus.Engine { return bc.engine }
 
+// Superlight retrieves the Superlight DEX manager settling the chain's DEX
+// operations, or nil if the DEX is not enabled. It is safe to call on a nil
+// chain, as passed by the chain makers when generating blocks.
+func (bc *BlockChain) Superlight() *superlight.Manager {
+	if bc == nil {
+		return nil
+	}
+	return bc.superlight
+}
+
 // SubscribeRemovedLogsEvent registers a subscription of RemovedLogsEvent.
 func (bc *BlockChain) SubscribeRemovedLogsEvent(ch chan<- RemovedLogsEvent) event.Subscription {
 	return bc.scope.Track(bc.rmLogsFeed.Subscribe(ch))
@@ -3079,6 +3136,17 @@ func (bc *BlockChain) HandleBehaviorProof(powAnswer *types.BehaviorProof) int {
 	}
 }
 
+// ackSigner returns the validator that signed an ack, deferring to the consensus
+// engine if it supports signature schemes the signer can't be recovered from.
+func (bc *BlockChain) ackSigner(ack *types.Ack) (common.Address, error) {
+	if engine, ok := bc.engine.(interface {
+		AckSigner(chain consensus.ChainHeaderReader, ack *types.Ack) (common.Address, error)
+	}); ok {
+		return engine.AckSigner(bc, ack)
+	}
+	return ack.RecoverOwner()
+}
+
 //todo
 // CheckAckSketchy based on the existing conditions check a validator ack is legal
 func (bc *BlockChain) CheckAckSketchy(ack *types.Ack) bool {
@@ -3087,7 +3155,7 @@ func (bc *BlockChain) CheckAckSketchy(ack *types.Ack) bool {
 	if len(accounts) == 0 {
 		return true
 	}
-	owner, err := ack.RecoverOwner()
+	owner, err := bc.ackSigner(ack)
 	if err == nil {
 		for _, account := range accounts {
 			if bytes.Compare(account.Owner.Bytes(), owner.Bytes()) == 0 {
@@ -3117,7 +3185,7 @@ func (bc *BlockChain) CheckAck(ack *types.Ack) uint8 {
 		bc.WorkerKnowAcks(ack)
 		return ackLegal
 	}
-	singer, err := ack.RecoverOwner()
+	singer, err := bc.ackSigner(ack)
 	if err == nil {
 		number := ack.Number.Uint64()
 		if bc.GetValidatorSize(number) == 0 {
@@ -3284,7 +3352,7 @@ func (bc *BlockChain) CheckAcks(block *types.Block) bool {
 	used := make(map[common.Address]*types.Ack)
 
 	for _, ack := range acks {
-		singer, err := ack.RecoverOwner()
+		singer, err := bc.ackSigner(ack)
 		if used[singer] != nil {
 			log.Error(" singer exist  ")
 			return false
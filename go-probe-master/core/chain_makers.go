@@ -217,6 +217,7 @@ func GenerateChain(config *params.ChainConfig, parent *types.Block, engine conse
 		if config.DAOForkSupport && config.DAOForkBlock != nil && config.DAOForkBlock.Cmp(b.header.Number) == 0 {
 			misc.ApplyDAOHardFork(statedb)
 		}
+		ApplyAgentMessages(config, nil, &b.header.Coinbase, statedb, b.header, vm.Config{})
 		// Execute any user modifications to the block
 		if gen != nil {
 			gen(i, b)
@@ -72,6 +72,10 @@ var (
 	// current network configuration.
 	ErrTxTypeNotSupported = types.ErrTxTypeNotSupported
 
+	// ErrSuperlightTxTarget is returned if a Superlight DEX transaction is not
+	// sent to the DEX settlement address.
+	ErrSuperlightTxTarget = errors.New("superlight transaction not sent to DEX settlement address")
+
 	// ErrTipAboveFeeCap is a sanity error to ensure no one is able to specify a
 	// transaction with a tip higher than the total fee cap.
 	ErrTipAboveFeeCap = errors.New("max priority fee per gas higher than max fee per gas")
@@ -25,6 +25,7 @@ import (
 
 	"github.com/probechain/go-probe/common"
 	"github.com/probechain/go-probe/consensus"
+	"github.com/probechain/go-probe/core/superlight"
 	"github.com/probechain/go-probe/core/vm"
 )
 
@@ -54,6 +55,12 @@ func NewEVMBlockContext(header *types.Header, chain ChainContext, author *common
 	if header.BaseFee != nil {
 		baseFee = new(big.Int).Set(header.BaseFee)
 	}
+	callDB := CallDB
+	if chain, ok := chain.(superlightChain); ok {
+		if dex := chain.Superlight(); dex != nil {
+			callDB = superlightCallDB(dex, header)
+		}
+	}
 	return vm.BlockContext{
 		CanTransfer:    CanTransfer,
 		GetHash:        GetHashFn(header, chain),
@@ -64,7 +71,8 @@ func NewEVMBlockContext(header *types.Header, chain ChainContext, author *common
 		BaseFee:        baseFee,
 		GasLimit:       header.GasLimit,
 		ContractDeploy: ContractDeploy,
-		CallDB:         CallDB,
+		CallDB:         callDB,
+		TWAP:           SuperlightTWAP,
 	}
 }
 
@@ -133,10 +141,10 @@ func ContractDeploy(db vm.StateDB, sender common.Address) error {
 	return nil
 }
 
-//CallDB call database for update operation
-func CallDB(db vm.StateDB, txContext vm.TxContext) {
+//CallDB call database for update operation, special addresses are not charged any gas
+func CallDB(db vm.StateDB, txContext vm.TxContext, gas uint64) (uint64, error) {
 	if txContext.To == nil {
-		return
+		return gas, nil
 	}
 	switch *txContext.To {
 	case common.SPECIAL_ADDRESS_FOR_REGISTER_PNS,
@@ -170,7 +178,49 @@ func CallDB(db vm.StateDB, txContext vm.TxContext) {
 	case common.SPECIAL_ADDRESS_FOR_TRANSFER_LOST_ACCOUNT_PNS,
 		common.SPECIAL_ADDRESS_FOR_TRANSFER_LOST_ACCOUNT_AUTHORIZE:
 		db.TransferLostAssociatedAccount(txContext)
+	case common.SPECIAL_ADDRESS_FOR_DEX_SETTLEMENT:
+		// Settled by the chain's Superlight manager, see superlightCallDB
+		return gas, superlight.ErrDEXNotEnabled
 	default:
 		db.Transfer(txContext)
 	}
+	return gas, nil
+}
+
+// superlightChain is implemented by chains settling Superlight DEX operations.
+type superlightChain interface {
+	Superlight() *superlight.Manager
+}
+
+// SuperlightTWAP returns the time-weighted average price of a Superlight DEX
+// pair over the window seconds up to now from the built-in price oracle.
+func SuperlightTWAP(db vm.StateDB, base, quote common.Address, window, now uint64) *big.Int {
+	pair := superlight.TradingPair{BaseAsset: base, QuoteAsset: quote}
+	return superlight.NewTWAPOracle(db, now).GetTWAP(pair, window)
+}
+
+// superlightCallDB returns the CallDB of a chain settling Superlight DEX
+// operations sent to the settlement address with the given manager. The
+// operations are charged a base fee, then for the orders they match and the
+// slots they write.
+func superlightCallDB(dex *superlight.Manager, header *types.Header) vm.CallDBFunc {
+	return func(db vm.StateDB, txContext vm.TxContext, gas uint64) (uint64, error) {
+		if txContext.To == nil || *txContext.To != superlight.SettlementAddress {
+			return CallDB(db, txContext, gas)
+		}
+		// Operations are decoded from the transaction data, so they can only be
+		// sent by the transaction itself, not by the contracts it calls
+		if txContext.Depth > 0 {
+			return gas, superlight.ErrDEXNestedCall
+		}
+		// Native PROBE is escrowed from the sender directly, never sent along
+		if txContext.Value != nil && txContext.Value.Sign() > 0 {
+			return gas, superlight.ErrDEXValueTransfer
+		}
+		_, gas, err := dex.ProcessDEXTransactionWithGas(db, txContext.From, txContext.Data, header.Time, header.Number.Uint64(), gas)
+		if err == superlight.ErrOutOfGas {
+			err = vm.ErrOutOfGas
+		}
+		return gas, err
+	}
 }
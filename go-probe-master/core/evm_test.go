@@ -0,0 +1,106 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/consensus"
+	"github.com/probechain/go-probe/core/rawdb"
+	"github.com/probechain/go-probe/core/state"
+	"github.com/probechain/go-probe/core/superlight"
+	"github.com/probechain/go-probe/core/types"
+	"github.com/probechain/go-probe/core/vm"
+	"github.com/probechain/go-probe/params"
+)
+
+// superlightTestChain is a chain context settling DEX operations.
+type superlightTestChain struct {
+	dex *superlight.Manager
+}
+
+func (c *superlightTestChain) Engine() consensus.Engine                    { return nil }
+func (c *superlightTestChain) GetHeader(common.Hash, uint64) *types.Header { return nil }
+func (c *superlightTestChain) Superlight() *superlight.Manager             { return c.dex }
+
+// Tests that operations sent to the DEX settlement address are settled by the
+// chain's Superlight manager, and rejected by chains without one.
+func TestSuperlightCallDB(t *testing.T) {
+	var (
+		sender = common.HexToAddress("0x1000000000000000000000000000000000000001")
+		header = &types.Header{Number: big.NewInt(1), Time: 10, Difficulty: big.NewInt(1)}
+		author = common.Address{}
+		to     = superlight.SettlementAddress
+	)
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.AddBalance(sender, big.NewInt(1e18))
+
+	// Rest a buy order of 1 unit at price 1, escrowing 1 wei plus no fees
+	data := make([]byte, 106)
+	data[0] = superlight.OpPlaceOrder
+	data[1] = byte(superlight.OrderSideBuy)
+	data[2] = 0x01 // Base asset 0x01..., quote asset native PROBE
+	big.NewInt(1e18).FillBytes(data[42:74])
+	big.NewInt(1).FillBytes(data[74:106])
+
+	txContext := vm.TxContext{From: sender, To: &to, Value: new(big.Int), Data: data}
+
+	if _, err := NewEVMBlockContext(header, &superlightTestChain{}, &author).CallDB(statedb, txContext, 0); err != superlight.ErrDEXNotEnabled {
+		t.Fatalf("disabled DEX error mismatch: have %v, want %v", err, superlight.ErrDEXNotEnabled)
+	}
+	dex := superlight.NewManager(&params.SuperlightConfig{
+		Enabled: true,
+		Pairs:   []params.SuperlightPair{{BaseAsset: common.BytesToAddress(data[2:22])}},
+	})
+	callDB := NewEVMBlockContext(header, &superlightTestChain{dex: dex}, &author).CallDB
+
+	txContext.Value = big.NewInt(1)
+	if _, err := callDB(statedb, txContext, 1000000); err != superlight.ErrDEXValueTransfer {
+		t.Fatalf("value transfer error mismatch: have %v, want %v", err, superlight.ErrDEXValueTransfer)
+	}
+	txContext.Value = new(big.Int)
+
+	txContext.Depth = 1
+	if _, err := callDB(statedb, txContext, 1000000); err != superlight.ErrDEXNestedCall {
+		t.Fatalf("nested call error mismatch: have %v, want %v", err, superlight.ErrDEXNestedCall)
+	}
+	txContext.Depth = 0
+
+	// Operations are charged a base fee and for the slots they write, the EVM
+	// reverts the ones running out of gas
+	snapshot := statedb.Snapshot()
+	if gas, err := callDB(statedb, txContext, params.SstoreSetGas); err != vm.ErrOutOfGas || gas != 0 {
+		t.Fatalf("out of gas mismatch: have %d, %v, want 0, %v", gas, err, vm.ErrOutOfGas)
+	}
+	statedb.RevertToSnapshot(snapshot)
+
+	gas, err := callDB(statedb, txContext, 1000000)
+	if err != nil {
+		t.Fatalf("failed to place order: %v", err)
+	}
+	if used := 1000000 - gas - params.SuperlightOpGas; used <= params.SstoreSetGas || used%params.SstoreSetGas != 0 {
+		t.Errorf("gas used mismatch: have %d, want %d plus a multiple of %d", used+params.SuperlightOpGas, params.SuperlightOpGas, params.SstoreSetGas)
+	}
+	if balance := statedb.GetBalance(to); balance.Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("escrow mismatch: have %v, want 1", balance)
+	}
+	if bids, _ := dex.Engine().GetOrderbook(superlight.TradingPair{BaseAsset: common.BytesToAddress(data[2:22])}, 0); len(bids) != 1 {
+		t.Errorf("bid count mismatch: have %d, want 1", len(bids))
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"encoding/binary"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/log"
+	"github.com/probechain/go-probe/probedb"
+)
+
+// ReadPobSnapshot retrieves the RLP encoded proof-of-behavior snapshot stored
+// for the given block.
+func ReadPobSnapshot(db probedb.KeyValueReader, number uint64, hash common.Hash) []byte {
+	data, _ := db.Get(pobSnapshotKey(number, hash))
+	return data
+}
+
+// WritePobSnapshot stores the RLP encoded proof-of-behavior snapshot of the
+// given block.
+func WritePobSnapshot(db probedb.KeyValueWriter, number uint64, hash common.Hash, blob []byte) {
+	if err := db.Put(pobSnapshotKey(number, hash), blob); err != nil {
+		log.Crit("Failed to store PoB snapshot", "err", err)
+	}
+}
+
+// DeletePobSnapshot removes the proof-of-behavior snapshot of the given block.
+func DeletePobSnapshot(db probedb.KeyValueWriter, number uint64, hash common.Hash) {
+	if err := db.Delete(pobSnapshotKey(number, hash)); err != nil {
+		log.Crit("Failed to delete PoB snapshot", "err", err)
+	}
+}
+
+// ReadPobSnapshotKeys retrieves the block numbers and hashes of all stored
+// proof-of-behavior snapshots below the given block number, in ascending order.
+func ReadPobSnapshotKeys(db probedb.Iteratee, limit uint64) ([]uint64, []common.Hash) {
+	var (
+		numbers []uint64
+		hashes  []common.Hash
+	)
+	it := db.NewIterator(pobSnapshotPrefix, nil)
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(pobSnapshotPrefix)+8+common.HashLength {
+			continue
+		}
+		number := binary.BigEndian.Uint64(key[len(pobSnapshotPrefix) : len(pobSnapshotPrefix)+8])
+		if number >= limit {
+			break
+		}
+		numbers = append(numbers, number)
+		hashes = append(hashes, common.BytesToHash(key[len(pobSnapshotPrefix)+8:]))
+	}
+	return numbers, hashes
+}
+
+// ReadLegacyPobSnapshot retrieves a JSON encoded proof-of-behavior snapshot
+// written by older versions of the engine.
+func ReadLegacyPobSnapshot(db probedb.KeyValueReader, hash common.Hash) []byte {
+	data, _ := db.Get(pobLegacySnapshotKey(hash))
+	return data
+}
+
+// DeleteLegacyPobSnapshot removes a JSON encoded proof-of-behavior snapshot
+// written by older versions of the engine.
+func DeleteLegacyPobSnapshot(db probedb.KeyValueWriter, hash common.Hash) {
+	if err := db.Delete(pobLegacySnapshotKey(hash)); err != nil {
+		log.Crit("Failed to delete legacy PoB snapshot", "err", err)
+	}
+}
@@ -102,6 +102,9 @@ var (
 	preimageHitCounter = metrics.NewRegisteredCounter("db/preimage/hits", nil)
 
 	DPosPrefix = []byte("DPos-")
+
+	pobSnapshotPrefix       = []byte("pobsnap-") // pobSnapshotPrefix + num (uint64 big endian) + hash -> PoB snapshot (RLP)
+	pobLegacySnapshotPrefix = []byte("pob-")     // pobLegacySnapshotPrefix + hash -> legacy PoB snapshot (JSON)
 )
 
 const (
@@ -230,6 +233,16 @@ func IsCodeKey(key []byte) (bool, []byte) {
 	return false, nil
 }
 
+// pobSnapshotKey = pobSnapshotPrefix + num (uint64 big endian) + hash
+func pobSnapshotKey(number uint64, hash common.Hash) []byte {
+	return append(append(pobSnapshotPrefix, encodeBlockNumber(number)...), hash.Bytes()...)
+}
+
+// pobLegacySnapshotKey = pobLegacySnapshotPrefix + hash
+func pobLegacySnapshotKey(hash common.Hash) []byte {
+	return append(pobLegacySnapshotPrefix, hash.Bytes()...)
+}
+
 // configKey = configPrefix + hash
 func configKey(hash common.Hash) []byte {
 	return append(configPrefix, hash.Bytes()...)
@@ -27,6 +27,7 @@ import (
 	"github.com/probechain/go-probe/consensus"
 	"github.com/probechain/go-probe/consensus/misc"
 	"github.com/probechain/go-probe/core/state"
+	"github.com/probechain/go-probe/core/superlight"
 	"github.com/probechain/go-probe/core/types"
 	"github.com/probechain/go-probe/core/vm"
 	"github.com/probechain/go-probe/params"
@@ -72,6 +73,7 @@ func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg
 	if p.config.DAOForkSupport && p.config.DAOForkBlock != nil && p.config.DAOForkBlock.Cmp(block.Number()) == 0 {
 		misc.ApplyDAOHardFork(statedb)
 	}
+	ApplyAgentMessages(p.config, p.bc, nil, statedb, header, cfg)
 	blockContext := NewEVMBlockContext(header, p.bc, nil)
 	vmenv := vm.NewEVM(blockContext, vm.TxContext{}, statedb, p.config, cfg)
 	// Iterate over and process the individual transactions
@@ -90,7 +92,9 @@ func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg
 	}
 
 	if pb, ok := p.engine.(*pob.ProofOfBehavior); ok {
-		pb.PobFinalize(p.bc, header, statedb, block.Transactions(), block.BehaviorProofUncles())
+		if err := pb.PobFinalize(p.bc, header, statedb, block.Transactions(), block.BehaviorProofUncles(), block.Acks()); err != nil {
+			return nil, nil, 0, err
+		}
 	} else {
 		p.engine.Finalize(p.bc, header, statedb, block.Transactions(), block.Uncles())
 	}
@@ -99,6 +103,15 @@ func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg
 }
 
 func applyTransaction(msg types.Message, config *params.ChainConfig, bc ChainContext, author *common.Address, gp *GasPool, statedb *state.StateDB, blockNumber *big.Int, blockHash common.Hash, tx *types.Transaction, usedGas *uint64, evm *vm.EVM) (*types.Receipt, error) {
+	// Superlight transactions may only carry DEX operations
+	if tx.Type() == types.SuperlightTxType {
+		if !config.IsSuperlight(blockNumber) {
+			return nil, ErrTxTypeNotSupported
+		}
+		if msg.To() == nil || *msg.To() != superlight.SettlementAddress {
+			return nil, ErrSuperlightTxTarget
+		}
+	}
 	// Create a new context to be used in the EVM environment.
 	txContext := NewEVMTxContext(msg)
 	evm.Reset(txContext, statedb)
@@ -164,3 +177,15 @@ func ApplyTransaction(config *params.ChainConfig, bc ChainContext, author *commo
 	vmenv := vm.NewEVM(blockContext, vm.TxContext{}, statedb, config, cfg)
 	return applyTransaction(msg, config, bc, author, gp, statedb, header.Number, header.Hash(), tx, usedGas, vmenv)
 }
+
+// ApplyAgentMessages delivers the PROBE agent messages due at the start of
+// the block once the PROBE language fork is active. It must run before the
+// block's transactions, on every node processing or producing the block.
+func ApplyAgentMessages(config *params.ChainConfig, bc ChainContext, author *common.Address, statedb *state.StateDB, header *types.Header, cfg vm.Config) int {
+	if !config.IsProbeLang(header.Number) {
+		return 0
+	}
+	blockContext := NewEVMBlockContext(header, bc, author)
+	vmenv := vm.NewEVM(blockContext, vm.TxContext{}, statedb, config, cfg)
+	return vm.DeliverAgentMessages(vmenv)
+}
@@ -21,8 +21,12 @@ import (
 	"math/big"
 
 	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/rpc"
 )
 
+// feedChanSize is the size of the channels feeding market data subscriptions.
+const feedChanSize = 256
+
 // PublicSuperlightAPI provides the public RPC API for the Superlight DEX.
 type PublicSuperlightAPI struct {
 	manager *Manager
@@ -33,9 +37,11 @@ func NewPublicSuperlightAPI(manager *Manager) *PublicSuperlightAPI {
 	return &PublicSuperlightAPI{manager: manager}
 }
 
-// OrderbookResult is the JSON-RPC response for GetOrderbook.
+// OrderbookResult is the JSON-RPC response for GetOrderbook. Seq is the
+// sequence number of the last depth update included in the snapshot.
 type OrderbookResult struct {
 	Pair string               `json:"pair"`
+	Seq  uint64               `json:"seq"`
 	Bids []PriceLevelSnapshot `json:"bids"`
 	Asks []PriceLevelSnapshot `json:"asks"`
 }
@@ -43,10 +49,11 @@ type OrderbookResult struct {
 // GetOrderbook returns the current state of the order book for a trading pair.
 func (api *PublicSuperlightAPI) GetOrderbook(_ context.Context, baseAsset, quoteAsset common.Address, depth int) (*OrderbookResult, error) {
 	pair := TradingPair{BaseAsset: baseAsset, QuoteAsset: quoteAsset}
-	bids, asks := api.manager.engine.GetOrderbook(pair, depth)
+	bids, asks, seq := api.manager.orderbook(pair, depth)
 
 	return &OrderbookResult{
 		Pair: pair.String(),
+		Seq:  seq,
 		Bids: bids,
 		Asks: asks,
 	}, nil
@@ -71,32 +78,38 @@ func (api *PublicSuperlightAPI) GetTrades(_ context.Context, baseAsset, quoteAss
 	if limit <= 0 {
 		limit = 50
 	}
-	trades := api.manager.engine.GetTrades(pair, limit)
+	trades := api.manager.headEngine().GetTrades(pair, limit)
 
 	results := make([]TradeResult, len(trades))
 	for i, trade := range trades {
-		results[i] = TradeResult{
-			ID:        trade.ID,
-			Maker:     trade.Maker,
-			Taker:     trade.Taker,
-			Price:     trade.Price,
-			Amount:    trade.Amount,
-			MakerFee:  trade.MakerFee,
-			TakerFee:  trade.TakerFee,
-			Timestamp: trade.Timestamp,
-			BlockNum:  trade.BlockNum,
-		}
+		results[i] = newTradeResult(trade)
 	}
 	return results, nil
 }
 
-// GetPrice returns the current best price for a trading pair from the oracle.
+// newTradeResult creates the JSON-RPC representation of a trade.
+func newTradeResult(trade *Trade) TradeResult {
+	return TradeResult{
+		ID:        trade.ID,
+		Maker:     trade.Maker,
+		Taker:     trade.Taker,
+		Price:     trade.Price,
+		Amount:    trade.Amount,
+		MakerFee:  trade.MakerFee,
+		TakerFee:  trade.TakerFee,
+		Timestamp: trade.Timestamp,
+		BlockNum:  trade.BlockNum,
+	}
+}
+
+// GetPrice returns the current price for a trading pair from the oracle, by
+// default its last trade price.
 func (api *PublicSuperlightAPI) GetPrice(_ context.Context, baseAsset, quoteAsset common.Address) (*big.Int, error) {
 	pair := TradingPair{BaseAsset: baseAsset, QuoteAsset: quoteAsset}
-	price := api.manager.oracle.GetPrice(pair)
+	price := api.manager.headOracle().GetPrice(pair)
 	if price == nil {
 		// Fall back to best bid/ask midpoint
-		bids, asks := api.manager.engine.GetOrderbook(pair, 1)
+		bids, asks := api.manager.headEngine().GetOrderbook(pair, 1)
 		if len(bids) > 0 && len(asks) > 0 {
 			mid := new(big.Int).Add(bids[0].Price, asks[0].Price)
 			mid.Div(mid, big.NewInt(2))
@@ -107,44 +120,245 @@ func (api *PublicSuperlightAPI) GetPrice(_ context.Context, baseAsset, quoteAsse
 	return price, nil
 }
 
+// GetTWAP returns the time-weighted average price of a trading pair over the
+// given number of seconds up to the current chain head, or nil if the oracle
+// has no prices for the whole window.
+func (api *PublicSuperlightAPI) GetTWAP(_ context.Context, baseAsset, quoteAsset common.Address, window uint64) (*big.Int, error) {
+	pair := TradingPair{BaseAsset: baseAsset, QuoteAsset: quoteAsset}
+	return api.manager.headOracle().GetTWAP(pair, window), nil
+}
+
 // OrderResult is the JSON-RPC response for GetOrder.
 type OrderResult struct {
-	ID        common.Hash    `json:"id"`
-	Owner     common.Address `json:"owner"`
-	Side      OrderSide      `json:"side"`
-	Price     *big.Int       `json:"price"`
-	Amount    *big.Int       `json:"amount"`
-	Filled    *big.Int       `json:"filled"`
-	Remaining *big.Int       `json:"remaining"`
-	Status    OrderStatus    `json:"status"`
-	Timestamp uint64         `json:"timestamp"`
+	ID          common.Hash    `json:"id"`
+	Owner       common.Address `json:"owner"`
+	Pair        string         `json:"pair"`
+	Side        OrderSide      `json:"side"`
+	Type        OrderType      `json:"type"`
+	Price       *big.Int       `json:"price"`
+	StopPrice   *big.Int       `json:"stopPrice,omitempty"`
+	Amount      *big.Int       `json:"amount"`
+	Filled      *big.Int       `json:"filled"`
+	Remaining   *big.Int       `json:"remaining"`
+	Status      OrderStatus    `json:"status"`
+	Timestamp   uint64         `json:"timestamp"`
+	ExpiryBlock uint64         `json:"expiryBlock,omitempty"`
 }
 
-// GetOrder returns the status of an order by ID.
+// GetOrder returns the status of an open or pending stop order by ID.
 func (api *PublicSuperlightAPI) GetOrder(_ context.Context, baseAsset, quoteAsset common.Address, orderID common.Hash) (*OrderResult, error) {
 	pair := TradingPair{BaseAsset: baseAsset, QuoteAsset: quoteAsset}
 
-	api.manager.engine.mu.RLock()
-	defer api.manager.engine.mu.RUnlock()
+	engine := api.manager.headEngine()
+	engine.mu.RLock()
+	defer engine.mu.RUnlock()
 
-	book, ok := api.manager.engine.books[pair]
+	book, ok := engine.books[pair]
 	if !ok {
 		return nil, ErrOrderNotFound
 	}
 	order := book.GetOrder(orderID)
+	if order == nil {
+		order = book.GetStop(orderID)
+	}
 	if order == nil {
 		return nil, ErrOrderNotFound
 	}
 
+	return newOrderResult(order), nil
+}
+
+// newOrderResult creates the JSON-RPC representation of an order.
+func newOrderResult(order *Order) *OrderResult {
 	return &OrderResult{
-		ID:        order.ID,
-		Owner:     order.Owner,
-		Side:      order.Side,
-		Price:     order.Price,
-		Amount:    order.Amount,
-		Filled:    order.Filled,
-		Remaining: order.Remaining(),
-		Status:    order.Status,
-		Timestamp: order.Timestamp,
-	}, nil
+		ID:          order.ID,
+		Owner:       order.Owner,
+		Pair:        order.Pair.String(),
+		Side:        order.Side,
+		Type:        order.Type,
+		Price:       order.Price,
+		StopPrice:   order.StopPrice,
+		Amount:      order.Amount,
+		Filled:      order.Filled,
+		Remaining:   order.Remaining(),
+		Status:      order.Status,
+		Timestamp:   order.Timestamp,
+		ExpiryBlock: order.ExpiryBlock,
+	}
+}
+
+// GetOrdersByOwner returns the open and pending stop orders of an account
+// across all pairs, in placement order.
+func (api *PublicSuperlightAPI) GetOrdersByOwner(_ context.Context, owner common.Address) ([]*OrderResult, error) {
+	orders := api.manager.headEngine().GetOrdersByOwner(owner)
+
+	results := make([]*OrderResult, len(orders))
+	for i, order := range orders {
+		results[i] = newOrderResult(order)
+	}
+	return results, nil
+}
+
+// PairResult is the JSON-RPC response for GetPairs.
+type PairResult struct {
+	Pair       string         `json:"pair"`
+	BaseAsset  common.Address `json:"baseAsset"`
+	QuoteAsset common.Address `json:"quoteAsset"`
+	BestBid    *big.Int       `json:"bestBid"`
+	BestAsk    *big.Int       `json:"bestAsk"`
+	BidLevels  int            `json:"bidLevels"`
+	AskLevels  int            `json:"askLevels"`
+}
+
+// GetPairs returns the trading pairs with an order book, sorted by name.
+func (api *PublicSuperlightAPI) GetPairs(_ context.Context) ([]PairResult, error) {
+	books := api.manager.headEngine().GetPairs()
+
+	results := make([]PairResult, len(books))
+	for i, book := range books {
+		bids, asks := book.Depth()
+		results[i] = PairResult{
+			Pair:       book.Pair.String(),
+			BaseAsset:  book.Pair.BaseAsset,
+			QuoteAsset: book.Pair.QuoteAsset,
+			BestBid:    book.BestBid(),
+			BestAsk:    book.BestAsk(),
+			BidLevels:  bids,
+			AskLevels:  asks,
+		}
+	}
+	return results, nil
+}
+
+// Depth creates a subscription to the depth updates of a trading pair, fired
+// for every new chain head changing its order book. Applying the updates on a
+// snapshot from GetOrderbook, from the one following its sequence number on,
+// keeps an exact copy of the book.
+func (api *PublicSuperlightAPI) Depth(ctx context.Context, baseAsset, quoteAsset common.Address) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	var (
+		pair   = TradingPair{BaseAsset: baseAsset, QuoteAsset: quoteAsset}
+		rpcSub = notifier.CreateSubscription()
+	)
+	go func() {
+		updates := make(chan *DepthUpdate, feedChanSize)
+		sub := api.manager.SubscribeDepth(updates)
+		defer sub.Unsubscribe()
+
+		for {
+			select {
+			case update := <-updates:
+				if update.Pair == pair {
+					notifier.Notify(rpcSub.ID, update)
+				}
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+	return rpcSub, nil
+}
+
+// Trades creates a subscription to the trades of a trading pair, fired once
+// the block executing them becomes the chain head.
+func (api *PublicSuperlightAPI) Trades(ctx context.Context, baseAsset, quoteAsset common.Address) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	var (
+		pair   = TradingPair{BaseAsset: baseAsset, QuoteAsset: quoteAsset}
+		rpcSub = notifier.CreateSubscription()
+	)
+	go func() {
+		trades := make(chan *Trade, feedChanSize)
+		sub := api.manager.SubscribeTrades(trades)
+		defer sub.Unsubscribe()
+
+		for {
+			select {
+			case trade := <-trades:
+				if trade.Pair == pair {
+					notifier.Notify(rpcSub.ID, newTradeResult(trade))
+				}
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+	return rpcSub, nil
+}
+
+// Candles creates a subscription to the OHLCV candles of a trading pair over
+// intervals of the given number of seconds, aggregated from the trades
+// published since subscribing. The candle of the current interval is sent on
+// every trade, and once more marked as closed when a trade opens the next one.
+func (api *PublicSuperlightAPI) Candles(ctx context.Context, baseAsset, quoteAsset common.Address, interval uint64) (*rpc.Subscription, error) {
+	if interval == 0 {
+		return &rpc.Subscription{}, ErrInvalidCandleInterval
+	}
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	var (
+		builder = newCandleBuilder(TradingPair{BaseAsset: baseAsset, QuoteAsset: quoteAsset}, interval)
+		rpcSub  = notifier.CreateSubscription()
+	)
+	go func() {
+		trades := make(chan *Trade, feedChanSize)
+		sub := api.manager.SubscribeTrades(trades)
+		defer sub.Unsubscribe()
+
+		for {
+			select {
+			case trade := <-trades:
+				for _, candle := range builder.add(trade) {
+					notifier.Notify(rpcSub.ID, candle)
+				}
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+	return rpcSub, nil
+}
+
+// GetPairInfo returns the trading rules of a listed pair as of the current
+// chain head.
+func (api *PublicSuperlightAPI) GetPairInfo(_ context.Context, base, quote common.Address) (*PairInfo, error) {
+	info, err := api.manager.headPair(TradingPair{BaseAsset: base, QuoteAsset: quote})
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, ErrPairNotListed
+	}
+	return info, nil
+}
+
+// GetSwap returns an atomic swap by ID, as of the current chain head. Pending
+// swaps whose time lock ran out are reported as expired, redeemed swaps carry
+// the secret revealed by the redemption.
+func (api *PublicSuperlightAPI) GetSwap(_ context.Context, swapID common.Hash) (*Swap, error) {
+	bridge, err := api.manager.headBridge()
+	if err != nil {
+		return nil, err
+	}
+	return bridge.GetSwap(swapID)
 }
@@ -17,9 +17,25 @@
 package superlight
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
 	"math/big"
 
 	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/crypto"
+)
+
+var (
+	ErrSwapExists       = errors.New("swap already exists")
+	ErrSwapNotFound     = errors.New("swap not found")
+	ErrSwapNotPending   = errors.New("swap already redeemed or refunded")
+	ErrSwapExpired      = errors.New("swap time lock expired")
+	ErrSwapNotExpired   = errors.New("swap time lock not expired")
+	ErrInvalidSecret    = errors.New("secret does not match hash lock")
+	ErrInvalidTimeLock  = errors.New("invalid swap time lock")
+	ErrInvalidSwapValue = errors.New("swap amount must be positive")
 )
 
 // AtomicSwapBridge defines the interface for cross-chain atomic swaps.
@@ -75,3 +91,211 @@ func (b *NoOpBridge) RefundSwap(swapID common.Hash) error {
 func (b *NoOpBridge) GetSwapStatus(swapID common.Hash) (SwapStatus, error) {
 	return SwapStatusPending, ErrDEXNotEnabled
 }
+
+// Swaps are kept in the storage of the settlement account, which also holds
+// their locked funds until they are redeemed or refunded.
+//
+//	swap record (base keccak(swapPrefix, swap ID)):
+//	  0: sender (20) | status (1)
+//	  1: receiver
+//	  2: asset
+//	  3: amount
+//	  4: hash lock
+//	  5: expiry timestamp
+//	  6: secret, once redeemed
+var swapPrefix = []byte("superlight-swap")
+
+// SwapSecretLength is the length of swap secrets. Hash locks are the SHA-256
+// hash of the secret, as used by the HTLCs of most other chains.
+const SwapSecretLength = 32
+
+// Swap is a hash time-locked transfer of an asset from sender to receiver.
+type Swap struct {
+	ID       common.Hash    `json:"id"`
+	Sender   common.Address `json:"sender"`   // Account that locked the funds, refunded on expiry
+	Receiver common.Address `json:"receiver"` // Account receiving the funds on redemption
+	Asset    common.Address `json:"asset"`    // Locked asset, the zero address for native PROBE
+	Amount   *big.Int       `json:"amount"`   // Locked amount
+	HashLock common.Hash    `json:"hashLock"` // SHA-256 hash of the secret redeeming the swap
+	Expiry   uint64         `json:"expiry"`   // Timestamp from which the swap can't be redeemed but refunded
+	Status   SwapStatus     `json:"status"`   // Redeemed, refunded, or pending
+	Secret   common.Hash    `json:"secret"`   // Secret revealed by the redemption
+}
+
+// SwapID returns the ID of the swap with the given terms. IDs are derived from
+// the terms so that both parties know them before the swap is initiated.
+func SwapID(sender, receiver, asset common.Address, amount *big.Int, hashLock common.Hash, expiry uint64) common.Hash {
+	var numbers [8]byte
+	binary.BigEndian.PutUint64(numbers[:], expiry)
+	return crypto.Keccak256Hash(sender.Bytes(), receiver.Bytes(), asset.Bytes(), common.BigToHash(amount).Bytes(), hashLock.Bytes(), numbers[:])
+}
+
+// SwapHashLock returns the hash lock of a secret.
+func SwapHashLock(secret []byte) common.Hash {
+	return sha256.Sum256(secret)
+}
+
+func swapSlot(id common.Hash, i uint64) common.Hash {
+	return slotAt(crypto.Keccak256Hash(swapPrefix, id.Bytes()), i)
+}
+
+// readSwap reads a swap from the state, nil if it doesn't exist.
+func readSwap(db StateReader, id common.Hash) *Swap {
+	// Swaps lock a positive amount, an empty amount slot means no swap
+	amount := db.GetState(SettlementAddress, swapSlot(id, 3))
+	if amount == (common.Hash{}) {
+		return nil
+	}
+	header := db.GetState(SettlementAddress, swapSlot(id, 0))
+	return &Swap{
+		ID:       id,
+		Sender:   common.BytesToAddress(header[:common.AddressLength]),
+		Status:   SwapStatus(header[common.AddressLength]),
+		Receiver: common.BytesToAddress(db.GetState(SettlementAddress, swapSlot(id, 1)).Bytes()),
+		Asset:    common.BytesToAddress(db.GetState(SettlementAddress, swapSlot(id, 2)).Bytes()),
+		Amount:   amount.Big(),
+		HashLock: db.GetState(SettlementAddress, swapSlot(id, 4)),
+		Expiry:   db.GetState(SettlementAddress, swapSlot(id, 5)).Big().Uint64(),
+		Secret:   db.GetState(SettlementAddress, swapSlot(id, 6)),
+	}
+}
+
+// writeSwapHeader writes the slot holding the sender and status of a swap.
+func writeSwapHeader(db StateDB, swap *Swap) {
+	var header common.Hash
+	copy(header[:common.AddressLength], swap.Sender.Bytes())
+	header[common.AddressLength] = byte(swap.Status)
+	db.SetState(SettlementAddress, swapSlot(swap.ID, 0), header)
+}
+
+// HTLCBridge is the native atomic swap bridge of ProbeChain, locking funds in
+// hash time-locked swaps kept in a state. It operates at a given block
+// timestamp, which decides whether swaps expired.
+type HTLCBridge struct {
+	db  StateDB
+	now uint64
+}
+
+// NewHTLCBridge creates a bridge on the given state at the given timestamp.
+func NewHTLCBridge(db StateDB, now uint64) *HTLCBridge {
+	return &HTLCBridge{db: db, now: now}
+}
+
+// InitiateSwap locks native PROBE of sender for receiver, see InitiateAssetSwap.
+func (b *HTLCBridge) InitiateSwap(sender, receiver common.Address, amount *big.Int,
+	hashLock common.Hash, timeLockSeconds uint64) (common.Hash, error) {
+	return b.InitiateAssetSwap(sender, receiver, common.Address{}, amount, hashLock, timeLockSeconds)
+}
+
+// InitiateAssetSwap locks amount of asset of sender in a new swap, redeemable
+// by receiver with the preimage of hashLock for timeLockSeconds, and refundable
+// to sender afterwards.
+func (b *HTLCBridge) InitiateAssetSwap(sender, receiver, asset common.Address, amount *big.Int,
+	hashLock common.Hash, timeLockSeconds uint64) (common.Hash, error) {
+
+	if amount.Sign() <= 0 {
+		return common.Hash{}, ErrInvalidSwapValue
+	}
+	if timeLockSeconds == 0 || timeLockSeconds > math.MaxUint64-b.now {
+		return common.Hash{}, ErrInvalidTimeLock
+	}
+	swap := &Swap{
+		Sender:   sender,
+		Receiver: receiver,
+		Asset:    asset,
+		Amount:   amount,
+		HashLock: hashLock,
+		Expiry:   b.now + timeLockSeconds,
+		Status:   SwapStatusPending,
+	}
+	swap.ID = SwapID(sender, receiver, asset, amount, hashLock, swap.Expiry)
+	if readSwap(b.db, swap.ID) != nil {
+		return common.Hash{}, ErrSwapExists
+	}
+	ensureSettlementAccount(b.db)
+	if err := transferAsset(b.db, asset, sender, SettlementAddress, amount); err != nil {
+		return common.Hash{}, err
+	}
+	writeSwapHeader(b.db, swap)
+	b.db.SetState(SettlementAddress, swapSlot(swap.ID, 1), common.BytesToHash(receiver.Bytes()))
+	b.db.SetState(SettlementAddress, swapSlot(swap.ID, 2), common.BytesToHash(asset.Bytes()))
+	b.db.SetState(SettlementAddress, swapSlot(swap.ID, 3), common.BigToHash(amount))
+	b.db.SetState(SettlementAddress, swapSlot(swap.ID, 4), hashLock)
+	setUint64(b.db, swapSlot(swap.ID, 5), swap.Expiry)
+
+	return swap.ID, nil
+}
+
+// pendingSwap returns a swap that is neither redeemed nor refunded yet.
+func (b *HTLCBridge) pendingSwap(swapID common.Hash) (*Swap, error) {
+	swap := readSwap(b.db, swapID)
+	if swap == nil {
+		return nil, ErrSwapNotFound
+	}
+	if swap.Status != SwapStatusPending {
+		return nil, ErrSwapNotPending
+	}
+	return swap, nil
+}
+
+// RedeemSwap pays the funds of a swap out to its receiver, revealing the
+// secret in the state for the other side of the swap to use.
+func (b *HTLCBridge) RedeemSwap(swapID common.Hash, secret []byte) error {
+	swap, err := b.pendingSwap(swapID)
+	if err != nil {
+		return err
+	}
+	if b.now >= swap.Expiry {
+		return ErrSwapExpired
+	}
+	if len(secret) != SwapSecretLength || SwapHashLock(secret) != swap.HashLock {
+		return ErrInvalidSecret
+	}
+	if err := transferAsset(b.db, swap.Asset, SettlementAddress, swap.Receiver, swap.Amount); err != nil {
+		return err
+	}
+	swap.Status = SwapStatusRedeemed
+	writeSwapHeader(b.db, swap)
+	b.db.SetState(SettlementAddress, swapSlot(swap.ID, 6), common.BytesToHash(secret))
+	return nil
+}
+
+// RefundSwap pays the funds of an expired swap back to its sender.
+func (b *HTLCBridge) RefundSwap(swapID common.Hash) error {
+	swap, err := b.pendingSwap(swapID)
+	if err != nil {
+		return err
+	}
+	if b.now < swap.Expiry {
+		return ErrSwapNotExpired
+	}
+	if err := transferAsset(b.db, swap.Asset, SettlementAddress, swap.Sender, swap.Amount); err != nil {
+		return err
+	}
+	swap.Status = SwapStatusRefunded
+	writeSwapHeader(b.db, swap)
+	return nil
+}
+
+// GetSwapStatus returns the status of a swap, expired for pending swaps whose
+// time lock ran out.
+func (b *HTLCBridge) GetSwapStatus(swapID common.Hash) (SwapStatus, error) {
+	swap, err := b.GetSwap(swapID)
+	if err != nil {
+		return SwapStatusPending, err
+	}
+	return swap.Status, nil
+}
+
+// GetSwap returns a swap, with the status of pending swaps whose time lock
+// ran out reported as expired.
+func (b *HTLCBridge) GetSwap(swapID common.Hash) (*Swap, error) {
+	swap := readSwap(b.db, swapID)
+	if swap == nil {
+		return nil, ErrSwapNotFound
+	}
+	if swap.Status == SwapStatusPending && b.now >= swap.Expiry {
+		swap.Status = SwapStatusExpired
+	}
+	return swap, nil
+}
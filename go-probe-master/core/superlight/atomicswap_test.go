@@ -0,0 +1,266 @@
+// Copyright 2024 The go-probe Authors
+// This file is part of the go-probe library.
+//
+// The go-probe library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-probe library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-probe library. If not, see <http://www.gnu.org/licenses/>.
+
+package superlight
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/core/state"
+)
+
+var (
+	_ AtomicSwapBridge = (*HTLCBridge)(nil)
+	_ AtomicSwapBridge = (*simChain)(nil)
+)
+
+// simChain is an in-process counterparty chain running HTLCs on a ledger of
+// its own, with a clock moved by the tests.
+type simChain struct {
+	now      uint64
+	balances map[common.Address]*big.Int
+	swaps    map[common.Hash]*Swap
+}
+
+func newSimChain(now uint64) *simChain {
+	return &simChain{
+		now:      now,
+		balances: make(map[common.Address]*big.Int),
+		swaps:    make(map[common.Hash]*Swap),
+	}
+}
+
+func (c *simChain) balance(owner common.Address) *big.Int {
+	if balance, ok := c.balances[owner]; ok {
+		return balance
+	}
+	return new(big.Int)
+}
+
+func (c *simChain) InitiateSwap(sender, receiver common.Address, amount *big.Int, hashLock common.Hash, timeLockSeconds uint64) (common.Hash, error) {
+	if c.balance(sender).Cmp(amount) < 0 {
+		return common.Hash{}, ErrInsufficientBalance
+	}
+	expiry := c.now + timeLockSeconds
+	id := SwapID(sender, receiver, common.Address{}, amount, hashLock, expiry)
+	if _, ok := c.swaps[id]; ok {
+		return common.Hash{}, ErrSwapExists
+	}
+	c.balances[sender] = new(big.Int).Sub(c.balance(sender), amount)
+	c.swaps[id] = &Swap{ID: id, Sender: sender, Receiver: receiver, Amount: amount, HashLock: hashLock, Expiry: expiry}
+	return id, nil
+}
+
+func (c *simChain) RedeemSwap(swapID common.Hash, secret []byte) error {
+	swap, ok := c.swaps[swapID]
+	switch {
+	case !ok:
+		return ErrSwapNotFound
+	case swap.Status != SwapStatusPending:
+		return ErrSwapNotPending
+	case c.now >= swap.Expiry:
+		return ErrSwapExpired
+	case SwapHashLock(secret) != swap.HashLock:
+		return ErrInvalidSecret
+	}
+	c.balances[swap.Receiver] = new(big.Int).Add(c.balance(swap.Receiver), swap.Amount)
+	swap.Status, swap.Secret = SwapStatusRedeemed, common.BytesToHash(secret)
+	return nil
+}
+
+func (c *simChain) RefundSwap(swapID common.Hash) error {
+	swap, ok := c.swaps[swapID]
+	switch {
+	case !ok:
+		return ErrSwapNotFound
+	case swap.Status != SwapStatusPending:
+		return ErrSwapNotPending
+	case c.now < swap.Expiry:
+		return ErrSwapNotExpired
+	}
+	c.balances[swap.Sender] = new(big.Int).Add(c.balance(swap.Sender), swap.Amount)
+	swap.Status = SwapStatusRefunded
+	return nil
+}
+
+func (c *simChain) GetSwapStatus(swapID common.Hash) (SwapStatus, error) {
+	swap, ok := c.swaps[swapID]
+	if !ok {
+		return SwapStatusPending, ErrSwapNotFound
+	}
+	if swap.Status == SwapStatusPending && c.now >= swap.Expiry {
+		return SwapStatusExpired, nil
+	}
+	return swap.Status, nil
+}
+
+func encodeInitiateSwap(receiver, asset common.Address, amount *big.Int, hashLock common.Hash, timeLock uint64) []byte {
+	data := []byte{OpInitiateSwap}
+	data = append(data, receiver.Bytes()...)
+	data = append(data, asset.Bytes()...)
+	data = append(data, common.BigToHash(amount).Bytes()...)
+	data = append(data, hashLock.Bytes()...)
+	return binary.BigEndian.AppendUint64(data, timeLock)
+}
+
+func encodeRedeemSwap(id common.Hash, secret []byte) []byte {
+	return append(append([]byte{OpRedeemSwap}, id.Bytes()...), secret...)
+}
+
+func encodeRefundSwap(id common.Hash) []byte {
+	return append([]byte{OpRefundSwap}, id.Bytes()...)
+}
+
+// Tests a full cross-chain swap: bob trades PROBE for alice's coins on the
+// counterparty chain, and both get paid once bob reveals his secret.
+func TestAtomicSwapCrossChain(t *testing.T) {
+	var (
+		mgr     = NewManager(feedConfig)
+		db      = newFundedState(t)
+		now     = uint64(1000)
+		api     = NewPublicSuperlightAPI(mgr)
+		sim     = newSimChain(now)
+		secret  = common.HexToHash("0x5ec7e75ec7e75ec7e75ec7e75ec7e75ec7e75ec7e75ec7e75ec7e75ec7e75ec7").Bytes()
+		lock    = SwapHashLock(secret)
+		initial = new(big.Int).Set(db.GetBalance(bob))
+	)
+	mgr.SetHeadState(func() (StateDB, uint64, error) { return db, now, nil })
+	sim.balances[alice] = big.NewInt(300)
+
+	process := func(from common.Address, data []byte) {
+		t.Helper()
+		if _, err := mgr.ProcessDEXTransaction(db, from, data, now, now); err != nil {
+			t.Fatalf("failed to process swap operation: %v", err)
+		}
+	}
+	// Bob locks PROBE for alice on ProbeChain for two days
+	process(bob, encodeInitiateSwap(alice, common.Address{}, units(500), lock, 48*3600))
+	id := SwapID(bob, alice, common.Address{}, units(500), lock, now+48*3600)
+
+	// Alice checks the terms, then locks her coins for bob for a day
+	swap, err := api.GetSwap(context.Background(), id)
+	if err != nil {
+		t.Fatalf("failed to retrieve swap: %v", err)
+	}
+	if swap.Status != SwapStatusPending || swap.Receiver != alice || swap.Amount.Cmp(units(500)) != 0 || swap.HashLock != lock {
+		t.Fatalf("swap mismatch: %+v", swap)
+	}
+	now += 60
+	sim.now = now
+	simID, err := sim.InitiateSwap(alice, bob, big.NewInt(300), swap.HashLock, 24*3600)
+	if err != nil {
+		t.Fatalf("failed to initiate counterparty swap: %v", err)
+	}
+	// Bob redeems the coins, revealing the secret on the counterparty chain
+	now += 60
+	sim.now = now
+	if err := sim.RedeemSwap(simID, secret); err != nil {
+		t.Fatalf("failed to redeem counterparty swap: %v", err)
+	}
+	// Alice learns the secret there and redeems the PROBE
+	process(alice, encodeRedeemSwap(id, sim.swaps[simID].Secret.Bytes()))
+
+	if balance := sim.balance(bob); balance.Cmp(big.NewInt(300)) != 0 {
+		t.Fatalf("counterparty balance mismatch: have %v, want 300", balance)
+	}
+	if balance, want := db.GetBalance(bob), new(big.Int).Sub(initial, units(500)); balance.Cmp(want) != 0 {
+		t.Fatalf("initiator balance mismatch: have %v, want %v", balance, want)
+	}
+	if balance := db.GetBalance(alice); balance.Cmp(units(500)) != 0 {
+		t.Fatalf("receiver balance mismatch: have %v, want %v", balance, units(500))
+	}
+	if swap, err = api.GetSwap(context.Background(), id); err != nil || swap.Status != SwapStatusRedeemed || !bytes.Equal(swap.Secret.Bytes(), secret) {
+		t.Fatalf("redeemed swap mismatch: %+v, %v", swap, err)
+	}
+	// A redeemed swap can't be redeemed or refunded again, even after expiry
+	now += 48 * 3600
+	if _, err := mgr.ProcessDEXTransaction(db, alice, encodeRedeemSwap(id, secret), now, now); err != ErrSwapNotPending {
+		t.Fatalf("expected ErrSwapNotPending on second redemption, got %v", err)
+	}
+	if _, err := mgr.ProcessDEXTransaction(db, bob, encodeRefundSwap(id), now, now); err != ErrSwapNotPending {
+		t.Fatalf("expected ErrSwapNotPending on refund, got %v", err)
+	}
+}
+
+// Tests that swaps of ledger tokens are refunded once their time lock ran out,
+// and can't be redeemed anymore, across restarts.
+func TestAtomicSwapRefund(t *testing.T) {
+	var (
+		db     = newFundedState(t)
+		asset  = testPair.BaseAsset
+		secret = make([]byte, SwapSecretLength)
+		lock   = SwapHashLock(secret)
+	)
+	bridge := NewHTLCBridge(db, 1000)
+	if _, err := bridge.InitiateAssetSwap(alice, bob, asset, units(400), lock, 0); err != ErrInvalidTimeLock {
+		t.Fatalf("expected ErrInvalidTimeLock, got %v", err)
+	}
+	if _, err := bridge.InitiateAssetSwap(alice, bob, asset, new(big.Int), lock, 100); err != ErrInvalidSwapValue {
+		t.Fatalf("expected ErrInvalidSwapValue, got %v", err)
+	}
+	if _, err := bridge.InitiateAssetSwap(alice, bob, asset, units(200000), lock, 100); err != ErrInsufficientBalance {
+		t.Fatalf("expected ErrInsufficientBalance, got %v", err)
+	}
+	id, err := bridge.InitiateAssetSwap(alice, bob, asset, units(400), lock, 100)
+	if err != nil {
+		t.Fatalf("failed to initiate swap: %v", err)
+	}
+	if _, err := bridge.InitiateAssetSwap(alice, bob, asset, units(400), lock, 100); err != ErrSwapExists {
+		t.Fatalf("expected ErrSwapExists, got %v", err)
+	}
+	if balance := AssetBalance(db, asset, alice); balance.Cmp(units(100000-400)) != 0 {
+		t.Fatalf("sender balance mismatch: have %v, want %v", balance, units(100000-400))
+	}
+	if err := bridge.RedeemSwap(id, append([]byte{1}, secret[1:]...)); err != ErrInvalidSecret {
+		t.Fatalf("expected ErrInvalidSecret, got %v", err)
+	}
+	if err := bridge.RefundSwap(id); err != ErrSwapNotExpired {
+		t.Fatalf("expected ErrSwapNotExpired, got %v", err)
+	}
+	// Restart after the time lock ran out
+	root, err := db.Commit(true)
+	if err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	reopened, err := state.New(root, db.Database(), nil)
+	if err != nil {
+		t.Fatalf("failed to reopen state: %v", err)
+	}
+	bridge = NewHTLCBridge(reopened, 1100)
+	if status, err := bridge.GetSwapStatus(id); err != nil || status != SwapStatusExpired {
+		t.Fatalf("expected expired swap, got %d, %v", status, err)
+	}
+	if err := bridge.RedeemSwap(id, secret); err != ErrSwapExpired {
+		t.Fatalf("expected ErrSwapExpired, got %v", err)
+	}
+	if err := bridge.RefundSwap(id); err != nil {
+		t.Fatalf("failed to refund swap: %v", err)
+	}
+	if balance := AssetBalance(reopened, asset, alice); balance.Cmp(units(100000)) != 0 {
+		t.Fatalf("refunded balance mismatch: have %v, want %v", balance, units(100000))
+	}
+	if status, err := bridge.GetSwapStatus(id); err != nil || status != SwapStatusRefunded {
+		t.Fatalf("expected refunded swap, got %d, %v", status, err)
+	}
+	if _, err := bridge.GetSwapStatus(common.Hash{1}); err != ErrSwapNotFound {
+		t.Fatalf("expected ErrSwapNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2024 The go-probe Authors
+// This file is part of the go-probe library.
+//
+// The go-probe library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-probe library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-probe library. If not, see <http://www.gnu.org/licenses/>.
+
+package superlight
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+)
+
+// benchBook is the subset of order book operations benchmarked.
+type benchBook interface {
+	add(order *Order)
+	remove(order *Order)
+	best(side OrderSide) *Order
+}
+
+// indexedBook adapts the skiplist based order book.
+type indexedBook struct {
+	*OrderBook
+}
+
+func (b indexedBook) add(order *Order)    { b.AddOrder(order) }
+func (b indexedBook) remove(order *Order) { b.RemoveOrder(order.ID) }
+
+func (b indexedBook) best(side OrderSide) *Order {
+	if level := b.side(side).first(); level != nil {
+		return level.Front()
+	}
+	return nil
+}
+
+// sliceLevel and sliceBook are the order book before the price index: sorted
+// level slices, re-sorted whenever a level is added, with order slices per
+// level. They are kept as the baseline the benchmarks compare against.
+type sliceLevel struct {
+	price  *big.Int
+	orders []*Order
+}
+
+type sliceBook struct {
+	bids, asks []*sliceLevel
+}
+
+func (b *sliceBook) add(order *Order) {
+	levels, desc := &b.asks, false
+	if order.Side == OrderSideBuy {
+		levels, desc = &b.bids, true
+	}
+	for _, level := range *levels {
+		if level.price.Cmp(order.Price) == 0 {
+			level.orders = append(level.orders, order)
+			return
+		}
+	}
+	*levels = append(*levels, &sliceLevel{price: new(big.Int).Set(order.Price), orders: []*Order{order}})
+	sort.Slice(*levels, func(i, j int) bool {
+		return ((*levels)[i].price.Cmp((*levels)[j].price) > 0) == desc
+	})
+}
+
+func (b *sliceBook) remove(order *Order) {
+	levels := &b.asks
+	if order.Side == OrderSideBuy {
+		levels = &b.bids
+	}
+	for i, level := range *levels {
+		if level.price.Cmp(order.Price) == 0 {
+			for j, o := range level.orders {
+				if o.ID == order.ID {
+					level.orders = append(level.orders[:j], level.orders[j+1:]...)
+					break
+				}
+			}
+			if len(level.orders) == 0 {
+				*levels = append((*levels)[:i], (*levels)[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+func (b *sliceBook) best(side OrderSide) *Order {
+	levels := b.asks
+	if side == OrderSideBuy {
+		levels = b.bids
+	}
+	if len(levels) == 0 {
+		return nil
+	}
+	return levels[0].orders[0]
+}
+
+// benchOrders creates n sell orders spread over the given number of price levels.
+func benchOrders(n, levels int) []*Order {
+	rnd := rand.New(rand.NewSource(1))
+
+	orders := make([]*Order, n)
+	for i := range orders {
+		orders[i] = &Order{
+			ID:     common.BigToHash(big.NewInt(int64(i + 1))),
+			Side:   OrderSideSell,
+			Price:  big.NewInt(rnd.Int63n(int64(levels)) + 1),
+			Amount: big.NewInt(1),
+			Filled: new(big.Int),
+		}
+	}
+	return orders
+}
+
+// benchBooks runs a benchmark on both order book implementations, for books
+// of growing size with ten orders per price level on average.
+func benchBooks(b *testing.B, run func(b *testing.B, book benchBook, orders []*Order)) {
+	for _, size := range []int{1000, 10000, 100000} {
+		for _, impl := range []string{"skiplist", "slice"} {
+			b.Run(fmt.Sprintf("%s/orders=%d", impl, size), func(b *testing.B) {
+				var book benchBook = indexedBook{NewOrderBook(testPair)}
+				if impl == "slice" {
+					book = new(sliceBook)
+				}
+				orders := benchOrders(2*size, size/10)
+				for _, order := range orders[:size] {
+					book.add(order)
+				}
+				b.ResetTimer()
+				run(b, book, orders)
+			})
+		}
+	}
+}
+
+// BenchmarkOrderBookChurn measures placing an order and cancelling an older one
+// at a random place in the book, keeping the book size steady.
+func BenchmarkOrderBookChurn(b *testing.B) {
+	benchBooks(b, func(b *testing.B, book benchBook, orders []*Order) {
+		live, spare := orders[:len(orders)/2], orders[len(orders)/2:]
+		for i := 0; i < b.N; i++ {
+			j, k := (i*7919)%len(live), i%len(spare)
+			book.remove(live[j])
+			live[j], spare[k] = spare[k], live[j]
+			book.add(live[j])
+		}
+	})
+}
+
+// BenchmarkOrderBookMatch measures filling the best order and replacing it with
+// a new order at a random price, like a stream of takers against a deep book.
+func BenchmarkOrderBookMatch(b *testing.B) {
+	benchBooks(b, func(b *testing.B, book benchBook, orders []*Order) {
+		spare := orders[len(orders)/2:]
+		for i := 0; i < b.N; i++ {
+			filled := book.best(OrderSideSell)
+			book.remove(filled)
+			next := spare[i%len(spare)]
+			spare[i%len(spare)] = filled
+			book.add(next)
+		}
+	})
+}
+
+// BenchmarkMatchingEngine measures placing crossing and resting limit orders
+// through the matching engine.
+func BenchmarkMatchingEngine(b *testing.B) {
+	for _, levels := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("levels=%d", levels), func(b *testing.B) {
+			var (
+				engine = NewMatchingEngine()
+				rnd    = rand.New(rand.NewSource(1))
+				amount = big.NewInt(10)
+			)
+			for i := 0; i < 10*levels; i++ {
+				price := big.NewInt(int64(levels + 1 + rnd.Intn(levels)))
+				engine.PlaceOrder(alice, testPair, OrderSideSell, price, amount, 0, 0)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Alternate resting asks and buys crossing the best ask
+				if i%2 == 0 {
+					engine.PlaceOrder(alice, testPair, OrderSideSell, big.NewInt(int64(levels+1+rnd.Intn(levels))), amount, 0, 0)
+				} else {
+					engine.PlaceOrder(bob, testPair, OrderSideBuy, big.NewInt(int64(2*levels)), amount, 0, 0)
+				}
+			}
+		})
+	}
+}
@@ -20,37 +20,114 @@ import (
 	"crypto/sha256"
 	"errors"
 	"math/big"
+	"sort"
 	"sync"
 
 	"github.com/probechain/go-probe/common"
 )
 
 var (
-	ErrOrderNotFound     = errors.New("order not found")
-	ErrInvalidPrice      = errors.New("price must be positive")
-	ErrInvalidAmount     = errors.New("amount must be positive")
-	ErrNotOrderOwner     = errors.New("not order owner")
+	ErrOrderNotFound      = errors.New("order not found")
+	ErrInvalidPrice       = errors.New("price must be positive")
+	ErrInvalidAmount      = errors.New("amount must be positive")
+	ErrNotOrderOwner      = errors.New("not order owner")
 	ErrOrderAlreadyFilled = errors.New("order already filled or cancelled")
+	ErrInvalidOrderType   = errors.New("invalid order type")
+	ErrInvalidStopPrice   = errors.New("stop price must be positive")
+	ErrOrderExpired       = errors.New("order expired")
+	ErrOrderWouldCross    = errors.New("post-only order would match")
+	ErrOrderNotFillable   = errors.New("fill-or-kill order cannot be filled")
+	ErrTooManyOrders      = errors.New("too many open orders")
 )
 
 // MatchingEngine is the core DEX matching engine. It manages order books
 // for multiple trading pairs and executes price-time priority matching.
+// Orders never trade with orders of their own owner, which are handled by
+// the self-trade prevention mode instead.
 type MatchingEngine struct {
 	mu         sync.RWMutex
 	books      map[TradingPair]*OrderBook
 	trades     []*Trade
 	tradeIndex map[common.Hash]*Trade
+	sequence   uint64   // Sequence number of the next order
+	evicted    []*Order // Orders removed from the books or reduced outside of trades, not yet collected
+
+	maxOrders uint64                    // Open and pending orders allowed per owner, zero if unlimited
+	selfTrade SelfTradeMode             // Handling of orders matching orders of their owner
+	owned     map[common.Address]uint64 // Number of open and pending orders per owner
+
+	steps   uint64 // Resting and stop orders visited since the last meter call
+	budget  uint64 // Orders that may be visited before matching stops, if metered
+	metered bool   // Whether matching is limited by the budget
 }
 
-// NewMatchingEngine creates a new matching engine.
+// NewMatchingEngine creates a new matching engine, without a limit on the
+// orders per owner and cancelling incoming orders that would self-trade.
 func NewMatchingEngine() *MatchingEngine {
 	return &MatchingEngine{
 		books:      make(map[TradingPair]*OrderBook),
 		trades:     make([]*Trade, 0),
 		tradeIndex: make(map[common.Hash]*Trade),
+		owned:      make(map[common.Address]uint64),
+	}
+}
+
+// SetMaxOrdersPerAccount limits the number of open and pending orders of each
+// owner, zero meaning unlimited. Orders beyond the limit are rejected, unless
+// they never rest in the book.
+func (me *MatchingEngine) SetMaxOrdersPerAccount(max uint64) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.maxOrders = max
+}
+
+// SetSelfTradeMode sets how orders matching resting orders of their owner are
+// handled.
+func (me *MatchingEngine) SetSelfTradeMode(mode SelfTradeMode) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.selfTrade = mode
+}
+
+// meter limits the resting and stop orders matching may visit from now on to
+// the budget, and resets the count of visited ones. Matching stops once the
+// budget is spent, leaving the books to be rebuilt.
+func (me *MatchingEngine) meter(budget uint64) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	me.steps, me.budget, me.metered = 0, budget, true
+}
+
+// step accounts for visiting an order, reporting whether the budget allows it.
+func (me *MatchingEngine) step() bool {
+	me.steps++
+	return !me.exhausted()
+}
+
+// exhausted reports whether more orders were visited than the budget allows.
+func (me *MatchingEngine) exhausted() bool {
+	return me.metered && me.steps > me.budget
+}
+
+// disown accounts for an order of an owner leaving the book.
+func (me *MatchingEngine) disown(order *Order) {
+	if me.owned[order.Owner]--; me.owned[order.Owner] == 0 {
+		delete(me.owned, order.Owner)
 	}
 }
 
+// evict removes a resting order from its price level outside of trading,
+// leaving it with the given status to be collected through takeEvicted. The
+// level is left to the caller to drop once empty.
+func (me *MatchingEngine) evict(book *OrderBook, order *Order, status OrderStatus) {
+	order.Status = status
+	delete(book.orderIndex, order.ID)
+	order.level.remove(order)
+	me.disown(order)
+	me.evicted = append(me.evicted, order)
+}
+
 // getOrCreateBook returns the order book for a pair, creating it if needed.
 func (me *MatchingEngine) getOrCreateBook(pair TradingPair) *OrderBook {
 	book, ok := me.books[pair]
@@ -61,62 +138,222 @@ func (me *MatchingEngine) getOrCreateBook(pair TradingPair) *OrderBook {
 	return book
 }
 
-// PlaceOrder places a new order and attempts to match it against existing orders.
-// Returns the placed order and any resulting trades.
+// PlaceOrder places a new limit order and attempts to match it against
+// existing orders. Returns the placed order and any resulting trades.
 func (me *MatchingEngine) PlaceOrder(owner common.Address, pair TradingPair, side OrderSide,
 	price, amount *big.Int, timestamp uint64, blockNum uint64) (*Order, []*Trade, error) {
 
-	if price == nil || price.Sign() <= 0 {
+	return me.PlaceOrderWithOptions(owner, pair, side, price, amount, OrderOptions{}, timestamp, blockNum)
+}
+
+// PlaceOrderWithOptions places a new order of any type. Orders are matched
+// right away, except for stop orders, which are kept pending until triggered
+// through the price oracle. Orders that can't be executed as requested are
+// rejected without touching the book.
+func (me *MatchingEngine) PlaceOrderWithOptions(owner common.Address, pair TradingPair, side OrderSide,
+	price, amount *big.Int, opts OrderOptions, timestamp uint64, blockNum uint64) (*Order, []*Trade, error) {
+
+	if opts.Type > OrderTypeStopLimit {
+		return nil, nil, ErrInvalidOrderType
+	}
+	// Market orders may leave their price open, all others need one
+	if price == nil || price.Sign() < 0 || (price.Sign() == 0 && opts.Type != OrderTypeMarket && opts.Type != OrderTypeStop) {
 		return nil, nil, ErrInvalidPrice
 	}
 	if amount == nil || amount.Sign() <= 0 {
 		return nil, nil, ErrInvalidAmount
 	}
+	if opts.Type.isStop() && (opts.StopPrice == nil || opts.StopPrice.Sign() <= 0) {
+		return nil, nil, ErrInvalidStopPrice
+	}
+	if opts.ExpiryBlock != 0 && opts.ExpiryBlock < blockNum {
+		return nil, nil, ErrOrderExpired
+	}
 
 	me.mu.Lock()
 	defer me.mu.Unlock()
 
-	// Generate order ID from fields
-	orderID := generateOrderID(owner, pair, side, price, amount, blockNum)
+	if me.maxOrders > 0 && (opts.Type.rests() || opts.Type.isStop()) && me.owned[owner] >= me.maxOrders {
+		return nil, nil, ErrTooManyOrders
+	}
+	if book, ok := me.books[pair]; ok || opts.Type == OrderTypeFOK {
+		switch opts.Type {
+		case OrderTypeFOK:
+			if !ok || book.matchable(owner, side, price, amount, blockNum, me.selfTrade == SelfTradeCancelOldest).Cmp(amount) < 0 {
+				return nil, nil, ErrOrderNotFillable
+			}
+		case OrderTypePostOnly:
+			if book.crosses(side, price, blockNum) {
+				return nil, nil, ErrOrderWouldCross
+			}
+		}
+	}
+
+	// Generate order ID from fields and the next sequence number
+	seq := me.sequence
+	me.sequence++
+	orderID := generateOrderID(owner, pair, side, price, amount, blockNum, seq)
 
 	order := &Order{
-		ID:        orderID,
-		Owner:     owner,
-		Pair:      pair,
-		Side:      side,
-		Price:     new(big.Int).Set(price),
-		Amount:    new(big.Int).Set(amount),
-		Filled:    new(big.Int),
-		Status:    OrderStatusOpen,
-		Timestamp: timestamp,
-		BlockNum:  blockNum,
+		ID:          orderID,
+		Owner:       owner,
+		Pair:        pair,
+		Side:        side,
+		Type:        opts.Type,
+		Price:       new(big.Int).Set(price),
+		Amount:      new(big.Int).Set(amount),
+		Filled:      new(big.Int),
+		Status:      OrderStatusOpen,
+		Timestamp:   timestamp,
+		BlockNum:    blockNum,
+		Seq:         seq,
+		ExpiryBlock: opts.ExpiryBlock,
 	}
-
 	book := me.getOrCreateBook(pair)
 
-	// Try to match against opposite side
-	trades := me.matchOrder(order, book, timestamp, blockNum)
+	if opts.Type.isStop() {
+		order.StopPrice = new(big.Int).Set(opts.StopPrice)
+		order.Status = OrderStatusPending
+		book.AddStop(order)
+		me.owned[owner]++
+		return order, nil, nil
+	}
+	trades := me.execute(order, book, timestamp, blockNum)
+	if order.level != nil {
+		me.owned[owner]++
+	}
+	return order, trades, nil
+}
 
-	// If order has remaining amount, add to the book
-	if order.Remaining().Sign() > 0 && order.Status != OrderStatusCancelled {
+// execute matches an order against the opposite side of the book, then adds
+// its remainder to the book or cancels it, depending on the order type. Orders
+// stopped by self-trade prevention are cancelled.
+func (me *MatchingEngine) execute(order *Order, book *OrderBook, timestamp, blockNum uint64) []*Trade {
+	trades, selfTraded := me.matchOrder(order, book, timestamp, blockNum)
+
+	switch {
+	case selfTraded:
+		order.Status = OrderStatusCancelled
+	case order.Remaining().Sign() == 0:
+		order.Status = OrderStatusFilled
+	case order.Type.rests():
 		if order.Filled.Sign() > 0 {
 			order.Status = OrderStatusPartial
 		}
 		book.AddOrder(order)
-	} else if order.Remaining().Sign() == 0 {
-		order.Status = OrderStatusFilled
+	default:
+		order.Status = OrderStatusCancelled
 	}
+	return trades
+}
 
-	return order, trades, nil
+// triggerStops removes the stop orders of a pair triggered by the given price
+// from the pending ones and returns them. Expired stop orders are removed as
+// well, to be collected through takeEvicted.
+func (me *MatchingEngine) triggerStops(pair TradingPair, price *big.Int, blockNum uint64) []*Order {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	book, ok := me.books[pair]
+	if !ok {
+		return nil
+	}
+	triggered, expired := book.takeStops(price, blockNum)
+	for _, order := range expired {
+		order.Status = OrderStatusExpired
+		me.disown(order)
+	}
+	me.evicted = append(me.evicted, expired...)
+	return triggered
+}
+
+// executeStop executes a triggered stop order, like a market order for stop
+// orders and like a limit order for stop-limit orders.
+func (me *MatchingEngine) executeStop(order *Order, timestamp, blockNum uint64) []*Trade {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if !me.step() {
+		return nil
+	}
+	order.Status = OrderStatusOpen
+	trades := me.execute(order, me.getOrCreateBook(order.Pair), timestamp, blockNum)
+	if order.level == nil {
+		me.disown(order)
+	}
+	return trades
+}
+
+// takeEvicted returns the orders removed from the books without trading since
+// the last call, because they expired or by self-trade prevention, and the
+// resting orders reduced by self-trade prevention.
+func (me *MatchingEngine) takeEvicted() []*Order {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	evicted := me.evicted
+	me.evicted = nil
+	return evicted
+}
+
+// sweepCost returns the quote value of buying amount from the asks of a pair
+// at any price, as far as the asks reach. Orders of the buyer are skipped, as
+// it never trades with them.
+func (me *MatchingEngine) sweepCost(pair TradingPair, buyer common.Address, amount *big.Int, blockNum uint64) *big.Int {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	cost := new(big.Int)
+	book, ok := me.books[pair]
+	if !ok {
+		return cost
+	}
+	remaining := new(big.Int).Set(amount)
+	book.walkMatches(OrderSideBuy, new(big.Int), blockNum, func(maker *Order) bool {
+		if !me.step() {
+			return false
+		}
+		if maker.Owner == buyer {
+			return true
+		}
+		fill := maker.Remaining()
+		if fill.Cmp(remaining) > 0 {
+			fill.Set(remaining)
+		}
+		cost.Add(cost, quoteValue(fill, maker.Price))
+		remaining.Sub(remaining, fill)
+		return remaining.Sign() > 0
+	})
+	return cost
+}
+
+// restore adds open orders loaded from the state to the books, in placement
+// order, and resumes the order sequence.
+func (me *MatchingEngine) restore(orders []*Order, sequence uint64) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	for _, order := range orders {
+		if order.Status == OrderStatusPending {
+			me.getOrCreateBook(order.Pair).AddStop(order)
+		} else {
+			me.getOrCreateBook(order.Pair).AddOrder(order)
+		}
+		me.owned[order.Owner]++
+	}
+	me.sequence = sequence
 }
 
-// CancelOrder cancels an open order. Only the owner can cancel.
+// CancelOrder cancels an open or pending stop order. Only the owner can cancel.
 func (me *MatchingEngine) CancelOrder(orderID common.Hash, owner common.Address) (*Order, error) {
 	me.mu.Lock()
 	defer me.mu.Unlock()
 
 	for _, book := range me.books {
 		order := book.GetOrder(orderID)
+		if order == nil {
+			order = book.GetStop(orderID)
+		}
 		if order == nil {
 			continue
 		}
@@ -126,50 +363,46 @@ func (me *MatchingEngine) CancelOrder(orderID common.Hash, owner common.Address)
 		if order.Status == OrderStatusFilled || order.Status == OrderStatusCancelled {
 			return nil, ErrOrderAlreadyFilled
 		}
+		if order.Status == OrderStatusPending {
+			book.RemoveStop(orderID)
+		} else {
+			book.RemoveOrder(orderID)
+		}
+		me.disown(order)
 		order.Status = OrderStatusCancelled
-		book.RemoveOrder(orderID)
 		return order, nil
 	}
 	return nil, ErrOrderNotFound
 }
 
-// GetOrderbook returns a snapshot of the order book for a pair.
-func (me *MatchingEngine) GetOrderbook(pair TradingPair, depth int) (bids, asks []PriceLevelSnapshot) {
+// openOrder returns an order resting in the book of a pair, or nil if it was
+// filled, cancelled or never placed.
+func (me *MatchingEngine) openOrder(pair TradingPair, orderID common.Hash) *Order {
 	me.mu.RLock()
 	defer me.mu.RUnlock()
 
 	book, ok := me.books[pair]
 	if !ok {
-		return nil, nil
+		return nil
 	}
+	return book.GetOrder(orderID)
+}
 
-	book.mu.RLock()
-	defer book.mu.RUnlock()
+// GetOrderbook returns a snapshot of the order book for a pair.
+func (me *MatchingEngine) GetOrderbook(pair TradingPair, depth int) (bids, asks []PriceLevelSnapshot) {
+	me.mu.RLock()
+	defer me.mu.RUnlock()
 
-	bidCount := len(book.Bids)
-	if depth > 0 && depth < bidCount {
-		bidCount = depth
-	}
-	for i := 0; i < bidCount; i++ {
-		bids = append(bids, PriceLevelSnapshot{
-			Price:  new(big.Int).Set(book.Bids[i].Price),
-			Amount: book.Bids[i].TotalAmount(),
-			Count:  len(book.Bids[i].Orders),
-		})
+	book, ok := me.books[pair]
+	if !ok {
+		return nil, nil
 	}
-
-	askCount := len(book.Asks)
-	if depth > 0 && depth < askCount {
-		askCount = depth
+	for _, level := range book.Levels(OrderSideBuy, depth) {
+		bids = append(bids, level.snapshot())
 	}
-	for i := 0; i < askCount; i++ {
-		asks = append(asks, PriceLevelSnapshot{
-			Price:  new(big.Int).Set(book.Asks[i].Price),
-			Amount: book.Asks[i].TotalAmount(),
-			Count:  len(book.Asks[i].Orders),
-		})
+	for _, level := range book.Levels(OrderSideSell, depth) {
+		asks = append(asks, level.snapshot())
 	}
-
 	return bids, asks
 }
 
@@ -188,6 +421,44 @@ func (me *MatchingEngine) GetTrades(pair TradingPair, limit int) []*Trade {
 	return result
 }
 
+// GetOrdersByOwner returns the open and pending stop orders of an account
+// across all pairs, in placement order.
+func (me *MatchingEngine) GetOrdersByOwner(owner common.Address) []*Order {
+	me.mu.RLock()
+	defer me.mu.RUnlock()
+
+	var orders []*Order
+	for _, book := range me.books {
+		book.mu.RLock()
+		for _, order := range book.orderIndex {
+			if order.Owner == owner {
+				orders = append(orders, order)
+			}
+		}
+		for _, order := range book.stops {
+			if order.Owner == owner {
+				orders = append(orders, order)
+			}
+		}
+		book.mu.RUnlock()
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].Seq < orders[j].Seq })
+	return orders
+}
+
+// GetPairs returns the pairs with an order book, sorted by their name.
+func (me *MatchingEngine) GetPairs() []*OrderBook {
+	me.mu.RLock()
+	defer me.mu.RUnlock()
+
+	books := make([]*OrderBook, 0, len(me.books))
+	for _, book := range me.books {
+		books = append(books, book)
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].Pair.String() < books[j].Pair.String() })
+	return books
+}
+
 // PriceLevelSnapshot is a read-only snapshot of a price level.
 type PriceLevelSnapshot struct {
 	Price  *big.Int `json:"price"`
@@ -195,22 +466,34 @@ type PriceLevelSnapshot struct {
 	Count  int      `json:"count"`
 }
 
-// matchOrder attempts to match the incoming order against the opposite side.
-func (me *MatchingEngine) matchOrder(order *Order, book *OrderBook, timestamp, blockNum uint64) []*Trade {
-	var trades []*Trade
-	var oppositeSide *[]*PriceLevel
-
-	if order.Side == OrderSideBuy {
-		oppositeSide = &book.Asks
-	} else {
-		oppositeSide = &book.Bids
+// snapshot returns a read-only copy of the price level.
+func (pl *PriceLevel) snapshot() PriceLevelSnapshot {
+	return PriceLevelSnapshot{
+		Price:  new(big.Int).Set(pl.Price),
+		Amount: pl.TotalAmount(),
+		Count:  pl.Len(),
 	}
+}
 
-	for len(*oppositeSide) > 0 && order.Remaining().Sign() > 0 {
-		bestLevel := (*oppositeSide)[0]
-
-		// Check price compatibility
-		if order.Side == OrderSideBuy && order.Price.Cmp(bestLevel.Price) < 0 {
+// matchOrder attempts to match the incoming order against the opposite side.
+// It reports whether matching was stopped by self-trade prevention, in which
+// case the remainder of the order is to be cancelled.
+func (me *MatchingEngine) matchOrder(order *Order, book *OrderBook, timestamp, blockNum uint64) ([]*Trade, bool) {
+	var (
+		trades     []*Trade
+		selfTraded bool
+	)
+	oppositeSide := book.asks
+	if order.Side == OrderSideSell {
+		oppositeSide = book.bids
+	}
+	for !selfTraded && order.Remaining().Sign() > 0 {
+		bestLevel := oppositeSide.first()
+		if bestLevel == nil {
+			break
+		}
+		// Check price compatibility, market orders without price match any
+		if order.Side == OrderSideBuy && order.Price.Sign() > 0 && order.Price.Cmp(bestLevel.Price) < 0 {
 			break // Buy price too low
 		}
 		if order.Side == OrderSideSell && order.Price.Cmp(bestLevel.Price) > 0 {
@@ -218,8 +501,18 @@ func (me *MatchingEngine) matchOrder(order *Order, book *OrderBook, timestamp, b
 		}
 
 		// Match against orders at this level (FIFO)
-		for len(bestLevel.Orders) > 0 && order.Remaining().Sign() > 0 {
-			makerOrder := bestLevel.Orders[0]
+		for bestLevel.Len() > 0 && order.Remaining().Sign() > 0 {
+			// Stop matching once the operation can't pay for more makers
+			if !me.step() {
+				return trades, selfTraded
+			}
+			makerOrder := bestLevel.Front()
+
+			// Evict expired makers instead of trading with them
+			if makerOrder.Expired(blockNum) {
+				me.evict(book, makerOrder, OrderStatusExpired)
+				continue
+			}
 
 			// Calculate fill amount
 			fillAmount := new(big.Int).Set(order.Remaining())
@@ -227,6 +520,28 @@ func (me *MatchingEngine) matchOrder(order *Order, book *OrderBook, timestamp, b
 				fillAmount.Set(makerOrder.Remaining())
 			}
 
+			// Never trade with orders of the same owner
+			if makerOrder.Owner == order.Owner {
+				if me.selfTrade == SelfTradeCancelOldest {
+					me.evict(book, makerOrder, OrderStatusCancelled)
+					continue
+				}
+				if me.selfTrade == SelfTradeDecrement {
+					makerOrder.Amount.Sub(makerOrder.Amount, fillAmount)
+					order.Amount.Sub(order.Amount, fillAmount)
+					if makerOrder.Remaining().Sign() == 0 {
+						me.evict(book, makerOrder, OrderStatusCancelled)
+					} else {
+						me.evicted = append(me.evicted, makerOrder)
+					}
+					if order.Remaining().Sign() > 0 {
+						continue
+					}
+				}
+				selfTraded = true
+				break
+			}
+
 			// Create trade
 			tradeID := generateTradeID(makerOrder.ID, order.ID, fillAmount, blockNum)
 			trade := &Trade{
@@ -236,6 +551,7 @@ func (me *MatchingEngine) matchOrder(order *Order, book *OrderBook, timestamp, b
 				Maker:      makerOrder.Owner,
 				Taker:      order.Owner,
 				Pair:       order.Pair,
+				Side:       order.Side,
 				Price:      new(big.Int).Set(bestLevel.Price), // Execute at maker's price
 				Amount:     fillAmount,
 				MakerFee:   new(big.Int), // Fees calculated by Manager
@@ -255,23 +571,25 @@ func (me *MatchingEngine) matchOrder(order *Order, book *OrderBook, timestamp, b
 			if makerOrder.IsFilled() {
 				makerOrder.Status = OrderStatusFilled
 				delete(book.orderIndex, makerOrder.ID)
-				bestLevel.Orders = bestLevel.Orders[1:]
+				bestLevel.remove(makerOrder)
+				me.disown(makerOrder)
 			} else {
 				makerOrder.Status = OrderStatusPartial
 			}
 		}
 
 		// Remove empty level
-		if len(bestLevel.Orders) == 0 {
-			*oppositeSide = (*oppositeSide)[1:]
+		if bestLevel.Len() == 0 {
+			oppositeSide.remove(bestLevel.Price)
 		}
 	}
 
-	return trades
+	return trades, selfTraded
 }
 
-// generateOrderID creates a deterministic order ID from order fields.
-func generateOrderID(owner common.Address, pair TradingPair, side OrderSide, price, amount *big.Int, blockNum uint64) common.Hash {
+// generateOrderID creates a deterministic order ID from order fields. The
+// sequence number keeps identical orders placed in the same block apart.
+func generateOrderID(owner common.Address, pair TradingPair, side OrderSide, price, amount *big.Int, blockNum uint64, seq uint64) common.Hash {
 	h := sha256.New()
 	h.Write(owner.Bytes())
 	h.Write(pair.BaseAsset.Bytes())
@@ -280,6 +598,7 @@ func generateOrderID(owner common.Address, pair TradingPair, side OrderSide, pri
 	h.Write(price.Bytes())
 	h.Write(amount.Bytes())
 	h.Write(new(big.Int).SetUint64(blockNum).Bytes())
+	h.Write(new(big.Int).SetUint64(seq).Bytes())
 	return common.BytesToHash(h.Sum(nil))
 }
 
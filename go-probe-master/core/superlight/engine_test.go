@@ -31,6 +31,7 @@ var (
 	alice = common.HexToAddress("0xAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA")
 	bob   = common.HexToAddress("0xBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB")
 	carol = common.HexToAddress("0xCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCCC")
+	dave  = common.HexToAddress("0xDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD")
 )
 
 func TestPlaceAndMatchOrders(t *testing.T) {
@@ -157,7 +158,7 @@ func TestPriceTimePriority(t *testing.T) {
 		big.NewInt(100), big.NewInt(5), 1002, 3) // Same price as bob, but later (FIFO)
 
 	// Large buy order should match bob first (best price), then carol (same price, FIFO)
-	_, trades, err := engine.PlaceOrder(alice, testPair, OrderSideBuy,
+	_, trades, err := engine.PlaceOrder(dave, testPair, OrderSideBuy,
 		big.NewInt(110), big.NewInt(12), 1003, 4)
 	if err != nil {
 		t.Fatal(err)
@@ -252,3 +253,280 @@ func TestGetTrades(t *testing.T) {
 		t.Fatalf("expected 1 trade, got %d", len(trades))
 	}
 }
+
+func TestMarketOrder(t *testing.T) {
+	engine := NewMatchingEngine()
+
+	_, _, _ = engine.PlaceOrder(alice, testPair, OrderSideSell,
+		big.NewInt(100), big.NewInt(5), 1000, 1)
+	_, _, _ = engine.PlaceOrder(carol, testPair, OrderSideSell,
+		big.NewInt(200), big.NewInt(5), 1000, 1)
+
+	// Market buy without price sweeps both levels and cancels the rest
+	order, trades, err := engine.PlaceOrderWithOptions(bob, testPair, OrderSideBuy,
+		big.NewInt(0), big.NewInt(12), OrderOptions{Type: OrderTypeMarket}, 1001, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 2 {
+		t.Fatalf("expected 2 trades, got %d", len(trades))
+	}
+	if order.Status != OrderStatusCancelled || order.Filled.Cmp(big.NewInt(10)) != 0 {
+		t.Fatalf("expected cancelled order with 10 filled, got status %d filled %s", order.Status, order.Filled)
+	}
+	if bids, asks := engine.GetOrderbook(testPair, 10); len(bids) != 0 || len(asks) != 0 {
+		t.Fatal("expected empty order book after market order")
+	}
+}
+
+func TestImmediateOrCancelOrder(t *testing.T) {
+	engine := NewMatchingEngine()
+
+	_, _, _ = engine.PlaceOrder(alice, testPair, OrderSideSell,
+		big.NewInt(100), big.NewInt(5), 1000, 1)
+	_, _, _ = engine.PlaceOrder(carol, testPair, OrderSideSell,
+		big.NewInt(200), big.NewInt(5), 1000, 1)
+
+	// IOC buy at 150 only takes the first level
+	order, trades, err := engine.PlaceOrderWithOptions(bob, testPair, OrderSideBuy,
+		big.NewInt(150), big.NewInt(10), OrderOptions{Type: OrderTypeIOC}, 1001, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 1 || order.Status != OrderStatusCancelled {
+		t.Fatalf("expected 1 trade and cancelled order, got %d trades and status %d", len(trades), order.Status)
+	}
+	if bids, asks := engine.GetOrderbook(testPair, 10); len(bids) != 0 || len(asks) != 1 {
+		t.Fatal("expected IOC remainder not to rest in the book")
+	}
+}
+
+func TestFillOrKillOrder(t *testing.T) {
+	engine := NewMatchingEngine()
+
+	_, _, _ = engine.PlaceOrder(alice, testPair, OrderSideSell,
+		big.NewInt(100), big.NewInt(5), 1000, 1)
+	_, _, _ = engine.PlaceOrder(carol, testPair, OrderSideSell,
+		big.NewInt(200), big.NewInt(5), 1000, 1)
+
+	// Not enough liquidity up to 150
+	_, _, err := engine.PlaceOrderWithOptions(bob, testPair, OrderSideBuy,
+		big.NewInt(150), big.NewInt(10), OrderOptions{Type: OrderTypeFOK}, 1001, 2)
+	if err != ErrOrderNotFillable {
+		t.Fatalf("expected ErrOrderNotFillable, got %v", err)
+	}
+	if _, asks := engine.GetOrderbook(testPair, 10); len(asks) != 2 {
+		t.Fatal("expected rejected FOK order not to touch the book")
+	}
+	// Enough liquidity up to 200
+	order, trades, err := engine.PlaceOrderWithOptions(bob, testPair, OrderSideBuy,
+		big.NewInt(200), big.NewInt(10), OrderOptions{Type: OrderTypeFOK}, 1001, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 2 || order.Status != OrderStatusFilled {
+		t.Fatalf("expected 2 trades and filled order, got %d trades and status %d", len(trades), order.Status)
+	}
+	// No book at all
+	_, _, err = engine.PlaceOrderWithOptions(bob, TradingPair{BaseAsset: carol}, OrderSideBuy,
+		big.NewInt(200), big.NewInt(10), OrderOptions{Type: OrderTypeFOK}, 1001, 2)
+	if err != ErrOrderNotFillable {
+		t.Fatalf("expected ErrOrderNotFillable, got %v", err)
+	}
+}
+
+func TestPostOnlyOrder(t *testing.T) {
+	engine := NewMatchingEngine()
+
+	_, _, _ = engine.PlaceOrder(alice, testPair, OrderSideSell,
+		big.NewInt(100), big.NewInt(5), 1000, 1)
+
+	// Would cross the ask
+	_, _, err := engine.PlaceOrderWithOptions(bob, testPair, OrderSideBuy,
+		big.NewInt(100), big.NewInt(5), OrderOptions{Type: OrderTypePostOnly}, 1001, 2)
+	if err != ErrOrderWouldCross {
+		t.Fatalf("expected ErrOrderWouldCross, got %v", err)
+	}
+	// Rests below the ask
+	order, trades, err := engine.PlaceOrderWithOptions(bob, testPair, OrderSideBuy,
+		big.NewInt(99), big.NewInt(5), OrderOptions{Type: OrderTypePostOnly}, 1001, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 0 || order.Status != OrderStatusOpen {
+		t.Fatalf("expected resting order, got %d trades and status %d", len(trades), order.Status)
+	}
+}
+
+func TestStopOrders(t *testing.T) {
+	engine := NewMatchingEngine()
+
+	_, _, _ = engine.PlaceOrder(alice, testPair, OrderSideSell,
+		big.NewInt(120), big.NewInt(10), 1000, 1)
+
+	// Buy stop at 110, buy stop-limit at 130 limited to 100
+	stop, trades, err := engine.PlaceOrderWithOptions(bob, testPair, OrderSideBuy,
+		big.NewInt(0), big.NewInt(4), OrderOptions{Type: OrderTypeStop, StopPrice: big.NewInt(110)}, 1001, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 0 || stop.Status != OrderStatusPending {
+		t.Fatalf("expected pending stop order, got %d trades and status %d", len(trades), stop.Status)
+	}
+	stopLimit, _, err := engine.PlaceOrderWithOptions(carol, testPair, OrderSideBuy,
+		big.NewInt(100), big.NewInt(4), OrderOptions{Type: OrderTypeStopLimit, StopPrice: big.NewInt(130)}, 1001, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := engine.PlaceOrderWithOptions(carol, testPair, OrderSideBuy,
+		big.NewInt(100), big.NewInt(4), OrderOptions{Type: OrderTypeStopLimit}, 1001, 2); err != ErrInvalidStopPrice {
+		t.Fatalf("expected ErrInvalidStopPrice, got %v", err)
+	}
+
+	// Price below both stops triggers nothing, 115 only the stop order
+	if triggered := engine.triggerStops(testPair, big.NewInt(105), 3); len(triggered) != 0 {
+		t.Fatalf("expected no triggered stops, got %d", len(triggered))
+	}
+	triggered := engine.triggerStops(testPair, big.NewInt(115), 3)
+	if len(triggered) != 1 || triggered[0] != stop {
+		t.Fatalf("expected the stop order to trigger, got %d orders", len(triggered))
+	}
+	if trades := engine.executeStop(stop, 1003, 3); len(trades) != 1 || stop.Status != OrderStatusFilled {
+		t.Fatalf("expected filled stop order, got %d trades and status %d", len(trades), stop.Status)
+	}
+	// The stop-limit order rests at its limit once triggered
+	triggered = engine.triggerStops(testPair, big.NewInt(130), 4)
+	if len(triggered) != 1 || triggered[0] != stopLimit {
+		t.Fatalf("expected the stop-limit order to trigger, got %d orders", len(triggered))
+	}
+	if trades := engine.executeStop(stopLimit, 1004, 4); len(trades) != 0 || stopLimit.Status != OrderStatusOpen {
+		t.Fatalf("expected resting stop-limit order, got %d trades and status %d", len(trades), stopLimit.Status)
+	}
+	if bids, _ := engine.GetOrderbook(testPair, 10); len(bids) != 1 {
+		t.Fatalf("expected 1 bid level, got %d", len(bids))
+	}
+}
+
+func TestOrderExpiry(t *testing.T) {
+	engine := NewMatchingEngine()
+
+	// Expiry before the current block is rejected
+	_, _, err := engine.PlaceOrderWithOptions(alice, testPair, OrderSideSell,
+		big.NewInt(100), big.NewInt(5), OrderOptions{ExpiryBlock: 1}, 1000, 2)
+	if err != ErrOrderExpired {
+		t.Fatalf("expected ErrOrderExpired, got %v", err)
+	}
+	expiring, _, _ := engine.PlaceOrderWithOptions(alice, testPair, OrderSideSell,
+		big.NewInt(100), big.NewInt(5), OrderOptions{ExpiryBlock: 2}, 1000, 2)
+	_, _, _ = engine.PlaceOrder(carol, testPair, OrderSideSell,
+		big.NewInt(110), big.NewInt(5), 1000, 2)
+
+	// Still valid in its expiry block
+	if _, trades, _ := engine.PlaceOrder(bob, testPair, OrderSideBuy,
+		big.NewInt(110), big.NewInt(1), 1001, 2); len(trades) != 1 || trades[0].Maker != alice {
+		t.Fatal("expected a trade with the order in its expiry block")
+	}
+	// Evicted afterwards instead of matched
+	_, trades, _ := engine.PlaceOrder(bob, testPair, OrderSideBuy,
+		big.NewInt(110), big.NewInt(1), 1002, 3)
+	if len(trades) != 1 || trades[0].Maker != carol {
+		t.Fatal("expected the expired order to be skipped")
+	}
+	expired := engine.takeEvicted()
+	if len(expired) != 1 || expired[0] != expiring || expiring.Status != OrderStatusExpired {
+		t.Fatalf("expected the expired order to be collected, got %d orders", len(expired))
+	}
+	if engine.openOrder(testPair, expiring.ID) != nil {
+		t.Fatal("expected the expired order to be removed from the book")
+	}
+}
+
+func TestSelfTradePrevention(t *testing.T) {
+	tests := []struct {
+		mode    SelfTradeMode
+		trades  []int64     // Amounts of the trades of the incoming order
+		status  OrderStatus // Status of the incoming order
+		evicted int         // Number of resting orders evicted or reduced
+		bids    []int64     // Amounts of the bid levels afterwards
+		asks    []int64     // Amounts of the ask levels afterwards
+	}{
+		{SelfTradeCancelNewest, nil, OrderStatusCancelled, 0, nil, []int64{10, 5}},
+		{SelfTradeCancelOldest, []int64{5}, OrderStatusPartial, 2, []int64{3}, nil},
+		{SelfTradeDecrement, []int64{3}, OrderStatusFilled, 1, nil, []int64{2, 5}},
+	}
+	for _, test := range tests {
+		engine := NewMatchingEngine()
+		engine.SetSelfTradeMode(test.mode)
+
+		_, _, _ = engine.PlaceOrder(alice, testPair, OrderSideSell, big.NewInt(100), big.NewInt(5), 1000, 1)
+		_, _, _ = engine.PlaceOrder(carol, testPair, OrderSideSell, big.NewInt(100), big.NewInt(5), 1000, 1)
+		_, _, _ = engine.PlaceOrder(alice, testPair, OrderSideSell, big.NewInt(110), big.NewInt(5), 1000, 1)
+
+		order, trades, err := engine.PlaceOrder(alice, testPair, OrderSideBuy, big.NewInt(110), big.NewInt(8), 1001, 2)
+		if err != nil {
+			t.Fatalf("mode %d: failed to place order: %v", test.mode, err)
+		}
+		if len(trades) != len(test.trades) {
+			t.Fatalf("mode %d: trade count mismatch: have %d, want %d", test.mode, len(trades), len(test.trades))
+		}
+		for i, trade := range trades {
+			if trade.Maker == alice || trade.Amount.Cmp(big.NewInt(test.trades[i])) != 0 {
+				t.Fatalf("mode %d: trade %d mismatch: %+v", test.mode, i, trade)
+			}
+		}
+		if order.Status != test.status {
+			t.Fatalf("mode %d: status mismatch: have %d, want %d", test.mode, order.Status, test.status)
+		}
+		if evicted := engine.takeEvicted(); len(evicted) != test.evicted {
+			t.Fatalf("mode %d: evicted count mismatch: have %d, want %d", test.mode, len(evicted), test.evicted)
+		}
+		bids, asks := engine.GetOrderbook(testPair, 0)
+		for _, side := range []struct {
+			levels []PriceLevelSnapshot
+			want   []int64
+		}{{bids, test.bids}, {asks, test.asks}} {
+			if len(side.levels) != len(side.want) {
+				t.Fatalf("mode %d: level count mismatch: have %d, want %d", test.mode, len(side.levels), len(side.want))
+			}
+			for i, level := range side.levels {
+				if level.Amount.Cmp(big.NewInt(side.want[i])) != 0 {
+					t.Fatalf("mode %d: level %d amount mismatch: have %v, want %d", test.mode, i, level.Amount, side.want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestMaxOrdersPerAccount(t *testing.T) {
+	engine := NewMatchingEngine()
+	engine.SetMaxOrdersPerAccount(2)
+
+	first, _, _ := engine.PlaceOrder(alice, testPair, OrderSideSell, big.NewInt(100), big.NewInt(5), 1000, 1)
+	_, _, _ = engine.PlaceOrderWithOptions(alice, testPair, OrderSideSell,
+		big.NewInt(100), big.NewInt(5), OrderOptions{Type: OrderTypeStopLimit, StopPrice: big.NewInt(90)}, 1000, 1)
+
+	// Orders that may rest or wait for their trigger are rejected at the limit
+	if _, _, err := engine.PlaceOrder(alice, testPair, OrderSideSell, big.NewInt(120), big.NewInt(5), 1000, 1); err != ErrTooManyOrders {
+		t.Fatalf("expected ErrTooManyOrders, got %v", err)
+	}
+	if _, _, err := engine.PlaceOrderWithOptions(alice, testPair, OrderSideSell,
+		big.NewInt(100), big.NewInt(5), OrderOptions{Type: OrderTypeStop, StopPrice: big.NewInt(90)}, 1000, 1); err != ErrTooManyOrders {
+		t.Fatalf("expected ErrTooManyOrders for stop order, got %v", err)
+	}
+	// Orders never resting are accepted, and the limit is per account
+	_, _, _ = engine.PlaceOrder(bob, testPair, OrderSideBuy, big.NewInt(90), big.NewInt(5), 1000, 1)
+	if _, trades, err := engine.PlaceOrderWithOptions(alice, testPair, OrderSideSell,
+		big.NewInt(90), big.NewInt(1), OrderOptions{Type: OrderTypeIOC}, 1000, 1); err != nil || len(trades) != 1 {
+		t.Fatalf("expected the IOC order to trade, got %d trades, %v", len(trades), err)
+	}
+	// Filled orders free their slot
+	if _, trades, _ := engine.PlaceOrder(bob, testPair, OrderSideBuy, big.NewInt(100), big.NewInt(5), 1001, 2); len(trades) != 1 {
+		t.Fatalf("expected 1 trade, got %d", len(trades))
+	}
+	if engine.openOrder(testPair, first.ID) != nil {
+		t.Fatal("expected the first order to be filled")
+	}
+	if _, _, err := engine.PlaceOrder(alice, testPair, OrderSideSell, big.NewInt(120), big.NewInt(5), 1001, 2); err != nil {
+		t.Fatalf("failed to place order after a fill: %v", err)
+	}
+}
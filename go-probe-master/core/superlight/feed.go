@@ -0,0 +1,316 @@
+// Copyright 2024 The go-probe Authors
+// This file is part of the go-probe library.
+//
+// The go-probe library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-probe library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-probe library. If not, see <http://www.gnu.org/licenses/>.
+
+package superlight
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/event"
+)
+
+// ErrInvalidCandleInterval is returned when subscribing to candles of an
+// interval of zero seconds.
+var ErrInvalidCandleInterval = errors.New("candle interval must be positive")
+
+// opRetention is the number of blocks operations not yet part of the published
+// chain head are kept for, in case they become part of a later head.
+const opRetention = 128
+
+// DepthUpdate is an incremental update of the order book of a pair, holding
+// the price levels changed since the previous update with their new absolute
+// amounts, zero for removed levels. Updates of a pair carry consecutive
+// sequence numbers: a client applying the updates following a snapshot of
+// sequence number n keeps an exact copy of the book, and re-applying an update
+// the snapshot already includes is harmless.
+type DepthUpdate struct {
+	Pair     TradingPair          `json:"pair"`
+	Seq      uint64               `json:"seq"`
+	BlockNum uint64               `json:"blockNum"`
+	Bids     []PriceLevelSnapshot `json:"bids"`
+	Asks     []PriceLevelSnapshot `json:"asks"`
+}
+
+// bookOp is an operation applied to the order book, recorded to publish its
+// trades once it becomes part of the chain head.
+type bookOp struct {
+	prev     common.Hash // Book hash before the operation
+	trades   []*Trade    // Trades the operation executed
+	blockNum uint64      // Block the operation was applied in
+}
+
+// pairDepth is the published depth of a pair.
+type pairDepth struct {
+	seq        uint64
+	bids, asks map[string]PriceLevelSnapshot
+}
+
+// marketFeed publishes the market data of the order book as found in the
+// states of successive chain heads, so that subscribers never see operations
+// from reverted transactions, calls or abandoned forks.
+type marketFeed struct {
+	depthFeed event.Feed
+	tradeFeed event.Feed
+	scope     event.SubscriptionScope
+
+	ops       map[common.Hash]*bookOp // Recorded operations by resulting book hash
+	published common.Hash             // Book hash of the last published head
+	depth     map[TradingPair]*pairDepth
+}
+
+func newMarketFeed() *marketFeed {
+	return &marketFeed{
+		ops:   make(map[common.Hash]*bookOp),
+		depth: make(map[TradingPair]*pairDepth),
+	}
+}
+
+// record remembers an operation that moved the book from hash prev to next.
+func (f *marketFeed) record(prev, next common.Hash, trades []*Trade, blockNum uint64) {
+	f.ops[next] = &bookOp{prev: prev, trades: trades, blockNum: blockNum}
+}
+
+// headTrades returns the trades of the operations leading to the book hash of
+// a new head since the last published one, oldest first, and forgets about
+// operations too old to ever be published.
+func (f *marketFeed) headTrades(head common.Hash, blockNum uint64) []*Trade {
+	var ops []*bookOp
+	for hash := head; hash != f.published; {
+		op, ok := f.ops[hash]
+		if !ok {
+			break // Reached operations published or pruned before
+		}
+		ops = append(ops, op)
+		delete(f.ops, hash)
+		hash = op.prev
+	}
+	var trades []*Trade
+	for i := len(ops) - 1; i >= 0; i-- {
+		trades = append(trades, ops[i].trades...)
+	}
+	for hash, op := range f.ops {
+		if op.blockNum+opRetention < blockNum {
+			delete(f.ops, hash)
+		}
+	}
+	f.published = head
+	return trades
+}
+
+// depthUpdates diffs the books of the engine against the published depth and
+// returns an update for every pair that changed, in pair order.
+func (f *marketFeed) depthUpdates(engine *MatchingEngine, blockNum uint64) []*DepthUpdate {
+	engine.mu.RLock()
+	defer engine.mu.RUnlock()
+
+	pairs := make(map[TradingPair]struct{})
+	for pair := range engine.books {
+		pairs[pair] = struct{}{}
+	}
+	for pair := range f.depth {
+		pairs[pair] = struct{}{}
+	}
+	var updates []*DepthUpdate
+	for _, pair := range sortedPairs(pairs) {
+		depth, ok := f.depth[pair]
+		if !ok {
+			depth = &pairDepth{bids: make(map[string]PriceLevelSnapshot), asks: make(map[string]PriceLevelSnapshot)}
+			f.depth[pair] = depth
+		}
+		var bids, asks []*PriceLevel
+		if book, ok := engine.books[pair]; ok {
+			bids, asks = book.Levels(OrderSideBuy, 0), book.Levels(OrderSideSell, 0)
+		}
+		update := &DepthUpdate{
+			Pair:     pair,
+			BlockNum: blockNum,
+			Bids:     diffLevels(depth.bids, bids, true),
+			Asks:     diffLevels(depth.asks, asks, false),
+		}
+		if len(update.Bids) == 0 && len(update.Asks) == 0 {
+			continue
+		}
+		depth.seq++
+		update.Seq = depth.seq
+		updates = append(updates, update)
+	}
+	return updates
+}
+
+// seq returns the sequence number of the last depth update of a pair.
+func (f *marketFeed) seq(pair TradingPair) uint64 {
+	if depth, ok := f.depth[pair]; ok {
+		return depth.seq
+	}
+	return 0
+}
+
+// diffLevels returns the levels that differ between the published ones and
+// the current ones, updating the published levels. Removed levels are returned
+// with zero amount. The result is ordered best price first.
+func diffLevels(published map[string]PriceLevelSnapshot, current []*PriceLevel, desc bool) []PriceLevelSnapshot {
+	var changed []PriceLevelSnapshot
+
+	seen := make(map[string]struct{}, len(current))
+	for _, level := range current {
+		key := level.Price.String()
+		seen[key] = struct{}{}
+
+		snapshot := level.snapshot()
+		if prev, ok := published[key]; ok && prev.Amount.Cmp(snapshot.Amount) == 0 && prev.Count == snapshot.Count {
+			continue
+		}
+		published[key] = snapshot
+		changed = append(changed, snapshot)
+	}
+	for key, prev := range published {
+		if _, ok := seen[key]; !ok {
+			delete(published, key)
+			changed = append(changed, PriceLevelSnapshot{Price: prev.Price, Amount: new(big.Int)})
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		return (changed[i].Price.Cmp(changed[j].Price) > 0) == desc
+	})
+	return changed
+}
+
+// sortedPairs returns a set of pairs in a deterministic order.
+func sortedPairs(set map[TradingPair]struct{}) []TradingPair {
+	pairs := make([]TradingPair, 0, len(set))
+	for pair := range set {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].String() < pairs[j].String() })
+	return pairs
+}
+
+// Publish publishes the market data of a new chain head: the trades of the
+// operations that led to its order book, and the depth changes of every pair
+// since the previous head. Operations of forks the head does not build on are
+// never published, while the depth always converges to the book of the head.
+func (m *Manager) Publish(db StateDB, blockNum uint64) {
+	m.mu.Lock()
+	m.sync(db)
+	trades := m.feed.headTrades(m.book, blockNum)
+	updates := m.feed.depthUpdates(m.engine, blockNum)
+	m.mu.Unlock()
+
+	// Deliver outside of the lock, subscribers may be slow
+	for _, trade := range trades {
+		m.feed.tradeFeed.Send(trade)
+	}
+	for _, update := range updates {
+		m.feed.depthFeed.Send(update)
+	}
+}
+
+// SubscribeDepth subscribes to the depth updates of all pairs.
+func (m *Manager) SubscribeDepth(ch chan<- *DepthUpdate) event.Subscription {
+	return m.feed.scope.Track(m.feed.depthFeed.Subscribe(ch))
+}
+
+// SubscribeTrades subscribes to the trades of all pairs, in execution order.
+func (m *Manager) SubscribeTrades(ch chan<- *Trade) event.Subscription {
+	return m.feed.scope.Track(m.feed.tradeFeed.Subscribe(ch))
+}
+
+// Stop terminates all market data subscriptions.
+func (m *Manager) Stop() {
+	m.feed.scope.Close()
+}
+
+// Candle is the OHLCV summary of the trades of a pair within an interval.
+type Candle struct {
+	Pair        TradingPair `json:"pair"`
+	Interval    uint64      `json:"interval"`    // Length of the interval in seconds
+	Start       uint64      `json:"start"`       // Timestamp the interval starts at
+	Open        *big.Int    `json:"open"`        // Price of the first trade
+	High        *big.Int    `json:"high"`        // Highest trade price
+	Low         *big.Int    `json:"low"`         // Lowest trade price
+	Close       *big.Int    `json:"close"`       // Price of the last trade
+	Volume      *big.Int    `json:"volume"`      // Traded amount in base asset
+	QuoteVolume *big.Int    `json:"quoteVolume"` // Traded value in quote asset
+	Trades      int         `json:"trades"`      // Number of trades
+	Closed      bool        `json:"closed"`      // Whether the interval is over
+}
+
+// copy returns a deep copy of the candle.
+func (c *Candle) copy() *Candle {
+	cpy := *c
+	cpy.Open, cpy.High, cpy.Low, cpy.Close = new(big.Int).Set(c.Open), new(big.Int).Set(c.High), new(big.Int).Set(c.Low), new(big.Int).Set(c.Close)
+	cpy.Volume, cpy.QuoteVolume = new(big.Int).Set(c.Volume), new(big.Int).Set(c.QuoteVolume)
+	return &cpy
+}
+
+// candleBuilder aggregates the trades of a pair into candles of an interval.
+type candleBuilder struct {
+	pair     TradingPair
+	interval uint64
+	current  *Candle
+}
+
+func newCandleBuilder(pair TradingPair, interval uint64) *candleBuilder {
+	return &candleBuilder{pair: pair, interval: interval}
+}
+
+// add aggregates a trade and returns the candles it updated: the previous
+// candle, closed, if the trade is the first of a new interval, followed by the
+// candle of the trade's interval. Trades must be added in execution order;
+// their timestamps are those of their blocks, so never decrease.
+func (b *candleBuilder) add(trade *Trade) []*Candle {
+	if trade.Pair != b.pair {
+		return nil
+	}
+	var (
+		updated []*Candle
+		start   = trade.Timestamp - trade.Timestamp%b.interval
+	)
+	if b.current != nil && start > b.current.Start {
+		b.current.Closed = true
+		updated = append(updated, b.current)
+		b.current = nil
+	}
+	if b.current == nil {
+		b.current = &Candle{
+			Pair:        b.pair,
+			Interval:    b.interval,
+			Start:       start,
+			Open:        new(big.Int).Set(trade.Price),
+			High:        new(big.Int).Set(trade.Price),
+			Low:         new(big.Int).Set(trade.Price),
+			Close:       new(big.Int),
+			Volume:      new(big.Int),
+			QuoteVolume: new(big.Int),
+		}
+	}
+	c := b.current
+	if trade.Price.Cmp(c.High) > 0 {
+		c.High.Set(trade.Price)
+	}
+	if trade.Price.Cmp(c.Low) < 0 {
+		c.Low.Set(trade.Price)
+	}
+	c.Close.Set(trade.Price)
+	c.Volume.Add(c.Volume, trade.Amount)
+	c.QuoteVolume.Add(c.QuoteVolume, quoteValue(trade.Amount, trade.Price))
+	c.Trades++
+
+	return append(updated, c.copy())
+}
@@ -0,0 +1,238 @@
+// Copyright 2024 The go-probe Authors
+// This file is part of the go-probe library.
+//
+// The go-probe library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-probe library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-probe library. If not, see <http://www.gnu.org/licenses/>.
+
+package superlight
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/probechain/go-probe/params"
+)
+
+var feedConfig = &params.SuperlightConfig{Enabled: true, MakerFeeBps: 10, TakerFeeBps: 30, Pairs: testListings}
+
+// depthReplica is a copy of one side of an order book kept from depth updates.
+type depthReplica map[string]*big.Int
+
+func (r depthReplica) apply(levels []PriceLevelSnapshot) {
+	for _, level := range levels {
+		if level.Amount.Sign() == 0 {
+			delete(r, level.Price.String())
+		} else {
+			r[level.Price.String()] = level.Amount
+		}
+	}
+}
+
+func (r depthReplica) check(t *testing.T, name string, levels []PriceLevelSnapshot) {
+	t.Helper()
+	if len(r) != len(levels) {
+		t.Fatalf("%s level count mismatch: have %d, want %d", name, len(r), len(levels))
+	}
+	for _, level := range levels {
+		if amount := r[level.Price.String()]; amount == nil || amount.Cmp(level.Amount) != 0 {
+			t.Fatalf("%s level %v amount mismatch: have %v, want %v", name, level.Price, amount, level.Amount)
+		}
+	}
+}
+
+// Tests that depth updates carry consecutive sequence numbers per pair and
+// keep a replica of the book in sync with the book of the published heads.
+func TestDepthUpdates(t *testing.T) {
+	mgr := NewManager(feedConfig)
+	db := newFundedState(t)
+
+	updates := make(chan *DepthUpdate, 16)
+	sub := mgr.SubscribeDepth(updates)
+	defer sub.Unsubscribe()
+
+	var (
+		bids, asks = make(depthReplica), make(depthReplica)
+		seq        uint64
+	)
+	publish := func(blockNum uint64, want int) {
+		t.Helper()
+		mgr.Publish(db, blockNum)
+		for i := 0; i < want; i++ {
+			select {
+			case update := <-updates:
+				if seq++; update.Seq != seq {
+					t.Fatalf("block %d: sequence mismatch: have %d, want %d", blockNum, update.Seq, seq)
+				}
+				if update.Pair != testPair || update.BlockNum != blockNum {
+					t.Fatalf("block %d: update of pair %v at block %d", blockNum, update.Pair, update.BlockNum)
+				}
+				bids.apply(update.Bids)
+				asks.apply(update.Asks)
+			default:
+				t.Fatalf("block %d: missing depth update", blockNum)
+			}
+		}
+		select {
+		case update := <-updates:
+			t.Fatalf("block %d: unexpected depth update %+v", blockNum, update)
+		default:
+		}
+		wantBids, wantAsks := mgr.Engine().GetOrderbook(testPair, 0)
+		bids.check(t, "bid", wantBids)
+		asks.check(t, "ask", wantAsks)
+	}
+	placeOrder(t, mgr, db, OrderSideSell, 300, 1000, 1)
+	placeOrder(t, mgr, db, OrderSideSell, 200, 1000, 1)
+	placeOrder(t, mgr, db, OrderSideBuy, 100, 700, 1)
+	publish(1, 1)
+
+	// An unchanged book yields no update
+	publish(2, 0)
+
+	placeOrder(t, mgr, db, OrderSideBuy, 250, 1200, 3) // Clears 200, rests 200 at 250
+	placeOrder(t, mgr, db, OrderSideSell, 300, 500, 3)
+	publish(3, 1)
+
+	placeOrder(t, mgr, db, OrderSideSell, 100, 900, 4) // Clears both bids
+	publish(4, 1)
+
+	if len(bids) != 0 {
+		t.Fatalf("cleared bids still in replica: %v", bids)
+	}
+	if _, _, have := mgr.orderbook(testPair, 0); have != seq {
+		t.Fatalf("snapshot sequence mismatch: have %d, want %d", have, seq)
+	}
+}
+
+// Tests that only the trades of operations leading to a published head are
+// sent, in execution order, and never those of abandoned forks.
+func TestTradePublication(t *testing.T) {
+	mgr := NewManager(feedConfig)
+	db := newFundedState(t)
+
+	trades := make(chan *Trade, 16)
+	sub := mgr.SubscribeTrades(trades)
+	defer sub.Unsubscribe()
+
+	check := func(name string, want ...int64) {
+		t.Helper()
+		for _, amount := range want {
+			select {
+			case trade := <-trades:
+				if trade.Amount.Cmp(units(amount)) != 0 {
+					t.Fatalf("%s: trade amount mismatch: have %v, want %v", name, trade.Amount, units(amount))
+				}
+			default:
+				t.Fatalf("%s: missing trade of %d", name, amount)
+			}
+		}
+		select {
+		case trade := <-trades:
+			t.Fatalf("%s: unexpected trade %+v", name, trade)
+		default:
+		}
+	}
+	placeOrder(t, mgr, db, OrderSideSell, 200, 1000, 1)
+	placeOrder(t, mgr, db, OrderSideSell, 300, 1000, 1)
+	placeOrder(t, mgr, db, OrderSideBuy, 200, 100, 1)
+	placeOrder(t, mgr, db, OrderSideBuy, 200, 200, 1)
+	mgr.Publish(db, 1)
+	check("head", 100, 200)
+
+	// Build two competing blocks on the head
+	forkA, forkB := db.Copy(), db.Copy()
+	placeOrder(t, mgr, forkA, OrderSideBuy, 300, 900, 2)
+	placeOrder(t, mgr, forkB, OrderSideBuy, 200, 300, 2)
+	placeOrder(t, mgr, forkB, OrderSideBuy, 200, 400, 2)
+
+	// A failed operation records nothing
+	if _, err := mgr.ProcessDEXTransaction(forkB, bob, encodeCancelOrder(testPair.BaseAsset.Hash()), 1002, 2); err == nil {
+		t.Fatal("cancelled unknown order")
+	}
+	mgr.Publish(forkB, 2)
+	check("fork B", 300, 400)
+
+	// Reorg to fork A and extend it
+	mgr.Publish(forkA, 2)
+	check("fork A", 700, 200)
+
+	placeOrder(t, mgr, forkA, OrderSideBuy, 300, 50, 3)
+	mgr.Publish(forkA, 3)
+	check("fork A extended", 50)
+
+	// The depth converged to fork A
+	checkSameBook(t, mgr, func() *Manager {
+		want := NewManager(feedConfig)
+		want.Sync(forkA)
+		return want
+	}())
+}
+
+// Tests that trades are aggregated into candles of their interval, closing a
+// candle once a trade of a later interval arrives.
+func TestCandles(t *testing.T) {
+	builder := newCandleBuilder(testPair, 60)
+
+	trade := func(timestamp uint64, price, amount int64) *Trade {
+		return &Trade{Pair: testPair, Price: units(price), Amount: big.NewInt(amount), Timestamp: timestamp}
+	}
+	check := func(candle *Candle, start uint64, open, high, low, close, volume int64, trades int, closed bool) {
+		t.Helper()
+		if candle.Start != start || candle.Interval != 60 || candle.Trades != trades || candle.Closed != closed {
+			t.Fatalf("candle mismatch: have start %d, trades %d, closed %v, want %d, %d, %v", candle.Start, candle.Trades, candle.Closed, start, trades, closed)
+		}
+		for _, field := range []struct {
+			name       string
+			have, want *big.Int
+		}{
+			{"open", candle.Open, units(open)},
+			{"high", candle.High, units(high)},
+			{"low", candle.Low, units(low)},
+			{"close", candle.Close, units(close)},
+			{"volume", candle.Volume, big.NewInt(volume)},
+		} {
+			if field.have.Cmp(field.want) != 0 {
+				t.Fatalf("candle %s mismatch: have %v, want %v", field.name, field.have, field.want)
+			}
+		}
+	}
+	if candles := builder.add(trade(120, 10, 5)); len(candles) != 1 {
+		t.Fatalf("candle count mismatch: have %d, want 1", len(candles))
+	} else {
+		check(candles[0], 120, 10, 10, 10, 10, 5, 1, false)
+	}
+	builder.add(trade(150, 14, 1))
+	candles := builder.add(trade(179, 8, 2))
+	check(candles[0], 120, 10, 14, 8, 8, 8, 3, false)
+
+	// Updates returned earlier are not modified later on
+	update := builder.add(trade(179, 9, 1))[0]
+	builder.add(trade(179, 20, 1))
+	check(update, 120, 10, 14, 8, 9, 9, 4, false)
+
+	// Trades of other pairs are ignored
+	if candles := builder.add(&Trade{Pair: TradingPair{BaseAsset: bob}, Price: units(1), Amount: big.NewInt(1), Timestamp: 500}); candles != nil {
+		t.Fatalf("candle of other pair: %+v", candles)
+	}
+	// A trade after a gap closes the candle and opens the one of its interval
+	candles = builder.add(trade(300, 11, 3))
+	if len(candles) != 2 {
+		t.Fatalf("candle count mismatch: have %d, want 2", len(candles))
+	}
+	check(candles[0], 120, 10, 20, 8, 20, 10, 5, true)
+	check(candles[1], 300, 11, 11, 11, 11, 3, 1, false)
+
+	if want := quoteValue(big.NewInt(3), units(11)); candles[1].QuoteVolume.Cmp(want) != 0 {
+		t.Fatalf("quote volume mismatch: have %v, want %v", candles[1].QuoteVolume, want)
+	}
+}
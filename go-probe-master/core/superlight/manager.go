@@ -17,7 +17,9 @@
 package superlight
 
 import (
+	"encoding/binary"
 	"errors"
+	"math"
 	"math/big"
 	"sync"
 
@@ -29,107 +31,490 @@ import (
 var (
 	ErrDEXNotEnabled = errors.New("superlight DEX not enabled")
 	ErrInvalidDEXOp  = errors.New("invalid DEX operation")
+	ErrOutOfGas      = errors.New("out of gas")
+
+	errNoHeadState = errors.New("chain head state not available")
+)
+
+// DEX operation types, encoded in the low nibble of the first byte of
+// transaction data.
+const (
+	OpPlaceOrder   byte = 0x01
+	OpCancelOrder  byte = 0x02
+	OpInitiateSwap byte = 0x03
+	OpRedeemSwap   byte = 0x04
+	OpRefundSwap   byte = 0x05
+	OpListPair     byte = 0x06
+	OpDelistPair   byte = 0x07
 )
 
-// DEX operation types encoded in transaction data.
+// Versions of the DEX operation encoding, in the high nibble of the first byte
+// of transaction data. Operations are sent as version|type.
 const (
-	OpPlaceOrder  byte = 0x01
-	OpCancelOrder byte = 0x02
+	OpVersion0 byte = 0x00 // Limit orders
+	OpVersion1 byte = 0x10 // Order types, stop prices and expiry
+
+	opVersionMask byte = 0xf0
 )
 
 // Manager coordinates the Superlight DEX matching engine with on-chain state.
 // It processes DEX transactions and settles trades via the special address.
+//
+// The order book is part of the state of the settlement account, the matching
+// engine merely caches it. Whenever the manager processes an operation on a
+// state whose book differs from the cached one, because of a reorg, a reverted
+// transaction or a call on another state, the engine is rebuilt from the state.
 type Manager struct {
-	mu     sync.RWMutex
-	config *params.SuperlightConfig
-	engine *MatchingEngine
-	oracle PriceOracle
+	mu        sync.RWMutex
+	config    *params.SuperlightConfig
+	selfTrade SelfTradeMode
+	engine    *MatchingEngine
+	oracle    PriceOracle
+	feed      *marketFeed
+
+	book  common.Hash                     // Book hash of the state the engine is in sync with
+	stale bool                            // Whether the engine was modified by a failed operation
+	head  func() (StateDB, uint64, error) // Retrieves the state and timestamp of the current chain head
 }
 
 // NewManager creates a new Superlight DEX manager.
 func NewManager(config *params.SuperlightConfig) *Manager {
 	if config == nil {
 		config = &params.SuperlightConfig{
-			MakerFeeBps:         10,  // 0.1%
-			TakerFeeBps:         30,  // 0.3%
+			MakerFeeBps:         10, // 0.1%
+			TakerFeeBps:         30, // 0.3%
 			MaxOrdersPerAccount: 100,
 		}
 	}
-	return &Manager{
-		config: config,
-		engine: NewMatchingEngine(),
-		oracle: &NoOpOracle{},
+	selfTrade, err := ParseSelfTradeMode(config.SelfTradePrevention)
+	if err != nil {
+		log.Warn("Invalid Superlight self-trade prevention, cancelling newest orders", "err", err)
+	}
+	m := &Manager{
+		config:    config,
+		selfTrade: selfTrade,
+		feed:      newMarketFeed(),
 	}
+	m.engine = m.newEngine()
+	return m
+}
+
+// newEngine creates an empty matching engine enforcing the configured order
+// limit and self-trade prevention.
+func (m *Manager) newEngine() *MatchingEngine {
+	engine := NewMatchingEngine()
+	engine.SetMaxOrdersPerAccount(m.config.MaxOrdersPerAccount)
+	engine.SetSelfTradeMode(m.selfTrade)
+	return engine
 }
 
-// SetOracle sets the price oracle for the DEX.
+// SetOracle replaces the built-in TWAP oracle of the DEX. Stop orders are
+// triggered by its prices while processing transactions, so it must return the
+// same prices on every node for the same state.
 func (m *Manager) SetOracle(oracle PriceOracle) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.oracle = oracle
 }
 
+// priceOracle returns the oracle pricing pairs on the given state at the given
+// time: the configured one if any, otherwise the built-in TWAP oracle.
+func (m *Manager) priceOracle(db StateReader, now uint64) PriceOracle {
+	if m.oracle != nil {
+		return m.oracle
+	}
+	return NewTWAPOracle(db, now)
+}
+
+// headOracle returns the price oracle on the state of the current chain head.
+func (m *Manager) headOracle() PriceOracle {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.oracle != nil {
+		return m.oracle
+	}
+	if m.head == nil {
+		return &NoOpOracle{}
+	}
+	db, now, err := m.head()
+	if err != nil {
+		log.Warn("Failed to retrieve head state for Superlight prices", "err", err)
+		return &NoOpOracle{}
+	}
+	return NewTWAPOracle(db, now)
+}
+
 // Engine returns the matching engine for direct access.
 func (m *Manager) Engine() *MatchingEngine {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.engine
+}
+
+// SetHeadState sets the function retrieving the state and timestamp of the
+// current chain head, which the order book is synced with and prices are read
+// from before serving queries.
+func (m *Manager) SetHeadState(head func() (StateDB, uint64, error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.head = head
+}
+
+// Sync rebuilds the matching engine from the order book in the given state,
+// unless it is already in sync with it.
+func (m *Manager) Sync(db StateDB) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sync(db)
+}
+
+// sync rebuilds the matching engine from the state if needed. Trades matched
+// so far are carried over, as the state only holds the open orders.
+func (m *Manager) sync(db StateDB) {
+	hash := bookHash(db)
+	if !m.stale && hash == m.book {
+		return
+	}
+	orders, sequence := loadOrders(db)
+
+	engine := m.newEngine()
+	engine.restore(orders, sequence)
+	engine.trades, engine.tradeIndex = m.engine.trades, m.engine.tradeIndex
+
+	m.engine, m.book, m.stale = engine, hash, false
+	log.Debug("Superlight order book rebuilt", "book", hash, "orders", len(orders))
+}
+
+// headEngine returns the matching engine synced with the current chain head.
+func (m *Manager) headEngine() *MatchingEngine {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.syncHead()
 	return m.engine
 }
 
-// ProcessDEXTransaction processes a Superlight DEX transaction.
-// It parses the operation from tx data and executes it.
-func (m *Manager) ProcessDEXTransaction(from common.Address, data []byte,
+// syncHead syncs the matching engine with the state of the current chain head.
+func (m *Manager) syncHead() {
+	if m.head == nil {
+		return
+	}
+	if db, _, err := m.head(); err == nil {
+		m.sync(db)
+	} else {
+		log.Warn("Failed to retrieve head state for Superlight order book", "err", err)
+	}
+}
+
+// orderbook returns a snapshot of the order book of a pair at the current
+// chain head, along with the sequence number of the last depth update it
+// includes.
+func (m *Manager) orderbook(pair TradingPair, depth int) (bids, asks []PriceLevelSnapshot, seq uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.syncHead()
+	bids, asks = m.engine.GetOrderbook(pair, depth)
+	return bids, asks, m.feed.seq(pair)
+}
+
+// headBridge returns the atomic swap bridge on the state of the current chain
+// head, at the head's timestamp.
+func (m *Manager) headBridge() (*HTLCBridge, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.head == nil {
+		return nil, errNoHeadState
+	}
+	db, now, err := m.head()
+	if err != nil {
+		return nil, err
+	}
+	return NewHTLCBridge(db, now), nil
+}
+
+// headPair returns the trading rules of a pair at the current chain head, nil
+// if it is not listed.
+func (m *Manager) headPair(pair TradingPair) (*PairInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.head == nil {
+		return nil, errNoHeadState
+	}
+	db, _, err := m.head()
+	if err != nil {
+		return nil, err
+	}
+	return lookupPair(db, m.config.Pairs, pair), nil
+}
+
+// ProcessDEXTransaction processes a Superlight DEX transaction sent to the
+// settlement address, parsing the operation from tx data and settling it on
+// the given state. On error the caller must revert the state changes made.
+func (m *Manager) ProcessDEXTransaction(db StateDB, from common.Address, data []byte,
 	timestamp uint64, blockNum uint64) ([]*Trade, error) {
 
+	trades, _, err := m.ProcessDEXTransactionWithGas(db, from, data, timestamp, blockNum, math.MaxUint64)
+	return trades, err
+}
+
+// ProcessDEXTransactionWithGas is like ProcessDEXTransaction, but charges the
+// operation a base fee, then for every order it visited while matching and
+// every storage slot it wrote from the given gas, returning the gas left.
+// Matching stops as soon as the gas can't pay for more orders. Operations
+// needing more gas fail with ErrOutOfGas, failed operations are charged for
+// the work done too.
+func (m *Manager) ProcessDEXTransactionWithGas(db StateDB, from common.Address, data []byte,
+	timestamp uint64, blockNum uint64, gas uint64) ([]*Trade, uint64, error) {
+
 	if !m.config.Enabled {
-		return nil, ErrDEXNotEnabled
+		return nil, gas, ErrDEXNotEnabled
 	}
 	if len(data) < 1 {
-		return nil, ErrInvalidDEXOp
+		return nil, gas, ErrInvalidDEXOp
+	}
+	if gas < params.SuperlightOpGas {
+		return nil, 0, ErrOutOfGas
 	}
+	gas -= params.SuperlightOpGas
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ensureSettlementAccount(db)
+	listConfigPairs(db, m.config.Pairs)
+	m.sync(db)
+	m.engine.meter(gas / params.SuperlightTradeGas)
 
-	switch data[0] {
-	case OpPlaceOrder:
-		return m.processPlaceOrder(from, data[1:], timestamp, blockNum)
-	case OpCancelOrder:
-		return nil, m.processCancelOrder(from, data[1:])
+	var (
+		metered = &meteredStateDB{StateDB: db}
+		trades  []*Trade
+		book    = true
+		err     error
+	)
+	switch version, op := data[0]&opVersionMask, data[0]&^opVersionMask; {
+	case version > OpVersion1:
+		err = ErrInvalidDEXOp
+	case op == OpPlaceOrder:
+		trades, err = m.processPlaceOrder(metered, from, version, data[1:], timestamp, blockNum)
+	case op == OpCancelOrder:
+		err = m.processCancelOrder(metered, from, data[1:])
+	case op == OpInitiateSwap || op == OpRedeemSwap || op == OpRefundSwap:
+		// Swaps don't touch the order book, leave its hash alone
+		err = processSwap(metered, from, op, data[1:], timestamp)
+		book = false
+	case op == OpListPair || op == OpDelistPair:
+		// Listings only gate new orders, leave the book hash alone too
+		err = m.processListing(metered, from, op, data[1:])
+		book = false
 	default:
-		return nil, ErrInvalidDEXOp
+		err = ErrInvalidDEXOp
+	}
+	var next common.Hash
+	if err == nil && book {
+		next = nextBookHash(m.book, from, data, timestamp, blockNum)
+		metered.SetState(SettlementAddress, bookHashKey, next)
+	}
+	used := m.engine.steps*params.SuperlightTradeGas + metered.writes*params.SstoreSetGas
+	if m.engine.exhausted() || used > gas {
+		// The engine may hold the orders of the operation, rebuild it from
+		// the reverted state
+		m.stale = true
+		return nil, 0, ErrOutOfGas
+	}
+	if err != nil {
+		return nil, gas - used, err
 	}
+	if book {
+		prev := m.book
+		m.book = next
+		m.feed.record(prev, m.book, trades, blockNum)
+	}
+	return trades, gas - used, nil
+}
+
+// meteredStateDB counts the storage writes of a DEX operation to charge them.
+type meteredStateDB struct {
+	StateDB
+	writes uint64
 }
 
-// processPlaceOrder decodes and executes a place order operation.
-// Data format: [side(1)] [baseAsset(20)] [quoteAsset(20)] [price(32)] [amount(32)]
-func (m *Manager) processPlaceOrder(from common.Address, data []byte, timestamp, blockNum uint64) ([]*Trade, error) {
-	if len(data) < 105 { // 1 + 20 + 20 + 32 + 32
+func (db *meteredStateDB) SetState(addr common.Address, key, value common.Hash) {
+	db.writes++
+	db.StateDB.SetState(addr, key, value)
+}
+
+// placeOrderOp is a decoded place order operation.
+type placeOrderOp struct {
+	side   OrderSide
+	pair   TradingPair
+	price  *big.Int
+	amount *big.Int
+	opts   OrderOptions
+}
+
+// decodePlaceOrder decodes a place order operation of the given encoding version.
+// Version 0: [side(1)] [baseAsset(20)] [quoteAsset(20)] [price(32)] [amount(32)]
+// Version 1: [side(1)] [type(1)] [baseAsset(20)] [quoteAsset(20)] [price(32)] [amount(32)] [stopPrice(32)] [expiryBlock(8)]
+func decodePlaceOrder(version byte, data []byte) (*placeOrderOp, error) {
+	op := new(placeOrderOp)
+	switch version {
+	case OpVersion0:
+		if len(data) < 105 { // 1 + 20 + 20 + 32 + 32
+			return nil, ErrInvalidDEXOp
+		}
+		op.side = OrderSide(data[0])
+		data = data[1:]
+
+	case OpVersion1:
+		if len(data) < 146 { // 1 + 1 + 20 + 20 + 32 + 32 + 32 + 8
+			return nil, ErrInvalidDEXOp
+		}
+		op.side, op.opts.Type = OrderSide(data[0]), OrderType(data[1])
+		op.opts.StopPrice = new(big.Int).SetBytes(data[106:138])
+		op.opts.ExpiryBlock = binary.BigEndian.Uint64(data[138:146])
+		data = data[2:]
+
+	default:
 		return nil, ErrInvalidDEXOp
 	}
+	op.pair = TradingPair{
+		BaseAsset:  common.BytesToAddress(data[0:20]),
+		QuoteAsset: common.BytesToAddress(data[20:40]),
+	}
+	op.price = new(big.Int).SetBytes(data[40:72])
+	op.amount = new(big.Int).SetBytes(data[72:104])
 
-	side := OrderSide(data[0])
-	baseAsset := common.BytesToAddress(data[1:21])
-	quoteAsset := common.BytesToAddress(data[21:41])
-	price := new(big.Int).SetBytes(data[41:73])
-	amount := new(big.Int).SetBytes(data[73:105])
+	return op, nil
+}
 
-	pair := TradingPair{BaseAsset: baseAsset, QuoteAsset: quoteAsset}
+// processPlaceOrder decodes and executes a place order operation, escrowing
+// the assets the order may spend before handing it to the matching engine.
+// Afterwards the stop orders of the pair triggered by the oracle price, by
+// default the last trade price, are executed, and the orders found expired are removed.
+func (m *Manager) processPlaceOrder(db StateDB, from common.Address, version byte, data []byte, timestamp, blockNum uint64) ([]*Trade, error) {
+	op, err := decodePlaceOrder(version, data)
+	if err != nil {
+		return nil, err
+	}
+	side, pair := op.side, op.pair
 
-	order, trades, err := m.engine.PlaceOrder(from, pair, side, price, amount, timestamp, blockNum)
+	if side != OrderSideBuy && side != OrderSideSell {
+		return nil, ErrInvalidDEXOp
+	}
+	// Buy stop orders need a price to bound their escrow, the book they will
+	// be executed against is not known yet
+	if side == OrderSideBuy && op.opts.Type == OrderTypeStop && op.price.Sign() == 0 {
+		return nil, ErrInvalidPrice
+	}
+	if op.amount.Sign() <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	info := readListing(db, pair)
+	if info == nil {
+		return nil, ErrPairNotListed
+	}
+	if err := info.validate(op.price, op.amount, op.opts); err != nil {
+		return nil, err
+	}
+	escrow := m.orderEscrow(pair, from, side, op.price, op.amount, blockNum)
+	if err := transferAsset(db, escrowAsset(pair, side), from, SettlementAddress, escrow); err != nil {
+		return nil, err
+	}
+	order, trades, err := m.engine.PlaceOrderWithOptions(from, pair, side, op.price, op.amount, op.opts, timestamp, blockNum)
 	if err != nil {
 		return nil, err
 	}
+	// From here on the engine diverges from the state until the operation is
+	// done, any failure forces a rebuild
+	m.stale = true
+	setOrderEscrow(db, order.ID, escrow)
 
-	// Calculate fees for each trade
-	for _, trade := range trades {
-		m.calculateFees(trade)
+	if err := m.settleOrder(db, order, trades, false); err != nil {
+		return nil, err
+	}
+	for _, stop := range m.engine.triggerStops(pair, m.priceOracle(db, timestamp).GetPrice(pair), blockNum) {
+		if m.engine.exhausted() {
+			break
+		}
+		stopTrades := m.engine.executeStop(stop, timestamp, blockNum)
+		if err := m.settleOrder(db, stop, stopTrades, true); err != nil {
+			return nil, err
+		}
+		trades = append(trades, stopTrades...)
+	}
+	// Stop orders found expired without any being triggered are left over
+	if err := m.collectEvicted(db); err != nil {
+		return nil, err
 	}
+	setUint64(db, orderSequenceKey, m.engine.sequence)
+	m.stale = false
 
-	log.Debug("Superlight order placed", "orderID", order.ID.Hex(), "side", side,
-		"price", price, "amount", amount, "trades", len(trades))
+	log.Debug("Superlight order placed", "orderID", order.ID.Hex(), "side", side, "type", op.opts.Type,
+		"price", op.price, "amount", op.amount, "trades", len(trades))
 
 	return trades, nil
 }
 
-// processCancelOrder decodes and executes a cancel order operation.
+// settleOrder settles the trades of an executed order, accounting their prices
+// in the price accumulator of the pair, and persists the fills of its makers.
+// The order itself is then written to the state if it rests in the book or
+// waits for its trigger, and removed from it with its escrow released
+// otherwise. stored tells whether the order is in the state already. Orders
+// evicted from the book meanwhile are persisted as well.
+func (m *Manager) settleOrder(db StateDB, order *Order, trades []*Trade, stored bool) error {
+	for _, trade := range trades {
+		m.calculateFees(trade)
+		if err := m.SettleTrade(db, trade); err != nil {
+			return err
+		}
+		updateAccumulator(db, trade)
+		if maker := m.engine.openOrder(order.Pair, trade.MakerOrder); maker != nil {
+			updateOrderFill(db, maker)
+		} else {
+			deleteOrder(db, trade.MakerOrder)
+		}
+	}
+	switch {
+	case order.Status == OrderStatusFilled || order.Status == OrderStatusCancelled:
+		if err := releaseEscrow(db, order.ID, escrowAsset(order.Pair, order.Side), order.Owner); err != nil {
+			return err
+		}
+		if stored {
+			deleteOrder(db, order.ID)
+		}
+	case stored:
+		updateOrderFill(db, order)
+	default:
+		storeOrder(db, order)
+	}
+	return m.collectEvicted(db)
+}
+
+// collectEvicted persists the orders the engine evicted or reduced without
+// trading: orders still resting are updated, the others removed from the
+// state with their escrow released.
+func (m *Manager) collectEvicted(db StateDB) error {
+	for _, order := range m.engine.takeEvicted() {
+		if m.engine.openOrder(order.Pair, order.ID) != nil {
+			updateOrderFill(db, order)
+			continue
+		}
+		if err := releaseEscrow(db, order.ID, escrowAsset(order.Pair, order.Side), order.Owner); err != nil {
+			return err
+		}
+		deleteOrder(db, order.ID)
+	}
+	return nil
+}
+
+// processCancelOrder decodes and executes a cancel order operation, releasing
+// the escrow left of the order.
 // Data format: [orderID(32)]
-func (m *Manager) processCancelOrder(from common.Address, data []byte) error {
+func (m *Manager) processCancelOrder(db StateDB, from common.Address, data []byte) error {
 	if len(data) < 32 {
 		return ErrInvalidDEXOp
 	}
@@ -139,34 +524,178 @@ func (m *Manager) processCancelOrder(from common.Address, data []byte) error {
 	if err != nil {
 		return err
 	}
+	m.stale = true
+	if err := releaseEscrow(db, order.ID, escrowAsset(order.Pair, order.Side), order.Owner); err != nil {
+		return err
+	}
+	deleteOrder(db, order.ID)
+	m.stale = false
 
 	log.Debug("Superlight order cancelled", "orderID", order.ID.Hex())
 	return nil
 }
 
+// processSwap decodes and executes an atomic swap operation on the native
+// HTLC bridge.
+// Initiate format: [receiver(20)] [asset(20)] [amount(32)] [hashLock(32)] [timeLock(8)]
+// Redeem format:   [swapID(32)] [secret(32)]
+// Refund format:   [swapID(32)]
+func processSwap(db StateDB, from common.Address, op byte, data []byte, timestamp uint64) error {
+	bridge := NewHTLCBridge(db, timestamp)
+
+	switch op {
+	case OpInitiateSwap:
+		if len(data) < 112 {
+			return ErrInvalidDEXOp
+		}
+		var (
+			receiver = common.BytesToAddress(data[0:20])
+			asset    = common.BytesToAddress(data[20:40])
+			amount   = new(big.Int).SetBytes(data[40:72])
+			hashLock = common.BytesToHash(data[72:104])
+			timeLock = binary.BigEndian.Uint64(data[104:112])
+		)
+		id, err := bridge.InitiateAssetSwap(from, receiver, asset, amount, hashLock, timeLock)
+		if err != nil {
+			return err
+		}
+		log.Debug("Superlight swap initiated", "swapID", id.Hex(), "receiver", receiver, "asset", asset, "amount", amount)
+		return nil
+
+	case OpRedeemSwap:
+		if len(data) < 32+SwapSecretLength {
+			return ErrInvalidDEXOp
+		}
+		return bridge.RedeemSwap(common.BytesToHash(data[:32]), data[32:32+SwapSecretLength])
+
+	default:
+		if len(data) < 32 {
+			return ErrInvalidDEXOp
+		}
+		return bridge.RefundSwap(common.BytesToHash(data[:32]))
+	}
+}
+
+// processListing decodes and executes a pair listing operation of the
+// governor, listing a pair or updating its trading rules, or delisting it.
+// List format:   [baseAsset(20)] [quoteAsset(20)] [tickSize(32)] [lotSize(32)]
+// Delist format: [baseAsset(20)] [quoteAsset(20)]
+func (m *Manager) processListing(db StateDB, from common.Address, op byte, data []byte) error {
+	if m.config.Governor == (common.Address{}) || from != m.config.Governor {
+		return ErrNotGovernor
+	}
+	if len(data) < 40 {
+		return ErrInvalidDEXOp
+	}
+	pair := TradingPair{
+		BaseAsset:  common.BytesToAddress(data[0:20]),
+		QuoteAsset: common.BytesToAddress(data[20:40]),
+	}
+	if op == OpDelistPair {
+		if readListing(db, pair) == nil {
+			return ErrPairNotListed
+		}
+		deleteListing(db, pair)
+		log.Info("Superlight pair delisted", "pair", pair)
+		return nil
+	}
+	if len(data) < 104 {
+		return ErrInvalidDEXOp
+	}
+	writeListing(db, &PairInfo{
+		Pair:     pair,
+		TickSize: new(big.Int).SetBytes(data[40:72]),
+		LotSize:  new(big.Int).SetBytes(data[72:104]),
+	})
+	log.Info("Superlight pair listed", "pair", pair)
+	return nil
+}
+
+// orderEscrow returns the amount an order has to escrow: the base amount for
+// sell orders, and the quote value plus the highest possible fee for buy orders.
+// Buy orders without price are valued at what they would cost against the book.
+func (m *Manager) orderEscrow(pair TradingPair, owner common.Address, side OrderSide, price, amount *big.Int, blockNum uint64) *big.Int {
+	if side == OrderSideSell {
+		return new(big.Int).Set(amount)
+	}
+	feeBps := m.config.MakerFeeBps
+	if m.config.TakerFeeBps > feeBps {
+		feeBps = m.config.TakerFeeBps
+	}
+	value := quoteValue(amount, price)
+	if price.Sign() == 0 {
+		value = m.engine.sweepCost(pair, owner, amount, blockNum)
+	}
+	fee := new(big.Int).Mul(value, new(big.Int).SetUint64(feeBps))
+	fee.Div(fee, big.NewInt(10000))
+
+	return value.Add(value, fee)
+}
+
+// feeCollector returns the account credited with trading fees.
+func (m *Manager) feeCollector() common.Address {
+	if m.config.FeeCollector != (common.Address{}) {
+		return m.config.FeeCollector
+	}
+	return SettlementAddress
+}
+
 // calculateFees computes maker and taker fees for a trade.
 func (m *Manager) calculateFees(trade *Trade) {
 	// Fee = amount * price * feeBps / 10000
-	quoteValue := new(big.Int).Mul(trade.Amount, trade.Price)
-	quoteValue.Div(quoteValue, big.NewInt(1e18)) // Normalize from price scaling
+	value := quoteValue(trade.Amount, trade.Price)
 
-	trade.MakerFee = new(big.Int).Mul(quoteValue, new(big.Int).SetUint64(m.config.MakerFeeBps))
+	trade.MakerFee = new(big.Int).Mul(value, new(big.Int).SetUint64(m.config.MakerFeeBps))
 	trade.MakerFee.Div(trade.MakerFee, big.NewInt(10000))
 
-	trade.TakerFee = new(big.Int).Mul(quoteValue, new(big.Int).SetUint64(m.config.TakerFeeBps))
+	trade.TakerFee = new(big.Int).Mul(value, new(big.Int).SetUint64(m.config.TakerFeeBps))
 	trade.TakerFee.Div(trade.TakerFee, big.NewInt(10000))
 }
 
-// SettleTrade processes on-chain settlement for a trade.
-// In a full implementation, this would transfer tokens between maker and taker
-// through the DEX settlement special address.
-func (m *Manager) SettleTrade(trade *Trade) error {
-	log.Info("Settling trade", "tradeID", trade.ID.Hex(),
+// SettleTrade moves the funds of a trade out of the escrow of both orders: the
+// buyer receives the base amount, the seller the quote value minus its fee, and
+// the fee collector both fees. The buyer's fee is paid from its escrow on top
+// of the quote value. Makers whose order got filled get their escrow back.
+func (m *Manager) SettleTrade(db StateDB, trade *Trade) error {
+	var (
+		buyer, seller       = trade.Taker, trade.Maker
+		buyOrder, sellOrder = trade.TakerOrder, trade.MakerOrder
+		buyerFee, sellerFee = trade.TakerFee, trade.MakerFee
+		makerSide           = OrderSideSell
+		value               = quoteValue(trade.Amount, trade.Price)
+	)
+	if trade.Side == OrderSideSell {
+		buyer, seller = seller, buyer
+		buyOrder, sellOrder = sellOrder, buyOrder
+		buyerFee, sellerFee = sellerFee, buyerFee
+		makerSide = OrderSideBuy
+	}
+	if sellerFee.Cmp(value) > 0 {
+		sellerFee = value
+	}
+	if err := spendEscrow(db, buyOrder, new(big.Int).Add(value, buyerFee)); err != nil {
+		return err
+	}
+	if err := spendEscrow(db, sellOrder, trade.Amount); err != nil {
+		return err
+	}
+	if err := transferAsset(db, trade.Pair.BaseAsset, SettlementAddress, buyer, trade.Amount); err != nil {
+		return err
+	}
+	if err := transferAsset(db, trade.Pair.QuoteAsset, SettlementAddress, seller, new(big.Int).Sub(value, sellerFee)); err != nil {
+		return err
+	}
+	if err := transferAsset(db, trade.Pair.QuoteAsset, SettlementAddress, m.feeCollector(), new(big.Int).Add(buyerFee, sellerFee)); err != nil {
+		return err
+	}
+	if m.engine.openOrder(trade.Pair, trade.MakerOrder) == nil {
+		if err := releaseEscrow(db, trade.MakerOrder, escrowAsset(trade.Pair, makerSide), trade.Maker); err != nil {
+			return err
+		}
+	}
+	log.Debug("Superlight trade settled", "tradeID", trade.ID.Hex(),
 		"maker", trade.Maker.Hex(), "taker", trade.Taker.Hex(),
 		"amount", trade.Amount, "price", trade.Price)
 
-	// Settlement is performed by the state transition function when it
-	// encounters a SuperlightTx targeting SPECIAL_ADDRESS_FOR_DEX_SETTLEMENT.
-	// The state changes (balance transfers) happen in core/state_transition.go.
 	return nil
 }
@@ -21,17 +21,35 @@ import (
 	"testing"
 
 	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/core/rawdb"
+	"github.com/probechain/go-probe/core/state"
 	"github.com/probechain/go-probe/params"
 )
 
+// testListings lists testPair without restrictions on prices and amounts.
+var testListings = []params.SuperlightPair{{BaseAsset: testPair.BaseAsset, QuoteAsset: testPair.QuoteAsset}}
+
+// newTestState creates an empty state database to settle trades on.
+func newTestState(t *testing.T) *state.StateDB {
+	t.Helper()
+	db, err := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	if err != nil {
+		t.Fatalf("failed to create state: %v", err)
+	}
+	return db
+}
+
 func TestManagerProcessPlaceOrder(t *testing.T) {
 	config := &params.SuperlightConfig{
 		Enabled:             true,
 		MakerFeeBps:         10,
 		TakerFeeBps:         30,
 		MaxOrdersPerAccount: 100,
+		Pairs:               testListings,
 	}
 	mgr := NewManager(config)
+	db := newTestState(t)
+	AddAssetBalance(db, common.HexToAddress("0x1111111111111111111111111111111111111111"), alice, big.NewInt(10))
 
 	// Encode a place order: sell 10 tokens at price 1000
 	data := make([]byte, 106) // OpPlaceOrder(1) + side(1) + base(20) + quote(20) + price(32) + amount(32)
@@ -46,7 +64,7 @@ func TestManagerProcessPlaceOrder(t *testing.T) {
 	amountBytes := amount.Bytes()
 	copy(data[74+(32-len(amountBytes)):106], amountBytes)
 
-	trades, err := mgr.ProcessDEXTransaction(alice, data, 1000, 1)
+	trades, err := mgr.ProcessDEXTransaction(db, alice, data, 1000, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -57,13 +75,16 @@ func TestManagerProcessPlaceOrder(t *testing.T) {
 	// Now place a matching buy order
 	data[0] = OpPlaceOrder
 	data[1] = byte(OrderSideBuy)
-	trades, err = mgr.ProcessDEXTransaction(bob, data, 1001, 2)
+	trades, err = mgr.ProcessDEXTransaction(db, bob, data, 1001, 2)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(trades) != 1 {
 		t.Fatalf("expected 1 trade, got %d", len(trades))
 	}
+	if balance := AssetBalance(db, common.HexToAddress("0x1111111111111111111111111111111111111111"), bob); balance.Cmp(amount) != 0 {
+		t.Fatalf("expected buyer balance %v, got %v", amount, balance)
+	}
 }
 
 func TestManagerFees(t *testing.T) {
@@ -114,44 +135,219 @@ func TestManagerDisabled(t *testing.T) {
 	mgr := NewManager(config)
 
 	data := []byte{OpPlaceOrder, byte(OrderSideBuy)}
-	_, err := mgr.ProcessDEXTransaction(alice, data, 1000, 1)
+	_, err := mgr.ProcessDEXTransaction(newTestState(t), alice, data, 1000, 1)
 	if err != ErrDEXNotEnabled {
 		t.Fatalf("expected ErrDEXNotEnabled, got %v", err)
 	}
 }
 
 func TestManagerInvalidOp(t *testing.T) {
-	config := &params.SuperlightConfig{Enabled: true}
+	config := &params.SuperlightConfig{Enabled: true, Pairs: testListings}
 	mgr := NewManager(config)
 
+	db := newTestState(t)
+
 	// Empty data
-	_, err := mgr.ProcessDEXTransaction(alice, []byte{}, 1000, 1)
+	_, err := mgr.ProcessDEXTransaction(db, alice, []byte{}, 1000, 1)
 	if err != ErrInvalidDEXOp {
 		t.Fatalf("expected ErrInvalidDEXOp, got %v", err)
 	}
 
 	// Unknown op code
-	_, err = mgr.ProcessDEXTransaction(alice, []byte{0xFF}, 1000, 1)
+	_, err = mgr.ProcessDEXTransaction(db, alice, []byte{0xFF}, 1000, 1)
 	if err != ErrInvalidDEXOp {
 		t.Fatalf("expected ErrInvalidDEXOp, got %v", err)
 	}
 }
 
-func TestSettleTrade(t *testing.T) {
-	config := &params.SuperlightConfig{Enabled: true}
+// testOracle is a price oracle returning a fixed price for all pairs.
+type testOracle struct {
+	price *big.Int
+}
+
+func (o *testOracle) GetPrice(pair TradingPair) *big.Int { return o.price }
+
+func (o *testOracle) GetTWAP(pair TradingPair, windowSeconds uint64) *big.Int { return o.price }
+
+func TestManagerOrderTypes(t *testing.T) {
+	config := &params.SuperlightConfig{Enabled: true, TakerFeeBps: 100, Pairs: testListings}
 	mgr := NewManager(config)
+	oracle := new(testOracle)
+	mgr.SetOracle(oracle)
+
+	db := newTestState(t)
+	AddAssetBalance(db, testPair.BaseAsset, alice, units(10000))
+	db.AddBalance(bob, units(10000))
 
-	trade := &Trade{
-		ID:     common.HexToHash("0x1234"),
-		Maker:  alice,
-		Taker:  bob,
-		Amount: big.NewInt(100),
-		Price:  big.NewInt(1000),
+	place := func(owner common.Address, data []byte, blockNum uint64) []*Trade {
+		t.Helper()
+		trades, err := mgr.ProcessDEXTransaction(db, owner, data, 1000+blockNum, blockNum)
+		if err != nil {
+			t.Fatalf("failed to place order: %v", err)
+		}
+		return trades
 	}
+	place(alice, encodePlaceOrder(OrderSideSell, testPair, units(200), units(1000)), 1)
 
-	// Settlement should succeed (placeholder implementation)
-	err := mgr.SettleTrade(trade)
+	// A market buy escrows what sweeping the book costs plus fees, and gets
+	// back nothing as it is filled at exactly that cost
+	trades := place(bob, encodePlaceOrderV1(OrderSideBuy, testPair, new(big.Int), units(400), OrderOptions{Type: OrderTypeMarket}), 2)
+	if len(trades) != 1 {
+		t.Fatalf("expected 1 trade, got %d", len(trades))
+	}
+	if balance := db.GetBalance(bob); balance.Cmp(units(10000-808)) != 0 {
+		t.Fatalf("expected buyer balance %v, got %v", units(10000-808), balance)
+	}
+	// Buy stops need a price to bound their escrow, unknown versions are rejected
+	data := encodePlaceOrderV1(OrderSideBuy, testPair, new(big.Int), units(100), OrderOptions{Type: OrderTypeStop, StopPrice: units(250)})
+	if _, err := mgr.ProcessDEXTransaction(db, bob, data, 1003, 3); err != ErrInvalidPrice {
+		t.Fatalf("expected ErrInvalidPrice, got %v", err)
+	}
+	data[0] = 0x20 | OpPlaceOrder
+	if _, err := mgr.ProcessDEXTransaction(db, bob, data, 1003, 3); err != ErrInvalidDEXOp {
+		t.Fatalf("expected ErrInvalidDEXOp, got %v", err)
+	}
+	// A pending stop-limit order survives restarts
+	place(bob, encodePlaceOrderV1(OrderSideBuy, testPair, units(200), units(100), OrderOptions{Type: OrderTypeStopLimit, StopPrice: units(250)}), 3)
+
+	restarted := NewManager(config)
+	restarted.Sync(db)
+	stops := restarted.Engine().books[testPair].stops
+	if len(stops) != 1 || stops[0].StopPrice.Cmp(units(250)) != 0 || stops[0].Status != OrderStatusPending {
+		t.Fatalf("pending stop order not restored: %+v", stops)
+	}
+	// It triggers once the oracle price reaches its stop price
+	oracle.price = units(240)
+	if trades := place(alice, encodePlaceOrder(OrderSideSell, testPair, units(300), units(100)), 4); len(trades) != 0 {
+		t.Fatalf("expected no trades before the trigger, got %d", len(trades))
+	}
+	oracle.price = units(250)
+	if trades := place(alice, encodePlaceOrder(OrderSideSell, testPair, units(300), units(100)), 5); len(trades) != 1 || trades[0].Taker != bob {
+		t.Fatalf("expected the stop-limit order to trade, got %d trades", len(trades))
+	}
+	if balance := AssetBalance(db, testPair.BaseAsset, bob); balance.Cmp(units(500)) != 0 {
+		t.Fatalf("expected buyer token balance %v, got %v", units(500), balance)
+	}
+	// Expired orders are evicted and their escrow released
+	place(alice, encodePlaceOrderV1(OrderSideSell, testPair, units(150), units(1000), OrderOptions{ExpiryBlock: 6}), 6)
+	if balance := AssetBalance(db, testPair.BaseAsset, alice); balance.Cmp(units(10000-1200-1000)) != 0 {
+		t.Fatalf("expected seller token balance %v, got %v", units(10000-1200-1000), balance)
+	}
+	if trades := place(bob, encodePlaceOrder(OrderSideBuy, testPair, units(200), units(100)), 7); len(trades) != 1 || trades[0].Price.Cmp(units(200)) != 0 {
+		t.Fatalf("expected a trade at 200 with the expired order skipped, got %+v", trades)
+	}
+	if balance := AssetBalance(db, testPair.BaseAsset, alice); balance.Cmp(units(10000-1200)) != 0 {
+		t.Fatalf("expected seller token balance %v, got %v", units(10000-1200), balance)
+	}
+	if count := getUint64(db, openOrdersKey); count != 3 {
+		t.Fatalf("expected 3 open orders in state, got %d", count)
+	}
+}
+
+// Tests that orders reduced or cancelled by self-trade prevention are settled
+// and persisted, and that the order limit holds across restarts.
+func TestManagerSelfTradePrevention(t *testing.T) {
+	config := &params.SuperlightConfig{
+		Enabled:             true,
+		MaxOrdersPerAccount: 2,
+		SelfTradePrevention: "decrement",
+		Pairs:               testListings,
+	}
+	mgr := NewManager(config)
+	db := newFundedState(t)
+	db.AddBalance(alice, units(100000))
+
+	process := func(data []byte) error {
+		_, err := mgr.ProcessDEXTransaction(db, alice, data, 1001, 1)
+		return err
+	}
+	if err := process(encodePlaceOrder(OrderSideSell, testPair, units(2), units(500))); err != nil {
+		t.Fatalf("failed to place order: %v", err)
+	}
+	// The buy is cancelled, the sell reduced, with nothing traded
+	if err := process(encodePlaceOrder(OrderSideBuy, testPair, units(2), units(200))); err != nil {
+		t.Fatalf("failed to place order: %v", err)
+	}
+	if balance := db.GetBalance(alice); balance.Cmp(units(100000)) != 0 {
+		t.Fatalf("buyer balance mismatch: have %v, want %v", balance, units(100000))
+	}
+	restarted := NewManager(config)
+	restarted.Sync(db)
+	checkSameBook(t, restarted, mgr)
+
+	orders := restarted.Engine().GetOrdersByOwner(alice)
+	if len(orders) != 1 || orders[0].Remaining().Cmp(units(300)) != 0 {
+		t.Fatalf("expected one order of 300 left, got %+v", orders)
+	}
+	// Selling the rest releases all escrow once filled
+	placeOrder(t, mgr, db, OrderSideBuy, 2, 300, 2)
+	if balance := AssetBalance(db, testPair.BaseAsset, alice); balance.Cmp(units(100000-300)) != 0 {
+		t.Fatalf("seller token balance mismatch: have %v, want %v", balance, units(100000-300))
+	}
+	for i := 0; i < 2; i++ {
+		if err := process(encodePlaceOrder(OrderSideSell, testPair, units(3), units(1))); err != nil {
+			t.Fatalf("failed to place order: %v", err)
+		}
+	}
+	restarted = NewManager(config)
+	if _, err := restarted.ProcessDEXTransaction(db, alice, encodePlaceOrder(OrderSideSell, testPair, units(3), units(1)), 1003, 3); err != ErrTooManyOrders {
+		t.Fatalf("expected ErrTooManyOrders, got %v", err)
+	}
+}
+
+// Tests that operations are charged upfront, then for the orders they match and
+// the slots they write, that matching stops once out of gas, and that reverting
+// an operation running out of gas restores the book.
+func TestManagerGas(t *testing.T) {
+	mgr := NewManager(&params.SuperlightConfig{Enabled: true, Pairs: testListings})
+	db := newFundedState(t)
+
+	// Operations unable to pay the base fee are rejected before touching the state
+	if _, gas, err := mgr.ProcessDEXTransactionWithGas(db, alice, encodePlaceOrder(OrderSideSell, testPair, units(100), units(1)), 1001, 1, params.SuperlightOpGas-1); err != ErrOutOfGas || gas != 0 {
+		t.Fatalf("base fee mismatch: have %d, %v, want 0, %v", gas, err, ErrOutOfGas)
+	}
+	if readListing(db, testPair) != nil {
+		t.Fatalf("pairs listed without paying the base fee")
+	}
+	placeOrder(t, mgr, db, OrderSideSell, 100, 1, 1)
+	placeOrder(t, mgr, db, OrderSideSell, 100, 1, 1)
+
+	buy := encodePlaceOrder(OrderSideBuy, testPair, units(100), units(2))
+	snapshot := db.Snapshot()
+	trades, gas, err := mgr.ProcessDEXTransactionWithGas(db, bob, buy, 1002, 2, 10000000)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("failed to place order: %v", err)
+	}
+	if len(trades) != 2 {
+		t.Fatalf("trade count mismatch: have %d, want 2", len(trades))
+	}
+	used := 10000000 - gas
+	if matched := params.SuperlightOpGas + 2*params.SuperlightTradeGas; used <= matched || (used-matched)%params.SstoreSetGas != 0 {
+		t.Fatalf("gas used mismatch: have %d, want %d plus a multiple of %d", used, matched, params.SstoreSetGas)
+	}
+	db.RevertToSnapshot(snapshot)
+
+	snapshot = db.Snapshot()
+	if _, gas, err := mgr.ProcessDEXTransactionWithGas(db, bob, buy, 1002, 2, used-1); err != ErrOutOfGas || gas != 0 {
+		t.Fatalf("out of gas mismatch: have %d, %v, want 0, %v", gas, err, ErrOutOfGas)
+	}
+	db.RevertToSnapshot(snapshot)
+
+	// Sweeping a deep book stops matching as soon as the gas runs out
+	for i := 0; i < 50; i++ {
+		placeOrder(t, mgr, db, OrderSideSell, 100, 1, 1)
+	}
+	sweep := encodePlaceOrder(OrderSideBuy, testPair, units(100), units(52))
+	snapshot = db.Snapshot()
+	if _, gas, err := mgr.ProcessDEXTransactionWithGas(db, bob, sweep, 1002, 2, params.SuperlightOpGas+5*params.SuperlightTradeGas); err != ErrOutOfGas || gas != 0 {
+		t.Fatalf("sweep out of gas mismatch: have %d, %v, want 0, %v", gas, err, ErrOutOfGas)
+	}
+	if steps := mgr.engine.steps; steps != 6 {
+		t.Fatalf("orders visited mismatch: have %d, want 6", steps)
+	}
+	db.RevertToSnapshot(snapshot)
+
+	if trades := placeOrder(t, mgr, db, OrderSideBuy, 100, 52, 2); len(trades) != 52 {
+		t.Fatalf("trade count after revert mismatch: have %d, want 52", len(trades))
 	}
 }
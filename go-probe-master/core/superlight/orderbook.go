@@ -18,22 +18,76 @@ package superlight
 
 import (
 	"math/big"
-	"sort"
 	"sync"
 
 	"github.com/probechain/go-probe/common"
 )
 
-// PriceLevel represents all orders at a single price point.
+// PriceLevel represents all orders at a single price point, queued in time
+// priority through links embedded in the orders.
 type PriceLevel struct {
-	Price  *big.Int
-	Orders []*Order // FIFO queue of orders at this price
+	Price *big.Int
+
+	head, tail *Order // First and last order of the FIFO queue
+	count      int    // Number of orders in the queue
+}
+
+// newPriceLevel creates an empty price level.
+func newPriceLevel(price *big.Int) *PriceLevel {
+	return &PriceLevel{Price: new(big.Int).Set(price)}
+}
+
+// push appends an order to the end of the queue.
+func (pl *PriceLevel) push(order *Order) {
+	order.level, order.prev, order.next = pl, pl.tail, nil
+	if pl.tail != nil {
+		pl.tail.next = order
+	} else {
+		pl.head = order
+	}
+	pl.tail = order
+	pl.count++
+}
+
+// remove unlinks an order from the queue in O(1).
+func (pl *PriceLevel) remove(order *Order) {
+	if order.prev != nil {
+		order.prev.next = order.next
+	} else {
+		pl.head = order.next
+	}
+	if order.next != nil {
+		order.next.prev = order.prev
+	} else {
+		pl.tail = order.prev
+	}
+	order.level, order.prev, order.next = nil, nil, nil
+	pl.count--
+}
+
+// Front returns the oldest order at this price, or nil if there is none.
+func (pl *PriceLevel) Front() *Order {
+	return pl.head
+}
+
+// Len returns the number of orders at this price.
+func (pl *PriceLevel) Len() int {
+	return pl.count
+}
+
+// Orders returns the orders at this price in time priority.
+func (pl *PriceLevel) Orders() []*Order {
+	orders := make([]*Order, 0, pl.count)
+	for order := pl.head; order != nil; order = order.next {
+		orders = append(orders, order)
+	}
+	return orders
 }
 
 // TotalAmount returns the total remaining amount at this price level.
 func (pl *PriceLevel) TotalAmount() *big.Int {
 	total := new(big.Int)
-	for _, order := range pl.Orders {
+	for order := pl.head; order != nil; order = order.next {
 		total.Add(total, order.Remaining())
 	}
 	return total
@@ -46,38 +100,53 @@ type OrderBook struct {
 	mu   sync.RWMutex
 	Pair TradingPair
 
-	Bids []*PriceLevel // Sorted descending by price (highest first)
-	Asks []*PriceLevel // Sorted ascending by price (lowest first)
+	bids *priceIndex // Sorted descending by price (highest first)
+	asks *priceIndex // Sorted ascending by price (lowest first)
 
 	// Index for fast order lookup by ID
 	orderIndex map[common.Hash]*Order
+
+	// Stop orders waiting for their trigger, in placement order
+	stops []*Order
 }
 
 // NewOrderBook creates a new empty order book for the given trading pair.
 func NewOrderBook(pair TradingPair) *OrderBook {
 	return &OrderBook{
 		Pair:       pair,
-		Bids:       make([]*PriceLevel, 0),
-		Asks:       make([]*PriceLevel, 0),
+		bids:       newPriceIndex(true),
+		asks:       newPriceIndex(false),
 		orderIndex: make(map[common.Hash]*Order),
 	}
 }
 
-// AddOrder inserts an order into the appropriate side of the book.
+// side returns the price index holding the orders of the given side.
+func (ob *OrderBook) side(side OrderSide) *priceIndex {
+	if side == OrderSideBuy {
+		return ob.bids
+	}
+	return ob.asks
+}
+
+// AddOrder appends an order to the queue of its price level, creating the
+// level if needed.
 func (ob *OrderBook) AddOrder(order *Order) {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
 	ob.orderIndex[order.ID] = order
 
-	if order.Side == OrderSideBuy {
-		ob.addToBids(order)
-	} else {
-		ob.addToAsks(order)
+	levels := ob.side(order.Side)
+	level := levels.get(order.Price)
+	if level == nil {
+		level = newPriceLevel(order.Price)
+		levels.insert(level)
 	}
+	level.push(order)
 }
 
-// RemoveOrder removes an order from the book by ID.
+// RemoveOrder removes an order from the book by ID, dropping its price level
+// if it was the last order at its price.
 func (ob *OrderBook) RemoveOrder(orderID common.Hash) *Order {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
@@ -87,13 +156,35 @@ func (ob *OrderBook) RemoveOrder(orderID common.Hash) *Order {
 		return nil
 	}
 	delete(ob.orderIndex, orderID)
+	ob.unlink(order)
+	return order
+}
 
-	if order.Side == OrderSideBuy {
-		ob.removeFromLevels(&ob.Bids, order)
-	} else {
-		ob.removeFromLevels(&ob.Asks, order)
+// unlink removes an order from its price level, and the level from the book
+// once empty.
+func (ob *OrderBook) unlink(order *Order) {
+	level := order.level
+	if level == nil {
+		return
 	}
-	return order
+	level.remove(order)
+	if level.Len() == 0 {
+		ob.side(order.Side).remove(level.Price)
+	}
+}
+
+// Levels returns the best price levels of one side of the book, up to depth
+// levels or all if depth is not positive.
+func (ob *OrderBook) Levels(side OrderSide, depth int) []*PriceLevel {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	var levels []*PriceLevel
+	ob.side(side).ascend(func(level *PriceLevel) bool {
+		levels = append(levels, level)
+		return depth <= 0 || len(levels) < depth
+	})
+	return levels
 }
 
 // GetOrder returns an order by ID, or nil if not found.
@@ -103,86 +194,151 @@ func (ob *OrderBook) GetOrder(orderID common.Hash) *Order {
 	return ob.orderIndex[orderID]
 }
 
-// BestBid returns the highest bid price, or nil if no bids.
-func (ob *OrderBook) BestBid() *big.Int {
-	ob.mu.RLock()
-	defer ob.mu.RUnlock()
-	if len(ob.Bids) == 0 {
-		return nil
-	}
-	return new(big.Int).Set(ob.Bids[0].Price)
+// AddStop adds a stop order waiting for its trigger price.
+func (ob *OrderBook) AddStop(order *Order) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	ob.stops = append(ob.stops, order)
 }
 
-// BestAsk returns the lowest ask price, or nil if no asks.
-func (ob *OrderBook) BestAsk() *big.Int {
-	ob.mu.RLock()
-	defer ob.mu.RUnlock()
-	if len(ob.Asks) == 0 {
-		return nil
+// RemoveStop removes a pending stop order by ID.
+func (ob *OrderBook) RemoveStop(orderID common.Hash) *Order {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	for i, order := range ob.stops {
+		if order.ID == orderID {
+			ob.stops = append(ob.stops[:i], ob.stops[i+1:]...)
+			return order
+		}
 	}
-	return new(big.Int).Set(ob.Asks[0].Price)
+	return nil
 }
 
-// Depth returns the number of price levels on each side.
-func (ob *OrderBook) Depth() (bids, asks int) {
+// GetStop returns a pending stop order by ID, or nil if not found.
+func (ob *OrderBook) GetStop(orderID common.Hash) *Order {
 	ob.mu.RLock()
 	defer ob.mu.RUnlock()
-	return len(ob.Bids), len(ob.Asks)
-}
 
-// addToBids inserts an order into bids (sorted descending by price, FIFO within level).
-func (ob *OrderBook) addToBids(order *Order) {
-	for _, level := range ob.Bids {
-		if level.Price.Cmp(order.Price) == 0 {
-			level.Orders = append(level.Orders, order)
-			return
+	for _, order := range ob.stops {
+		if order.ID == orderID {
+			return order
 		}
 	}
-	// New price level
-	newLevel := &PriceLevel{
-		Price:  new(big.Int).Set(order.Price),
-		Orders: []*Order{order},
-	}
-	ob.Bids = append(ob.Bids, newLevel)
-	sort.Slice(ob.Bids, func(i, j int) bool {
-		return ob.Bids[i].Price.Cmp(ob.Bids[j].Price) > 0 // Descending
-	})
+	return nil
 }
 
-// addToAsks inserts an order into asks (sorted ascending by price, FIFO within level).
-func (ob *OrderBook) addToAsks(order *Order) {
-	for _, level := range ob.Asks {
-		if level.Price.Cmp(order.Price) == 0 {
-			level.Orders = append(level.Orders, order)
-			return
+// takeStops removes and returns the pending stop orders triggered by the given
+// price, and those expired at the given block, in placement order. Buy stops
+// trigger once the price rises to their stop price, sell stops once it falls
+// to it.
+func (ob *OrderBook) takeStops(price *big.Int, blockNum uint64) (triggered, expired []*Order) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	pending := ob.stops[:0]
+	for _, order := range ob.stops {
+		switch {
+		case order.Expired(blockNum):
+			expired = append(expired, order)
+		case price == nil:
+			pending = append(pending, order)
+		case order.Side == OrderSideBuy && price.Cmp(order.StopPrice) >= 0,
+			order.Side == OrderSideSell && price.Cmp(order.StopPrice) <= 0:
+			triggered = append(triggered, order)
+		default:
+			pending = append(pending, order)
 		}
 	}
-	// New price level
-	newLevel := &PriceLevel{
-		Price:  new(big.Int).Set(order.Price),
-		Orders: []*Order{order},
+	for i := len(pending); i < len(ob.stops); i++ {
+		ob.stops[i] = nil
 	}
-	ob.Asks = append(ob.Asks, newLevel)
-	sort.Slice(ob.Asks, func(i, j int) bool {
-		return ob.Asks[i].Price.Cmp(ob.Asks[j].Price) < 0 // Ascending
-	})
+	ob.stops = pending
+	return triggered, expired
 }
 
-// removeFromLevels removes an order from the given price levels.
-func (ob *OrderBook) removeFromLevels(levels *[]*PriceLevel, order *Order) {
-	for i, level := range *levels {
-		if level.Price.Cmp(order.Price) == 0 {
-			for j, o := range level.Orders {
-				if o.ID == order.ID {
-					level.Orders = append(level.Orders[:j], level.Orders[j+1:]...)
-					break
-				}
+// walkMatches calls fn with the orders an incoming order of the given side and
+// price, zero meaning any price, would match against, in matching order, until
+// fn returns false. Orders expired at blockNum are skipped.
+func (ob *OrderBook) walkMatches(side OrderSide, price *big.Int, blockNum uint64, fn func(maker *Order) bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	opposite := ob.asks
+	if side == OrderSideSell {
+		opposite = ob.bids
+	}
+	opposite.ascend(func(level *PriceLevel) bool {
+		if side == OrderSideBuy && price.Sign() > 0 && price.Cmp(level.Price) < 0 {
+			return false
+		}
+		if side == OrderSideSell && price.Cmp(level.Price) > 0 {
+			return false
+		}
+		for order := level.head; order != nil; order = order.next {
+			if order.Expired(blockNum) {
+				continue
 			}
-			// Remove empty price level
-			if len(level.Orders) == 0 {
-				*levels = append((*levels)[:i], (*levels)[i+1:]...)
+			if !fn(order) {
+				return false
 			}
-			return
 		}
+		return true
+	})
+}
+
+// matchable returns how much of amount an incoming order of the given owner,
+// side and price would fill against the book. Orders of the owner are skipped
+// if skipOwn is set, otherwise they end the matching.
+func (ob *OrderBook) matchable(owner common.Address, side OrderSide, price, amount *big.Int, blockNum uint64, skipOwn bool) *big.Int {
+	matched := new(big.Int)
+	ob.walkMatches(side, price, blockNum, func(maker *Order) bool {
+		if maker.Owner == owner {
+			return skipOwn
+		}
+		matched.Add(matched, maker.Remaining())
+		return matched.Cmp(amount) < 0
+	})
+	if matched.Cmp(amount) > 0 {
+		matched.Set(amount)
+	}
+	return matched
+}
+
+// crosses returns whether an incoming order of the given side and price would
+// match any order of the book, regardless of its owner.
+func (ob *OrderBook) crosses(side OrderSide, price *big.Int, blockNum uint64) bool {
+	crosses := false
+	ob.walkMatches(side, price, blockNum, func(*Order) bool {
+		crosses = true
+		return false
+	})
+	return crosses
+}
+
+// BestBid returns the highest bid price, or nil if no bids.
+func (ob *OrderBook) BestBid() *big.Int {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+	if level := ob.bids.first(); level != nil {
+		return new(big.Int).Set(level.Price)
+	}
+	return nil
+}
+
+// BestAsk returns the lowest ask price, or nil if no asks.
+func (ob *OrderBook) BestAsk() *big.Int {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+	if level := ob.asks.first(); level != nil {
+		return new(big.Int).Set(level.Price)
 	}
+	return nil
+}
+
+// Depth returns the number of price levels on each side.
+func (ob *OrderBook) Depth() (bids, asks int) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+	return ob.bids.len(), ob.asks.len()
 }
@@ -0,0 +1,118 @@
+// Copyright 2024 The go-probe Authors
+// This file is part of the go-probe library.
+//
+// The go-probe library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-probe library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-probe library. If not, see <http://www.gnu.org/licenses/>.
+
+package superlight
+
+import (
+	"math/big"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+)
+
+// Tests that the price index keeps its levels ordered through random inserts
+// and removals, on both sides.
+func TestPriceIndex(t *testing.T) {
+	for _, desc := range []bool{false, true} {
+		var (
+			idx    = newPriceIndex(desc)
+			prices = make(map[int64]bool)
+			rnd    = rand.New(rand.NewSource(1))
+		)
+		for i := 0; i < 5000; i++ {
+			price := rnd.Int63n(1000) + 1
+			switch {
+			case prices[price]:
+				idx.remove(big.NewInt(price))
+				delete(prices, price)
+			default:
+				idx.insert(newPriceLevel(big.NewInt(price)))
+				prices[price] = true
+			}
+		}
+		want := make([]int64, 0, len(prices))
+		for price := range prices {
+			want = append(want, price)
+		}
+		sort.Slice(want, func(i, j int) bool { return (want[i] < want[j]) != desc })
+
+		var have []int64
+		idx.ascend(func(level *PriceLevel) bool {
+			have = append(have, level.Price.Int64())
+			return true
+		})
+		if len(have) != len(want) || idx.len() != len(want) {
+			t.Fatalf("desc %v: level count mismatch: have %d (len %d), want %d", desc, len(have), idx.len(), len(want))
+		}
+		for i := range want {
+			if have[i] != want[i] {
+				t.Fatalf("desc %v: level %d mismatch: have %d, want %d", desc, i, have[i], want[i])
+			}
+		}
+		for _, price := range want {
+			if level := idx.get(big.NewInt(price)); level == nil || level.Price.Int64() != price {
+				t.Fatalf("desc %v: level %d not found", desc, price)
+			}
+		}
+		if idx.get(big.NewInt(1001)) != nil {
+			t.Fatalf("desc %v: found level at missing price", desc)
+		}
+		if first := idx.first(); first == nil || first.Price.Int64() != want[0] {
+			t.Fatalf("desc %v: best level mismatch", desc)
+		}
+	}
+}
+
+// Tests that orders are queued in time priority within their price level, and
+// that levels are dropped once their last order is removed.
+func TestOrderBookQueue(t *testing.T) {
+	book := NewOrderBook(testPair)
+
+	orders := make([]*Order, 4)
+	for i := range orders {
+		orders[i] = &Order{
+			ID:     common.Hash{byte(i + 1)},
+			Side:   OrderSideSell,
+			Price:  big.NewInt(100),
+			Amount: big.NewInt(10),
+			Filled: new(big.Int),
+		}
+		book.AddOrder(orders[i])
+	}
+	book.RemoveOrder(orders[1].ID) // Middle
+	book.RemoveOrder(orders[0].ID) // Head
+	book.RemoveOrder(orders[3].ID) // Tail
+
+	levels := book.Levels(OrderSideSell, 0)
+	if len(levels) != 1 {
+		t.Fatalf("level count mismatch: have %d, want 1", len(levels))
+	}
+	if queue := levels[0].Orders(); len(queue) != 1 || queue[0] != orders[2] {
+		t.Fatalf("queue mismatch: have %v", queue)
+	}
+	if amount := levels[0].TotalAmount(); amount.Cmp(big.NewInt(10)) != 0 {
+		t.Fatalf("level amount mismatch: have %v, want 10", amount)
+	}
+	book.RemoveOrder(orders[2].ID)
+	if bids, asks := book.Depth(); bids != 0 || asks != 0 {
+		t.Fatalf("depth mismatch: have %d/%d, want 0/0", bids, asks)
+	}
+	if book.BestAsk() != nil {
+		t.Fatal("empty book has a best ask")
+	}
+}
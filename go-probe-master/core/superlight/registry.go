@@ -0,0 +1,142 @@
+// Copyright 2024 The go-probe Authors
+// This file is part of the go-probe library.
+//
+// The go-probe library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-probe library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-probe library. If not, see <http://www.gnu.org/licenses/>.
+
+package superlight
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/crypto"
+	"github.com/probechain/go-probe/params"
+)
+
+var (
+	ErrPairNotListed   = errors.New("trading pair not listed")
+	ErrNotGovernor     = errors.New("sender is not the DEX governor")
+	ErrInvalidTickSize = errors.New("price is not a multiple of the tick size")
+	ErrInvalidLotSize  = errors.New("amount is not a multiple of the lot size")
+)
+
+// Only listed pairs can be traded. Listings are kept in the storage of the
+// settlement account: the pairs of the configuration are listed by the first
+// DEX operation, from then on the governor lists and delists pairs through
+// operations of its own. Delisting a pair stops new orders, the orders left
+// in its book can still be cancelled.
+//
+//	listing (base keccak(listingPrefix, base asset, quote asset)):
+//	  0: whether the pair is listed
+//	  1: tick size
+//	  2: lot size
+var (
+	listingsKey   = crypto.Keccak256Hash([]byte("superlight-listings")) // Whether the configured pairs were listed
+	listingPrefix = []byte("superlight-listing")                        // listingPrefix + pair -> listing
+)
+
+// PairInfo holds the trading rules of a listed pair.
+type PairInfo struct {
+	Pair     TradingPair `json:"pair"`
+	TickSize *big.Int    `json:"tickSize"` // Prices must be multiples of the tick size, any if zero
+	LotSize  *big.Int    `json:"lotSize"`  // Amounts must be multiples of the lot size, any if zero
+}
+
+// newPairInfo returns the trading rules of a pair of the configuration.
+func newPairInfo(config params.SuperlightPair) *PairInfo {
+	info := &PairInfo{
+		Pair:     TradingPair{BaseAsset: config.BaseAsset, QuoteAsset: config.QuoteAsset},
+		TickSize: new(big.Int),
+		LotSize:  new(big.Int),
+	}
+	if config.TickSize != nil {
+		info.TickSize.Set(config.TickSize)
+	}
+	if config.LotSize != nil {
+		info.LotSize.Set(config.LotSize)
+	}
+	return info
+}
+
+// validate checks the prices and the amount of an order against the trading
+// rules of its pair. Zero prices, leaving market orders open, are valid.
+func (p *PairInfo) validate(price, amount *big.Int, opts OrderOptions) error {
+	onTick := func(price *big.Int) bool {
+		return p.TickSize.Sign() == 0 || new(big.Int).Mod(price, p.TickSize).Sign() == 0
+	}
+	if !onTick(price) || (opts.Type.isStop() && !onTick(opts.StopPrice)) {
+		return ErrInvalidTickSize
+	}
+	if p.LotSize.Sign() > 0 && new(big.Int).Mod(amount, p.LotSize).Sign() != 0 {
+		return ErrInvalidLotSize
+	}
+	return nil
+}
+
+func listingSlot(pair TradingPair, i uint64) common.Hash {
+	return slotAt(crypto.Keccak256Hash(listingPrefix, pair.BaseAsset.Bytes(), pair.QuoteAsset.Bytes()), i)
+}
+
+// readListing reads the trading rules of a pair, nil if it is not listed.
+func readListing(db StateReader, pair TradingPair) *PairInfo {
+	if getUint64(db, listingSlot(pair, 0)) == 0 {
+		return nil
+	}
+	return &PairInfo{
+		Pair:     pair,
+		TickSize: db.GetState(SettlementAddress, listingSlot(pair, 1)).Big(),
+		LotSize:  db.GetState(SettlementAddress, listingSlot(pair, 2)).Big(),
+	}
+}
+
+// writeListing lists a pair, or updates the trading rules of a listed one.
+func writeListing(db StateDB, info *PairInfo) {
+	setUint64(db, listingSlot(info.Pair, 0), 1)
+	db.SetState(SettlementAddress, listingSlot(info.Pair, 1), common.BigToHash(info.TickSize))
+	db.SetState(SettlementAddress, listingSlot(info.Pair, 2), common.BigToHash(info.LotSize))
+}
+
+// deleteListing delists a pair.
+func deleteListing(db StateDB, pair TradingPair) {
+	for i := uint64(0); i < 3; i++ {
+		db.SetState(SettlementAddress, listingSlot(pair, i), common.Hash{})
+	}
+}
+
+// listConfigPairs lists the pairs of the configuration, unless done before.
+func listConfigPairs(db StateDB, pairs []params.SuperlightPair) {
+	if getUint64(db, listingsKey) != 0 {
+		return
+	}
+	for _, pair := range pairs {
+		writeListing(db, newPairInfo(pair))
+	}
+	setUint64(db, listingsKey, 1)
+}
+
+// lookupPair returns the trading rules of a pair in the given state, nil if it
+// is not listed. Until the first DEX operation listed them, the pairs of the
+// configuration are listed.
+func lookupPair(db StateReader, pairs []params.SuperlightPair, pair TradingPair) *PairInfo {
+	if getUint64(db, listingsKey) != 0 {
+		return readListing(db, pair)
+	}
+	for _, config := range pairs {
+		if config.BaseAsset == pair.BaseAsset && config.QuoteAsset == pair.QuoteAsset {
+			return newPairInfo(config)
+		}
+	}
+	return nil
+}
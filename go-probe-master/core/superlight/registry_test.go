@@ -0,0 +1,109 @@
+// Copyright 2024 The go-probe Authors
+// This file is part of the go-probe library.
+//
+// The go-probe library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-probe library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-probe library. If not, see <http://www.gnu.org/licenses/>.
+
+package superlight
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/params"
+)
+
+func encodeListPair(pair TradingPair, tickSize, lotSize *big.Int) []byte {
+	data := append([]byte{OpListPair}, pair.BaseAsset.Bytes()...)
+	data = append(data, pair.QuoteAsset.Bytes()...)
+	data = append(data, common.BigToHash(tickSize).Bytes()...)
+	return append(data, common.BigToHash(lotSize).Bytes()...)
+}
+
+func encodeDelistPair(pair TradingPair) []byte {
+	return append(append([]byte{OpDelistPair}, pair.BaseAsset.Bytes()...), pair.QuoteAsset.Bytes()...)
+}
+
+// Tests that only listed pairs trade, within their tick and lot sizes, and
+// that only the governor lists and delists pairs.
+func TestPairRegistry(t *testing.T) {
+	var (
+		config = &params.SuperlightConfig{
+			Enabled:  true,
+			Governor: carol,
+			Pairs:    []params.SuperlightPair{{BaseAsset: testPair.BaseAsset, QuoteAsset: testPair.QuoteAsset, TickSize: units(5), LotSize: units(10)}},
+		}
+		mgr   = NewManager(config)
+		api   = NewPublicSuperlightAPI(mgr)
+		db    = newFundedState(t)
+		other = TradingPair{BaseAsset: testPair.BaseAsset, QuoteAsset: carol}
+	)
+	mgr.SetHeadState(func() (StateDB, uint64, error) { return db, 1000, nil })
+
+	// The configured pairs are listed before the first operation
+	info, err := api.GetPairInfo(context.Background(), testPair.BaseAsset, testPair.QuoteAsset)
+	if err != nil || info.TickSize.Cmp(units(5)) != 0 || info.LotSize.Cmp(units(10)) != 0 {
+		t.Fatalf("pair info mismatch: %+v, %v", info, err)
+	}
+	if _, err := api.GetPairInfo(context.Background(), other.BaseAsset, other.QuoteAsset); err != ErrPairNotListed {
+		t.Fatalf("expected ErrPairNotListed, got %v", err)
+	}
+	process := func(from common.Address, data []byte) error {
+		_, err := mgr.ProcessDEXTransaction(db, from, data, 1001, 1)
+		return err
+	}
+	for _, test := range []struct {
+		data []byte
+		want error
+	}{
+		{encodePlaceOrder(OrderSideSell, testPair, units(202), units(100)), ErrInvalidTickSize},
+		{encodePlaceOrder(OrderSideSell, testPair, units(200), units(105)), ErrInvalidLotSize},
+		{encodePlaceOrderV1(OrderSideSell, testPair, units(200), units(100), OrderOptions{Type: OrderTypeStopLimit, StopPrice: units(193)}), ErrInvalidTickSize},
+		{encodePlaceOrder(OrderSideSell, other, units(200), units(100)), ErrPairNotListed},
+		{encodePlaceOrder(OrderSideSell, testPair, units(200), units(100)), nil},
+	} {
+		if err := process(alice, test.data); err != test.want {
+			t.Fatalf("order error mismatch: have %v, want %v", err, test.want)
+		}
+	}
+	order := mgr.Engine().GetOrdersByOwner(alice)[0]
+
+	// Only the governor manages listings
+	if err := process(alice, encodeListPair(other, new(big.Int), new(big.Int))); err != ErrNotGovernor {
+		t.Fatalf("expected ErrNotGovernor, got %v", err)
+	}
+	if err := process(carol, encodeListPair(other, new(big.Int), new(big.Int))); err != nil {
+		t.Fatalf("failed to list pair: %v", err)
+	}
+	if err := process(alice, encodePlaceOrder(OrderSideSell, other, units(201), units(101))); err != nil {
+		t.Fatalf("failed to place order on listed pair: %v", err)
+	}
+	// Delisted pairs take no new orders, but the open ones can be cancelled
+	if err := process(carol, encodeDelistPair(testPair)); err != nil {
+		t.Fatalf("failed to delist pair: %v", err)
+	}
+	if err := process(carol, encodeDelistPair(testPair)); err != ErrPairNotListed {
+		t.Fatalf("expected ErrPairNotListed on second delisting, got %v", err)
+	}
+	if err := process(alice, encodePlaceOrder(OrderSideSell, testPair, units(200), units(100))); err != ErrPairNotListed {
+		t.Fatalf("expected ErrPairNotListed, got %v", err)
+	}
+	if err := process(alice, encodeCancelOrder(order.ID)); err != nil {
+		t.Fatalf("failed to cancel order on delisted pair: %v", err)
+	}
+	if _, err := api.GetPairInfo(context.Background(), testPair.BaseAsset, testPair.QuoteAsset); err != ErrPairNotListed {
+		t.Fatalf("expected ErrPairNotListed after delisting, got %v", err)
+	}
+}
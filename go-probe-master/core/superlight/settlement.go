@@ -0,0 +1,154 @@
+// Copyright 2024 The go-probe Authors
+// This file is part of the go-probe library.
+//
+// The go-probe library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-probe library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-probe library. If not, see <http://www.gnu.org/licenses/>.
+
+package superlight
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/crypto"
+)
+
+var (
+	ErrInsufficientBalance = errors.New("insufficient balance for order escrow")
+	ErrInsufficientEscrow  = errors.New("insufficient order escrow")
+	ErrDEXValueTransfer    = errors.New("value transfer to DEX settlement address")
+	ErrDEXNestedCall       = errors.New("DEX operation from a contract call")
+)
+
+// SettlementAddress is the account holding all escrowed assets of the DEX. Its
+// storage keeps the token ledger and the escrow of every open order.
+var SettlementAddress = common.SPECIAL_ADDRESS_FOR_DEX_SETTLEMENT
+
+var (
+	assetBalancePrefix = []byte("superlight-balance") // assetBalancePrefix + asset + owner -> token balance
+	orderEscrowPrefix  = []byte("superlight-escrow")  // orderEscrowPrefix + order ID -> escrowed amount
+)
+
+// StateDB is the subset of the state database trades are settled on. All of
+// its mutations are journaled, so reverting a transaction reverts everything
+// the DEX did in it.
+type StateDB interface {
+	Exist(common.Address) bool
+	CreateContractAccount(common.Address)
+
+	GetBalance(common.Address) *big.Int
+	AddBalance(common.Address, *big.Int)
+	SubBalance(common.Address, *big.Int)
+
+	GetState(common.Address, common.Hash) common.Hash
+	SetState(common.Address, common.Hash, common.Hash)
+}
+
+// ensureSettlementAccount creates the settlement account on first use. Only
+// contract accounts have a storage trie, so it must be created as one.
+func ensureSettlementAccount(db StateDB) {
+	if !db.Exist(SettlementAddress) {
+		db.CreateContractAccount(SettlementAddress)
+	}
+}
+
+// assetBalanceKey returns the storage slot of the ledger balance of an owner.
+func assetBalanceKey(asset, owner common.Address) common.Hash {
+	return crypto.Keccak256Hash(assetBalancePrefix, asset.Bytes(), owner.Bytes())
+}
+
+// orderEscrowKey returns the storage slot of the escrow of an order.
+func orderEscrowKey(id common.Hash) common.Hash {
+	return crypto.Keccak256Hash(orderEscrowPrefix, id.Bytes())
+}
+
+// AssetBalance returns the balance of a token asset the DEX ledger holds for
+// owner. Native PROBE is never held in the ledger, but in account balances.
+func AssetBalance(db StateDB, asset, owner common.Address) *big.Int {
+	return db.GetState(SettlementAddress, assetBalanceKey(asset, owner)).Big()
+}
+
+// AddAssetBalance credits a token asset to owner in the DEX ledger. It is the
+// entry point for tokens arriving from outside of the DEX, e.g. through bridges.
+func AddAssetBalance(db StateDB, asset, owner common.Address, amount *big.Int) {
+	ensureSettlementAccount(db)
+	balance := AssetBalance(db, asset, owner)
+	db.SetState(SettlementAddress, assetBalanceKey(asset, owner), common.BigToHash(balance.Add(balance, amount)))
+}
+
+// transferAsset moves amount of asset between two accounts, through account
+// balances for native PROBE and through the ledger for tokens.
+func transferAsset(db StateDB, asset, from, to common.Address, amount *big.Int) error {
+	if amount.Sign() == 0 || from == to {
+		return nil
+	}
+	if asset == (common.Address{}) {
+		if db.GetBalance(from).Cmp(amount) < 0 {
+			return ErrInsufficientBalance
+		}
+		db.SubBalance(from, amount)
+		db.AddBalance(to, amount)
+		return nil
+	}
+	balance := AssetBalance(db, asset, from)
+	if balance.Cmp(amount) < 0 {
+		return ErrInsufficientBalance
+	}
+	db.SetState(SettlementAddress, assetBalanceKey(asset, from), common.BigToHash(balance.Sub(balance, amount)))
+	AddAssetBalance(db, asset, to, amount)
+	return nil
+}
+
+// OrderEscrow returns the amount still escrowed for an open order, in the quote
+// asset for buy orders and in the base asset for sell orders.
+func OrderEscrow(db StateDB, id common.Hash) *big.Int {
+	return db.GetState(SettlementAddress, orderEscrowKey(id)).Big()
+}
+
+func setOrderEscrow(db StateDB, id common.Hash, amount *big.Int) {
+	db.SetState(SettlementAddress, orderEscrowKey(id), common.BigToHash(amount))
+}
+
+// spendEscrow takes amount out of the escrow of an order. The funds stay with
+// the settlement account for the caller to pay out.
+func spendEscrow(db StateDB, id common.Hash, amount *big.Int) error {
+	escrow := OrderEscrow(db, id)
+	if escrow.Cmp(amount) < 0 {
+		return ErrInsufficientEscrow
+	}
+	setOrderEscrow(db, id, escrow.Sub(escrow, amount))
+	return nil
+}
+
+// releaseEscrow returns whatever is left of the escrow of a filled or cancelled
+// order to its owner.
+func releaseEscrow(db StateDB, id common.Hash, asset, owner common.Address) error {
+	escrow := OrderEscrow(db, id)
+	setOrderEscrow(db, id, new(big.Int))
+	return transferAsset(db, asset, SettlementAddress, owner, escrow)
+}
+
+// escrowAsset returns the asset escrowed by orders of the given side.
+func escrowAsset(pair TradingPair, side OrderSide) common.Address {
+	if side == OrderSideBuy {
+		return pair.QuoteAsset
+	}
+	return pair.BaseAsset
+}
+
+// quoteValue returns the value of amount base asset at price in quote asset.
+func quoteValue(amount, price *big.Int) *big.Int {
+	value := new(big.Int).Mul(amount, price)
+	return value.Div(value, big.NewInt(1e18)) // Normalize from price scaling
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 The go-probe Authors
+// This file is part of the go-probe library.
+//
+// The go-probe library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-probe library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-probe library. If not, see <http://www.gnu.org/licenses/>.
+
+package superlight
+
+import (
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/params"
+)
+
+// units returns n whole units of an asset with 18 decimals, n given in
+// hundredths.
+func units(n int64) *big.Int {
+	return new(big.Int).Mul(big.NewInt(n), big.NewInt(1e16))
+}
+
+// encodePlaceOrder encodes a place order operation.
+func encodePlaceOrder(side OrderSide, pair TradingPair, price, amount *big.Int) []byte {
+	data := make([]byte, 106)
+	data[0] = OpPlaceOrder
+	data[1] = byte(side)
+	copy(data[2:22], pair.BaseAsset.Bytes())
+	copy(data[22:42], pair.QuoteAsset.Bytes())
+	price.FillBytes(data[42:74])
+	amount.FillBytes(data[74:106])
+	return data
+}
+
+// encodePlaceOrderV1 encodes a place order operation with order options.
+func encodePlaceOrderV1(side OrderSide, pair TradingPair, price, amount *big.Int, opts OrderOptions) []byte {
+	data := make([]byte, 147)
+	data[0] = OpVersion1 | OpPlaceOrder
+	data[1] = byte(side)
+	data[2] = byte(opts.Type)
+	copy(data[3:23], pair.BaseAsset.Bytes())
+	copy(data[23:43], pair.QuoteAsset.Bytes())
+	price.FillBytes(data[43:75])
+	amount.FillBytes(data[75:107])
+	if opts.StopPrice != nil {
+		opts.StopPrice.FillBytes(data[107:139])
+	}
+	binary.BigEndian.PutUint64(data[139:147], opts.ExpiryBlock)
+	return data
+}
+
+// encodeCancelOrder encodes a cancel order operation.
+func encodeCancelOrder(id common.Hash) []byte {
+	return append([]byte{OpCancelOrder}, id.Bytes()...)
+}
+
+// Tests that placing, matching and cancelling orders escrows, moves and
+// releases funds, and that fees end up with the fee collector.
+func TestSettlement(t *testing.T) {
+	mgr := NewManager(&params.SuperlightConfig{
+		Enabled:      true,
+		MakerFeeBps:  10,
+		TakerFeeBps:  30,
+		FeeCollector: carol,
+		Pairs:        testListings,
+	})
+	db := newTestState(t)
+	pair, token := testPair, testPair.BaseAsset
+
+	AddAssetBalance(db, token, alice, units(10000))
+	db.AddBalance(bob, units(100000))
+
+	check := func(what string, have, want *big.Int) {
+		t.Helper()
+		if have.Cmp(want) != 0 {
+			t.Errorf("%s mismatch: have %v, want %v", what, have, want)
+		}
+	}
+	// Alice sells 100 tokens at 2 PROBE, escrowing the tokens
+	if _, err := mgr.ProcessDEXTransaction(db, alice, encodePlaceOrder(OrderSideSell, pair, units(200), units(10000)), 1000, 1); err != nil {
+		t.Fatalf("failed to place sell order: %v", err)
+	}
+	sellID := generateOrderID(alice, pair, OrderSideSell, units(200), units(10000), 1, 0)
+
+	check("seller token balance", AssetBalance(db, token, alice), new(big.Int))
+	check("sell order escrow", OrderEscrow(db, sellID), units(10000))
+	check("settlement token balance", AssetBalance(db, token, SettlementAddress), units(10000))
+
+	// Bob buys 40 tokens for up to 3 PROBE, escrowing 120 PROBE plus fees. The
+	// trade executes at the maker price, so he pays 80 PROBE plus the 0.3% taker
+	// fee and gets the rest of the escrow back.
+	trades, err := mgr.ProcessDEXTransaction(db, bob, encodePlaceOrder(OrderSideBuy, pair, units(300), units(4000)), 1001, 2)
+	if err != nil {
+		t.Fatalf("failed to place buy order: %v", err)
+	}
+	if len(trades) != 1 {
+		t.Fatalf("trade count mismatch: have %d, want 1", len(trades))
+	}
+	buyID := generateOrderID(bob, pair, OrderSideBuy, units(300), units(4000), 2, 1)
+
+	check("buyer balance", db.GetBalance(bob), new(big.Int).Sub(units(100000), units(8024)))
+	check("buyer token balance", AssetBalance(db, token, bob), units(4000))
+	check("buy order escrow", OrderEscrow(db, buyID), new(big.Int))
+	check("seller balance", db.GetBalance(alice), units(7992))
+	check("fee collector balance", db.GetBalance(carol), units(32))
+	check("settlement balance", db.GetBalance(SettlementAddress), new(big.Int))
+	check("sell order escrow", OrderEscrow(db, sellID), units(6000))
+
+	// Cancelling the rest of the sell order releases its escrow
+	if _, err := mgr.ProcessDEXTransaction(db, bob, encodeCancelOrder(sellID), 1002, 3); err != ErrNotOrderOwner {
+		t.Fatalf("foreign cancel error mismatch: have %v, want %v", err, ErrNotOrderOwner)
+	}
+	if _, err := mgr.ProcessDEXTransaction(db, alice, encodeCancelOrder(sellID), 1002, 3); err != nil {
+		t.Fatalf("failed to cancel order: %v", err)
+	}
+	check("seller token balance", AssetBalance(db, token, alice), units(6000))
+	check("sell order escrow", OrderEscrow(db, sellID), new(big.Int))
+	check("settlement token balance", AssetBalance(db, token, SettlementAddress), new(big.Int))
+}
+
+// Tests that orders which can't be escrowed are rejected without touching the
+// order book, and that settlements are reverted with the state.
+func TestSettlementEscrow(t *testing.T) {
+	mgr := NewManager(&params.SuperlightConfig{Enabled: true, MakerFeeBps: 10, TakerFeeBps: 30, Pairs: testListings})
+	db := newTestState(t)
+	pair := testPair
+
+	db.AddBalance(bob, units(1000))
+
+	if _, err := mgr.ProcessDEXTransaction(db, alice, encodePlaceOrder(OrderSideSell, pair, units(100), units(100)), 1000, 1); err != ErrInsufficientBalance {
+		t.Fatalf("unfunded sell error mismatch: have %v, want %v", err, ErrInsufficientBalance)
+	}
+	if _, err := mgr.ProcessDEXTransaction(db, bob, encodePlaceOrder(OrderSideBuy, pair, units(100), units(1000)), 1000, 1); err != ErrInsufficientBalance {
+		t.Fatalf("unfunded buy error mismatch: have %v, want %v", err, ErrInsufficientBalance)
+	}
+	if bids, asks := mgr.engine.GetOrderbook(pair, 0); len(bids) != 0 || len(asks) != 0 {
+		t.Fatalf("rejected orders entered the book: %d bids, %d asks", len(bids), len(asks))
+	}
+	// Reverting the state reverts the escrow
+	snapshot := db.Snapshot()
+	if _, err := mgr.ProcessDEXTransaction(db, bob, encodePlaceOrder(OrderSideBuy, pair, units(100), units(500)), 1000, 1); err != nil {
+		t.Fatalf("failed to place buy order: %v", err)
+	}
+	if balance := db.GetBalance(bob); balance.Cmp(units(1000)) >= 0 {
+		t.Fatalf("buy order not escrowed: balance %v", balance)
+	}
+	db.RevertToSnapshot(snapshot)
+	if balance := db.GetBalance(bob); balance.Cmp(units(1000)) != 0 {
+		t.Fatalf("escrow not reverted: balance %v", balance)
+	}
+	if escrow := OrderEscrow(db, generateOrderID(bob, pair, OrderSideBuy, units(100), units(500), 1, 0)); escrow.Sign() != 0 {
+		t.Fatalf("order escrow not reverted: %v", escrow)
+	}
+}
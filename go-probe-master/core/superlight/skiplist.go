@@ -0,0 +1,164 @@
+// Copyright 2024 The go-probe Authors
+// This file is part of the go-probe library.
+//
+// The go-probe library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-probe library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-probe library. If not, see <http://www.gnu.org/licenses/>.
+
+package superlight
+
+import (
+	"math/big"
+)
+
+const (
+	maxSkipHeight = 24 // Enough for 4^24 price levels per side
+	skipSeed      = 0x9e3779b97f4a7c15
+)
+
+// skipNode is a node of the price index, linking a price level to its
+// successors on every layer it is part of.
+type skipNode struct {
+	level *PriceLevel
+	next  []*skipNode
+}
+
+// priceIndex is a skiplist of the price levels of one side of an order book,
+// ordered best price first: descending for bids, ascending for asks. Lookups,
+// inserts and removals take O(log n), the best level is found in O(1).
+//
+// Node heights are drawn from a fixed-seed generator, so the shape of the
+// list, and with it the cost of every operation, is the same on all nodes.
+type priceIndex struct {
+	head   skipNode
+	height int    // Number of layers in use
+	length int    // Number of price levels
+	desc   bool   // Whether higher prices come first
+	rand   uint64 // State of the height generator
+}
+
+// newPriceIndex creates an empty price index, ordered descending for bids.
+func newPriceIndex(desc bool) *priceIndex {
+	return &priceIndex{
+		head:   skipNode{next: make([]*skipNode, maxSkipHeight)},
+		height: 1,
+		desc:   desc,
+		rand:   skipSeed,
+	}
+}
+
+// before returns whether price a comes before price b in the index.
+func (idx *priceIndex) before(a, b *big.Int) bool {
+	if idx.desc {
+		return a.Cmp(b) > 0
+	}
+	return a.Cmp(b) < 0
+}
+
+// randomHeight draws the height of a new node, each layer being used with a
+// quarter of the probability of the one below.
+func (idx *priceIndex) randomHeight() int {
+	// xorshift64*
+	idx.rand ^= idx.rand >> 12
+	idx.rand ^= idx.rand << 25
+	idx.rand ^= idx.rand >> 27
+	r := idx.rand * 2685821657736338717
+
+	height := 1
+	for height < maxSkipHeight && r&3 == 0 {
+		height++
+		r >>= 2
+	}
+	return height
+}
+
+// seek fills update with the last node before price on every layer and
+// returns the node following it on the lowest layer.
+func (idx *priceIndex) seek(price *big.Int, update []*skipNode) *skipNode {
+	node := &idx.head
+	for i := idx.height - 1; i >= 0; i-- {
+		for node.next[i] != nil && idx.before(node.next[i].level.Price, price) {
+			node = node.next[i]
+		}
+		if update != nil {
+			update[i] = node
+		}
+	}
+	return node.next[0]
+}
+
+// get returns the price level at the given price, or nil if there is none.
+func (idx *priceIndex) get(price *big.Int) *PriceLevel {
+	if node := idx.seek(price, nil); node != nil && node.level.Price.Cmp(price) == 0 {
+		return node.level
+	}
+	return nil
+}
+
+// insert adds a price level to the index. There must be no level at its price.
+func (idx *priceIndex) insert(level *PriceLevel) {
+	var update [maxSkipHeight]*skipNode
+	idx.seek(level.Price, update[:])
+
+	height := idx.randomHeight()
+	for i := idx.height; i < height; i++ {
+		update[i] = &idx.head
+	}
+	if height > idx.height {
+		idx.height = height
+	}
+	node := &skipNode{level: level, next: make([]*skipNode, height)}
+	for i := 0; i < height; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	idx.length++
+}
+
+// remove deletes the price level at the given price from the index.
+func (idx *priceIndex) remove(price *big.Int) {
+	var update [maxSkipHeight]*skipNode
+	node := idx.seek(price, update[:])
+	if node == nil || node.level.Price.Cmp(price) != 0 {
+		return
+	}
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for idx.height > 1 && idx.head.next[idx.height-1] == nil {
+		idx.height--
+	}
+	idx.length--
+}
+
+// first returns the level with the best price, or nil if the index is empty.
+func (idx *priceIndex) first() *PriceLevel {
+	if node := idx.head.next[0]; node != nil {
+		return node.level
+	}
+	return nil
+}
+
+// ascend calls fn with the price levels from the best price on, until fn
+// returns false.
+func (idx *priceIndex) ascend(fn func(level *PriceLevel) bool) {
+	for node := idx.head.next[0]; node != nil; node = node.next[0] {
+		if !fn(node.level) {
+			return
+		}
+	}
+}
+
+// len returns the number of price levels in the index.
+func (idx *priceIndex) len() int {
+	return idx.length
+}
@@ -0,0 +1,211 @@
+// Copyright 2024 The go-probe Authors
+// This file is part of the go-probe library.
+//
+// The go-probe library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-probe library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-probe library. If not, see <http://www.gnu.org/licenses/>.
+
+package superlight
+
+import (
+	"encoding/binary"
+	"math/big"
+	"sort"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/crypto"
+)
+
+// The order book is kept in the storage of the settlement account, so that it
+// is part of world state: every open order has a record of orderRecordSlots
+// consecutive slots, and the IDs of all open orders are kept in an array to
+// be able to rebuild the book without iterating the storage trie.
+//
+//	order record (base keccak(orderPrefix, id)):
+//	  0: owner (20) | side (1) | status (1) | type (1)
+//	  1: base asset
+//	  2: quote asset
+//	  3: price
+//	  4: amount
+//	  5: filled
+//	  6: timestamp (8) | block number (8) | sequence (8) | open order index (8)
+//	  7: stop price
+//	  8: expiry block
+//
+//	open orders (base keccak(openOrdersKey)):
+//	  openOrdersKey: number of open orders
+//	  base + i:      ID of the i-th open order
+const orderRecordSlots = 9
+
+var (
+	bookHashKey      = crypto.Keccak256Hash([]byte("superlight-book"))        // Hash of all operations applied to the book
+	orderSequenceKey = crypto.Keccak256Hash([]byte("superlight-sequence"))    // Sequence number of the next order
+	openOrdersKey    = crypto.Keccak256Hash([]byte("superlight-open-orders")) // Number of open orders
+	orderPrefix      = []byte("superlight-order")                             // orderPrefix + order ID -> order record
+)
+
+// slotAt returns the storage slot at offset i from base.
+func slotAt(base common.Hash, i uint64) common.Hash {
+	slot := new(big.Int).SetBytes(base.Bytes())
+	return common.BigToHash(slot.Add(slot, new(big.Int).SetUint64(i)))
+}
+
+// orderSlot returns the i-th storage slot of the record of an order.
+func orderSlot(id common.Hash, i uint64) common.Hash {
+	return slotAt(crypto.Keccak256Hash(orderPrefix, id.Bytes()), i)
+}
+
+// openOrderSlot returns the storage slot of the i-th open order ID.
+func openOrderSlot(i uint64) common.Hash {
+	return slotAt(crypto.Keccak256Hash(openOrdersKey.Bytes()), i)
+}
+
+func getUint64(db StateReader, key common.Hash) uint64 {
+	return db.GetState(SettlementAddress, key).Big().Uint64()
+}
+
+func setUint64(db StateDB, key common.Hash, value uint64) {
+	db.SetState(SettlementAddress, key, common.BigToHash(new(big.Int).SetUint64(value)))
+}
+
+// bookHash returns the hash of all operations applied to the order book in
+// the given state. Two states with the same hash have identical books.
+func bookHash(db StateDB) common.Hash {
+	return db.GetState(SettlementAddress, bookHashKey)
+}
+
+// nextBookHash chains an operation applied to the order book into its hash.
+func nextBookHash(prev common.Hash, from common.Address, data []byte, timestamp, blockNum uint64) common.Hash {
+	var numbers [16]byte
+	binary.BigEndian.PutUint64(numbers[:8], timestamp)
+	binary.BigEndian.PutUint64(numbers[8:], blockNum)
+	return crypto.Keccak256Hash(prev.Bytes(), from.Bytes(), numbers[:], data)
+}
+
+// writeOrderHeader writes the slot holding the owner, side, status and type of
+// an order.
+func writeOrderHeader(db StateDB, order *Order) {
+	var header common.Hash
+	copy(header[:common.AddressLength], order.Owner.Bytes())
+	header[common.AddressLength] = byte(order.Side)
+	header[common.AddressLength+1] = byte(order.Status)
+	header[common.AddressLength+2] = byte(order.Type)
+	db.SetState(SettlementAddress, orderSlot(order.ID, 0), header)
+}
+
+// writeOrderNumbers writes the slot holding the numeric fields of an order.
+func writeOrderNumbers(db StateDB, order *Order, index uint64) {
+	var numbers common.Hash
+	binary.BigEndian.PutUint64(numbers[0:], order.Timestamp)
+	binary.BigEndian.PutUint64(numbers[8:], order.BlockNum)
+	binary.BigEndian.PutUint64(numbers[16:], order.Seq)
+	binary.BigEndian.PutUint64(numbers[24:], index)
+	db.SetState(SettlementAddress, orderSlot(order.ID, 6), numbers)
+}
+
+// storeOrder writes a new open order into the state and appends it to the
+// open orders.
+func storeOrder(db StateDB, order *Order) {
+	index := getUint64(db, openOrdersKey)
+
+	writeOrderHeader(db, order)
+	db.SetState(SettlementAddress, orderSlot(order.ID, 1), common.BytesToHash(order.Pair.BaseAsset.Bytes()))
+	db.SetState(SettlementAddress, orderSlot(order.ID, 2), common.BytesToHash(order.Pair.QuoteAsset.Bytes()))
+	db.SetState(SettlementAddress, orderSlot(order.ID, 3), common.BigToHash(order.Price))
+	db.SetState(SettlementAddress, orderSlot(order.ID, 4), common.BigToHash(order.Amount))
+	db.SetState(SettlementAddress, orderSlot(order.ID, 5), common.BigToHash(order.Filled))
+	writeOrderNumbers(db, order, index)
+	if order.StopPrice != nil {
+		db.SetState(SettlementAddress, orderSlot(order.ID, 7), common.BigToHash(order.StopPrice))
+	}
+	setUint64(db, orderSlot(order.ID, 8), order.ExpiryBlock)
+
+	db.SetState(SettlementAddress, openOrderSlot(index), order.ID)
+	setUint64(db, openOrdersKey, index+1)
+}
+
+// updateOrderFill writes the filled amount and status of an open order, or of
+// a triggered stop order, along with its amount reduced by self-trade
+// prevention.
+func updateOrderFill(db StateDB, order *Order) {
+	writeOrderHeader(db, order)
+	db.SetState(SettlementAddress, orderSlot(order.ID, 4), common.BigToHash(order.Amount))
+	db.SetState(SettlementAddress, orderSlot(order.ID, 5), common.BigToHash(order.Filled))
+}
+
+// deleteOrder removes a filled or cancelled order from the state, moving the
+// last open order into its place in the open orders.
+func deleteOrder(db StateDB, id common.Hash) {
+	numbers := db.GetState(SettlementAddress, orderSlot(id, 6))
+	index := binary.BigEndian.Uint64(numbers[24:])
+
+	last := getUint64(db, openOrdersKey) - 1
+	if index != last {
+		moved := db.GetState(SettlementAddress, openOrderSlot(last))
+		db.SetState(SettlementAddress, openOrderSlot(index), moved)
+
+		movedNumbers := db.GetState(SettlementAddress, orderSlot(moved, 6))
+		binary.BigEndian.PutUint64(movedNumbers[24:], index)
+		db.SetState(SettlementAddress, orderSlot(moved, 6), movedNumbers)
+	}
+	db.SetState(SettlementAddress, openOrderSlot(last), common.Hash{})
+	setUint64(db, openOrdersKey, last)
+
+	for i := uint64(0); i < orderRecordSlots; i++ {
+		db.SetState(SettlementAddress, orderSlot(id, i), common.Hash{})
+	}
+}
+
+// loadOrder reads the record of an open order from the state.
+func loadOrder(db StateDB, id common.Hash) *Order {
+	var (
+		header  = db.GetState(SettlementAddress, orderSlot(id, 0))
+		numbers = db.GetState(SettlementAddress, orderSlot(id, 6))
+	)
+	order := &Order{
+		ID:    id,
+		Owner: common.BytesToAddress(header[:common.AddressLength]),
+		Pair: TradingPair{
+			BaseAsset:  common.BytesToAddress(db.GetState(SettlementAddress, orderSlot(id, 1)).Bytes()),
+			QuoteAsset: common.BytesToAddress(db.GetState(SettlementAddress, orderSlot(id, 2)).Bytes()),
+		},
+		Side:      OrderSide(header[common.AddressLength]),
+		Type:      OrderType(header[common.AddressLength+2]),
+		Status:    OrderStatus(header[common.AddressLength+1]),
+		Price:     db.GetState(SettlementAddress, orderSlot(id, 3)).Big(),
+		Amount:    db.GetState(SettlementAddress, orderSlot(id, 4)).Big(),
+		Filled:    db.GetState(SettlementAddress, orderSlot(id, 5)).Big(),
+		Timestamp: binary.BigEndian.Uint64(numbers[0:]),
+		BlockNum:  binary.BigEndian.Uint64(numbers[8:]),
+		Seq:       binary.BigEndian.Uint64(numbers[16:]),
+
+		ExpiryBlock: getUint64(db, orderSlot(id, 8)),
+	}
+	if order.Type.isStop() {
+		order.StopPrice = db.GetState(SettlementAddress, orderSlot(id, 7)).Big()
+	}
+	return order
+}
+
+// loadOrders reads all open orders from the state in placement order, along
+// with the sequence number of the next order.
+func loadOrders(db StateDB) ([]*Order, uint64) {
+	count := getUint64(db, openOrdersKey)
+
+	orders := make([]*Order, 0, count)
+	for i := uint64(0); i < count; i++ {
+		orders = append(orders, loadOrder(db, db.GetState(SettlementAddress, openOrderSlot(i))))
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].Seq < orders[j].Seq })
+
+	return orders, getUint64(db, orderSequenceKey)
+}
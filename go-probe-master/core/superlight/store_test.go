@@ -0,0 +1,190 @@
+// Copyright 2024 The go-probe Authors
+// This file is part of the go-probe library.
+//
+// The go-probe library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-probe library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-probe library. If not, see <http://www.gnu.org/licenses/>.
+
+package superlight
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/probechain/go-probe/core/state"
+	"github.com/probechain/go-probe/params"
+)
+
+// newFundedState creates a state in which alice holds tokens and bob PROBE.
+func newFundedState(t *testing.T) *state.StateDB {
+	t.Helper()
+	db := newTestState(t)
+	AddAssetBalance(db, testPair.BaseAsset, alice, units(100000))
+	db.AddBalance(bob, units(100000))
+	return db
+}
+
+// placeOrder places an order through the manager, failing the test on error.
+func placeOrder(t *testing.T, mgr *Manager, db StateDB, side OrderSide, price, amount int64, blockNum uint64) []*Trade {
+	t.Helper()
+	owner := alice
+	if side == OrderSideBuy {
+		owner = bob
+	}
+	trades, err := mgr.ProcessDEXTransaction(db, owner, encodePlaceOrder(side, testPair, units(price), units(amount)), 1000+blockNum, blockNum)
+	if err != nil {
+		t.Fatalf("failed to place order: %v", err)
+	}
+	return trades
+}
+
+// checkSameBook checks that two managers hold the same open orders.
+func checkSameBook(t *testing.T, have, want *Manager) {
+	t.Helper()
+	for _, side := range []OrderSide{OrderSideBuy, OrderSideSell} {
+		haveOrders, wantOrders := have.Engine().books[testPair].levelOrders(side), want.Engine().books[testPair].levelOrders(side)
+		if fmt.Sprintf("%+v", haveOrders) != fmt.Sprintf("%+v", wantOrders) {
+			t.Fatalf("side %d order mismatch:\nhave %+v\nwant %+v", side, haveOrders, wantOrders)
+		}
+	}
+}
+
+// levelOrders returns copies of the orders of one side of the book, in
+// matching order.
+func (ob *OrderBook) levelOrders(side OrderSide) []Order {
+	var orders []Order
+	for _, level := range ob.Levels(side, 0) {
+		for _, order := range level.Orders() {
+			clone := *order
+			clone.level, clone.prev, clone.next = nil, nil, nil
+			orders = append(orders, clone)
+		}
+	}
+	return orders
+}
+
+// Tests that the order book is stored in the state, and that a manager created
+// on the state, like after a restart, rebuilds the very same book.
+func TestOrderBookPersistence(t *testing.T) {
+	config := &params.SuperlightConfig{Enabled: true, MakerFeeBps: 10, TakerFeeBps: 30, Pairs: testListings}
+	mgr := NewManager(config)
+	db := newFundedState(t)
+
+	placeOrder(t, mgr, db, OrderSideSell, 300, 1000, 1)
+	placeOrder(t, mgr, db, OrderSideSell, 200, 1000, 1)
+	placeOrder(t, mgr, db, OrderSideSell, 200, 500, 2)
+	placeOrder(t, mgr, db, OrderSideBuy, 100, 700, 2)
+	placeOrder(t, mgr, db, OrderSideBuy, 250, 1200, 3) // Fills 1000 at 200, partially fills 200 at 200
+
+	var cancel Order
+	for _, order := range mgr.Engine().books[testPair].levelOrders(OrderSideSell) {
+		if order.Price.Cmp(units(300)) == 0 {
+			cancel = order
+		}
+	}
+	if _, err := mgr.ProcessDEXTransaction(db, alice, encodeCancelOrder(cancel.ID), 1004, 4); err != nil {
+		t.Fatalf("failed to cancel order: %v", err)
+	}
+	placeOrder(t, mgr, db, OrderSideSell, 400, 800, 4)
+
+	// Commit and reopen the state, then rebuild the book
+	root, err := db.Commit(true)
+	if err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	reopened, err := state.New(root, db.Database(), nil)
+	if err != nil {
+		t.Fatalf("failed to reopen state: %v", err)
+	}
+	restarted := NewManager(config)
+	restarted.Sync(reopened)
+	checkSameBook(t, restarted, mgr)
+
+	asks := restarted.Engine().books[testPair].levelOrders(OrderSideSell)
+	if len(asks) != 2 || asks[0].Filled.Cmp(units(200)) != 0 || asks[0].Status != OrderStatusPartial {
+		t.Fatalf("partially filled ask not restored: %+v", asks)
+	}
+	// Both managers keep matching identically on their states
+	haveTrades := placeOrder(t, restarted, reopened, OrderSideBuy, 500, 1000, 5)
+	wantTrades := placeOrder(t, mgr, db, OrderSideBuy, 500, 1000, 5)
+	if len(haveTrades) != 2 || len(wantTrades) != 2 {
+		t.Fatalf("trade count mismatch: have %d, want %d, expected 2", len(haveTrades), len(wantTrades))
+	}
+	for i := range haveTrades {
+		if have, want := fmt.Sprintf("%+v", *haveTrades[i]), fmt.Sprintf("%+v", *wantTrades[i]); have != want {
+			t.Fatalf("trade %d mismatch:\nhave %s\nwant %s", i, have, want)
+		}
+	}
+	checkSameBook(t, restarted, mgr)
+	if reopened.IntermediateRoot(true) != db.IntermediateRoot(true) {
+		t.Fatalf("state root mismatch after matching")
+	}
+}
+
+// Tests that the engine follows the state when operations are reverted or
+// processed on a different state, like after a reorg.
+func TestOrderBookRevert(t *testing.T) {
+	mgr := NewManager(&params.SuperlightConfig{Enabled: true, Pairs: testListings})
+	db := newFundedState(t)
+
+	placeOrder(t, mgr, db, OrderSideSell, 200, 1000, 1)
+	fork := db.Copy()
+
+	// Fill the ask, then revert the fill
+	snapshot := db.Snapshot()
+	if trades := placeOrder(t, mgr, db, OrderSideBuy, 200, 1000, 2); len(trades) != 1 {
+		t.Fatalf("trade count mismatch: have %d, want 1", len(trades))
+	}
+	db.RevertToSnapshot(snapshot)
+
+	// The next operation must see the ask unfilled
+	if trades := placeOrder(t, mgr, db, OrderSideBuy, 200, 400, 2); len(trades) != 1 || trades[0].Amount.Cmp(units(400)) != 0 {
+		t.Fatalf("reverted fill still in effect: %+v", trades)
+	}
+	asks := mgr.Engine().books[testPair].levelOrders(OrderSideSell)
+	if len(asks) != 1 || asks[0].Remaining().Cmp(units(600)) != 0 {
+		t.Fatalf("ask mismatch after revert: %+v", asks)
+	}
+	// Processing on the forked state rebuilds the engine from it
+	if trades := placeOrder(t, mgr, fork, OrderSideBuy, 200, 100, 2); len(trades) != 1 {
+		t.Fatalf("trade count mismatch on fork: have %d, want 1", len(trades))
+	}
+	asks = mgr.Engine().books[testPair].levelOrders(OrderSideSell)
+	if len(asks) != 1 || asks[0].Remaining().Cmp(units(900)) != 0 {
+		t.Fatalf("ask mismatch on fork: %+v", asks)
+	}
+	// Queries are served from the head state
+	mgr.SetHeadState(func() (StateDB, uint64, error) { return db, 0, nil })
+	if order, err := NewPublicSuperlightAPI(mgr).GetOrder(nil, testPair.BaseAsset, testPair.QuoteAsset, asks[0].ID); err != nil || order.Remaining.Cmp(units(600)) != 0 {
+		t.Fatalf("head order mismatch: %+v, %v", order, err)
+	}
+}
+
+// Tests that identical orders placed by the same owner in the same block get
+// distinct IDs and are escrowed separately.
+func TestOrderIDsUnique(t *testing.T) {
+	mgr := NewManager(&params.SuperlightConfig{Enabled: true, Pairs: testListings})
+	db := newFundedState(t)
+
+	placeOrder(t, mgr, db, OrderSideSell, 200, 1000, 1)
+	placeOrder(t, mgr, db, OrderSideSell, 200, 1000, 1)
+
+	asks := mgr.Engine().books[testPair].levelOrders(OrderSideSell)
+	if len(asks) != 2 || asks[0].ID == asks[1].ID {
+		t.Fatalf("identical orders collided: %+v", asks)
+	}
+	for _, ask := range asks {
+		if escrow := OrderEscrow(db, ask.ID); escrow.Cmp(units(1000)) != 0 {
+			t.Errorf("order %x escrow mismatch: have %v, want %v", ask.ID, escrow, units(1000))
+		}
+	}
+}
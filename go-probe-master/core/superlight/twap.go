@@ -0,0 +1,228 @@
+// Copyright 2024 The go-probe Authors
+// This file is part of the go-probe library.
+//
+// The go-probe library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-probe library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-probe library. If not, see <http://www.gnu.org/licenses/>.
+
+package superlight
+
+import (
+	"encoding/binary"
+	"math/big"
+	"sort"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/common/math"
+	"github.com/probechain/go-probe/crypto"
+)
+
+// The price accumulators of every pair are kept in the storage of the
+// settlement account, next to the order book. Like the accumulators of
+// Uniswap v2, the cumulative price is the sum of the price of every second
+// since the first trade, the price of a second being the last trade price of
+// the blocks before it. Trades only move the price from their block on, so
+// prices within a block can't be manipulated into the average. The cumulative
+// price wraps around at 2^256; averages are taken from differences, which are
+// correct as long as they don't exceed 2^256.
+//
+// Every block trading a pair adds an observation of the cumulative price at
+// its timestamp to a ring buffer, from which the cumulative price at any time
+// within the buffer is recovered by interpolation.
+//
+//	accumulator (base keccak(twapPrefix, base asset, quote asset)):
+//	  0: last update timestamp (8) | observation count (8) | next observation (8)
+//	  1: last trade price
+//	  2: cumulative price at the last update timestamp
+//
+//	observations (base keccak(twapObservationPrefix, base asset, quote asset)):
+//	  2i:   timestamp of the i-th observation
+//	  2i+1: cumulative price at that timestamp
+const twapObservations = 1024
+
+var (
+	twapPrefix            = []byte("superlight-twap")             // twapPrefix + pair -> accumulator
+	twapObservationPrefix = []byte("superlight-twap-observation") // twapObservationPrefix + pair -> observations
+)
+
+// StateReader is the subset of the state database prices are read from.
+type StateReader interface {
+	GetState(common.Address, common.Hash) common.Hash
+}
+
+// accumulator is the price accumulator of a pair.
+type accumulator struct {
+	timestamp  uint64   // Timestamp of the last block trading the pair
+	count      uint64   // Number of observations in the ring buffer
+	next       uint64   // Index of the next observation to write
+	price      *big.Int // Last trade price
+	cumulative *big.Int // Cumulative price at timestamp
+}
+
+// observation is the cumulative price of a pair at a timestamp.
+type observation struct {
+	timestamp  uint64
+	cumulative *big.Int
+}
+
+func accumulatorSlot(pair TradingPair, i uint64) common.Hash {
+	return slotAt(crypto.Keccak256Hash(twapPrefix, pair.BaseAsset.Bytes(), pair.QuoteAsset.Bytes()), i)
+}
+
+func observationSlot(pair TradingPair, i uint64) common.Hash {
+	return slotAt(crypto.Keccak256Hash(twapObservationPrefix, pair.BaseAsset.Bytes(), pair.QuoteAsset.Bytes()), i)
+}
+
+// readAccumulator reads the accumulator of a pair, nil if it never traded.
+func readAccumulator(db StateReader, pair TradingPair) *accumulator {
+	header := db.GetState(SettlementAddress, accumulatorSlot(pair, 0))
+	acc := &accumulator{
+		timestamp:  binary.BigEndian.Uint64(header[0:]),
+		count:      binary.BigEndian.Uint64(header[8:]),
+		next:       binary.BigEndian.Uint64(header[16:]),
+		price:      db.GetState(SettlementAddress, accumulatorSlot(pair, 1)).Big(),
+		cumulative: db.GetState(SettlementAddress, accumulatorSlot(pair, 2)).Big(),
+	}
+	if acc.count == 0 {
+		return nil
+	}
+	return acc
+}
+
+func writeAccumulator(db StateDB, pair TradingPair, acc *accumulator) {
+	var header common.Hash
+	binary.BigEndian.PutUint64(header[0:], acc.timestamp)
+	binary.BigEndian.PutUint64(header[8:], acc.count)
+	binary.BigEndian.PutUint64(header[16:], acc.next)
+	db.SetState(SettlementAddress, accumulatorSlot(pair, 0), header)
+	db.SetState(SettlementAddress, accumulatorSlot(pair, 1), common.BigToHash(acc.price))
+	db.SetState(SettlementAddress, accumulatorSlot(pair, 2), common.BigToHash(acc.cumulative))
+}
+
+// readObservation reads the i-th observation of the ring buffer of a pair.
+func readObservation(db StateReader, pair TradingPair, i uint64) observation {
+	return observation{
+		timestamp:  db.GetState(SettlementAddress, observationSlot(pair, 2*i)).Big().Uint64(),
+		cumulative: db.GetState(SettlementAddress, observationSlot(pair, 2*i+1)).Big(),
+	}
+}
+
+// observe appends the current cumulative price of an accumulator to the ring
+// buffer of its pair, overwriting the oldest observation once full.
+func observe(db StateDB, pair TradingPair, acc *accumulator) {
+	setUint64(db, observationSlot(pair, 2*acc.next), acc.timestamp)
+	db.SetState(SettlementAddress, observationSlot(pair, 2*acc.next+1), common.BigToHash(acc.cumulative))
+
+	acc.next = (acc.next + 1) % twapObservations
+	if acc.count < twapObservations {
+		acc.count++
+	}
+}
+
+// updateAccumulator accounts for a trade of a pair in its accumulator. The
+// first trade of a block accumulates the price of the previous blocks up to
+// the block's timestamp, the last one sets the price of the seconds to come.
+func updateAccumulator(db StateDB, trade *Trade) {
+	acc := readAccumulator(db, trade.Pair)
+	switch {
+	case acc == nil:
+		acc = &accumulator{timestamp: trade.Timestamp, cumulative: new(big.Int)}
+		observe(db, trade.Pair, acc)
+	case trade.Timestamp > acc.timestamp:
+		elapsed := new(big.Int).SetUint64(trade.Timestamp - acc.timestamp)
+		acc.cumulative = math.U256(acc.cumulative.Add(acc.cumulative, elapsed.Mul(elapsed, acc.price)))
+		acc.timestamp = trade.Timestamp
+		observe(db, trade.Pair, acc)
+	}
+	acc.price = trade.Price
+	writeAccumulator(db, trade.Pair, acc)
+}
+
+// cumulativePrice returns the cumulative price of a pair at a timestamp, or
+// nil if the timestamp precedes the oldest observation still kept. Timestamps
+// after the last update are extrapolated with the last trade price.
+func cumulativePrice(db StateReader, pair TradingPair, acc *accumulator, timestamp uint64) *big.Int {
+	if timestamp >= acc.timestamp {
+		elapsed := new(big.Int).SetUint64(timestamp - acc.timestamp)
+		return math.U256(elapsed.Mul(elapsed, acc.price).Add(elapsed, acc.cumulative))
+	}
+	// Observations are ordered by timestamp from the oldest, at index next once
+	// the ring buffer is full, on
+	oldest := uint64(0)
+	if acc.count == twapObservations {
+		oldest = acc.next
+	}
+	at := func(i int) observation {
+		return readObservation(db, pair, (oldest+uint64(i))%twapObservations)
+	}
+	// Find the last observation at or before the timestamp
+	i := sort.Search(int(acc.count), func(i int) bool { return at(i).timestamp > timestamp }) - 1
+	if i < 0 {
+		return nil
+	}
+	prev := at(i)
+	if prev.timestamp == timestamp {
+		return prev.cumulative
+	}
+	// The price was constant until the following observation, recover it from
+	// the cumulative price difference
+	next := observation{timestamp: acc.timestamp, cumulative: acc.cumulative}
+	if i+1 < int(acc.count) {
+		next = at(i + 1)
+	}
+	delta := math.U256(new(big.Int).Sub(next.cumulative, prev.cumulative))
+	delta.Mul(delta, new(big.Int).SetUint64(timestamp-prev.timestamp))
+	delta.Div(delta, new(big.Int).SetUint64(next.timestamp-prev.timestamp))
+	return math.U256(delta.Add(delta, prev.cumulative))
+}
+
+// TWAPOracle is the built-in price oracle of the DEX, reading the last trade
+// prices and the price accumulators of a state at a given time. Prices are
+// only available for pairs that traded, and averages only over windows still
+// covered by the kept observations.
+type TWAPOracle struct {
+	db  StateReader
+	now uint64
+}
+
+// NewTWAPOracle creates an oracle on the given state, averaging prices up to
+// the given timestamp.
+func NewTWAPOracle(db StateReader, now uint64) *TWAPOracle {
+	return &TWAPOracle{db: db, now: now}
+}
+
+// GetPrice returns the last trade price of a pair.
+func (o *TWAPOracle) GetPrice(pair TradingPair) *big.Int {
+	if acc := readAccumulator(o.db, pair); acc != nil {
+		return acc.price
+	}
+	return nil
+}
+
+// GetTWAP returns the time-weighted average price of a pair over the last
+// windowSeconds seconds, or its last trade price for an empty window.
+func (o *TWAPOracle) GetTWAP(pair TradingPair, windowSeconds uint64) *big.Int {
+	acc := readAccumulator(o.db, pair)
+	if acc == nil || windowSeconds > o.now {
+		return nil
+	}
+	if windowSeconds == 0 {
+		return acc.price
+	}
+	end := cumulativePrice(o.db, pair, acc, o.now)
+	start := cumulativePrice(o.db, pair, acc, o.now-windowSeconds)
+	if start == nil {
+		return nil
+	}
+	twap := math.U256(new(big.Int).Sub(end, start))
+	return twap.Div(twap, new(big.Int).SetUint64(windowSeconds))
+}
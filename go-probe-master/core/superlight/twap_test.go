@@ -0,0 +1,148 @@
+// Copyright 2024 The go-probe Authors
+// This file is part of the go-probe library.
+//
+// The go-probe library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-probe library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-probe library. If not, see <http://www.gnu.org/licenses/>.
+
+package superlight
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/probechain/go-probe/core/state"
+)
+
+// ratio returns units(n) / d, the expected average of n units over d seconds.
+func ratio(n, d int64) *big.Int {
+	return new(big.Int).Div(units(n), big.NewInt(d))
+}
+
+// Tests that the accumulators average the last trade price of each block over
+// the seconds following it, and survive a restart.
+func TestTWAPAccumulator(t *testing.T) {
+	db := newTestState(t)
+	ensureSettlementAccount(db)
+
+	for _, trade := range []struct {
+		timestamp uint64
+		price     int64
+	}{
+		{100, 10}, {100, 12}, // Only the last price of a block counts
+		{110, 20},
+		{130, 30},
+	} {
+		updateAccumulator(db, &Trade{Pair: testPair, Price: units(trade.price), Amount: units(1), Timestamp: trade.timestamp})
+	}
+	check := func(db StateReader) {
+		t.Helper()
+		oracle := NewTWAPOracle(db, 150)
+
+		// Cumulative prices: 0 at 100, 120 at 110, 520 at 130, 1120 at 150
+		for _, test := range []struct {
+			window uint64
+			want   *big.Int
+		}{
+			{0, units(30)},
+			{10, units(30)},
+			{30, ratio(1120-320, 30)}, // Interpolated within 110..130
+			{45, ratio(1120-60, 45)},  // Interpolated within 100..110
+			{50, ratio(1120, 50)},
+			{51, nil}, // Before the first trade
+			{151, nil},
+		} {
+			have := oracle.GetTWAP(testPair, test.window)
+			if (have == nil) != (test.want == nil) || (have != nil && have.Cmp(test.want) != 0) {
+				t.Fatalf("window %d: twap mismatch: have %v, want %v", test.window, have, test.want)
+			}
+		}
+		if price := oracle.GetPrice(testPair); price == nil || price.Cmp(units(30)) != 0 {
+			t.Fatalf("price mismatch: have %v, want %v", price, units(30))
+		}
+		if price := oracle.GetPrice(TradingPair{BaseAsset: testPair.QuoteAsset, QuoteAsset: testPair.BaseAsset}); price != nil {
+			t.Fatalf("price of untraded pair: %v", price)
+		}
+	}
+	check(db)
+
+	root, err := db.Commit(true)
+	if err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	reopened, err := state.New(root, db.Database(), nil)
+	if err != nil {
+		t.Fatalf("failed to reopen state: %v", err)
+	}
+	check(reopened)
+}
+
+// Tests that averages are available over windows covered by the observation
+// ring buffer once it wrapped around, and unavailable beyond.
+func TestTWAPObservationRing(t *testing.T) {
+	db := newTestState(t)
+	ensureSettlementAccount(db)
+
+	// One block every 10 seconds, trading at the block number
+	blocks := int64(twapObservations + 100)
+	for i := int64(1); i <= blocks; i++ {
+		updateAccumulator(db, &Trade{Pair: testPair, Price: units(i), Amount: units(1), Timestamp: uint64(10 * i)})
+	}
+	now := uint64(10 * blocks)
+	oracle := NewTWAPOracle(db, now)
+
+	// Over the last n blocks, the prices of blocks-n to blocks-1 accrued
+	for _, n := range []int64{1, 2, 100, twapObservations - 1} {
+		sum := (blocks - n + blocks - 1) * n / 2
+		want := ratio(10*sum, 10*n)
+		if have := oracle.GetTWAP(testPair, uint64(10*n)); have == nil || have.Cmp(want) != 0 {
+			t.Fatalf("window of %d blocks: twap mismatch: have %v, want %v", n, have, want)
+		}
+	}
+	// Half way between two blocks
+	want := ratio(5*(blocks-1), 5)
+	if have := oracle.GetTWAP(testPair, 5); have == nil || have.Cmp(want) != 0 {
+		t.Fatalf("half block window: twap mismatch: have %v, want %v", have, want)
+	}
+	if have := oracle.GetTWAP(testPair, 10*twapObservations); have != nil {
+		t.Fatalf("twap beyond kept observations: %v", have)
+	}
+}
+
+// Tests that without a configured oracle, the manager accumulates the prices of
+// its trades and triggers stop orders by the last trade price.
+func TestManagerTWAPOracle(t *testing.T) {
+	mgr := NewManager(feedConfig)
+	db := newFundedState(t)
+
+	placeOrder(t, mgr, db, OrderSideSell, 200, 100, 1)
+	placeOrder(t, mgr, db, OrderSideBuy, 190, 100, 1)
+	stop := encodePlaceOrderV1(OrderSideSell, testPair, new(big.Int), units(50), OrderOptions{Type: OrderTypeStop, StopPrice: units(190)})
+	if _, err := mgr.ProcessDEXTransaction(db, alice, stop, 1001, 1); err != nil {
+		t.Fatalf("failed to place stop order: %v", err)
+	}
+	if trades := placeOrder(t, mgr, db, OrderSideBuy, 200, 100, 2); len(trades) != 1 {
+		t.Fatalf("expected 1 trade above the stop price, got %d", len(trades))
+	}
+	trades := placeOrder(t, mgr, db, OrderSideSell, 190, 10, 3)
+	if len(trades) != 2 || trades[1].Amount.Cmp(units(50)) != 0 {
+		t.Fatalf("expected the stop order to trade after the price fell, got %+v", trades)
+	}
+	oracle := NewTWAPOracle(db, 1013)
+	if price := oracle.GetPrice(testPair); price == nil || price.Cmp(units(190)) != 0 {
+		t.Fatalf("price mismatch: have %v, want %v", price, units(190))
+	}
+	// 200 for one second from the first trade, 190 for the ten after
+	if have, want := oracle.GetTWAP(testPair, 11), ratio(200+1900, 11); have == nil || have.Cmp(want) != 0 {
+		t.Fatalf("twap mismatch: have %v, want %v", have, want)
+	}
+}
@@ -17,6 +17,7 @@
 package superlight
 
 import (
+	"fmt"
 	"math/big"
 
 	"github.com/probechain/go-probe/common"
@@ -38,8 +39,65 @@ const (
 	OrderStatusFilled    OrderStatus = 1
 	OrderStatusPartial   OrderStatus = 2
 	OrderStatusCancelled OrderStatus = 3
+	OrderStatusPending   OrderStatus = 4 // Stop order waiting for its trigger
+	OrderStatusExpired   OrderStatus = 5
 )
 
+// OrderType represents how an order is executed.
+type OrderType uint8
+
+const (
+	OrderTypeLimit     OrderType = 0 // Matches up to its price, rests the remainder
+	OrderTypeMarket    OrderType = 1 // Matches at any price, or up to its price if set, cancels the remainder
+	OrderTypeIOC       OrderType = 2 // Immediate-or-cancel: matches up to its price, cancels the remainder
+	OrderTypeFOK       OrderType = 3 // Fill-or-kill: rejected unless it can be filled completely
+	OrderTypePostOnly  OrderType = 4 // Rejected if it would match, rests otherwise
+	OrderTypeStop      OrderType = 5 // Market order once the oracle price reaches the stop price
+	OrderTypeStopLimit OrderType = 6 // Limit order once the oracle price reaches the stop price
+)
+
+// rests returns whether the unfilled remainder of an order of this type is
+// added to the book.
+func (t OrderType) rests() bool {
+	return t == OrderTypeLimit || t == OrderTypePostOnly || t == OrderTypeStopLimit
+}
+
+// isStop returns whether orders of this type wait for a trigger price.
+func (t OrderType) isStop() bool {
+	return t == OrderTypeStop || t == OrderTypeStopLimit
+}
+
+// OrderOptions holds the parameters of an order beyond plain limit orders.
+type OrderOptions struct {
+	Type        OrderType // Execution type
+	StopPrice   *big.Int  // Trigger price of stop orders
+	ExpiryBlock uint64    // Last block the order is valid in, zero if good-till-cancelled
+}
+
+// SelfTradeMode determines what happens when an order would match a resting
+// order of the same owner.
+type SelfTradeMode uint8
+
+const (
+	SelfTradeCancelNewest SelfTradeMode = 0 // Cancels the remainder of the incoming order
+	SelfTradeCancelOldest SelfTradeMode = 1 // Cancels the resting order and goes on matching
+	SelfTradeDecrement    SelfTradeMode = 2 // Reduces both orders by their overlap without trading
+)
+
+// ParseSelfTradeMode parses a self-trade prevention mode by its configuration
+// name, an empty name meaning the default cancel-newest.
+func ParseSelfTradeMode(name string) (SelfTradeMode, error) {
+	switch name {
+	case "", "cancel-newest":
+		return SelfTradeCancelNewest, nil
+	case "cancel-oldest":
+		return SelfTradeCancelOldest, nil
+	case "decrement":
+		return SelfTradeDecrement, nil
+	}
+	return SelfTradeCancelNewest, fmt.Errorf("unknown self-trade prevention mode %q", name)
+}
+
 // TradingPair identifies a pair of assets that can be traded.
 type TradingPair struct {
 	BaseAsset  common.Address `json:"baseAsset"`  // Token contract address (zero for native PROBE)
@@ -51,18 +109,27 @@ func (tp TradingPair) String() string {
 	return tp.BaseAsset.Hex() + "/" + tp.QuoteAsset.Hex()
 }
 
-// Order represents a limit order in the Superlight DEX.
+// Order represents an order in the Superlight DEX.
 type Order struct {
-	ID        common.Hash    `json:"id"`        // Unique order ID (hash of order fields)
+	ID        common.Hash    `json:"id"`        // Unique order ID (hash of order fields and sequence number)
 	Owner     common.Address `json:"owner"`     // Account that placed the order
 	Pair      TradingPair    `json:"pair"`      // Trading pair
 	Side      OrderSide      `json:"side"`      // Buy or sell
-	Price     *big.Int       `json:"price"`     // Price in quote asset (scaled by 1e18)
+	Type      OrderType      `json:"type"`      // Execution type
+	Price     *big.Int       `json:"price"`     // Price in quote asset (scaled by 1e18), zero for unbounded market orders
 	Amount    *big.Int       `json:"amount"`    // Total amount in base asset
 	Filled    *big.Int       `json:"filled"`    // Amount already filled
 	Status    OrderStatus    `json:"status"`    // Current order status
 	Timestamp uint64         `json:"timestamp"` // Block timestamp when order was placed
 	BlockNum  uint64         `json:"blockNum"`  // Block number when order was placed
+	Seq       uint64         `json:"seq"`       // Sequence number of the order across all pairs
+
+	StopPrice   *big.Int `json:"stopPrice,omitempty"`   // Trigger price of stop orders
+	ExpiryBlock uint64   `json:"expiryBlock,omitempty"` // Last block the order is valid in, zero if good-till-cancelled
+
+	// Links of the order in the queue of its price level while in the book
+	level      *PriceLevel
+	prev, next *Order
 }
 
 // Remaining returns the unfilled amount of the order.
@@ -70,6 +137,11 @@ func (o *Order) Remaining() *big.Int {
 	return new(big.Int).Sub(o.Amount, o.Filled)
 }
 
+// Expired returns whether the order is no longer valid at the given block.
+func (o *Order) Expired(blockNum uint64) bool {
+	return o.ExpiryBlock != 0 && blockNum > o.ExpiryBlock
+}
+
 // IsFilled returns true if the order is completely filled.
 func (o *Order) IsFilled() bool {
 	return o.Filled.Cmp(o.Amount) >= 0
@@ -82,11 +154,12 @@ type Trade struct {
 	TakerOrder common.Hash    `json:"takerOrder"` // Taker order ID
 	Maker      common.Address `json:"maker"`      // Maker address
 	Taker      common.Address `json:"taker"`      // Taker address
-	Pair       TradingPair    `json:"pair"`        // Trading pair
-	Price      *big.Int       `json:"price"`       // Execution price
-	Amount     *big.Int       `json:"amount"`      // Trade amount in base asset
-	MakerFee   *big.Int       `json:"makerFee"`    // Fee charged to maker
-	TakerFee   *big.Int       `json:"takerFee"`    // Fee charged to taker
-	Timestamp  uint64         `json:"timestamp"`   // Block timestamp
-	BlockNum   uint64         `json:"blockNum"`    // Block number
+	Pair       TradingPair    `json:"pair"`       // Trading pair
+	Side       OrderSide      `json:"side"`       // Side of the taker order
+	Price      *big.Int       `json:"price"`      // Execution price
+	Amount     *big.Int       `json:"amount"`     // Trade amount in base asset
+	MakerFee   *big.Int       `json:"makerFee"`   // Fee charged to maker
+	TakerFee   *big.Int       `json:"takerFee"`   // Fee charged to taker
+	Timestamp  uint64         `json:"timestamp"`  // Block timestamp
+	BlockNum   uint64         `json:"blockNum"`   // Block number
 }
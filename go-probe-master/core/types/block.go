@@ -183,6 +183,21 @@ type Header struct {
 	// It provides absolute time ordering with clock source metadata and uncertainty bounds.
 	// Optional: old nodes ignore this field via rlp:"optional".
 	AtomicTime []byte `json:"atomicTime" rlp:"optional"`
+
+	// Evidence carries consensus-engine specific proofs of validator misbehavior
+	// (e.g. double signing) to be acted upon when the header is applied.
+	// Optional: old nodes ignore this field via rlp:"optional".
+	Evidence []byte `json:"evidence" rlp:"optional"`
+
+	// KeyRegistrations carries consensus-engine specific registrations and
+	// rotations of validator post-quantum signing keys.
+	// Optional: old nodes ignore this field via rlp:"optional".
+	KeyRegistrations []byte `json:"keyRegistrations" rlp:"optional"`
+
+	// AckSigners lists the validators whose ACKs for the parent block are
+	// carried in the body, committing the ACK participation to the header.
+	// Optional: old nodes ignore this field via rlp:"optional".
+	AckSigners []common.Address `json:"ackSigners" rlp:"optional"`
 }
 
 func (h *Header) String() string {
@@ -217,15 +232,17 @@ func (h *Header) String() string {
 
 // field type overrides for gencodec
 type headerMarshaling struct {
-	Difficulty *hexutil.Big
-	Number     *hexutil.Big
-	GasLimit   hexutil.Uint64
-	GasUsed    hexutil.Uint64
-	Time       hexutil.Uint64
-	Extra      hexutil.Bytes
-	BaseFee    *hexutil.Big
-	AtomicTime hexutil.Bytes
-	Hash       common.Hash `json:"hash"` // adds call to Hash() in MarshalJSON
+	Difficulty       *hexutil.Big
+	Number           *hexutil.Big
+	GasLimit         hexutil.Uint64
+	GasUsed          hexutil.Uint64
+	Time             hexutil.Uint64
+	Extra            hexutil.Bytes
+	BaseFee          *hexutil.Big
+	AtomicTime       hexutil.Bytes
+	Evidence         hexutil.Bytes
+	KeyRegistrations hexutil.Bytes
+	Hash             common.Hash `json:"hash"` // adds call to Hash() in MarshalJSON
 }
 
 // Hash returns the block hash of the header, which is simply the keccak256 hash of its
@@ -439,6 +456,18 @@ func CopyHeader(h *Header) *Header {
 		cpy.AtomicTime = make([]byte, len(h.AtomicTime))
 		copy(cpy.AtomicTime, h.AtomicTime)
 	}
+	if len(h.Evidence) > 0 {
+		cpy.Evidence = make([]byte, len(h.Evidence))
+		copy(cpy.Evidence, h.Evidence)
+	}
+	if len(h.KeyRegistrations) > 0 {
+		cpy.KeyRegistrations = make([]byte, len(h.KeyRegistrations))
+		copy(cpy.KeyRegistrations, h.KeyRegistrations)
+	}
+	if len(h.AckSigners) > 0 {
+		cpy.AckSigners = make([]common.Address, len(h.AckSigners))
+		copy(cpy.AckSigners, h.AckSigners)
+	}
 	return &cpy
 }
 
@@ -38,6 +38,9 @@ func (h Header) MarshalJSON() ([]byte, error) {
 		Nonce            BlockNonce      `json:"nonce"`
 		BaseFee          *hexutil.Big    `json:"baseFeePerGas" rlp:"optional"`
 		AtomicTime       hexutil.Bytes   `json:"atomicTime" rlp:"optional"`
+		Evidence         hexutil.Bytes   `json:"evidence" rlp:"optional"`
+		KeyRegistrations hexutil.Bytes   `json:"keyRegistrations" rlp:"optional"`
+		AckSigners       []common.Address `json:"ackSigners" rlp:"optional"`
 		Hash             common.Hash     `json:"hash"`
 	}
 	var enc Header
@@ -63,6 +66,9 @@ func (h Header) MarshalJSON() ([]byte, error) {
 	enc.Nonce = h.Nonce
 	enc.BaseFee = (*hexutil.Big)(h.BaseFee)
 	enc.AtomicTime = h.AtomicTime
+	enc.Evidence = h.Evidence
+	enc.KeyRegistrations = h.KeyRegistrations
+	enc.AckSigners = h.AckSigners
 	enc.Hash = h.Hash()
 	return json.Marshal(&enc)
 }
@@ -92,6 +98,9 @@ func (h *Header) UnmarshalJSON(input []byte) error {
 		Nonce            *BlockNonce     `json:"nonce"`
 		BaseFee          *hexutil.Big    `json:"baseFeePerGas" rlp:"optional"`
 		AtomicTime       *hexutil.Bytes  `json:"atomicTime" rlp:"optional"`
+		Evidence         *hexutil.Bytes  `json:"evidence" rlp:"optional"`
+		KeyRegistrations *hexutil.Bytes  `json:"keyRegistrations" rlp:"optional"`
+		AckSigners       []common.Address `json:"ackSigners" rlp:"optional"`
 	}
 	var dec Header
 	if err := json.Unmarshal(input, &dec); err != nil {
@@ -181,5 +190,14 @@ func (h *Header) UnmarshalJSON(input []byte) error {
 	if dec.AtomicTime != nil {
 		h.AtomicTime = *dec.AtomicTime
 	}
+	if dec.Evidence != nil {
+		h.Evidence = *dec.Evidence
+	}
+	if dec.KeyRegistrations != nil {
+		h.KeyRegistrations = *dec.KeyRegistrations
+	}
+	if dec.AckSigners != nil {
+		h.AckSigners = dec.AckSigners
+	}
 	return nil
 }
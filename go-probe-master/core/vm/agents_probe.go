@@ -0,0 +1,98 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/probechain/go-probe/log"
+	"github.com/probechain/go-probe/params"
+	"github.com/probechain/go-probe/probe-lang/integration"
+)
+
+// Reputation changes of an agent whose message handler succeeded or failed.
+const (
+	agentHandlerReward  = 1
+	agentHandlerPenalty = -10
+)
+
+// DeliverAgentMessages runs the handlers of the PROBE agent messages sent in
+// earlier blocks, oldest first, up to params.ProbeAgentMessagesPerBlock
+// messages. Each handler runs in the code of the contract that spawned the
+// agent with params.ProbeAgentHandlerGas gas, which the sender prepaid as
+// part of params.ProbeAgentSendGas when it sent the message. A failed handler has its changes reverted and lowers the
+// agent's reputation, a successful one stores the new agent state and raises
+// it. Logs emitted by handlers are not part of any receipt.
+//
+// It returns the number of messages delivered.
+func DeliverAgentMessages(evm *EVM) int {
+	reg := integration.NewAgentRegistry(evm.StateDB)
+	block := evm.Context.BlockNumber.Uint64()
+	delivered := 0
+	for uint64(delivered) < params.ProbeAgentMessagesPerBlock {
+		msg, ok := reg.NextMessage(block)
+		if !ok {
+			break
+		}
+		delivered++
+
+		snapshot := evm.StateDB.Snapshot()
+		if err := deliverAgentMessage(evm, reg, msg); err != nil {
+			evm.StateDB.RevertToSnapshot(snapshot)
+			log.Debug("PROBE agent message failed", "seq", msg.Seq, "from", msg.From, "to", msg.To, "err", err)
+			reg.UpdateReputation(msg.To, agentHandlerPenalty)
+			continue
+		}
+		reg.UpdateReputation(msg.To, agentHandlerReward)
+	}
+	return delivered
+}
+
+// deliverAgentMessage runs the handler of a single message and stores the
+// agent's new state.
+func deliverAgentMessage(evm *EVM, reg *integration.AgentRegistry, msg *integration.AgentMessage) error {
+	ag, err := reg.Agent(msg.To)
+	if err != nil {
+		return err
+	}
+	if ag.Entry > math.MaxUint32 {
+		return fmt.Errorf("%w: invalid dispatcher entry %d", integration.ErrExecutionFailed, ag.Entry)
+	}
+	code, err := integration.DecodePROBEContract(evm.StateDB.GetCode(ag.Owner))
+	if err != nil {
+		return err
+	}
+	contract := NewContract(AccountRef(msg.From), AccountRef(ag.Address), new(big.Int), params.ProbeAgentHandlerGas)
+	ctx := &integration.ExecutionContext{
+		Address:   ag.Address,
+		Caller:    msg.From,
+		Origin:    msg.From,
+		GasLimit:  contract.Gas,
+		BlockNum:  evm.Context.BlockNumber.Uint64(),
+		BlockTime: evm.Context.Time.Uint64(),
+		Entry:     uint32(ag.Entry),
+		SendGas:   params.ProbeAgentSendGas,
+		Host:      &probeHost{evm: evm, contract: contract},
+	}
+	_, state, err := integration.DeliverMessage(code, ctx, ag.State, msg.Data)
+	if err != nil {
+		return err
+	}
+	return reg.SetAgentState(ag.Address, state)
+}
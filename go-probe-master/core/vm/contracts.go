@@ -149,6 +149,16 @@ func init() {
 
 // ActivePrecompiles returns the precompiles enabled with the current configuration.
 func ActivePrecompiles(rules params.Rules) []common.Address {
+	precompiles := activeForkPrecompiles(rules)
+	if rules.IsSuperlight {
+		precompiles = append(precompiles[:len(precompiles):len(precompiles)], SuperlightTWAPPrecompileAddress)
+	}
+	return precompiles
+}
+
+// activeForkPrecompiles returns the precompiles enabled by the forks active
+// with the current configuration.
+func activeForkPrecompiles(rules params.Rules) []common.Address {
 	switch {
 	case rules.IsDilithium:
 		return PrecompiledAddressesDilithium
@@ -0,0 +1,69 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"math/big"
+
+	"github.com/probechain/go-probe/common"
+)
+
+// superlightTWAP implements a precompiled contract reading the Superlight DEX
+// price oracle of the state and block it is called in.
+// Input format: baseAsset(32) || quoteAsset(32) || window(32), addresses left-padded.
+// Output: 32 bytes — the time-weighted average price over the last window seconds,
+// the last trade price for a zero window, zero if unavailable.
+type superlightTWAP struct {
+	db   StateDB
+	now  uint64
+	twap TWAPFunc
+}
+
+const (
+	superlightTWAPInputLen = 96
+	superlightTWAPGas      = 25000 // Covers the storage reads of an observation lookup
+)
+
+func (c *superlightTWAP) RequiredGas(input []byte) uint64 {
+	return superlightTWAPGas
+}
+
+func (c *superlightTWAP) Run(input []byte) ([]byte, error) {
+	// Pad input if too short
+	if len(input) < superlightTWAPInputLen {
+		padded := make([]byte, superlightTWAPInputLen)
+		copy(padded, input)
+		input = padded
+	}
+	var (
+		base   = common.BytesToAddress(input[12:32])
+		quote  = common.BytesToAddress(input[44:64])
+		window = new(big.Int).SetBytes(input[64:96])
+	)
+	if c.twap == nil || !window.IsUint64() {
+		return make([]byte, 32), nil
+	}
+	price := c.twap(c.db, base, quote, window.Uint64(), c.now)
+	if price == nil {
+		return make([]byte, 32), nil
+	}
+	return common.BigToHash(price).Bytes(), nil
+}
+
+// SuperlightTWAPPrecompileAddress is the address of the Superlight TWAP oracle
+// precompile, active on chains with the Superlight DEX enabled.
+var SuperlightTWAPPrecompileAddress = common.BytesToAddress([]byte{21})
@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"testing"
 	"time"
 
@@ -272,6 +273,33 @@ func TestPrecompileBlake2FMalformedInput(t *testing.T) {
 
 func TestPrecompiledEcrecover(t *testing.T) { testJson("ecRecover", "01", t) }
 
+// Tests that the Superlight TWAP precompile decodes its input and returns zero
+// for prices the oracle doesn't have.
+func TestPrecompiledSuperlightTWAP(t *testing.T) {
+	var (
+		base  = common.HexToAddress("0x1111111111111111111111111111111111111111")
+		quote = common.HexToAddress("0x2222222222222222222222222222222222222222")
+	)
+	p := &superlightTWAP{now: 1000, twap: func(db StateDB, b, q common.Address, window, now uint64) *big.Int {
+		if b != base || q != quote || now != 1000 || window > now {
+			return nil
+		}
+		return new(big.Int).SetUint64(window)
+	}}
+	input := append(append(common.LeftPadBytes(base.Bytes(), 32), common.LeftPadBytes(quote.Bytes(), 32)...), common.LeftPadBytes([]byte{0x01, 0x2c}, 32)...)
+	if have, err := p.Run(input); err != nil || !bytes.Equal(have, common.LeftPadBytes([]byte{0x01, 0x2c}, 32)) {
+		t.Fatalf("twap mismatch: have %x, %v", have, err)
+	}
+	// Unknown prices, oversized windows and truncated input yield zero
+	input[95] = 0xff
+	input[94] = 0xff
+	for _, in := range [][]byte{input, append(input[:64:64], bytes.Repeat([]byte{0xff}, 32)...), input[:40]} {
+		if have, err := p.Run(in); err != nil || !bytes.Equal(have, make([]byte, 32)) {
+			t.Fatalf("expected zero price, have %x, %v", have, err)
+		}
+	}
+}
+
 func testJson(name, addr string, t *testing.T) {
 	tests, err := loadJson(name)
 	if err != nil {
@@ -28,6 +28,7 @@ import (
 	uint256 "github.com/probechain/go-probe/core/vm/uint256"
 	"github.com/probechain/go-probe/crypto"
 	"github.com/probechain/go-probe/params"
+	"github.com/probechain/go-probe/probe-lang/integration"
 )
 
 // emptyCodeHash is used by create to ensure deployment is disallowed to already
@@ -44,8 +45,11 @@ type (
 	CancellationFunc func(StateDB, common.Address, common.Address)
 	//ContractDeployFunc is the signature of a transfer function
 	ContractDeployFunc func(StateDB, common.Address) error
-	//CallDBFunc call database
-	CallDBFunc func(StateDB, TxContext)
+	//CallDBFunc call database, returning the gas left of the gas given to the call
+	CallDBFunc func(StateDB, TxContext, uint64) (uint64, error)
+	// TWAPFunc returns the time-weighted average price of a Superlight DEX pair
+	// over the given window of seconds up to the given time
+	TWAPFunc func(db StateDB, base, quote common.Address, window, now uint64) *big.Int
 )
 
 func (evm *EVM) precompile(addr common.Address) (PrecompiledContract, bool) {
@@ -62,6 +66,9 @@ func (evm *EVM) precompile(addr common.Address) (PrecompiledContract, bool) {
 	default:
 		precompiles = PrecompiledContractsHomestead
 	}
+	if evm.chainRules.IsSuperlight && addr == SuperlightTWAPPrecompileAddress {
+		return &superlightTWAP{db: evm.StateDB, now: evm.Context.Time.Uint64(), twap: evm.Context.TWAP}, true
+	}
 	p, ok := precompiles[addr]
 	return p, ok
 }
@@ -96,6 +103,8 @@ type BlockContext struct {
 	ContractDeploy ContractDeployFunc
 	//CallDB call database for update operation
 	CallDB CallDBFunc
+	// TWAP reads the Superlight DEX price oracle for the TWAP precompile
+	TWAP TWAPFunc
 	// Block information
 	Coinbase    common.Address // Provides information for COINBASE
 	GasLimit    uint64         // Provides information for GASLIMIT
@@ -119,6 +128,7 @@ type TxContext struct {
 	//Set when the evm call method is called
 	PobEpoch   uint64
 	BlockNumber *big.Int
+	Depth       int
 }
 
 // EVM is the ProbeChain Virtual Machine base object and provides
@@ -188,10 +198,16 @@ func NewEVM(blockCtx BlockContext, txCtx TxContext, statedb StateDB, chainConfig
 		panic("No supported ewasm interpreter yet.")
 	}
 
+	// PROBE language contracts are recognised by their magic prefix and must
+	// be offered to their interpreter before the catch-all EVM.
+	if evm.chainRules.IsProbeLang {
+		evm.interpreters = append(evm.interpreters, NewPROBEInterpreter(evm, config))
+	}
+
 	// vmConfig.EVMInterpreter will be used by EVM-C, it won't be checked here
 	// as we always want to have the built-in EVM as the failover option.
 	evm.interpreters = append(evm.interpreters, NewEVMInterpreter(evm, config))
-	evm.interpreter = evm.interpreters[0]
+	evm.interpreter = evm.interpreters[len(evm.interpreters)-1]
 
 	return evm
 }
@@ -249,10 +265,14 @@ func (evm *EVM) Call(caller ContractRef, to common.Address, input []byte, gas ui
 		evm.TxContext.Value = value
 	}
 	evm.TxContext.BlockNumber = evm.Context.BlockNumber
+	evm.TxContext.Depth = evm.depth
 	if evm.chainConfig.Pob != nil {
 		evm.TxContext.PobEpoch = evm.chainConfig.Pob.Epoch
 	}
-	evm.Context.CallDB(evm.StateDB, evm.TxContext)
+	if gas, err = evm.Context.CallDB(evm.StateDB, evm.TxContext, gas); err != nil {
+		evm.StateDB.RevertToSnapshot(snapshot)
+		return nil, gas, err
+	}
 	// Capture the tracer start/end events in debug mode
 	if evm.Config.Debug && evm.depth == 0 {
 		evm.Config.Tracer.CaptureStart(evm, caller.Address(), to, false, input, gas, value)
@@ -478,7 +498,10 @@ func (evm *EVM) create(caller ContractRef, codeAndHash *codeAndHash, gas uint64,
 		evm.TxContext.From = caller.Address()
 		evm.TxContext.To = &address
 		evm.TxContext.Value = value
-		evm.Context.CallDB(evm.StateDB,evm.TxContext)
+		var err error
+		if gas, err = evm.Context.CallDB(evm.StateDB, evm.TxContext, gas); err != nil {
+			return nil, common.Address{}, gas, err
+		}
 	}else{
 		if err := evm.Context.ContractDeploy(evm.StateDB, caller.Address()); err != nil {
 			return nil, common.Address{}, gas, err
@@ -497,7 +520,19 @@ func (evm *EVM) create(caller ContractRef, codeAndHash *codeAndHash, gas uint64,
 		evm.Config.Tracer.CaptureStart(evm, caller.Address(), address, true, codeAndHash.code, gas, defaultValue)
 	}
 	start := time.Now()
-	ret, err := run(evm, contract, nil, false)
+	var (
+		ret []byte
+		err error
+	)
+	if evm.chainRules.IsProbeLang && integration.IsPROBEContract(codeAndHash.code) {
+		// PROBE contracts have no constructor: the verified deployment data
+		// is the contract code itself.
+		if _, err = integration.VerifyPROBEContract(codeAndHash.code); err == nil {
+			ret = codeAndHash.code
+		}
+	} else {
+		ret, err = run(evm, contract, nil, false)
+	}
 	// Check whprobeer the max code size has been exceeded, assign err if the case.
 	if err == nil && evm.chainRules.IsEIP158 && len(ret) > params.MaxCodeSize {
 		err = ErrMaxCodeSizeExceeded
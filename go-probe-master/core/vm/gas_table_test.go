@@ -90,7 +90,7 @@ func TestEIP2200(t *testing.T) {
 
 		vmctx := vm.BlockContext{
 			CanTransfer: func(vm.StateDB, common.Address, *big.Int) bool { return true },
-			CallDB:      func(vm.StateDB, vm.TxContext) {},
+			CallDB:      func(_ vm.StateDB, _ vm.TxContext, gas uint64) (uint64, error) { return gas, nil },
 		}
 		vmenv := vm.NewEVM(vmctx, vm.TxContext{}, statedb, params.AllPobProtocolChanges, vm.Config{ExtraEips: []int{2200}})
 
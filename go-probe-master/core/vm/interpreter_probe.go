@@ -0,0 +1,246 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/core/types"
+	"github.com/probechain/go-probe/params"
+	"github.com/probechain/go-probe/probe-lang/integration"
+	probevm "github.com/probechain/go-probe/probe-lang/lang/vm"
+)
+
+// revertSelector is the selector of Error(string), used to encode revert
+// reasons the way Solidity does so that RPC clients can decode them.
+var revertSelector = []byte{0x08, 0xc3, 0x79, 0xa0}
+
+// PROBEInterpreter runs contracts compiled from the PROBE language, whose
+// code starts with the PRBE magic, on the PROBE register VM.
+//
+// Call data selects the function by its byte offset followed by 32-byte
+// big-endian arguments (see integration.EncodeCallData); the result is
+// returned as a single 32-byte word.
+type PROBEInterpreter struct {
+	evm *EVM
+	cfg Config
+}
+
+// NewPROBEInterpreter returns a new instance of the PROBE interpreter.
+func NewPROBEInterpreter(evm *EVM, cfg Config) *PROBEInterpreter {
+	return &PROBEInterpreter{evm: evm, cfg: cfg}
+}
+
+// CanRun reports whether code is a PROBE language contract.
+func (in *PROBEInterpreter) CanRun(code []byte) bool {
+	return integration.IsPROBEContract(code)
+}
+
+// Run executes a PROBE contract against the state database. Gas used by the
+// PROBE VM is charged to the contract and a revert returns
+// ErrExecutionReverted with the encoded reason, keeping the gas left.
+func (in *PROBEInterpreter) Run(contract *Contract, input []byte, readOnly bool) ([]byte, error) {
+	// Increment the call depth which is restricted to 1024
+	in.evm.depth++
+	defer func() { in.evm.depth-- }()
+
+	code, err := integration.DecodePROBEContract(contract.Code)
+	if err != nil {
+		return nil, err
+	}
+	entry, args, err := integration.DecodeCallData(input)
+	if err != nil {
+		return nil, err
+	}
+	// PROBE words are 64 bits wide, a contract must not be credited a value
+	// it cannot see
+	value := contract.Value()
+	if value != nil && !value.IsUint64() {
+		return nil, ErrValueOverflow
+	}
+	ctx := &integration.ExecutionContext{
+		Address:   contract.Address(),
+		Caller:    contract.Caller(),
+		Origin:    in.evm.Origin,
+		GasLimit:  contract.Gas,
+		BlockNum:  in.evm.Context.BlockNumber.Uint64(),
+		BlockTime: in.evm.Context.Time.Uint64(),
+		Entry:     entry,
+		Args:      args,
+		SendGas:   params.ProbeAgentSendGas,
+		Host:      &probeHost{evm: in.evm, contract: contract, readOnly: readOnly},
+	}
+	if value != nil {
+		ctx.Value = value.Uint64()
+	}
+	if in.cfg.Debug {
+		if t, ok := in.cfg.Tracer.(PROBETracer); ok {
+			ctx.Tracer = &probeStepTracer{evm: in.evm, tracer: t, depth: in.evm.depth}
+		}
+	}
+	res, err := integration.Execute(code, ctx)
+	if res.GasUsed > contract.Gas {
+		res.GasUsed = contract.Gas
+	}
+	contract.UseGas(res.GasUsed)
+
+	switch {
+	case errors.Is(err, probevm.ErrOutOfGas):
+		return nil, ErrOutOfGas
+	case errors.Is(err, probevm.ErrReverted):
+		return encodeRevertReason(res.RevertReason), ErrExecutionReverted
+	case errors.Is(err, ErrWriteProtection):
+		return nil, ErrWriteProtection
+	case errors.Is(err, probevm.ErrInsufficientBalance):
+		return nil, ErrInsufficientBalance
+	case err != nil:
+		return nil, err
+	}
+	return integration.EncodeWord(res.ReturnValue), nil
+}
+
+// PROBETracer is implemented by tracers that also trace the instructions of
+// PROBE contracts, which run on the PROBE VM rather than the EVM interpreter.
+type PROBETracer interface {
+	CaptureProbeStep(env *EVM, v *probevm.VM, step *probevm.Step, depth int)
+}
+
+// probeStepTracer forwards the steps of a PROBE contract to a PROBETracer.
+type probeStepTracer struct {
+	evm    *EVM
+	tracer PROBETracer
+	depth  int
+}
+
+func (t *probeStepTracer) CaptureStep(v *probevm.VM, step *probevm.Step) {
+	t.tracer.CaptureProbeStep(t.evm, v, step, t.depth)
+}
+
+// encodeRevertReason ABI-encodes a revert reason as Error(string). An empty
+// reason yields no data.
+func encodeRevertReason(reason string) []byte {
+	if reason == "" {
+		return nil
+	}
+	padded := (len(reason) + 31) / 32 * 32
+	data := make([]byte, 4+32+32+padded)
+	copy(data, revertSelector)
+	data[4+31] = 0x20 // offset of the string
+	binary.BigEndian.PutUint64(data[4+32+24:], uint64(len(reason)))
+	copy(data[4+64:], reason)
+	return data
+}
+
+// probeHost exposes the state database to a PROBE contract. Storage keys and
+// values are stored as big-endian words; state changes are undone with the
+// call's snapshot if execution fails.
+type probeHost struct {
+	evm      *EVM
+	contract *Contract
+	readOnly bool
+}
+
+func (h *probeHost) Address() common.Address { return h.contract.Address() }
+
+func (h *probeHost) Caller() common.Address { return h.contract.Caller() }
+
+// Balance returns the balance of addr, or MaxUint64 if it does not fit. PROBE
+// words are 64 bits wide, so contracts cannot tell balances of MaxUint64 pico
+// or more apart and must read MaxUint64 as a lower bound. Transfers are not
+// affected, they move at most MaxUint64 at a time.
+func (h *probeHost) Balance(addr common.Address) uint64 {
+	bal := h.evm.StateDB.GetBalance(addr)
+	if !bal.IsUint64() {
+		return math.MaxUint64
+	}
+	return bal.Uint64()
+}
+
+func (h *probeHost) Transfer(to common.Address, amount uint64) error {
+	if h.readOnly {
+		return ErrWriteProtection
+	}
+	value := new(big.Int).SetUint64(amount)
+	from := h.contract.Address()
+	if !h.evm.Context.CanTransfer(h.evm.StateDB, from, value) {
+		return probevm.ErrInsufficientBalance
+	}
+	h.evm.StateDB.SubBalance(from, value)
+	h.evm.StateDB.AddBalance(to, value)
+	return nil
+}
+
+func (h *probeHost) GetStorage(key uint64) uint64 {
+	val := h.evm.StateDB.GetState(h.contract.Address(), storageWord(key))
+	return binary.BigEndian.Uint64(val[common.HashLength-8:])
+}
+
+func (h *probeHost) SetStorage(key, value uint64) error {
+	if h.readOnly {
+		return ErrWriteProtection
+	}
+	h.evm.StateDB.SetState(h.contract.Address(), storageWord(key), storageWord(value))
+	return nil
+}
+
+func (h *probeHost) EmitLog(ev probevm.Event) error {
+	if h.readOnly {
+		return ErrWriteProtection
+	}
+	l := integration.EventLog(h.contract.Address(), ev)
+	h.evm.StateDB.AddLog(&types.Log{
+		Address:     l.Address,
+		Topics:      l.Topics,
+		Data:        l.Data,
+		BlockNumber: h.evm.Context.BlockNumber.Uint64(),
+	})
+	return nil
+}
+
+// Spawn creates an agent owned by the executing contract in the agent
+// registry.
+func (h *probeHost) Spawn(entry uint64, state []uint64) (common.Address, error) {
+	if h.readOnly {
+		return common.Address{}, ErrWriteProtection
+	}
+	reg := integration.NewAgentRegistry(h.evm.StateDB)
+	return reg.Spawn(h.contract.Address(), entry, state, h.evm.Context.BlockNumber.Uint64())
+}
+
+// Send queues msg for the agent at to. It is delivered at the start of a
+// later block by DeliverAgentMessages.
+func (h *probeHost) Send(to common.Address, msg []uint64) error {
+	if h.readOnly {
+		return ErrWriteProtection
+	}
+	reg := integration.NewAgentRegistry(h.evm.StateDB)
+	err := reg.Send(h.contract.Address(), to, msg, h.evm.Context.BlockNumber.Uint64())
+	if errors.Is(err, integration.ErrAgentNotFound) {
+		return fmt.Errorf("%w: %x", probevm.ErrUnknownAgent, to)
+	}
+	return err
+}
+
+// storageWord encodes a VM word as a storage slot key or value.
+func storageWord(v uint64) common.Hash {
+	return common.BytesToHash(integration.EncodeWord(v))
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/probechain/go-probe/common/math"
 	"github.com/probechain/go-probe/core/types"
 	"github.com/probechain/go-probe/params"
+	probevm "github.com/probechain/go-probe/probe-lang/lang/vm"
 	//uint256 "github.com/probechain/go-probe/core/vm/uint256"
 	uint256 "github.com/probechain/go-probe/core/vm/uint256"
 )
@@ -111,6 +112,13 @@ type Tracer interface {
 	CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error)
 }
 
+// ProbeStructLog is a structured log of an instruction executed by a PROBE
+// contract, with the EVM call depth of the contract.
+type ProbeStructLog struct {
+	probevm.StepLog
+	Depth int
+}
+
 // StructLogger is an EVM state logger and implements Tracer.
 //
 // StructLogger can capture state based on the given Log configuration and also keeps
@@ -119,10 +127,11 @@ type Tracer interface {
 type StructLogger struct {
 	cfg LogConfig
 
-	storage map[common.Address]Storage
-	logs    []StructLog
-	output  []byte
-	err     error
+	storage   map[common.Address]Storage
+	logs      []StructLog
+	probeLogs []ProbeStructLog
+	output    []byte
+	err       error
 }
 
 // NewStructLogger returns a new logger
@@ -141,6 +150,7 @@ func (l *StructLogger) Reset() {
 	l.storage = make(map[common.Address]Storage)
 	l.output = make([]byte, 0)
 	l.logs = l.logs[:0]
+	l.probeLogs = l.probeLogs[:0]
 	l.err = nil
 }
 
@@ -209,6 +219,20 @@ func (l *StructLogger) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost ui
 	l.logs = append(l.logs, log)
 }
 
+// CaptureProbeStep implements the PROBETracer interface, logging an
+// instruction of a PROBE contract. The registers are captured unless the
+// stack is disabled, the memory unless memory is disabled.
+func (l *StructLogger) CaptureProbeStep(env *EVM, v *probevm.VM, step *probevm.Step, depth int) {
+	if l.cfg.Limit != 0 && l.cfg.Limit <= len(l.probeLogs) {
+		return
+	}
+	log := ProbeStructLog{
+		StepLog: step.Snapshot(v, !l.cfg.DisableStack, !l.cfg.DisableMemory),
+		Depth:   depth,
+	}
+	l.probeLogs = append(l.probeLogs, log)
+}
+
 // CaptureFault implements the Tracer interface to trace an execution fault
 // while running an opcode.
 func (l *StructLogger) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, depth int, err error) {
@@ -229,6 +253,9 @@ func (l *StructLogger) CaptureEnd(output []byte, gasUsed uint64, t time.Duration
 // StructLogs returns the captured log entries.
 func (l *StructLogger) StructLogs() []StructLog { return l.logs }
 
+// ProbeLogs returns the captured PROBE VM instructions.
+func (l *StructLogger) ProbeLogs() []ProbeStructLog { return l.probeLogs }
+
 // Error returns the VM error captured by the trace.
 func (l *StructLogger) Error() error { return l.err }
 
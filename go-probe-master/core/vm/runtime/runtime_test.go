@@ -17,6 +17,7 @@
 package runtime
 
 import (
+	"bytes"
 	"fmt"
 	"math/big"
 	"os"
@@ -33,7 +34,12 @@ import (
 	"github.com/probechain/go-probe/core/state"
 	"github.com/probechain/go-probe/core/types"
 	"github.com/probechain/go-probe/core/vm"
+	"github.com/probechain/go-probe/crypto"
 	"github.com/probechain/go-probe/params"
+	"github.com/probechain/go-probe/probe-lang/integration"
+	"github.com/probechain/go-probe/probe-lang/lang/codegen"
+	"github.com/probechain/go-probe/probe-lang/lang/lower"
+	"github.com/probechain/go-probe/probe-lang/lang/parser"
 )
 
 func TestDefaults(t *testing.T) {
@@ -124,6 +130,245 @@ func TestCall(t *testing.T) {
 	}
 }
 
+const probeSource = `
+struct Paid { amount: u64 }
+
+fn pay(balance: u64, amount: u64) -> u64 {
+    require(amount <= balance, "insufficient balance");
+    emit Paid { amount: amount };
+    balance - amount
+}
+
+fn count() -> u64 {
+    storage_store(7, storage_load(7) + 1);
+    storage_load(7)
+}
+`
+
+// compilePROBE compiles PROBE source to bytecode.
+func compilePROBE(t *testing.T, name, source string) *codegen.Bytecode {
+	t.Helper()
+	prog, errs := parser.Parse(name, source)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	irProg, err := lower.Lower(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := codegen.New().Generate(irProg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bc
+}
+
+func TestPROBEContract(t *testing.T) {
+	bc := compilePROBE(t, "pay.probe", probeSource)
+	blob := integration.EncodePROBEContract(bc.Code, bc.Constants)
+
+	// Before the fork PRBE code is plain EVM code and fails to deploy.
+	if _, _, _, err := Create(blob, &Config{}); err == nil {
+		t.Fatal("deployed PROBE contract before the fork")
+	}
+
+	cfg := new(Config)
+	setDefaults(cfg)
+	cfg.ChainConfig.ProbeLangBlock = new(big.Int)
+	code, address, _, err := Create(blob, cfg)
+	if err != nil {
+		t.Fatal("didn't expect error", err)
+	}
+	if !bytes.Equal(code, blob) || !bytes.Equal(cfg.State.GetCode(address), blob) {
+		t.Fatalf("deployed code mismatch")
+	}
+
+	entry := uint32(bc.Functions[0].Offset)
+	ret, _, err := Call(address, integration.EncodeCallData(entry, 10, 4), cfg)
+	if err != nil {
+		t.Fatal("didn't expect error", err)
+	}
+	if num := new(big.Int).SetBytes(ret); num.Cmp(big.NewInt(6)) != 0 {
+		t.Error("Expected 6, got", num)
+	}
+	if logs := cfg.State.Logs(); len(logs) != 1 || logs[0].Address != address {
+		t.Errorf("logs = %v, want one log from %x", logs, address)
+	}
+
+	// Values wider than a PROBE word are rejected rather than dropped.
+	cfg.Value = new(big.Int).Lsh(big.NewInt(1), 64)
+	cfg.State.AddBalance(cfg.Origin, cfg.Value)
+	if _, _, err := Call(address, integration.EncodeCallData(entry, 10, 4), cfg); err != vm.ErrValueOverflow {
+		t.Fatalf("error = %v, want %v", err, vm.ErrValueOverflow)
+	}
+	if balance := cfg.State.GetBalance(address); balance.Sign() != 0 {
+		t.Errorf("contract balance = %v, want 0", balance)
+	}
+	cfg.Value = new(big.Int)
+
+	ret, _, err = Call(address, integration.EncodeCallData(entry, 1, 4), cfg)
+	if err != vm.ErrExecutionReverted {
+		t.Fatalf("error = %v, want %v", err, vm.ErrExecutionReverted)
+	}
+	if reason, err := abi.UnpackRevert(ret); err != nil || reason != "insufficient balance" {
+		t.Errorf("revert reason = %q (%v)", reason, err)
+	}
+
+	// Storage persists in the state between calls.
+	count := bc.Functions[len(bc.Functions)-1]
+	if count.Name != "count" {
+		t.Fatalf("last function is %s, want count", count.Name)
+	}
+	for want := int64(1); want <= 2; want++ {
+		ret, _, err := Call(address, integration.EncodeCallData(uint32(count.Offset)), cfg)
+		if err != nil {
+			t.Fatal("didn't expect error", err)
+		}
+		if num := new(big.Int).SetBytes(ret); num.Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("count = %v, want %d", num, want)
+		}
+	}
+	if slot := cfg.State.GetState(address, common.BigToHash(big.NewInt(7))); slot != common.BigToHash(big.NewInt(2)) {
+		t.Errorf("storage slot 7 = %x, want 2", slot)
+	}
+}
+
+func TestPROBETrace(t *testing.T) {
+	bc := compilePROBE(t, "pay.probe", probeSource)
+	cfg := new(Config)
+	setDefaults(cfg)
+	cfg.ChainConfig.ProbeLangBlock = new(big.Int)
+	_, address, _, err := Create(integration.EncodePROBEContract(bc.Code, bc.Constants), cfg)
+	if err != nil {
+		t.Fatal("didn't expect error", err)
+	}
+
+	tracer := vm.NewStructLogger(&vm.LogConfig{DisableMemory: true})
+	cfg.EVMConfig = vm.Config{Debug: true, Tracer: tracer}
+	ret, leftOver, err := Call(address, integration.EncodeCallData(uint32(bc.Functions[0].Offset), 10, 4), cfg)
+	if err != nil {
+		t.Fatal("didn't expect error", err)
+	}
+	logs := tracer.ProbeLogs()
+	if len(logs) == 0 {
+		t.Fatal("no PROBE steps traced")
+	}
+	if len(tracer.StructLogs()) != 0 {
+		t.Errorf("%d EVM steps traced for a PROBE contract", len(tracer.StructLogs()))
+	}
+	if logs[0].PC != uint32(bc.Functions[0].Offset) || logs[0].Gas != cfg.GasLimit {
+		t.Errorf("first step = %+v, want pc %d gas %d", logs[0].Step, bc.Functions[0].Offset, cfg.GasLimit)
+	}
+	var cost uint64
+	for _, log := range logs {
+		cost += log.Cost
+		if log.Memory != nil || log.Registers == nil {
+			t.Fatalf("step %+v: memory or registers captured against the config", log.Step)
+		}
+	}
+	if cost != cfg.GasLimit-leftOver {
+		t.Errorf("traced gas %d, want %d", cost, cfg.GasLimit-leftOver)
+	}
+	last := logs[len(logs)-1]
+	// The entry function returns its result in R1.
+	if last.Op.String() != "RETURN" || last.Registers[1] != new(big.Int).SetBytes(ret).Uint64() {
+		t.Errorf("last step = %+v, registers %v; want RETURN of %x", last.Step, last.Registers, ret)
+	}
+}
+
+const probeAgentSource = `
+agent Counter {
+    state {
+        count: u64,
+    }
+
+    msg increment(by: u64) {
+        require(by > 0, "zero increment");
+        self.count += by;
+    }
+}
+
+fn start(n: u64) {
+    let c = spawn Counter { count: n };
+    c.increment(2);
+    c.increment(3);
+}
+
+fn broken() {
+    let c = spawn Counter { count: 1 };
+    c.increment(0);
+}
+`
+
+func TestPROBEAgents(t *testing.T) {
+	bc := compilePROBE(t, "agents.probe", probeAgentSource)
+	entries := make(map[string]uint32)
+	for _, f := range bc.Functions {
+		entries[f.Name] = uint32(f.Offset)
+	}
+	cfg := new(Config)
+	setDefaults(cfg)
+	cfg.ChainConfig.ProbeLangBlock = new(big.Int)
+	cfg.BlockNumber = big.NewInt(5)
+	_, address, _, err := Create(integration.EncodePROBEContract(bc.Code, bc.Constants), cfg)
+	if err != nil {
+		t.Fatal("didn't expect error", err)
+	}
+
+	counter := crypto.CreateAddress(address, cfg.State.GetNonce(address))
+	_, leftOver, err := Call(address, integration.EncodeCallData(entries["start"], 10), cfg)
+	if err != nil {
+		t.Fatal("didn't expect error", err)
+	}
+	// Senders prepay the delivery of their messages.
+	if used := cfg.GasLimit - leftOver; used < 2*params.ProbeAgentSendGas {
+		t.Errorf("start used %d gas, want at least %d", used, 2*params.ProbeAgentSendGas)
+	}
+	broken := crypto.CreateAddress(address, cfg.State.GetNonce(address))
+	if _, _, err := Call(address, integration.EncodeCallData(entries["broken"]), cfg); err != nil {
+		t.Fatal("didn't expect error", err)
+	}
+	reg := integration.NewAgentRegistry(cfg.State)
+	if reg.Pending() != 3 {
+		t.Fatalf("%d messages pending, want 3", reg.Pending())
+	}
+	// Messages are not delivered in the block they were sent in.
+	if n := vm.DeliverAgentMessages(NewEnv(cfg)); n != 0 {
+		t.Fatalf("delivered %d messages in the sending block", n)
+	}
+
+	cfg.BlockNumber = big.NewInt(6)
+	if n := vm.DeliverAgentMessages(NewEnv(cfg)); n != 3 {
+		t.Fatalf("delivered %d messages, want 3", n)
+	}
+	for _, tt := range []struct {
+		addr  common.Address
+		count uint64
+		score uint64
+	}{
+		{counter, 15, integration.InitialReputation + 2},
+		{broken, 1, integration.InitialReputation - 10},
+	} {
+		ag, err := reg.Agent(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ag.State) != 1 || ag.State[0] != tt.count {
+			t.Errorf("agent %x state = %v, want [%d]", tt.addr, ag.State, tt.count)
+		}
+		rep, err := reg.GetReputation(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Score != tt.score {
+			t.Errorf("agent %x reputation = %d, want %d", tt.addr, rep.Score, tt.score)
+		}
+	}
+	if reg.Pending() != 0 {
+		t.Errorf("%d messages still pending", reg.Pending())
+	}
+}
+
 func BenchmarkCall(b *testing.B) {
 	var definition = `[{"constant":true,"inputs":[],"name":"seller","outputs":[{"name":"","type":"address"}],"type":"function"},{"constant":false,"inputs":[],"name":"abort","outputs":[],"type":"function"},{"constant":true,"inputs":[],"name":"value","outputs":[{"name":"","type":"uint256"}],"type":"function"},{"constant":false,"inputs":[],"name":"refund","outputs":[],"type":"function"},{"constant":true,"inputs":[],"name":"buyer","outputs":[{"name":"","type":"address"}],"type":"function"},{"constant":false,"inputs":[],"name":"confirmReceived","outputs":[],"type":"function"},{"constant":true,"inputs":[],"name":"state","outputs":[{"name":"","type":"uint8"}],"type":"function"},{"constant":false,"inputs":[],"name":"confirmPurchase","outputs":[],"type":"function"},{"inputs":[],"type":"constructor"},{"anonymous":false,"inputs":[],"name":"Aborted","type":"event"},{"anonymous":false,"inputs":[],"name":"PurchaseConfirmed","type":"event"},{"anonymous":false,"inputs":[],"name":"ItemReceived","type":"event"},{"anonymous":false,"inputs":[],"name":"Refunded","type":"event"}]`
 
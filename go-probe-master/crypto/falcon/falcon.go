@@ -0,0 +1,195 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+// Package falcon implements Falcon-512 signature verification in pure Go.
+//
+// Keys and signatures use the encodings of the Falcon specification: a
+// public key is a header byte followed by 512 coefficients of 14 bits, and
+// a signature is a header byte, a 40-byte nonce and the compressed s2
+// polynomial, optionally zero-padded to MaxSignatureSize.
+package falcon
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	n    = 512
+	logn = 9
+	q    = 12289
+
+	// PublicKeySize is the size of an encoded Falcon-512 public key.
+	PublicKeySize = 1 + n*14/8 // 897
+
+	// NonceSize is the size of the signature nonce.
+	NonceSize = 40
+
+	// MaxSignatureSize is the size of a padded Falcon-512 signature.
+	MaxSignatureSize = 666
+
+	// normBound is the maximum squared norm of (s1, s2).
+	normBound = 34034726
+
+	pubHeader = 0x00 + logn
+	sigHeader = 0x30 + logn
+)
+
+var (
+	errInvalidPublicKey = errors.New("falcon: invalid public key")
+	errInvalidSignature = errors.New("falcon: invalid signature")
+)
+
+// Verify reports whether sig is a valid Falcon-512 signature of msg under
+// the encoded public key pub.
+func Verify(pub, msg, sig []byte) bool {
+	h, err := decodePublicKey(pub)
+	if err != nil {
+		return false
+	}
+	nonce, s2, err := decodeSignature(sig)
+	if err != nil {
+		return false
+	}
+	c := hashToPoint(nonce, msg)
+
+	// s1 = c - s2*h mod (q, x^n + 1), with both halves counted in the norm.
+	var norm int64
+	for i := 0; i < n; i++ {
+		var acc int64
+		for j := 0; j <= i; j++ {
+			acc += int64(s2[j]) * int64(h[i-j])
+		}
+		for j := i + 1; j < n; j++ {
+			acc -= int64(s2[j]) * int64(h[n+i-j])
+		}
+		s1 := (int64(c[i]) - acc) % q
+		if s1 < 0 {
+			s1 += q
+		}
+		if s1 > q/2 {
+			s1 -= q
+		}
+		norm += s1*s1 + int64(s2[i])*int64(s2[i])
+	}
+	return norm <= normBound
+}
+
+// decodePublicKey decodes the 14-bit coefficients of h.
+func decodePublicKey(pub []byte) ([]uint16, error) {
+	if len(pub) != PublicKeySize || pub[0] != pubHeader {
+		return nil, errInvalidPublicKey
+	}
+	h := make([]uint16, n)
+	var acc uint32
+	var bits uint
+	i := 0
+	for _, b := range pub[1:] {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		if bits >= 14 {
+			bits -= 14
+			v := uint16(acc >> bits & 0x3fff)
+			if v >= q {
+				return nil, errInvalidPublicKey
+			}
+			h[i] = v
+			i++
+		}
+	}
+	return h, nil
+}
+
+// decodeSignature splits a signature into its nonce and the decompressed
+// s2 polynomial. Each coefficient is a sign bit, the low 7 bits of its
+// magnitude and the high bits in unary, terminated by a one.
+func decodeSignature(sig []byte) ([]byte, []int16, error) {
+	if len(sig) < 1+NonceSize || len(sig) > MaxSignatureSize || sig[0] != sigHeader {
+		return nil, nil, errInvalidSignature
+	}
+	nonce, data := sig[1:1+NonceSize], sig[1+NonceSize:]
+
+	pos, total := 0, len(data)*8
+	bit := func() (uint, bool) {
+		if pos >= total {
+			return 0, false
+		}
+		b := uint(data[pos>>3]>>(7-pos&7)) & 1
+		pos++
+		return b, true
+	}
+	s2 := make([]int16, n)
+	for i := range s2 {
+		if pos+8 > total {
+			return nil, nil, errInvalidSignature
+		}
+		sign, _ := bit()
+		var v uint
+		for k := 0; k < 7; k++ {
+			b, _ := bit()
+			v = v<<1 | b
+		}
+		for {
+			b, ok := bit()
+			if !ok {
+				return nil, nil, errInvalidSignature
+			}
+			if b == 1 {
+				break
+			}
+			v += 128
+			if v > 2047 {
+				return nil, nil, errInvalidSignature
+			}
+		}
+		// Zero has a single encoding.
+		if sign == 1 && v == 0 {
+			return nil, nil, errInvalidSignature
+		}
+		if sign == 1 {
+			s2[i] = -int16(v)
+		} else {
+			s2[i] = int16(v)
+		}
+	}
+	// The remaining bits are padding and must be zero.
+	for ; pos < total; pos++ {
+		if data[pos>>3]>>(7-pos&7)&1 != 0 {
+			return nil, nil, errInvalidSignature
+		}
+	}
+	return nonce, s2, nil
+}
+
+// hashToPoint hashes the nonce and message to a polynomial with
+// coefficients modulo q, rejecting samples above the largest multiple of q
+// that fits in 16 bits.
+func hashToPoint(nonce, msg []byte) []uint16 {
+	h := sha3.NewShake256()
+	h.Write(nonce)
+	h.Write(msg)
+
+	c := make([]uint16, 0, n)
+	var buf [2]byte
+	for len(c) < n {
+		h.Read(buf[:])
+		if t := uint32(buf[0])<<8 | uint32(buf[1]); t < 5*q {
+			c = append(c, uint16(t%q))
+		}
+	}
+	return c
+}
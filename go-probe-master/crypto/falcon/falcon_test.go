@@ -0,0 +1,127 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package falcon
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+)
+
+// testVector was produced with an independent Falcon-512 signer.
+var testVector = struct {
+	msg, pub, sig []byte
+}{
+	msg: []byte("probechain falcon-512 test vector"),
+	pub: common.FromHex("094ddc6966b8a4e17e95e21b9b549b4838c61933c189285842c5d8ce0d872c780af790f91856f9995a9bbcaf9a98a5fd" +
+		"247480b188c1fa8e9b5ee046c8f8dc2d834ac4c3486e992b4c3041ad1fe827d19bc449cd5f200426383ea735a7612806" +
+		"09a50c5baeddd7a31d4e0c18ec750e408d6b2a56d97b5bc77b9ebff8c9af8c37a0684a4c4a061cce6a79ab26e0874091" +
+		"48b66e218c74c2b1f666df61adc242101351450633398146a6b55e27da25ecb865c43881be5d5f7c8812092e84ce4e72" +
+		"1214b4932bb5dc5a6185168c64c27134100a8137c1fe2a5e6955b70dfce3af5c459e2e1ce3a8a4f3538939606f1f55a4" +
+		"a50d5701e36b615197e3f988d7456c2ff91a4f01a805530b53a3145fa587d16758665c5ad49416a10589511002fde25d" +
+		"88987d2b876bf95e9152d9dc91643f79aa5a3350a9b83096e67ee684b2acad9b5de74c7806fcd8e6ac6c38b299810e5c" +
+		"d6842af962a5062fbe1e2f8b8808775fac2e226e830419440c32705bae5ad8d877a1a37e75aeec23020171579aa0b643" +
+		"e8050962ba64574cec3dcd8d67fe08f36946af9aae4b84afb40fc824167f02a65f9b27ef3e46e600f92e0ca232f43cf7" +
+		"c4e3a6b6467f0ab80f209bbadedbcca8a307d96b4a6c042189d191518cd459aca21307a7dbad07c06526c8003b1565b0" +
+		"61124aae782e1c25002615af0056046fd923529d6668e91d98335e5ee95d10da01c1ed99cadf903ab48649632bc2a93c" +
+		"977b6ea7a17db83a75c266832ad6e02ba16ebe030d2a41c358cd1b29b8eb2385dfbc120b7ab592623738d51283c0691f" +
+		"1d855bc324433bfae4ea8c8706529ea911fec4338da85667caad8b03859fc4c2107c2e5604ab79988790be1f090cc0a8" +
+		"2e96dd6185122ca19d717477ac9faae810012806699ee24c88236cb26102fa1b5f2e0960fd894851c010a4224025b415" +
+		"e9600ecd833c6f4b9f3cde305e6e9e3cfdcca1f0260a8d70b527b5a70ebe4859a79064339dc443920f1b1f9fc5b359d2" +
+		"8e297760b68b20059b1778b3901c992861cef8a1c86427afb93a21e988bd7994533479ef7d093d65589292bd80acbda4" +
+		"3769c728e44ac8b3c02b533a12f12fc44e98ccc9bbaddb1d30f59ce12d06a463b507ea43e5e416d6c2d9a26c8f2175be" +
+		"e303975600441c952b9a6d854ea82b5dce7c4c7ea0699b211605a8ef58eac87bb53c792b8f137daab80949c81a7e2621" +
+		"583bd70dd399d48903efeb9e21223b01f498541e2af4c44244434d6a8640a768f0"),
+	sig: common.FromHex("39b022a5c2cffde436509f7e7a541e20e323b2413916a289d4b30c902caf1d3990338091a8e24e6c53c56c6fbae75762" +
+		"452b7894d2db6e8dc9c632857d81677669e7be75a2500c257d697ff6b8cf0a2e327ca17d665d9f0f5ea8590c3e788294" +
+		"4b6b6c491035a7edcebaa64a3e8b44e339102e2b135d7d61e61eddc8d957dc3f4ac94a6614dcfaa76e362e927b545aeb" +
+		"4c429cf532fc494c71d57ee0ac4b5986d3aedb0dee28870b6308fffde7022bb85364341cfe9cd0569c640ffad5a488ee" +
+		"273707882cdc7613fb406312086b5529f9cd79b56bbd5584f22372d29582c96520fa3f214c23ce89f9d8896a998b852a" +
+		"74522cb1fe14152b769b48a14cb1fc94d0882c72a94268d3683adc822e30a9443fb49e204d9f87209bfee96811127ba8" +
+		"1a02285f52ef863afacb407604e2c9b6625166ea2d2393a60d66db18fee35ed9c6cb0f7aa8ccd48ea20267f7246201a4" +
+		"6324bbed0a552e919bfe0523c08840913e536918676d5333418c65b6ae147dbf7fa15dbb7abb32d3c2f124e4831d5ffc" +
+		"b33485636689fbcf406f15688799c9daca773c365ec66bd2fb658f6750991c5d7f9e56cb9b9c5c4d24a53fed368b3074" +
+		"6037a45be1e16db1b9af3a40ae27d1939a92a9753d7c7699d4f5ded4c79dcdef3bf3cc640547d370d0584b9e8c9efcc1" +
+		"010f13c09a3b5f69957664e56266a91d3dcdc92a687d5679c352a6dc24f51756250fb782254aaaf76c58c2b5f1c6c854" +
+		"f870a42215256a4c8d39ab93c3dcb5b4890b9d0e60e01b621cc8962a694bcfdcf20c1c2c92d3516650f0a6bf792feb66" +
+		"b344941661aa9ed095ef872c6992d3df0a46d8a8f192482224b644ebb3f504ab3ab7c3a7f5d4924def65369986977ead" +
+		"772c899e2ae567a4329c848a29d35d3ab95ba33f5e8ae3d34e921b112270"),
+}
+
+func TestVerify(t *testing.T) {
+	v := testVector
+	if len(v.pub) != PublicKeySize {
+		t.Fatalf("public key size: got %d, want %d", len(v.pub), PublicKeySize)
+	}
+	if !Verify(v.pub, v.msg, v.sig) {
+		t.Fatal("valid signature rejected")
+	}
+
+	// Zero padding up to the maximum size is accepted.
+	padded := make([]byte, MaxSignatureSize)
+	copy(padded, v.sig)
+	if !Verify(v.pub, v.msg, padded) {
+		t.Error("padded signature rejected")
+	}
+
+	// Tamper with message
+	if Verify(v.pub, []byte("tampered"), v.sig) {
+		t.Error("tampered message accepted")
+	}
+
+	// Tamper with nonce
+	badSig := bytes.Clone(v.sig)
+	badSig[1] ^= 0x01
+	if Verify(v.pub, v.msg, badSig) {
+		t.Error("tampered nonce accepted")
+	}
+
+	// Tamper with public key
+	badPub := bytes.Clone(v.pub)
+	badPub[100] ^= 0x10
+	if Verify(badPub, v.msg, v.sig) {
+		t.Error("tampered public key accepted")
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	v := testVector
+	tests := []struct {
+		name     string
+		pub, sig []byte
+	}{
+		{"short key", v.pub[:PublicKeySize-1], v.sig},
+		{"key header", append([]byte{0x0a}, v.pub[1:]...), v.sig},
+		{"signature header", v.pub, append([]byte{0x3a}, v.sig[1:]...)},
+		{"truncated signature", v.pub, v.sig[:len(v.sig)-20]},
+		{"nonce only", v.pub, v.sig[:1+NonceSize]},
+		{"oversized signature", v.pub, append(bytes.Clone(v.sig), make([]byte, MaxSignatureSize)...)},
+		{"nonzero padding", v.pub, append(bytes.Clone(v.sig), 0x01)},
+	}
+	for _, tc := range tests {
+		if Verify(tc.pub, v.msg, tc.sig) {
+			t.Errorf("%s: accepted", tc.name)
+		}
+	}
+	// A coefficient of 12289 or more is not a valid key.
+	badPub := bytes.Clone(v.pub)
+	badPub[1], badPub[2] = 0xff, 0xfc
+	if _, err := decodePublicKey(badPub); err == nil {
+		t.Error("out of range coefficient accepted")
+	}
+}
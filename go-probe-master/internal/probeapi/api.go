@@ -1181,6 +1181,9 @@ type ExecutionResult struct {
 	Failed      bool           `json:"failed"`
 	ReturnValue string         `json:"returnValue"`
 	StructLogs  []StructLogRes `json:"structLogs"`
+
+	// ProbeLogs holds the instructions executed by PROBE contracts.
+	ProbeLogs []ProbeStructLogRes `json:"probeLogs,omitempty"`
 }
 
 // StructLogRes stores a structured log emitted by the EVM while replaying a
@@ -1234,6 +1237,64 @@ func FormatLogs(logs []vm.StructLog) []StructLogRes {
 	return formatted
 }
 
+// ProbeStructLogRes stores a structured log of an instruction executed by a
+// PROBE contract while replaying a transaction in debug mode
+type ProbeStructLogRes struct {
+	Pc        uint32             `json:"pc"`
+	Op        string             `json:"op"`
+	Operands  [3]uint8           `json:"operands"`
+	Gas       uint64             `json:"gas"`
+	GasCost   uint64             `json:"gasCost"`
+	Depth     int                `json:"depth"`
+	CallDepth int                `json:"callDepth"`
+	Error     string             `json:"error,omitempty"`
+	Registers *map[string]string `json:"registers,omitempty"`
+	Memory    *[]string          `json:"memory,omitempty"`
+}
+
+// FormatProbeLogs formats the structured logs of PROBE contracts for json
+// output. Registers are keyed by name and memory is split into 32-byte rows.
+// It returns nil if no PROBE contract ran.
+func FormatProbeLogs(logs []vm.ProbeStructLog) []ProbeStructLogRes {
+	if len(logs) == 0 {
+		return nil
+	}
+	formatted := make([]ProbeStructLogRes, len(logs))
+	for index, trace := range logs {
+		formatted[index] = ProbeStructLogRes{
+			Pc:        trace.PC,
+			Op:        trace.Op.String(),
+			Operands:  [3]uint8{trace.A, trace.B, trace.C},
+			Gas:       trace.Gas,
+			GasCost:   trace.Cost,
+			Depth:     trace.Depth,
+			CallDepth: trace.CallDepth,
+		}
+		if trace.Err != nil {
+			formatted[index].Error = trace.Err.Error()
+		}
+		if trace.Registers != nil {
+			registers := make(map[string]string, len(trace.Registers))
+			for r, v := range trace.Registers {
+				registers[fmt.Sprintf("r%d", r)] = hexutil.EncodeUint64(v)
+			}
+			formatted[index].Registers = &registers
+		}
+		if trace.Memory != nil {
+			memory := make([]string, 0, (len(trace.Memory)+31)/32)
+			for i := 0; i < len(trace.Memory); i += 32 {
+				end := i + 32
+				if end > len(trace.Memory) {
+					end = len(trace.Memory)
+				}
+				memory = append(memory, fmt.Sprintf("%x", trace.Memory[i:end]))
+			}
+			formatted[index].Memory = &memory
+		}
+	}
+	return formatted
+}
+
 // RPCMarshalHeader converts the given header to the RPC output .
 func RPCMarshalHeader(head *types.Header) map[string]interface{} {
 	result := map[string]interface{}{
@@ -48,6 +48,9 @@ func (lprobe *LightProbeum) stateAtTransaction(ctx context.Context, block *types
 	if err != nil {
 		return nil, vm.BlockContext{}, nil, err
 	}
+	// Deliver the agent messages due at the start of the block
+	core.ApplyAgentMessages(lprobe.blockchain.Config(), lprobe.blockchain, nil, statedb, block.Header(), vm.Config{})
+
 	if txIndex == 0 && len(block.Transactions()) == 0 {
 		return nil, vm.BlockContext{}, statedb, nil
 	}
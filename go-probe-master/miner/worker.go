@@ -478,7 +478,7 @@ func (w *worker) sendAck(blockNumber uint64, ackType types.AckType) error {
 		log.Error("somprobeing wrong in produce ack", "blockNumber", blockNumber)
 		return err
 	}
-	ackSig, err := pobEngine.AckSig(ack)
+	ackSig, err := pobEngine.AckSig(w.chain, ack)
 	if err != nil {
 		log.Error("somprobeing wrong in AckSig", "blockNumber", blockNumber)
 		return err
@@ -1214,6 +1214,10 @@ func (w *worker) validatorCommitNewWork(interrupt *int32, noempty bool, currentE
 	log.Info("validatorCommitNewWork", "calc Difficulty :  ", header.Difficulty)
 	header.Coinbase = common.Address{}
 	header.ValidatorAddr = w.coinbase
+	if err := w.engine.Prepare(w.chain, header); err != nil {
+		log.Error("Failed to prepare header for mining", "err", err)
+		return nil
+	}
 
 	// Could potentially happen if starting to mine in an odd state.
 	err := w.makeCurrent(parent, header)
@@ -1221,6 +1225,7 @@ func (w *worker) validatorCommitNewWork(interrupt *int32, noempty bool, currentE
 		log.Error("Failed to create mining context", "err", err)
 		return nil
 	}
+	core.ApplyAgentMessages(w.chainConfig, w.chain, &w.coinbase, w.current.state, header, *w.chain.GetVMConfig())
 
 	answers := w.probe.BlockChain().GetLatestBehaviorProof(parent, realParent.Number(), realParent.Hash())
 	if answers == nil {
@@ -1286,6 +1291,14 @@ func (w *worker) validatorCommitNewWork(interrupt *int32, noempty bool, currentE
 		uint(len(w.current.acks)),
 	}
 	w.current.header.AckCountList = append(w.current.header.AckCountList, &ackCount)
+	if pobEngine, ok := w.engine.(*pob.ProofOfBehavior); ok {
+		signers, err := pobEngine.AckSigners(w.chain, w.current.header, w.current.acks)
+		if err != nil {
+			log.Error("Failed to collect ACK signers", "err", err)
+			return nil
+		}
+		w.current.header.AckSigners = signers
+	}
 
 	// Deep copy receipts here to avoid interaction between different tasks.
 	receipts := copyReceipts(w.current.receipts)
@@ -1293,7 +1306,10 @@ func (w *worker) validatorCommitNewWork(interrupt *int32, noempty bool, currentE
 
 	//finalize seal
 	if pobEngine, ok := w.engine.(*pob.ProofOfBehavior); ok {
-		pobEngine.PobFinalize(w.chain, header, s, w.current.txs, w.current.powAnswerUncles)
+		if err := pobEngine.PobFinalize(w.chain, header, s, w.current.txs, w.current.powAnswerUncles, w.current.acks); err != nil {
+			log.Error("Failed to finalize block", "err", err)
+			return nil
+		}
 	}
 	block := types.ValidatorNewBlock(w.current.header, w.current.txs, w.current.powAnswerUncles, w.current.acks, receipts,
 		trie.NewStackTrie(nil), newBlockType)
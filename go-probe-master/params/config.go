@@ -218,6 +218,10 @@ type ChainConfig struct {
 
 	SuperlightBlock *big.Int `json:"superlightBlock,omitempty"` // Superlight DEX switch block (nil = no fork, 0 = already active)
 
+	ProbeLangBlock *big.Int `json:"probeLangBlock,omitempty"` // PROBE language contracts switch block (nil = no fork, 0 = already active)
+
+	PobBehaviorBlock *big.Int `json:"pobBehaviorBlock,omitempty"` // PoB behavior commitments switch block (nil = no fork, 0 = already active)
+
 	EWASMBlock    *big.Int `json:"ewasmBlock,omitempty"`    // EWASM switch block (nil = no fork, 0 = already activated)
 	CatalystBlock *big.Int `json:"catalystBlock,omitempty"` // Catalyst switch block (nil = no fork, 0 = already on catalyst)
 
@@ -234,13 +238,28 @@ type ChainConfig struct {
 
 // PobConfig is the consensus engine configs for Proof-of-Behavior based sealing.
 type PobConfig struct {
-	Period            uint64             `json:"period"`            // Block period in seconds (0 = StellarSpeed 400ms)
-	TickIntervalMs    uint64             `json:"tickIntervalMs"`    // StellarSpeed tick interval in ms (default 400)
-	Epoch             uint64             `json:"epoch"`             // Epoch length for score checkpoints
-	InitialScore      uint64             `json:"initialScore"`      // Starting score for new validators (default 5000)
-	SlashFraction     uint64             `json:"slashFraction"`     // Slash severity in basis points
-	DemotionThreshold uint64             `json:"demotionThreshold"` // Score below which validator is demoted
-	ValidatorList     []common.Validator `json:"list"`              // Initial validators
+	Period            uint64             `json:"period"`                      // Block period in seconds (0 = StellarSpeed 400ms)
+	TickIntervalMs    uint64             `json:"tickIntervalMs"`              // StellarSpeed tick interval in ms (default 400)
+	Epoch             uint64             `json:"epoch"`                       // Epoch length for score checkpoints
+	InitialScore      uint64             `json:"initialScore"`                // Starting score for new validators (default 5000)
+	SlashFraction     uint64             `json:"slashFraction"`               // Slash severity in basis points
+	DemotionThreshold uint64             `json:"demotionThreshold"`           // Score below which validator is demoted
+	BlockReward       *big.Int           `json:"blockReward,omitempty"`       // Validator reward per block at a perfect score (default 1 PROBE)
+	AckRewardShare    uint64             `json:"ackRewardShare,omitempty"`    // Share of the block reward paid to ACK witnesses in basis points
+	Treasury          common.Address     `json:"treasury,omitempty"`          // Recipient of rewards withheld for imperfect behavior scores
+	SnapshotRetention uint64             `json:"snapshotRetention,omitempty"` // Number of blocks of snapshots kept on disk (default 65536)
+	Scoring           []PobScoringRule   `json:"scoring,omitempty"`           // Behavior scoring rules activated at fork blocks
+	ValidatorList     []common.Validator `json:"list"`                        // Initial validators
+}
+
+// PobScoringRule selects the behavior scoring model and dimension weights used
+// by the PoB engine from a given block onwards. Rules are either scheduled in
+// the chain config or voted in by the validators.
+type PobScoringRule struct {
+	Block   uint64    `json:"block"`           // Block number from which the rule is active
+	Model   string    `json:"model"`           // Scoring model name ("default" or "decayed")
+	Weights [5]uint64 `json:"weights"`         // Dimension weights in percent, summing up to 100
+	Decay   uint64    `json:"decay,omitempty"` // Share of the history retained per epoch in basis points (decayed model only)
 }
 
 // String implements the stringer interface, returning the consensus engine details.
@@ -267,7 +286,20 @@ type SuperlightConfig struct {
 	Enabled       bool    `json:"enabled"`       // Whether Superlight DEX is active
 	MakerFeeBps   uint64  `json:"makerFeeBps"`   // Maker fee in basis points (default 10 = 0.1%)
 	TakerFeeBps   uint64  `json:"takerFeeBps"`   // Taker fee in basis points (default 30 = 0.3%)
-	MaxOrdersPerAccount uint64 `json:"maxOrdersPerAccount"` // Max open orders per account (default 100)
+	MaxOrdersPerAccount uint64 `json:"maxOrdersPerAccount"` // Max open orders per account (default 100, zero = unlimited)
+	FeeCollector  common.Address `json:"feeCollector,omitempty"` // Account credited with trading fees (zero = settlement account)
+
+	SelfTradePrevention string           `json:"selfTradePrevention,omitempty"` // "cancel-newest" (default), "cancel-oldest" or "decrement"
+	Governor            common.Address   `json:"governor,omitempty"`            // Account allowed to list and delist pairs (zero = none)
+	Pairs               []SuperlightPair `json:"pairs,omitempty"`               // Pairs listed from the start
+}
+
+// SuperlightPair lists a trading pair of the Superlight DEX.
+type SuperlightPair struct {
+	BaseAsset  common.Address `json:"baseAsset"`
+	QuoteAsset common.Address `json:"quoteAsset"`
+	TickSize   *big.Int       `json:"tickSize,omitempty"` // Prices must be multiples of the tick size (zero = any)
+	LotSize    *big.Int       `json:"lotSize,omitempty"`  // Amounts must be multiples of the lot size (zero = any)
 }
 
 // String implements the fmt.Stringer interface.
@@ -392,6 +424,18 @@ func (c *ChainConfig) IsSuperlight(num *big.Int) bool {
 	return isForked(c.SuperlightBlock, num)
 }
 
+// IsProbeLang returns whether num is either equal to the PROBE language fork block or greater.
+func (c *ChainConfig) IsProbeLang(num *big.Int) bool {
+	return isForked(c.ProbeLangBlock, num)
+}
+
+// IsPobBehavior returns whether num is either equal to the PoB behavior
+// commitments fork block or greater. From the fork on, headers commit to
+// their ACK signers and checkpoints carry the validator behavior payload.
+func (c *ChainConfig) IsPobBehavior(num *big.Int) bool {
+	return isForked(c.PobBehaviorBlock, num)
+}
+
 // CheckCompatible checks whprobeer scheduled fork transitions have been imported
 // with a mismatching chain configuration.
 func (c *ChainConfig) CheckCompatible(newcfg *ChainConfig, height uint64) *ConfigCompatError {
@@ -436,6 +480,8 @@ func (c *ChainConfig) CheckConfigForkOrder() error {
 		{name: "dilithiumBlock", block: c.DilithiumBlock, optional: true},
 		{name: "stellarSpeedBlock", block: c.StellarSpeedBlock, optional: true},
 		{name: "superlightBlock", block: c.SuperlightBlock, optional: true},
+		{name: "probeLangBlock", block: c.ProbeLangBlock, optional: true},
+		{name: "pobBehaviorBlock", block: c.PobBehaviorBlock, optional: true},
 	} {
 		if lastFork.name != "" {
 			// Next one must be higher number
@@ -514,6 +560,12 @@ func (c *ChainConfig) checkCompatible(newcfg *ChainConfig, head *big.Int) *Confi
 	if isForkIncompatible(c.DilithiumBlock, newcfg.DilithiumBlock, head) {
 		return newCompatError("Dilithium fork block", c.DilithiumBlock, newcfg.DilithiumBlock)
 	}
+	if isForkIncompatible(c.ProbeLangBlock, newcfg.ProbeLangBlock, head) {
+		return newCompatError("PROBE language fork block", c.ProbeLangBlock, newcfg.ProbeLangBlock)
+	}
+	if isForkIncompatible(c.PobBehaviorBlock, newcfg.PobBehaviorBlock, head) {
+		return newCompatError("PoB behavior fork block", c.PobBehaviorBlock, newcfg.PobBehaviorBlock)
+	}
 	return nil
 }
 
@@ -582,7 +634,7 @@ type Rules struct {
 	IsHomestead, IsEIP150, IsEIP155, IsEIP158               bool
 	IsByzantium, IsConstantinople, IsPetersburg, IsIstanbul bool
 	IsBerlin, IsLondon, IsCatalyst, IsShenzhen              bool
-	IsDilithium                                             bool
+	IsDilithium, IsSuperlight, IsProbeLang                  bool
 }
 
 // Rules ensures c's ChainID is not nil.
@@ -606,6 +658,8 @@ func (c *ChainConfig) Rules(num *big.Int) Rules {
 		IsCatalyst:       c.IsCatalyst(num),
 		IsShenzhen:       c.IsShenzhen(num),
 		IsDilithium:      c.IsDilithium(num),
+		IsSuperlight:     c.IsSuperlight(num),
+		IsProbeLang:      c.IsProbeLang(num),
 	}
 }
 
@@ -96,3 +96,19 @@ func TestCheckCompatible(t *testing.T) {
 		}
 	}
 }
+
+// Tests that the Superlight rules follow the fork block rather than the
+// Superlight config switch, so the TWAP precompile activates at the fork.
+func TestRulesSuperlight(t *testing.T) {
+	config := &ChainConfig{ChainID: big.NewInt(1), SuperlightBlock: big.NewInt(10), Superlight: &SuperlightConfig{Enabled: true}}
+	if config.Rules(big.NewInt(9)).IsSuperlight {
+		t.Error("Superlight rules active before the fork block")
+	}
+	if !config.Rules(big.NewInt(10)).IsSuperlight {
+		t.Error("Superlight rules inactive at the fork block")
+	}
+	config = &ChainConfig{ChainID: big.NewInt(1), Superlight: &SuperlightConfig{Enabled: true}}
+	if config.Rules(big.NewInt(10)).IsSuperlight {
+		t.Error("Superlight rules active without a fork block")
+	}
+}
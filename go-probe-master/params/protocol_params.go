@@ -156,6 +156,13 @@ const (
 	// up to half the consumed gas could be refunded. Redefined as 1/5th in EIP-3529
 	RefundQuotient        uint64 = 2
 	RefundQuotientEIP3529 uint64 = 5
+
+	SuperlightOpGas    uint64 = 5000  // Gas charged upfront for every Superlight DEX operation
+	SuperlightTradeGas uint64 = 10000 // Gas charged per order visited while matching a Superlight DEX operation
+
+	ProbeAgentHandlerGas       uint64 = 1000000 // Gas available to a PROBE agent message handler
+	ProbeAgentMessagesPerBlock uint64 = 64      // Maximum number of PROBE agent messages delivered at the start of a block
+	ProbeAgentSendGas          uint64 = 1025000 // Gas prepaid per PROBE agent message sent: the handler gas and five header and queue slots
 )
 
 // Gas discount table for BLS12-381 G1 and G2 multi exponentiation operations
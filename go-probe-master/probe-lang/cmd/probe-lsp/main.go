@@ -0,0 +1,30 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+
+// Command probe-lsp is a Language Server Protocol server for PROBE
+// Language sources.
+//
+// Usage:
+//
+//	probe-lsp
+//
+// The server talks JSON-RPC over stdin and stdout and is started by the
+// editor. It reports parse, type and lowering errors of open .probe files
+// as diagnostics and supports hover types, go-to-definition, document
+// symbols for fn, struct, resource, agent, enum, trait and mod declarations
+// and completion of the chain and crypto standard library modules.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/probechain/go-probe/probe-lang/lsp"
+)
+
+func main() {
+	if err := lsp.NewServer(os.Stdin, os.Stdout).Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "probe-lsp: %v\n", err)
+		os.Exit(1)
+	}
+}
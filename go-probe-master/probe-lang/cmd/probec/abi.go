@@ -0,0 +1,157 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/probechain/go-probe/crypto"
+	"github.com/probechain/go-probe/probe-lang/lang/ast"
+	"github.com/probechain/go-probe/probe-lang/lang/codegen"
+)
+
+// ABI describes a compiled contract: its entry points and the agents it
+// declares, with the metadata needed to call and deploy it.
+type ABI struct {
+	Compiler  string     `json:"compiler"`
+	Source    string     `json:"source"`
+	CodeHash  string     `json:"codeHash"` // keccak256 of the deployable blob
+	CodeSize  int        `json:"codeSize"`
+	Constants int        `json:"constants"`
+	Functions []Function `json:"functions"`
+	Agents    []Agent    `json:"agents,omitempty"`
+}
+
+// Function is a callable entry point. Offset is the byte offset of its
+// first instruction; arguments are passed in R1..Rn and the result is
+// returned in R1.
+type Function struct {
+	Name   string  `json:"name"`
+	Offset int     `json:"offset"`
+	Locals int     `json:"locals"`
+	Inputs []Param `json:"inputs"`
+	Output string  `json:"output,omitempty"`
+}
+
+// Param is a named, typed parameter or field.
+type Param struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Agent describes an agent's state and message handlers. Messages are
+// encoded as [handler index][args...].
+type Agent struct {
+	Name     string    `json:"name"`
+	State    []Param   `json:"state"`
+	Handlers []Handler `json:"handlers"`
+}
+
+// Handler is a message handler of an agent.
+type Handler struct {
+	Index  int     `json:"index"`
+	Name   string  `json:"name"`
+	Inputs []Param `json:"inputs"`
+	Output string  `json:"output,omitempty"`
+}
+
+// JSON returns the indented JSON encoding of the ABI.
+func (a *ABI) JSON() ([]byte, error) {
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// buildABI collects the ABI of a program from its declarations and the
+// function table of the generated bytecode.
+func buildABI(source string, prog *ast.Program, bc *codegen.Bytecode, blob []byte) *ABI {
+	a := &ABI{
+		Compiler:  "probec " + version,
+		Source:    source,
+		CodeHash:  crypto.Keccak256Hash(blob).Hex(),
+		CodeSize:  len(bc.Code),
+		Constants: len(bc.Constants),
+		Functions: []Function{},
+	}
+	entries := make(map[string]codegen.FuncEntry)
+	for _, f := range bc.Functions {
+		entries[f.Name] = f
+	}
+	a.collect(prog.Declarations, "", entries)
+	return a
+}
+
+func (a *ABI) collect(decls []ast.Declaration, module string, entries map[string]codegen.FuncEntry) {
+	qualify := func(name string) string {
+		if module == "" {
+			return name
+		}
+		return module + "::" + name
+	}
+	addFunc := func(name string, params []ast.Param, ret ast.TypeExpr) {
+		entry, ok := entries[name]
+		if !ok {
+			return
+		}
+		a.Functions = append(a.Functions, Function{
+			Name:   name,
+			Offset: entry.Offset,
+			Locals: entry.Locals,
+			Inputs: abiParams(params),
+			Output: typeString(ret),
+		})
+	}
+	for _, decl := range decls {
+		switch d := decl.(type) {
+		case *ast.FnDecl:
+			addFunc(qualify(d.Name), d.Params, d.ReturnType)
+		case *ast.ImplDecl:
+			for _, m := range d.Methods {
+				addFunc(qualify(d.TypeName)+"::"+m.Name, m.Params, m.ReturnType)
+			}
+		case *ast.AgentDecl:
+			ag := Agent{Name: qualify(d.Name), State: []Param{}, Handlers: []Handler{}}
+			if d.State != nil {
+				for _, f := range d.State.Fields {
+					ag.State = append(ag.State, Param{Name: f.Name, Type: typeString(f.Type)})
+				}
+			}
+			for i, h := range d.Handlers {
+				// Handlers take the agent state as an implicit first argument.
+				params := append([]ast.Param{{Name: "self"}}, h.Params...)
+				addFunc(ag.Name+"::"+h.Name, params, h.ReturnType)
+				ag.Handlers = append(ag.Handlers, Handler{
+					Index:  i,
+					Name:   h.Name,
+					Inputs: abiParams(h.Params),
+					Output: typeString(h.ReturnType),
+				})
+			}
+			a.Agents = append(a.Agents, ag)
+		case *ast.ModDecl:
+			a.collect(d.Declarations, qualify(d.Name), entries)
+		}
+	}
+}
+
+func abiParams(params []ast.Param) []Param {
+	out := make([]Param, 0, len(params))
+	for _, p := range params {
+		typ := "self"
+		if p.Type != nil {
+			typ = p.Type.String()
+		}
+		out = append(out, Param{Name: p.Name, Type: typ})
+	}
+	return out
+}
+
+func typeString(t ast.TypeExpr) string {
+	if t == nil {
+		return ""
+	}
+	return t.String()
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/probechain/go-probe/probe-lang/integration"
+	"github.com/probechain/go-probe/probe-lang/lang/parser"
+)
+
+const abiSource = `
+fn add(a: u64, b: u64) -> u64 { a + b }
+
+agent Counter {
+    state { count: u64 }
+    msg increment(by: u64) { self.count += by; }
+    msg get() -> u64 { self.count }
+}
+
+mod math {
+    pub fn double(x: u64) -> u64 { x * 2 }
+}
+`
+
+func TestBuildABI(t *testing.T) {
+	prog, errs := parser.Parse("abi.probe", abiSource)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	bc := generate(lowerProgram(prog, true), true)
+	blob := integration.EncodePROBEContract(bc.Code, bc.Constants)
+	abi := buildABI("abi.probe", prog, bc, blob)
+
+	names := make(map[string]Function)
+	for _, f := range abi.Functions {
+		names[f.Name] = f
+	}
+	for _, name := range []string{"add", "Counter::increment", "Counter::get", "math::double"} {
+		if _, ok := names[name]; !ok {
+			t.Errorf("function %s missing from ABI", name)
+		}
+	}
+	if add := names["add"]; len(add.Inputs) != 2 || add.Output != "u64" {
+		t.Errorf("add = %+v", add)
+	}
+	if len(abi.Agents) != 1 || len(abi.Agents[0].Handlers) != 2 || abi.Agents[0].Handlers[1].Name != "get" {
+		t.Fatalf("agents = %+v", abi.Agents)
+	}
+	if abi.Agents[0].Handlers[1].Index != 1 {
+		t.Errorf("get handler index = %d, want 1", abi.Agents[0].Handlers[1].Index)
+	}
+	if _, err := abi.JSON(); err != nil {
+		t.Fatal(err)
+	}
+
+	contract, err := integration.DecodePROBEContract(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contract.Code) != abi.CodeSize || len(contract.Constants) != abi.Constants {
+		t.Errorf("blob does not round-trip: %d/%d code bytes, %d/%d constants",
+			len(contract.Code), abi.CodeSize, len(contract.Constants), abi.Constants)
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/probechain/go-probe/probe-lang/lang/codegen"
+	"github.com/probechain/go-probe/probe-lang/lang/vm"
+)
+
+const debugUsage = "usage: probec debug [flags] <source.probe> [args...]"
+
+const debugHelp = `commands:
+  s, step [n]        execute n instructions (default 1)
+  n, next            run to the next source line in the current function
+  c, continue        run to the next breakpoint or the end
+  b, break <loc>     set a breakpoint at a line, a function or @instruction
+  b, break           list breakpoints
+  clear              delete all breakpoints
+  r, regs            print the non-zero registers
+  m, mem <addr> [n]  print n memory words from addr (default 4)
+  l, list            print the source around the current line
+  w, where           print the current location
+  q, quit            stop debugging`
+
+// runDebug implements "probec debug": it compiles a source file and runs
+// one of its functions under a debugger reading commands from in, or prints
+// every executed instruction with -trace.
+func runDebug(args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("debug", flag.ContinueOnError)
+	var (
+		entry    = fs.String("entry", "main", "Function to run")
+		gas      = fs.Uint64("gas", 10_000_000, "Gas limit")
+		optimize = fs.Bool("optimize", false, "Enable optimization passes")
+		trace    = fs.Bool("trace", false, "Print every executed instruction instead of debugging")
+	)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New(debugUsage)
+	}
+	filename := fs.Arg(0)
+	source, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var callArgs []uint64
+	for _, arg := range fs.Args()[1:] {
+		v, err := strconv.ParseUint(arg, 0, 64)
+		if err != nil {
+			return fmt.Errorf("invalid argument %q: %v", arg, err)
+		}
+		callArgs = append(callArgs, v)
+	}
+
+	bc := generate(lowerProgram(parse(filename, string(source)), *optimize), true)
+	d, err := newDebugger(bc, string(source), *entry, *gas, callArgs, out)
+	if err != nil {
+		return err
+	}
+	if *trace {
+		d.machine.SetTracer(d)
+		d.cont()
+		return nil
+	}
+	d.where()
+	d.repl(in)
+	return nil
+}
+
+// debugger single-steps a function of compiled bytecode, mapping
+// instructions back to source lines.
+type debugger struct {
+	bc      *codegen.Bytecode
+	source  []string
+	machine *vm.VM
+	out     io.Writer
+	breaks  map[uint32]bool // breakpoints by byte offset
+	done    bool            // execution halted or failed
+}
+
+func newDebugger(bc *codegen.Bytecode, source, entry string, gas uint64, args []uint64, out io.Writer) (*debugger, error) {
+	d := &debugger{
+		bc:      bc,
+		source:  strings.Split(source, "\n"),
+		machine: vm.New(bc.Code, bc.Constants, gas, nil),
+		out:     out,
+		breaks:  make(map[uint32]bool),
+	}
+	for _, f := range bc.Functions {
+		if f.Name == entry {
+			d.machine.Enter(uint32(f.Offset), args...)
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("function %s not found", entry)
+}
+
+// repl reads and executes commands until the input ends or quit.
+func (d *debugger) repl(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(d.out, "(probe) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(d.out)
+			return
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if d.command(fields[0], fields[1:]) {
+			return
+		}
+	}
+}
+
+// command executes a debugger command and reports whether to quit.
+func (d *debugger) command(cmd string, args []string) bool {
+	switch cmd {
+	case "s", "step", "n", "next", "c", "continue":
+		if d.done {
+			fmt.Fprintln(d.out, "the program has finished")
+			return false
+		}
+	}
+	switch cmd {
+	case "s", "step":
+		n := 1
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+				fmt.Fprintf(d.out, "invalid count %q\n", args[0])
+				return false
+			}
+		}
+		for i := 0; i < n && !d.done; i++ {
+			d.step()
+		}
+		d.where()
+	case "n", "next":
+		d.next()
+	case "c", "continue":
+		d.cont()
+	case "b", "break":
+		if len(args) == 0 {
+			d.listBreaks()
+		} else {
+			d.setBreak(args[0])
+		}
+	case "clear":
+		d.breaks = make(map[uint32]bool)
+	case "r", "regs":
+		d.regs()
+	case "m", "mem":
+		d.mem(args)
+	case "l", "list":
+		d.list()
+	case "w", "where":
+		d.where()
+	case "q", "quit":
+		return true
+	case "h", "help":
+		fmt.Fprintln(d.out, debugHelp)
+	default:
+		fmt.Fprintf(d.out, "unknown command %q, try help\n", cmd)
+	}
+	return false
+}
+
+// step executes one instruction.
+func (d *debugger) step() {
+	if d.done {
+		return
+	}
+	if err := d.machine.Step(); err != nil {
+		d.done = true
+		fmt.Fprintf(d.out, "error: %v (gas used %d)\n", err, d.machine.GasUsed())
+		return
+	}
+	if d.machine.Halted() {
+		d.done = true
+		fmt.Fprintf(d.out, "halted: result %d, gas used %d\n", d.machine.Register(1), d.machine.GasUsed())
+	}
+}
+
+// next runs until execution reaches another source line without being in a
+// function called from the current one.
+func (d *debugger) next() {
+	line, depth := d.bc.Line(int(d.machine.PC())), d.machine.CallDepth()
+	for !d.done {
+		d.step()
+		pc := d.machine.PC()
+		if d.breaks[pc] {
+			break
+		}
+		if d.machine.CallDepth() <= depth && d.bc.Line(int(pc)) != line {
+			break
+		}
+	}
+	d.where()
+}
+
+// cont runs until a breakpoint or the end of execution.
+func (d *debugger) cont() {
+	for !d.done {
+		d.step()
+		if d.breaks[d.machine.PC()] && !d.done {
+			fmt.Fprintln(d.out, "breakpoint")
+			break
+		}
+	}
+	d.where()
+}
+
+// setBreak sets breakpoints at a source line, the entry of a function or an
+// instruction index prefixed with @.
+func (d *debugger) setBreak(loc string) {
+	var offsets []uint32
+	switch {
+	case strings.HasPrefix(loc, "@"):
+		idx, err := strconv.Atoi(loc[1:])
+		if err != nil || idx < 0 || 4*idx >= len(d.bc.Code) {
+			fmt.Fprintf(d.out, "invalid instruction %q\n", loc)
+			return
+		}
+		offsets = append(offsets, uint32(4*idx))
+	case loc[0] >= '0' && loc[0] <= '9':
+		line, err := strconv.Atoi(loc)
+		if err != nil {
+			fmt.Fprintf(d.out, "invalid line %q\n", loc)
+			return
+		}
+		for _, e := range d.bc.Lines {
+			if e.Line == line {
+				offsets = append(offsets, uint32(e.Offset))
+			}
+		}
+		if len(offsets) == 0 {
+			fmt.Fprintf(d.out, "no code for line %d\n", line)
+			return
+		}
+	default:
+		for _, f := range d.bc.Functions {
+			if f.Name == loc {
+				offsets = append(offsets, uint32(f.Offset))
+			}
+		}
+		if len(offsets) == 0 {
+			fmt.Fprintf(d.out, "no function %s\n", loc)
+			return
+		}
+	}
+	for _, pc := range offsets {
+		d.breaks[pc] = true
+		fmt.Fprintf(d.out, "breakpoint at %s\n", d.location(pc))
+	}
+}
+
+func (d *debugger) listBreaks() {
+	pcs := make([]uint32, 0, len(d.breaks))
+	for pc := range d.breaks {
+		pcs = append(pcs, pc)
+	}
+	sort.Slice(pcs, func(i, j int) bool { return pcs[i] < pcs[j] })
+	for _, pc := range pcs {
+		fmt.Fprintln(d.out, d.location(pc))
+	}
+}
+
+// location describes byte offset pc as its instruction index, function and
+// source line.
+func (d *debugger) location(pc uint32) string {
+	fn := "?"
+	for _, f := range d.bc.Functions {
+		if f.Offset <= int(pc) {
+			fn = f.Name
+		}
+	}
+	loc := fmt.Sprintf("[%04d] %s", pc/4, fn)
+	if line := d.bc.Line(int(pc)); line > 0 {
+		loc += fmt.Sprintf(":%d", line)
+	}
+	return loc
+}
+
+// where prints the next instruction and its source line.
+func (d *debugger) where() {
+	if d.done {
+		return
+	}
+	pc := d.machine.PC()
+	fmt.Fprintf(d.out, "%s  %s\n", d.location(pc), strings.TrimSpace(vm.DisassembleInstruction(d.bc.Code, pc)))
+	if line := d.bc.Line(int(pc)); line > 0 && line <= len(d.source) {
+		fmt.Fprintf(d.out, "%5d | %s\n", line, d.source[line-1])
+	}
+}
+
+func (d *debugger) regs() {
+	for i := 1; i < 256; i++ {
+		if v := d.machine.Register(uint8(i)); v != 0 {
+			fmt.Fprintf(d.out, "R%-3d = %d (%#x)\n", i, v, v)
+		}
+	}
+}
+
+func (d *debugger) mem(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(d.out, "usage: mem <addr> [words]")
+		return
+	}
+	addr, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil {
+		fmt.Fprintf(d.out, "invalid address %q\n", args[0])
+		return
+	}
+	n := uint64(4)
+	if len(args) > 1 {
+		if n, err = strconv.ParseUint(args[1], 0, 64); err != nil {
+			fmt.Fprintf(d.out, "invalid count %q\n", args[1])
+			return
+		}
+	}
+	for i := uint64(0); i < n; i++ {
+		v, err := d.machine.Memory().ReadUint64(addr + 8*i)
+		if err != nil {
+			fmt.Fprintf(d.out, "%#x: %v\n", addr+8*i, err)
+			return
+		}
+		fmt.Fprintf(d.out, "%#x: %d (%#x)\n", addr+8*i, v, v)
+	}
+}
+
+// list prints the source lines around the current one.
+func (d *debugger) list() {
+	line := d.bc.Line(int(d.machine.PC()))
+	if line == 0 {
+		fmt.Fprintln(d.out, "no source line")
+		return
+	}
+	for l := line - 3; l <= line+3; l++ {
+		if l < 1 || l > len(d.source) {
+			continue
+		}
+		marker := "  "
+		if l == line {
+			marker = "=>"
+		}
+		fmt.Fprintf(d.out, "%s%4d | %s\n", marker, l, d.source[l-1])
+	}
+}
+
+// CaptureStep implements vm.Tracer for -trace, printing each instruction.
+func (d *debugger) CaptureStep(v *vm.VM, step *vm.Step) {
+	loc := d.location(step.PC)
+	instr := strings.TrimSpace(vm.DisassembleInstruction(d.bc.Code, step.PC))
+	fmt.Fprintf(d.out, "%-24s %-32s gas=%d cost=%d", loc, instr, step.Gas, step.Cost)
+	if step.Err != nil {
+		fmt.Fprintf(d.out, " error=%v", step.Err)
+	}
+	fmt.Fprintln(d.out)
+}
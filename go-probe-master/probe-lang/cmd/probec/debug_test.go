@@ -0,0 +1,77 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const debugSource = `fn square(x: u64) -> u64 {
+    x * x
+}
+
+fn main(a: u64, b: u64) -> u64 {
+    let s = square(a);
+    let t = s + b;
+    t * 2
+}
+`
+
+func debugSession(t *testing.T, commands string, args ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "debug.probe")
+	if err := os.WriteFile(path, []byte(debugSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	args = append(args[:len(args):len(args)], path, "3", "4")
+	if err := runDebug(args, strings.NewReader(commands), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestDebugger(t *testing.T) {
+	out := debugSession(t, "b square\nb 7\nc\nr\nn\nc\nc\nc\nq\n")
+	for _, want := range []string{
+		"main:6  PUSH",                     // initial location
+		"    6 |     let s = square(a);",   // with its source line
+		"breakpoint at [0000] square:2",    // function breakpoint
+		"breakpoint at [0004] main:7",      // line breakpoint
+		"breakpoint\n[0000] square:2  MUL", // first continue
+		"R1   = 3 (0x3)",                   // argument in R1
+		"[0004] main:7  ADD",               // next steps out of square
+		"halted: result 26, gas used 37",   // 2 * (3*3 + 4)
+		"the program has finished",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	// next stops on line 7 already, so the second continue runs to the end.
+	if n := strings.Count(out, "breakpoint\n"); n != 1 {
+		t.Errorf("stopped at %d breakpoints, want 1:\n%s", n, out)
+	}
+}
+
+func TestDebuggerTrace(t *testing.T) {
+	out := debugSession(t, "", "-trace")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 9 {
+		t.Fatalf("trace has %d lines, want 8 steps and the result:\n%s", len(lines), out)
+	}
+	if !strings.HasPrefix(lines[2], "[0000] square:2") || !strings.Contains(lines[2], "MUL") {
+		t.Errorf("third step = %q, want the MUL in square", lines[2])
+	}
+	if !strings.Contains(lines[0], "gas=10000000 cost=1") {
+		t.Errorf("first step = %q", lines[0])
+	}
+	if lines[8] != "halted: result 26, gas used 37" {
+		t.Errorf("last line = %q", lines[8])
+	}
+}
@@ -9,27 +9,67 @@
 //
 // Flags:
 //
-//	-o <output>    Output file (default: stdout)
-//	-emit <stage>  Emit intermediate output: tokens, ast, ir, bytecode (default: bytecode)
-//	-optimize      Enable optimization passes (default: true)
-//	-verify        Run bytecode verifier (default: true)
-//	-version       Print version and exit
+//	-o <output>      Output file (default: stdout)
+//	-emit <stage>    Emit stage: tokens, ast, ir, asm, bytecode (default: bytecode)
+//	-format <fmt>    Bytecode output format: hex or bin (default: hex)
+//	-abi <file>      Write the ABI/metadata JSON to file (default: next to -o)
+//	-optimize        Enable optimization passes (default: true)
+//	-verify          Run bytecode verifier (default: true)
+//	-version         Print version and exit
+//
+// The bytecode stage writes a deployable contract blob: the PRBE magic,
+// the constant pool and the code, as encoded by
+// integration.EncodePROBEContract.
+//
+// Debugging:
+//
+//	probec debug [flags] <source.probe> [args...]
+//
+// compiles the source and runs a function with the given arguments under an
+// interactive debugger that single-steps instructions, stops at breakpoints
+// on source lines, functions or instructions and prints registers and
+// memory. Type help at the prompt for the commands.
+//
+//	-entry <name>    Function to run (default: main)
+//	-gas <limit>     Gas limit (default: 10000000)
+//	-optimize        Enable optimization passes (default: false)
+//	-trace           Print every executed instruction instead of debugging
 package main
 
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/probechain/go-probe/common/hexutil"
+	"github.com/probechain/go-probe/probe-lang/integration"
+	"github.com/probechain/go-probe/probe-lang/lang/ast"
+	"github.com/probechain/go-probe/probe-lang/lang/codegen"
+	"github.com/probechain/go-probe/probe-lang/lang/ir"
 	"github.com/probechain/go-probe/probe-lang/lang/lexer"
+	"github.com/probechain/go-probe/probe-lang/lang/lower"
+	"github.com/probechain/go-probe/probe-lang/lang/parser"
+	"github.com/probechain/go-probe/probe-lang/lang/types"
+	"github.com/probechain/go-probe/probe-lang/lang/vm"
 )
 
 const version = "0.1.0"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "debug" {
+		if err := runDebug(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			fatalf("%v", err)
+		}
+		return
+	}
 	var (
 		output   = flag.String("o", "", "Output file (default: stdout)")
-		emit     = flag.String("emit", "bytecode", "Emit stage: tokens, ast, ir, bytecode")
+		emit     = flag.String("emit", "bytecode", "Emit stage: tokens, ast, ir, asm, bytecode")
+		format   = flag.String("format", "hex", "Bytecode output format: hex, bin")
+		abiFile  = flag.String("abi", "", "ABI/metadata JSON output file (default: next to -o)")
 		optimize = flag.Bool("optimize", true, "Enable optimization passes")
 		verify   = flag.Bool("verify", true, "Run bytecode verifier")
 		ver      = flag.Bool("version", false, "Print version and exit")
@@ -45,35 +85,138 @@ func main() {
 		fmt.Fprintln(os.Stderr, "usage: probec [flags] <source.probe>")
 		os.Exit(1)
 	}
+	if *format != "hex" && *format != "bin" {
+		fatalf("unknown bytecode format: %s", *format)
+	}
 
 	filename := flag.Arg(0)
 	source, err := os.ReadFile(filename)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+		fatalf("%v", err)
 	}
 
-	// Suppress unused variable warnings for flags we'll use in later phases.
-	_ = output
-	_ = optimize
-	_ = verify
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		defer f.Close()
+		out = f
+	}
 
 	switch *emit {
 	case "tokens":
-		emitTokens(filename, string(source))
-	case "ast", "ir", "bytecode":
-		fmt.Fprintf(os.Stderr, "emit stage %q not yet implemented\n", *emit)
-		os.Exit(1)
+		emitTokens(out, filename, string(source))
+	case "ast":
+		prog := parse(filename, string(source))
+		fmt.Fprint(out, prog)
+	case "ir":
+		irProg := lowerProgram(parse(filename, string(source)), *optimize)
+		fmt.Fprint(out, irProg)
+	case "asm", "bytecode":
+		prog := parse(filename, string(source))
+		bc := generate(lowerProgram(prog, *optimize), *verify)
+		if *emit == "asm" {
+			emitAsm(out, bc)
+			break
+		}
+		blob := integration.EncodePROBEContract(bc.Code, bc.Constants)
+		if *format == "bin" {
+			_, err = out.Write(blob)
+		} else {
+			_, err = fmt.Fprintln(out, hexutil.Encode(blob))
+		}
+		if err != nil {
+			fatalf("%v", err)
+		}
+		path := *abiFile
+		if path == "" && *output != "" {
+			path = strings.TrimSuffix(*output, filepath.Ext(*output)) + ".abi.json"
+		}
+		if path != "" {
+			data, err := buildABI(filename, prog, bc, blob).JSON()
+			if err != nil {
+				fatalf("%v", err)
+			}
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				fatalf("%v", err)
+			}
+		}
 	default:
-		fmt.Fprintf(os.Stderr, "unknown emit stage: %s\n", *emit)
-		os.Exit(1)
+		fatalf("unknown emit stage: %s", *emit)
 	}
 }
 
-func emitTokens(filename, source string) {
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func emitTokens(out io.Writer, filename, source string) {
 	l := lexer.New(filename, source)
 	tokens := l.Tokenize()
 	for _, tok := range tokens {
-		fmt.Printf("%s\t%s\t%q\n", tok.Pos, tok.Type, tok.Literal)
+		fmt.Fprintf(out, "%s\t%s\t%q\n", tok.Pos, tok.Type, tok.Literal)
+	}
+}
+
+// parse parses source, exiting with the parse errors if there are any.
+func parse(filename, source string) *ast.Program {
+	prog, errs := parser.Parse(filename, source)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+	return prog
+}
+
+// lowerProgram type-checks and lowers a program to IR, exiting with the
+// diagnostics if it is invalid.
+func lowerProgram(prog *ast.Program, optimize bool) *ir.Program {
+	irProg, err := lower.Lower(prog)
+	if err != nil {
+		if diags, ok := err.(types.Diagnostics); ok {
+			for _, d := range diags {
+				fmt.Fprintln(os.Stderr, d)
+			}
+			os.Exit(1)
+		}
+		fatalf("%v", err)
+	}
+	if optimize {
+		ir.Optimize(irProg)
+	}
+	return irProg
+}
+
+// generate compiles IR to bytecode and optionally verifies it.
+func generate(irProg *ir.Program, verify bool) *codegen.Bytecode {
+	bc, err := codegen.New().Generate(irProg)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if verify {
+		if errs := codegen.Verify(bc); len(errs) > 0 {
+			for i := range errs {
+				fmt.Fprintln(os.Stderr, errs[i].Error())
+			}
+			os.Exit(1)
+		}
+	}
+	return bc
+}
+
+// emitAsm writes the constant pool, the function table and a disassembly
+// of the code.
+func emitAsm(out io.Writer, bc *codegen.Bytecode) {
+	for i, c := range bc.Constants {
+		fmt.Fprintf(out, "; $%d = %#x\n", i, c)
+	}
+	for _, f := range bc.Functions {
+		fmt.Fprintf(out, "; %s @ [%04d] locals=%d\n", f.Name, f.Offset/4, f.Locals)
 	}
+	fmt.Fprint(out, vm.Disassemble(bc.Code))
 }
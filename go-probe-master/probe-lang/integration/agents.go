@@ -0,0 +1,466 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+
+package integration
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/crypto"
+	"github.com/probechain/go-probe/probe-lang/stdlib/agent"
+)
+
+var (
+	// ErrAgentNotFound is returned for an address that is not a registered agent.
+	ErrAgentNotFound = errors.New("agent not found")
+
+	// ErrAgentExists is returned when registering an address twice.
+	ErrAgentExists = errors.New("agent already registered")
+
+	// ErrTooManyMessages is returned when sending a message from an account
+	// with MaxPendingMessages messages awaiting delivery.
+	ErrTooManyMessages = errors.New("too many pending agent messages")
+
+	// AgentRegistryAddress is the account holding the agent registry and the
+	// message queue in its storage. It is in the reserved address range, so
+	// transactions cannot send value to it.
+	AgentRegistryAddress = common.HexToAddress("0x000000000000000000000000000000000000011b")
+)
+
+const (
+	// InitialReputation is the score of a newly registered agent.
+	InitialReputation = 500
+
+	// MaxReputation is the highest reputation score.
+	MaxReputation = 1000
+
+	// MaxPendingMessages is the number of undelivered messages an account
+	// may have queued.
+	MaxPendingMessages = 16
+)
+
+// AgentStateDB is the part of the state database the agent registry uses.
+type AgentStateDB interface {
+	Exist(common.Address) bool
+	CreateContractAccount(common.Address)
+
+	GetNonce(common.Address) uint64
+	SetNonce(common.Address, uint64)
+
+	GetState(common.Address, common.Hash) common.Hash
+	SetState(common.Address, common.Hash, common.Hash)
+}
+
+// The registry is kept in the storage of AgentRegistryAddress. Byte strings
+// are stored as a length slot followed by 32-byte chunks at keccak(slot)+i.
+//
+//	agent record (base keccak(agentPrefix, address)):
+//	  0: owner contract
+//	  1: dispatcher entry (8) | state length (8)
+//	  2+i: state word i
+//
+//	identity (base keccak(identityPrefix, address)):
+//	  0: registered (8) | version (8) | created at (8)
+//	  1: name
+//	  2: public key
+//
+//	reputation (base keccak(reputationPrefix, address)):
+//	  0: score (8) | total tasks (8) | successful tasks (8) | slashes (8)
+//
+//	capability (base keccak(capabilityPrefix, address, name)):
+//	  0: advertised (8) | cost (8)
+//	  1: version
+//	  2: description
+//
+//	capability index (base keccak(capabilityIndexPrefix, name)):
+//	  0: number of agents
+//	  keccak(base)+i: address of the i-th agent
+//
+//	message (base keccak(messagePrefix, sequence)):
+//	  0: sender
+//	  1: recipient
+//	  2: block number (8) | length (8)
+//	  3+i: message word i
+//
+//	pending messages (keccak(pendingPrefix, sender)):
+//	  number of undelivered messages of the sender
+//
+// Messages are delivered in the order they were sent: queueHeadKey holds the
+// sequence number of the oldest undelivered message, queueTailKey that of
+// the next message to be sent.
+var (
+	queueHeadKey          = crypto.Keccak256Hash([]byte("probe-agent-queue-head"))
+	queueTailKey          = crypto.Keccak256Hash([]byte("probe-agent-queue-tail"))
+	agentPrefix           = []byte("probe-agent")
+	identityPrefix        = []byte("probe-agent-identity")
+	reputationPrefix      = []byte("probe-agent-reputation")
+	capabilityPrefix      = []byte("probe-agent-capability")
+	capabilityIndexPrefix = []byte("probe-agent-capability-index")
+	messagePrefix         = []byte("probe-agent-message")
+	pendingPrefix         = []byte("probe-agent-pending")
+)
+
+// AgentRecord is a spawned agent: the contract whose code handles its
+// messages, the offset of its dispatcher in that code and its state.
+type AgentRecord struct {
+	Address common.Address
+	Owner   common.Address
+	Entry   uint64
+	State   []uint64
+}
+
+// AgentMessage is a message queued for an agent.
+type AgentMessage struct {
+	Seq   uint64
+	From  common.Address
+	To    common.Address
+	Block uint64 // block the message was sent in
+	Data  []uint64
+}
+
+// AgentRegistry keeps PROBE agents, their identities and reputation and the
+// messages sent to them in the state. It implements agent.Registry.
+type AgentRegistry struct {
+	db AgentStateDB
+}
+
+var _ agent.Registry = (*AgentRegistry)(nil)
+
+// NewAgentRegistry returns the agent registry stored in db.
+func NewAgentRegistry(db AgentStateDB) *AgentRegistry {
+	return &AgentRegistry{db: db}
+}
+
+// Spawn creates an agent owned by the contract at owner with the given
+// dispatcher entry and initial state, and registers its identity. The agent
+// address is derived from the owner and its nonce, as for contract creation,
+// and the agent gets an account of its own for its balance and storage.
+func (r *AgentRegistry) Spawn(owner common.Address, entry uint64, state []uint64, block uint64) (common.Address, error) {
+	nonce := r.db.GetNonce(owner)
+	addr := crypto.CreateAddress(owner, nonce)
+	if r.db.Exist(addr) {
+		return common.Address{}, fmt.Errorf("%w: %x", ErrAgentExists, addr)
+	}
+	r.db.SetNonce(owner, nonce+1)
+	r.db.CreateContractAccount(addr)
+	if err := r.Register(agent.Identity{Address: addr, CreatedAt: block}); err != nil {
+		return common.Address{}, err
+	}
+	base := crypto.Keccak256Hash(agentPrefix, addr.Bytes())
+	r.set(slotAt(base, 0), common.BytesToHash(owner.Bytes()))
+	r.writeState(addr, entry, state)
+	return addr, nil
+}
+
+// Agent returns the record of the agent at addr.
+func (r *AgentRegistry) Agent(addr common.Address) (*AgentRecord, error) {
+	base := crypto.Keccak256Hash(agentPrefix, addr.Bytes())
+	owner := r.get(slotAt(base, 0))
+	if owner == (common.Hash{}) {
+		return nil, fmt.Errorf("%w: %x", ErrAgentNotFound, addr)
+	}
+	header := r.get(slotAt(base, 1))
+	rec := &AgentRecord{
+		Address: addr,
+		Owner:   common.BytesToAddress(owner.Bytes()),
+		Entry:   binary.BigEndian.Uint64(header[0:]),
+		State:   make([]uint64, binary.BigEndian.Uint64(header[8:])),
+	}
+	for i := range rec.State {
+		rec.State[i] = r.getUint64(slotAt(base, uint64(2+i)))
+	}
+	return rec, nil
+}
+
+// SetAgentState replaces the state of the agent at addr. The state keeps
+// the size it was spawned with.
+func (r *AgentRegistry) SetAgentState(addr common.Address, state []uint64) error {
+	rec, err := r.Agent(addr)
+	if err != nil {
+		return err
+	}
+	if len(state) != len(rec.State) {
+		return fmt.Errorf("agent %x: state has %d words, want %d", addr, len(state), len(rec.State))
+	}
+	r.writeState(addr, rec.Entry, state)
+	return nil
+}
+
+// writeState writes the dispatcher entry and state of an agent.
+func (r *AgentRegistry) writeState(addr common.Address, entry uint64, state []uint64) {
+	base := crypto.Keccak256Hash(agentPrefix, addr.Bytes())
+	var header common.Hash
+	binary.BigEndian.PutUint64(header[0:], entry)
+	binary.BigEndian.PutUint64(header[8:], uint64(len(state)))
+	r.set(slotAt(base, 1), header)
+	for i, w := range state {
+		r.setUint64(slotAt(base, uint64(2+i)), w)
+	}
+}
+
+// Send queues a message from one account to the agent at to, sent in the
+// given block. It writes 5+len(msg) slots: the message, the queue tail and
+// the number of pending messages of the sender, which is capped at
+// MaxPendingMessages.
+func (r *AgentRegistry) Send(from, to common.Address, msg []uint64, block uint64) error {
+	if _, err := r.Agent(to); err != nil {
+		return err
+	}
+	pendingKey := crypto.Keccak256Hash(pendingPrefix, from.Bytes())
+	pending := r.getUint64(pendingKey)
+	if pending >= MaxPendingMessages {
+		return fmt.Errorf("%w: %x", ErrTooManyMessages, from)
+	}
+	r.setUint64(pendingKey, pending+1)
+
+	seq := r.getUint64(queueTailKey)
+	base := messageBase(seq)
+	r.set(slotAt(base, 0), common.BytesToHash(from.Bytes()))
+	r.set(slotAt(base, 1), common.BytesToHash(to.Bytes()))
+	var header common.Hash
+	binary.BigEndian.PutUint64(header[0:], block)
+	binary.BigEndian.PutUint64(header[8:], uint64(len(msg)))
+	r.set(slotAt(base, 2), header)
+	for i, w := range msg {
+		r.setUint64(slotAt(base, uint64(3+i)), w)
+	}
+	r.setUint64(queueTailKey, seq+1)
+	return nil
+}
+
+// Pending returns the number of queued messages.
+func (r *AgentRegistry) Pending() uint64 {
+	return r.getUint64(queueTailKey) - r.getUint64(queueHeadKey)
+}
+
+// NextMessage removes and returns the oldest queued message if it was sent
+// before the given block. Messages are only delivered in a later block than
+// the one they were sent in, in the order they were sent.
+func (r *AgentRegistry) NextMessage(block uint64) (*AgentMessage, bool) {
+	seq := r.getUint64(queueHeadKey)
+	if seq == r.getUint64(queueTailKey) {
+		return nil, false
+	}
+	base := messageBase(seq)
+	header := r.get(slotAt(base, 2))
+	msg := &AgentMessage{
+		Seq:   seq,
+		From:  common.BytesToAddress(r.get(slotAt(base, 0)).Bytes()),
+		To:    common.BytesToAddress(r.get(slotAt(base, 1)).Bytes()),
+		Block: binary.BigEndian.Uint64(header[0:]),
+		Data:  make([]uint64, binary.BigEndian.Uint64(header[8:])),
+	}
+	if msg.Block >= block {
+		return nil, false
+	}
+	for i := range msg.Data {
+		msg.Data[i] = r.getUint64(slotAt(base, uint64(3+i)))
+	}
+	// Clear the delivered message.
+	for i := uint64(0); i < uint64(3+len(msg.Data)); i++ {
+		r.set(slotAt(base, i), common.Hash{})
+	}
+	r.setUint64(queueHeadKey, seq+1)
+
+	pendingKey := crypto.Keccak256Hash(pendingPrefix, msg.From.Bytes())
+	r.setUint64(pendingKey, r.getUint64(pendingKey)-1)
+	return msg, true
+}
+
+// Register implements agent.Registry.
+func (r *AgentRegistry) Register(id agent.Identity) error {
+	base := crypto.Keccak256Hash(identityPrefix, id.Address[:])
+	if r.get(base) != (common.Hash{}) {
+		return fmt.Errorf("%w: %x", ErrAgentExists, id.Address)
+	}
+	var header common.Hash
+	binary.BigEndian.PutUint64(header[0:], 1)
+	binary.BigEndian.PutUint64(header[8:], id.Version)
+	binary.BigEndian.PutUint64(header[16:], id.CreatedAt)
+	r.set(base, header)
+	r.setBytes(slotAt(base, 1), []byte(id.Name))
+	r.setBytes(slotAt(base, 2), id.PublicKey)
+	r.writeReputation(id.Address, &agent.Reputation{Score: InitialReputation}, 0)
+	return nil
+}
+
+// Lookup implements agent.Registry.
+func (r *AgentRegistry) Lookup(address [20]byte) (*agent.Identity, error) {
+	base := crypto.Keccak256Hash(identityPrefix, address[:])
+	header := r.get(base)
+	if header == (common.Hash{}) {
+		return nil, fmt.Errorf("%w: %x", ErrAgentNotFound, address)
+	}
+	return &agent.Identity{
+		Address:   address,
+		PublicKey: r.getBytes(slotAt(base, 2)),
+		Name:      string(r.getBytes(slotAt(base, 1))),
+		Version:   binary.BigEndian.Uint64(header[8:]),
+		CreatedAt: binary.BigEndian.Uint64(header[16:]),
+	}, nil
+}
+
+// FindByCapability implements agent.Registry. Agents are returned in the
+// order they advertised the capability.
+func (r *AgentRegistry) FindByCapability(capability string) ([]agent.Identity, error) {
+	index := crypto.Keccak256Hash(capabilityIndexPrefix, []byte(capability))
+	n := r.getUint64(index)
+	ids := make([]agent.Identity, 0, n)
+	for i := uint64(0); i < n; i++ {
+		addr := common.BytesToAddress(r.get(slotAt(crypto.Keccak256Hash(index.Bytes()), i)).Bytes())
+		id, err := r.Lookup(addr)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, *id)
+	}
+	return ids, nil
+}
+
+// Advertise implements agent.Registry. Advertising a capability again
+// updates its details.
+func (r *AgentRegistry) Advertise(address [20]byte, cap agent.Capability) error {
+	if _, err := r.Lookup(address); err != nil {
+		return err
+	}
+	base := crypto.Keccak256Hash(capabilityPrefix, address[:], []byte(cap.Name))
+	if r.get(base) == (common.Hash{}) {
+		index := crypto.Keccak256Hash(capabilityIndexPrefix, []byte(cap.Name))
+		n := r.getUint64(index)
+		r.set(slotAt(crypto.Keccak256Hash(index.Bytes()), n), common.BytesToHash(address[:]))
+		r.setUint64(index, n+1)
+	}
+	var header common.Hash
+	binary.BigEndian.PutUint64(header[0:], 1)
+	binary.BigEndian.PutUint64(header[8:], cap.Cost)
+	r.set(base, header)
+	r.setBytes(slotAt(base, 1), []byte(cap.Version))
+	r.setBytes(slotAt(base, 2), []byte(cap.Description))
+	return nil
+}
+
+// UpdateReputation implements agent.Registry. The score moves by delta
+// within [0, MaxReputation]; a non-negative delta counts as a successful
+// task and a negative one as a slashing event.
+func (r *AgentRegistry) UpdateReputation(address [20]byte, delta int64) error {
+	rep, successes, err := r.reputation(address)
+	if err != nil {
+		return err
+	}
+	score := int64(rep.Score) + delta
+	switch {
+	case score < 0:
+		score = 0
+	case score > MaxReputation:
+		score = MaxReputation
+	}
+	rep.Score = uint64(score)
+	rep.TotalTasks++
+	if delta >= 0 {
+		successes++
+	} else {
+		rep.Slashes++
+	}
+	r.writeReputation(address, rep, successes)
+	return nil
+}
+
+// GetReputation implements agent.Registry.
+func (r *AgentRegistry) GetReputation(address [20]byte) (*agent.Reputation, error) {
+	rep, _, err := r.reputation(address)
+	return rep, err
+}
+
+func (r *AgentRegistry) reputation(address [20]byte) (*agent.Reputation, uint64, error) {
+	if _, err := r.Lookup(address); err != nil {
+		return nil, 0, err
+	}
+	word := r.get(crypto.Keccak256Hash(reputationPrefix, address[:]))
+	rep := &agent.Reputation{
+		Score:      binary.BigEndian.Uint64(word[0:]),
+		TotalTasks: binary.BigEndian.Uint64(word[8:]),
+		Slashes:    binary.BigEndian.Uint64(word[24:]),
+	}
+	successes := binary.BigEndian.Uint64(word[16:])
+	if rep.TotalTasks > 0 {
+		rep.SuccessRate = successes * 100 / rep.TotalTasks
+	}
+	return rep, successes, nil
+}
+
+func (r *AgentRegistry) writeReputation(address [20]byte, rep *agent.Reputation, successes uint64) {
+	var word common.Hash
+	binary.BigEndian.PutUint64(word[0:], rep.Score)
+	binary.BigEndian.PutUint64(word[8:], rep.TotalTasks)
+	binary.BigEndian.PutUint64(word[16:], successes)
+	binary.BigEndian.PutUint64(word[24:], rep.Slashes)
+	r.set(crypto.Keccak256Hash(reputationPrefix, address[:]), word)
+}
+
+// ---- Storage helpers ---------------------------------------------------------
+
+// messageBase returns the first storage slot of the message with sequence
+// number seq.
+func messageBase(seq uint64) common.Hash {
+	return crypto.Keccak256Hash(messagePrefix, common.BigToHash(new(big.Int).SetUint64(seq)).Bytes())
+}
+
+// slotAt returns the storage slot at offset i from base.
+func slotAt(base common.Hash, i uint64) common.Hash {
+	slot := new(big.Int).SetBytes(base.Bytes())
+	return common.BigToHash(slot.Add(slot, new(big.Int).SetUint64(i)))
+}
+
+func (r *AgentRegistry) get(key common.Hash) common.Hash {
+	return r.db.GetState(AgentRegistryAddress, key)
+}
+
+// set writes a slot, creating the registry account on first use: only
+// contract accounts have a storage trie.
+func (r *AgentRegistry) set(key, value common.Hash) {
+	if !r.db.Exist(AgentRegistryAddress) {
+		r.db.CreateContractAccount(AgentRegistryAddress)
+	}
+	r.db.SetState(AgentRegistryAddress, key, value)
+}
+
+func (r *AgentRegistry) getUint64(key common.Hash) uint64 {
+	return r.get(key).Big().Uint64()
+}
+
+func (r *AgentRegistry) setUint64(key common.Hash, v uint64) {
+	r.set(key, common.BigToHash(new(big.Int).SetUint64(v)))
+}
+
+// getBytes reads the byte string stored at slot.
+func (r *AgentRegistry) getBytes(slot common.Hash) []byte {
+	n := r.getUint64(slot)
+	if n == 0 {
+		return nil
+	}
+	data := make([]byte, 0, n+31)
+	chunks := crypto.Keccak256Hash(slot.Bytes())
+	for i := uint64(0); uint64(len(data)) < n; i++ {
+		data = append(data, r.get(slotAt(chunks, i)).Bytes()...)
+	}
+	return data[:n]
+}
+
+// setBytes stores data at slot, clearing the chunks of a longer old value.
+func (r *AgentRegistry) setBytes(slot common.Hash, data []byte) {
+	old := r.getUint64(slot)
+	chunks := crypto.Keccak256Hash(slot.Bytes())
+	for i := uint64(0); i*32 < uint64(len(data)); i++ {
+		var chunk common.Hash
+		copy(chunk[:], data[i*32:])
+		r.set(slotAt(chunks, i), chunk)
+	}
+	for i := (uint64(len(data)) + 31) / 32; i*32 < old; i++ {
+		r.set(slotAt(chunks, i), common.Hash{})
+	}
+	r.setUint64(slot, uint64(len(data)))
+}
@@ -0,0 +1,321 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+
+package integration
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+	probevm "github.com/probechain/go-probe/probe-lang/lang/vm"
+	"github.com/probechain/go-probe/probe-lang/stdlib/agent"
+)
+
+// memoryState is an in-memory AgentStateDB.
+type memoryState struct {
+	accounts map[common.Address]bool
+	nonces   map[common.Address]uint64
+	storage  map[common.Address]map[common.Hash]common.Hash
+}
+
+func newMemoryState() *memoryState {
+	return &memoryState{
+		accounts: make(map[common.Address]bool),
+		nonces:   make(map[common.Address]uint64),
+		storage:  make(map[common.Address]map[common.Hash]common.Hash),
+	}
+}
+
+func (s *memoryState) Exist(addr common.Address) bool { return s.accounts[addr] }
+
+func (s *memoryState) CreateContractAccount(addr common.Address) {
+	s.accounts[addr] = true
+	s.storage[addr] = make(map[common.Hash]common.Hash)
+}
+
+func (s *memoryState) GetNonce(addr common.Address) uint64        { return s.nonces[addr] }
+func (s *memoryState) SetNonce(addr common.Address, nonce uint64) { s.nonces[addr] = nonce }
+
+func (s *memoryState) GetState(addr common.Address, key common.Hash) common.Hash {
+	return s.storage[addr][key]
+}
+
+func (s *memoryState) SetState(addr common.Address, key, value common.Hash) {
+	if value == (common.Hash{}) {
+		delete(s.storage[addr], key)
+		return
+	}
+	s.storage[addr][key] = value
+}
+
+// registryHost spawns agents and sends messages through a registry.
+type registryHost struct {
+	*probevm.MemoryHost
+	reg     *AgentRegistry
+	block   uint64
+	spawned common.Address
+}
+
+func (h *registryHost) Spawn(entry uint64, state []uint64) (common.Address, error) {
+	addr, err := h.reg.Spawn(h.Self, entry, state, h.block)
+	h.spawned = addr
+	return addr, err
+}
+
+func (h *registryHost) Send(to common.Address, msg []uint64) error {
+	return h.reg.Send(h.Self, to, msg, h.block)
+}
+
+const counterSource = `
+agent Counter {
+    state {
+        count: u64,
+    }
+
+    msg increment(by: u64) {
+        require(by > 0, "zero increment");
+        self.count += by;
+    }
+}
+
+fn start(n: u64) {
+    let c = spawn Counter { count: n };
+    c.increment(2);
+    c.increment(3);
+}
+`
+
+func TestAgentRegistry(t *testing.T) {
+	db := newMemoryState()
+	reg := NewAgentRegistry(db)
+	owner := common.HexToAddress("0x0a")
+
+	a, err := reg.Spawn(owner, 64, []uint64{1, 2}, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := reg.Spawn(owner, 64, nil, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b || !db.Exist(a) || db.GetNonce(owner) != 2 {
+		t.Fatalf("agents %x and %x, owner nonce %d", a, b, db.GetNonce(owner))
+	}
+	rec, err := reg.Agent(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Owner != owner || rec.Entry != 64 || fmt.Sprint(rec.State) != "[1 2]" {
+		t.Errorf("agent = %+v", rec)
+	}
+	if err := reg.SetAgentState(a, []uint64{3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := reg.Agent(a); fmt.Sprint(rec.State) != "[3 4]" {
+		t.Errorf("state after update = %v, want [3 4]", rec.State)
+	}
+	if err := reg.SetAgentState(a, []uint64{1}); err == nil {
+		t.Error("state of a different size was accepted")
+	}
+	if _, err := reg.Agent(owner); !errors.Is(err, ErrAgentNotFound) {
+		t.Errorf("Agent(owner) error = %v, want ErrAgentNotFound", err)
+	}
+
+	// Spawned agents are registered.
+	id, err := reg.Lookup(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Address != a || id.CreatedAt != 7 {
+		t.Errorf("identity = %+v", id)
+	}
+	if err := reg.Register(agent.Identity{Address: a}); !errors.Is(err, ErrAgentExists) {
+		t.Errorf("second registration: error = %v, want ErrAgentExists", err)
+	}
+	rep, err := reg.GetReputation(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Score != InitialReputation || rep.TotalTasks != 0 {
+		t.Errorf("initial reputation = %+v", rep)
+	}
+}
+
+func TestAgentRegistryIdentities(t *testing.T) {
+	reg := NewAgentRegistry(newMemoryState())
+	alice := common.HexToAddress("0x01")
+	bob := common.HexToAddress("0x02")
+	long := make([]byte, 100)
+	for i := range long {
+		long[i] = byte(i)
+	}
+	if err := reg.Register(agent.Identity{Address: alice, Name: "alice", PublicKey: long, Version: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Register(agent.Identity{Address: bob, Name: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := reg.Lookup(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Name != "alice" || id.Version != 2 || string(id.PublicKey) != string(long) {
+		t.Errorf("identity = %+v", id)
+	}
+
+	for _, adv := range []struct {
+		addr common.Address
+		cap  agent.Capability
+	}{
+		{bob, agent.Capability{Name: "oracle", Cost: 5}},
+		{alice, agent.Capability{Name: "oracle", Cost: 7}},
+		{bob, agent.Capability{Name: "oracle", Cost: 6}},
+		{alice, agent.Capability{Name: "swap"}},
+	} {
+		if err := reg.Advertise(adv.addr, adv.cap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reg.Advertise(common.HexToAddress("0x03"), agent.Capability{Name: "oracle"}); !errors.Is(err, ErrAgentNotFound) {
+		t.Errorf("advertise by unknown agent: error = %v, want ErrAgentNotFound", err)
+	}
+	ids, err := reg.FindByCapability("oracle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0].Address != bob || ids[1].Address != alice {
+		t.Errorf("oracle providers = %+v, want bob and alice", ids)
+	}
+	if ids, _ := reg.FindByCapability("none"); len(ids) != 0 {
+		t.Errorf("found %d agents for an unknown capability", len(ids))
+	}
+
+	for _, delta := range []int64{100, 600, -2000, 3} {
+		if err := reg.UpdateReputation(alice, delta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rep, err := reg.GetReputation(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := agent.Reputation{Score: 3, TotalTasks: 4, SuccessRate: 75, Slashes: 1}
+	if *rep != want {
+		t.Errorf("reputation = %+v, want %+v", *rep, want)
+	}
+	if err := reg.UpdateReputation(common.HexToAddress("0x03"), 1); !errors.Is(err, ErrAgentNotFound) {
+		t.Errorf("unknown agent: error = %v, want ErrAgentNotFound", err)
+	}
+}
+
+func TestAgentBytesShrink(t *testing.T) {
+	db := newMemoryState()
+	reg := NewAgentRegistry(db)
+	slot := common.HexToHash("0x01")
+	reg.setBytes(slot, make([]byte, 70))
+	reg.setBytes(slot, []byte("short"))
+	if got := string(reg.getBytes(slot)); got != "short" {
+		t.Errorf("getBytes = %q, want short", got)
+	}
+	// The length slot and one chunk remain.
+	if n := len(db.storage[AgentRegistryAddress]); n != 2 {
+		t.Errorf("%d slots in use, want 2", n)
+	}
+}
+
+func TestAgentMessages(t *testing.T) {
+	blob, bc := compile(t, counterSource)
+	contract, err := VerifyPROBEContract(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := common.HexToAddress("0x0a")
+	db := newMemoryState()
+	reg := NewAgentRegistry(db)
+
+	// Spawn the agent and queue its messages as the chain host would.
+	host := &registryHost{MemoryHost: probevm.NewMemoryHost(owner, common.Address{}), reg: reg, block: 5}
+	if _, err := Execute(contract, &ExecutionContext{
+		Address:  owner,
+		GasLimit: 1_000_000,
+		Entry:    entryOf(t, bc, "start"),
+		Args:     []uint64{10},
+		Host:     host,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if reg.Pending() != 2 {
+		t.Fatalf("%d messages pending, want 2", reg.Pending())
+	}
+	if _, ok := reg.NextMessage(5); ok {
+		t.Fatal("message delivered in the block it was sent in")
+	}
+	for _, want := range []uint64{12, 15} {
+		msg, ok := reg.NextMessage(6)
+		if !ok {
+			t.Fatal("no message due")
+		}
+		ag, err := reg.Agent(msg.To)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := &ExecutionContext{Address: ag.Address, Caller: msg.From, GasLimit: 100_000, Entry: uint32(ag.Entry)}
+		_, state, err := DeliverMessage(contract, ctx, ag.State, msg.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := reg.SetAgentState(ag.Address, state); err != nil {
+			t.Fatal(err)
+		}
+		if state[0] != want {
+			t.Errorf("count = %d, want %d", state[0], want)
+		}
+	}
+	if _, ok := reg.NextMessage(6); ok || reg.Pending() != 0 {
+		t.Errorf("queue not drained: %d pending", reg.Pending())
+	}
+	// Delivered messages are cleared from storage.
+	for key := range db.storage[AgentRegistryAddress] {
+		for i := uint64(0); i < 2; i++ {
+			if key == messageBase(i) {
+				t.Errorf("message %d still stored", i)
+			}
+		}
+	}
+
+	// A failing handler leaves the state alone.
+	ag, _ := reg.Agent(host.spawned)
+	ctx := &ExecutionContext{Address: ag.Address, GasLimit: 100_000, Entry: uint32(ag.Entry)}
+	if _, _, err := DeliverMessage(contract, ctx, ag.State, []uint64{0, 0}); !errors.Is(err, ErrExecutionFailed) {
+		t.Errorf("error = %v, want ErrExecutionFailed", err)
+	}
+}
+
+func TestAgentPendingMessages(t *testing.T) {
+	reg := NewAgentRegistry(newMemoryState())
+	to, err := reg.Spawn(common.HexToAddress("0x0a"), 0, []uint64{0}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, other := common.HexToAddress("0x0b"), common.HexToAddress("0x0c")
+	for i := 0; i < MaxPendingMessages; i++ {
+		if err := reg.Send(sender, to, []uint64{0, uint64(i)}, 1); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	if err := reg.Send(sender, to, []uint64{0, 0}, 1); !errors.Is(err, ErrTooManyMessages) {
+		t.Fatalf("error = %v, want ErrTooManyMessages", err)
+	}
+	// The cap is per sender, and delivering a message frees its place.
+	if err := reg.Send(other, to, []uint64{0, 0}, 1); err != nil {
+		t.Fatalf("other sender: %v", err)
+	}
+	if msg, ok := reg.NextMessage(2); !ok || msg.From != sender {
+		t.Fatalf("next message = %+v, want one from %x", msg, sender)
+	}
+	if err := reg.Send(sender, to, []uint64{0, 0}, 2); err != nil {
+		t.Fatalf("after delivery: %v", err)
+	}
+}
@@ -6,10 +6,13 @@
 package integration
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 
 	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/common/hexutil"
+	"github.com/probechain/go-probe/probe-lang/lang/codegen"
 	probevm "github.com/probechain/go-probe/probe-lang/lang/vm"
 )
 
@@ -20,6 +23,9 @@ var (
 	// ErrExecutionFailed is returned when contract execution fails.
 	ErrExecutionFailed = errors.New("PROBE contract execution failed")
 
+	// ErrInvalidCallData is returned when call data cannot be decoded.
+	ErrInvalidCallData = errors.New("invalid PROBE call data")
+
 	// PROBEMagicPrefix identifies PROBE Language bytecode (vs EVM bytecode).
 	// Contracts prefixed with this 4-byte magic are routed to the PROBE VM.
 	PROBEMagicPrefix = []byte{0x50, 0x52, 0x42, 0x45} // "PRBE"
@@ -34,27 +40,39 @@ type Contract struct {
 
 // ExecutionContext provides blockchain state to the PROBE VM.
 type ExecutionContext struct {
+	Address   common.Address // address of the executing contract
 	Caller    common.Address
 	Origin    common.Address
 	Value     uint64 // attached value in pico
 	GasLimit  uint64
 	BlockNum  uint64
 	BlockTime uint64
+	Entry     uint32   // byte offset of the function to run
+	Args      []uint64 // arguments passed in R1..Rn
+	SendGas   uint64   // gas charged per agent message sent, besides its words
+
+	// Host provides balances, storage and logs. If nil, the contract runs
+	// against an empty in-memory state.
+	Host probevm.Host
+
+	// Tracer, if set, is notified of every executed instruction.
+	Tracer probevm.Tracer
 }
 
 // ExecutionResult contains the output of a PROBE contract execution.
 type ExecutionResult struct {
-	ReturnValue uint64
-	GasUsed     uint64
-	Logs        []Log
-	Success     bool
+	ReturnValue  uint64
+	GasUsed      uint64
+	Logs         []Log
+	Success      bool
+	RevertReason string // reason given to revert, if the contract reverted
 }
 
 // Log is an event emitted during contract execution.
 type Log struct {
-	Address common.Address
-	Topics  []common.Hash
-	Data    []byte
+	Address common.Address `json:"address"`
+	Topics  []common.Hash  `json:"topics"`
+	Data    hexutil.Bytes  `json:"data"`
 }
 
 // IsPROBEContract checks if bytecode is a PROBE Language contract.
@@ -103,6 +121,22 @@ func DecodePROBEContract(raw []byte) (*Contract, error) {
 	}, nil
 }
 
+// VerifyPROBEContract decodes raw contract data and runs the bytecode
+// verifier over it, so that only well-formed code is deployed.
+func VerifyPROBEContract(raw []byte) (*Contract, error) {
+	contract, err := DecodePROBEContract(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(contract.Code) == 0 {
+		return nil, fmt.Errorf("%w: empty code", ErrInvalidBytecode)
+	}
+	if errs := codegen.Verify(&codegen.Bytecode{Code: contract.Code, Constants: contract.Constants}); len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBytecode, errs[0].Error())
+	}
+	return contract, nil
+}
+
 // EncodePROBEContract encodes a PROBE contract for on-chain storage.
 func EncodePROBEContract(code []byte, constants []uint64) []byte {
 	numConst := uint32(len(constants))
@@ -126,35 +160,152 @@ func EncodePROBEContract(code []byte, constants []uint64) []byte {
 	return result
 }
 
-// Execute runs a PROBE contract in the VM with the given context.
+// Execute runs a PROBE contract in the VM with the given context. Errors
+// wrap ErrExecutionFailed and the underlying VM error, so a revert can be
+// detected with errors.Is(err, vm.ErrReverted).
 func Execute(contract *Contract, ctx *ExecutionContext) (*ExecutionResult, error) {
-	// Create and configure the VM.
-	v := probevm.New(contract.Code, contract.Constants, ctx.GasLimit)
-
-	// Set blockchain context.
-	v.SetBlockContext(ctx.BlockNum, ctx.BlockTime, addressToUint64(ctx.Caller))
+	if len(ctx.Args) > maxCallArgs {
+		return &ExecutionResult{}, fmt.Errorf("%w: too many arguments (%d)", ErrExecutionFailed, len(ctx.Args))
+	}
+	if ctx.Entry%4 != 0 || int(ctx.Entry) >= len(contract.Code) {
+		return &ExecutionResult{}, fmt.Errorf("%w: invalid entry point %d", ErrExecutionFailed, ctx.Entry)
+	}
+	v, rec := newVM(contract, ctx)
+	v.Enter(ctx.Entry, ctx.Args...)
+	retVal, err := v.Run()
+	return executionResult(v, rec, retVal, err)
+}
 
-	// Run the contract.
+// DeliverMessage runs the dispatcher of an agent at ctx.Entry with the
+// agent's state and a message, as the agent runtime does when the message
+// is due. It returns the state as updated by the handler.
+func DeliverMessage(contract *Contract, ctx *ExecutionContext, state, msg []uint64) (*ExecutionResult, []uint64, error) {
+	if ctx.Entry%4 != 0 || int(ctx.Entry) >= len(contract.Code) {
+		return &ExecutionResult{}, nil, fmt.Errorf("%w: invalid dispatcher entry %d", ErrExecutionFailed, ctx.Entry)
+	}
+	v, rec := newVM(contract, ctx)
+	statePtr, err := v.Memory().AllocWords(state)
+	if err != nil {
+		return &ExecutionResult{}, nil, fmt.Errorf("%w: %w", ErrExecutionFailed, err)
+	}
+	msgPtr, err := v.Memory().AllocWords(msg)
+	if err != nil {
+		return &ExecutionResult{}, nil, fmt.Errorf("%w: %w", ErrExecutionFailed, err)
+	}
+	// Handlers see the state fields without the length word.
+	v.Enter(ctx.Entry, statePtr+8, msgPtr)
 	retVal, err := v.Run()
+	res, err := executionResult(v, rec, retVal, err)
+	if err != nil {
+		return res, nil, err
+	}
+	newState, err := v.Memory().ReadWords(statePtr)
+	if err != nil {
+		return res, nil, fmt.Errorf("%w: %w", ErrExecutionFailed, err)
+	}
+	return res, newState, nil
+}
 
-	result := &ExecutionResult{
-		ReturnValue: retVal,
-		GasUsed:     v.GasUsed(),
-		Success:     err == nil,
+// newVM creates a VM for ctx that records the events it emits.
+func newVM(contract *Contract, ctx *ExecutionContext) (*probevm.VM, *logRecorder) {
+	host := ctx.Host
+	if host == nil {
+		host = probevm.NewMemoryHost(ctx.Address, ctx.Caller)
 	}
+	rec := &logRecorder{Host: host, addr: ctx.Address}
+	v := probevm.New(contract.Code, contract.Constants, ctx.GasLimit, rec)
+	v.SetBlockContext(ctx.BlockNum, ctx.BlockTime)
+	v.SetSendGas(ctx.SendGas)
+	v.SetTracer(ctx.Tracer)
+	return v, rec
+}
 
+func executionResult(v *probevm.VM, rec *logRecorder, retVal uint64, err error) (*ExecutionResult, error) {
+	result := &ExecutionResult{
+		ReturnValue:  retVal,
+		GasUsed:      v.GasUsed(),
+		Success:      err == nil,
+		RevertReason: v.RevertReason(),
+		Logs:         rec.logs,
+	}
 	if err != nil {
-		return result, fmt.Errorf("%w: %v", ErrExecutionFailed, err)
+		return result, fmt.Errorf("%w: %w", ErrExecutionFailed, err)
 	}
-
 	return result, nil
 }
 
-// addressToUint64 converts the first 8 bytes of an address to a uint64 for VM registers.
-func addressToUint64(addr common.Address) uint64 {
-	var v uint64
-	for i := 0; i < 8 && i < len(addr); i++ {
-		v |= uint64(addr[i]) << (i * 8)
+// logRecorder passes events through to the host and keeps them, as logs,
+// for the execution result.
+type logRecorder struct {
+	probevm.Host
+	addr common.Address
+	logs []Log
+}
+
+func (r *logRecorder) EmitLog(ev probevm.Event) error {
+	if err := r.Host.EmitLog(ev); err != nil {
+		return err
+	}
+	r.logs = append(r.logs, EventLog(r.addr, ev))
+	return nil
+}
+
+// EventLog converts a VM event emitted by the contract at addr into a log.
+// The event tag is the first topic and each field is a 32-byte big-endian
+// data word.
+func EventLog(addr common.Address, ev probevm.Event) Log {
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], ev.ID)
+	data := make([]byte, 0, len(ev.Fields)*32)
+	for _, f := range ev.Fields {
+		data = append(data, EncodeWord(f)...)
+	}
+	return Log{
+		Address: addr,
+		Topics:  []common.Hash{common.BytesToHash(id[:])},
+		Data:    data,
 	}
-	return v
+}
+
+// maxCallArgs is the number of argument registers, R1..R254.
+const maxCallArgs = 254
+
+// EncodeCallData encodes a call to the function at byte offset entry as
+// [entry:4][args:32 each], with big-endian words as in the EVM ABI.
+func EncodeCallData(entry uint32, args ...uint64) []byte {
+	data := make([]byte, 4, 4+32*len(args))
+	binary.BigEndian.PutUint32(data, entry)
+	for _, a := range args {
+		data = append(data, EncodeWord(a)...)
+	}
+	return data
+}
+
+// DecodeCallData decodes call data produced by EncodeCallData. Empty call
+// data runs the function at offset 0 without arguments.
+func DecodeCallData(data []byte) (uint32, []uint64, error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+	if len(data) < 4 || (len(data)-4)%32 != 0 {
+		return 0, nil, fmt.Errorf("%w: malformed call data", ErrInvalidCallData)
+	}
+	entry := binary.BigEndian.Uint32(data)
+	args := make([]uint64, 0, (len(data)-4)/32)
+	for word := data[4:]; len(word) > 0; word = word[32:] {
+		for _, b := range word[:24] {
+			if b != 0 {
+				return 0, nil, fmt.Errorf("%w: argument %d exceeds 64 bits", ErrInvalidCallData, len(args))
+			}
+		}
+		args = append(args, binary.BigEndian.Uint64(word[24:32]))
+	}
+	return entry, args, nil
+}
+
+// EncodeWord encodes a VM word as a 32-byte big-endian value.
+func EncodeWord(v uint64) []byte {
+	word := make([]byte, 32)
+	binary.BigEndian.PutUint64(word[24:], v)
+	return word
 }
@@ -0,0 +1,176 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+
+package integration
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/probe-lang/lang/codegen"
+	"github.com/probechain/go-probe/probe-lang/lang/lower"
+	"github.com/probechain/go-probe/probe-lang/lang/parser"
+	probevm "github.com/probechain/go-probe/probe-lang/lang/vm"
+)
+
+const testSource = `
+struct Paid { amount: u64 }
+
+fn pay(balance: u64, amount: u64) -> u64 {
+    require(amount <= balance, "insufficient balance");
+    emit Paid { amount: amount };
+    balance - amount
+}
+`
+
+func compile(t *testing.T, src string) ([]byte, *codegen.Bytecode) {
+	t.Helper()
+	prog, errs := parser.Parse("test.probe", src)
+	if len(errs) > 0 {
+		t.Fatalf("parse: %v", errs)
+	}
+	irProg, err := lower.Lower(prog)
+	if err != nil {
+		t.Fatalf("lower: %v", err)
+	}
+	bc, err := codegen.New().Generate(irProg)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	return EncodePROBEContract(bc.Code, bc.Constants), bc
+}
+
+func entryOf(t *testing.T, bc *codegen.Bytecode, name string) uint32 {
+	t.Helper()
+	for _, f := range bc.Functions {
+		if f.Name == name {
+			return uint32(f.Offset)
+		}
+	}
+	t.Fatalf("function %s not found", name)
+	return 0
+}
+
+func TestCallDataRoundTrip(t *testing.T) {
+	data := EncodeCallData(8, 1, 1<<63)
+	if len(data) != 4+2*32 {
+		t.Fatalf("encoded length = %d, want %d", len(data), 4+2*32)
+	}
+	entry, args, err := DecodeCallData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != 8 || len(args) != 2 || args[0] != 1 || args[1] != 1<<63 {
+		t.Errorf("decoded entry=%d args=%v", entry, args)
+	}
+	if entry, args, err := DecodeCallData(nil); err != nil || entry != 0 || len(args) != 0 {
+		t.Errorf("empty call data: entry=%d args=%v err=%v", entry, args, err)
+	}
+	for _, bad := range [][]byte{{1, 2}, append(EncodeCallData(0), 1)} {
+		if _, _, err := DecodeCallData(bad); !errors.Is(err, ErrInvalidCallData) {
+			t.Errorf("DecodeCallData(%x) error = %v, want ErrInvalidCallData", bad, err)
+		}
+	}
+	wide := EncodeCallData(0, 1)
+	wide[4] = 1
+	if _, _, err := DecodeCallData(wide); !errors.Is(err, ErrInvalidCallData) {
+		t.Errorf("argument over 64 bits: error = %v, want ErrInvalidCallData", err)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	blob, bc := compile(t, testSource)
+	contract, err := VerifyPROBEContract(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := common.HexToAddress("0x01")
+	ctx := &ExecutionContext{
+		Address:  addr,
+		GasLimit: 1_000_000,
+		Entry:    entryOf(t, bc, "pay"),
+		Args:     []uint64{10, 4},
+	}
+	res, err := Execute(contract, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ReturnValue != 6 || !res.Success || res.GasUsed == 0 {
+		t.Errorf("result = %+v", res)
+	}
+	if len(res.Logs) != 1 {
+		t.Fatalf("got %d logs, want 1", len(res.Logs))
+	}
+	if l := res.Logs[0]; l.Address != addr || len(l.Topics) != 1 || !bytes.Equal(l.Data, EncodeWord(4)) {
+		t.Errorf("log = %+v", l)
+	}
+
+	ctx.Args = []uint64{1, 4}
+	res, err = Execute(contract, ctx)
+	if !errors.Is(err, ErrExecutionFailed) || !errors.Is(err, probevm.ErrReverted) {
+		t.Fatalf("error = %v, want a revert", err)
+	}
+	if res.Success || res.RevertReason != "insufficient balance" || len(res.Logs) != 0 {
+		t.Errorf("reverted result = %+v", res)
+	}
+
+	ctx.Entry = 3
+	if _, err := Execute(contract, ctx); !errors.Is(err, ErrExecutionFailed) {
+		t.Errorf("misaligned entry: error = %v, want ErrExecutionFailed", err)
+	}
+}
+
+func TestExecuteHost(t *testing.T) {
+	blob, bc := compile(t, `
+fn deposit(amount: u64) -> u64 {
+    storage_store(caller_key(), storage_load(caller_key()) + amount);
+    storage_load(caller_key())
+}
+
+fn caller_key() -> u64 {
+    if caller() == @0x0000000000000000000000000000000000000002 { 2 } else { 1 }
+}
+`)
+	contract, err := VerifyPROBEContract(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, caller := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	host := probevm.NewMemoryHost(addr, caller)
+	ctx := &ExecutionContext{
+		Address:  addr,
+		Caller:   caller,
+		GasLimit: 1_000_000,
+		Entry:    entryOf(t, bc, "deposit"),
+		Args:     []uint64{5},
+		Host:     host,
+	}
+	for _, want := range []uint64{5, 10} {
+		res, err := Execute(contract, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.ReturnValue != want {
+			t.Errorf("deposit = %d, want %d", res.ReturnValue, want)
+		}
+	}
+	if len(host.Storage) != 1 || host.Storage[2] != 10 {
+		t.Errorf("storage = %v, want map[2:10]", host.Storage)
+	}
+}
+
+func TestVerifyPROBEContract(t *testing.T) {
+	if _, err := VerifyPROBEContract([]byte{0x60, 0x00}); !errors.Is(err, ErrInvalidBytecode) {
+		t.Errorf("EVM code: error = %v, want ErrInvalidBytecode", err)
+	}
+	if _, err := VerifyPROBEContract(EncodePROBEContract(nil, nil)); !errors.Is(err, ErrInvalidBytecode) {
+		t.Errorf("empty code: error = %v, want ErrInvalidBytecode", err)
+	}
+	// A constant load past the end of the pool must be rejected.
+	code := []byte{byte(probevm.OpLoadConst), 1, 0xff, 0xff, byte(probevm.OpReturn), 0, 0, 0}
+	if _, err := VerifyPROBEContract(EncodePROBEContract(code, nil)); !errors.Is(err, ErrInvalidBytecode) {
+		t.Errorf("bad constant: error = %v, want ErrInvalidBytecode", err)
+	}
+}
@@ -10,6 +10,11 @@ import (
 
 	"github.com/probechain/go-probe/common"
 	"github.com/probechain/go-probe/common/hexutil"
+	"github.com/probechain/go-probe/probe-lang/lang/codegen"
+	"github.com/probechain/go-probe/probe-lang/lang/ir"
+	"github.com/probechain/go-probe/probe-lang/lang/lower"
+	"github.com/probechain/go-probe/probe-lang/lang/parser"
+	"github.com/probechain/go-probe/probe-lang/lang/types"
 )
 
 // ProbeLanguageAPI provides RPC methods for PROBE Language operations.
@@ -21,6 +26,7 @@ func NewProbeLanguageAPI() *ProbeLanguageAPI {
 }
 
 // CompileResult contains the output of compiling PROBE source code.
+// Bytecode is the deployable contract, as encoded by EncodePROBEContract.
 type CompileResult struct {
 	Bytecode  hexutil.Bytes `json:"bytecode"`
 	Constants []uint64      `json:"constants"`
@@ -32,10 +38,53 @@ type CompileResult struct {
 type CallResult struct {
 	ReturnValue hexutil.Uint64 `json:"returnValue"`
 	GasUsed     hexutil.Uint64 `json:"gasUsed"`
+	Logs        []Log          `json:"logs,omitempty"`
 	Success     bool           `json:"success"`
 	Error       string         `json:"error,omitempty"`
 }
 
+// Compile compiles PROBE source code into a deployable contract. Compile
+// errors are reported in the result rather than as an RPC error.
+func (api *ProbeLanguageAPI) Compile(_ context.Context, source string) *CompileResult {
+	prog, errs := parser.Parse("", source)
+	if len(errs) > 0 {
+		result := &CompileResult{}
+		for _, err := range errs {
+			result.Errors = append(result.Errors, err.Error())
+		}
+		return result
+	}
+	irProg, err := lower.Lower(prog)
+	if err != nil {
+		result := &CompileResult{}
+		if diags, ok := err.(types.Diagnostics); ok {
+			for _, d := range diags {
+				result.Errors = append(result.Errors, d.Error())
+			}
+		} else {
+			result.Errors = []string{err.Error()}
+		}
+		return result
+	}
+	ir.Optimize(irProg)
+	bc, err := codegen.New().Generate(irProg)
+	if err != nil {
+		return &CompileResult{Errors: []string{err.Error()}}
+	}
+	if verrs := codegen.Verify(bc); len(verrs) > 0 {
+		result := &CompileResult{}
+		for i := range verrs {
+			result.Errors = append(result.Errors, verrs[i].Error())
+		}
+		return result
+	}
+	return &CompileResult{
+		Bytecode:  EncodePROBEContract(bc.Code, bc.Constants),
+		Constants: bc.Constants,
+		Success:   true,
+	}
+}
+
 // TokenInfo returns PROBE token metadata.
 func (api *ProbeLanguageAPI) TokenInfo(_ context.Context) map[string]interface{} {
 	return map[string]interface{}{
@@ -52,7 +101,9 @@ func (api *ProbeLanguageAPI) IsPROBEContract(_ context.Context, code hexutil.Byt
 }
 
 // SimulateCall simulates executing a PROBE contract without modifying state.
-func (api *ProbeLanguageAPI) SimulateCall(_ context.Context, contractCode hexutil.Bytes, caller common.Address, gasLimit hexutil.Uint64) (*CallResult, error) {
+// The optional input is call data as encoded by EncodeCallData; without it
+// the function at offset 0 is run.
+func (api *ProbeLanguageAPI) SimulateCall(_ context.Context, contractCode hexutil.Bytes, caller common.Address, gasLimit hexutil.Uint64, input *hexutil.Bytes) (*CallResult, error) {
 	contract, err := DecodePROBEContract(contractCode)
 	if err != nil {
 		return &CallResult{
@@ -65,6 +116,11 @@ func (api *ProbeLanguageAPI) SimulateCall(_ context.Context, contractCode hexuti
 		Caller:   caller,
 		GasLimit: uint64(gasLimit),
 	}
+	if input != nil {
+		if ctx.Entry, ctx.Args, err = DecodeCallData(*input); err != nil {
+			return &CallResult{Success: false, Error: err.Error()}, nil
+		}
+	}
 
 	result, err := Execute(contract, ctx)
 	if err != nil {
@@ -79,6 +135,7 @@ func (api *ProbeLanguageAPI) SimulateCall(_ context.Context, contractCode hexuti
 	return &CallResult{
 		ReturnValue: hexutil.Uint64(result.ReturnValue),
 		GasUsed:     hexutil.Uint64(result.GasUsed),
+		Logs:        result.Logs,
 		Success:     true,
 	}, nil
 }
@@ -268,10 +268,11 @@ func (a *AgentStateBlock) String() string {
 
 // MsgHandler is a message handler inside an AgentDecl: msg MsgName(params) { body }.
 type MsgHandler struct {
-	Token  token.Token // 'msg'
-	Name   string
-	Params []Param
-	Body   *BlockExpr
+	Token      token.Token // 'msg'
+	Name       string
+	Params     []Param
+	ReturnType TypeExpr // nil means unit
+	Body       *BlockExpr
 }
 
 func (m *MsgHandler) String() string {
@@ -284,7 +285,12 @@ func (m *MsgHandler) String() string {
 		parts[i] = p.String()
 	}
 	out.WriteString(strings.Join(parts, ", "))
-	out.WriteString(") ")
+	out.WriteString(")")
+	if m.ReturnType != nil {
+		out.WriteString(" -> ")
+		out.WriteString(m.ReturnType.String())
+	}
+	out.WriteString(" ")
 	out.WriteString(m.Body.String())
 	return out.String()
 }
@@ -1199,3 +1205,105 @@ func (d *ModDecl) String() string {
 	}
 	return out.String()
 }
+
+// ---------------------------------------------------------------------------
+// Positions
+// ---------------------------------------------------------------------------
+
+// Pos returns the source position of a node: the position of its leading
+// token, or of its leftmost operand for infix and postfix expressions.
+func Pos(n Node) token.Position {
+	switch n := n.(type) {
+	case *Ident:
+		return n.Token.Pos
+	case *IntLiteral:
+		return n.Token.Pos
+	case *FloatLiteral:
+		return n.Token.Pos
+	case *StringLiteral:
+		return n.Token.Pos
+	case *BoolLiteral:
+		return n.Token.Pos
+	case *BytesLiteral:
+		return n.Token.Pos
+	case *NilLiteral:
+		return n.Token.Pos
+	case *AddressLiteral:
+		return n.Token.Pos
+	case *PrefixExpr:
+		return n.Token.Pos
+	case *InfixExpr:
+		return Pos(n.Left)
+	case *IndexExpr:
+		return Pos(n.Left)
+	case *FieldExpr:
+		return Pos(n.Object)
+	case *CallExpr:
+		return Pos(n.Function)
+	case *MethodCallExpr:
+		return Pos(n.Receiver)
+	case *BlockExpr:
+		return n.Token.Pos
+	case *IfExpr:
+		return n.Token.Pos
+	case *MatchExpr:
+		return n.Token.Pos
+	case *RangeExpr:
+		return n.Token.Pos
+	case *ArrayExpr:
+		return n.Token.Pos
+	case *MoveExpr:
+		return n.Token.Pos
+	case *CopyExpr:
+		return n.Token.Pos
+	case *SpawnExpr:
+		return n.Token.Pos
+	case *SendExpr:
+		return n.Token.Pos
+	case *RecvExpr:
+		return n.Token.Pos
+	case *LetStmt:
+		return n.Token.Pos
+	case *AssignStmt:
+		return Pos(n.Target)
+	case *ReturnStmt:
+		return n.Token.Pos
+	case *ExprStmt:
+		return n.Token.Pos
+	case *ForStmt:
+		return n.Token.Pos
+	case *WhileStmt:
+		return n.Token.Pos
+	case *BreakStmt:
+		return n.Token.Pos
+	case *ContinueStmt:
+		return n.Token.Pos
+	case *DropStmt:
+		return n.Token.Pos
+	case *EmitStmt:
+		return n.Token.Pos
+	case *RequireStmt:
+		return n.Token.Pos
+	case *FnDecl:
+		return n.Token.Pos
+	case *StructDecl:
+		return n.Token.Pos
+	case *EnumDecl:
+		return n.Token.Pos
+	case *TraitDecl:
+		return n.Token.Pos
+	case *ImplDecl:
+		return n.Token.Pos
+	case *AgentDecl:
+		return n.Token.Pos
+	case *ResourceDecl:
+		return n.Token.Pos
+	case *TypeDecl:
+		return n.Token.Pos
+	case *UseDecl:
+		return n.Token.Pos
+	case *ModDecl:
+		return n.Token.Pos
+	}
+	return token.Position{}
+}
@@ -11,6 +11,8 @@ package codegen
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
+	"sort"
 
 	"github.com/probechain/go-probe/probe-lang/lang/ir"
 )
@@ -20,6 +22,24 @@ type Bytecode struct {
 	Code      []byte   // encoded instructions
 	Constants []uint64 // constant pool
 	Functions []FuncEntry
+	Lines     []LineEntry // source line table, ordered by offset
+}
+
+// LineEntry maps the code from Offset up to the next entry to a source line.
+// Line is 0 for generated code without a source position.
+type LineEntry struct {
+	Offset int
+	Line   int
+}
+
+// Line returns the source line of the instruction at byte offset pc, or 0 if
+// it is unknown.
+func (bc *Bytecode) Line(pc int) int {
+	i := sort.Search(len(bc.Lines), func(i int) bool { return bc.Lines[i].Offset > pc })
+	if i == 0 {
+		return 0
+	}
+	return bc.Lines[i-1].Line
 }
 
 // FuncEntry describes a function's location in the bytecode.
@@ -30,24 +50,44 @@ type FuncEntry struct {
 }
 
 // Generator translates IR to bytecode.
+//
+// SSA values are mapped onto R1..R254: parameters are pinned to R1..Rn, values
+// used outside their defining block stay allocated for the whole function and
+// block-local values are released after their last use. R0 is the VM's zero
+// register and R255 is reserved as scratch for address arithmetic.
 type Generator struct {
 	code      []byte
 	constants []uint64
+	pool      map[uint64]uint16 // constant value -> pool index
 	functions []FuncEntry
-	labels    map[string]int    // block label -> code offset
+	lines     []LineEntry
+	labels    map[string]int    // function-qualified block label -> code offset
 	patches   []patchEntry      // forward references to patch
 	regMap    map[int]uint8     // SSA value ID -> register number
 	nextReg   uint8
+	freeRegs  []uint8           // released registers available for reuse
+	global    map[int]bool      // values live across blocks
+	lastUse   map[int]int       // value ID -> index of its last use in its block
+	fn        string            // name of the function being generated
+	err       error             // first allocation error
 }
 
 type patchEntry struct {
-	offset int    // offset in code to patch
-	label  string // target block label
+	offset int    // offset in code to patch, or constant pool index
+	label  string // target block label, or function name for calls
+	call   bool   // whether the target is a function
+	ref    bool   // whether to store the function's byte offset in the pool
 }
 
+const (
+	scratchReg uint8 = 255 // reserved for address arithmetic
+	maxReg     uint8 = 254 // highest allocatable register
+)
+
 // New creates a new bytecode generator.
 func New() *Generator {
 	return &Generator{
+		pool:   make(map[uint64]uint16),
 		labels: make(map[string]int),
 		regMap: make(map[int]uint8),
 	}
@@ -57,45 +97,77 @@ func New() *Generator {
 func (g *Generator) Generate(prog *ir.Program) (*Bytecode, error) {
 	// Translate constants.
 	for _, c := range prog.Constants {
-		switch v := c.Value.(type) {
+		var v uint64
+		switch c := c.Value.(type) {
 		case int64:
-			g.constants = append(g.constants, uint64(v))
+			v = uint64(c)
 		case uint64:
-			g.constants = append(g.constants, v)
+			v = c
 		case float64:
-			// Store float bits as uint64.
-			g.constants = append(g.constants, 0) // placeholder
-		default:
-			g.constants = append(g.constants, 0)
+			v = math.Float64bits(c)
+		case bool:
+			if c {
+				v = 1
+			}
+		}
+		if _, ok := g.pool[v]; !ok {
+			g.pool[v] = uint16(len(g.constants))
 		}
+		g.constants = append(g.constants, v)
 	}
 
 	// Generate each function.
+	offsets := make(map[string]int)
 	for _, fn := range prog.Functions {
+		if _, ok := offsets[fn.Name]; ok {
+			return nil, fmt.Errorf("duplicate function: %s", fn.Name)
+		}
+		offsets[fn.Name] = len(g.code)
 		if err := g.generateFunction(fn); err != nil {
 			return nil, fmt.Errorf("function %s: %w", fn.Name, err)
 		}
 	}
+	if len(g.constants) > math.MaxUint16+1 {
+		return nil, fmt.Errorf("constant pool too large: %d entries", len(g.constants))
+	}
 
 	// Patch forward references.
 	for _, p := range g.patches {
-		target, ok := g.labels[p.label]
-		if !ok {
+		var (
+			target int
+			ok     bool
+		)
+		if p.call || p.ref {
+			if target, ok = offsets[p.label]; !ok {
+				return nil, fmt.Errorf("undefined function: %s", p.label)
+			}
+			if p.ref {
+				g.constants[p.offset] = uint64(target)
+				continue
+			}
+		} else if target, ok = g.labels[p.label]; !ok {
 			return nil, fmt.Errorf("undefined label: %s", p.label)
 		}
-		binary.LittleEndian.PutUint16(g.code[p.offset+2:], uint16(target/4))
+		if target/4 > math.MaxUint16 {
+			return nil, fmt.Errorf("jump target %d out of range", target)
+		}
+		binary.BigEndian.PutUint16(g.code[p.offset+2:], uint16(target/4))
 	}
 
 	return &Bytecode{
 		Code:      g.code,
 		Constants: g.constants,
 		Functions: g.functions,
+		Lines:     g.lines,
 	}, nil
 }
 
 func (g *Generator) generateFunction(fn *ir.Function) error {
 	g.regMap = make(map[int]uint8)
-	g.nextReg = 0
+	g.nextReg = 1
+	g.freeRegs = g.freeRegs[:0]
+	g.fn = fn.Name
+	g.analyze(fn)
 
 	entry := FuncEntry{
 		Name:   fn.Name,
@@ -103,26 +175,49 @@ func (g *Generator) generateFunction(fn *ir.Function) error {
 		Locals: fn.Locals,
 	}
 
-	// Map parameters to registers.
+	g.markLine(fn.Line)
+
+	// Map parameters to registers R1..Rn, where the VM passes arguments.
 	for _, p := range fn.Params {
 		g.allocReg(p)
 	}
 
 	// Generate blocks.
-	for _, block := range fn.Blocks {
-		g.labels[block.Label] = len(g.code)
+	for i, block := range fn.Blocks {
+		g.labels[g.label(block)] = len(g.code)
 
-		for _, inst := range block.Instructions {
+		for j, inst := range block.Instructions {
+			if inst.Line != 0 {
+				g.markLine(inst.Line)
+			}
 			if err := g.generateInstruction(inst); err != nil {
 				return err
 			}
+			g.release(inst, j)
 		}
 
 		if block.Terminator != nil {
-			if err := g.generateTerminator(block.Terminator); err != nil {
+			var next *ir.BasicBlock
+			if i+1 < len(fn.Blocks) {
+				next = fn.Blocks[i+1]
+			}
+			if err := g.generateTerminator(block.Terminator, next); err != nil {
 				return err
 			}
 		}
+		// Block-local values are dead past the end of their block.
+		var dead []uint8
+		for id, r := range g.regMap {
+			if !g.global[id] {
+				delete(g.regMap, id)
+				dead = append(dead, r)
+			}
+		}
+		sort.Slice(dead, func(i, j int) bool { return dead[i] > dead[j] })
+		g.freeRegs = append(g.freeRegs, dead...)
+	}
+	if g.err != nil {
+		return g.err
 	}
 
 	entry.Locals = int(g.nextReg)
@@ -130,13 +225,93 @@ func (g *Generator) generateFunction(fn *ir.Function) error {
 	return nil
 }
 
+// markLine records that the code generated next comes from the given source
+// line.
+func (g *Generator) markLine(line int) {
+	if n := len(g.lines); n > 0 {
+		last := &g.lines[n-1]
+		if last.Line == line {
+			return
+		}
+		if last.Offset == len(g.code) {
+			last.Line = line
+			return
+		}
+	}
+	g.lines = append(g.lines, LineEntry{Offset: len(g.code), Line: line})
+}
+
+// analyze computes which values of fn are live across blocks and where the
+// block-local ones are last used.
+func (g *Generator) analyze(fn *ir.Function) {
+	g.global = make(map[int]bool)
+	g.lastUse = make(map[int]int)
+
+	defs := make(map[int]*ir.BasicBlock)
+	for _, p := range fn.Params {
+		g.global[p.ID] = true
+	}
+	for _, block := range fn.Blocks {
+		for _, inst := range block.Instructions {
+			defs[inst.Result.ID] = block
+		}
+	}
+	use := func(v ir.Value, block *ir.BasicBlock, idx int) {
+		if defs[v.ID] != block {
+			g.global[v.ID] = true
+		} else {
+			g.lastUse[v.ID] = idx
+		}
+	}
+	for _, block := range fn.Blocks {
+		for i, inst := range block.Instructions {
+			for _, op := range inst.Operands {
+				if inst.Op == ir.OpPhi {
+					g.global[op.ID] = true
+				}
+				use(op, block, i)
+			}
+		}
+		n := len(block.Instructions)
+		switch t := block.Terminator.(type) {
+		case *ir.TermReturn:
+			if t.Value != nil {
+				use(*t.Value, block, n)
+			}
+		case *ir.TermRevert:
+			if t.Reason != nil {
+				use(*t.Reason, block, n)
+			}
+		case *ir.TermCondBranch:
+			use(t.Cond, block, n)
+		}
+	}
+}
+
+// label returns the code label of a block, qualified by its function.
+func (g *Generator) label(block *ir.BasicBlock) string {
+	return g.fn + ":" + block.Label
+}
+
 func (g *Generator) allocReg(v ir.Value) uint8 {
 	if r, ok := g.regMap[v.ID]; ok {
 		return r
 	}
-	r := g.nextReg
+	var r uint8
+	switch {
+	case len(g.freeRegs) > 0:
+		r = g.freeRegs[len(g.freeRegs)-1]
+		g.freeRegs = g.freeRegs[:len(g.freeRegs)-1]
+	case g.nextReg <= maxReg:
+		r = g.nextReg
+		g.nextReg++
+	default:
+		if g.err == nil {
+			g.err = fmt.Errorf("out of registers (%d live values)", maxReg)
+		}
+		return 0
+	}
 	g.regMap[v.ID] = r
-	g.nextReg++
 	return r
 }
 
@@ -147,14 +322,50 @@ func (g *Generator) getReg(v ir.Value) uint8 {
 	return g.allocReg(v)
 }
 
+// freeReg returns the register of a block-local value to the free list.
+func (g *Generator) freeReg(v ir.Value) {
+	if g.global[v.ID] {
+		return
+	}
+	if r, ok := g.regMap[v.ID]; ok {
+		delete(g.regMap, v.ID)
+		g.freeRegs = append(g.freeRegs, r)
+	}
+}
+
+// release frees the registers of the operands of the idx-th instruction of a
+// block that are not used afterwards, and its result if it is never used.
+func (g *Generator) release(inst *ir.Instruction, idx int) {
+	for _, op := range inst.Operands {
+		if last, ok := g.lastUse[op.ID]; ok && last == idx {
+			g.freeReg(op)
+		}
+	}
+	if _, used := g.lastUse[inst.Result.ID]; !used && hasResult(inst.Op) {
+		g.freeReg(inst.Result)
+	}
+}
+
+// constant returns the pool index of v, adding it to the pool if needed.
+func (g *Generator) constant(v uint64) uint16 {
+	if idx, ok := g.pool[v]; ok {
+		return idx
+	}
+	idx := uint16(len(g.constants))
+	g.pool[v] = idx
+	g.constants = append(g.constants, v)
+	return idx
+}
+
 // emit4 emits a 4-byte instruction: [opcode][a][b][c]
 func (g *Generator) emit4(op byte, a, b, c uint8) {
 	g.code = append(g.code, op, a, b, c)
 }
 
-// emitImm emits an immediate instruction: [opcode][a][imm16]
+// emitImm emits an immediate instruction: [opcode][a][imm16], with the
+// immediate big-endian.
 func (g *Generator) emitImm(op byte, a uint8, imm uint16) {
-	g.code = append(g.code, op, a, byte(imm), byte(imm>>8))
+	g.code = append(g.code, op, a, byte(imm>>8), byte(imm))
 }
 
 // VM opcodes (must match probe-lang/lang/vm/opcodes.go).
@@ -195,57 +406,103 @@ const (
 	vmHalt         byte = 33
 	vmPush         byte = 34
 	vmPop          byte = 35
+	vmSpawn        byte = 36
+	vmSend         byte = 37
+	vmRecv         byte = 38
+	vmSelf         byte = 39
+	vmBalance      byte = 40
+	vmTransfer     byte = 41
+	vmEmit         byte = 42
+	vmCaller       byte = 43
+	vmBlockNum     byte = 44
+	vmBlockTime    byte = 45
+	vmSHA3         byte = 46
+	vmSHAKE256     byte = 47
+	vmFalcon512    byte = 48
+	vmMLDSA        byte = 49
+	vmSLHDSA       byte = 50
+	vmSecp256k1    byte = 51
+	vmResourceNew  byte = 52
+	vmResourceDrop byte = 53
+	vmResourceChk  byte = 54
+	vmArrayNew     byte = 55
+	vmArrayGet     byte = 56
+	vmArraySet     byte = 57
+	vmArrayLen     byte = 58
+	vmRevert       byte = 59
+	vmSLoad        byte = 60
+	vmSStore       byte = 61
 )
 
+// binaryOps maps IR ops to their 3-address VM counterparts.
+var binaryOps = map[ir.Op]byte{
+	ir.OpAdd: vmAdd, ir.OpSub: vmSub, ir.OpMul: vmMul, ir.OpDiv: vmDiv, ir.OpMod: vmMod,
+	ir.OpBitAnd: vmAnd, ir.OpBitOr: vmOr, ir.OpBitXor: vmXor, ir.OpShl: vmShl, ir.OpShr: vmShr,
+	ir.OpEq: vmEq, ir.OpNeq: vmNeq, ir.OpLt: vmLt, ir.OpLte: vmLte, ir.OpGt: vmGt, ir.OpGte: vmGte,
+}
+
+// hasResult reports whether an IR op produces a value.
+func hasResult(op ir.Op) bool {
+	switch op {
+	case ir.OpStore, ir.OpDrop, ir.OpSend, ir.OpTransfer, ir.OpEmit, ir.OpSStore, ir.OpSHA3, ir.OpSHAKE256:
+		return false
+	}
+	return true
+}
+
 func (g *Generator) generateInstruction(inst *ir.Instruction) error {
-	a := g.allocReg(inst.Result)
+	var a uint8
+	if hasResult(inst.Op) {
+		a = g.allocReg(inst.Result)
+	}
+	if op, ok := binaryOps[inst.Op]; ok {
+		g.emit4(op, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
+		return nil
+	}
 
 	switch inst.Op {
-	case ir.OpAdd:
-		g.emit4(vmAdd, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
-	case ir.OpSub:
-		g.emit4(vmSub, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
-	case ir.OpMul:
-		g.emit4(vmMul, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
-	case ir.OpDiv:
-		g.emit4(vmDiv, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
-	case ir.OpMod:
-		g.emit4(vmMod, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
 	case ir.OpNeg:
 		g.emit4(vmNeg, a, g.getReg(inst.Operands[0]), 0)
-
-	case ir.OpBitAnd:
-		g.emit4(vmAnd, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
-	case ir.OpBitOr:
-		g.emit4(vmOr, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
-	case ir.OpBitXor:
-		g.emit4(vmXor, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
 	case ir.OpBitNot:
 		g.emit4(vmNot, a, g.getReg(inst.Operands[0]), 0)
-	case ir.OpShl:
-		g.emit4(vmShl, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
-	case ir.OpShr:
-		g.emit4(vmShr, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
-
-	case ir.OpEq:
-		g.emit4(vmEq, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
-	case ir.OpNeq:
-		g.emit4(vmNeq, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
-	case ir.OpLt:
-		g.emit4(vmLt, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
-	case ir.OpLte:
-		g.emit4(vmLte, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
-	case ir.OpGt:
-		g.emit4(vmGt, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
-	case ir.OpGte:
-		g.emit4(vmGte, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
+
+	case ir.OpLogAnd, ir.OpLogOr:
+		op := vmAnd
+		if inst.Op == ir.OpLogOr {
+			op = vmOr
+		}
+		g.emit4(vmNeq, a, g.getReg(inst.Operands[0]), 0)
+		g.emit4(vmNeq, scratchReg, g.getReg(inst.Operands[1]), 0)
+		g.emit4(op, a, a, scratchReg)
+	case ir.OpLogNot:
+		g.emit4(vmEq, a, g.getReg(inst.Operands[0]), 0)
 
 	case ir.OpConst:
+		if inst.ConstIdx < 0 {
+			return fmt.Errorf("unresolved constant for %s", inst.Result)
+		}
 		g.emitImm(vmLoadConst, a, uint16(inst.ConstIdx))
 	case ir.OpMove:
 		g.emit4(vmMove, a, g.getReg(inst.Operands[0]), 0)
-	case ir.OpCopy:
+	case ir.OpCopy, ir.OpConvert, ir.OpExtend:
 		g.emit4(vmCopy, a, g.getReg(inst.Operands[0]), 0)
+	case ir.OpTruncate:
+		var mask uint64
+		switch inst.Type {
+		case ir.TypeBool:
+			mask = 1
+		case ir.TypeU8:
+			mask = math.MaxUint8
+		case ir.TypeU16:
+			mask = math.MaxUint16
+		case ir.TypeU32:
+			mask = math.MaxUint32
+		default:
+			g.emit4(vmCopy, a, g.getReg(inst.Operands[0]), 0)
+			return nil
+		}
+		g.emitImm(vmLoadConst, scratchReg, g.constant(mask))
+		g.emit4(vmAnd, a, g.getReg(inst.Operands[0]), scratchReg)
 
 	case ir.OpLoad:
 		g.emit4(vmLoadMem, a, g.getReg(inst.Operands[0]), 0)
@@ -253,13 +510,42 @@ func (g *Generator) generateInstruction(inst *ir.Instruction) error {
 		g.emit4(vmStoreMem, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]), 0)
 	case ir.OpAlloc:
 		g.emit4(vmAlloc, a, g.getReg(inst.Operands[0]), 0)
+	case ir.OpFieldPtr:
+		// Fields are 64-bit words: base + 8*idx.
+		base := g.getReg(inst.Operands[0])
+		if inst.FieldIdx == 0 {
+			g.emit4(vmCopy, a, base, 0)
+			break
+		}
+		g.emitImm(vmLoadConst, scratchReg, g.constant(uint64(inst.FieldIdx)*8))
+		g.emit4(vmAdd, a, base, scratchReg)
+	case ir.OpIndexPtr:
+		// Arrays are laid out as [len][elems...]: base + 8*(idx+1).
+		g.emitImm(vmLoadConst, scratchReg, g.constant(3))
+		g.emit4(vmShl, a, g.getReg(inst.Operands[1]), scratchReg)
+		g.emit4(vmAdd, a, a, g.getReg(inst.Operands[0]))
+		g.emitImm(vmLoadConst, scratchReg, g.constant(8))
+		g.emit4(vmAdd, a, a, scratchReg)
+	case ir.OpDrop:
+		g.emit4(vmFree, g.getReg(inst.Operands[0]), 0, 0)
 
 	case ir.OpCall:
-		// Emit push for each argument, then call.
+		// Push the arguments; the VM pops them into the callee's R1..Rn.
 		for _, arg := range inst.Operands {
 			g.emit4(vmPush, g.getReg(arg), 0, 0)
 		}
-		g.emitImm(vmCall, a, 0) // TODO: resolve function index
+		g.patches = append(g.patches, patchEntry{
+			offset: len(g.code),
+			label:  inst.FuncName,
+			call:   true,
+		})
+		g.emitImm(vmCall, a, 0) // patched later
+	case ir.OpFuncRef:
+		// Reserve a pool entry of its own for the offset, known at the end.
+		idx := len(g.constants)
+		g.constants = append(g.constants, 0)
+		g.patches = append(g.patches, patchEntry{offset: idx, label: inst.FuncName, ref: true})
+		g.emitImm(vmLoadConst, a, uint16(idx))
 
 	case ir.OpPhi:
 		// Phi nodes are resolved during register allocation.
@@ -268,6 +554,52 @@ func (g *Generator) generateInstruction(inst *ir.Instruction) error {
 			g.emit4(vmMove, a, g.getReg(inst.Operands[0]), 0)
 		}
 
+	case ir.OpSpawn:
+		g.emit4(vmSpawn, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
+	case ir.OpSend:
+		g.emit4(vmSend, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]), 0)
+	case ir.OpRecv:
+		g.emit4(vmRecv, a, 0, 0)
+	case ir.OpSelf:
+		g.emit4(vmSelf, a, 0, 0)
+
+	case ir.OpBalance:
+		g.emit4(vmBalance, a, g.getReg(inst.Operands[0]), 0)
+	case ir.OpTransfer:
+		g.emit4(vmTransfer, 0, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
+	case ir.OpEmit:
+		g.emit4(vmEmit, g.getReg(inst.Operands[0]), 0, 0)
+	case ir.OpCaller:
+		g.emit4(vmCaller, a, 0, 0)
+	case ir.OpBlockNum:
+		g.emit4(vmBlockNum, a, 0, 0)
+	case ir.OpBlockTime:
+		g.emit4(vmBlockTime, a, 0, 0)
+	case ir.OpSLoad:
+		g.emit4(vmSLoad, a, g.getReg(inst.Operands[0]), 0)
+	case ir.OpSStore:
+		g.emit4(vmSStore, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]), 0)
+
+	case ir.OpSHA3, ir.OpSHAKE256:
+		// Operands: destination, source and length.
+		op := vmSHA3
+		if inst.Op == ir.OpSHAKE256 {
+			op = vmSHAKE256
+		}
+		g.emit4(op, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]), g.getReg(inst.Operands[2]))
+	case ir.OpFalcon512Verify, ir.OpMLDSAVerify, ir.OpSLHDSAVerify:
+		// Operands: message, signature and public key. The public key is
+		// passed in the result register.
+		op := map[ir.Op]byte{
+			ir.OpFalcon512Verify: vmFalcon512,
+			ir.OpMLDSAVerify:     vmMLDSA,
+			ir.OpSLHDSAVerify:    vmSLHDSA,
+		}[inst.Op]
+		g.emit4(vmCopy, a, g.getReg(inst.Operands[2]), 0)
+		g.emit4(op, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
+	case ir.OpSecp256k1Recover:
+		g.emit4(vmSecp256k1, a, g.getReg(inst.Operands[0]), g.getReg(inst.Operands[1]))
+
 	default:
 		return fmt.Errorf("unsupported IR op: %s", inst.Op)
 	}
@@ -275,7 +607,9 @@ func (g *Generator) generateInstruction(inst *ir.Instruction) error {
 	return nil
 }
 
-func (g *Generator) generateTerminator(term ir.Terminator) error {
+// generateTerminator emits the terminator of a block. Branches to next, the
+// block laid out right after it, fall through.
+func (g *Generator) generateTerminator(term ir.Terminator, next *ir.BasicBlock) error {
 	switch t := term.(type) {
 	case *ir.TermReturn:
 		if t.Value != nil {
@@ -284,28 +618,35 @@ func (g *Generator) generateTerminator(term ir.Terminator) error {
 			g.emit4(vmReturn, 0, 0, 0)
 		}
 	case *ir.TermBranch:
-		g.patches = append(g.patches, patchEntry{
-			offset: len(g.code),
-			label:  t.Target.Label,
-		})
-		g.emitImm(vmJump, 0, 0) // patched later
+		if t.Target != next {
+			g.emitJump(vmJump, 0, t.Target)
+		}
 	case *ir.TermCondBranch:
 		// Jump to false block if condition is false.
-		g.patches = append(g.patches, patchEntry{
-			offset: len(g.code),
-			label:  t.FalseBlk.Label,
-		})
-		g.emitImm(vmJumpIfNot, g.getReg(t.Cond), 0)
+		g.emitJump(vmJumpIfNot, g.getReg(t.Cond), t.FalseBlk)
 		// Fall through to true block, or jump.
-		g.patches = append(g.patches, patchEntry{
-			offset: len(g.code),
-			label:  t.TrueBlk.Label,
-		})
-		g.emitImm(vmJump, 0, 0)
+		if t.TrueBlk != next {
+			g.emitJump(vmJump, 0, t.TrueBlk)
+		}
 	case *ir.TermHalt:
 		g.emit4(vmHalt, 0, 0, 0)
+	case *ir.TermRevert:
+		if t.Reason != nil {
+			g.emit4(vmRevert, g.getReg(*t.Reason), 0, 0)
+		} else {
+			g.emit4(vmRevert, 0, 0, 0)
+		}
 	default:
 		return fmt.Errorf("unsupported terminator: %T", term)
 	}
 	return nil
 }
+
+// emitJump emits a jump to a block of the current function, patched later.
+func (g *Generator) emitJump(op byte, a uint8, target *ir.BasicBlock) {
+	g.patches = append(g.patches, patchEntry{
+		offset: len(g.code),
+		label:  g.label(target),
+	})
+	g.emitImm(op, a, 0)
+}
@@ -183,3 +183,43 @@ func TestVerifyTruncatedInstruction(t *testing.T) {
 		t.Error("expected verification errors for truncated instruction")
 	}
 }
+
+func TestLineTable(t *testing.T) {
+	b := ir.NewBuilder()
+	paramA := ir.Value{ID: 0, Type: ir.TypeU64, Name: "a"}
+	b.SetLine(1)
+	b.StartFunction("f", []ir.Value{paramA}, ir.TypeU64)
+	b.SetBlock(b.NewBlock("entry"))
+	b.SetLine(2)
+	sum := b.Emit(ir.OpAdd, b.NewValue(ir.TypeU64, "sum"), paramA, paramA)
+	b.SetLine(3)
+	prod := b.Emit(ir.OpMul, b.NewValue(ir.TypeU64, "prod"), sum, sum)
+	b.EmitReturn(&prod)
+
+	// A generated helper without a source position.
+	b.SetLine(0)
+	b.StartFunction("helper", nil, ir.TypeVoid)
+	b.SetBlock(b.NewBlock("entry"))
+	b.EmitReturn(nil)
+
+	bc, err := New().Generate(b.Program())
+	if err != nil {
+		t.Fatalf("generate failed: %v", err)
+	}
+	// The function's first instruction comes from line 2, so the entry for
+	// its declaration is replaced.
+	want := []LineEntry{{0, 2}, {4, 3}, {bc.Functions[1].Offset, 0}}
+	if len(bc.Lines) != len(want) {
+		t.Fatalf("line table = %v, want %v", bc.Lines, want)
+	}
+	for i := range want {
+		if bc.Lines[i] != want[i] {
+			t.Errorf("line entry %d = %v, want %v", i, bc.Lines[i], want[i])
+		}
+	}
+	for pc, line := range map[int]int{0: 2, 4: 3, 8: 3, bc.Functions[1].Offset: 0, -4: 0} {
+		if got := bc.Line(pc); got != line {
+			t.Errorf("Line(%d) = %d, want %d", pc, got, line)
+		}
+	}
+}
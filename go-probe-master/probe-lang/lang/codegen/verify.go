@@ -60,7 +60,7 @@ func Verify(bc *Bytecode) []VerifyError {
 
 		// For LoadConst, check constant pool bounds.
 		if op == vmLoadConst {
-			constIdx := uint16(bc.Code[offset+2]) | uint16(bc.Code[offset+3])<<8
+			constIdx := uint16(bc.Code[offset+2])<<8 | uint16(bc.Code[offset+3])
 			if int(constIdx) >= len(bc.Constants) {
 				errors = append(errors, VerifyError{
 					Offset:  offset,
@@ -70,8 +70,8 @@ func Verify(bc *Bytecode) []VerifyError {
 		}
 
 		// For jumps, validate target.
-		if op == vmJump || op == vmJumpIf || op == vmJumpIfNot {
-			target := uint16(bc.Code[offset+2]) | uint16(bc.Code[offset+3])<<8
+		if op == vmJump || op == vmJumpIf || op == vmJumpIfNot || op == vmCall {
+			target := uint16(bc.Code[offset+2])<<8 | uint16(bc.Code[offset+3])
 			targetOffset := int(target) * 4
 			if targetOffset < 0 || targetOffset >= len(bc.Code) {
 				errors = append(errors, VerifyError{
@@ -85,10 +85,10 @@ func Verify(bc *Bytecode) []VerifyError {
 	// Check that the last instruction is a terminator.
 	if len(bc.Code) >= 4 {
 		lastOp := bc.Code[len(bc.Code)-4]
-		if lastOp != vmReturn && lastOp != vmHalt && lastOp != vmJump {
+		if lastOp != vmReturn && lastOp != vmHalt && lastOp != vmJump && lastOp != vmRevert {
 			errors = append(errors, VerifyError{
 				Offset:  len(bc.Code) - 4,
-				Message: "function does not end with return, halt, or jump",
+				Message: "function does not end with return, halt, jump or revert",
 			})
 		}
 	}
@@ -97,5 +97,5 @@ func Verify(bc *Bytecode) []VerifyError {
 }
 
 func isValidInstruction(op byte) bool {
-	return op <= vmPop
+	return op <= vmSStore
 }
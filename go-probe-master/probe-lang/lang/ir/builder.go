@@ -10,6 +10,7 @@ type Builder struct {
 	function *Function
 	block    *BasicBlock
 	nextID   int
+	line     int // source line recorded on emitted instructions
 }
 
 // NewBuilder creates a new IR builder.
@@ -44,12 +45,24 @@ func (b *Builder) StartFunction(name string, params []Value, ret TypeRef) *Funct
 		Name:       name,
 		Params:     params,
 		ReturnType: ret,
+		Line:       b.line,
 	}
 	b.function = f
 	b.program.Functions = append(b.program.Functions, f)
 	return f
 }
 
+// SetLine sets the source line recorded on the instructions emitted next;
+// 0 leaves them without a line.
+func (b *Builder) SetLine(line int) {
+	b.line = line
+}
+
+// Line returns the source line recorded on emitted instructions.
+func (b *Builder) Line() int {
+	return b.line
+}
+
 // NewBlock creates a new basic block in the current function.
 func (b *Builder) NewBlock(label string) *BasicBlock {
 	bb := &BasicBlock{Label: label}
@@ -62,6 +75,11 @@ func (b *Builder) SetBlock(bb *BasicBlock) {
 	b.block = bb
 }
 
+// Block returns the current insertion point.
+func (b *Builder) Block() *BasicBlock {
+	return b.block
+}
+
 // NewValue allocates a fresh SSA value.
 func (b *Builder) NewValue(typ TypeRef, name string) Value {
 	v := Value{ID: b.nextID, Type: typ, Name: name}
@@ -76,6 +94,7 @@ func (b *Builder) Emit(op Op, result Value, operands ...Value) Value {
 		Op:       op,
 		Result:   result,
 		Operands: operands,
+		Line:     b.line,
 	}
 	b.block.Instructions = append(b.block.Instructions, inst)
 	return result
@@ -87,6 +106,7 @@ func (b *Builder) EmitConst(result Value, constIdx int) Value {
 		Op:       OpConst,
 		Result:   result,
 		ConstIdx: constIdx,
+		Line:     b.line,
 	}
 	b.block.Instructions = append(b.block.Instructions, inst)
 	return result
@@ -99,6 +119,20 @@ func (b *Builder) EmitCall(result Value, funcName string, args ...Value) Value {
 		Result:   result,
 		FuncName: funcName,
 		Operands: args,
+		Line:     b.line,
+	}
+	b.block.Instructions = append(b.block.Instructions, inst)
+	return result
+}
+
+// EmitFuncRef emits a reference to a function, resolved to its byte offset
+// by code generation.
+func (b *Builder) EmitFuncRef(result Value, funcName string) Value {
+	inst := &Instruction{
+		Op:       OpFuncRef,
+		Result:   result,
+		FuncName: funcName,
+		Line:     b.line,
 	}
 	b.block.Instructions = append(b.block.Instructions, inst)
 	return result
@@ -111,6 +145,7 @@ func (b *Builder) EmitFieldPtr(result Value, base Value, fieldIdx int) Value {
 		Result:   result,
 		Operands: []Value{base},
 		FieldIdx: fieldIdx,
+		Line:     b.line,
 	}
 	b.block.Instructions = append(b.block.Instructions, inst)
 	return result
@@ -145,12 +180,18 @@ func (b *Builder) EmitHalt() {
 	b.block.Terminator = &TermHalt{}
 }
 
+// EmitRevert sets a revert terminator.
+func (b *Builder) EmitRevert(reason *Value) {
+	b.block.Terminator = &TermRevert{Reason: reason}
+}
+
 // EmitPhi creates a phi instruction for merging values at join points.
 func (b *Builder) EmitPhi(result Value, values ...Value) Value {
 	inst := &Instruction{
 		Op:       OpPhi,
 		Result:   result,
 		Operands: values,
+		Line:     b.line,
 	}
 	// Phi instructions go at the start of the block.
 	b.block.Instructions = append([]*Instruction{inst}, b.block.Instructions...)
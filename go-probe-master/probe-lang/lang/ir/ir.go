@@ -30,6 +30,7 @@ type Function struct {
 	ReturnType TypeRef
 	Blocks     []*BasicBlock
 	Locals     int // number of local values allocated
+	Line       int // source line of the declaration, 0 if unknown
 }
 
 // BasicBlock is a straight-line sequence of instructions with a terminator.
@@ -159,6 +160,7 @@ const (
 	// Calls
 	OpCall       // call function
 	OpCallMethod // call method on receiver
+	OpFuncRef    // byte offset of a function
 
 	// Agent operations
 	OpSpawn      // spawn new agent
@@ -173,6 +175,8 @@ const (
 	OpCaller     // get transaction caller
 	OpBlockNum   // get block number
 	OpBlockTime  // get block timestamp
+	OpSLoad      // read contract storage
+	OpSStore     // write contract storage
 
 	// Crypto
 	OpSHA3
@@ -197,10 +201,11 @@ var opNames = map[Op]string{
 	OpAlloc: "alloc", OpLoad: "load", OpStore: "store",
 	OpFieldPtr: "fieldptr", OpIndexPtr: "indexptr",
 	OpConst: "const", OpCopy: "copy", OpMove: "move", OpDrop: "drop", OpPhi: "phi",
-	OpCall: "call", OpCallMethod: "callmethod",
+	OpCall: "call", OpCallMethod: "callmethod", OpFuncRef: "funcref",
 	OpSpawn: "spawn", OpSend: "send", OpRecv: "recv", OpSelf: "self",
 	OpBalance: "balance", OpTransfer: "transfer", OpEmit: "emit",
 	OpCaller: "caller", OpBlockNum: "blocknum", OpBlockTime: "blocktime",
+	OpSLoad: "sload", OpSStore: "sstore",
 	OpSHA3: "sha3", OpSHAKE256: "shake256",
 	OpFalcon512Verify: "falcon512verify", OpMLDSAVerify: "mldsaverify",
 	OpSLHDSAVerify: "slhdsaverify", OpSecp256k1Recover: "ecrecover",
@@ -221,18 +226,25 @@ type Instruction struct {
 	Operands []Value  // source values
 	ConstIdx int      // index into constant pool (for OpConst)
 	FieldIdx int      // field index (for OpFieldPtr)
-	FuncName string   // function name (for OpCall)
+	FuncName string   // function name (for OpCall and OpFuncRef)
 	Type     TypeRef  // type annotation
+	Line     int      // source line, 0 if unknown
 }
 
 func (inst *Instruction) String() string {
 	s := fmt.Sprintf("%s = %s", inst.Result, inst.Op)
+	if inst.Op == OpCall || inst.Op == OpCallMethod || inst.Op == OpFuncRef {
+		s += " @" + inst.FuncName
+	}
 	for _, op := range inst.Operands {
 		s += " " + op.String()
 	}
 	if inst.Op == OpConst {
 		s += fmt.Sprintf(" $%d", inst.ConstIdx)
 	}
+	if inst.Op == OpFieldPtr {
+		s += fmt.Sprintf(" .%d", inst.FieldIdx)
+	}
 	return s
 }
 
@@ -282,3 +294,16 @@ type TermHalt struct{}
 
 func (t *TermHalt) terminator() {}
 func (t *TermHalt) String() string { return "halt" }
+
+// TermRevert aborts execution, discarding its effects.
+type TermRevert struct {
+	Reason *Value // length-prefixed reason string; nil for none
+}
+
+func (t *TermRevert) terminator() {}
+func (t *TermRevert) String() string {
+	if t.Reason != nil {
+		return fmt.Sprintf("revert %s", t.Reason)
+	}
+	return "revert"
+}
@@ -166,3 +166,73 @@ func TestOpString(t *testing.T) {
 		t.Errorf("expected 'sha3', got %q", s)
 	}
 }
+
+func TestConstantFold(t *testing.T) {
+	b := NewBuilder()
+	b.StartFunction("seven", nil, TypeU64)
+	b.SetBlock(b.NewBlock("entry"))
+
+	three := b.NewValue(TypeU64, "three")
+	b.EmitConst(three, b.AddConstant(Constant{Type: TypeU64, Value: int64(3)}))
+	four := b.NewValue(TypeU64, "four")
+	b.EmitConst(four, b.AddConstant(Constant{Type: TypeU64, Value: uint64(4)}))
+	sum := b.NewValue(TypeU64, "sum")
+	b.Emit(OpAdd, sum, three, four)
+	b.EmitReturn(&sum)
+
+	prog := b.Program()
+	fn := prog.Functions[0]
+	ConstantFold(prog, fn)
+
+	inst := fn.Blocks[0].Instructions[2]
+	if inst.Op != OpConst || inst.ConstIdx < 0 {
+		t.Fatalf("sum not folded: %s", inst)
+	}
+	if got := prog.Constants[inst.ConstIdx].Value; got != uint64(7) {
+		t.Errorf("folded value = %v, want 7", got)
+	}
+
+	DeadCodeEliminate(fn)
+	if len(fn.Blocks[0].Instructions) != 1 {
+		t.Errorf("expected operands to be eliminated, got %d instructions", len(fn.Blocks[0].Instructions))
+	}
+}
+
+func TestCommonSubexprCopies(t *testing.T) {
+	b := NewBuilder()
+	x := Value{ID: 100, Type: TypeU64, Name: "x"}
+	b.StartFunction("twice", []Value{x}, TypeU64)
+	b.SetBlock(b.NewBlock("entry"))
+
+	first := b.NewValue(TypeU64, "first")
+	b.Emit(OpMul, first, x, x)
+	second := b.NewValue(TypeU64, "second")
+	b.Emit(OpMul, second, x, x)
+	sum := b.NewValue(TypeU64, "sum")
+	b.Emit(OpAdd, sum, first, second)
+	b.EmitReturn(&sum)
+
+	fn := b.Program().Functions[0]
+	CommonSubexprEliminate(fn)
+
+	inst := fn.Blocks[0].Instructions[1]
+	if inst.Op != OpCopy || inst.Operands[0].ID != first.ID {
+		t.Errorf("second multiply = %s, want a copy of the first", inst)
+	}
+}
+
+func TestDeadCodeKeepsRevertReason(t *testing.T) {
+	b := NewBuilder()
+	b.StartFunction("fail", nil, TypeVoid)
+	b.SetBlock(b.NewBlock("entry"))
+
+	reason := b.NewValue(TypeU64, "reason")
+	b.EmitConst(reason, b.AddConstant(Constant{Type: TypeU64, Value: uint64(8)}))
+	b.EmitRevert(&reason)
+
+	fn := b.Program().Functions[0]
+	DeadCodeEliminate(fn)
+	if len(fn.Blocks[0].Instructions) != 1 {
+		t.Error("revert reason was eliminated")
+	}
+}
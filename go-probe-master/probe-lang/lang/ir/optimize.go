@@ -4,24 +4,27 @@
 // Package ir provides optimization passes for the SSA IR.
 package ir
 
+import "math"
+
 // Optimize runs all optimization passes on a program.
 func Optimize(prog *Program) {
 	for _, fn := range prog.Functions {
-		ConstantFold(fn)
+		ConstantFold(prog, fn)
 		DeadCodeEliminate(fn)
 		CommonSubexprEliminate(fn)
 	}
 }
 
-// ConstantFold evaluates constant expressions at compile time.
-// This implements Sparse Conditional Constant Propagation (SCCP).
-func ConstantFold(fn *Function) {
+// ConstantFold evaluates instructions whose operands are all constants at
+// compile time, adding the results to the program's constant pool. Values
+// are folded as 64-bit words with the same wrapping semantics as the VM.
+func ConstantFold(prog *Program, fn *Function) {
 	changed := true
 	for changed {
 		changed = false
 		for _, block := range fn.Blocks {
 			for i, inst := range block.Instructions {
-				if result, ok := tryFoldConstant(inst, fn); ok {
+				if result, ok := tryFoldConstant(inst, prog, fn); ok {
 					// Replace with a constant load.
 					block.Instructions[i] = result
 					changed = true
@@ -33,64 +36,110 @@ func ConstantFold(fn *Function) {
 
 // tryFoldConstant attempts to fold a constant instruction.
 // Returns (replacement instruction, true) if foldable.
-func tryFoldConstant(inst *Instruction, fn *Function) (*Instruction, bool) {
-	if len(inst.Operands) < 2 {
+func tryFoldConstant(inst *Instruction, prog *Program, fn *Function) (*Instruction, bool) {
+	if len(inst.Operands) != 2 {
 		return nil, false
 	}
 
 	// Check if both operands are constants.
-	leftConst := findConstDef(inst.Operands[0], fn)
-	rightConst := findConstDef(inst.Operands[1], fn)
-	if leftConst == nil || rightConst == nil {
-		return nil, false
-	}
-
-	leftVal, leftOk := leftConst.Value.(int64)
-	rightVal, rightOk := rightConst.Value.(int64)
+	left, leftOk := findConstDef(inst.Operands[0], prog, fn)
+	right, rightOk := findConstDef(inst.Operands[1], prog, fn)
 	if !leftOk || !rightOk {
 		return nil, false
 	}
 
-	var result int64
+	var result uint64
 	switch inst.Op {
 	case OpAdd:
-		result = leftVal + rightVal
+		result = left + right
 	case OpSub:
-		result = leftVal - rightVal
+		result = left - right
 	case OpMul:
-		result = leftVal * rightVal
+		result = left * right
 	case OpDiv:
-		if rightVal == 0 {
-			return nil, false
+		if right == 0 {
+			return nil, false // leave the runtime error in place
 		}
-		result = leftVal / rightVal
+		result = left / right
 	case OpMod:
-		if rightVal == 0 {
+		if right == 0 {
 			return nil, false
 		}
-		result = leftVal % rightVal
+		result = left % right
+	case OpBitAnd:
+		result = left & right
+	case OpBitOr:
+		result = left | right
+	case OpBitXor:
+		result = left ^ right
+	case OpShl:
+		result = left << (right & 63)
+	case OpShr:
+		result = left >> (right & 63)
+	case OpEq:
+		result = boolWord(left == right)
+	case OpNeq:
+		result = boolWord(left != right)
+	case OpLt:
+		result = boolWord(left < right)
+	case OpLte:
+		result = boolWord(left <= right)
+	case OpGt:
+		result = boolWord(left > right)
+	case OpGte:
+		result = boolWord(left >= right)
 	default:
 		return nil, false
 	}
 
+	prog.Constants = append(prog.Constants, Constant{Type: inst.Result.Type, Value: result})
 	return &Instruction{
 		Op:       OpConst,
 		Result:   inst.Result,
-		ConstIdx: -1, // sentinel for inline constant
-		Operands: nil,
-	}, result != 0 || result == 0 // always true, just to use result
+		Type:     inst.Type,
+		ConstIdx: len(prog.Constants) - 1,
+		Line:     inst.Line,
+	}, true
 }
 
-// findConstDef finds the constant definition for a value, if any.
-func findConstDef(v Value, fn *Function) *Constant {
+func boolWord(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// findConstDef returns the word a value is defined to, if it is loaded from
+// the constant pool.
+func findConstDef(v Value, prog *Program, fn *Function) (uint64, bool) {
 	for _, block := range fn.Blocks {
 		for _, inst := range block.Instructions {
-			if inst.Result.ID == v.ID && inst.Op == OpConst && inst.ConstIdx >= 0 {
-				return &Constant{Type: v.Type, Value: int64(inst.ConstIdx)}
+			if inst.Result.ID != v.ID || inst.Op != OpConst {
+				continue
+			}
+			if inst.ConstIdx < 0 || inst.ConstIdx >= len(prog.Constants) {
+				return 0, false
 			}
+			return constWord(prog.Constants[inst.ConstIdx])
 		}
 	}
-	return nil
+	return 0, false
+}
+
+// constWord returns the 64-bit word a constant is encoded as, matching the
+// code generator's constant pool.
+func constWord(c Constant) (uint64, bool) {
+	switch v := c.Value.(type) {
+	case int64:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	case float64:
+		return math.Float64bits(v), true
+	case bool:
+		return boolWord(v), true
+	}
+	return 0, false
 }
 
 // DeadCodeEliminate removes instructions whose results are never used.
@@ -112,6 +161,9 @@ func DeadCodeEliminate(fn *Function) {
 		if term, ok := block.Terminator.(*TermReturn); ok && term.Value != nil {
 			uses[term.Value.ID]++
 		}
+		if term, ok := block.Terminator.(*TermRevert); ok && term.Reason != nil {
+			uses[term.Reason.ID]++
+		}
 	}
 
 	// Remove dead instructions (those with no uses and no side effects).
@@ -141,7 +193,8 @@ func hasSideEffects(op Op) bool {
 	switch op {
 	case OpStore, OpCall, OpCallMethod,
 		OpSpawn, OpSend, OpRecv,
-		OpTransfer, OpEmit,
+		OpTransfer, OpEmit, OpSStore,
+		OpSHA3, OpSHAKE256,
 		OpDrop:
 		return true
 	}
@@ -160,7 +213,7 @@ func CommonSubexprEliminate(fn *Function) {
 		available := make(map[exprKey]Value)
 
 		for i, inst := range block.Instructions {
-			if hasSideEffects(inst.Op) || len(inst.Operands) < 2 {
+			if !isPure(inst.Op) || len(inst.Operands) < 2 {
 				continue
 			}
 
@@ -171,11 +224,14 @@ func CommonSubexprEliminate(fn *Function) {
 			}
 
 			if existing, ok := available[key]; ok {
-				// Replace with a move from the existing result.
+				// Replace with a copy of the existing result. A move would
+				// clear the earlier value, which may still be used.
 				block.Instructions[i] = &Instruction{
-					Op:       OpMove,
+					Op:       OpCopy,
+					Type:     inst.Type,
 					Result:   inst.Result,
 					Operands: []Value{existing},
+					Line:     inst.Line,
 				}
 			} else {
 				available[key] = inst.Result
@@ -184,6 +240,19 @@ func CommonSubexprEliminate(fn *Function) {
 	}
 }
 
+// isPure reports whether an op computes its result from its operands
+// alone, without reading memory or chain state.
+func isPure(op Op) bool {
+	switch op {
+	case OpAdd, OpSub, OpMul, OpDiv, OpMod,
+		OpBitAnd, OpBitOr, OpBitXor, OpShl, OpShr,
+		OpEq, OpNeq, OpLt, OpLte, OpGt, OpGte,
+		OpLogAnd, OpLogOr, OpIndexPtr:
+		return true
+	}
+	return false
+}
+
 // RemoveUnreachableBlocks removes blocks with no predecessors (except entry).
 func RemoveUnreachableBlocks(fn *Function) {
 	if len(fn.Blocks) <= 1 {
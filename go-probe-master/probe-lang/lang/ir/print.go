@@ -0,0 +1,53 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+
+package ir
+
+import (
+	"fmt"
+	"strings"
+)
+
+// String renders the program as text: the constant pool followed by each
+// function.
+func (p *Program) String() string {
+	var sb strings.Builder
+	for i, c := range p.Constants {
+		fmt.Fprintf(&sb, "$%d = %v\n", i, c.Value)
+	}
+	for _, fn := range p.Functions {
+		if sb.Len() > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(fn.String())
+	}
+	return sb.String()
+}
+
+// String renders a function with its blocks, one instruction per line.
+func (f *Function) String() string {
+	var sb strings.Builder
+	params := make([]string, len(f.Params))
+	for i, p := range f.Params {
+		params[i] = p.String()
+	}
+	fmt.Fprintf(&sb, "fn %s(%s) {\n", f.Name, strings.Join(params, ", "))
+	for _, b := range f.Blocks {
+		sb.WriteString(b.String())
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// String renders a block's label, instructions and terminator.
+func (b *BasicBlock) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s:\n", b.Label)
+	for _, inst := range b.Instructions {
+		fmt.Fprintf(&sb, "  %s\n", inst)
+	}
+	if b.Terminator != nil {
+		fmt.Fprintf(&sb, "  %s\n", b.Terminator)
+	}
+	return sb.String()
+}
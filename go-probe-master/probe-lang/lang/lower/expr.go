@@ -0,0 +1,1459 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package lower
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+
+	"github.com/probechain/go-probe/probe-lang/lang/ast"
+	"github.com/probechain/go-probe/probe-lang/lang/ir"
+	"github.com/probechain/go-probe/probe-lang/lang/token"
+)
+
+// strEqName is the generated helper comparing two strings or byte buffers.
+// The '$' keeps it out of the user's namespace.
+const strEqName = "$streq"
+
+// dispatchName is the generated message dispatcher of an agent, qualified
+// with the agent name.
+const dispatchName = "$dispatch"
+
+// unit is the result of expressions that produce no value.
+var unit = ir.Value{ID: -1}
+
+func isUnit(v ir.Value) bool { return v.ID < 0 }
+
+var (
+	shapeU64     = &shape{name: "u64"}
+	shapeF64     = &shape{name: "f64"}
+	shapeBool    = &shape{name: "bool"}
+	shapeString  = &shape{name: "string"}
+	shapeBytes   = &shape{name: "bytes"}
+	shapeAddress = &shape{name: "address"}
+)
+
+var binaryOps = map[string]ir.Op{
+	"+": ir.OpAdd, "-": ir.OpSub, "*": ir.OpMul, "/": ir.OpDiv, "%": ir.OpMod,
+	"&": ir.OpBitAnd, "|": ir.OpBitOr, "^": ir.OpBitXor, "<<": ir.OpShl, ">>": ir.OpShr,
+	"==": ir.OpEq, "!=": ir.OpNeq, "<": ir.OpLt, "<=": ir.OpLte, ">": ir.OpGt, ">=": ir.OpGte,
+}
+
+// intrinsics are the chain and crypto builtins, callable qualified or bare.
+var intrinsics = map[string]ir.Op{
+	"chain::caller":          ir.OpCaller,
+	"chain::block_number":    ir.OpBlockNum,
+	"chain::block_timestamp": ir.OpBlockTime,
+	"chain::balance":         ir.OpBalance,
+	"chain::transfer":        ir.OpTransfer,
+	"chain::storage_load":    ir.OpSLoad,
+	"chain::storage_store":   ir.OpSStore,
+	"crypto::sha3":           ir.OpSHA3,
+	"crypto::shake256":       ir.OpSHAKE256,
+
+	"crypto::falcon512_verify": ir.OpFalcon512Verify,
+	"crypto::ml_dsa_verify":    ir.OpMLDSAVerify,
+	"crypto::slh_dsa_verify":   ir.OpSLHDSAVerify,
+}
+
+// ---------------------------------------------------------------------------
+// Functions
+// ---------------------------------------------------------------------------
+
+// begin starts a function declared at the given source line, 0 for
+// generated helpers, and resets the per-function state.
+func (l *lowerer) begin(name string, ret ir.TypeRef, line int) *ir.Function {
+	l.b.SetLine(line)
+	l.slots = 0
+	l.scopes = nil
+	l.loops = nil
+	l.blocks = 0
+	l.dead = make(map[*ir.BasicBlock]bool)
+	f := l.b.StartFunction(name, nil, ret)
+	l.frame = l.b.NewValue(ir.TypeU64, "")
+	l.b.SetBlock(l.b.NewBlock("entry"))
+	return f
+}
+
+// finish allocates the frame on entry, now that the number of slots is
+// known, and drops unreachable blocks.
+func (l *lowerer) finish(f *ir.Function) {
+	if l.slots > 0 {
+		size := l.b.NewValue(ir.TypeU64, "")
+		entry := f.Blocks[0]
+		entry.Instructions = append([]*ir.Instruction{
+			{Op: ir.OpConst, Result: size, ConstIdx: l.constIndex(ir.TypeU64, int64(8*l.slots)), Line: f.Line},
+			{Op: ir.OpAlloc, Result: l.frame, Operands: []ir.Value{size}, Line: f.Line},
+		}, entry.Instructions...)
+	}
+	ir.RemoveUnreachableBlocks(f)
+}
+
+func (l *lowerer) lowerFunction(fn *function) {
+	l.fn = fn
+	f := l.begin(fn.name, l.typeOf(fn.ret, fn.module), fn.pos.Line)
+	l.push()
+	if fn.self != nil {
+		v := l.b.NewValue(l.irType(fn.self), "self")
+		f.Params = append(f.Params, v)
+		l.bind("self", false, v, fn.self)
+	}
+	for i, p := range fn.params {
+		v := l.b.NewValue(l.irType(fn.paramShapes[i]), p.Name)
+		f.Params = append(f.Params, v)
+		l.bind(p.Name, p.Mutable, v, fn.paramShapes[i])
+	}
+	val, _ := l.block(fn.body)
+	if !l.terminated() {
+		if fn.ret != nil {
+			v := l.need(val)
+			l.b.EmitReturn(&v)
+		} else {
+			l.b.EmitReturn(nil)
+		}
+	}
+	l.pop()
+	l.finish(f)
+}
+
+// lowerStrEq emits the helper comparing two [len][bytes...] buffers.
+func (l *lowerer) lowerStrEq() {
+	l.fn = &function{name: strEqName}
+	f := l.begin(strEqName, ir.TypeBool, 0)
+	a := l.b.NewValue(ir.TypeString, "a")
+	b := l.b.NewValue(ir.TypeString, "b")
+	f.Params = []ir.Value{a, b}
+
+	differ := l.newBlock("differ")
+	n := l.load(a)
+	l.test(l.emit(ir.OpEq, ir.TypeBool, n, l.load(b)), l.newBlock("same"), differ)
+	words := l.emit(ir.OpShr, ir.TypeU64, l.emit(ir.OpAdd, ir.TypeU64, n, l.intConst(7)), l.intConst(3))
+	l.loopRange(l.intConst(0), words, func(i ir.Value) {
+		x := l.load(l.emit(ir.OpIndexPtr, ir.TypeU64, a, i))
+		y := l.load(l.emit(ir.OpIndexPtr, ir.TypeU64, b, i))
+		l.test(l.emit(ir.OpEq, ir.TypeBool, x, y), l.newBlock("word"), differ)
+	})
+	t := l.boolConst(true)
+	l.b.EmitReturn(&t)
+
+	l.b.SetBlock(differ)
+	v := l.boolConst(false)
+	l.b.EmitReturn(&v)
+	l.finish(f)
+}
+
+// lowerDispatch emits the dispatcher of an agent, which calls the handler
+// selected by the first word of a message with the state and the remaining
+// words as arguments.
+func (l *lowerer) lowerDispatch(name string, ag *agent) {
+	for i, f := range ag.state.fields {
+		if !l.isWord(ag.state.shapes[i]) {
+			l.errorf(f.Token.Pos, "agent %s state field %s must be a word value, not a reference", name, f.Name)
+		}
+	}
+	q := name + "::" + dispatchName
+	l.fn = &function{name: q}
+	f := l.begin(q, ir.TypeVoid, 0)
+	self := l.b.NewValue(ag.state.ref, "self")
+	msg := l.b.NewValue(ir.TypeU64, "msg")
+	f.Params = []ir.Value{self, msg}
+
+	idx := l.load(l.fieldPtr(msg, 1))
+	for i, h := range ag.handlers {
+		fn := l.funcs[name+"::"+h]
+		for j, p := range fn.params {
+			if !l.isWord(fn.paramShapes[j]) {
+				l.errorf(fn.pos, "message handler %s parameter %s must be a word value, not a reference", fn.name, p.Name)
+			}
+		}
+		next := l.newBlock("next")
+		l.test(l.emit(ir.OpEq, ir.TypeBool, idx, l.intConst(int64(i))), l.newBlock("handler"), next)
+		args := []ir.Value{self}
+		for j := range fn.params {
+			args = append(args, l.load(l.fieldPtr(msg, 2+j)))
+		}
+		l.b.EmitCall(l.b.NewValue(l.typeOf(fn.ret, fn.module), ""), fn.name, args...)
+		l.b.EmitReturn(nil)
+		l.b.SetBlock(next)
+	}
+	l.revert("unknown message")
+	l.finish(f)
+}
+
+// ---------------------------------------------------------------------------
+// Emission helpers
+// ---------------------------------------------------------------------------
+
+func (l *lowerer) constIndex(typ ir.TypeRef, v interface{}) int {
+	key := constKey{typ: typ, value: v}
+	if idx, ok := l.consts[key]; ok {
+		return idx
+	}
+	idx := l.b.AddConstant(ir.Constant{Type: typ, Value: v})
+	l.consts[key] = idx
+	return idx
+}
+
+func (l *lowerer) constant(typ ir.TypeRef, v interface{}) ir.Value {
+	return l.b.EmitConst(l.b.NewValue(typ, ""), l.constIndex(typ, v))
+}
+
+func (l *lowerer) intConst(v int64) ir.Value {
+	return l.constant(ir.TypeU64, v)
+}
+
+func (l *lowerer) boolConst(v bool) ir.Value {
+	if v {
+		return l.constant(ir.TypeBool, int64(1))
+	}
+	return l.constant(ir.TypeBool, int64(0))
+}
+
+func (l *lowerer) emit(op ir.Op, typ ir.TypeRef, operands ...ir.Value) ir.Value {
+	return l.b.Emit(op, l.b.NewValue(typ, ""), operands...)
+}
+
+func (l *lowerer) load(ptr ir.Value) ir.Value {
+	return l.emit(ir.OpLoad, ir.TypeU64, ptr)
+}
+
+func (l *lowerer) store(ptr, v ir.Value) {
+	l.emit(ir.OpStore, ir.TypeVoid, ptr, v)
+}
+
+func (l *lowerer) fieldPtr(base ir.Value, idx int) ir.Value {
+	return l.b.EmitFieldPtr(l.b.NewValue(ir.TypeU64, ""), base, idx)
+}
+
+// alloc allocates a zeroed buffer of the given number of words.
+func (l *lowerer) alloc(words int) ir.Value {
+	if words < 1 {
+		words = 1
+	}
+	return l.emit(ir.OpAlloc, ir.TypeU64, l.intConst(int64(8*words)))
+}
+
+// allocWords allocates a zeroed buffer of a dynamic number of words.
+func (l *lowerer) allocWords(words ir.Value) ir.Value {
+	return l.emit(ir.OpAlloc, ir.TypeU64, l.emit(ir.OpShl, ir.TypeU64, words, l.intConst(3)))
+}
+
+// bytes materializes a [len][bytes...] buffer.
+func (l *lowerer) bytes(data []byte) ir.Value {
+	words := (len(data) + 7) / 8
+	ptr := l.alloc(1 + words)
+	l.store(ptr, l.intConst(int64(len(data))))
+	for i := 0; i < words; i++ {
+		var chunk [8]byte
+		copy(chunk[:], data[i*8:])
+		if w := binary.LittleEndian.Uint64(chunk[:]); w != 0 {
+			l.store(l.fieldPtr(ptr, 1+i), l.intConst(int64(w)))
+		}
+	}
+	return ptr
+}
+
+// at records the source line of n on the instructions emitted next and
+// returns a function restoring the previous line.
+func (l *lowerer) at(n ast.Node) func() {
+	prev := l.b.Line()
+	if line := ast.Pos(n).Line; line > 0 {
+		l.b.SetLine(line)
+	}
+	return func() { l.b.SetLine(prev) }
+}
+
+func (l *lowerer) newSlot() int {
+	l.slots++
+	return l.slots - 1
+}
+
+func (l *lowerer) slotPtr(slot int) ir.Value {
+	return l.fieldPtr(l.frame, slot)
+}
+
+// newBlock creates a block with a unique label. Blocks created while
+// lowering unreachable code are unreachable too.
+func (l *lowerer) newBlock(kind string) *ir.BasicBlock {
+	l.blocks++
+	bb := l.b.NewBlock(fmt.Sprintf("%s%d", kind, l.blocks))
+	if l.isDead() {
+		l.dead[bb] = true
+	}
+	return bb
+}
+
+func (l *lowerer) terminated() bool {
+	return l.b.Block().Terminator != nil
+}
+
+func (l *lowerer) isDead() bool {
+	return l.dead[l.b.Block()]
+}
+
+// diverge continues lowering in a fresh unreachable block after a return,
+// break or continue.
+func (l *lowerer) diverge() {
+	bb := l.newBlock("dead")
+	l.dead[bb] = true
+	l.b.SetBlock(bb)
+}
+
+func (l *lowerer) jump(target *ir.BasicBlock) {
+	if !l.terminated() {
+		l.b.EmitBranch(target)
+	}
+}
+
+// test continues in ok when cond holds and branches to fail otherwise.
+func (l *lowerer) test(cond ir.Value, ok, fail *ir.BasicBlock) {
+	l.b.EmitCondBranch(cond, ok, fail)
+	l.b.SetBlock(ok)
+}
+
+// revert aborts with a constant reason.
+func (l *lowerer) revert(reason string) {
+	r := l.bytes([]byte(reason))
+	l.b.EmitRevert(&r)
+}
+
+// loopRange emits a loop over [start, end), calling body with the index.
+// continue inside body advances to the next index.
+func (l *lowerer) loopRange(start, end ir.Value, body func(i ir.Value)) {
+	slot := l.newSlot()
+	l.store(l.slotPtr(slot), start)
+	cond := l.newBlock("for")
+	blk := l.newBlock("body")
+	step := l.newBlock("next")
+	exit := l.newBlock("endfor")
+	l.jump(cond)
+
+	l.b.SetBlock(cond)
+	l.b.EmitCondBranch(l.emit(ir.OpLt, ir.TypeBool, l.load(l.slotPtr(slot)), end), blk, exit)
+
+	l.b.SetBlock(blk)
+	l.loops = append(l.loops, loop{cont: step, exit: exit})
+	body(l.load(l.slotPtr(slot)))
+	l.loops = l.loops[:len(l.loops)-1]
+	l.jump(step)
+
+	l.b.SetBlock(step)
+	ptr := l.slotPtr(slot)
+	l.store(ptr, l.emit(ir.OpAdd, ir.TypeU64, l.load(ptr), l.intConst(1)))
+	l.jump(cond)
+
+	l.b.SetBlock(exit)
+}
+
+// ---------------------------------------------------------------------------
+// Scopes
+// ---------------------------------------------------------------------------
+
+func (l *lowerer) push() {
+	l.scopes = append(l.scopes, make(map[string]*local))
+}
+
+func (l *lowerer) pop() {
+	l.scopes = l.scopes[:len(l.scopes)-1]
+}
+
+func (l *lowerer) lookup(name string) *local {
+	for i := len(l.scopes) - 1; i >= 0; i-- {
+		if loc, ok := l.scopes[i][name]; ok {
+			return loc
+		}
+	}
+	return nil
+}
+
+// bind introduces a binding. Mutable bindings get a frame slot.
+func (l *lowerer) bind(name string, mutable bool, v ir.Value, sh *shape) {
+	loc := &local{val: v, slot: -1, mutable: mutable, shape: sh}
+	if mutable {
+		loc.slot = l.newSlot()
+		l.store(l.slotPtr(loc.slot), v)
+	}
+	l.scopes[len(l.scopes)-1][name] = loc
+}
+
+func (l *lowerer) read(loc *local) ir.Value {
+	if loc.slot >= 0 {
+		return l.load(l.slotPtr(loc.slot))
+	}
+	return loc.val
+}
+
+// ---------------------------------------------------------------------------
+// Statements
+// ---------------------------------------------------------------------------
+
+func (l *lowerer) block(b *ast.BlockExpr) (ir.Value, *shape) {
+	if b == nil {
+		return unit, nil
+	}
+	l.push()
+	defer l.pop()
+	for _, s := range b.Statements {
+		l.stmt(s)
+	}
+	if b.Tail != nil {
+		return l.expr(b.Tail)
+	}
+	return unit, nil
+}
+
+func (l *lowerer) stmt(s ast.Statement) {
+	defer l.at(s)()
+	switch s := s.(type) {
+	case *ast.LetStmt:
+		sh := l.shapeOf(s.Type, l.fn.module)
+		if s.Value == nil {
+			// Declaration only: zero-initialised and assignable.
+			l.bind(s.Name.Value, true, l.intConst(0), sh)
+			return
+		}
+		v, vs := l.value(s.Value)
+		if sh == nil {
+			sh = vs
+		}
+		l.bind(s.Name.Value, s.Mutable, v, sh)
+
+	case *ast.AssignStmt:
+		l.assign(s)
+
+	case *ast.ReturnStmt:
+		if s.Value != nil {
+			v, _ := l.value(s.Value)
+			l.b.EmitReturn(&v)
+		} else {
+			l.b.EmitReturn(nil)
+		}
+		l.diverge()
+
+	case *ast.ExprStmt:
+		l.expr(s.Expression)
+
+	case *ast.ForStmt:
+		l.forStmt(s)
+
+	case *ast.WhileStmt:
+		cond := l.newBlock("while")
+		body := l.newBlock("do")
+		exit := l.newBlock("endwhile")
+		l.jump(cond)
+		l.b.SetBlock(cond)
+		c, _ := l.value(s.Condition)
+		l.b.EmitCondBranch(c, body, exit)
+		l.b.SetBlock(body)
+		l.loops = append(l.loops, loop{cont: cond, exit: exit})
+		l.block(s.Body)
+		l.loops = l.loops[:len(l.loops)-1]
+		l.jump(cond)
+		l.b.SetBlock(exit)
+
+	case *ast.BreakStmt:
+		if len(l.loops) == 0 {
+			l.errorf(s.Token.Pos, "break outside of a loop")
+			return
+		}
+		l.b.EmitBranch(l.loops[len(l.loops)-1].exit)
+		l.diverge()
+
+	case *ast.ContinueStmt:
+		if len(l.loops) == 0 {
+			l.errorf(s.Token.Pos, "continue outside of a loop")
+			return
+		}
+		l.b.EmitBranch(l.loops[len(l.loops)-1].cont)
+		l.diverge()
+
+	case *ast.DropStmt:
+		loc := l.lookup(s.Value.Value)
+		if loc == nil {
+			l.errorf(s.Value.Token.Pos, "undefined: %s", s.Value.Value)
+			return
+		}
+		l.emit(ir.OpDrop, ir.TypeVoid, l.read(loc))
+
+	case *ast.EmitStmt:
+		l.emitEvent(s)
+
+	case *ast.RequireStmt:
+		c, _ := l.value(s.Condition)
+		ok := l.newBlock("require")
+		fail := l.newBlock("fail")
+		l.b.EmitCondBranch(c, ok, fail)
+		l.b.SetBlock(fail)
+		if s.Message != nil {
+			msg, _ := l.value(s.Message)
+			l.b.EmitRevert(&msg)
+		} else {
+			l.b.EmitRevert(nil)
+		}
+		l.b.SetBlock(ok)
+
+	default:
+		l.errorf(ast.Pos(s), "unsupported statement %T", s)
+	}
+}
+
+func (l *lowerer) assign(s *ast.AssignStmt) {
+	ptr, _, ok := l.place(s.Target)
+	if !ok {
+		return
+	}
+	v, _ := l.value(s.Value)
+	if s.Operator != "=" {
+		op, ok := binaryOps[strings.TrimSuffix(s.Operator, "=")]
+		if !ok {
+			l.errorf(s.Token.Pos, "unsupported assignment operator %s", s.Operator)
+			return
+		}
+		v = l.emit(op, ir.TypeU64, l.load(ptr), v)
+	}
+	l.store(ptr, v)
+}
+
+// place returns a pointer to the storage an assignable expression names.
+func (l *lowerer) place(e ast.Expression) (ir.Value, *shape, bool) {
+	switch e := e.(type) {
+	case *ast.Ident:
+		loc := l.lookup(e.Value)
+		if loc == nil {
+			l.errorf(e.Token.Pos, "undefined: %s", e.Value)
+			return unit, nil, false
+		}
+		if loc.slot < 0 {
+			l.errorf(e.Token.Pos, "cannot assign to immutable binding %s", e.Value)
+			return unit, nil, false
+		}
+		return l.slotPtr(loc.slot), loc.shape, true
+
+	case *ast.FieldExpr:
+		obj, sh := l.value(e.Object)
+		idx, fsh, ok := l.field(sh, e.Field, e.Token.Pos)
+		if !ok {
+			return unit, nil, false
+		}
+		return l.fieldPtr(obj, idx), fsh, true
+
+	case *ast.IndexExpr:
+		arr, sh := l.value(e.Left)
+		if isText(sh) {
+			l.errorf(e.Token.Pos, "cannot assign to a byte of %s", sh.name)
+			return unit, nil, false
+		}
+		idx, _ := l.value(e.Index)
+		var elem *shape
+		if sh != nil {
+			elem = sh.elem
+		}
+		return l.indexPtr(arr, idx), elem, true
+
+	case *ast.PrefixExpr:
+		if e.Operator == "*" {
+			ptr, sh := l.value(e.Right)
+			return ptr, sh, true
+		}
+	}
+	l.errorf(ast.Pos(e), "invalid assignment target %s", e)
+	return unit, nil, false
+}
+
+// field resolves a field of the aggregate a shape names. Without a shape,
+// the field must be declared by exactly one aggregate.
+func (l *lowerer) field(sh *shape, name string, pos token.Position) (int, *shape, bool) {
+	if sh != nil && sh.handle {
+		l.errorf(pos, "cannot access field %s of agent handle %s; send it a message", name, sh.name)
+		return 0, nil, false
+	}
+	var agg *aggregate
+	if sh != nil {
+		agg = l.structs[sh.name]
+	}
+	if agg == nil {
+		for _, cand := range l.structs {
+			if cand.field(name) < 0 {
+				continue
+			}
+			if agg != nil {
+				l.errorf(pos, "ambiguous field %s", name)
+				return 0, nil, false
+			}
+			agg = cand
+		}
+	}
+	if agg == nil || agg.field(name) < 0 {
+		l.errorf(pos, "unknown field %s", name)
+		return 0, nil, false
+	}
+	idx := agg.field(name)
+	return idx, agg.shapes[idx], true
+}
+
+// indexPtr returns a pointer to element idx of an array, reverting when the
+// index is out of bounds.
+func (l *lowerer) indexPtr(arr, idx ir.Value) ir.Value {
+	l.boundsCheck(idx, l.load(arr))
+	return l.emit(ir.OpIndexPtr, ir.TypeU64, arr, idx)
+}
+
+func (l *lowerer) boundsCheck(idx, n ir.Value) {
+	l.check(l.emit(ir.OpLt, ir.TypeBool, idx, n), "index out of bounds")
+}
+
+// check reverts with reason unless cond holds.
+func (l *lowerer) check(cond ir.Value, reason string) {
+	ok := l.newBlock("ok")
+	fail := l.newBlock("fail")
+	l.b.EmitCondBranch(cond, ok, fail)
+	l.b.SetBlock(fail)
+	l.revert(reason)
+	l.b.SetBlock(ok)
+}
+
+func (l *lowerer) forStmt(s *ast.ForStmt) {
+	var start, end ir.Value
+	var elem func(i ir.Value) (ir.Value, *shape)
+	if r, ok := s.Iterable.(*ast.RangeExpr); ok {
+		start, end = l.rangeBounds(r)
+		elem = func(i ir.Value) (ir.Value, *shape) { return i, shapeU64 }
+	} else {
+		arr, sh := l.value(s.Iterable)
+		start, end = l.intConst(0), l.load(arr)
+		elem = func(i ir.Value) (ir.Value, *shape) {
+			if isText(sh) {
+				return l.byteAt(arr, i), shapeU64
+			}
+			var esh *shape
+			if sh != nil {
+				esh = sh.elem
+			}
+			return l.load(l.emit(ir.OpIndexPtr, ir.TypeU64, arr, i)), esh
+		}
+	}
+	l.loopRange(start, end, func(i ir.Value) {
+		l.push()
+		v, sh := elem(i)
+		l.bind(s.Binding.Value, false, v, sh)
+		l.block(s.Body)
+		l.pop()
+	})
+}
+
+func (l *lowerer) rangeBounds(r *ast.RangeExpr) (ir.Value, ir.Value) {
+	start := l.intConst(0)
+	if r.Start != nil {
+		start, _ = l.value(r.Start)
+	}
+	if r.End == nil {
+		l.errorf(r.Token.Pos, "range needs an upper bound")
+		return start, start
+	}
+	end, _ := l.value(r.End)
+	return start, end
+}
+
+// byteAt extracts byte i of a [len][bytes...] buffer.
+func (l *lowerer) byteAt(buf, i ir.Value) ir.Value {
+	word := l.load(l.emit(ir.OpIndexPtr, ir.TypeU64, buf, l.emit(ir.OpShr, ir.TypeU64, i, l.intConst(3))))
+	shift := l.emit(ir.OpShl, ir.TypeU64, l.emit(ir.OpBitAnd, ir.TypeU64, i, l.intConst(7)), l.intConst(3))
+	return l.emit(ir.OpBitAnd, ir.TypeU64, l.emit(ir.OpShr, ir.TypeU64, word, shift), l.intConst(0xff))
+}
+
+func (l *lowerer) emitEvent(s *ast.EmitStmt) {
+	names := make([]string, 0, len(s.Fields))
+	for name := range s.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// Events are word arrays [n][id][fields...] so the VM can read them.
+	ev := l.alloc(2 + len(names))
+	l.store(ev, l.intConst(int64(1+len(names))))
+	l.store(l.fieldPtr(ev, 1), l.intConst(eventID(s.Event)))
+	for i, name := range names {
+		v, _ := l.value(s.Fields[name])
+		l.store(l.fieldPtr(ev, 2+i), v)
+	}
+	l.emit(ir.OpEmit, ir.TypeVoid, ev)
+}
+
+// eventID derives an event's tag word from the first 8 bytes of the
+// Keccak-256 hash of its name.
+func eventID(name string) int64 {
+	h := sha3.NewLegacyKeccak256()
+	h.Write([]byte(name))
+	return int64(binary.BigEndian.Uint64(h.Sum(nil)[:8]))
+}
+
+// ---------------------------------------------------------------------------
+// Expressions
+// ---------------------------------------------------------------------------
+
+// value lowers an expression that must produce a value.
+func (l *lowerer) value(e ast.Expression) (ir.Value, *shape) {
+	v, sh := l.expr(e)
+	return l.need(v), sh
+}
+
+func (l *lowerer) need(v ir.Value) ir.Value {
+	if isUnit(v) {
+		return l.intConst(0)
+	}
+	return v
+}
+
+func (l *lowerer) expr(e ast.Expression) (ir.Value, *shape) {
+	defer l.at(e)()
+	switch e := e.(type) {
+	case *ast.IntLiteral:
+		return l.intConst(e.Value), shapeU64
+	case *ast.FloatLiteral:
+		return l.constant(ir.TypeF64, e.Value), shapeF64
+	case *ast.BoolLiteral:
+		return l.boolConst(e.Value), shapeBool
+	case *ast.NilLiteral:
+		return l.intConst(0), nil
+	case *ast.StringLiteral:
+		s, err := unescape(e.Value)
+		if err != nil {
+			l.errorf(e.Token.Pos, "%v", err)
+		}
+		return l.bytes([]byte(s)), shapeString
+	case *ast.BytesLiteral:
+		return l.bytes(e.Value), shapeBytes
+	case *ast.AddressLiteral:
+		return l.address(e), shapeAddress
+	case *ast.Ident:
+		return l.ident(e)
+	case *ast.PrefixExpr:
+		return l.prefix(e)
+	case *ast.InfixExpr:
+		return l.infix(e)
+	case *ast.IndexExpr:
+		arr, sh := l.value(e.Left)
+		idx, _ := l.value(e.Index)
+		if isText(sh) {
+			l.boundsCheck(idx, l.load(arr))
+			return l.byteAt(arr, idx), shapeU64
+		}
+		var elem *shape
+		if sh != nil {
+			elem = sh.elem
+		}
+		return l.load(l.indexPtr(arr, idx)), elem
+	case *ast.FieldExpr:
+		obj, sh := l.value(e.Object)
+		idx, fsh, ok := l.field(sh, e.Field, e.Token.Pos)
+		if !ok {
+			return l.intConst(0), nil
+		}
+		return l.load(l.fieldPtr(obj, idx)), fsh
+	case *ast.CallExpr:
+		return l.call(e)
+	case *ast.MethodCallExpr:
+		return l.methodCall(e)
+	case *ast.BlockExpr:
+		return l.block(e)
+	case *ast.IfExpr:
+		return l.ifExpr(e)
+	case *ast.MatchExpr:
+		return l.match(e)
+	case *ast.RangeExpr:
+		return l.rangeArray(e)
+	case *ast.ArrayExpr:
+		arr := l.alloc(1 + len(e.Elements))
+		l.store(arr, l.intConst(int64(len(e.Elements))))
+		var elem *shape
+		for i, el := range e.Elements {
+			v, sh := l.value(el)
+			if i == 0 {
+				elem = sh
+			}
+			l.store(l.fieldPtr(arr, 1+i), v)
+		}
+		return arr, &shape{name: "[]", elem: elem}
+	case *ast.MoveExpr:
+		v, sh := l.value(e.Value)
+		return l.emit(ir.OpMove, l.irType(sh), v), sh
+	case *ast.CopyExpr:
+		v, sh := l.value(e.Value)
+		return l.copyValue(v, sh), sh
+	case *ast.SpawnExpr:
+		return l.spawn(e)
+	case *ast.SendExpr:
+		l.send(e)
+		return unit, nil
+	case *ast.RecvExpr:
+		return l.emit(ir.OpRecv, ir.TypeU64), nil
+	}
+	l.errorf(ast.Pos(e), "unsupported expression %T", e)
+	return unit, nil
+}
+
+func (l *lowerer) ident(e *ast.Ident) (ir.Value, *shape) {
+	if loc := l.lookup(e.Value); loc != nil {
+		return l.read(loc), loc.shape
+	}
+	if v := l.lookupVariant(e.Value, nil); v != nil {
+		if len(v.fields) > 0 {
+			l.errorf(e.Token.Pos, "variant %s takes %d arguments", v.name, len(v.fields))
+		}
+		return l.unitVariant(v), &shape{name: v.enum.name}
+	}
+	l.errorf(e.Token.Pos, "undefined: %s", e.Value)
+	return l.intConst(0), nil
+}
+
+func (l *lowerer) unitVariant(v *variant) ir.Value {
+	tag := l.intConst(int64(v.tag))
+	if !v.enum.boxed {
+		return tag
+	}
+	box := l.alloc(1)
+	l.store(box, tag)
+	return box
+}
+
+// address materializes an address literal as the VM's address buffer: the
+// 20 bytes as three little-endian words, zero-padded.
+func (l *lowerer) address(e *ast.AddressLiteral) ir.Value {
+	digits := strings.TrimPrefix(strings.TrimPrefix(e.Value, "@"), "0x")
+	if len(digits)%2 == 1 {
+		digits = "0" + digits
+	}
+	raw, err := hex.DecodeString(digits)
+	if err != nil {
+		l.errorf(e.Token.Pos, "invalid address literal %s", e.Value)
+	}
+	var buf [24]byte
+	if len(raw) > 20 {
+		raw = raw[len(raw)-20:]
+	}
+	copy(buf[20-len(raw):], raw)
+	ptr := l.alloc(3)
+	for i := 0; i < 3; i++ {
+		if w := binary.LittleEndian.Uint64(buf[8*i:]); w != 0 {
+			l.store(l.fieldPtr(ptr, i), l.intConst(int64(w)))
+		}
+	}
+	return ptr
+}
+
+// addressEq compares two address buffers word by word.
+func (l *lowerer) addressEq(a, b ir.Value) ir.Value {
+	eq := l.emit(ir.OpEq, ir.TypeBool, l.load(a), l.load(b))
+	for i := 1; i < 3; i++ {
+		w := l.emit(ir.OpEq, ir.TypeBool, l.load(l.fieldPtr(a, i)), l.load(l.fieldPtr(b, i)))
+		eq = l.emit(ir.OpBitAnd, ir.TypeBool, eq, w)
+	}
+	return eq
+}
+
+func (l *lowerer) prefix(e *ast.PrefixExpr) (ir.Value, *shape) {
+	switch e.Operator {
+	case "&":
+		return l.addressOf(e.Right)
+	case "*":
+		v, sh := l.value(e.Right)
+		if l.isAggregate(sh) {
+			// References to aggregates are the aggregate pointer itself.
+			return v, sh
+		}
+		return l.load(v), sh
+	}
+	v, sh := l.value(e.Right)
+	switch e.Operator {
+	case "-":
+		return l.emit(ir.OpNeg, l.irType(sh), v), sh
+	case "!":
+		return l.emit(ir.OpLogNot, ir.TypeBool, v), shapeBool
+	case "~":
+		return l.emit(ir.OpBitNot, l.irType(sh), v), sh
+	case "#":
+		return l.load(v), shapeU64
+	}
+	l.errorf(e.Token.Pos, "unsupported operator %s", e.Operator)
+	return v, sh
+}
+
+// addressOf lowers &x. Aggregates are already references; scalars yield a
+// pointer to their storage, spilling immutable values to a fresh slot.
+func (l *lowerer) addressOf(e ast.Expression) (ir.Value, *shape) {
+	switch x := e.(type) {
+	case *ast.Ident:
+		if loc := l.lookup(x.Value); loc != nil && loc.slot >= 0 && !l.isAggregate(loc.shape) {
+			return l.slotPtr(loc.slot), loc.shape
+		}
+	case *ast.FieldExpr, *ast.IndexExpr:
+		ptr, sh, ok := l.place(x)
+		if !ok {
+			return l.intConst(0), nil
+		}
+		if l.isAggregate(sh) {
+			return l.load(ptr), sh
+		}
+		return ptr, sh
+	}
+	v, sh := l.value(e)
+	if l.isAggregate(sh) {
+		return v, sh
+	}
+	ptr := l.slotPtr(l.newSlot())
+	l.store(ptr, v)
+	return ptr, sh
+}
+
+func (l *lowerer) infix(e *ast.InfixExpr) (ir.Value, *shape) {
+	if e.Operator == "&&" || e.Operator == "||" {
+		return l.logical(e)
+	}
+	left, ls := l.value(e.Left)
+	right, rs := l.value(e.Right)
+	if (e.Operator == "==" || e.Operator == "!=") && isText(ls) && isText(rs) {
+		l.needStrEq = true
+		eq := l.b.EmitCall(l.b.NewValue(ir.TypeBool, ""), strEqName, left, right)
+		if e.Operator == "!=" {
+			eq = l.emit(ir.OpLogNot, ir.TypeBool, eq)
+		}
+		return eq, shapeBool
+	}
+	if (e.Operator == "==" || e.Operator == "!=") && isAddress(ls) && isAddress(rs) {
+		eq := l.addressEq(left, right)
+		if e.Operator == "!=" {
+			eq = l.emit(ir.OpLogNot, ir.TypeBool, eq)
+		}
+		return eq, shapeBool
+	}
+	op, ok := binaryOps[e.Operator]
+	if !ok {
+		l.errorf(e.Token.Pos, "unsupported operator %s", e.Operator)
+		return left, ls
+	}
+	if op >= ir.OpEq && op <= ir.OpGte {
+		return l.emit(op, ir.TypeBool, left, right), shapeBool
+	}
+	return l.emit(op, l.irType(ls), left, right), ls
+}
+
+// logical lowers short-circuiting && and ||. The short-circuit result is
+// stored up front; evaluating the right operand overwrites it.
+func (l *lowerer) logical(e *ast.InfixExpr) (ir.Value, *shape) {
+	or := e.Operator == "||"
+	slot := l.newSlot()
+	left, _ := l.value(e.Left)
+	l.store(l.slotPtr(slot), l.boolConst(or))
+	rhs := l.newBlock("rhs")
+	join := l.newBlock("endlogic")
+	if or {
+		l.b.EmitCondBranch(left, join, rhs)
+	} else {
+		l.b.EmitCondBranch(left, rhs, join)
+	}
+	l.b.SetBlock(rhs)
+	right, _ := l.value(e.Right)
+	l.store(l.slotPtr(slot), l.emit(ir.OpNeq, ir.TypeBool, right, l.intConst(0)))
+	l.jump(join)
+	l.b.SetBlock(join)
+	return l.load(l.slotPtr(slot)), shapeBool
+}
+
+// merge collects the values of the arms of an if or match.
+type merge struct {
+	slot    int
+	shape   *shape
+	live    int
+	missing bool
+}
+
+// arm records the value an arm produced and jumps to the join block.
+// Arms that diverge do not contribute.
+func (l *lowerer) arm(m *merge, v ir.Value, sh *shape, join *ir.BasicBlock) {
+	if l.isDead() {
+		l.jump(join)
+		return
+	}
+	m.live++
+	if isUnit(v) {
+		m.missing = true
+	} else if !m.missing {
+		if m.slot < 0 {
+			m.slot = l.newSlot()
+		}
+		l.store(l.slotPtr(m.slot), v)
+		if m.shape == nil {
+			m.shape = sh
+		}
+	}
+	l.jump(join)
+}
+
+// merged returns the joined value in the (current) join block.
+func (l *lowerer) merged(m *merge) (ir.Value, *shape) {
+	if m.live == 0 {
+		l.dead[l.b.Block()] = true
+		return unit, nil
+	}
+	if m.missing || m.slot < 0 {
+		return unit, nil
+	}
+	return l.load(l.slotPtr(m.slot)), m.shape
+}
+
+func (l *lowerer) ifExpr(e *ast.IfExpr) (ir.Value, *shape) {
+	c, _ := l.value(e.Condition)
+	then := l.newBlock("then")
+	join := l.newBlock("endif")
+	els := join
+	if e.Alternative != nil {
+		els = l.newBlock("else")
+	}
+	l.b.EmitCondBranch(c, then, els)
+	m := &merge{slot: -1}
+
+	l.b.SetBlock(then)
+	v, sh := l.block(e.Consequence)
+	l.arm(m, v, sh, join)
+
+	if e.Alternative != nil {
+		l.b.SetBlock(els)
+		v, sh := l.expr(e.Alternative)
+		l.arm(m, v, sh, join)
+	} else {
+		// Falling through yields no value.
+		m.live++
+		m.missing = true
+	}
+	l.b.SetBlock(join)
+	return l.merged(m)
+}
+
+func (l *lowerer) match(e *ast.MatchExpr) (ir.Value, *shape) {
+	subj, sh := l.value(e.Subject)
+	join := l.newBlock("endmatch")
+	m := &merge{slot: -1}
+	for _, a := range e.Arms {
+		next := l.newBlock("arm")
+		l.push()
+		l.pattern(a.Pattern, subj, sh, next)
+		if a.Guard != nil {
+			g, _ := l.value(a.Guard)
+			l.test(g, l.newBlock("guard"), next)
+		}
+		v, vsh := l.expr(a.Body)
+		l.arm(m, v, vsh, join)
+		l.pop()
+		l.b.SetBlock(next)
+	}
+	l.revert("no match arm matched")
+	l.b.SetBlock(join)
+	return l.merged(m)
+}
+
+// pattern tests subj against p, branching to fail on mismatch and binding
+// any names the pattern introduces.
+func (l *lowerer) pattern(p ast.Expression, subj ir.Value, sh *shape, fail *ir.BasicBlock) {
+	switch p := p.(type) {
+	case *ast.Ident:
+		if p.Value == "_" {
+			return
+		}
+		if v := l.lookupVariant(p.Value, sh); v != nil && (sh == nil || sh.name == v.enum.name) {
+			if len(v.fields) > 0 {
+				l.errorf(p.Token.Pos, "variant %s takes %d arguments", v.name, len(v.fields))
+				return
+			}
+			l.testTag(subj, v, fail)
+			return
+		}
+		l.bind(p.Value, false, subj, sh)
+
+	case *ast.IntLiteral:
+		l.test(l.emit(ir.OpEq, ir.TypeBool, subj, l.intConst(p.Value)), l.newBlock("match"), fail)
+
+	case *ast.BoolLiteral:
+		l.test(l.emit(ir.OpEq, ir.TypeBool, subj, l.boolConst(p.Value)), l.newBlock("match"), fail)
+
+	case *ast.StringLiteral:
+		s, err := unescape(p.Value)
+		if err != nil {
+			l.errorf(p.Token.Pos, "%v", err)
+		}
+		l.needStrEq = true
+		eq := l.b.EmitCall(l.b.NewValue(ir.TypeBool, ""), strEqName, subj, l.bytes([]byte(s)))
+		l.test(eq, l.newBlock("match"), fail)
+
+	case *ast.CallExpr:
+		id, ok := p.Function.(*ast.Ident)
+		if !ok {
+			l.errorf(ast.Pos(p), "unsupported pattern %s", p)
+			return
+		}
+		if v := l.lookupVariant(id.Value, sh); v != nil {
+			if len(p.Arguments) != len(v.fields) {
+				l.errorf(p.Token.Pos, "variant %s takes %d arguments, got %d", v.name, len(v.fields), len(p.Arguments))
+				return
+			}
+			l.testTag(subj, v, fail)
+			for i, sub := range p.Arguments {
+				l.pattern(sub, l.load(l.fieldPtr(subj, 1+i)), v.shapes[i], fail)
+			}
+			return
+		}
+		if q, ok := l.resolve(id.Value, l.fn.module, l.isStruct); ok {
+			agg := l.structs[q]
+			if len(p.Arguments) != len(agg.fields) {
+				l.errorf(p.Token.Pos, "%s has %d fields, got %d", q, len(agg.fields), len(p.Arguments))
+				return
+			}
+			for i, sub := range p.Arguments {
+				l.pattern(sub, l.load(l.fieldPtr(subj, i)), agg.shapes[i], fail)
+			}
+			return
+		}
+		l.errorf(p.Token.Pos, "unknown variant %s", id.Value)
+
+	default:
+		l.errorf(ast.Pos(p), "unsupported pattern %s", p)
+	}
+}
+
+func (l *lowerer) testTag(subj ir.Value, v *variant, fail *ir.BasicBlock) {
+	tag := subj
+	if v.enum.boxed {
+		tag = l.load(subj)
+	}
+	l.test(l.emit(ir.OpEq, ir.TypeBool, tag, l.intConst(int64(v.tag))), l.newBlock("match"), fail)
+}
+
+// rangeArray materializes a range outside a for loop as an array.
+func (l *lowerer) rangeArray(e *ast.RangeExpr) (ir.Value, *shape) {
+	start, end := l.rangeBounds(e)
+	l.check(l.emit(ir.OpLte, ir.TypeBool, start, end), "invalid range")
+
+	n := l.emit(ir.OpSub, ir.TypeU64, end, start)
+	arr := l.allocWords(l.emit(ir.OpAdd, ir.TypeU64, n, l.intConst(1)))
+	l.store(arr, n)
+	l.loopRange(l.intConst(0), n, func(i ir.Value) {
+		l.store(l.emit(ir.OpIndexPtr, ir.TypeU64, arr, i), l.emit(ir.OpAdd, ir.TypeU64, start, i))
+	})
+	return arr, &shape{name: "[]", elem: shapeU64}
+}
+
+// copyValue duplicates an aggregate; scalars are copied directly.
+func (l *lowerer) copyValue(v ir.Value, sh *shape) ir.Value {
+	if sh != nil && !sh.handle {
+		if agg, ok := l.structs[sh.name]; ok {
+			dst := l.alloc(len(agg.fields))
+			for i := range agg.fields {
+				l.store(l.fieldPtr(dst, i), l.load(l.fieldPtr(v, i)))
+			}
+			return dst
+		}
+		if sh.name == "[]" || isText(sh) {
+			n := l.load(v)
+			words := n
+			if isText(sh) {
+				words = l.emit(ir.OpShr, ir.TypeU64, l.emit(ir.OpAdd, ir.TypeU64, n, l.intConst(7)), l.intConst(3))
+			}
+			dst := l.allocWords(l.emit(ir.OpAdd, ir.TypeU64, words, l.intConst(1)))
+			l.store(dst, n)
+			l.loopRange(l.intConst(0), words, func(i ir.Value) {
+				l.store(l.emit(ir.OpIndexPtr, ir.TypeU64, dst, i), l.load(l.emit(ir.OpIndexPtr, ir.TypeU64, v, i)))
+			})
+			return dst
+		}
+	}
+	return l.emit(ir.OpCopy, l.irType(sh), v)
+}
+
+// ---------------------------------------------------------------------------
+// Calls
+// ---------------------------------------------------------------------------
+
+func (l *lowerer) call(e *ast.CallExpr) (ir.Value, *shape) {
+	id, ok := e.Function.(*ast.Ident)
+	if !ok {
+		l.errorf(e.Token.Pos, "cannot call %s", e.Function)
+		return unit, nil
+	}
+	name, pos := id.Value, e.Token.Pos
+	if l.lookup(name) != nil {
+		l.errorf(pos, "cannot call %s: not a function", name)
+		return unit, nil
+	}
+	if q, ok := l.resolve(name, l.fn.module, l.isFunc); ok {
+		return l.callFunc(l.funcs[q], nil, e.Arguments, pos)
+	}
+	if q, ok := l.resolve(name, l.fn.module, l.isStruct); ok {
+		return l.construct(l.structs[q], e.Arguments, pos)
+	}
+	if v := l.lookupVariant(name, nil); v != nil {
+		if len(e.Arguments) != len(v.fields) {
+			l.errorf(pos, "variant %s takes %d arguments, got %d", v.name, len(v.fields), len(e.Arguments))
+			return unit, nil
+		}
+		if len(v.fields) == 0 {
+			return l.unitVariant(v), &shape{name: v.enum.name}
+		}
+		box := l.alloc(1 + len(v.fields))
+		l.store(box, l.intConst(int64(v.tag)))
+		for i, arg := range e.Arguments {
+			a, _ := l.value(arg)
+			l.store(l.fieldPtr(box, 1+i), a)
+		}
+		return box, &shape{name: v.enum.name}
+	}
+	if op, ok := l.lookupIntrinsic(name); ok {
+		return l.intrinsic(op, name, e.Arguments, pos)
+	}
+	l.errorf(pos, "undefined function %s", name)
+	return unit, nil
+}
+
+func (l *lowerer) callFunc(fn *function, recv *ir.Value, args []ast.Expression, pos token.Position) (ir.Value, *shape) {
+	if fn.self != nil {
+		l.errorf(pos, "message handler %s must be invoked with send", fn.name)
+		return unit, nil
+	}
+	var vals []ir.Value
+	if recv != nil {
+		vals = append(vals, *recv)
+	}
+	for _, a := range args {
+		v, _ := l.value(a)
+		vals = append(vals, v)
+	}
+	if len(vals) != len(fn.params) {
+		l.errorf(pos, "%s expects %d arguments, got %d", fn.name, len(fn.params), len(vals))
+		return unit, nil
+	}
+	res := l.b.EmitCall(l.b.NewValue(l.typeOf(fn.ret, fn.module), ""), fn.name, vals...)
+	if fn.ret == nil {
+		return unit, nil
+	}
+	return res, fn.retShape
+}
+
+func (l *lowerer) construct(agg *aggregate, args []ast.Expression, pos token.Position) (ir.Value, *shape) {
+	if len(args) != len(agg.fields) {
+		l.errorf(pos, "%s has %d fields, got %d", agg.name, len(agg.fields), len(args))
+		return unit, nil
+	}
+	ptr := l.alloc(len(agg.fields))
+	for i, arg := range args {
+		v, _ := l.value(arg)
+		l.store(l.fieldPtr(ptr, i), v)
+	}
+	return ptr, &shape{name: agg.name}
+}
+
+func (l *lowerer) methodCall(e *ast.MethodCallExpr) (ir.Value, *shape) {
+	recv, sh := l.value(e.Receiver)
+	pos := e.Token.Pos
+	if sh != nil && sh.handle {
+		// Invoking a handler on an agent handle sends it a message.
+		l.sendMessage(recv, sh, e.Method, e.Arguments, pos)
+		return unit, nil
+	}
+	if sh != nil {
+		if fn, ok := l.funcs[sh.name+"::"+e.Method]; ok {
+			return l.callFunc(fn, &recv, e.Arguments, pos)
+		}
+		if e.Method == "len" && len(e.Arguments) == 0 && (sh.name == "[]" || isText(sh)) {
+			return l.load(recv), shapeU64
+		}
+	}
+	// Without a known receiver type the method name must be unique.
+	var found *function
+	for _, fn := range l.order {
+		if fn.self != nil || lastSegment(fn.name) != e.Method || len(fn.params) == 0 || fn.params[0].Name != "self" {
+			continue
+		}
+		if found != nil {
+			l.errorf(pos, "ambiguous method %s", e.Method)
+			return unit, nil
+		}
+		found = fn
+	}
+	if found == nil {
+		l.errorf(pos, "unknown method %s", e.Method)
+		return unit, nil
+	}
+	return l.callFunc(found, &recv, e.Arguments, pos)
+}
+
+func (l *lowerer) lookupIntrinsic(name string) (ir.Op, bool) {
+	isIntrinsic := func(q string) bool {
+		_, ok := intrinsics[q]
+		return ok
+	}
+	if q, ok := l.resolve(name, l.fn.module, isIntrinsic); ok {
+		return intrinsics[q], true
+	}
+	for _, pkg := range []string{"chain::", "crypto::"} {
+		if op, ok := intrinsics[pkg+name]; ok {
+			return op, true
+		}
+	}
+	return 0, false
+}
+
+func (l *lowerer) intrinsic(op ir.Op, name string, args []ast.Expression, pos token.Position) (ir.Value, *shape) {
+	want := 0
+	switch op {
+	case ir.OpBalance, ir.OpSLoad, ir.OpSHA3, ir.OpSHAKE256:
+		want = 1
+	case ir.OpTransfer, ir.OpSStore:
+		want = 2
+	case ir.OpFalcon512Verify, ir.OpMLDSAVerify, ir.OpSLHDSAVerify:
+		want = 3
+	}
+	if len(args) != want {
+		l.errorf(pos, "%s expects %d arguments, got %d", name, want, len(args))
+		return unit, nil
+	}
+	var vals []ir.Value
+	for _, a := range args {
+		v, _ := l.value(a)
+		vals = append(vals, v)
+	}
+	switch op {
+	case ir.OpCaller:
+		return l.emit(op, ir.TypeAddress), shapeAddress
+	case ir.OpTransfer, ir.OpSStore:
+		l.emit(op, ir.TypeVoid, vals...)
+		return unit, nil
+	case ir.OpSHA3, ir.OpSHAKE256:
+		// Hash the data bytes into a fresh 32-byte buffer.
+		digest := l.alloc(5)
+		l.store(digest, l.intConst(32))
+		l.emit(op, ir.TypeVoid, l.fieldPtr(digest, 1), l.fieldPtr(vals[0], 1), l.load(vals[0]))
+		return digest, shapeBytes
+	case ir.OpFalcon512Verify, ir.OpMLDSAVerify, ir.OpSLHDSAVerify:
+		// Message, signature and public key, each a bytes value.
+		return l.emit(op, ir.TypeBool, vals...), shapeBool
+	}
+	return l.emit(op, ir.TypeU64, vals...), shapeU64
+}
+
+// ---------------------------------------------------------------------------
+// Agents
+// ---------------------------------------------------------------------------
+
+func (l *lowerer) spawn(e *ast.SpawnExpr) (ir.Value, *shape) {
+	q, ok := l.resolve(e.Agent, l.fn.module, func(q string) bool {
+		_, ok := l.agents[q]
+		return ok
+	})
+	if !ok {
+		l.errorf(e.Token.Pos, "undefined agent %s", e.Agent)
+		return l.intConst(0), nil
+	}
+	state := l.agents[q].state
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if state.field(name) < 0 {
+			l.errorf(e.Token.Pos, "agent %s has no state field %s", q, name)
+		}
+	}
+	// The state is passed as the word array [len, fields...].
+	ptr := l.alloc(1 + len(state.fields))
+	l.store(ptr, l.intConst(int64(len(state.fields))))
+	for i, f := range state.fields {
+		if init, ok := e.Fields[f.Name]; ok {
+			v, _ := l.value(init)
+			l.store(l.fieldPtr(ptr, 1+i), v)
+		}
+	}
+	dispatch := l.b.EmitFuncRef(l.b.NewValue(ir.TypeU64, ""), q+"::"+dispatchName)
+	return l.emit(ir.OpSpawn, ir.TypeAddress, ptr, dispatch), &shape{name: q, handle: true}
+}
+
+func (l *lowerer) send(e *ast.SendExpr) {
+	target, sh := l.value(e.Target)
+	if call, ok := e.Message.(*ast.CallExpr); ok && sh != nil && sh.handle {
+		if id, ok := call.Function.(*ast.Ident); ok {
+			l.sendMessage(target, sh, id.Value, call.Arguments, call.Token.Pos)
+			return
+		}
+	}
+	l.errorf(e.Token.Pos, "send needs an agent handle and a call of one of its message handlers")
+}
+
+// sendMessage encodes a handler invocation as the word array
+// [len, handler index, args...] and sends it to the agent.
+func (l *lowerer) sendMessage(target ir.Value, sh *shape, handler string, args []ast.Expression, pos token.Position) {
+	ag := l.agents[sh.name]
+	idx := -1
+	for i, h := range ag.handlers {
+		if h == handler {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		l.errorf(pos, "agent %s has no handler %s", sh.name, handler)
+		return
+	}
+	fn := l.funcs[sh.name+"::"+handler]
+	if len(args) != len(fn.params) {
+		l.errorf(pos, "%s expects %d arguments, got %d", fn.name, len(fn.params), len(args))
+		return
+	}
+	msg := l.alloc(2 + len(args))
+	l.store(msg, l.intConst(int64(1+len(args))))
+	l.store(l.fieldPtr(msg, 1), l.intConst(int64(idx)))
+	for i, a := range args {
+		v, _ := l.value(a)
+		l.store(l.fieldPtr(msg, 2+i), v)
+	}
+	l.emit(ir.OpSend, ir.TypeVoid, target, msg)
+}
+
+// unescape resolves the escape sequences of a string literal.
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("unterminated escape in %q", s)
+		}
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '0':
+			b.WriteByte(0)
+		case '\\', '"':
+			b.WriteByte(s[i])
+		default:
+			return "", fmt.Errorf("unknown escape \\%c in %q", s[i], s)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,617 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Package lower translates a parsed PROBE program into SSA IR.
+//
+// Value model:
+//
+//   - Every value occupies one 64-bit word. Integers, bools, floats (as raw
+//     bits), addresses and agent handles are stored directly.
+//   - Structs, resources and agent state live on the heap and are passed by
+//     reference; field i is the word at offset 8*i.
+//   - Arrays, strings and bytes are heap buffers laid out as [len][data...].
+//     Array elements take one word each; string bytes are packed and padded
+//     to a word boundary with zeroes.
+//   - Enums whose variants carry no data are plain tags. Otherwise every
+//     value is boxed as [tag][payload...].
+//   - Immutable bindings are SSA values. Mutable bindings live in a per-call
+//     frame allocated on function entry, so the IR never needs phi nodes.
+//
+// Names are qualified with "::": functions in modules as "mod::f", methods
+// and message handlers as "Type::method". Handlers take the agent state as
+// an implicit first parameter named self. Spawning an agent passes its state
+// as a word array together with the offset of a generated dispatcher,
+// "Agent::$dispatch"(self, msg). Messages sent to an agent with
+// "send h handler(args)" are word arrays [handler index, args...] that the
+// dispatcher routes to the handler. Agent state and messages outlive the
+// execution that created them, so they may only hold words.
+package lower
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/probechain/go-probe/probe-lang/lang/ast"
+	"github.com/probechain/go-probe/probe-lang/lang/ir"
+	"github.com/probechain/go-probe/probe-lang/lang/token"
+	"github.com/probechain/go-probe/probe-lang/lang/types"
+)
+
+// Error is a lowering error with a source position.
+type Error struct {
+	Pos token.Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// primitives maps primitive type names to their predefined IR types.
+var primitives = map[string]ir.TypeRef{
+	"void": ir.TypeVoid, "bool": ir.TypeBool,
+	"u8": ir.TypeU8, "u16": ir.TypeU16, "u32": ir.TypeU32, "u64": ir.TypeU64,
+	"u128": ir.TypeU128, "u256": ir.TypeU256, "i64": ir.TypeI64, "f64": ir.TypeF64,
+	"string": ir.TypeString, "bytes": ir.TypeBytes, "address": ir.TypeAddress,
+}
+
+// primitiveNames lists the predefined IR types in TypeRef order.
+var primitiveNames = []string{
+	"void", "bool", "u8", "u16", "u32", "u64", "u128", "u256",
+	"i64", "f64", "string", "bytes", "address",
+}
+
+// shape is the static layout information the lowering needs about a value:
+// which aggregate it points to, or the element shape of an array.
+type shape struct {
+	name   string // qualified type name, "[]" for arrays
+	elem   *shape // element shape for arrays
+	handle bool   // agent handle rather than agent state
+}
+
+// aggregate describes a struct, resource or agent state layout.
+type aggregate struct {
+	name   string
+	module string
+	kind   ir.TypeKind
+	fields []ast.Field
+	shapes []*shape
+	ref    ir.TypeRef
+}
+
+func (a *aggregate) field(name string) int {
+	for i, f := range a.fields {
+		if f.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// enum describes an enum declaration.
+type enum struct {
+	name     string
+	ref      ir.TypeRef
+	boxed    bool
+	variants []*variant
+}
+
+// variant describes a single enum variant.
+type variant struct {
+	enum   *enum
+	name   string
+	tag    int
+	fields []ast.TypeExpr
+	shapes []*shape
+}
+
+// agent describes an agent declaration.
+type agent struct {
+	state    *aggregate
+	handlers []string // bare handler names in declaration order
+}
+
+// alias is a type alias declaration.
+type alias struct {
+	typ    ast.TypeExpr
+	module string
+}
+
+// function is a function, method or message handler to be lowered.
+type function struct {
+	name   string
+	module string
+	pos    token.Position
+	self   *shape // implicit receiver shape for message handlers
+	params []ast.Param
+	ret    ast.TypeExpr
+	body   *ast.BlockExpr
+
+	paramShapes []*shape
+	retShape    *shape
+}
+
+// local is a binding in scope.
+type local struct {
+	val     ir.Value // SSA value when slot < 0
+	slot    int      // frame slot for mutable bindings, or -1
+	mutable bool
+	shape   *shape
+}
+
+// loop records the jump targets of an enclosing loop.
+type loop struct {
+	cont, exit *ir.BasicBlock
+}
+
+// constKey identifies a constant pool entry.
+type constKey struct {
+	typ   ir.TypeRef
+	value interface{}
+}
+
+// lowerer holds the state of a lowering run.
+type lowerer struct {
+	b   *ir.Builder
+	err *Error
+
+	structs      map[string]*aggregate
+	enums        map[string]*enum
+	variants     map[string]*variant   // by qualified "Enum::Variant"
+	bareVariants map[string][]*variant // by variant name
+	agents       map[string]*agent
+	aliases      map[string]alias
+	funcs        map[string]*function
+	order        []*function
+	imports      map[string]string // qualified alias -> target path
+	consts       map[constKey]int
+	needStrEq    bool
+
+	// Per-function state.
+	fn     *function
+	frame  ir.Value
+	slots  int
+	scopes []map[string]*local
+	loops  []loop
+	blocks int
+	dead   map[*ir.BasicBlock]bool
+}
+
+// Lower translates a parsed program into an IR program. The program is
+// type-checked first and any diagnostics are returned as a
+// types.Diagnostics error. Lowering continues past its own errors; the
+// first one encountered is returned.
+func Lower(prog *ast.Program) (*ir.Program, error) {
+	if _, diags := types.Check(prog); len(diags) > 0 {
+		return nil, diags
+	}
+	l := &lowerer{
+		b:            ir.NewBuilder(),
+		structs:      make(map[string]*aggregate),
+		enums:        make(map[string]*enum),
+		variants:     make(map[string]*variant),
+		bareVariants: make(map[string][]*variant),
+		agents:       make(map[string]*agent),
+		aliases:      make(map[string]alias),
+		funcs:        make(map[string]*function),
+		imports:      make(map[string]string),
+		consts:       make(map[constKey]int),
+	}
+	for _, name := range primitiveNames {
+		l.b.AddType(ir.TypeDef{Name: name, Kind: ir.TypeKindPrimitive})
+	}
+	var impls []implDecl
+	l.collect(prog.Declarations, "", &impls)
+	for _, impl := range impls {
+		l.collectImpl(impl.decl, impl.module)
+	}
+	l.resolveTypes()
+	for _, fn := range l.order {
+		l.lowerFunction(fn)
+	}
+	agents := make([]string, 0, len(l.agents))
+	for name := range l.agents {
+		agents = append(agents, name)
+	}
+	sort.Strings(agents)
+	for _, name := range agents {
+		l.lowerDispatch(name, l.agents[name])
+	}
+	if l.needStrEq {
+		l.lowerStrEq()
+	}
+	if l.err != nil {
+		return nil, l.err
+	}
+	return l.b.Program(), nil
+}
+
+// errorf records an error; only the first one is kept.
+func (l *lowerer) errorf(pos token.Position, format string, args ...interface{}) {
+	if l.err == nil {
+		l.err = &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Declarations
+// ---------------------------------------------------------------------------
+
+type implDecl struct {
+	decl   *ast.ImplDecl
+	module string
+}
+
+// collect registers the declarations of a module. Impl blocks are deferred
+// until every type is known.
+func (l *lowerer) collect(decls []ast.Declaration, module string, impls *[]implDecl) {
+	for _, decl := range decls {
+		switch d := decl.(type) {
+		case *ast.FnDecl:
+			l.addFunc(&function{
+				name:   module + d.Name,
+				module: module,
+				pos:    d.Token.Pos,
+				params: d.Params,
+				ret:    d.ReturnType,
+				body:   d.Body,
+			})
+		case *ast.StructDecl:
+			l.addAggregate(module, d.Name, d.Token.Pos, ir.TypeKindStruct, d.Fields)
+		case *ast.ResourceDecl:
+			l.addAggregate(module, d.Name, d.Token.Pos, ir.TypeKindResource, d.Fields)
+		case *ast.EnumDecl:
+			l.addEnum(module, d)
+		case *ast.AgentDecl:
+			l.addAgent(module, d)
+		case *ast.TypeDecl:
+			if l.isType(module + d.Name) {
+				l.errorf(d.Token.Pos, "type %s redeclared", module+d.Name)
+				continue
+			}
+			l.aliases[module+d.Name] = alias{typ: d.Type, module: module}
+		case *ast.UseDecl:
+			if len(d.Path) == 0 {
+				continue
+			}
+			name := d.Path[len(d.Path)-1]
+			if d.Alias != "" {
+				name = d.Alias
+			}
+			l.imports[module+name] = strings.Join(d.Path, "::")
+		case *ast.ModDecl:
+			l.collect(d.Declarations, module+d.Name+"::", impls)
+		case *ast.ImplDecl:
+			*impls = append(*impls, implDecl{decl: d, module: module})
+		case *ast.TraitDecl:
+			// Traits only constrain types; they produce no code.
+		}
+	}
+}
+
+func (l *lowerer) addFunc(fn *function) {
+	if _, ok := l.funcs[fn.name]; ok {
+		l.errorf(fn.pos, "function %s redeclared", fn.name)
+		return
+	}
+	l.funcs[fn.name] = fn
+	l.order = append(l.order, fn)
+}
+
+func (l *lowerer) addAggregate(module, name string, pos token.Position, kind ir.TypeKind, fields []ast.Field) *aggregate {
+	q := module + name
+	if l.isType(q) {
+		l.errorf(pos, "type %s redeclared", q)
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, f := range fields {
+		if seen[f.Name] {
+			l.errorf(f.Token.Pos, "duplicate field %s in %s", f.Name, q)
+		}
+		seen[f.Name] = true
+	}
+	agg := &aggregate{name: q, module: module, kind: kind, fields: fields}
+	agg.ref = l.b.AddType(ir.TypeDef{Name: q, Kind: kind, Linear: kind == ir.TypeKindResource})
+	l.structs[q] = agg
+	return agg
+}
+
+func (l *lowerer) addEnum(module string, d *ast.EnumDecl) {
+	q := module + d.Name
+	if l.isType(q) {
+		l.errorf(d.Token.Pos, "type %s redeclared", q)
+		return
+	}
+	e := &enum{name: q}
+	td := ir.TypeDef{Name: q, Kind: ir.TypeKindEnum}
+	for i, v := range d.Variants {
+		if _, ok := l.variants[q+"::"+v.Name]; ok {
+			l.errorf(v.Token.Pos, "duplicate variant %s in %s", v.Name, q)
+			continue
+		}
+		vt := &variant{enum: e, name: v.Name, tag: i, fields: v.Fields}
+		e.variants = append(e.variants, vt)
+		if len(v.Fields) > 0 {
+			e.boxed = true
+		}
+		l.variants[q+"::"+v.Name] = vt
+		l.bareVariants[v.Name] = append(l.bareVariants[v.Name], vt)
+		td.Fields = append(td.Fields, ir.FieldDef{Name: v.Name, Type: ir.TypeU64})
+	}
+	e.ref = l.b.AddType(td)
+	l.enums[q] = e
+}
+
+func (l *lowerer) addAgent(module string, d *ast.AgentDecl) {
+	var fields []ast.Field
+	if d.State != nil {
+		fields = d.State.Fields
+	}
+	state := l.addAggregate(module, d.Name, d.Token.Pos, ir.TypeKindAgent, fields)
+	if state == nil {
+		return
+	}
+	ag := &agent{state: state}
+	l.agents[state.name] = ag
+	for _, h := range d.Handlers {
+		ag.handlers = append(ag.handlers, h.Name)
+		l.addFunc(&function{
+			name:   state.name + "::" + h.Name,
+			module: module,
+			pos:    h.Token.Pos,
+			self:   &shape{name: state.name},
+			params: h.Params,
+			ret:    h.ReturnType,
+			body:   h.Body,
+		})
+	}
+}
+
+func (l *lowerer) collectImpl(d *ast.ImplDecl, module string) {
+	q, ok := l.resolve(d.TypeName, module, l.isType)
+	if !ok {
+		l.errorf(d.Token.Pos, "impl of undefined type %s", d.TypeName)
+		return
+	}
+	for i := range d.Methods {
+		m := &d.Methods[i]
+		l.addFunc(&function{
+			name:   q + "::" + m.Name,
+			module: module,
+			pos:    m.Token.Pos,
+			params: m.Params,
+			ret:    m.ReturnType,
+			body:   m.Body,
+		})
+	}
+}
+
+// resolveTypes computes field, variant and signature shapes once every
+// declaration is known, and fills in the IR type definitions.
+func (l *lowerer) resolveTypes() {
+	types := l.b.Program().Types
+	for _, agg := range l.structs {
+		for _, f := range agg.fields {
+			agg.shapes = append(agg.shapes, l.shapeOf(f.Type, agg.module))
+			types[agg.ref].Fields = append(types[agg.ref].Fields, ir.FieldDef{
+				Name: f.Name,
+				Type: l.typeOf(f.Type, agg.module),
+			})
+		}
+	}
+	for q, e := range l.enums {
+		module := q[:len(q)-len(lastSegment(q))]
+		for _, v := range e.variants {
+			for _, t := range v.fields {
+				v.shapes = append(v.shapes, l.shapeOf(t, module))
+			}
+		}
+	}
+	for _, fn := range l.order {
+		for _, p := range fn.params {
+			sh := l.shapeOf(p.Type, fn.module)
+			if p.Name == "self" && p.Type == nil {
+				// Receiver of a method: the impl type.
+				sh = &shape{name: fn.name[:len(fn.name)-len(lastSegment(fn.name))-2]}
+			}
+			fn.paramShapes = append(fn.paramShapes, sh)
+		}
+		fn.retShape = l.shapeOf(fn.ret, fn.module)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Name resolution
+// ---------------------------------------------------------------------------
+
+// resolve finds the qualified name that name refers to from module. The
+// module itself is searched first, then its ancestors; at each level a
+// `use` import may rename the first path segment.
+func (l *lowerer) resolve(name, module string, exists func(string) bool) (string, bool) {
+	first, rest := name, ""
+	if i := strings.Index(name, "::"); i >= 0 {
+		first, rest = name[:i], name[i:]
+	}
+	for m := module; ; m = parentModule(m) {
+		if exists(m + name) {
+			return m + name, true
+		}
+		if target, ok := l.imports[m+first]; ok && exists(target+rest) {
+			return target + rest, true
+		}
+		if m == "" {
+			return "", false
+		}
+	}
+}
+
+// parentModule returns the enclosing module prefix of a "a::b::" prefix.
+func parentModule(m string) string {
+	m = strings.TrimSuffix(m, "::")
+	if i := strings.LastIndex(m, "::"); i >= 0 {
+		return m[:i+2]
+	}
+	return ""
+}
+
+// lastSegment returns the final segment of a qualified name.
+func lastSegment(name string) string {
+	if i := strings.LastIndex(name, "::"); i >= 0 {
+		return name[i+2:]
+	}
+	return name
+}
+
+func (l *lowerer) isType(q string) bool {
+	if _, ok := l.structs[q]; ok {
+		return true
+	}
+	if _, ok := l.enums[q]; ok {
+		return true
+	}
+	_, ok := l.aliases[q]
+	return ok
+}
+
+func (l *lowerer) isFunc(q string) bool {
+	_, ok := l.funcs[q]
+	return ok
+}
+
+func (l *lowerer) isStruct(q string) bool {
+	agg, ok := l.structs[q]
+	return ok && agg.kind != ir.TypeKindAgent
+}
+
+func (l *lowerer) isVariant(q string) bool {
+	_, ok := l.variants[q]
+	return ok
+}
+
+// lookupVariant resolves a variant name, qualified or bare. Bare names must
+// be unambiguous; hint, when it names an enum, disambiguates.
+func (l *lowerer) lookupVariant(name string, hint *shape) *variant {
+	if strings.Contains(name, "::") {
+		if q, ok := l.resolve(name, l.fn.module, l.isVariant); ok {
+			return l.variants[q]
+		}
+		return nil
+	}
+	candidates := l.bareVariants[name]
+	if hint != nil {
+		for _, v := range candidates {
+			if v.enum.name == hint.name {
+				return v
+			}
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Types
+// ---------------------------------------------------------------------------
+
+// shapeOf resolves the static shape of a type expression. Unknown names
+// yield a shape with the bare name so primitives compare by name.
+func (l *lowerer) shapeOf(t ast.TypeExpr, module string) *shape {
+	return l.shapeOfDepth(t, module, 0)
+}
+
+func (l *lowerer) shapeOfDepth(t ast.TypeExpr, module string, depth int) *shape {
+	if depth > 32 {
+		return nil // cyclic alias
+	}
+	var name string
+	switch t := t.(type) {
+	case *ast.NamedType:
+		name = t.Name
+	case *ast.PathType:
+		name = strings.Join(t.Segments, "::")
+	case *ast.ArrayType:
+		return &shape{name: "[]", elem: l.shapeOfDepth(t.Elem, module, depth+1)}
+	case *ast.SliceType:
+		return &shape{name: "[]", elem: l.shapeOfDepth(t.Elem, module, depth+1)}
+	case *ast.RefType:
+		return l.shapeOfDepth(t.Elem, module, depth+1)
+	case *ast.MutRefType:
+		return l.shapeOfDepth(t.Elem, module, depth+1)
+	default:
+		return nil
+	}
+	q, ok := l.resolve(name, module, l.isType)
+	if !ok {
+		return &shape{name: name}
+	}
+	if a, ok := l.aliases[q]; ok {
+		return l.shapeOfDepth(a.typ, a.module, depth+1)
+	}
+	_, isAgent := l.agents[q]
+	return &shape{name: q, handle: isAgent}
+}
+
+// typeOf maps a type expression to an IR type reference.
+func (l *lowerer) typeOf(t ast.TypeExpr, module string) ir.TypeRef {
+	if t == nil {
+		return ir.TypeVoid
+	}
+	return l.irType(l.shapeOf(t, module))
+}
+
+func (l *lowerer) irType(sh *shape) ir.TypeRef {
+	if sh == nil {
+		return ir.TypeU64
+	}
+	if ref, ok := primitives[sh.name]; ok {
+		return ref
+	}
+	if agg, ok := l.structs[sh.name]; ok && !sh.handle {
+		return agg.ref
+	}
+	if e, ok := l.enums[sh.name]; ok {
+		return e.ref
+	}
+	return ir.TypeU64
+}
+
+// isAggregate reports whether values of a shape are heap references.
+func (l *lowerer) isAggregate(sh *shape) bool {
+	if sh == nil || sh.handle {
+		return false
+	}
+	switch sh.name {
+	case "[]", "string", "bytes", "address":
+		return true
+	}
+	if _, ok := l.structs[sh.name]; ok {
+		return true
+	}
+	if e, ok := l.enums[sh.name]; ok {
+		return e.boxed
+	}
+	return false
+}
+
+// isWord reports whether values of a shape are self-contained words rather
+// than references into the memory of the current execution.
+func (l *lowerer) isWord(sh *shape) bool {
+	return !l.isAggregate(sh) && (sh == nil || !sh.handle)
+}
+
+func isText(sh *shape) bool {
+	return sh != nil && (sh.name == "string" || sh.name == "bytes")
+}
+
+func isAddress(sh *shape) bool {
+	return sh != nil && sh.name == "address"
+}
@@ -0,0 +1,320 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package lower
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/probe-lang/lang/codegen"
+	"github.com/probechain/go-probe/probe-lang/lang/ir"
+	"github.com/probechain/go-probe/probe-lang/lang/parser"
+	"github.com/probechain/go-probe/probe-lang/lang/vm"
+)
+
+// compile runs source through the parser, lowering, codegen and verifier.
+func compile(t *testing.T, filename, source string) *codegen.Bytecode {
+	t.Helper()
+	return build(t, filename, source, false)
+}
+
+// build compiles source, optionally running the IR optimizer.
+func build(t *testing.T, filename, source string, optimize bool) *codegen.Bytecode {
+	t.Helper()
+	prog, errs := parser.Parse(filename, source)
+	if len(errs) > 0 {
+		t.Fatalf("parse %s: %v", filename, errs)
+	}
+	irProg, err := Lower(prog)
+	if err != nil {
+		t.Fatalf("lower %s: %v", filename, err)
+	}
+	if optimize {
+		ir.Optimize(irProg)
+	}
+	bc, err := codegen.New().Generate(irProg)
+	if err != nil {
+		t.Fatalf("generate %s: %v", filename, err)
+	}
+	if verrs := codegen.Verify(bc); len(verrs) > 0 {
+		t.Fatalf("verify %s: %v", filename, verrs)
+	}
+	return bc
+}
+
+func compileFile(t *testing.T, name string, optimize bool) *codegen.Bytecode {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	src, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return build(t, path, string(src), optimize)
+}
+
+// call executes a compiled function with the given arguments.
+func call(t *testing.T, bc *codegen.Bytecode, fn string, args ...uint64) (uint64, error) {
+	t.Helper()
+	for _, f := range bc.Functions {
+		if f.Name == fn {
+			m := vm.New(bc.Code, bc.Constants, 10_000_000, nil)
+			m.Enter(uint32(f.Offset), args...)
+			return m.Run()
+		}
+	}
+	t.Fatalf("function %s not found", fn)
+	return 0, nil
+}
+
+type golden struct {
+	fn   string
+	args []uint64
+	want uint64
+	err  string // expected error substring, if any
+}
+
+// runGolden runs the cases against both unoptimized and optimized code.
+func runGolden(t *testing.T, file string, cases []golden) {
+	for _, optimize := range []bool{false, true} {
+		bc := compileFile(t, file, optimize)
+		for _, tc := range cases {
+			got, err := call(t, bc, tc.fn, tc.args...)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("%s%v (optimize=%v): error %v, want %q", tc.fn, tc.args, optimize, err, tc.err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s%v (optimize=%v): %v", tc.fn, tc.args, optimize, err)
+				continue
+			}
+			if got != tc.want {
+				t.Errorf("%s%v (optimize=%v) = %d, want %d", tc.fn, tc.args, optimize, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestArith(t *testing.T) {
+	runGolden(t, "arith.probe", []golden{
+		{fn: "add", args: []uint64{2, 3}, want: 5},
+		{fn: "fib", args: []uint64{10}, want: 55},
+		{fn: "factorial", args: []uint64{5}, want: 120},
+		{fn: "gcd", args: []uint64{84, 36}, want: 12},
+		{fn: "sum_range", args: []uint64{10}, want: 45},
+		{fn: "sum_odd", args: []uint64{100}, want: 1 + 3 + 5 + 7 + 9},
+		{fn: "max", args: []uint64{3, 9}, want: 9},
+		{fn: "max", args: []uint64{9, 3}, want: 9},
+		{fn: "classify", args: []uint64{0}, want: 100},
+		{fn: "classify", args: []uint64{5}, want: 200},
+		{fn: "classify", args: []uint64{50}, want: 300},
+		{fn: "bits", args: []uint64{6}, want: ((6 << 4) | 3) ^ (6 >> 1)},
+		{fn: "both", args: []uint64{1, 2}, want: 1},
+		{fn: "both", args: []uint64{1, 0}, want: 0},
+		{fn: "either", args: []uint64{0, 5}, want: 0, err: "division by zero"},
+		{fn: "either", args: []uint64{3, 0}, want: 1},
+		{fn: "swap_sum", args: []uint64{4, 5}, want: 9},
+		{fn: "digits", args: []uint64{0}, want: 1},
+		{fn: "digits", args: []uint64{12345}, want: 5},
+	})
+}
+
+func TestTypes(t *testing.T) {
+	runGolden(t, "types.probe", []golden{
+		{fn: "point_norm", args: []uint64{3, 4}, want: 25},
+		{fn: "point_shift", args: []uint64{4}, want: 5},
+		{fn: "segment_len", args: []uint64{2, 9}, want: 7},
+		{fn: "color_code", args: []uint64{0}, want: 10},
+		{fn: "color_code", args: []uint64{1}, want: 20},
+		{fn: "color_code", args: []uint64{2}, want: 30},
+		{fn: "area", args: []uint64{0}, want: 12},
+		{fn: "area", args: []uint64{1}, want: 12},
+		{fn: "area", args: []uint64{2}, want: 0},
+		{fn: "array_sum", want: 14},
+		{fn: "array_set", args: []uint64{1}, want: 70},
+		{fn: "array_set", args: []uint64{3}, err: "index out of bounds"},
+		{fn: "range_array", want: 3 + 6 + 4},
+		{fn: "copied", want: 6},
+		{fn: "modules", args: []uint64{2}, want: 10},
+	})
+}
+
+func TestContract(t *testing.T) {
+	runGolden(t, "contract.probe", []golden{
+		{fn: "withdraw", args: []uint64{10, 4}, want: 6},
+		{fn: "withdraw", args: []uint64{3, 4}, err: "insufficient balance"},
+		{fn: "guarded", args: []uint64{7}, want: 7},
+		{fn: "guarded", args: []uint64{13}, err: "reverted"},
+		{fn: "mint", args: []uint64{42}, want: 42},
+		{fn: "merge", args: []uint64{2, 3}, want: 5},
+		{fn: "greet", args: []uint64{0}, want: 1},
+		{fn: "greet", args: []uint64{1}, want: 2},
+		{fn: "text_eq", want: 1},
+		{fn: "text_len", want: 12 + 'o'},
+		{fn: "hashed", want: 32},
+		{fn: "verified", want: 2},
+		{fn: "addr", want: 1},
+		{fn: "message", want: 1},
+		{fn: "chain_info", want: 0},
+		{fn: "bump", args: []uint64{3}, want: 3},
+		{fn: "lookup", args: []uint64{1}, want: 6},
+		{fn: "lookup", args: []uint64{2}, err: "index out of bounds"},
+	})
+
+	bc := compileFile(t, "contract.probe", false)
+	for _, name := range []string{"Counter::increment", "Counter::get", "$streq"} {
+		found := false
+		for _, f := range bc.Functions {
+			found = found || f.Name == name
+		}
+		if !found {
+			t.Errorf("function %s not generated", name)
+		}
+	}
+}
+
+func TestRevertReason(t *testing.T) {
+	bc := compile(t, "revert.probe", `fn f() -> u64 { require(false, "nope"); 1 }`)
+	_, err := call(t, bc, "f")
+	if !errors.Is(err, vm.ErrReverted) {
+		t.Fatalf("error = %v, want ErrReverted", err)
+	}
+	if !strings.HasSuffix(err.Error(), ": nope") {
+		t.Errorf("error = %q, want reason nope", err)
+	}
+}
+
+func TestLowerErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`fn f() -> u64 { x }`, "1:17: undefined: x"},
+		{`fn f() { let x = 1; x = 2; }`, "cannot assign to immutable binding x"},
+		{`fn f() { break; }`, "break outside of a loop"},
+		{`fn f() { g(); }`, "undefined function g"},
+		{`fn f(a: u64) -> u64 { a } fn g() -> u64 { f() }`, "f expects 1 arguments, got 0"},
+		{`fn f() {} fn f() {}`, "function f redeclared"},
+		{`struct P { x: u64 } fn f(p: P) -> u64 { p.y }`, "unknown field y"},
+		{`enum E { A(u64) } fn f() -> u64 { match A(1) { A => 1 } }`, "variant A takes 1 arguments"},
+		{`agent A { msg m() {} } fn f() { let a = spawn A {}; a.n(); }`, "agent A has no handler n"},
+		{`agent A { msg m() {} } fn f() { A::m(); }`, "must be invoked with send"},
+		{`agent A { msg m() {} } fn f() { let a = spawn A {}; send a 1; }`, "send needs an agent handle"},
+		{`agent A { state { owner: address } msg m() {} }`, "state field owner must be a word value"},
+		{`agent A { msg m(s: string) {} }`, "parameter s must be a word value"},
+	}
+	for _, tc := range tests {
+		prog, errs := parser.Parse("", tc.src)
+		if len(errs) > 0 {
+			t.Fatalf("parse %q: %v", tc.src, errs)
+		}
+		_, err := Lower(prog)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Lower(%q) error = %v, want %q", tc.src, err, tc.want)
+		}
+	}
+}
+
+func TestEmitEvent(t *testing.T) {
+	bc := compileFile(t, "contract.probe", false)
+	for _, f := range bc.Functions {
+		if f.Name != "withdraw" {
+			continue
+		}
+		host := vm.NewMemoryHost(common.Address{}, common.Address{})
+		m := vm.New(bc.Code, bc.Constants, 10_000_000, host)
+		m.Enter(uint32(f.Offset), 10, 4)
+		if _, err := m.Run(); err != nil {
+			t.Fatal(err)
+		}
+		events := host.Logs
+		if len(events) != 1 {
+			t.Fatalf("got %d events, want 1", len(events))
+		}
+		if ev := events[0]; ev.ID != uint64(eventID("Transfer")) || len(ev.Fields) != 1 || ev.Fields[0] != 4 {
+			t.Errorf("event = %+v, want Transfer{amount: 4}", ev)
+		}
+		return
+	}
+	t.Fatal("withdraw not found")
+}
+
+func TestAgentDispatch(t *testing.T) {
+	bc := compileFile(t, "contract.probe", true)
+	var message, dispatch uint32
+	for _, f := range bc.Functions {
+		switch f.Name {
+		case "message":
+			message = uint32(f.Offset)
+		case "Counter::" + dispatchName:
+			dispatch = uint32(f.Offset)
+		}
+	}
+	host := vm.NewMemoryHost(common.Address{1}, common.Address{2})
+	m := vm.New(bc.Code, bc.Constants, 10_000_000, host)
+	m.Enter(message)
+	if _, err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(host.Agents) != 1 || len(host.Mailbox) != 2 {
+		t.Fatalf("got %d agents and %d messages, want 1 and 2", len(host.Agents), len(host.Mailbox))
+	}
+	ag := host.Agents[host.Mailbox[0].To]
+	if ag == nil || ag.Entry != uint64(dispatch) || len(ag.State) != 1 || ag.State[0] != 1 {
+		t.Fatalf("agent = %+v, want entry %d and state [1]", ag, dispatch)
+	}
+
+	// Deliver the messages as the runtime does: the state without its length
+	// word is self, the message is passed as is.
+	deliver := func(msg []uint64) ([]uint64, error) {
+		m := vm.New(bc.Code, bc.Constants, 10_000_000, host)
+		state, err := m.Memory().AllocWords(ag.State)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ptr, err := m.Memory().AllocWords(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Enter(uint32(ag.Entry), state+8, ptr)
+		if _, err := m.Run(); err != nil {
+			return nil, err
+		}
+		return m.Memory().ReadWords(state)
+	}
+	for i, want := range [][]uint64{{0, 5}, {1}} {
+		if got := host.Mailbox[i].Data; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("message %d = %v, want %v", i, got, want)
+		}
+	}
+	state, err := deliver(host.Mailbox[0].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state[0] != 6 {
+		t.Errorf("count after increment(5) = %d, want 6", state[0])
+	}
+	if _, err := deliver([]uint64{2}); err == nil || !strings.Contains(err.Error(), "unknown message") {
+		t.Errorf("unknown handler: error = %v, want unknown message", err)
+	}
+}
@@ -82,6 +82,16 @@ var infixPrecedence = map[token.Type]precedence{
 // Parser
 // ---------------------------------------------------------------------------
 
+// Error is a parse error with a source position.
+type Error struct {
+	Pos token.Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
 // Parser holds the mutable state for a single parse run.
 type Parser struct {
 	lex     *lexer.Lexer
@@ -169,8 +179,7 @@ func (p *Parser) skipTo(types ...token.Type) {
 
 // errorf records a parse error at the given position.
 func (p *Parser) errorf(pos token.Position, format string, args ...interface{}) {
-	msg := fmt.Sprintf(format, args...)
-	p.errors = append(p.errors, fmt.Errorf("%s: %s", pos, msg))
+	p.errors = append(p.errors, &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)})
 }
 
 // ---------------------------------------------------------------------------
@@ -552,8 +561,14 @@ func (p *Parser) parseMsgHandler() ast.MsgHandler {
 
 	params := p.parseParamList()
 
+	var retType ast.TypeExpr
+	if p.curIs(token.ARROW) {
+		p.advance()
+		retType = p.parseType()
+	}
+
 	body := p.parseBlockExpr()
-	return ast.MsgHandler{Token: tok, Name: name, Params: params, Body: body}
+	return ast.MsgHandler{Token: tok, Name: name, Params: params, ReturnType: retType, Body: body}
 }
 
 // ---------------------------------------------------------------------------
@@ -1002,6 +1017,7 @@ func (p *Parser) parseBlockExpr() *ast.BlockExpr {
 			}
 		} else {
 			// Try to parse as expression — may be tail or stmt.
+			exprTok := p.cur
 			expr := p.parseExpression(precLowest)
 
 			// Check assignment operators.
@@ -1017,6 +1033,10 @@ func (p *Parser) parseBlockExpr() *ast.BlockExpr {
 			} else if p.curIs(token.SEMICOLON) {
 				p.advance()
 				stmts = append(stmts, &ast.ExprStmt{Token: p.cur, Expression: expr})
+			} else if isBlockLike(expr) && !p.curIs(token.RBRACE) {
+				// if/match/block expressions need no semicolon when
+				// followed by further statements.
+				stmts = append(stmts, &ast.ExprStmt{Token: exprTok, Expression: expr})
 			} else {
 				// No semicolon — treat as block tail.
 				tail = expr
@@ -1029,6 +1049,16 @@ func (p *Parser) parseBlockExpr() *ast.BlockExpr {
 	return &ast.BlockExpr{Token: tok, Statements: stmts, Tail: tail}
 }
 
+// isBlockLike reports whether expr ends with a block and may therefore be used
+// as a statement without a terminating semicolon.
+func isBlockLike(expr ast.Expression) bool {
+	switch expr.(type) {
+	case *ast.IfExpr, *ast.MatchExpr, *ast.BlockExpr:
+		return true
+	}
+	return false
+}
+
 // curAssignOp returns the assignment operator string if the current token is
 // an assignment operator, otherwise "".
 func (p *Parser) curAssignOp() string {
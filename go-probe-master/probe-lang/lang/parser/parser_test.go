@@ -309,6 +309,18 @@ func TestParseAgentDecl_NoState(t *testing.T) {
 	}
 }
 
+func TestParseAgentDecl_HandlerReturnType(t *testing.T) {
+	src := `agent Counter { state { n: u64 } msg get() -> u64 { self.n } }`
+	prog := mustParse(t, src)
+	ag := firstDecl(t, prog).(*ast.AgentDecl)
+	if len(ag.Handlers) != 1 {
+		t.Fatalf("want 1 handler, got %d", len(ag.Handlers))
+	}
+	if rt := ag.Handlers[0].ReturnType; rt == nil || rt.String() != "u64" {
+		t.Errorf("handler return type: want u64, got %v", rt)
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Resource declaration
 // ---------------------------------------------------------------------------
@@ -1138,6 +1150,20 @@ func TestErrorRecovery_InvalidTopLevel(t *testing.T) {
 	}
 }
 
+func TestErrorPosition(t *testing.T) {
+	_, errs := parseWithErrors(t, "fn f() {\n    let = 1;\n}")
+	perr, ok := errs[0].(*Error)
+	if !ok {
+		t.Fatalf("error is %T, want *Error", errs[0])
+	}
+	if perr.Pos.File != "test.probe" || perr.Pos.Line != 2 || perr.Pos.Column != 9 {
+		t.Errorf("error position = %s, want test.probe:2:9", perr.Pos)
+	}
+	if want := perr.Pos.String() + ": " + perr.Msg; perr.Error() != want {
+		t.Errorf("Error() = %q, want %q", perr.Error(), want)
+	}
+}
+
 func TestErrorRecovery_MissingParamType(t *testing.T) {
 	// Missing type after colon — parser should handle gracefully.
 	src := `fn bad(x:) { }`
@@ -1261,6 +1287,28 @@ func TestParseBlockExpr_Standalone(t *testing.T) {
 	}
 }
 
+func TestParseBlockLikeStatements(t *testing.T) {
+	src := `fn f(x: u64) -> u64 {
+		if x > 1 { x = 1; }
+		match x { 0 => 1, _ => 2 }
+		{ x }
+	}`
+	prog := mustParse(t, src)
+	fn := firstDecl(t, prog).(*ast.FnDecl)
+	if len(fn.Body.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(fn.Body.Statements))
+	}
+	if _, ok := fn.Body.Statements[0].(*ast.ExprStmt).Expression.(*ast.IfExpr); !ok {
+		t.Errorf("expected if statement, got %T", fn.Body.Statements[0])
+	}
+	if _, ok := fn.Body.Statements[1].(*ast.ExprStmt).Expression.(*ast.MatchExpr); !ok {
+		t.Errorf("expected match statement, got %T", fn.Body.Statements[1])
+	}
+	if _, ok := fn.Body.Tail.(*ast.BlockExpr); !ok {
+		t.Errorf("expected block tail, got %T", fn.Body.Tail)
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Self parameter
 // ---------------------------------------------------------------------------
@@ -0,0 +1,908 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Semantic analysis for the PROBE language.
+//
+// Check walks a parsed program and reports positioned diagnostics for:
+//
+//   - Name resolution: modules, use imports, types, functions, variants.
+//   - Type checking: every expression is assigned a type; operands,
+//     arguments, returns and assignments must be compatible. Integer types
+//     widen implicitly; integer literals adopt the type they are used as.
+//   - Trait impls: an impl for a trait must provide exactly the trait's
+//     methods with matching signatures.
+//   - Linearity: resource values must be consumed exactly once, by move,
+//     drop, passing them by value, or returning them, on every path.
+//
+// Bare self receivers are borrowed (&T), so methods do not consume the
+// value they are called on.
+package types
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/probechain/go-probe/probe-lang/lang/ast"
+	"github.com/probechain/go-probe/probe-lang/lang/token"
+)
+
+// Diagnostic is a semantic error at a source position.
+type Diagnostic struct {
+	Pos token.Position
+	Msg string
+}
+
+func (d *Diagnostic) Error() string {
+	return fmt.Sprintf("%s: %s", d.Pos, d.Msg)
+}
+
+// Diagnostics is a list of diagnostics in source order.
+type Diagnostics []*Diagnostic
+
+func (ds Diagnostics) Error() string {
+	switch len(ds) {
+	case 0:
+		return "no errors"
+	case 1:
+		return ds[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", ds[0], len(ds)-1)
+}
+
+// Info records the results of checking a program.
+type Info struct {
+	// Types maps every checked expression to its type.
+	Types map[ast.Expression]Type
+
+	// Uses maps identifiers to the position of the declaration they
+	// resolve to.
+	Uses map[*ast.Ident]token.Position
+}
+
+// Internal types. They are distinct instances so they can be told apart
+// from the primitives they resemble by identity.
+var (
+	untypedInt Type = &primitiveType{kind: KindU64} // integer literal
+	nilType    Type = &primitiveType{kind: KindVoid}
+	never      Type = &primitiveType{kind: KindVoid} // diverging expression
+	invalid    Type = &primitiveType{kind: KindVoid} // already reported
+)
+
+var primitiveTypes = map[string]Type{
+	"void": Void, "bool": Bool,
+	"u8": U8, "u16": U16, "u32": U32, "u64": U64, "u128": U128, "u256": U256,
+	"i8": I8, "i16": I16, "i32": I32, "i64": I64, "f32": F32, "f64": F64,
+	"string": String, "bytes": Bytes, "address": Address,
+}
+
+// intrinsics are the chain and crypto builtins, callable qualified or bare.
+var intrinsics = map[string]*FnType{
+	"chain::caller":          {Return: Address},
+	"chain::block_number":    {Return: U64},
+	"chain::block_timestamp": {Return: U64},
+	"chain::balance":         {Params: []Type{Address}, Return: U64},
+	"chain::transfer":        {Params: []Type{Address, U64}, Return: Void},
+	"chain::storage_load":    {Params: []Type{U64}, Return: U64},
+	"chain::storage_store":   {Params: []Type{U64, U64}, Return: Void},
+	"crypto::sha3":           {Params: []Type{Bytes}, Return: Bytes},
+	"crypto::shake256":       {Params: []Type{Bytes}, Return: Bytes},
+
+	"crypto::falcon512_verify": {Params: []Type{Bytes, Bytes, Bytes}, Return: Bool},
+	"crypto::ml_dsa_verify":    {Params: []Type{Bytes, Bytes, Bytes}, Return: Bool},
+	"crypto::slh_dsa_verify":   {Params: []Type{Bytes, Bytes, Bytes}, Return: Bool},
+}
+
+// Intrinsics returns the signatures of the chain and crypto builtins by
+// qualified name, such as "chain::balance".
+func Intrinsics() map[string]*FnType {
+	m := make(map[string]*FnType, len(intrinsics))
+	for name, sig := range intrinsics {
+		m[name] = sig
+	}
+	return m
+}
+
+// typeDecl is a declared named type.
+type typeDecl struct {
+	typ    Type
+	pos    token.Position
+	module string
+	fields []ast.Field
+}
+
+type aliasDecl struct {
+	typ    ast.TypeExpr
+	module string
+	pos    token.Position
+}
+
+type variantInfo struct {
+	enum   *EnumType
+	index  int
+	pos    token.Position
+	fields []ast.TypeExpr
+}
+
+type traitDecl struct {
+	decl   *ast.TraitDecl
+	module string
+}
+
+type agentInfo struct {
+	typ      *AgentType
+	state    *StructType
+	handlers map[string]*funcSig
+}
+
+// funcSig is a function, method or message handler signature.
+type funcSig struct {
+	name   string
+	module string
+	pos    token.Position
+	params []ast.Param
+	ptypes []Type
+	ret    Type
+	retExp ast.TypeExpr
+	body   *ast.BlockExpr
+	self   Type // implicit receiver of message handlers
+	method bool // first parameter is a bare self receiver
+}
+
+type variable struct {
+	typ     Type
+	mutable bool
+	pos     token.Position
+}
+
+// scope is a lexical block with its own linear bookkeeping.
+type scope struct {
+	vars   map[string]*variable
+	linear *LinearChecker
+}
+
+type checker struct {
+	info  *Info
+	diags Diagnostics
+
+	types        map[string]*typeDecl
+	aliases      map[string]aliasDecl
+	funcs        map[string]*funcSig
+	order        []*funcSig
+	variants     map[string]*variantInfo
+	bareVariants map[string][]*variantInfo
+	traits       map[string]*traitDecl
+	agents       map[string]*agentInfo
+	imports      map[string]string
+
+	// Per-function state.
+	fn     *funcSig
+	scopes []*scope
+	loops  []int // scope depth at each enclosing loop
+	dead   bool  // current code is unreachable
+}
+
+// Check type-checks a program. It returns the recorded type information
+// and the diagnostics found, sorted by position.
+func Check(prog *ast.Program) (*Info, Diagnostics) {
+	c := &checker{
+		info: &Info{
+			Types: make(map[ast.Expression]Type),
+			Uses:  make(map[*ast.Ident]token.Position),
+		},
+		types:        make(map[string]*typeDecl),
+		aliases:      make(map[string]aliasDecl),
+		funcs:        make(map[string]*funcSig),
+		variants:     make(map[string]*variantInfo),
+		bareVariants: make(map[string][]*variantInfo),
+		traits:       make(map[string]*traitDecl),
+		agents:       make(map[string]*agentInfo),
+		imports:      make(map[string]string),
+	}
+	var impls []implDecl
+	c.collect(prog.Declarations, "", &impls)
+	c.resolveDecls()
+	for _, impl := range impls {
+		c.collectImpl(impl.decl, impl.module)
+	}
+	for _, fn := range c.order {
+		c.signature(fn)
+	}
+	for _, impl := range impls {
+		c.checkImpl(impl.decl, impl.module)
+	}
+	for _, fn := range c.order {
+		c.checkFunc(fn)
+	}
+	sort.SliceStable(c.diags, func(i, j int) bool {
+		a, b := c.diags[i].Pos, c.diags[j].Pos
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return c.info, c.diags
+}
+
+func (c *checker) errorf(pos token.Position, format string, args ...interface{}) {
+	c.diags = append(c.diags, &Diagnostic{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+// ---------------------------------------------------------------------------
+// Declarations
+// ---------------------------------------------------------------------------
+
+type implDecl struct {
+	decl   *ast.ImplDecl
+	module string
+}
+
+func (c *checker) collect(decls []ast.Declaration, module string, impls *[]implDecl) {
+	for _, decl := range decls {
+		switch d := decl.(type) {
+		case *ast.FnDecl:
+			c.addFunc(&funcSig{
+				name:   module + d.Name,
+				module: module,
+				pos:    d.Token.Pos,
+				params: d.Params,
+				retExp: d.ReturnType,
+				body:   d.Body,
+			})
+		case *ast.StructDecl:
+			c.addType(module, d.Name, d.Token.Pos, &StructType{Name: module + d.Name}, d.Fields)
+		case *ast.ResourceDecl:
+			c.addType(module, d.Name, d.Token.Pos, &ResourceType{Name: module + d.Name}, d.Fields)
+		case *ast.EnumDecl:
+			c.addEnum(module, d)
+		case *ast.AgentDecl:
+			c.addAgent(module, d)
+		case *ast.TraitDecl:
+			q := module + d.Name
+			if _, ok := c.traits[q]; ok {
+				c.errorf(d.Token.Pos, "trait %s redeclared", q)
+				continue
+			}
+			c.traits[q] = &traitDecl{decl: d, module: module}
+		case *ast.TypeDecl:
+			if c.isType(module + d.Name) {
+				c.errorf(d.Token.Pos, "type %s redeclared", module+d.Name)
+				continue
+			}
+			c.aliases[module+d.Name] = aliasDecl{typ: d.Type, module: module, pos: d.Token.Pos}
+		case *ast.UseDecl:
+			if len(d.Path) == 0 {
+				continue
+			}
+			name := d.Path[len(d.Path)-1]
+			if d.Alias != "" {
+				name = d.Alias
+			}
+			c.imports[module+name] = strings.Join(d.Path, "::")
+		case *ast.ModDecl:
+			c.collect(d.Declarations, module+d.Name+"::", impls)
+		case *ast.ImplDecl:
+			*impls = append(*impls, implDecl{decl: d, module: module})
+		}
+	}
+}
+
+func (c *checker) addFunc(fn *funcSig) {
+	if _, ok := c.funcs[fn.name]; ok {
+		c.errorf(fn.pos, "function %s redeclared", fn.name)
+		return
+	}
+	c.funcs[fn.name] = fn
+	c.order = append(c.order, fn)
+}
+
+func (c *checker) addType(module, name string, pos token.Position, typ Type, fields []ast.Field) bool {
+	q := module + name
+	if c.isType(q) {
+		c.errorf(pos, "type %s redeclared", q)
+		return false
+	}
+	seen := make(map[string]bool)
+	for _, f := range fields {
+		if seen[f.Name] {
+			c.errorf(f.Token.Pos, "duplicate field %s in %s", f.Name, q)
+		}
+		seen[f.Name] = true
+	}
+	c.types[q] = &typeDecl{typ: typ, pos: pos, module: module, fields: fields}
+	return true
+}
+
+func (c *checker) addEnum(module string, d *ast.EnumDecl) {
+	e := &EnumType{Name: module + d.Name}
+	if !c.addType(module, d.Name, d.Token.Pos, e, nil) {
+		return
+	}
+	for _, v := range d.Variants {
+		if _, ok := c.variants[e.Name+"::"+v.Name]; ok {
+			c.errorf(v.Token.Pos, "duplicate variant %s in %s", v.Name, e.Name)
+			continue
+		}
+		info := &variantInfo{enum: e, index: len(e.Variants), pos: v.Token.Pos, fields: v.Fields}
+		e.Variants = append(e.Variants, Variant{Name: v.Name})
+		c.variants[e.Name+"::"+v.Name] = info
+		c.bareVariants[v.Name] = append(c.bareVariants[v.Name], info)
+	}
+}
+
+func (c *checker) addAgent(module string, d *ast.AgentDecl) {
+	q := module + d.Name
+	var fields []ast.Field
+	if d.State != nil {
+		fields = d.State.Fields
+	}
+	ag := &agentInfo{
+		typ:      &AgentType{Name: q},
+		state:    &StructType{Name: q},
+		handlers: make(map[string]*funcSig),
+	}
+	if !c.addType(module, d.Name, d.Token.Pos, ag.typ, fields) {
+		return
+	}
+	c.agents[q] = ag
+	for _, h := range d.Handlers {
+		fn := &funcSig{
+			name:   q + "::" + h.Name,
+			module: module,
+			pos:    h.Token.Pos,
+			params: h.Params,
+			retExp: h.ReturnType,
+			body:   h.Body,
+			self:   &RefType{Inner: ag.state, Mutable: true},
+		}
+		ag.handlers[h.Name] = fn
+		c.addFunc(fn)
+	}
+}
+
+func (c *checker) collectImpl(d *ast.ImplDecl, module string) {
+	q, ok := c.resolve(d.TypeName, module, c.isType)
+	if !ok {
+		c.errorf(d.Token.Pos, "impl of undefined type %s", d.TypeName)
+		return
+	}
+	for i := range d.Methods {
+		m := &d.Methods[i]
+		c.addFunc(&funcSig{
+			name:   q + "::" + m.Name,
+			module: module,
+			pos:    m.Token.Pos,
+			params: m.Params,
+			retExp: m.ReturnType,
+			body:   m.Body,
+		})
+	}
+}
+
+// resolveDecls fills in the fields of declared types and variants.
+func (c *checker) resolveDecls() {
+	names := make([]string, 0, len(c.types))
+	for q := range c.types {
+		names = append(names, q)
+	}
+	sort.Strings(names)
+	for _, q := range names {
+		td := c.types[q]
+		var fields []Field
+		for _, f := range td.fields {
+			fields = append(fields, Field{Name: f.Name, Type: c.resolveType(f.Type, td.module)})
+		}
+		switch t := td.typ.(type) {
+		case *StructType:
+			t.Fields = fields
+		case *ResourceType:
+			t.Fields = fields
+		case *AgentType:
+			ag := c.agents[q]
+			ag.state.Fields = fields
+		}
+	}
+	names = names[:0]
+	for q := range c.variants {
+		names = append(names, q)
+	}
+	sort.Strings(names)
+	for _, q := range names {
+		v := c.variants[q]
+		module := c.types[v.enum.Name].module
+		var fields []Field
+		for i, t := range v.fields {
+			fields = append(fields, Field{Name: fmt.Sprint(i), Type: c.resolveType(t, module)})
+		}
+		v.enum.Variants[v.index].Fields = fields
+	}
+	// A type holding itself by value has no size and no linearity; drop
+	// the offending fields so later passes terminate.
+	names = names[:0]
+	for q := range c.types {
+		names = append(names, q)
+	}
+	sort.Strings(names)
+	for _, q := range names {
+		t := c.types[q].typ
+		if ag, ok := c.agents[q]; ok {
+			t = ag.state
+		}
+		if contains(t, t, make(map[Type]bool)) {
+			c.errorf(c.types[q].pos, "invalid recursive type %s", q)
+			switch t := t.(type) {
+			case *StructType:
+				t.Fields = nil
+			case *ResourceType:
+				t.Fields = nil
+			case *EnumType:
+				for i := range t.Variants {
+					t.Variants[i].Fields = nil
+				}
+			}
+		}
+	}
+}
+
+// contains reports whether t holds target by value, through fields,
+// payloads or elements. References break the chain.
+func contains(t, target Type, seen map[Type]bool) bool {
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+	var inner []Type
+	switch t := t.(type) {
+	case *ArrayType:
+		inner = []Type{t.Elem}
+	case *SliceType:
+		inner = []Type{t.Elem}
+	case *StructType:
+		inner = fieldTypes(t.Fields)
+	case *ResourceType:
+		inner = fieldTypes(t.Fields)
+	case *EnumType:
+		for _, v := range t.Variants {
+			inner = append(inner, fieldTypes(v.Fields)...)
+		}
+	}
+	for _, it := range inner {
+		if it == target || contains(it, target, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// signature resolves the parameter and return types of a function.
+func (c *checker) signature(fn *funcSig) {
+	seen := make(map[string]bool)
+	for i, p := range fn.params {
+		if seen[p.Name] {
+			c.errorf(p.Token.Pos, "duplicate parameter %s", p.Name)
+		}
+		seen[p.Name] = true
+		var t Type
+		if p.Name == "self" && p.Type == nil {
+			recv, ok := c.receiverType(fn)
+			if !ok || i != 0 {
+				c.errorf(p.Token.Pos, "self parameter outside of a method")
+				t = invalid
+			} else {
+				t = &RefType{Inner: recv, Mutable: true}
+				fn.method = true
+			}
+		} else {
+			t = c.resolveType(p.Type, fn.module)
+		}
+		fn.ptypes = append(fn.ptypes, t)
+	}
+	fn.ret = c.resolveType(fn.retExp, fn.module)
+}
+
+// receiverType returns the impl type a method belongs to.
+func (c *checker) receiverType(fn *funcSig) (Type, bool) {
+	i := strings.LastIndex(fn.name, "::")
+	if i < 0 {
+		return nil, false
+	}
+	td, ok := c.types[fn.name[:i]]
+	if !ok {
+		return nil, false
+	}
+	return td.typ, true
+}
+
+// checkImpl verifies that a trait impl provides exactly the trait's methods.
+func (c *checker) checkImpl(d *ast.ImplDecl, module string) {
+	if d.Trait == "" {
+		return
+	}
+	q, ok := c.resolve(d.Trait, module, func(q string) bool {
+		_, ok := c.traits[q]
+		return ok
+	})
+	if !ok {
+		c.errorf(d.Token.Pos, "undefined trait %s", d.Trait)
+		return
+	}
+	typeName, ok := c.resolve(d.TypeName, module, c.isType)
+	if !ok {
+		return
+	}
+	trait := c.traits[q]
+	required := make(map[string]bool)
+	for _, tm := range trait.decl.Methods {
+		required[tm.Name] = true
+		impl, ok := c.funcs[typeName+"::"+tm.Name]
+		if !ok {
+			c.errorf(d.Token.Pos, "%s does not implement %s: missing method %s", typeName, q, tm.Name)
+			continue
+		}
+		if !c.matchesTrait(impl, tm, trait.module) {
+			c.errorf(impl.pos, "method %s has the wrong signature for trait %s", tm.Name, q)
+		}
+	}
+	for _, m := range d.Methods {
+		if !required[m.Name] {
+			c.errorf(m.Token.Pos, "method %s is not a member of trait %s", m.Name, q)
+		}
+	}
+}
+
+func (c *checker) matchesTrait(impl *funcSig, tm ast.TraitMethod, module string) bool {
+	if len(impl.params) != len(tm.Params) {
+		return false
+	}
+	for i, p := range tm.Params {
+		if p.Name == "self" && p.Type == nil {
+			if !impl.method || i != 0 {
+				return false
+			}
+			continue
+		}
+		if !identical(c.resolveType(p.Type, module), impl.ptypes[i]) {
+			return false
+		}
+	}
+	return identical(c.resolveType(tm.ReturnType, module), impl.ret)
+}
+
+// ---------------------------------------------------------------------------
+// Name resolution
+// ---------------------------------------------------------------------------
+
+// resolve finds the qualified name that name refers to from module: the
+// module itself is searched first, then its ancestors; at each level a use
+// import may rename the first path segment.
+func (c *checker) resolve(name, module string, exists func(string) bool) (string, bool) {
+	first, rest := name, ""
+	if i := strings.Index(name, "::"); i >= 0 {
+		first, rest = name[:i], name[i:]
+	}
+	for m := module; ; m = parentModule(m) {
+		if exists(m + name) {
+			return m + name, true
+		}
+		if target, ok := c.imports[m+first]; ok && exists(target+rest) {
+			return target + rest, true
+		}
+		if m == "" {
+			return "", false
+		}
+	}
+}
+
+func parentModule(m string) string {
+	m = strings.TrimSuffix(m, "::")
+	if i := strings.LastIndex(m, "::"); i >= 0 {
+		return m[:i+2]
+	}
+	return ""
+}
+
+func (c *checker) isType(q string) bool {
+	if _, ok := c.types[q]; ok {
+		return true
+	}
+	_, ok := c.aliases[q]
+	return ok
+}
+
+func (c *checker) isFunc(q string) bool {
+	_, ok := c.funcs[q]
+	return ok
+}
+
+func (c *checker) isConstructible(q string) bool {
+	td, ok := c.types[q]
+	if !ok {
+		return false
+	}
+	switch td.typ.(type) {
+	case *StructType, *ResourceType:
+		return true
+	}
+	return false
+}
+
+// lookupVariant resolves a qualified or bare variant name. Bare names must
+// be unambiguous unless hint names the enum.
+func (c *checker) lookupVariant(name string, hint Type) *variantInfo {
+	if strings.Contains(name, "::") {
+		if q, ok := c.resolve(name, c.fn.module, func(q string) bool {
+			_, ok := c.variants[q]
+			return ok
+		}); ok {
+			return c.variants[q]
+		}
+		return nil
+	}
+	candidates := c.bareVariants[name]
+	for _, v := range candidates {
+		if hint != nil && Type(v.enum) == hint {
+			return v
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Types
+// ---------------------------------------------------------------------------
+
+func (c *checker) resolveType(t ast.TypeExpr, module string) Type {
+	return c.resolveTypeDepth(t, module, 0)
+}
+
+func (c *checker) resolveTypeDepth(t ast.TypeExpr, module string, depth int) Type {
+	switch t := t.(type) {
+	case nil:
+		return Void
+	case *ast.NamedType:
+		return c.namedType(t.Name, t.Token.Pos, module, depth)
+	case *ast.PathType:
+		return c.namedType(strings.Join(t.Segments, "::"), t.Token.Pos, module, depth)
+	case *ast.ArrayType:
+		elem := c.resolveTypeDepth(t.Elem, module, depth+1)
+		size, ok := t.Size.(*ast.IntLiteral)
+		if !ok || size.Value < 0 {
+			c.errorf(t.Token.Pos, "array size must be a non-negative integer literal")
+			return &SliceType{Elem: elem}
+		}
+		return &ArrayType{Elem: elem, Len: int(size.Value)}
+	case *ast.SliceType:
+		return &SliceType{Elem: c.resolveTypeDepth(t.Elem, module, depth+1)}
+	case *ast.RefType:
+		return &RefType{Inner: c.resolveTypeDepth(t.Elem, module, depth+1)}
+	case *ast.MutRefType:
+		return &RefType{Inner: c.resolveTypeDepth(t.Elem, module, depth+1), Mutable: true}
+	case *ast.FnType:
+		fn := &FnType{Return: c.resolveTypeDepth(t.ReturnType, module, depth+1)}
+		for _, p := range t.ParamTypes {
+			fn.Params = append(fn.Params, c.resolveTypeDepth(p, module, depth+1))
+		}
+		return fn
+	}
+	return invalid
+}
+
+func (c *checker) namedType(name string, pos token.Position, module string, depth int) Type {
+	if t, ok := primitiveTypes[name]; ok {
+		return t
+	}
+	q, ok := c.resolve(name, module, c.isType)
+	if !ok {
+		c.errorf(pos, "undefined type %s", name)
+		return invalid
+	}
+	if a, ok := c.aliases[q]; ok {
+		if depth > 32 {
+			c.errorf(a.pos, "type alias %s is cyclic", q)
+			return invalid
+		}
+		return c.resolveTypeDepth(a.typ, a.module, depth+1)
+	}
+	return c.types[q].typ
+}
+
+// typeName returns the qualified name of a declared type, if any.
+func typeName(t Type) string {
+	switch t := t.(type) {
+	case *StructType:
+		return t.Name
+	case *ResourceType:
+		return t.Name
+	case *EnumType:
+		return t.Name
+	case *AgentType:
+		return t.Name
+	}
+	return ""
+}
+
+// describe renders a type for diagnostics.
+func describe(t Type) string {
+	switch t {
+	case untypedInt:
+		return "integer literal"
+	case nilType:
+		return "nil"
+	case never, invalid:
+		return "!"
+	}
+	if name := typeName(t); name != "" {
+		return name
+	}
+	switch t := t.(type) {
+	case *ArrayType:
+		return fmt.Sprintf("[%s; %d]", describe(t.Elem), t.Len)
+	case *SliceType:
+		return fmt.Sprintf("[%s]", describe(t.Elem))
+	case *RefType:
+		if t.Mutable {
+			return "&mut " + describe(t.Inner)
+		}
+		return "&" + describe(t.Inner)
+	}
+	return t.String()
+}
+
+func isInteger(t Type) bool {
+	if t == untypedInt {
+		return true
+	}
+	if _, ok := t.(*primitiveType); !ok {
+		return false
+	}
+	switch t.Kind() {
+	case KindU8, KindU16, KindU32, KindU64, KindU128, KindU256, KindI8, KindI16, KindI32, KindI64:
+		return true
+	}
+	return false
+}
+
+func isSigned(t Type) bool {
+	switch t.Kind() {
+	case KindI8, KindI16, KindI32, KindI64:
+		return true
+	}
+	return false
+}
+
+func isFloat(t Type) bool {
+	_, ok := t.(*primitiveType)
+	return ok && (t.Kind() == KindF32 || t.Kind() == KindF64)
+}
+
+func isText(t Type) bool {
+	_, ok := t.(*primitiveType)
+	return ok && (t.Kind() == KindString || t.Kind() == KindBytes)
+}
+
+func isBool(t Type) bool {
+	return t == Bool || t == invalid || t == never
+}
+
+// deref strips references.
+func deref(t Type) Type {
+	for {
+		r, ok := t.(*RefType)
+		if !ok {
+			return t
+		}
+		t = r.Inner
+	}
+}
+
+// identical reports whether two types are the same. Declared types are
+// compared by identity.
+func identical(a, b Type) bool {
+	if a == invalid || b == invalid {
+		return true
+	}
+	switch a := a.(type) {
+	case *primitiveType:
+		b, ok := b.(*primitiveType)
+		return ok && a.kind == b.kind && a != untypedInt && b != untypedInt &&
+			a != nilType && b != nilType && a != never && b != never
+	case *ArrayType:
+		b, ok := b.(*ArrayType)
+		return ok && a.Len == b.Len && identical(a.Elem, b.Elem)
+	case *SliceType:
+		b, ok := b.(*SliceType)
+		return ok && identical(a.Elem, b.Elem)
+	case *RefType:
+		b, ok := b.(*RefType)
+		return ok && a.Mutable == b.Mutable && identical(a.Inner, b.Inner)
+	case *FnType:
+		b, ok := b.(*FnType)
+		if !ok || len(a.Params) != len(b.Params) || !identical(a.Return, b.Return) {
+			return false
+		}
+		for i := range a.Params {
+			if !identical(a.Params[i], b.Params[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// assignable reports whether a value of type src can be used as dst.
+func assignable(dst, src Type) bool {
+	if dst == invalid || src == invalid || src == never {
+		return true
+	}
+	if src == untypedInt {
+		return isInteger(dst)
+	}
+	if src == nilType {
+		switch dst.Kind() {
+		case KindRef, KindMutRef, KindAgent, KindString, KindBytes, KindSlice, KindAddress:
+			return true
+		}
+		return false
+	}
+	if isInteger(src) && isInteger(dst) && dst != untypedInt {
+		ss, ds := src.Size(), dst.Size()
+		if isSigned(src) == isSigned(dst) {
+			return ss <= ds
+		}
+		return !isSigned(src) && ss < ds
+	}
+	if src == String && dst == Bytes {
+		return true
+	}
+	switch d := dst.(type) {
+	case *SliceType:
+		switch s := src.(type) {
+		case *ArrayType:
+			return identical(d.Elem, s.Elem)
+		case *SliceType:
+			return identical(d.Elem, s.Elem)
+		}
+	case *RefType:
+		if s, ok := src.(*RefType); ok {
+			return (s.Mutable || !d.Mutable) && identical(d.Inner, s.Inner)
+		}
+	}
+	return identical(dst, src)
+}
+
+// unify returns the common type of two operands, or nil.
+func unify(a, b Type) Type {
+	switch {
+	case a == never:
+		return b
+	case b == never:
+		return a
+	case a == untypedInt && b == untypedInt:
+		return untypedInt
+	case assignable(b, a):
+		return b
+	case assignable(a, b):
+		return a
+	}
+	return nil
+}
+
+// concrete replaces literal types with their defaults.
+func concrete(t Type) Type {
+	if t == untypedInt {
+		return U64
+	}
+	return t
+}
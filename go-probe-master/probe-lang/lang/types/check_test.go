@@ -0,0 +1,197 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package types
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/probechain/go-probe/probe-lang/lang/ast"
+	"github.com/probechain/go-probe/probe-lang/lang/parser"
+)
+
+func check(t *testing.T, src string) (*Info, Diagnostics) {
+	t.Helper()
+	prog, errs := parser.Parse("test.probe", src)
+	if len(errs) > 0 {
+		t.Fatalf("parse %q: %v", src, errs)
+	}
+	return Check(prog)
+}
+
+func TestCheckValid(t *testing.T) {
+	src := `
+resource Coin { value: u64 }
+struct Point { x: u64, y: u64 }
+enum Shape { Circle(u64), Empty }
+trait Area { fn area(self) -> u64; }
+
+impl Area for Point {
+    fn area(self) -> u64 { self.x * self.y }
+}
+
+agent Bank {
+    state { total: u64 }
+    msg deposit(amount: u64) { self.total += amount; }
+}
+
+fn burn(c: Coin) -> u64 {
+    let v = c.value;
+    drop c;
+    v
+}
+
+fn pick(flag: bool, a: u64) -> u64 {
+    let c = Coin(a);
+    if flag {
+        burn(c)
+    } else {
+        drop c;
+        0
+    }
+}
+
+fn size(s: Shape) -> u64 {
+    match s {
+        Circle(r) => r * r,
+        Empty => 0,
+    }
+}
+
+fn total(xs: [u64; 3]) -> u64 {
+    let mut sum = 0;
+    for x in xs { sum += x; }
+    sum
+}
+
+fn run() {
+    let b = spawn Bank { total: 0 };
+    b.deposit(pick(true, 3) + size(Empty) + Point(1, 2).area());
+}
+`
+	if _, diags := check(t, src); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics:\n%v", diagList(diags))
+	}
+}
+
+func diagList(diags Diagnostics) string {
+	var lines []string
+	for _, d := range diags {
+		lines = append(lines, d.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestCheckErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"mismatch", `fn f() -> u64 { true }`, "1:17: cannot use bool as u64 in return"},
+		{"let", `fn f() { let x: bool = 1; }`, "1:24: cannot use integer literal as bool in let"},
+		{"argument", `fn g(a: u8) {} fn f(x: u64) { g(x); }`, "cannot use u64 as u8 in argument 1 to g"},
+		{"undefined", `fn f() -> u64 { x }`, "1:17: undefined: x"},
+		{"undefined type", `fn f(p: Nope) {}`, "undefined type Nope"},
+		{"condition", `fn f() { if 1 { } }`, "if condition must be bool"},
+		{"immutable", `fn f() { let x = 1; x = 2; }`, "cannot assign to immutable binding x"},
+		{"arity", `fn f(a: u64) {} fn g() { f(); }`, "f expects 1 arguments, got 0"},
+		{"field", `struct P { x: u64 } fn f(p: P) -> u64 { p.y }`, "unknown field y in P"},
+		{"handler", `agent A { msg m() {} } fn f() { A::m(); }`, "must be invoked with send"},
+		{"no handler", `agent A { msg m() {} } fn f() { let a = spawn A {}; a.n(); }`, "agent A has no handler n"},
+		{"missing return", `fn f() -> u64 { }`, "missing return value in f"},
+		{"recursive", `struct N { next: N }`, "invalid recursive type N"},
+
+		{"use after move", `resource R { v: u64 } fn f() { let r = R(1); let a = move r; drop a; drop r; }`,
+			"1:75: linear type error [use-after-move]"},
+		{"unconsumed", `resource R { v: u64 } fn f() { let r = R(1); }`,
+			"1:36: linear type error [unconsumed-resource] for \"r\""},
+		{"drop plain", `fn f() { let x = 1; drop x; }`, "drop-non-resource"},
+		{"some paths", `resource R { v: u64 } fn f(b: bool) { let r = R(1); if b { drop r; } }`,
+			"resource r is consumed on only some paths"},
+		{"loop", `resource R { v: u64 } fn f() { let r = R(1); while true { drop r; } }`,
+			"resource r is consumed inside a loop"},
+		{"return", `resource R { v: u64 } fn f() -> u64 { let r = R(1); return 1; }`,
+			"1:53: linear type error [unconsumed-resource]"},
+		{"discarded", `resource R { v: u64 } fn f() { R(1); }`, "unused resource value of type R"},
+		{"copy", `resource R { v: u64 } fn f() { let r = R(1); let s = copy r; drop r; drop s; }`,
+			"cannot copy resource of type R"},
+		{"field move", `resource R { v: u64 } struct H { r: R } fn f(h: H) -> R { h.r }`,
+			"cannot move resource field r out of H"},
+
+		{"missing method", `trait T { fn m(self) -> u64; } struct S { } impl T for S { }`,
+			"S does not implement T: missing method m"},
+		{"wrong signature", `trait T { fn m(self) -> u64; } struct S { } impl T for S { fn m(self) -> bool { true } }`,
+			"method m has the wrong signature for trait T"},
+		{"extra method", `trait T { } struct S { } impl T for S { fn m(self) {} }`,
+			"method m is not a member of trait T"},
+	}
+	for _, tc := range tests {
+		_, diags := check(t, tc.src)
+		if len(diags) == 0 {
+			t.Errorf("%s: no diagnostics, want %q", tc.name, tc.want)
+			continue
+		}
+		if !strings.Contains(diagList(diags), tc.want) {
+			t.Errorf("%s: diagnostics\n%v\nwant %q", tc.name, diagList(diags), tc.want)
+		}
+	}
+}
+
+func TestDiagnosticsSorted(t *testing.T) {
+	_, diags := check(t, "fn f() -> u64 {\n    y\n}\nfn g() -> u64 { x }\n")
+	if len(diags) != 2 {
+		t.Fatalf("got %d diagnostics, want 2:\n%v", len(diags), diagList(diags))
+	}
+	if diags[0].Pos.Line != 2 || diags[0].Pos.Column != 5 || diags[1].Pos.Line != 4 {
+		t.Errorf("positions = %v, %v", diags[0].Pos, diags[1].Pos)
+	}
+	if want := "test.probe:2:5: undefined: y (and 1 more errors)"; diags.Error() != want {
+		t.Errorf("Error() = %q, want %q", diags.Error(), want)
+	}
+}
+
+func TestCheckInfo(t *testing.T) {
+	info, diags := check(t, "fn f(a: u8) -> u64 {\n    let b = a + 1;\n    b\n}\n")
+	if len(diags) > 0 {
+		t.Fatal(diagList(diags))
+	}
+	var uses int
+	for id, pos := range info.Uses {
+		uses++
+		switch id.Value {
+		case "a":
+			if pos.Line != 1 {
+				t.Errorf("a declared at %v, want line 1", pos)
+			}
+		case "b":
+			if pos.Line != 2 {
+				t.Errorf("b declared at %v, want line 2", pos)
+			}
+		}
+		if got := info.Types[id]; id.Value == "a" && got != U8 || id.Value == "b" && got != U8 {
+			t.Errorf("type of %s = %v, want u8", id.Value, got)
+		}
+	}
+	if uses != 2 {
+		t.Errorf("recorded %d uses, want 2", uses)
+	}
+	var sums int
+	for e, typ := range info.Types {
+		if in, ok := e.(*ast.InfixExpr); ok && in.Operator == "+" {
+			sums++
+			if typ != U8 {
+				t.Errorf("a + 1 has type %v, want u8", typ)
+			}
+		}
+	}
+	if sums != 1 {
+		t.Errorf("recorded %d sums, want 1", sums)
+	}
+}
@@ -0,0 +1,1190 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+package types
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/probechain/go-probe/probe-lang/lang/ast"
+	"github.com/probechain/go-probe/probe-lang/lang/token"
+)
+
+// ---------------------------------------------------------------------------
+// Functions and scopes
+// ---------------------------------------------------------------------------
+
+func (c *checker) checkFunc(fn *funcSig) {
+	c.fn = fn
+	c.scopes = nil
+	c.loops = nil
+	c.dead = false
+	c.push()
+	if fn.self != nil {
+		c.declare("self", fn.self, false, fn.pos)
+	}
+	for i, p := range fn.params {
+		c.declare(p.Name, fn.ptypes[i], p.Mutable, p.Token.Pos)
+	}
+	t := c.block(fn.body)
+	if !c.dead && fn.ret != Void && fn.ret != invalid {
+		if fn.body != nil && fn.body.Tail == nil {
+			c.errorf(fn.pos, "missing return value in %s", fn.name)
+		} else if !assignable(fn.ret, t) {
+			c.errorf(ast.Pos(fn.body.Tail), "cannot use %s as %s in return", describe(t), describe(fn.ret))
+		}
+	} else if !c.dead && t.IsLinear() && t != invalid {
+		c.errorf(ast.Pos(fn.body.Tail), "unused resource value of type %s", describe(t))
+	}
+	c.pop()
+}
+
+func (c *checker) push() {
+	c.scopes = append(c.scopes, &scope{
+		vars:   make(map[string]*variable),
+		linear: NewLinearChecker(),
+	})
+}
+
+// pop closes a scope, reporting resources it leaves unconsumed.
+func (c *checker) pop() {
+	s := c.scopes[len(c.scopes)-1]
+	if !c.dead {
+		c.reportUnconsumed(s, nil)
+	}
+	c.scopes = c.scopes[:len(c.scopes)-1]
+}
+
+// reportUnconsumed reports the unconsumed resources of a scope, at their
+// declarations or at pos when leaving early.
+func (c *checker) reportUnconsumed(s *scope, pos *token.Position) {
+	errs := s.linear.CheckAllConsumed()
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Name < errs[j].Name })
+	for i := range errs {
+		at := s.vars[errs[i].Name].pos
+		if pos != nil {
+			at = *pos
+		}
+		c.errorf(at, "%s", errs[i].Error())
+	}
+}
+
+func (c *checker) declare(name string, t Type, mutable bool, pos token.Position) {
+	s := c.scopes[len(c.scopes)-1]
+	if b, ok := s.linear.bindings[name]; ok && !c.dead && b.typ.IsLinear() && !b.moved {
+		c.errorf(pos, "%s shadows unconsumed resource %s", name, name)
+	}
+	s.vars[name] = &variable{typ: t, mutable: mutable, pos: pos}
+	s.linear.Bind(name, t)
+}
+
+func (c *checker) lookup(name string) (*variable, *scope) {
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		if v, ok := c.scopes[i].vars[name]; ok {
+			return v, c.scopes[i]
+		}
+	}
+	return nil, nil
+}
+
+// snapshot records which linear bindings in scope have been consumed.
+func (c *checker) snapshot() map[*bindingState]bool {
+	m := make(map[*bindingState]bool)
+	for _, s := range c.scopes {
+		for _, b := range s.linear.bindings {
+			if b.typ.IsLinear() {
+				m[b] = b.moved
+			}
+		}
+	}
+	return m
+}
+
+func (c *checker) restore(m map[*bindingState]bool) {
+	for b, moved := range m {
+		b.moved = moved
+	}
+}
+
+// bindingName returns the name of a binding state for diagnostics.
+func (c *checker) bindingName(b *bindingState) string {
+	for _, s := range c.scopes {
+		for name, sb := range s.linear.bindings {
+			if sb == b {
+				return name
+			}
+		}
+	}
+	return "?"
+}
+
+// flow is the linear state at the end of one branch.
+type flow struct {
+	state map[*bindingState]bool
+	dead  bool
+}
+
+func (c *checker) endFlow() flow {
+	return flow{state: c.snapshot(), dead: c.dead}
+}
+
+// merge joins the flows of alternative branches. A resource must be
+// consumed on all live branches or on none of them.
+func (c *checker) merge(pos token.Position, before map[*bindingState]bool, flows []flow) {
+	var live []flow
+	for _, f := range flows {
+		if !f.dead {
+			live = append(live, f)
+		}
+	}
+	if len(live) == 0 {
+		c.restore(before)
+		c.dead = true
+		return
+	}
+	c.dead = false
+	var names []string
+	merged := make(map[*bindingState]bool)
+	for b := range before {
+		moved := live[0].state[b]
+		for _, f := range live[1:] {
+			if f.state[b] != moved {
+				names = append(names, c.bindingName(b))
+				moved = true
+			}
+		}
+		merged[b] = moved
+	}
+	c.restore(merged)
+	sort.Strings(names)
+	for _, name := range names {
+		c.errorf(pos, "resource %s is consumed on only some paths", name)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Statements
+// ---------------------------------------------------------------------------
+
+// block checks a block and returns its type: the tail's type, void, or
+// never when the block diverges.
+func (c *checker) block(b *ast.BlockExpr) Type {
+	if b == nil {
+		return Void
+	}
+	c.push()
+	for _, s := range b.Statements {
+		c.stmt(s)
+	}
+	t := Type(Void)
+	if b.Tail != nil {
+		t = c.expr(b.Tail)
+	}
+	if c.dead {
+		t = never
+	}
+	c.pop()
+	return t
+}
+
+func (c *checker) stmt(s ast.Statement) {
+	switch s := s.(type) {
+	case *ast.LetStmt:
+		var t Type
+		if s.Type != nil {
+			t = c.resolveType(s.Type, c.fn.module)
+		}
+		if s.Value == nil {
+			if t == nil {
+				c.errorf(s.Name.Token.Pos, "cannot infer the type of %s", s.Name.Value)
+				t = invalid
+			}
+			c.declare(s.Name.Value, t, true, s.Name.Token.Pos)
+			// Not yet initialised: it must be assigned before use.
+			_, sc := c.lookup(s.Name.Value)
+			sc.linear.bindings[s.Name.Value].moved = true
+			return
+		}
+		vt := c.expr(s.Value)
+		if t == nil {
+			t = concrete(vt)
+			if t == Void || t == never || t == nilType {
+				c.errorf(ast.Pos(s.Value), "cannot bind %s to a value of type %s", s.Name.Value, describe(vt))
+				t = invalid
+			}
+		} else if !assignable(t, vt) {
+			c.errorf(ast.Pos(s.Value), "cannot use %s as %s in let", describe(vt), describe(t))
+		}
+		c.declare(s.Name.Value, t, s.Mutable, s.Name.Token.Pos)
+
+	case *ast.AssignStmt:
+		c.assign(s)
+
+	case *ast.ReturnStmt:
+		t := Type(Void)
+		if s.Value != nil {
+			t = c.expr(s.Value)
+		}
+		if !assignable(c.fn.ret, t) {
+			if s.Value == nil {
+				c.errorf(s.Token.Pos, "missing return value in %s", c.fn.name)
+			} else {
+				c.errorf(ast.Pos(s.Value), "cannot use %s as %s in return", describe(t), describe(c.fn.ret))
+			}
+		}
+		if !c.dead {
+			pos := s.Token.Pos
+			for _, sc := range c.scopes {
+				c.reportUnconsumed(sc, &pos)
+			}
+		}
+		c.dead = true
+
+	case *ast.ExprStmt:
+		if t := c.expr(s.Expression); t.IsLinear() && t != invalid {
+			c.errorf(ast.Pos(s.Expression), "unused resource value of type %s", describe(t))
+		}
+
+	case *ast.ForStmt:
+		c.forStmt(s)
+
+	case *ast.WhileStmt:
+		c.cond(s.Condition, "while condition")
+		c.loop(s.Token.Pos, func() { c.block(s.Body) })
+
+	case *ast.BreakStmt:
+		c.jump(s.Token.Pos, "break")
+
+	case *ast.ContinueStmt:
+		c.jump(s.Token.Pos, "continue")
+
+	case *ast.DropStmt:
+		v, sc := c.lookup(s.Value.Value)
+		if v == nil {
+			c.errorf(s.Value.Token.Pos, "undefined: %s", s.Value.Value)
+			return
+		}
+		c.info.Uses[s.Value] = v.pos
+		c.info.Types[s.Value] = v.typ
+		if v.typ == invalid || c.dead {
+			return
+		}
+		if err := sc.linear.Drop(s.Value.Value); err != nil {
+			c.errorf(s.Value.Token.Pos, "%s", err.Error())
+		}
+
+	case *ast.EmitStmt:
+		c.emit(s)
+
+	case *ast.RequireStmt:
+		c.cond(s.Condition, "require")
+		if s.Message != nil {
+			if t := c.expr(s.Message); !assignable(String, t) {
+				c.errorf(ast.Pos(s.Message), "require message must be a string, not %s", describe(t))
+			}
+		}
+	}
+}
+
+// cond checks an expression used as a condition.
+func (c *checker) cond(e ast.Expression, what string) {
+	if t := c.expr(e); !isBool(t) {
+		c.errorf(ast.Pos(e), "%s must be bool, not %s", what, describe(t))
+	}
+}
+
+// loop checks a loop body. Resources declared outside the loop cannot be
+// consumed inside it, since the body may run more than once.
+func (c *checker) loop(pos token.Position, body func()) {
+	dead := c.dead
+	before := c.snapshot()
+	c.loops = append(c.loops, len(c.scopes))
+	body()
+	c.loops = c.loops[:len(c.loops)-1]
+	after := c.snapshot()
+	var names []string
+	for b, moved := range before {
+		if !moved && after[b] {
+			names = append(names, c.bindingName(b))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.errorf(pos, "resource %s is consumed inside a loop", name)
+	}
+	c.restore(after)
+	c.dead = dead
+}
+
+// jump checks break and continue, which leave the scopes of the loop body.
+func (c *checker) jump(pos token.Position, what string) {
+	if len(c.loops) == 0 {
+		c.errorf(pos, "%s outside of a loop", what)
+		return
+	}
+	if !c.dead {
+		for _, sc := range c.scopes[c.loops[len(c.loops)-1]:] {
+			c.reportUnconsumed(sc, &pos)
+		}
+	}
+	c.dead = true
+}
+
+func (c *checker) forStmt(s *ast.ForStmt) {
+	var elem Type
+	if r, ok := s.Iterable.(*ast.RangeExpr); ok {
+		elem = c.rangeElem(r)
+		c.info.Types[r] = &SliceType{Elem: elem}
+	} else {
+		t := deref(c.borrow(s.Iterable))
+		switch t := t.(type) {
+		case *ArrayType:
+			elem = t.Elem
+		case *SliceType:
+			elem = t.Elem
+		default:
+			if isText(t) {
+				elem = U8
+			} else {
+				if t != invalid {
+					c.errorf(ast.Pos(s.Iterable), "cannot range over %s", describe(t))
+				}
+				elem = invalid
+			}
+		}
+		if elem.IsLinear() {
+			c.errorf(ast.Pos(s.Iterable), "cannot iterate over resources of type %s by value", describe(elem))
+		}
+	}
+	c.loop(s.Token.Pos, func() {
+		c.push()
+		c.declare(s.Binding.Value, elem, false, s.Binding.Token.Pos)
+		c.info.Types[s.Binding] = elem
+		c.block(s.Body)
+		c.pop()
+	})
+}
+
+func (c *checker) rangeElem(r *ast.RangeExpr) Type {
+	t := Type(untypedInt)
+	for _, bound := range []ast.Expression{r.Start, r.End} {
+		if bound == nil {
+			continue
+		}
+		bt := c.expr(bound)
+		if !isInteger(bt) {
+			if bt != invalid {
+				c.errorf(ast.Pos(bound), "range bound must be an integer, not %s", describe(bt))
+			}
+			return invalid
+		}
+		if u := unify(t, bt); u != nil {
+			t = u
+		}
+	}
+	if r.End == nil {
+		c.errorf(r.Token.Pos, "range needs an upper bound")
+	}
+	return concrete(t)
+}
+
+func (c *checker) assign(s *ast.AssignStmt) {
+	target, mutable := c.place(s.Target)
+	vt := c.expr(s.Value)
+	if target == invalid {
+		return
+	}
+	if !mutable {
+		if id := c.rootBinding(s.Target); id != nil {
+			c.errorf(ast.Pos(s.Target), "cannot assign to immutable binding %s", id.Value)
+		} else {
+			c.errorf(ast.Pos(s.Target), "cannot assign through an immutable reference")
+		}
+		return
+	}
+	if s.Operator != "=" {
+		op := strings.TrimSuffix(s.Operator, "=")
+		if rt := c.arith(op, target, vt, ast.Pos(s.Value)); rt != invalid && !assignable(target, rt) {
+			c.errorf(ast.Pos(s.Value), "cannot use %s as %s in assignment", describe(rt), describe(target))
+		}
+		return
+	}
+	if !assignable(target, vt) {
+		c.errorf(ast.Pos(s.Value), "cannot use %s as %s in assignment", describe(vt), describe(target))
+		return
+	}
+	if id, ok := s.Target.(*ast.Ident); ok && target.IsLinear() && !c.dead {
+		// Assigning re-initialises a consumed resource binding.
+		_, sc := c.lookup(id.Value)
+		if b := sc.linear.bindings[id.Value]; !b.moved {
+			c.errorf(id.Token.Pos, "assignment discards unconsumed resource %s", id.Value)
+		} else {
+			b.moved = false
+		}
+	}
+}
+
+// place checks an assignment target, returning its type and whether it
+// may be written.
+func (c *checker) place(e ast.Expression) (Type, bool) {
+	switch e := e.(type) {
+	case *ast.Ident:
+		v, _ := c.lookup(e.Value)
+		if v == nil {
+			c.errorf(e.Token.Pos, "undefined: %s", e.Value)
+			return invalid, false
+		}
+		c.info.Uses[e] = v.pos
+		c.info.Types[e] = v.typ
+		return v.typ, v.mutable
+	case *ast.FieldExpr, *ast.IndexExpr:
+		t := c.borrow(e)
+		return t, c.writable(e)
+	case *ast.PrefixExpr:
+		if e.Operator == "*" {
+			t := c.borrow(e.Right)
+			r, ok := t.(*RefType)
+			if !ok {
+				if t != invalid {
+					c.errorf(e.Token.Pos, "cannot dereference %s", describe(t))
+				}
+				return invalid, false
+			}
+			c.info.Types[e] = r.Inner
+			return r.Inner, r.Mutable
+		}
+	}
+	c.errorf(ast.Pos(e), "invalid assignment target %s", e)
+	return invalid, false
+}
+
+// writable reports whether a field or element may be assigned: it must be
+// reached through a mutable binding or a mutable reference.
+func (c *checker) writable(e ast.Expression) bool {
+	for {
+		switch x := e.(type) {
+		case *ast.FieldExpr:
+			if r, ok := c.info.Types[x.Object].(*RefType); ok {
+				return r.Mutable
+			}
+			e = x.Object
+		case *ast.IndexExpr:
+			if r, ok := c.info.Types[x.Left].(*RefType); ok {
+				return r.Mutable
+			}
+			e = x.Left
+		case *ast.Ident:
+			v, _ := c.lookup(x.Value)
+			return v != nil && v.mutable
+		default:
+			// Temporaries such as call results are freshly owned.
+			return true
+		}
+	}
+}
+
+// rootBinding returns the binding a place is stored in, or nil when the
+// place is reached through a reference or a temporary.
+func (c *checker) rootBinding(e ast.Expression) *ast.Ident {
+	for {
+		switch x := e.(type) {
+		case *ast.FieldExpr:
+			if _, ok := c.info.Types[x.Object].(*RefType); ok {
+				return nil
+			}
+			e = x.Object
+		case *ast.IndexExpr:
+			if _, ok := c.info.Types[x.Left].(*RefType); ok {
+				return nil
+			}
+			e = x.Left
+		case *ast.Ident:
+			return x
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *checker) emit(s *ast.EmitStmt) {
+	names := make([]string, 0, len(s.Fields))
+	for name := range s.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var fields []Field
+	if q, ok := c.resolve(s.Event, c.fn.module, c.isType); ok {
+		if st, ok := c.types[q].typ.(*StructType); ok {
+			fields = st.Fields
+			if len(names) != len(fields) {
+				c.errorf(s.Token.Pos, "event %s has %d fields, got %d", q, len(fields), len(names))
+			}
+		}
+	}
+	for _, name := range names {
+		t := c.expr(s.Fields[name])
+		if t.IsLinear() {
+			c.errorf(ast.Pos(s.Fields[name]), "cannot emit resource value of type %s", describe(t))
+		}
+		if fields == nil {
+			continue
+		}
+		ft := fieldType(fields, name)
+		if ft == nil {
+			c.errorf(ast.Pos(s.Fields[name]), "event %s has no field %s", s.Event, name)
+		} else if !assignable(ft, t) {
+			c.errorf(ast.Pos(s.Fields[name]), "cannot use %s as %s in field %s", describe(t), describe(ft), name)
+		}
+	}
+}
+
+func fieldType(fields []Field, name string) Type {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Type
+		}
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Expressions
+// ---------------------------------------------------------------------------
+
+// expr checks an expression whose value is used, consuming resource
+// bindings it names directly.
+func (c *checker) expr(e ast.Expression) Type {
+	t := c.check(e, true)
+	c.info.Types[e] = t
+	return t
+}
+
+// borrow checks an expression whose value is only read in place.
+func (c *checker) borrow(e ast.Expression) Type {
+	t := c.check(e, false)
+	c.info.Types[e] = t
+	return t
+}
+
+func (c *checker) check(e ast.Expression, consume bool) Type {
+	switch e := e.(type) {
+	case *ast.IntLiteral:
+		return untypedInt
+	case *ast.FloatLiteral:
+		return F64
+	case *ast.BoolLiteral:
+		return Bool
+	case *ast.NilLiteral:
+		return nilType
+	case *ast.StringLiteral:
+		return String
+	case *ast.BytesLiteral:
+		return Bytes
+	case *ast.AddressLiteral:
+		return Address
+	case *ast.Ident:
+		return c.ident(e, consume)
+	case *ast.PrefixExpr:
+		return c.prefix(e)
+	case *ast.InfixExpr:
+		return c.infix(e)
+	case *ast.IndexExpr:
+		t := deref(c.borrow(e.Left))
+		if it := c.expr(e.Index); !isInteger(it) && it != invalid {
+			c.errorf(ast.Pos(e.Index), "index must be an integer, not %s", describe(it))
+		}
+		var elem Type
+		switch t := t.(type) {
+		case *ArrayType:
+			elem = t.Elem
+		case *SliceType:
+			elem = t.Elem
+		default:
+			if isText(t) {
+				return U8
+			}
+			if t != invalid {
+				c.errorf(e.Token.Pos, "cannot index %s", describe(t))
+			}
+			return invalid
+		}
+		if consume && elem.IsLinear() {
+			c.errorf(e.Token.Pos, "cannot move a resource out of an array")
+		}
+		return elem
+	case *ast.FieldExpr:
+		obj := c.borrow(e.Object)
+		t := c.field(obj, e.Field, e.Token.Pos)
+		if consume && t.IsLinear() {
+			c.errorf(e.Token.Pos, "cannot move resource field %s out of %s", e.Field, describe(deref(obj)))
+		}
+		return t
+	case *ast.CallExpr:
+		return c.call(e)
+	case *ast.MethodCallExpr:
+		return c.methodCall(e)
+	case *ast.BlockExpr:
+		return c.block(e)
+	case *ast.IfExpr:
+		return c.ifExpr(e)
+	case *ast.MatchExpr:
+		return c.match(e)
+	case *ast.RangeExpr:
+		return &SliceType{Elem: c.rangeElem(e)}
+	case *ast.ArrayExpr:
+		elem := Type(untypedInt)
+		for _, el := range e.Elements {
+			t := c.expr(el)
+			if u := unify(elem, t); u != nil {
+				elem = u
+			} else {
+				c.errorf(ast.Pos(el), "mixed array element types %s and %s", describe(elem), describe(t))
+			}
+		}
+		return &ArrayType{Elem: concrete(elem), Len: len(e.Elements)}
+	case *ast.MoveExpr:
+		return c.expr(e.Value)
+	case *ast.CopyExpr:
+		t := c.borrow(e.Value)
+		if !t.IsCopyable() {
+			c.errorf(e.Token.Pos, "cannot copy resource of type %s", describe(t))
+		}
+		return t
+	case *ast.SpawnExpr:
+		return c.spawn(e)
+	case *ast.SendExpr:
+		c.send(e)
+		return Void
+	case *ast.RecvExpr:
+		return U64
+	}
+	c.errorf(ast.Pos(e), "unsupported expression %s", e)
+	return invalid
+}
+
+func (c *checker) ident(e *ast.Ident, consume bool) Type {
+	if v, sc := c.lookup(e.Value); v != nil {
+		c.info.Uses[e] = v.pos
+		if consume && v.typ.IsLinear() && !c.dead {
+			if err := sc.linear.Use(e.Value); err != nil {
+				c.errorf(e.Token.Pos, "%s", err.Error())
+			}
+		}
+		return v.typ
+	}
+	if v := c.lookupVariant(e.Value, nil); v != nil {
+		c.info.Uses[e] = v.pos
+		if n := len(v.enum.Variants[v.index].Fields); n > 0 {
+			c.errorf(e.Token.Pos, "variant %s takes %d arguments", v.enum.Variants[v.index].Name, n)
+		}
+		return v.enum
+	}
+	if q, ok := c.resolve(e.Value, c.fn.module, c.isFunc); ok {
+		c.errorf(e.Token.Pos, "function %s used as a value", q)
+		return invalid
+	}
+	c.errorf(e.Token.Pos, "undefined: %s", e.Value)
+	return invalid
+}
+
+// field returns the type of a field of a struct, resource or agent state.
+func (c *checker) field(obj Type, name string, pos token.Position) Type {
+	var fields []Field
+	switch t := deref(obj).(type) {
+	case *StructType:
+		fields = t.Fields
+	case *ResourceType:
+		fields = t.Fields
+	case *AgentType:
+		c.errorf(pos, "cannot access field %s of agent handle %s; send it a message", name, t.Name)
+		return invalid
+	default:
+		if t != invalid {
+			c.errorf(pos, "%s has no fields", describe(t))
+		}
+		return invalid
+	}
+	if ft := fieldType(fields, name); ft != nil {
+		return ft
+	}
+	c.errorf(pos, "unknown field %s in %s", name, describe(deref(obj)))
+	return invalid
+}
+
+func (c *checker) prefix(e *ast.PrefixExpr) Type {
+	switch e.Operator {
+	case "&":
+		t := c.borrow(e.Right)
+		if t == invalid {
+			return invalid
+		}
+		mutable := true
+		switch e.Right.(type) {
+		case *ast.Ident, *ast.FieldExpr, *ast.IndexExpr:
+			_, mutable = c.placeMutable(e.Right)
+		}
+		return &RefType{Inner: t, Mutable: mutable}
+	case "*":
+		t := c.borrow(e.Right)
+		r, ok := t.(*RefType)
+		if !ok {
+			if t != invalid {
+				c.errorf(e.Token.Pos, "cannot dereference %s", describe(t))
+			}
+			return invalid
+		}
+		return r.Inner
+	case "#":
+		t := deref(c.borrow(e.Right))
+		switch t.(type) {
+		case *ArrayType, *SliceType:
+			return U64
+		}
+		if !isText(t) && t != invalid {
+			c.errorf(e.Token.Pos, "cannot take the length of %s", describe(t))
+		}
+		return U64
+	}
+	t := c.expr(e.Right)
+	switch e.Operator {
+	case "-":
+		if !isInteger(t) && !isFloat(t) && t != invalid {
+			c.errorf(e.Token.Pos, "cannot negate %s", describe(t))
+			return invalid
+		}
+	case "!":
+		if !isBool(t) {
+			c.errorf(e.Token.Pos, "operator ! needs bool, not %s", describe(t))
+		}
+		return Bool
+	case "~":
+		if !isInteger(t) && t != invalid {
+			c.errorf(e.Token.Pos, "operator ~ needs an integer, not %s", describe(t))
+			return invalid
+		}
+	}
+	return t
+}
+
+// placeMutable reports whether a place expression is writable.
+func (c *checker) placeMutable(e ast.Expression) (Type, bool) {
+	if id, ok := e.(*ast.Ident); ok {
+		v, _ := c.lookup(id.Value)
+		return nil, v != nil && v.mutable
+	}
+	return nil, c.writable(e)
+}
+
+func (c *checker) infix(e *ast.InfixExpr) Type {
+	switch e.Operator {
+	case "&&", "||":
+		c.cond(e.Left, "operand of "+e.Operator)
+		c.cond(e.Right, "operand of "+e.Operator)
+		return Bool
+	}
+	l := c.expr(e.Left)
+	r := c.expr(e.Right)
+	if l == invalid || r == invalid {
+		return invalid
+	}
+	switch e.Operator {
+	case "==", "!=":
+		u := unify(l, r)
+		if u == nil {
+			c.errorf(e.Token.Pos, "mismatched types %s and %s", describe(l), describe(r))
+		} else if !comparable(u) {
+			c.errorf(e.Token.Pos, "cannot compare values of type %s", describe(u))
+		}
+		return Bool
+	case "<", "<=", ">", ">=":
+		u := unify(l, r)
+		if u == nil {
+			c.errorf(e.Token.Pos, "mismatched types %s and %s", describe(l), describe(r))
+		} else if !isInteger(u) && !isFloat(u) {
+			c.errorf(e.Token.Pos, "cannot order values of type %s", describe(u))
+		}
+		return Bool
+	}
+	return c.arith(e.Operator, l, r, e.Token.Pos)
+}
+
+// arith checks an arithmetic or bitwise operator.
+func (c *checker) arith(op string, l, r Type, pos token.Position) Type {
+	if l == invalid || r == invalid {
+		return invalid
+	}
+	switch op {
+	case "<<", ">>":
+		if !isInteger(l) || !isInteger(r) {
+			c.errorf(pos, "shift needs integers, not %s and %s", describe(l), describe(r))
+			return invalid
+		}
+		return l
+	case "&", "|", "^", "%":
+		if !isInteger(l) || !isInteger(r) {
+			c.errorf(pos, "operator %s needs integers, not %s and %s", op, describe(l), describe(r))
+			return invalid
+		}
+	case "+", "-", "*", "/":
+		if !(isInteger(l) || isFloat(l)) || !(isInteger(r) || isFloat(r)) {
+			c.errorf(pos, "operator %s needs numbers, not %s and %s", op, describe(l), describe(r))
+			return invalid
+		}
+	default:
+		c.errorf(pos, "unsupported operator %s", op)
+		return invalid
+	}
+	u := unify(l, r)
+	if u == nil {
+		c.errorf(pos, "mismatched types %s and %s", describe(l), describe(r))
+		return invalid
+	}
+	return u
+}
+
+// comparable reports whether == is defined for a type. Enums with payloads
+// are boxed and have no equality.
+func comparable(t Type) bool {
+	switch t := t.(type) {
+	case *primitiveType:
+		return t != nilType
+	case *EnumType:
+		for _, v := range t.Variants {
+			if len(v.Fields) > 0 {
+				return false
+			}
+		}
+		return true
+	case *AgentType, *RefType:
+		return true
+	}
+	return false
+}
+
+func (c *checker) ifExpr(e *ast.IfExpr) Type {
+	c.cond(e.Condition, "if condition")
+	before := c.snapshot()
+	dead := c.dead
+
+	then := c.block(e.Consequence)
+	flows := []flow{c.endFlow()}
+	c.restore(before)
+	c.dead = dead
+
+	els := Type(Void)
+	if e.Alternative != nil {
+		els = c.expr(e.Alternative)
+	}
+	flows = append(flows, c.endFlow())
+	c.merge(e.Token.Pos, before, flows)
+
+	if e.Alternative == nil {
+		return Void
+	}
+	t := unify(then, els)
+	if t == nil {
+		c.errorf(e.Token.Pos, "if branches have mismatched types %s and %s", describe(then), describe(els))
+		return invalid
+	}
+	return t
+}
+
+func (c *checker) match(e *ast.MatchExpr) Type {
+	subj := c.expr(e.Subject)
+	before := c.snapshot()
+	dead := c.dead
+	var flows []flow
+	var result Type = never
+	for _, arm := range e.Arms {
+		c.restore(before)
+		c.dead = dead
+		c.push()
+		c.pattern(arm.Pattern, subj)
+		if arm.Guard != nil {
+			c.cond(arm.Guard, "match guard")
+		}
+		t := c.expr(arm.Body)
+		if c.dead {
+			t = never
+		}
+		if u := unify(result, t); u != nil {
+			result = u
+		} else {
+			c.errorf(ast.Pos(arm.Body), "match arms have mismatched types %s and %s", describe(result), describe(t))
+			result = invalid
+		}
+		c.pop()
+		flows = append(flows, c.endFlow())
+	}
+	c.merge(e.Token.Pos, before, flows)
+	if len(e.Arms) == 0 {
+		return Void
+	}
+	return result
+}
+
+// pattern checks a match pattern against the subject type and declares the
+// names it binds.
+func (c *checker) pattern(p ast.Expression, subj Type) {
+	c.info.Types[p] = subj
+	switch p := p.(type) {
+	case *ast.Ident:
+		if p.Value == "_" {
+			return
+		}
+		if v := c.lookupVariant(p.Value, subj); v != nil && (subj == invalid || Type(v.enum) == subj) {
+			c.info.Uses[p] = v.pos
+			if n := len(v.enum.Variants[v.index].Fields); n > 0 {
+				c.errorf(p.Token.Pos, "variant %s takes %d arguments", p.Value, n)
+			}
+			return
+		}
+		c.declare(p.Value, subj, false, p.Token.Pos)
+	case *ast.IntLiteral:
+		if !isInteger(subj) && subj != invalid {
+			c.errorf(p.Token.Pos, "cannot match %s against an integer", describe(subj))
+		}
+	case *ast.BoolLiteral:
+		if !isBool(subj) {
+			c.errorf(p.Token.Pos, "cannot match %s against a bool", describe(subj))
+		}
+	case *ast.StringLiteral:
+		if !isText(subj) && subj != invalid {
+			c.errorf(p.Token.Pos, "cannot match %s against a string", describe(subj))
+		}
+	case *ast.CallExpr:
+		id, ok := p.Function.(*ast.Ident)
+		if !ok {
+			break
+		}
+		var fields []Field
+		if v := c.lookupVariant(id.Value, subj); v != nil {
+			c.info.Uses[id] = v.pos
+			if subj != invalid && Type(v.enum) != subj {
+				c.errorf(id.Token.Pos, "variant %s of %s does not match %s", id.Value, v.enum.Name, describe(subj))
+			}
+			fields = v.enum.Variants[v.index].Fields
+		} else if q, ok := c.resolve(id.Value, c.fn.module, c.isConstructible); ok {
+			if !identical(c.types[q].typ, subj) {
+				c.errorf(id.Token.Pos, "%s does not match %s", q, describe(subj))
+			}
+			fields = structFields(c.types[q].typ)
+		} else {
+			c.errorf(id.Token.Pos, "unknown variant %s", id.Value)
+			return
+		}
+		if len(p.Arguments) != len(fields) {
+			c.errorf(id.Token.Pos, "%s takes %d arguments, got %d", id.Value, len(fields), len(p.Arguments))
+			return
+		}
+		for i, sub := range p.Arguments {
+			c.pattern(sub, fields[i].Type)
+		}
+	default:
+		c.errorf(ast.Pos(p), "unsupported pattern %s", p)
+	}
+}
+
+func structFields(t Type) []Field {
+	switch t := t.(type) {
+	case *StructType:
+		return t.Fields
+	case *ResourceType:
+		return t.Fields
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Calls
+// ---------------------------------------------------------------------------
+
+func (c *checker) call(e *ast.CallExpr) Type {
+	id, ok := e.Function.(*ast.Ident)
+	if !ok {
+		c.errorf(ast.Pos(e.Function), "cannot call %s", e.Function)
+		c.args(e.Arguments, nil, "call")
+		return invalid
+	}
+	name, pos := id.Value, id.Token.Pos
+	if v, _ := c.lookup(name); v != nil {
+		c.errorf(pos, "cannot call %s: not a function", name)
+		return invalid
+	}
+	if q, ok := c.resolve(name, c.fn.module, c.isFunc); ok {
+		fn := c.funcs[q]
+		c.info.Uses[id] = fn.pos
+		if fn.self != nil {
+			c.errorf(pos, "message handler %s must be invoked with send", q)
+			return invalid
+		}
+		c.args(e.Arguments, fn.ptypes, q)
+		return fn.ret
+	}
+	if q, ok := c.resolve(name, c.fn.module, c.isConstructible); ok {
+		td := c.types[q]
+		c.info.Uses[id] = td.pos
+		c.args(e.Arguments, fieldTypes(structFields(td.typ)), q)
+		return td.typ
+	}
+	if v := c.lookupVariant(name, nil); v != nil {
+		c.info.Uses[id] = v.pos
+		c.args(e.Arguments, fieldTypes(v.enum.Variants[v.index].Fields), name)
+		return v.enum
+	}
+	if sig, ok := c.lookupIntrinsic(name); ok {
+		c.args(e.Arguments, sig.Params, name)
+		return sig.Return
+	}
+	c.errorf(pos, "undefined function %s", name)
+	c.args(e.Arguments, nil, name)
+	return invalid
+}
+
+func fieldTypes(fields []Field) []Type {
+	types := make([]Type, len(fields))
+	for i, f := range fields {
+		types[i] = f.Type
+	}
+	return types
+}
+
+// args checks call arguments against parameter types; nil params only
+// checks the arguments themselves.
+func (c *checker) args(args []ast.Expression, params []Type, name string) {
+	if params != nil && len(args) != len(params) {
+		pos := token.Position{}
+		if len(args) > 0 {
+			pos = ast.Pos(args[0])
+		}
+		c.errorf(pos, "%s expects %d arguments, got %d", name, len(params), len(args))
+		params = nil
+	}
+	for i, a := range args {
+		t := c.expr(a)
+		if params != nil && !assignable(params[i], t) {
+			c.errorf(ast.Pos(a), "cannot use %s as %s in argument %d to %s", describe(t), describe(params[i]), i+1, name)
+		}
+	}
+}
+
+func (c *checker) lookupIntrinsic(name string) (*FnType, bool) {
+	if q, ok := c.resolve(name, c.fn.module, func(q string) bool {
+		_, ok := intrinsics[q]
+		return ok
+	}); ok {
+		return intrinsics[q], true
+	}
+	for _, pkg := range []string{"chain::", "crypto::"} {
+		if sig, ok := intrinsics[pkg+name]; ok {
+			return sig, true
+		}
+	}
+	return nil, false
+}
+
+func (c *checker) methodCall(e *ast.MethodCallExpr) Type {
+	recv := deref(c.borrow(e.Receiver))
+	if recv == invalid {
+		c.args(e.Arguments, nil, e.Method)
+		return invalid
+	}
+	if ag, ok := recv.(*AgentType); ok {
+		c.sendMessage(c.agents[ag.Name], e.Method, e.Arguments, e.Token.Pos)
+		return Void
+	}
+	if name := typeName(recv); name != "" {
+		if fn, ok := c.funcs[name+"::"+e.Method]; ok {
+			if !fn.method {
+				c.errorf(e.Token.Pos, "%s is not a method", fn.name)
+				return invalid
+			}
+			c.args(e.Arguments, fn.ptypes[1:], fn.name)
+			return fn.ret
+		}
+	}
+	if e.Method == "len" && len(e.Arguments) == 0 {
+		switch recv.(type) {
+		case *ArrayType, *SliceType:
+			return U64
+		}
+		if isText(recv) {
+			return U64
+		}
+	}
+	c.errorf(e.Token.Pos, "%s has no method %s", describe(recv), e.Method)
+	c.args(e.Arguments, nil, e.Method)
+	return invalid
+}
+
+// ---------------------------------------------------------------------------
+// Agents
+// ---------------------------------------------------------------------------
+
+func (c *checker) spawn(e *ast.SpawnExpr) Type {
+	q, ok := c.resolve(e.Agent, c.fn.module, func(q string) bool {
+		_, ok := c.agents[q]
+		return ok
+	})
+	if !ok {
+		c.errorf(e.Token.Pos, "undefined agent %s", e.Agent)
+		for _, v := range e.Fields {
+			c.expr(v)
+		}
+		return invalid
+	}
+	ag := c.agents[q]
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := c.expr(e.Fields[name])
+		ft := fieldType(ag.state.Fields, name)
+		if ft == nil {
+			c.errorf(ast.Pos(e.Fields[name]), "agent %s has no state field %s", q, name)
+		} else if !assignable(ft, t) {
+			c.errorf(ast.Pos(e.Fields[name]), "cannot use %s as %s in field %s", describe(t), describe(ft), name)
+		}
+	}
+	return ag.typ
+}
+
+func (c *checker) send(e *ast.SendExpr) {
+	target := deref(c.borrow(e.Target))
+	ag, ok := target.(*AgentType)
+	if !ok {
+		if target != invalid {
+			c.errorf(ast.Pos(e.Target), "cannot send to %s; not an agent", describe(target))
+		}
+		c.expr(e.Message)
+		return
+	}
+	if call, ok := e.Message.(*ast.CallExpr); ok {
+		if id, ok := call.Function.(*ast.Ident); ok {
+			c.sendMessage(c.agents[ag.Name], id.Value, call.Arguments, id.Token.Pos)
+			c.info.Types[e.Message] = Void
+			return
+		}
+	}
+	if t := c.expr(e.Message); t.IsLinear() {
+		c.errorf(ast.Pos(e.Message), "cannot send resource value of type %s", describe(t))
+	}
+}
+
+func (c *checker) sendMessage(ag *agentInfo, handler string, args []ast.Expression, pos token.Position) {
+	fn, ok := ag.handlers[handler]
+	if !ok {
+		c.errorf(pos, "agent %s has no handler %s", ag.typ.Name, handler)
+		c.args(args, nil, handler)
+		return
+	}
+	c.args(args, fn.ptypes, fn.name)
+}
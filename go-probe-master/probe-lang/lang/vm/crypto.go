@@ -20,12 +20,15 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/cloudflare/circl/sign/slhdsa"
+	"github.com/probechain/go-probe/crypto/dilithium"
+	"github.com/probechain/go-probe/crypto/falcon"
 	"golang.org/x/crypto/sha3"
 )
 
-// errPQCNotImplemented is the sentinel error returned by all PQC opcode stubs
-// until the underlying cryptographic libraries are integrated.
-var errPQCNotImplemented = errors.New("vm: PQC opcode not yet implemented")
+// errNotImplemented is the sentinel error returned by crypto opcodes whose
+// backend has not been injected into the VM.
+var errNotImplemented = errors.New("vm: crypto opcode not implemented")
 
 // ---- SHA3 / Keccak256 ------------------------------------------------------
 
@@ -134,47 +137,84 @@ func defaultEcrecover(hash, sig []byte) ([]byte, error) {
 	// implementation before constructing production VM instances.
 	_ = hash
 	_ = sig
-	return nil, fmt.Errorf("vm: secp256k1 ecrecover: %w (inject via ecrecoverShim)", errPQCNotImplemented)
+	return nil, fmt.Errorf("vm: secp256k1 ecrecover: %w (inject via ecrecoverShim)", errNotImplemented)
 }
 
-// ---- PQC stubs -------------------------------------------------------------
+// ---- PQC signature verification ------------------------------------------
 //
-// The following three functions are intentional stubs.  Production integration
-// requires linking the respective libraries (e.g., liboqs, cloudflare/circl).
-// Each returns errPQCNotImplemented until that work is complete.
-
-// execFalcon512Verify is the stub for the Falcon-512 signature verification
-// opcode.  Parameters msgAddr, sigAddr, and pubkeyAddr are addresses of the
-// respective byte arrays in the VM's linear memory.
-func execFalcon512Verify(mem *Memory, msgAddr, sigAddr, pubkeyAddr uint64) (uint64, error) {
-	// TODO: integrate with a Falcon-512 Go/CGo library.
-	_ = mem
-	_ = msgAddr
-	_ = sigAddr
-	_ = pubkeyAddr
-	return 0, fmt.Errorf("OpFalcon512Verify: %w", errPQCNotImplemented)
+// The verify opcodes read the message, signature and public key as
+// length-prefixed byte buffers, the layout the compiler uses for bytes
+// values: an 8-byte little-endian length followed by the data.  A signature
+// that does not verify, including a malformed one, yields 0 rather than an
+// error; only invalid memory accesses abort execution.
+
+// slhdsaParams is the SLH-DSA parameter set accepted by OpSLHDSAVerify.
+const slhdsaParams = slhdsa.SHAKE_128s
+
+// readBytes returns a view of the length-prefixed byte buffer at addr.
+func readBytes(mem *Memory, addr uint64) ([]byte, error) {
+	length, err := mem.ReadUint64(addr)
+	if err != nil {
+		return nil, err
+	}
+	return mem.ReadSlice(addr+8, length)
+}
+
+// readSignature reads the operands of a signature verification opcode.
+func readSignature(mem *Memory, msgAddr, sigAddr, pubkeyAddr uint64) (msg, sig, pubkey []byte, err error) {
+	if msg, err = readBytes(mem, msgAddr); err != nil {
+		return nil, nil, nil, fmt.Errorf("read msg: %w", err)
+	}
+	if sig, err = readBytes(mem, sigAddr); err != nil {
+		return nil, nil, nil, fmt.Errorf("read sig: %w", err)
+	}
+	if pubkey, err = readBytes(mem, pubkeyAddr); err != nil {
+		return nil, nil, nil, fmt.Errorf("read pubkey: %w", err)
+	}
+	return msg, sig, pubkey, nil
+}
+
+// signatureGas returns the cost of verifying a signature: the base cost of
+// the scheme plus gasCryptoWord for every 32-byte word of input.
+func signatureGas(base uint64, data ...[]byte) uint64 {
+	gas := base
+	for _, d := range data {
+		gas += (uint64(len(d)) + 31) / 32 * gasCryptoWord
+	}
+	return gas
 }
 
-// execMLDSAVerify is the stub for ML-DSA (CRYSTALS-Dilithium) signature
-// verification.  A full implementation would call
-// github.com/cloudflare/circl/sign/dilithium/mode2.Verify.
-func execMLDSAVerify(mem *Memory, msgAddr, sigAddr, pubkeyAddr uint64) (uint64, error) {
-	// TODO: delegate to crypto/dilithium.Verify after reading the byte slices
-	// from the VM's linear memory.
-	_ = mem
-	_ = msgAddr
-	_ = sigAddr
-	_ = pubkeyAddr
-	return 0, fmt.Errorf("OpMLDSAVerify: %w", errPQCNotImplemented)
+// verifyResult converts a verification outcome to a register value.
+func verifyResult(ok bool) uint64 {
+	if ok {
+		return 1
+	}
+	return 0
 }
 
-// execSLHDSAVerify is the stub for SLH-DSA (SPHINCS+) signature verification.
-// A full implementation would call into a SPHINCS+ Go binding.
-func execSLHDSAVerify(mem *Memory, msgAddr, sigAddr, pubkeyAddr uint64) (uint64, error) {
-	// TODO: integrate with a SPHINCS+ (SLH-DSA) library.
-	_ = mem
-	_ = msgAddr
-	_ = sigAddr
-	_ = pubkeyAddr
-	return 0, fmt.Errorf("OpSLHDSAVerify: %w", errPQCNotImplemented)
+// execFalcon512Verify verifies a Falcon-512 signature in the encoding of the
+// Falcon specification (header, 40-byte nonce, compressed s2) against an
+// 897-byte public key.
+func execFalcon512Verify(msg, sig, pubkey []byte) uint64 {
+	return verifyResult(falcon.Verify(pubkey, msg, sig))
+}
+
+// execMLDSAVerify verifies an ML-DSA (CRYSTALS-Dilithium2) signature using
+// the chain's crypto/dilithium package.
+func execMLDSAVerify(msg, sig, pubkey []byte) uint64 {
+	pub, err := dilithium.UnmarshalPublicKey(pubkey)
+	if err != nil {
+		return 0
+	}
+	return verifyResult(dilithium.Verify(pub, msg, sig))
+}
+
+// execSLHDSAVerify verifies an SLH-DSA-SHAKE-128s signature with an empty
+// context string, as specified by FIPS 205.
+func execSLHDSAVerify(msg, sig, pubkey []byte) uint64 {
+	pub := slhdsa.PublicKey{ID: slhdsaParams}
+	if err := pub.UnmarshalBinary(pubkey); err != nil {
+		return 0
+	}
+	return verifyResult(slhdsa.Verify(&pub, slhdsa.NewMessage(msg), sig, nil))
 }
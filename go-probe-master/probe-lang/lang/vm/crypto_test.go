@@ -0,0 +1,205 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/cloudflare/circl/sign/slhdsa"
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/crypto/dilithium"
+)
+
+// Falcon-512 test vector produced with an independent signer.
+var (
+	falconMsg    = []byte("probechain falcon-512 test vector")
+	falconPubkey = common.FromHex("0930ec2b7a974257bb86f3f0b2d2e5a6667ad4696ab46971d5eb6926894a49c826e7c9de20c05131354d390d10e763f4" +
+		"8ac61e3a2df8c8d27c7dad6841690bc99cb9b833e4621b8a29d844294e6a3bb92b22f048e631fc3913325031071aff84" +
+		"27ef0885291927bc50061c70e184664ec666d2daf3b8da148df5c61688e15c050d5e2b19d5fa41b537203da57bb0689c" +
+		"f120dde8a2f2857610ae88465299a70848ce77f9b17098536895eef9d3506b341c6c223a416d313e51a289f090de191e" +
+		"87e31066f39be1499aa551f8805e1161900300a22daaf38de0a83ae2b690c8931bb45d6cc44768b771f25a6530001195" +
+		"e80e6a79092c36a1a0785063955b1ccb41db222d2f4c2658af5c6713dafee98b0d9434ae251038c98500e958a877e653" +
+		"921136d3a2470c6ed1eab271553f42362b47b74cb64905941ba60de940956fb7f3064325cafff1e5203a938a38692fa7" +
+		"dd85a900143de012b71e0f7544adfda1411531c381cf6d75cac05a0aa3b01db1d4de15bf42e54db68d4fd74f886ee9ee" +
+		"0de02966d492330892a791ba350216097f90a0ca38e4467362a2da70410548d43371829cb5291d7325ced0fe0ca18026" +
+		"09e05ea4098e108d9c5eb265b2755992b774e0dc74be53e22405793815a662b066ccc90b8a76b1f522925a46489951de" +
+		"432957017b6854032189e44f20d8e01a6fe62cb29d288de5518b1111944e6aa3990cc6127d8c0a543a852a77116d766a" +
+		"33795987a03e0e82585e986659251966c20bc4336452586052b5514191060acd042a2e1e682001851f26d90a3c218977" +
+		"dce4d5879f8a553132b86ac50d2e259e125d581890d554c876cd4d1c7e57d6b9418a9c200479d10ad7afaacda2746cc4" +
+		"30e6a6f011a8a1706ed2e8e6503f22227e07e019b52e49d70b5ce5543aaac273231ad28141fb932588fb7d85cc8bfdc2" +
+		"8d147a7b94d7a38637d2d840e587bb1779afb873a9a845403a0546e1d60c8980c381a7df10421944a664bb98c99da9b1" +
+		"a25a0dd0d886ef4cb7157a702a3fdd3d0805a8e773e1283f7c4220a74f060c51a9f1e82d44658dee0b1b1e9294a6a078" +
+		"624f7f11b6d1d5e9e4a7816854b8f754624f581937dd05623a59d838c3a6a21ec1b4922c43211c068a2b182e8198f4fc" +
+		"d47969c15f1245a78193db00f0a6d4acc0670434d8f635cd97bdf5b3491acc6e31852a754864d99c641a785424701b45" +
+		"290b6069fe78647674a22c20257547c175ad8cb69c98e27bdbe084853544f9c8ab")
+	falconSig = common.FromHex("393597439d813c515f09322e6729a2ef47ad53e5602bcac8431dc4870ca2db5cf7df738e8594b0e1e5802f9ec3d14334" +
+		"e8a7e8949df749c63dedd38aaa7eb9382ab4c79bbbaa2aad53914de03b3c15f1ad77ee283756066ebe532fb214b55f75" +
+		"2d81e564f849d40fe58150e50e83f54b65f12dcc224bcee241cbee670f68222212912c6c94686c191e131694ff69be2f" +
+		"6f2943399e7964eca3d336915e22a8fae01b4483142a17ac6ef8a0a10e2a788e1416cad1484afa76ddfe54b134890c9a" +
+		"61716e67bccbf74989eca399a1922e2688be7ae389921b449b4423abfb0edda1c88ebd965b190298e867a36a16de24af" +
+		"4e197ee1145de6be72198c7b1515213fd24548e3057771901c32783f2e8ead5c9463da47355566727907ff79ed5a1811" +
+		"c4dfb368f42281b180203b2f6193e73748261f6de632b59881ba88b56c7cd4f7cbfef4e793f3a1f1685c4366fc8e246b" +
+		"13e08eaa83910aed47ca5b184e62323ae93c7ba0bb88b617d7a9e1b6192b50ea962b7d5e916266b10b5dbcc8e90a3250" +
+		"78618941d6d38ef5699f87e2e5754b210d30b5d25aa5abc903734946d2ad9b59506b8fcefe09d8637cb4d45e82ca222a" +
+		"aa3ec7d5534c556e3528ec4ea36a4d6129662eb29d871d0edde40bcb774961d685ed1339ed46ff56c7ed4ef1b2de5038" +
+		"ac472e37c467e003d17179a8475ff4d7a6b75c43bba652d64913d567a16675d159b7006bb9e7f346c2ed4a5dbf63c784" +
+		"c4a887e97661d3f385b9dcea9ba695fdeeb270c8a6fc70637b9f0edc88b444e174cc4aa7f8fdc4dd66d8525aad279d18" +
+		"42e5ad4bbd8468ded7ef507f34bf48eb993c1a3b9e01db71bbe2af8b605d637b3ae710037d3110cc0cd2be8fa9d1b5dd" +
+		"0f79674e25b5f3f610c3a106fd20f0f8a789fcf0e09f9c56092aa76a706b793d875788")
+)
+
+// writeBytes allocates a length-prefixed byte buffer holding data.
+func writeBytes(t *testing.T, mem *Memory, data []byte) uint64 {
+	t.Helper()
+	ptr, err := mem.Alloc(8 + uint64(len(data)))
+	if err != nil {
+		t.Fatalf("Alloc: %v", err)
+	}
+	if err := mem.WriteUint64(ptr, uint64(len(data))); err != nil {
+		t.Fatalf("WriteUint64: %v", err)
+	}
+	if err := mem.WriteSlice(ptr+8, data); err != nil {
+		t.Fatalf("WriteSlice: %v", err)
+	}
+	return ptr
+}
+
+// runVerify runs a single signature verification opcode and returns its
+// result and the gas it used.
+func runVerify(t *testing.T, op Opcode, msg, sig, pubkey []byte) (uint64, uint64) {
+	t.Helper()
+	v := New(nil, nil, 1_000_000, nil)
+	consts := []uint64{
+		writeBytes(t, v.memory, msg),
+		writeBytes(t, v.memory, sig),
+		writeBytes(t, v.memory, pubkey),
+	}
+	v.code = program(
+		instrWide(OpLoadConst, 11, 0), // R11 = msg
+		instrWide(OpLoadConst, 12, 1), // R12 = sig
+		instrWide(OpLoadConst, 10, 2), // R10 = pubkey
+		instr(op, 10, 11, 12),
+		instr(OpHalt, 10, 0, 0),
+	)
+	v.constants = consts
+	result := runVM(t, v)
+
+	// The verification costs everything but the loads and the halt.
+	return result, v.GasUsed() - 3*gasTrivial - gasTrivial
+}
+
+func TestFalcon512VerifyOpcode(t *testing.T) {
+	if got, _ := runVerify(t, OpFalcon512Verify, falconMsg, falconSig, falconPubkey); got != 1 {
+		t.Errorf("valid signature: got %d, want 1", got)
+	}
+	if got, _ := runVerify(t, OpFalcon512Verify, []byte("tampered"), falconSig, falconPubkey); got != 0 {
+		t.Errorf("tampered message: got %d, want 0", got)
+	}
+	if got, _ := runVerify(t, OpFalcon512Verify, falconMsg, falconSig[:100], falconPubkey); got != 0 {
+		t.Errorf("truncated signature: got %d, want 0", got)
+	}
+	if got, _ := runVerify(t, OpFalcon512Verify, falconMsg, falconSig, nil); got != 0 {
+		t.Errorf("empty public key: got %d, want 0", got)
+	}
+}
+
+func TestMLDSAVerifyOpcode(t *testing.T) {
+	pub, priv, err := dilithium.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("probechain ml-dsa")
+	sig := dilithium.Sign(priv, msg)
+	pubkey := dilithium.MarshalPublicKey(pub)
+
+	if got, _ := runVerify(t, OpMLDSAVerify, msg, sig, pubkey); got != 1 {
+		t.Errorf("valid signature: got %d, want 1", got)
+	}
+	badSig := bytes.Clone(sig)
+	badSig[0] ^= 0xff
+	if got, _ := runVerify(t, OpMLDSAVerify, msg, badSig, pubkey); got != 0 {
+		t.Errorf("tampered signature: got %d, want 0", got)
+	}
+	if got, _ := runVerify(t, OpMLDSAVerify, msg, sig, pubkey[1:]); got != 0 {
+		t.Errorf("short public key: got %d, want 0", got)
+	}
+}
+
+func TestSLHDSAVerifyOpcode(t *testing.T) {
+	if testing.Short() {
+		t.Skip("SLH-DSA signing is slow")
+	}
+	pub, priv, err := slhdsa.GenerateKey(rand.Reader, slhdsaParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("probechain slh-dsa")
+	sig, err := slhdsa.SignDeterministic(&priv, slhdsa.NewMessage(msg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey, err := pub.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := runVerify(t, OpSLHDSAVerify, msg, sig, pubkey); got != 1 {
+		t.Errorf("valid signature: got %d, want 1", got)
+	}
+	if got, _ := runVerify(t, OpSLHDSAVerify, []byte("tampered"), sig, pubkey); got != 0 {
+		t.Errorf("tampered message: got %d, want 0", got)
+	}
+}
+
+func TestSignatureGas(t *testing.T) {
+	_, short := runVerify(t, OpFalcon512Verify, nil, falconSig, falconPubkey)
+	_, long := runVerify(t, OpFalcon512Verify, make([]byte, 64), falconSig, falconPubkey)
+	if want := signatureGas(gasCrypto*4, nil, falconSig, falconPubkey); short != want {
+		t.Errorf("gas = %d, want %d", short, want)
+	}
+	if long-short != 2*gasCryptoWord {
+		t.Errorf("64-byte message costs %d more gas, want %d", long-short, 2*gasCryptoWord)
+	}
+}
+
+func TestSignatureInvalidAddress(t *testing.T) {
+	v := New(nil, nil, 1_000_000, nil)
+	msg := writeBytes(t, v.memory, []byte("msg"))
+	v.code = program(
+		instrWide(OpLoadConst, 11, 0), // R11 = msg
+		instrWide(OpLoadConst, 12, 1), // R12 = unallocated signature
+		instr(OpMLDSAVerify, 10, 11, 12),
+		instr(OpHalt, 10, 0, 0),
+	)
+	v.constants = []uint64{msg, 0xdead00}
+	if _, err := v.Run(); !errors.Is(err, ErrInvalidAddress) {
+		t.Fatalf("error = %v, want %v", err, ErrInvalidAddress)
+	}
+
+	// A length that wraps around the address space must not be accepted.
+	v = New(nil, nil, 1_000_000, nil)
+	msg = writeBytes(t, v.memory, []byte("msg"))
+	if err := v.memory.WriteUint64(msg, ^uint64(0)-4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readBytes(v.memory, msg); !errors.Is(err, ErrInvalidAddress) {
+		t.Fatalf("wrapping length: error = %v, want %v", err, ErrInvalidAddress)
+	}
+}
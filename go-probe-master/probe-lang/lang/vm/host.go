@@ -0,0 +1,166 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/probechain/go-probe/common"
+	"github.com/probechain/go-probe/crypto"
+)
+
+// ErrInsufficientBalance is returned by a host when a transfer exceeds the
+// balance of the executing contract.
+var ErrInsufficientBalance = errors.New("vm: insufficient balance for transfer")
+
+// ErrUnknownAgent is returned by a host when a message is sent to an address
+// that is not a spawned agent.
+var ErrUnknownAgent = errors.New("vm: message to unknown agent")
+
+// Host is the chain state a contract executes against.  The node backs it
+// with the state database; MemoryHost is a self-contained host for tests and
+// off-chain simulation.
+//
+// Methods that modify state return an error, which aborts execution; a host
+// rejects writes in a read-only (static) context this way.
+type Host interface {
+	// Address returns the address of the executing contract.
+	Address() common.Address
+	// Caller returns the address that invoked the contract.
+	Caller() common.Address
+	// Balance returns the balance of addr, saturated to 64 bits.
+	Balance(addr common.Address) uint64
+	// Transfer moves amount from the executing contract to addr.
+	Transfer(to common.Address, amount uint64) error
+	// GetStorage returns the value stored under key in the contract's
+	// persistent storage, or 0.
+	GetStorage(key uint64) uint64
+	// SetStorage stores value under key in the contract's storage.
+	SetStorage(key, value uint64) error
+	// EmitLog records an event emitted by the contract.
+	EmitLog(ev Event) error
+	// Spawn creates an agent with the given initial state whose messages are
+	// handled by the function at byte offset entry of the executing
+	// contract, and returns its address.
+	Spawn(entry uint64, state []uint64) (common.Address, error)
+	// Send queues msg for delivery to the agent at to.
+	Send(to common.Address, msg []uint64) error
+}
+
+// Event is an event emitted by OpEmit: a tag derived from the event name
+// and its field values in field name order.
+type Event struct {
+	ID     uint64
+	Fields []uint64
+}
+
+// Agent is a spawned agent: the entry of its message dispatcher and its state.
+type Agent struct {
+	Entry uint64
+	State []uint64
+}
+
+// Message is a message sent to an agent, encoded as [handler index][args...].
+type Message struct {
+	From common.Address
+	To   common.Address
+	Data []uint64
+}
+
+// MemoryHost is a Host that keeps balances, storage, logs, agents and sent
+// messages in memory. Messages are only queued; delivering them is up to the
+// caller.
+type MemoryHost struct {
+	Self     common.Address
+	From     common.Address
+	Balances map[common.Address]uint64
+	Storage  map[uint64]uint64
+	Logs     []Event
+	Agents   map[common.Address]*Agent
+	Mailbox  []Message
+
+	nonce uint64 // number of agents spawned, for address derivation
+}
+
+// NewMemoryHost returns an empty in-memory host for the contract at self
+// called by caller.
+func NewMemoryHost(self, caller common.Address) *MemoryHost {
+	return &MemoryHost{
+		Self:     self,
+		From:     caller,
+		Balances: make(map[common.Address]uint64),
+		Storage:  make(map[uint64]uint64),
+		Agents:   make(map[common.Address]*Agent),
+	}
+}
+
+// Address implements Host.
+func (h *MemoryHost) Address() common.Address { return h.Self }
+
+// Caller implements Host.
+func (h *MemoryHost) Caller() common.Address { return h.From }
+
+// Balance implements Host.
+func (h *MemoryHost) Balance(addr common.Address) uint64 { return h.Balances[addr] }
+
+// Transfer implements Host.
+func (h *MemoryHost) Transfer(to common.Address, amount uint64) error {
+	if h.Balances[h.Self] < amount {
+		return fmt.Errorf("%w: have %d, want %d", ErrInsufficientBalance, h.Balances[h.Self], amount)
+	}
+	h.Balances[h.Self] -= amount
+	h.Balances[to] += amount
+	return nil
+}
+
+// GetStorage implements Host.
+func (h *MemoryHost) GetStorage(key uint64) uint64 { return h.Storage[key] }
+
+// SetStorage implements Host.
+func (h *MemoryHost) SetStorage(key, value uint64) error {
+	if value == 0 {
+		delete(h.Storage, key)
+	} else {
+		h.Storage[key] = value
+	}
+	return nil
+}
+
+// EmitLog implements Host.
+func (h *MemoryHost) EmitLog(ev Event) error {
+	h.Logs = append(h.Logs, ev)
+	return nil
+}
+
+// Spawn implements Host. Agent addresses are derived from the contract
+// address and a counter, as contract creation derives them from the nonce.
+func (h *MemoryHost) Spawn(entry uint64, state []uint64) (common.Address, error) {
+	addr := crypto.CreateAddress(h.Self, h.nonce)
+	h.nonce++
+	h.Agents[addr] = &Agent{Entry: entry, State: state}
+	return addr, nil
+}
+
+// Send implements Host.
+func (h *MemoryHost) Send(to common.Address, msg []uint64) error {
+	if _, ok := h.Agents[to]; !ok {
+		return fmt.Errorf("%w: %x", ErrUnknownAgent, to)
+	}
+	h.Mailbox = append(h.Mailbox, Message{From: h.Self, To: to, Data: msg})
+	return nil
+}
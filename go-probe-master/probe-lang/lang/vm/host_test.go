@@ -0,0 +1,256 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/probechain/go-probe/common"
+)
+
+var (
+	testSelf   = common.HexToAddress("0x1000000000000000000000000000000000000001")
+	testCaller = common.HexToAddress("0x2000000000000000000000000000000000000002")
+	testPayee  = common.HexToAddress("0x3000000000000000000000000000000000000003")
+)
+
+func TestBalanceTransfer(t *testing.T) {
+	host := NewMemoryHost(testSelf, testCaller)
+	host.Balances[testSelf] = 100
+	host.Balances[testCaller] = 7
+
+	v := New(nil, nil, 1_000_000, host)
+	payee, err := v.memory.AllocAddress(testPayee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.code = program(
+		instr(OpCaller, 2, 0, 0),     // R2 = &caller
+		instr(OpBalance, 3, 2, 0),    // R3 = balance(caller)
+		instrWide(OpLoadConst, 4, 0), // R4 = &payee
+		instrWide(OpLoadConst, 5, 1), // R5 = 30
+		instr(OpTransfer, 0, 4, 5),   // transfer 30 to payee
+		instr(OpBalance, 6, 4, 0),    // R6 = balance(payee)
+		instr(OpHalt, 3, 0, 0),
+	)
+	v.constants = []uint64{payee, 30}
+
+	if got := runVM(t, v); got != 7 {
+		t.Errorf("balance(caller) = %d, want 7", got)
+	}
+	if v.registers[6] != 30 {
+		t.Errorf("balance(payee) = %d, want 30", v.registers[6])
+	}
+	if host.Balances[testSelf] != 70 || host.Balances[testPayee] != 30 {
+		t.Errorf("balances = %v", host.Balances)
+	}
+}
+
+func TestTransferInsufficientBalance(t *testing.T) {
+	host := NewMemoryHost(testSelf, testCaller)
+	host.Balances[testSelf] = 10
+
+	v := New(nil, nil, 1_000_000, host)
+	payee, err := v.memory.AllocAddress(testPayee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.code = program(
+		instrWide(OpLoadConst, 4, 0),
+		instrWide(OpLoadConst, 5, 1),
+		instr(OpTransfer, 0, 4, 5),
+		instr(OpHalt, 0, 0, 0),
+	)
+	v.constants = []uint64{payee, 11}
+	if _, err := v.Run(); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("error = %v, want %v", err, ErrInsufficientBalance)
+	}
+	if host.Balances[testSelf] != 10 || host.Balances[testPayee] != 0 {
+		t.Errorf("balances = %v", host.Balances)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	host := NewMemoryHost(testSelf, testCaller)
+	host.Storage[1] = 5
+
+	code := program(
+		instrWide(OpLoadConst, 2, 0), // R2 = key 1
+		instr(OpSLoad, 3, 2, 0),      // R3 = storage[1]
+		instr(OpAdd, 3, 3, 3),        // R3 *= 2
+		instrWide(OpLoadConst, 4, 1), // R4 = key 9
+		instr(OpSStore, 4, 3, 0),     // storage[9] = R3
+		instr(OpSStore, 2, 0, 0),     // storage[1] = 0
+		instr(OpSLoad, 5, 4, 0),      // R5 = storage[9]
+		instr(OpHalt, 5, 0, 0),
+	)
+	v := New(code, []uint64{1, 9}, 1_000_000, host)
+	if got := runVM(t, v); got != 10 {
+		t.Errorf("storage[9] = %d, want 10", got)
+	}
+	if len(host.Storage) != 1 || host.Storage[9] != 10 {
+		t.Errorf("storage = %v, want map[9:10]", host.Storage)
+	}
+	if want := 3*gasTrivial + gasArithmetic + 2*gasSLoad + 2*gasSStore; v.GasUsed() != want {
+		t.Errorf("gas used = %d, want %d", v.GasUsed(), want)
+	}
+}
+
+// readOnlyHost rejects all state changes, as a static call does.
+type readOnlyHost struct{ *MemoryHost }
+
+var errReadOnly = errors.New("read-only")
+
+func (readOnlyHost) SetStorage(key, value uint64) error { return errReadOnly }
+func (readOnlyHost) EmitLog(ev Event) error             { return errReadOnly }
+
+func TestEmitToHost(t *testing.T) {
+	v := New(nil, nil, 1_000_000, nil)
+	ev, err := v.memory.Alloc(24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, w := range []uint64{2, 0xfeed, 42} {
+		if err := v.memory.WriteUint64(ev+8*uint64(i), w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v.code = program(
+		instrWide(OpLoadConst, 2, 0),
+		instr(OpEmit, 2, 0, 0),
+		instr(OpHalt, 0, 0, 0),
+	)
+	v.constants = []uint64{ev}
+	runVM(t, v)
+	logs := v.Host().(*MemoryHost).Logs
+	if len(logs) != 1 || logs[0].ID != 0xfeed || len(logs[0].Fields) != 1 || logs[0].Fields[0] != 42 {
+		t.Errorf("logs = %+v", logs)
+	}
+
+	// A host error aborts execution.
+	host := readOnlyHost{NewMemoryHost(testSelf, testCaller)}
+	v = New(program(instr(OpSStore, 0, 0, 0), instr(OpHalt, 0, 0, 0)), nil, 1_000_000, host)
+	if _, err := v.Run(); !errors.Is(err, errReadOnly) {
+		t.Errorf("error = %v, want %v", err, errReadOnly)
+	}
+}
+
+func TestAddressMemory(t *testing.T) {
+	mem := NewMemory(0)
+	ptr, err := mem.AllocAddress(testPayee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := mem.ReadAddress(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != testPayee {
+		t.Errorf("ReadAddress = %x, want %x", got, testPayee)
+	}
+	// The padding word is zero, so comparing words compares addresses.
+	if w, _ := mem.ReadUint64(ptr + 16); w != 0x03000000 {
+		t.Errorf("last word = %#x, want 0x03000000", w)
+	}
+	if _, err := mem.ReadAddress(ptr + 8); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("misaligned read: error = %v, want %v", err, ErrInvalidAddress)
+	}
+}
+
+func TestSpawnSend(t *testing.T) {
+	host := NewMemoryHost(testSelf, testCaller)
+	v := New(nil, nil, 1_000_000, host)
+	state, err := v.memory.AllocWords([]uint64{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := v.memory.AllocWords([]uint64{0, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.code = program(
+		instrWide(OpLoadConst, 2, 0), // R2 = &state
+		instrWide(OpLoadConst, 3, 1), // R3 = dispatcher entry
+		instr(OpSpawn, 4, 2, 3),      // R4 = &agent
+		instrWide(OpLoadConst, 5, 2), // R5 = &msg
+		instr(OpSend, 4, 5, 0),       // send msg to agent
+		instr(OpHalt, 4, 0, 0),
+	)
+	v.constants = []uint64{state, 64, msg}
+	ptr := runVM(t, v)
+
+	addr, err := v.memory.ReadAddress(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ag, ok := host.Agents[addr]
+	if !ok || ag.Entry != 64 || len(ag.State) != 2 || ag.State[0] != 1 || ag.State[1] != 2 {
+		t.Fatalf("agents = %v, want %x with entry 64 and state [1 2]", host.Agents, addr)
+	}
+	if len(host.Mailbox) != 1 {
+		t.Fatalf("got %d messages, want 1", len(host.Mailbox))
+	}
+	if m := host.Mailbox[0]; m.From != testSelf || m.To != addr || len(m.Data) != 2 || m.Data[1] != 5 {
+		t.Errorf("message = %+v", m)
+	}
+	if want := 4*gasTrivial + 2*gasAgent + 4*gasSStore; v.GasUsed() != want {
+		t.Errorf("gas used = %d, want %d", v.GasUsed(), want)
+	}
+
+	// Messages may only be sent to spawned agents.
+	v = New(nil, nil, 1_000_000, host)
+	stranger, err := v.memory.AllocAddress(testPayee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = v.memory.AllocWords(nil); err != nil {
+		t.Fatal(err)
+	}
+	v.code = program(
+		instrWide(OpLoadConst, 2, 0),
+		instrWide(OpLoadConst, 3, 1),
+		instr(OpSend, 2, 3, 0),
+		instr(OpHalt, 0, 0, 0),
+	)
+	v.constants = []uint64{stranger, msg}
+	if _, err := v.Run(); !errors.Is(err, ErrUnknownAgent) {
+		t.Errorf("error = %v, want %v", err, ErrUnknownAgent)
+	}
+}
+
+func TestWordArrays(t *testing.T) {
+	mem := NewMemory(0)
+	ptr, err := mem.AllocWords([]uint64{7, 1 << 63})
+	if err != nil {
+		t.Fatal(err)
+	}
+	words, err := mem.ReadWords(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(words) != 2 || words[0] != 7 || words[1] != 1<<63 {
+		t.Errorf("ReadWords = %v, want [7 %d]", words, uint64(1<<63))
+	}
+	// A length beyond the memory limit must not be trusted.
+	if err := mem.WriteUint64(ptr, 1<<62); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.ReadWords(ptr); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("oversized array: error = %v, want %v", err, ErrInvalidAddress)
+	}
+}
@@ -17,8 +17,11 @@
 package vm
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+
+	"github.com/probechain/go-probe/common"
 )
 
 const (
@@ -58,6 +61,7 @@ func (a allocation) end() uint64 { return a.base + a.size }
 //   - The backing store is a single flat byte slice grown lazily.
 //   - All accesses are bounds-checked against the corresponding allocation.
 //   - A configurable limit caps total allocated bytes to prevent abuse.
+//   - Address 0 is never allocated, so it can serve as a null pointer.
 //
 // The zero value is not usable; use NewMemory.
 type Memory struct {
@@ -75,9 +79,10 @@ func NewMemory(limit uint64) *Memory {
 		limit = DefaultMemoryLimit
 	}
 	return &Memory{
-		data:   make([]byte, 0, 4096),
-		allocs: make(map[uint64]allocation),
-		limit:  limit,
+		data:    make([]byte, 0, 4096),
+		allocs:  make(map[uint64]allocation),
+		limit:   limit,
+		nextPtr: minAllocSize,
 	}
 }
 
@@ -225,6 +230,10 @@ func (m *Memory) WriteSlice(addr uint64, data []byte) error {
 	return nil
 }
 
+// Data returns the backing store, from address 0 up to the end of the
+// highest allocation made so far. The slice must not be modified.
+func (m *Memory) Data() []byte { return m.data }
+
 // Used returns the current number of allocated bytes.
 func (m *Memory) Used() uint64 { return m.used }
 
@@ -236,6 +245,9 @@ func (m *Memory) Limit() uint64 { return m.limit }
 func (m *Memory) checkAccess(addr, size uint64) error {
 	// addr must fall inside at least one live allocation and that allocation
 	// must fully cover [addr, addr+size).
+	if addr+size < addr {
+		return fmt.Errorf("%w: addr=0x%x size=%d", ErrInvalidAddress, addr, size)
+	}
 	for _, a := range m.allocs {
 		if addr >= a.base && addr+size <= a.end() {
 			return nil
@@ -257,3 +269,77 @@ func max64(a, b uint64) uint64 {
 	}
 	return b
 }
+
+// ---- Addresses -------------------------------------------------------------
+//
+// An address is held in VM memory as three little-endian words, the 20
+// address bytes followed by 4 zero bytes, and passed around by pointer.
+// Comparing the three words compares the addresses.
+
+// AddressSize is the size of an address buffer in VM memory.
+const AddressSize = 24
+
+// AllocAddress stores addr in a fresh buffer and returns its address.
+func (m *Memory) AllocAddress(addr common.Address) (uint64, error) {
+	ptr, err := m.Alloc(AddressSize)
+	if err != nil {
+		return 0, err
+	}
+	var buf [AddressSize]byte
+	copy(buf[:], addr[:])
+	if err := m.WriteSlice(ptr, buf[:]); err != nil {
+		return 0, err
+	}
+	return ptr, nil
+}
+
+// ReadAddress reads the address stored at ptr.
+func (m *Memory) ReadAddress(ptr uint64) (common.Address, error) {
+	data, err := m.ReadSlice(ptr, common.AddressLength)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return common.BytesToAddress(data), nil
+}
+
+// ---- Word arrays -----------------------------------------------------------
+//
+// Agent state and messages cross the VM boundary as word arrays laid out like
+// PROBE arrays: a length word followed by that many words.
+
+// AllocWords stores words in a fresh array and returns its address.
+func (m *Memory) AllocWords(words []uint64) (uint64, error) {
+	ptr, err := m.Alloc(uint64(8 * (1 + len(words))))
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 8*(1+len(words)))
+	binary.LittleEndian.PutUint64(buf, uint64(len(words)))
+	for i, w := range words {
+		binary.LittleEndian.PutUint64(buf[8*(i+1):], w)
+	}
+	if err := m.WriteSlice(ptr, buf); err != nil {
+		return 0, err
+	}
+	return ptr, nil
+}
+
+// ReadWords reads the word array at ptr.
+func (m *Memory) ReadWords(ptr uint64) ([]uint64, error) {
+	n, err := m.ReadUint64(ptr)
+	if err != nil {
+		return nil, err
+	}
+	if n > m.limit/8 {
+		return nil, fmt.Errorf("%w: addr=0x%x words=%d", ErrInvalidAddress, ptr, n)
+	}
+	data, err := m.ReadSlice(ptr+8, 8*n)
+	if err != nil {
+		return nil, err
+	}
+	words := make([]uint64, n)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(data[8*i:])
+	}
+	return words, nil
+}
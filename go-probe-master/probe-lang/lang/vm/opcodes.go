@@ -133,25 +133,32 @@ const (
 
 	// ---- Agent operations --------------------------------------------------
 
-	// OpSpawn creates a new agent of the type encoded in R[b] and stores the
-	// agent ID in R[a].
+	// OpSpawn creates an agent with the initial state in the word array at
+	// R[b], whose messages are dispatched by the function at byte offset R[c],
+	// and stores a pointer to its address in R[a].
 	OpSpawn
-	// OpSend sends the message value in R[b] to the agent identified by R[a].
+	// OpSend queues the message in the word array at R[b] for the agent whose
+	// address is at R[a]. It is delivered in a later block, paid for by the
+	// send gas set with SetSendGas.
 	OpSend
-	// OpRecv waits for an incoming message and stores it in R[a].
+	// OpRecv takes the next message enqueued with EnqueueMessage into R[a].
 	OpRecv
-	// OpSelf stores the current agent's ID in R[a].
+	// OpSelf stores a pointer to the executing contract's or agent's address
+	// in R[a].
 	OpSelf
 
 	// ---- Blockchain operations ---------------------------------------------
 
-	// OpBalance stores the token balance of address R[b] in R[a].
+	// OpBalance stores the token balance of the address at R[b] in R[a].
+	// Addresses live in memory as 20 bytes padded to a 24-byte buffer.
 	OpBalance
-	// OpTransfer transfers R[c] tokens from address R[a] to address R[b].
+	// OpTransfer transfers R[c] tokens from the executing contract to the
+	// address at R[b].  R[a] is ignored.
 	OpTransfer
 	// OpEmit emits a log event whose payload is in R[a].
 	OpEmit
-	// OpCaller stores the caller's address (as a 64-bit hash prefix) in R[a].
+	// OpCaller allocates a buffer holding the caller's address and stores
+	// its address in R[a].
 	OpCaller
 	// OpBlockNum stores the current block number in R[a].
 	OpBlockNum
@@ -167,11 +174,14 @@ const (
 	// Memory at the address held in R[a].
 	OpSHAKE256
 	// OpFalcon512Verify stores 1 in R[a] if the Falcon-512 signature is valid,
-	// 0 otherwise.  R[b] = msg ptr, R[c] = sig ptr (register d = next reg for pubkey).
+	// 0 otherwise.  R[b] = msg ptr, R[c] = sig ptr and, on entry, R[a] =
+	// pubkey ptr; each points to a length-prefixed byte buffer.
 	OpFalcon512Verify
-	// OpMLDSAVerify verifies an ML-DSA (Dilithium) signature; result in R[a].
+	// OpMLDSAVerify verifies an ML-DSA (Dilithium2) signature; operands and
+	// result as for OpFalcon512Verify.
 	OpMLDSAVerify
-	// OpSLHDSAVerify verifies an SLH-DSA (SPHINCS+) signature; result in R[a].
+	// OpSLHDSAVerify verifies an SLH-DSA-SHAKE-128s (SPHINCS+) signature;
+	// operands and result as for OpFalcon512Verify.
 	OpSLHDSAVerify
 	// OpSecp256k1Recover recovers the public key from hash+sig; stores ptr in R[a].
 	// R[b] = hash ptr (32 bytes), R[c] = sig ptr (65 bytes).
@@ -201,6 +211,19 @@ const (
 	// OpArrayLen stores the length of Array(R[b]) in R[a].
 	OpArrayLen
 
+	// ---- Abort -------------------------------------------------------------
+
+	// OpRevert aborts execution with the length-prefixed reason string at
+	// address R[a] (0 for none).
+	OpRevert
+
+	// ---- Storage -----------------------------------------------------------
+
+	// OpSLoad stores the contract storage word under key R[b] in R[a].
+	OpSLoad
+	// OpSStore stores R[b] in contract storage under key R[a].
+	OpSStore
+
 	// opcodeCount must remain the last constant; it gives the total number of
 	// defined opcodes and is used for table bounds checks.
 	opcodeCount
@@ -256,7 +279,7 @@ var opcodeTable = [opcodeCount]opcodeInfo{
 	OpHalt:       {"HALT", 1},
 	OpPush:       {"PUSH", 1},
 	OpPop:        {"POP", 1},
-	OpSpawn:      {"SPAWN", 2},
+	OpSpawn:      {"SPAWN", 3},
 	OpSend:       {"SEND", 2},
 	OpRecv:       {"RECV", 1},
 	OpSelf:       {"SELF", 1},
@@ -279,6 +302,9 @@ var opcodeTable = [opcodeCount]opcodeInfo{
 	OpArrayGet: {"ARRAY_GET", 3},
 	OpArraySet: {"ARRAY_SET", 3},
 	OpArrayLen: {"ARRAY_LEN", 2},
+	OpRevert:   {"REVERT", 1},
+	OpSLoad:    {"SLOAD", 2},
+	OpSStore:   {"SSTORE", 2},
 }
 
 // String returns the mnemonic name of the opcode, suitable for disassembly
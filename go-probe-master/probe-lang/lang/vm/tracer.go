@@ -0,0 +1,93 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import "sort"
+
+// Tracer is notified of every instruction the VM executes. CaptureStep is
+// called after the instruction ran, so the registers and memory of v
+// reflect its effects; step.Err is the error it failed with, if any.
+type Tracer interface {
+	CaptureStep(v *VM, step *Step)
+}
+
+// Step describes an executed instruction.
+type Step struct {
+	PC        uint32 // byte offset of the instruction
+	Op        Opcode
+	A, B, C   uint8  // operand bytes
+	Gas       uint64 // gas left before the instruction
+	Cost      uint64 // gas charged for the instruction
+	CallDepth int    // number of active CALL frames, 0 in the entry function
+	Err       error
+}
+
+// StepLog is a snapshot of the VM state after an instruction.
+type StepLog struct {
+	Step
+	Registers map[uint8]uint64 // non-zero registers
+	Memory    []byte           // memory contents from address 0
+}
+
+// Snapshot captures the registers and memory of v after step. Either can be
+// left out to keep traces of long executions small.
+func (s *Step) Snapshot(v *VM, registers, memory bool) StepLog {
+	log := StepLog{Step: *s}
+	if registers {
+		log.Registers = make(map[uint8]uint64)
+		for i, r := range v.registers {
+			if r != 0 {
+				log.Registers[uint8(i)] = r
+			}
+		}
+	}
+	if memory {
+		log.Memory = append([]byte(nil), v.memory.Data()...)
+	}
+	return log
+}
+
+// StepLogger is a Tracer recording a StepLog for every instruction.
+type StepLogger struct {
+	DisableRegisters bool
+	DisableMemory    bool
+	Limit            int // maximum number of steps recorded, 0 for no limit
+
+	logs []StepLog
+}
+
+// CaptureStep implements Tracer.
+func (l *StepLogger) CaptureStep(v *VM, step *Step) {
+	if l.Limit != 0 && len(l.logs) >= l.Limit {
+		return
+	}
+	l.logs = append(l.logs, step.Snapshot(v, !l.DisableRegisters, !l.DisableMemory))
+}
+
+// Logs returns the recorded steps.
+func (l *StepLogger) Logs() []StepLog { return l.logs }
+
+// SortedRegisters returns the indexes of the registers in log in ascending
+// order.
+func (log *StepLog) SortedRegisters() []uint8 {
+	regs := make([]uint8, 0, len(log.Registers))
+	for r := range log.Registers {
+		regs = append(regs, r)
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i] < regs[j] })
+	return regs
+}
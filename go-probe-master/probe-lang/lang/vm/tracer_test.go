@@ -0,0 +1,81 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+//
+// The ProbeChain is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The ProbeChain is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the ProbeChain. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	code := program(
+		instrWide(OpLoadConst, 2, 0), // R2 = 10
+		instrWide(OpLoadConst, 3, 1), // R3 = 32
+		instr(OpAdd, 4, 2, 3),        // R4 = R2 + R3
+		instr(OpHalt, 4, 0, 0),
+	)
+	logger := &StepLogger{DisableMemory: true}
+	v := New(code, []uint64{10, 32}, 100, nil)
+	v.SetTracer(logger)
+	runVM(t, v)
+
+	logs := logger.Logs()
+	if len(logs) != 4 {
+		t.Fatalf("%d steps traced, want 4", len(logs))
+	}
+	gas := uint64(100)
+	for i, log := range logs {
+		if log.PC != uint32(4*i) || log.Gas != gas || log.Err != nil {
+			t.Errorf("step %d = %+v, want pc %d gas %d", i, log.Step, 4*i, gas)
+		}
+		gas -= log.Cost
+	}
+	if gas != 100-v.GasUsed() {
+		t.Errorf("traced gas cost %d, want %d", 100-gas, v.GasUsed())
+	}
+	add := logs[2]
+	if add.Op != OpAdd || add.A != 4 || add.B != 2 || add.C != 3 {
+		t.Errorf("step 2 = %+v, want ADD R4, R2, R3", add.Step)
+	}
+	// Registers are captured after the instruction ran.
+	if add.Registers[4] != 42 || len(add.Registers) != 3 {
+		t.Errorf("registers after ADD = %v", add.Registers)
+	}
+	if regs := add.SortedRegisters(); len(regs) != 3 || regs[0] != 2 || regs[2] != 4 {
+		t.Errorf("sorted registers = %v", regs)
+	}
+	if add.Memory != nil {
+		t.Error("memory captured although disabled")
+	}
+}
+
+func TestTracerFault(t *testing.T) {
+	code := program(
+		instr(OpDiv, 1, 2, 0), // division by zero
+	)
+	logger := &StepLogger{Limit: 1}
+	v := New(code, nil, 100, nil)
+	v.SetTracer(logger)
+	_, err := v.Run()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	logs := logger.Logs()
+	if len(logs) != 1 || !errors.Is(logs[0].Err, err) || logs[0].Op != OpDiv {
+		t.Fatalf("logs = %+v, want the failing DIV", logs)
+	}
+}
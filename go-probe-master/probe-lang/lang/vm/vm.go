@@ -20,6 +20,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+
+	"github.com/probechain/go-probe/common"
 )
 
 // ---- Error sentinels -------------------------------------------------------
@@ -48,6 +50,10 @@ var ErrResourceFault = errors.New("vm: resource lifecycle fault")
 // In the current synchronous model, messages must be pre-loaded.
 var ErrNilReceive = errors.New("vm: no pending message")
 
+// ErrReverted is returned when the program aborts through OpRevert, e.g. on a
+// failed require.
+var ErrReverted = errors.New("vm: execution reverted")
+
 // ---- Gas costs -------------------------------------------------------------
 
 const (
@@ -60,8 +66,11 @@ const (
 	gasJump       uint64 = 3   // any branch
 	gasCall       uint64 = 20  // function call overhead
 	gasCrypto     uint64 = 200 // hash / signature ops
+	gasCryptoWord uint64 = 6   // per 32-byte word of signature input
 	gasAgent      uint64 = 50  // spawn / send / recv
 	gasBlockchain uint64 = 30  // balance, transfer, etc.
+	gasSLoad      uint64 = 200  // storage read
+	gasSStore     uint64 = 5000 // storage write
 )
 
 // ---- Resource tracking -----------------------------------------------------
@@ -79,9 +88,11 @@ const (
 
 // frame captures the state needed to resume a caller after a CALL returns.
 type frame struct {
-	returnPC  uint32 // PC to restore in the caller
-	returnReg uint8  // register to store the return value
-	baseReg   uint8  // first register used as function arguments (unused in v1)
+	returnPC  uint32      // PC to restore in the caller
+	returnReg uint8       // register to store the return value
+	baseReg   uint8       // first register used as function arguments (unused in v1)
+	stackBase int         // stack base of the caller
+	registers [256]uint64 // caller registers, restored on return
 }
 
 // ---- VM --------------------------------------------------------------------
@@ -102,6 +113,7 @@ type VM struct {
 	pc        uint32      // program counter (index of next instruction word)
 	memory    *Memory
 	stack     []uint64      // value stack used by PUSH/POP
+	stackBase int           // start of the current function's stack values
 	callStack []frame       // call frame stack
 	constants []uint64      // constant pool indexed by OpLoadConst
 	code      []byte        // bytecode (must be a multiple of 4 bytes)
@@ -113,15 +125,24 @@ type VM struct {
 	resources map[uint64]resourceState
 	nextResID uint64 // monotone resource handle generator
 
-	// inbox holds messages queued for OpRecv (simple synchronous model).
+	// inbox holds messages queued for OpRecv by EnqueueMessage.
 	inbox []uint64
 
 	// blockNum and blockTime simulate blockchain context.
 	blockNum  uint64
 	blockTime uint64
 
-	// callerAddr holds the caller's address for OpCaller.
-	callerAddr uint64
+	// sendGas is charged by OpSend on top of the words of the message.
+	sendGas uint64
+
+	// host provides balances, transfers, storage and logs.
+	host Host
+
+	// revertReason holds the reason passed to OpRevert.
+	revertReason string
+
+	// tracer, if set, is notified of every executed instruction.
+	tracer Tracer
 }
 
 // New creates a new VM ready to execute code.
@@ -130,11 +151,17 @@ type VM struct {
 //   - code:      bytecode slice; must be a non-empty multiple of 4 bytes.
 //   - constants: constant pool; may be nil.
 //   - gasLimit:  maximum gas units the execution may consume.
-func New(code []byte, constants []uint64, gasLimit uint64) *VM {
+//   - host:      chain state for the blockchain opcodes; nil runs against
+//     an empty MemoryHost.
+func New(code []byte, constants []uint64, gasLimit uint64, host Host) *VM {
+	if host == nil {
+		host = NewMemoryHost(common.Address{}, common.Address{})
+	}
 	return &VM{
 		code:      code,
 		constants: constants,
 		gasLimit:  gasLimit,
+		host:      host,
 		memory:    NewMemory(0),
 		resources: make(map[uint64]resourceState),
 		stack:     make([]uint64, 0, 32),
@@ -142,12 +169,18 @@ func New(code []byte, constants []uint64, gasLimit uint64) *VM {
 	}
 }
 
-// SetBlockContext configures the simulated blockchain context available to
-// OpBlockNum, OpBlockTime, and OpCaller.
-func (vm *VM) SetBlockContext(blockNum, blockTime, caller uint64) {
+// SetBlockContext configures the block context available to OpBlockNum and
+// OpBlockTime.
+func (vm *VM) SetBlockContext(blockNum, blockTime uint64) {
 	vm.blockNum = blockNum
 	vm.blockTime = blockTime
-	vm.callerAddr = caller
+}
+
+// SetSendGas sets the gas OpSend charges per message on top of its words,
+// with which a host storing messages for later delivery prepays the
+// delivery.
+func (vm *VM) SetSendGas(gas uint64) {
+	vm.sendGas = gas
 }
 
 // EnqueueMessage enqueues a value for retrieval by OpRecv.
@@ -155,6 +188,31 @@ func (vm *VM) EnqueueMessage(msg uint64) {
 	vm.inbox = append(vm.inbox, msg)
 }
 
+// Memory returns the VM's memory, for hosts that pass buffers to the code.
+func (vm *VM) Memory() *Memory { return vm.memory }
+
+// Host returns the host the VM executes against.
+func (vm *VM) Host() Host { return vm.host }
+
+// RevertReason returns the reason given by OpRevert, if any.
+func (vm *VM) RevertReason() string { return vm.revertReason }
+
+// Enter positions the VM at the function starting at byte offset pc, with
+// args loaded into R1..Rn as a CALL would.
+func (vm *VM) Enter(pc uint32, args ...uint64) {
+	vm.pc = pc
+	for i, arg := range args {
+		vm.setReg(uint8(i+1), arg)
+	}
+}
+
+// SetTracer installs a tracer notified of every executed instruction; nil
+// removes it.
+func (vm *VM) SetTracer(t Tracer) { vm.tracer = t }
+
+// CallDepth returns the number of active CALL frames.
+func (vm *VM) CallDepth() int { return len(vm.callStack) }
+
 // GasUsed returns the total gas consumed so far.
 func (vm *VM) GasUsed() uint64 { return vm.gasUsed }
 
@@ -204,7 +262,18 @@ func (vm *VM) Step() error {
 	imm16 := uint16(b)<<8 | uint16(c)
 
 	// ---- Execute ----
-	return vm.execute(op, a, b, c, imm16)
+	if vm.tracer == nil {
+		return vm.execute(op, a, b, c, imm16)
+	}
+	step := &Step{PC: vm.pc - 4, Op: op, A: a, B: b, C: c, CallDepth: len(vm.callStack)}
+	if vm.gasUsed < vm.gasLimit {
+		step.Gas = vm.gasLimit - vm.gasUsed
+	}
+	gasUsed := vm.gasUsed
+	step.Err = vm.execute(op, a, b, c, imm16)
+	step.Cost = vm.gasUsed - gasUsed
+	vm.tracer.CaptureStep(vm, step)
+	return step.Err
 }
 
 // setReg writes v to register idx, silently discarding writes to R0.
@@ -516,8 +585,10 @@ func (vm *VM) execute(op Opcode, a, b, c uint8, imm16 uint16) error {
 
 	case OpCall:
 		// Call function at instruction index imm16.
-		// R[a] will receive the return value.
-		// Argument registers must already be populated by the caller.
+		// R[a] will receive the return value. The values pushed by the
+		// caller since it was entered are popped into R1..Rn as arguments;
+		// all other registers are visible to the callee and restored on
+		// return.
 		if err := vm.useGas(gasCall); err != nil {
 			return err
 		}
@@ -525,10 +596,20 @@ func (vm *VM) execute(op Opcode, a, b, c uint8, imm16 uint16) error {
 		if int(funcStart) > len(vm.code) {
 			return fmt.Errorf("vm: call target %d out of range", funcStart)
 		}
+		args := vm.stack[vm.stackBase:]
+		if len(args) > 255 {
+			return fmt.Errorf("vm: too many call arguments (%d)", len(args))
+		}
 		vm.callStack = append(vm.callStack, frame{
 			returnPC:  vm.pc,
 			returnReg: a,
+			stackBase: vm.stackBase,
+			registers: vm.registers,
 		})
+		for i, arg := range args {
+			vm.setReg(uint8(i+1), arg)
+		}
+		vm.stack = vm.stack[:vm.stackBase]
 		vm.pc = funcStart
 
 	case OpReturn:
@@ -543,10 +624,13 @@ func (vm *VM) execute(op Opcode, a, b, c uint8, imm16 uint16) error {
 			vm.halted = true
 			return nil
 		}
-		f := vm.callStack[len(vm.callStack)-1]
-		vm.callStack = vm.callStack[:len(vm.callStack)-1]
+		f := &vm.callStack[len(vm.callStack)-1]
+		vm.stack = vm.stack[:vm.stackBase]
+		vm.stackBase = f.stackBase
+		vm.registers = f.registers
 		vm.pc = f.returnPC
 		vm.setReg(f.returnReg, retVal)
+		vm.callStack = vm.callStack[:len(vm.callStack)-1]
 
 	case OpHalt:
 		// Store result in R[1] for retrieval by Run().
@@ -556,6 +640,18 @@ func (vm *VM) execute(op Opcode, a, b, c uint8, imm16 uint16) error {
 		vm.setReg(1, vm.getReg(a))
 		vm.halted = true
 
+	case OpRevert:
+		// Abort with the reason string at R[a], if any.
+		if err := vm.useGas(gasTrivial); err != nil {
+			return err
+		}
+		vm.halted = true
+		if reason, ok := vm.readString(vm.getReg(a)); ok {
+			vm.revertReason = reason
+			return fmt.Errorf("%w: %s", ErrReverted, reason)
+		}
+		return ErrReverted
+
 	// ---- Stack frame -------------------------------------------------------
 
 	case OpPush:
@@ -578,20 +674,35 @@ func (vm *VM) execute(op Opcode, a, b, c uint8, imm16 uint16) error {
 	// ---- Agent operations --------------------------------------------------
 
 	case OpSpawn:
-		if err := vm.useGas(gasAgent); err != nil {
+		state, err := vm.readWords(vm.getReg(b))
+		if err != nil {
 			return err
 		}
-		// In the current synchronous model, spawn returns a synthetic ID.
-		id := vm.nextResID
-		vm.nextResID++
-		vm.setReg(a, id)
+		addr, err := vm.host.Spawn(vm.getReg(c), state)
+		if err != nil {
+			return err
+		}
+		ptr, err := vm.memory.AllocAddress(addr)
+		if err != nil {
+			return err
+		}
+		vm.setReg(a, ptr)
 
 	case OpSend:
-		if err := vm.useGas(gasAgent); err != nil {
+		to, err := vm.memory.ReadAddress(vm.getReg(a))
+		if err != nil {
+			return err
+		}
+		msg, err := vm.readWords(vm.getReg(b))
+		if err != nil {
+			return err
+		}
+		if err := vm.useGas(vm.sendGas); err != nil {
+			return err
+		}
+		if err := vm.host.Send(to, msg); err != nil {
 			return err
 		}
-		// Synchronous stub: enqueue the message in the VM's own inbox.
-		vm.inbox = append(vm.inbox, vm.getReg(b))
 
 	case OpRecv:
 		if err := vm.useGas(gasAgent); err != nil {
@@ -605,10 +716,14 @@ func (vm *VM) execute(op Opcode, a, b, c uint8, imm16 uint16) error {
 		vm.setReg(a, msg)
 
 	case OpSelf:
-		if err := vm.useGas(gasTrivial); err != nil {
+		if err := vm.useGas(gasMemOp); err != nil {
+			return err
+		}
+		ptr, err := vm.memory.AllocAddress(vm.host.Address())
+		if err != nil {
 			return err
 		}
-		vm.setReg(a, 0) // self is agent 0 in the single-agent model
+		vm.setReg(a, ptr)
 
 	// ---- Blockchain operations ---------------------------------------------
 
@@ -616,26 +731,59 @@ func (vm *VM) execute(op Opcode, a, b, c uint8, imm16 uint16) error {
 		if err := vm.useGas(gasBlockchain); err != nil {
 			return err
 		}
-		// Stub: return 0 (real implementation queries chain state).
-		vm.setReg(a, 0)
+		addr, err := vm.memory.ReadAddress(vm.getReg(b))
+		if err != nil {
+			return fmt.Errorf("OpBalance: %w", err)
+		}
+		vm.setReg(a, vm.host.Balance(addr))
 
 	case OpTransfer:
 		if err := vm.useGas(gasBlockchain); err != nil {
 			return err
 		}
-		// Stub: no-op in the interpreter; the chain layer validates actual transfers.
+		to, err := vm.memory.ReadAddress(vm.getReg(b))
+		if err != nil {
+			return fmt.Errorf("OpTransfer: %w", err)
+		}
+		if err := vm.host.Transfer(to, vm.getReg(c)); err != nil {
+			return err
+		}
 
 	case OpEmit:
+		// R[a] points at the event as a word array [n][id][fields...].
 		if err := vm.useGas(gasBlockchain); err != nil {
 			return err
 		}
-		// Stub: event emission is handled by the surrounding execution context.
+		ptr := vm.getReg(a)
+		n, err := vm.memory.ReadUint64(ptr)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("vm: empty event")
+		}
+		if err := vm.useGas(n * gasMemOp); err != nil {
+			return err
+		}
+		words := make([]uint64, n)
+		for i := range words {
+			if words[i], err = vm.memory.ReadUint64(ptr + 8 + 8*uint64(i)); err != nil {
+				return err
+			}
+		}
+		if err := vm.host.EmitLog(Event{ID: words[0], Fields: words[1:]}); err != nil {
+			return err
+		}
 
 	case OpCaller:
-		if err := vm.useGas(gasTrivial); err != nil {
+		if err := vm.useGas(gasMemOp); err != nil {
 			return err
 		}
-		vm.setReg(a, vm.callerAddr)
+		ptr, err := vm.memory.AllocAddress(vm.host.Caller())
+		if err != nil {
+			return fmt.Errorf("OpCaller: %w", err)
+		}
+		vm.setReg(a, ptr)
 
 	case OpBlockNum:
 		if err := vm.useGas(gasTrivial); err != nil {
@@ -649,6 +797,22 @@ func (vm *VM) execute(op Opcode, a, b, c uint8, imm16 uint16) error {
 		}
 		vm.setReg(a, vm.blockTime)
 
+	// ---- Storage -----------------------------------------------------------
+
+	case OpSLoad:
+		if err := vm.useGas(gasSLoad); err != nil {
+			return err
+		}
+		vm.setReg(a, vm.host.GetStorage(vm.getReg(b)))
+
+	case OpSStore:
+		if err := vm.useGas(gasSStore); err != nil {
+			return err
+		}
+		if err := vm.host.SetStorage(vm.getReg(a), vm.getReg(b)); err != nil {
+			return err
+		}
+
 	// ---- Crypto (native PQC opcodes) ---------------------------------------
 
 	case OpSHA3:
@@ -674,34 +838,34 @@ func (vm *VM) execute(op Opcode, a, b, c uint8, imm16 uint16) error {
 		}
 
 	case OpFalcon512Verify:
-		if err := vm.useGas(gasCrypto * 4); err != nil {
-			return err
-		}
-		result, err := execFalcon512Verify(vm.memory, vm.getReg(b), vm.getReg(c), 0)
+		msg, sig, pubkey, err := readSignature(vm.memory, vm.getReg(b), vm.getReg(c), vm.getReg(a))
 		if err != nil {
+			return fmt.Errorf("OpFalcon512Verify %w", err)
+		}
+		if err := vm.useGas(signatureGas(gasCrypto*4, msg, sig, pubkey)); err != nil {
 			return err
 		}
-		vm.setReg(a, result)
+		vm.setReg(a, execFalcon512Verify(msg, sig, pubkey))
 
 	case OpMLDSAVerify:
-		if err := vm.useGas(gasCrypto * 4); err != nil {
-			return err
-		}
-		result, err := execMLDSAVerify(vm.memory, vm.getReg(b), vm.getReg(c), 0)
+		msg, sig, pubkey, err := readSignature(vm.memory, vm.getReg(b), vm.getReg(c), vm.getReg(a))
 		if err != nil {
+			return fmt.Errorf("OpMLDSAVerify %w", err)
+		}
+		if err := vm.useGas(signatureGas(gasCrypto*4, msg, sig, pubkey)); err != nil {
 			return err
 		}
-		vm.setReg(a, result)
+		vm.setReg(a, execMLDSAVerify(msg, sig, pubkey))
 
 	case OpSLHDSAVerify:
-		if err := vm.useGas(gasCrypto * 6); err != nil {
-			return err
-		}
-		result, err := execSLHDSAVerify(vm.memory, vm.getReg(b), vm.getReg(c), 0)
+		msg, sig, pubkey, err := readSignature(vm.memory, vm.getReg(b), vm.getReg(c), vm.getReg(a))
 		if err != nil {
+			return fmt.Errorf("OpSLHDSAVerify %w", err)
+		}
+		if err := vm.useGas(signatureGas(gasCrypto*6, msg, sig, pubkey)); err != nil {
 			return err
 		}
-		vm.setReg(a, result)
+		vm.setReg(a, execSLHDSAVerify(msg, sig, pubkey))
 
 	case OpSecp256k1Recover:
 		if err := vm.useGas(gasCrypto * 2); err != nil {
@@ -800,34 +964,70 @@ func (vm *VM) execute(op Opcode, a, b, c uint8, imm16 uint16) error {
 	return nil
 }
 
+// readWords reads the word array at ptr for OpSpawn or OpSend, charging
+// gasAgent plus gasSStore per word, since the host persists the words.
+func (vm *VM) readWords(ptr uint64) ([]uint64, error) {
+	words, err := vm.memory.ReadWords(ptr)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.useGas(gasAgent + gasSStore*uint64(len(words))); err != nil {
+		return nil, err
+	}
+	return words, nil
+}
+
+// readString reads a length-prefixed byte string ([len:8][bytes]) from memory.
+func (vm *VM) readString(ptr uint64) (string, bool) {
+	if ptr == 0 {
+		return "", false
+	}
+	length, err := vm.memory.ReadUint64(ptr)
+	if err != nil {
+		return "", false
+	}
+	data, err := vm.memory.ReadSlice(ptr+8, length)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
 // ---- Disassembly helper ----------------------------------------------------
 
 // Disassemble returns a human-readable listing of the bytecode.
 func Disassemble(code []byte) string {
 	out := ""
 	for i := 0; i+4 <= len(code); i += 4 {
-		word := binary.LittleEndian.Uint32(code[i:])
-		op := Opcode(word & 0xFF)
-		a := (word >> 8) & 0xFF
-		b := (word >> 16) & 0xFF
-		c := (word >> 24) & 0xFF
-		imm16 := (b << 8) | c
-
-		instrIdx := i / 4
-		if op.IsWideImmediate() {
-			out += fmt.Sprintf("[%04d] %-20s R%d, %d\n", instrIdx, op, a, imm16)
-		} else {
-			switch op.Operands() {
-			case 1:
-				out += fmt.Sprintf("[%04d] %-20s R%d\n", instrIdx, op, a)
-			case 2:
-				out += fmt.Sprintf("[%04d] %-20s R%d, R%d\n", instrIdx, op, a, b)
-			case 3:
-				out += fmt.Sprintf("[%04d] %-20s R%d, R%d, R%d\n", instrIdx, op, a, b, c)
-			default:
-				out += fmt.Sprintf("[%04d] %-20s\n", instrIdx, op)
-			}
-		}
+		out += fmt.Sprintf("[%04d] %s\n", i/4, DisassembleInstruction(code, uint32(i)))
 	}
 	return out
 }
+
+// DisassembleInstruction returns the instruction at byte offset pc, without
+// its index.
+func DisassembleInstruction(code []byte, pc uint32) string {
+	if int(pc)+4 > len(code) {
+		return "<end of code>"
+	}
+	word := binary.LittleEndian.Uint32(code[pc:])
+	op := Opcode(word & 0xFF)
+	a := (word >> 8) & 0xFF
+	b := (word >> 16) & 0xFF
+	c := (word >> 24) & 0xFF
+	imm16 := (b << 8) | c
+
+	if op.IsWideImmediate() {
+		return fmt.Sprintf("%-20s R%d, %d", op, a, imm16)
+	}
+	switch op.Operands() {
+	case 1:
+		return fmt.Sprintf("%-20s R%d", op, a)
+	case 2:
+		return fmt.Sprintf("%-20s R%d, R%d", op, a, b)
+	case 3:
+		return fmt.Sprintf("%-20s R%d, R%d, R%d", op, a, b, c)
+	default:
+		return fmt.Sprintf("%-20s", op)
+	}
+}
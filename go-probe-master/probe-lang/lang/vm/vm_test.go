@@ -21,6 +21,7 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/probechain/go-probe/common"
 	"golang.org/x/crypto/sha3"
 )
 
@@ -54,7 +55,7 @@ func program(instrs ...[]byte) []byte {
 // newTestVM creates a VM with a generous gas limit for tests that do not
 // specifically test gas metering.
 func newTestVM(code []byte, consts []uint64) *VM {
-	return New(code, consts, 1_000_000)
+	return New(code, consts, 1_000_000, nil)
 }
 
 // runVM is a test helper that runs the VM and fails the test on error.
@@ -579,6 +580,77 @@ func TestCallReturn(t *testing.T) {
 	}
 }
 
+// TestCallArguments tests that pushed values are passed in R1..Rn and that
+// the caller's registers survive the call.
+//
+// Program layout:
+//
+//	[0] LOAD_CONST R5, 40
+//	[1] LOAD_CONST R6, 2
+//	[2] PUSH R5
+//	[3] PUSH R6
+//	[4] CALL R7, 8
+//	[5] ADD R1, R7, R5     → 42 + 40
+//	[6] HALT R1
+//	[7] HALT R0            unreachable
+//	[8] ADD R5, R1, R2     callee clobbers R5
+//	[9] RETURN R5
+func TestCallArguments(t *testing.T) {
+	code := program(
+		instrWide(OpLoadConst, 5, 0),
+		instrWide(OpLoadConst, 6, 1),
+		instr(OpPush, 5, 0, 0),
+		instr(OpPush, 6, 0, 0),
+		instrWide(OpCall, 7, 8),
+		instr(OpAdd, 1, 7, 5),
+		instr(OpHalt, 1, 0, 0),
+		instr(OpHalt, 0, 0, 0),
+		instr(OpAdd, 5, 1, 2),
+		instr(OpReturn, 5, 0, 0),
+	)
+	v := newTestVM(code, []uint64{40, 2})
+	if got := runVM(t, v); got != 82 {
+		t.Errorf("CallArguments: got %d; want 82", got)
+	}
+}
+
+// TestEnter tests starting execution at a function with arguments.
+func TestEnter(t *testing.T) {
+	code := program(
+		instr(OpHalt, 0, 0, 0),
+		instr(OpMul, 3, 1, 2),
+		instr(OpReturn, 3, 0, 0),
+	)
+	v := newTestVM(code, nil)
+	v.Enter(4, 6, 7)
+	if got := runVM(t, v); got != 42 {
+		t.Errorf("Enter: got %d; want 42", got)
+	}
+}
+
+func TestRevert(t *testing.T) {
+	// Revert without a reason.
+	v := newTestVM(program(instr(OpRevert, 0, 0, 0)), nil)
+	if _, err := v.Run(); !errors.Is(err, ErrReverted) {
+		t.Fatalf("Revert: got err %v; want ErrReverted", err)
+	}
+	// Revert with a length-prefixed reason string.
+	code := program(
+		instrWide(OpLoadConst, 2, 0), // R2 = 16
+		instr(OpAlloc, 3, 2, 0),      // R3 = alloc(16)
+		instrWide(OpLoadConst, 4, 1), // R4 = 2
+		instr(OpStoreMem, 3, 4, 0),   // length
+		instrWide(OpLoadConst, 4, 2), // R4 = "no"
+		instr(OpStoreMem, 3, 4, 8),   // bytes
+		instr(OpRevert, 3, 0, 0),
+	)
+	v = newTestVM(code, []uint64{16, 2, uint64('n') | uint64('o')<<8})
+	_, err := v.Run()
+	if !errors.Is(err, ErrReverted) || err.Error() != "vm: execution reverted: no" {
+		t.Fatalf("Revert: got err %v; want reason", err)
+	}
+}
+
 // ---- Memory operations -----------------------------------------------------
 
 func TestMemoryAllocStoreLoad(t *testing.T) {
@@ -746,7 +818,7 @@ func TestSHA3Opcode(t *testing.T) {
 	expected := h.Sum(nil) // 32 bytes
 
 	// Build a VM with pre-allocated memory regions and run only the SHA3 opcode.
-	v := New(nil, nil, 1_000_000)
+	v := New(nil, nil, 1_000_000, nil)
 	srcPtr, err := v.memory.Alloc(8)
 	if err != nil {
 		t.Fatalf("Alloc src: %v", err)
@@ -790,7 +862,7 @@ func TestSHA3Opcode(t *testing.T) {
 func TestSHAKE256Opcode(t *testing.T) {
 	const srcData = "probe"
 
-	v := New(nil, nil, 1_000_000)
+	v := New(nil, nil, 1_000_000, nil)
 
 	srcPtr, err := v.memory.Alloc(8)
 	if err != nil {
@@ -859,7 +931,7 @@ func TestGasExhaustion(t *testing.T) {
 		instrWide(OpJump, 0, 2),        // [5] jump to [2]
 		instr(OpHalt, 4, 0, 0),         // [6]
 	)
-	v := New(code, []uint64{100, 1}, 10)
+	v := New(code, []uint64{100, 1}, 10, nil)
 	_, err := v.Run()
 	if !errors.Is(err, ErrOutOfGas) {
 		t.Errorf("GasExhaustion: got %v; want ErrOutOfGas", err)
@@ -1037,16 +1109,21 @@ func TestBlockchainContext(t *testing.T) {
 		instr(OpCaller, 4, 0, 0),    // R4 = callerAddr
 		instr(OpHalt, 2, 0, 0),      // halt with block num
 	)
-	v := newTestVM(code, nil)
-	v.SetBlockContext(12345, 9999, 0xABCD)
+	caller := common.HexToAddress("0x00000000000000000000000000000000000abcd1")
+	v := New(code, nil, 1_000_000, NewMemoryHost(common.Address{}, caller))
+	v.SetBlockContext(12345, 9999)
 	if got := runVM(t, v); got != 12345 {
 		t.Errorf("BlockNum: got %d; want 12345", got)
 	}
 	if v.registers[3] != 9999 {
 		t.Errorf("BlockTime: got %d; want 9999", v.registers[3])
 	}
-	if v.registers[4] != 0xABCD {
-		t.Errorf("Caller: got 0x%x; want 0xABCD", v.registers[4])
+	got, err := v.memory.ReadAddress(v.registers[4])
+	if err != nil {
+		t.Fatalf("ReadAddress: %v", err)
+	}
+	if got != caller {
+		t.Errorf("Caller: got %x; want %x", got, caller)
 	}
 }
 
@@ -0,0 +1,454 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+
+package lsp
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/probechain/go-probe/probe-lang/lang/ast"
+	"github.com/probechain/go-probe/probe-lang/lang/lower"
+	"github.com/probechain/go-probe/probe-lang/lang/parser"
+	"github.com/probechain/go-probe/probe-lang/lang/token"
+	"github.com/probechain/go-probe/probe-lang/lang/types"
+)
+
+// posKey identifies a source position by line and column, ignoring the
+// file name and offset.
+type posKey struct{ line, col int }
+
+func keyOf(pos token.Position) posKey { return posKey{pos.Line, pos.Column} }
+
+// declaration is a named declaration found in a document.
+type declaration struct {
+	name   Range  // range of the declared name
+	detail string // signature shown on hover
+}
+
+// document is an open source file and the result of analysing it.
+type document struct {
+	uri   string
+	lines []string
+	prog  *ast.Program
+	info  *types.Info // nil if the document does not parse
+
+	diagnostics []Diagnostic
+	symbols     []DocumentSymbol
+	decls       map[posKey]*declaration // by the position declarations are resolved to
+	bindings    map[posKey]types.Type   // types of locals and parameters by declaration
+}
+
+// newDocument parses and checks the text of a document. Parse errors are
+// reported alone; a document that parses is type checked and, if that
+// succeeds, lowered to catch the errors only lowering detects.
+func newDocument(uri, text string) *document {
+	d := &document{
+		uri:         uri,
+		lines:       strings.Split(text, "\n"),
+		diagnostics: []Diagnostic{},
+		symbols:     []DocumentSymbol{},
+		decls:       make(map[posKey]*declaration),
+		bindings:    make(map[posKey]types.Type),
+	}
+	prog, errs := parser.Parse(filename(uri), text)
+	d.prog = prog
+	if prog != nil {
+		d.symbols = d.declSymbols(prog.Declarations, "")
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			var pos token.Position
+			msg := err.Error()
+			if perr, ok := err.(*parser.Error); ok {
+				pos, msg = perr.Pos, perr.Msg
+			}
+			d.report(pos, msg)
+		}
+		return d
+	}
+	info, diags := types.Check(prog)
+	d.info = info
+	for _, diag := range diags {
+		d.report(diag.Pos, diag.Msg)
+	}
+	if len(diags) == 0 {
+		if _, err := lower.Lower(prog); err != nil {
+			if lerr, ok := err.(*lower.Error); ok {
+				d.report(lerr.Pos, lerr.Msg)
+			} else {
+				d.report(token.Position{}, err.Error())
+			}
+		}
+	}
+	for id, target := range info.Uses {
+		if t, ok := info.Types[id]; ok {
+			d.bindings[keyOf(target)] = t
+		}
+	}
+	return d
+}
+
+// filename returns the path of a file URI, or the URI itself.
+func filename(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+		return u.Path
+	}
+	return uri
+}
+
+// report adds an error diagnostic covering the word at pos.
+func (d *document) report(pos token.Position, msg string) {
+	d.diagnostics = append(d.diagnostics, Diagnostic{
+		Range:    d.wordRange(pos),
+		Severity: SeverityError,
+		Source:   "probe",
+		Message:  msg,
+	})
+}
+
+// toPosition converts a one-based token position to a protocol position.
+func toPosition(pos token.Position) Position {
+	p := Position{Line: pos.Line - 1, Character: pos.Column - 1}
+	if p.Line < 0 {
+		p.Line = 0
+	}
+	if p.Character < 0 {
+		p.Character = 0
+	}
+	return p
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+}
+
+// wordRange returns the range of the identifier or keyword starting at pos,
+// or a single character if there is none.
+func (d *document) wordRange(pos token.Position) Range {
+	start := toPosition(pos)
+	end := Position{Line: start.Line, Character: start.Character + 1}
+	if start.Line < len(d.lines) {
+		line := d.lines[start.Line]
+		i := start.Character
+		for i < len(line) && isWordByte(line[i]) {
+			i++
+		}
+		if i > start.Character {
+			end.Character = i
+		}
+	}
+	return Range{Start: start, End: end}
+}
+
+// nameRange returns the range of name following the keyword at pos, or of
+// the keyword if the name is not on the same line.
+func (d *document) nameRange(pos token.Position, keyword, name string) Range {
+	kw := d.wordRange(pos)
+	if kw.Start.Line >= len(d.lines) {
+		return kw
+	}
+	line := d.lines[kw.Start.Line]
+	from := kw.Start.Character + len(keyword)
+	if from > len(line) {
+		return kw
+	}
+	i := strings.Index(line[from:], name)
+	if i < 0 {
+		return kw
+	}
+	start := Position{Line: kw.Start.Line, Character: from + i}
+	return Range{Start: start, End: Position{Line: start.Line, Character: start.Character + len(name)}}
+}
+
+// ---------------------------------------------------------------------------
+// Symbols
+// ---------------------------------------------------------------------------
+
+// declSymbols returns the symbols of decls and records them in d.decls.
+// Names of declarations nested in modules and types are qualified with
+// prefix in hover details.
+func (d *document) declSymbols(decls []ast.Declaration, prefix string) []DocumentSymbol {
+	var syms []DocumentSymbol
+	for _, decl := range decls {
+		switch decl := decl.(type) {
+		case *ast.FnDecl:
+			syms = append(syms, d.symbol(decl.Token, decl.Name, SymbolFunction,
+				signature("fn "+prefix+decl.Name, decl.Params, decl.ReturnType), nil))
+		case *ast.StructDecl:
+			syms = append(syms, d.symbol(decl.Token, decl.Name, SymbolStruct,
+				"struct "+prefix+decl.Name, d.fieldSymbols(decl.Fields)))
+		case *ast.ResourceDecl:
+			syms = append(syms, d.symbol(decl.Token, decl.Name, SymbolStruct,
+				"resource "+prefix+decl.Name, d.fieldSymbols(decl.Fields)))
+		case *ast.AgentDecl:
+			var children []DocumentSymbol
+			if decl.State != nil {
+				children = d.fieldSymbols(decl.State.Fields)
+			}
+			for _, h := range decl.Handlers {
+				children = append(children, d.symbol(h.Token, h.Name, SymbolMethod,
+					signature("msg "+prefix+decl.Name+"::"+h.Name, h.Params, h.ReturnType), nil))
+			}
+			syms = append(syms, d.symbol(decl.Token, decl.Name, SymbolClass,
+				"agent "+prefix+decl.Name, children))
+		case *ast.EnumDecl:
+			var children []DocumentSymbol
+			for _, v := range decl.Variants {
+				children = append(children, d.symbol(v.Token, v.Name, SymbolEnumMember,
+					prefix+decl.Name+"::"+v.String(), nil))
+			}
+			syms = append(syms, d.symbol(decl.Token, decl.Name, SymbolEnum,
+				"enum "+prefix+decl.Name, children))
+		case *ast.TraitDecl:
+			var children []DocumentSymbol
+			for _, m := range decl.Methods {
+				children = append(children, d.symbol(m.Token, m.Name, SymbolMethod,
+					signature("fn "+m.Name, m.Params, m.ReturnType), nil))
+			}
+			syms = append(syms, d.symbol(decl.Token, decl.Name, SymbolInterface,
+				"trait "+prefix+decl.Name, children))
+		case *ast.ImplDecl:
+			var children []DocumentSymbol
+			for _, m := range decl.Methods {
+				children = append(children, d.symbol(m.Token, m.Name, SymbolMethod,
+					signature("fn "+prefix+decl.TypeName+"::"+m.Name, m.Params, m.ReturnType), nil))
+			}
+			name := decl.TypeName
+			if decl.Trait != "" {
+				name = decl.Trait + " for " + decl.TypeName
+			}
+			sym := d.symbol(decl.Token, decl.TypeName, SymbolNamespace, "", children)
+			sym.Name = "impl " + name
+			syms = append(syms, sym)
+		case *ast.TypeDecl:
+			syms = append(syms, d.symbol(decl.Token, decl.Name, SymbolStruct,
+				"type "+prefix+decl.Name+" = "+decl.Type.String(), nil))
+		case *ast.ModDecl:
+			syms = append(syms, d.symbol(decl.Token, decl.Name, SymbolModule,
+				"mod "+prefix+decl.Name, d.declSymbols(decl.Declarations, prefix+decl.Name+"::")))
+		}
+	}
+	return syms
+}
+
+// fieldSymbols returns the symbols of struct, resource or agent state
+// fields.
+func (d *document) fieldSymbols(fields []ast.Field) []DocumentSymbol {
+	var syms []DocumentSymbol
+	for i := range fields {
+		f := &fields[i]
+		syms = append(syms, d.symbol(f.Token, f.Name, SymbolField, f.String(), nil))
+	}
+	return syms
+}
+
+// symbol creates the symbol of a declaration introduced by tok, which is
+// either its keyword or its name.
+func (d *document) symbol(tok token.Token, name string, kind SymbolKind, detail string, children []DocumentSymbol) DocumentSymbol {
+	keyword := ""
+	if tok.Literal != name {
+		keyword = tok.Literal
+	}
+	sel := d.nameRange(tok.Pos, keyword, name)
+	d.decls[keyOf(tok.Pos)] = &declaration{name: sel, detail: detail}
+
+	full := Range{Start: toPosition(tok.Pos), End: sel.End}
+	for _, c := range children {
+		if after(c.Range.End, full.End) {
+			full.End = c.Range.End
+		}
+	}
+	return DocumentSymbol{
+		Name:           name,
+		Detail:         detail,
+		Kind:           kind,
+		Range:          full,
+		SelectionRange: sel,
+		Children:       children,
+	}
+}
+
+// signature formats a function or handler signature.
+func signature(head string, params []ast.Param, ret ast.TypeExpr) string {
+	ps := make([]string, len(params))
+	for i := range params {
+		ps[i] = params[i].String()
+	}
+	sig := head + "(" + strings.Join(ps, ", ") + ")"
+	if ret != nil {
+		sig += " -> " + ret.String()
+	}
+	return sig
+}
+
+func after(a, b Position) bool {
+	return a.Line > b.Line || a.Line == b.Line && a.Character > b.Character
+}
+
+func contains(r Range, p Position) bool {
+	return !after(r.Start, p) && after(r.End, p)
+}
+
+// ---------------------------------------------------------------------------
+// Hover and definition
+// ---------------------------------------------------------------------------
+
+// identAt returns the resolved identifier under p, if any.
+func (d *document) identAt(p Position) *ast.Ident {
+	if d.info == nil {
+		return nil
+	}
+	for id := range d.info.Uses {
+		if contains(d.identRange(id), p) {
+			return id
+		}
+	}
+	return nil
+}
+
+func (d *document) identRange(id *ast.Ident) Range {
+	start := toPosition(id.Token.Pos)
+	return Range{Start: start, End: Position{Line: start.Line, Character: start.Character + len(id.Value)}}
+}
+
+// hover describes the identifier or declared name under p: the type of
+// variables and the signature of functions, types and variants.
+func (d *document) hover(p Position) *Hover {
+	var (
+		text string
+		rng  Range
+	)
+	if id := d.identAt(p); id != nil {
+		rng = d.identRange(id)
+		if t, ok := d.info.Types[id]; ok {
+			text = id.Value + ": " + t.String()
+		} else if decl := d.decls[keyOf(d.info.Uses[id])]; decl != nil {
+			text = decl.detail
+		}
+	} else {
+		for _, decl := range d.decls {
+			if contains(decl.name, p) {
+				text, rng = decl.detail, decl.name
+				break
+			}
+		}
+		for key, t := range d.bindings {
+			if r := d.wordRange(token.Position{Line: key.line, Column: key.col}); text == "" && contains(r, p) {
+				text, rng = d.lineWord(r)+": "+t.String(), r
+			}
+		}
+	}
+	if text == "" {
+		return nil
+	}
+	return &Hover{
+		Contents: MarkupContent{Kind: "markdown", Value: "```probe\n" + text + "\n```"},
+		Range:    &rng,
+	}
+}
+
+// lineWord returns the text of a single-line range.
+func (d *document) lineWord(r Range) string {
+	return d.lines[r.Start.Line][r.Start.Character:r.End.Character]
+}
+
+// definition returns the location of the declaration the identifier under
+// p resolves to.
+func (d *document) definition(p Position) *Location {
+	id := d.identAt(p)
+	if id == nil {
+		return nil
+	}
+	target := d.info.Uses[id]
+	rng := d.wordRange(target)
+	if decl := d.decls[keyOf(target)]; decl != nil {
+		rng = decl.name
+	}
+	return &Location{URI: d.uri, Range: rng}
+}
+
+// ---------------------------------------------------------------------------
+// Completion
+// ---------------------------------------------------------------------------
+
+var (
+	qualifiedPrefix = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_]*)::([A-Za-z0-9_]*)$`)
+	identPrefix     = regexp.MustCompile(`[A-Za-z0-9_]*$`)
+)
+
+// completion proposes the members of a standard library module after
+// "module::", and otherwise the standard library modules and the top-level
+// declarations of the document.
+func (d *document) completion(p Position) CompletionList {
+	var before string
+	if p.Line < len(d.lines) {
+		line := d.lines[p.Line]
+		if p.Character > len(line) {
+			p.Character = len(line)
+		}
+		before = line[:p.Character]
+	}
+	items := []CompletionItem{}
+	stdlib := types.Intrinsics()
+
+	if m := qualifiedPrefix.FindStringSubmatch(before); m != nil {
+		module, partial := m[1], m[2]
+		for name, sig := range stdlib {
+			member := strings.TrimPrefix(name, module+"::")
+			if member == name || !strings.HasPrefix(member, partial) {
+				continue
+			}
+			items = append(items, CompletionItem{
+				Label:  member,
+				Kind:   CompletionFunction,
+				Detail: fmt.Sprintf("fn %s%s", name, strings.TrimPrefix(sig.String(), "fn")),
+			})
+		}
+		sortItems(items)
+		return CompletionList{Items: items}
+	}
+
+	partial := identPrefix.FindString(before)
+	modules := make(map[string]bool)
+	for name := range stdlib {
+		modules[name[:strings.Index(name, "::")]] = true
+	}
+	for module := range modules {
+		if strings.HasPrefix(module, partial) {
+			items = append(items, CompletionItem{Label: module, Kind: CompletionModule, Detail: "standard library"})
+		}
+	}
+	for _, sym := range d.symbols {
+		if sym.Kind == SymbolNamespace || !strings.HasPrefix(sym.Name, partial) {
+			continue
+		}
+		items = append(items, CompletionItem{Label: sym.Name, Kind: completionKind(sym.Kind), Detail: sym.Detail})
+	}
+	sortItems(items)
+	return CompletionList{Items: items}
+}
+
+func completionKind(kind SymbolKind) CompletionItemKind {
+	switch kind {
+	case SymbolFunction:
+		return CompletionFunction
+	case SymbolClass:
+		return CompletionClass
+	case SymbolEnum:
+		return CompletionEnum
+	case SymbolInterface:
+		return CompletionInterface
+	case SymbolModule:
+		return CompletionModule
+	default:
+		return CompletionStruct
+	}
+}
+
+func sortItems(items []CompletionItem) {
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+}
@@ -0,0 +1,188 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+
+package lsp
+
+// The subset of the Language Server Protocol types used by the server.
+// Field names follow the specification so the types marshal to the wire
+// format directly.
+
+// Position is a zero-based line and character offset in a document.
+// Characters are counted in bytes, which matches UTF-16 code units for the
+// ASCII sources PROBE programs are written in.
+type Position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// Range is a half-open span of a document.
+type Range struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+// Location is a range in a document.
+type Location struct {
+	URI   string `json:"uri"`
+	Range Range  `json:"range"`
+}
+
+// SeverityError is the diagnostic severity of compile errors.
+const SeverityError = 1
+
+// Diagnostic is a problem reported for a range of a document.
+type Diagnostic struct {
+	Range    Range  `json:"range"`
+	Severity int    `json:"severity"`
+	Source   string `json:"source"`
+	Message  string `json:"message"`
+}
+
+// PublishDiagnosticsParams is sent with textDocument/publishDiagnostics.
+type PublishDiagnosticsParams struct {
+	URI         string       `json:"uri"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+// TextDocumentItem is an opened document.
+type TextDocumentItem struct {
+	URI        string `json:"uri"`
+	LanguageID string `json:"languageId"`
+	Version    int    `json:"version"`
+	Text       string `json:"text"`
+}
+
+// TextDocumentIdentifier names a document.
+type TextDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+// VersionedTextDocumentIdentifier names a version of a document.
+type VersionedTextDocumentIdentifier struct {
+	URI     string `json:"uri"`
+	Version int    `json:"version"`
+}
+
+// DidOpenTextDocumentParams is sent with textDocument/didOpen.
+type DidOpenTextDocumentParams struct {
+	TextDocument TextDocumentItem `json:"textDocument"`
+}
+
+// TextDocumentContentChangeEvent is a change of a document. The server
+// asks for full synchronisation, so Text is always the whole document.
+type TextDocumentContentChangeEvent struct {
+	Text string `json:"text"`
+}
+
+// DidChangeTextDocumentParams is sent with textDocument/didChange.
+type DidChangeTextDocumentParams struct {
+	TextDocument   VersionedTextDocumentIdentifier  `json:"textDocument"`
+	ContentChanges []TextDocumentContentChangeEvent `json:"contentChanges"`
+}
+
+// DidCloseTextDocumentParams is sent with textDocument/didClose.
+type DidCloseTextDocumentParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+// TextDocumentPositionParams are the parameters of hover, definition and
+// completion requests.
+type TextDocumentPositionParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+	Position     Position               `json:"position"`
+}
+
+// DocumentSymbolParams are the parameters of textDocument/documentSymbol.
+type DocumentSymbolParams struct {
+	TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+// MarkupContent is formatted text.
+type MarkupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// Hover is the result of textDocument/hover.
+type Hover struct {
+	Contents MarkupContent `json:"contents"`
+	Range    *Range        `json:"range,omitempty"`
+}
+
+// SymbolKind is the kind of a DocumentSymbol.
+type SymbolKind int
+
+const (
+	SymbolModule     SymbolKind = 2
+	SymbolNamespace  SymbolKind = 3
+	SymbolClass      SymbolKind = 5
+	SymbolMethod     SymbolKind = 6
+	SymbolField      SymbolKind = 8
+	SymbolEnum       SymbolKind = 10
+	SymbolInterface  SymbolKind = 11
+	SymbolFunction   SymbolKind = 12
+	SymbolEnumMember SymbolKind = 22
+	SymbolStruct     SymbolKind = 23
+)
+
+// DocumentSymbol is a declaration in a document. Range covers the
+// declaration from its keyword, SelectionRange its name.
+type DocumentSymbol struct {
+	Name           string           `json:"name"`
+	Detail         string           `json:"detail,omitempty"`
+	Kind           SymbolKind       `json:"kind"`
+	Range          Range            `json:"range"`
+	SelectionRange Range            `json:"selectionRange"`
+	Children       []DocumentSymbol `json:"children,omitempty"`
+}
+
+// CompletionItemKind is the kind of a CompletionItem.
+type CompletionItemKind int
+
+const (
+	CompletionFunction  CompletionItemKind = 3
+	CompletionClass     CompletionItemKind = 7
+	CompletionInterface CompletionItemKind = 8
+	CompletionModule    CompletionItemKind = 9
+	CompletionEnum      CompletionItemKind = 13
+	CompletionStruct    CompletionItemKind = 22
+)
+
+// CompletionItem is a completion proposal.
+type CompletionItem struct {
+	Label  string             `json:"label"`
+	Kind   CompletionItemKind `json:"kind"`
+	Detail string             `json:"detail,omitempty"`
+}
+
+// CompletionList is the result of textDocument/completion.
+type CompletionList struct {
+	IsIncomplete bool             `json:"isIncomplete"`
+	Items        []CompletionItem `json:"items"`
+}
+
+// CompletionOptions describes the completion support of the server.
+type CompletionOptions struct {
+	TriggerCharacters []string `json:"triggerCharacters,omitempty"`
+}
+
+// ServerCapabilities are the features announced in the initialize result.
+type ServerCapabilities struct {
+	TextDocumentSync       int                `json:"textDocumentSync"`
+	HoverProvider          bool               `json:"hoverProvider"`
+	DefinitionProvider     bool               `json:"definitionProvider"`
+	DocumentSymbolProvider bool               `json:"documentSymbolProvider"`
+	CompletionProvider     *CompletionOptions `json:"completionProvider,omitempty"`
+}
+
+// ServerInfo identifies the server.
+type ServerInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// InitializeResult is the result of initialize.
+type InitializeResult struct {
+	Capabilities ServerCapabilities `json:"capabilities"`
+	ServerInfo   *ServerInfo        `json:"serverInfo,omitempty"`
+}
@@ -0,0 +1,211 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+
+// Package lsp implements a Language Server Protocol server for the PROBE
+// Language. It publishes parse, type and lowering errors as diagnostics and
+// answers hover, go-to-definition, document symbol and completion requests
+// for open documents, using the lexer, parser and type checker of the
+// compiler.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// ErrExitWithoutShutdown is returned by Run when the client sent exit
+// without a preceding shutdown request.
+var ErrExitWithoutShutdown = errors.New("exit without shutdown")
+
+// Server is a language server talking JSON-RPC over a pair of streams.
+// Requests are handled one at a time in the order they arrive.
+type Server struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	docs        map[string]*document // open documents by URI
+	initialized bool
+	shutdown    bool
+}
+
+// NewServer creates a server reading requests from in and writing responses
+// and notifications to out.
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:   bufio.NewReader(in),
+		out:  out,
+		docs: make(map[string]*document),
+	}
+}
+
+// Run serves requests until the client sends exit or the input ends.
+func (s *Server) Run() error {
+	for {
+		msg, err := readMessage(s.in)
+		if err == io.EOF {
+			return nil
+		}
+		if rerr, ok := err.(*ResponseError); ok {
+			null := json.RawMessage("null")
+			if err := writeMessage(s.out, &message{ID: &null, Error: rerr}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return ErrExitWithoutShutdown
+			}
+			return nil
+		}
+		result, err := s.handle(msg)
+		if msg.ID == nil {
+			// Notifications have no response, failed ones included.
+			continue
+		}
+		resp := &message{ID: msg.ID}
+		if err != nil {
+			rerr, ok := err.(*ResponseError)
+			if !ok {
+				rerr = &ResponseError{Code: codeInvalidRequest, Message: err.Error()}
+			}
+			resp.Error = rerr
+		} else if resp.Result, err = json.Marshal(result); err != nil {
+			return err
+		}
+		if err := writeMessage(s.out, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// handle dispatches a request or notification to its handler.
+func (s *Server) handle(msg *message) (interface{}, error) {
+	if msg.Method == "initialize" {
+		s.initialized = true
+		return s.initialize(), nil
+	}
+	if !s.initialized {
+		return nil, &ResponseError{Code: codeServerNotInitialized, Message: "server not initialized"}
+	}
+	switch msg.Method {
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var params DidOpenTextDocumentParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		return nil, s.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params DidChangeTextDocumentParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			return nil, s.update(params.TextDocument.URI, params.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		delete(s.docs, params.TextDocument.URI)
+		return nil, s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{
+			URI:         params.TextDocument.URI,
+			Diagnostics: []Diagnostic{},
+		})
+
+	case "textDocument/hover":
+		var params TextDocumentPositionParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		if doc := s.docs[params.TextDocument.URI]; doc != nil {
+			if hover := doc.hover(params.Position); hover != nil {
+				return hover, nil
+			}
+		}
+		return nil, nil
+	case "textDocument/definition":
+		var params TextDocumentPositionParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		if doc := s.docs[params.TextDocument.URI]; doc != nil {
+			if loc := doc.definition(params.Position); loc != nil {
+				return loc, nil
+			}
+		}
+		return nil, nil
+	case "textDocument/documentSymbol":
+		var params DocumentSymbolParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		if doc := s.docs[params.TextDocument.URI]; doc != nil {
+			return doc.symbols, nil
+		}
+		return []DocumentSymbol{}, nil
+	case "textDocument/completion":
+		var params TextDocumentPositionParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		if doc := s.docs[params.TextDocument.URI]; doc != nil {
+			return doc.completion(params.Position), nil
+		}
+		return CompletionList{Items: []CompletionItem{}}, nil
+	}
+	return nil, &ResponseError{Code: codeMethodNotFound, Message: "method not found: " + msg.Method}
+}
+
+func (s *Server) initialize() *InitializeResult {
+	return &InitializeResult{
+		Capabilities: ServerCapabilities{
+			TextDocumentSync:       1, // full
+			HoverProvider:          true,
+			DefinitionProvider:     true,
+			DocumentSymbolProvider: true,
+			CompletionProvider:     &CompletionOptions{TriggerCharacters: []string{":"}},
+		},
+		ServerInfo: &ServerInfo{Name: "probe-lsp"},
+	}
+}
+
+// update analyses a new version of a document and publishes its
+// diagnostics.
+func (s *Server) update(uri, text string) error {
+	doc := newDocument(uri, text)
+	s.docs[uri] = doc
+	return s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{
+		URI:         uri,
+		Diagnostics: doc.diagnostics,
+	})
+}
+
+// notify sends a notification to the client.
+func (s *Server) notify(method string, params interface{}) error {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return writeMessage(s.out, &message{Method: method, Params: raw})
+}
+
+func decodeParams(msg *message, v interface{}) error {
+	if err := json.Unmarshal(msg.Params, v); err != nil {
+		return &ResponseError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
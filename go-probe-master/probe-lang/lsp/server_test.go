@@ -0,0 +1,334 @@
+// Copyright 2024 The ProbeChain Authors
+// This file is part of the ProbeChain.
+
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// client drives a Server running in-process over a pair of pipes.
+type client struct {
+	t      *testing.T
+	w      *io.PipeWriter
+	r      *bufio.Reader
+	nextID int
+	done   chan error
+}
+
+func newClient(t *testing.T) *client {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	c := &client{t: t, w: inW, r: bufio.NewReader(outR), done: make(chan error, 1)}
+	go func() {
+		c.done <- NewServer(inR, outW).Run()
+		outW.Close()
+	}()
+	var result InitializeResult
+	if err := c.call("initialize", map[string]interface{}{}, &result); err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+	if caps := result.Capabilities; caps.TextDocumentSync != 1 || !caps.HoverProvider || !caps.DefinitionProvider ||
+		!caps.DocumentSymbolProvider || caps.CompletionProvider == nil {
+		t.Fatalf("capabilities = %+v", caps)
+	}
+	c.notify("initialized", map[string]interface{}{})
+	return c
+}
+
+func (c *client) send(msg *message) {
+	if err := writeMessage(c.w, msg); err != nil {
+		c.t.Fatalf("write %s: %v", msg.Method, err)
+	}
+}
+
+func (c *client) read() *message {
+	msg, err := readMessage(c.r)
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return msg
+}
+
+func (c *client) notify(method string, params interface{}) {
+	raw, _ := json.Marshal(params)
+	c.send(&message{Method: method, Params: raw})
+}
+
+// call sends a request and decodes its result into result.
+func (c *client) call(method string, params, result interface{}) *ResponseError {
+	c.nextID++
+	id := json.RawMessage(strconv.Itoa(c.nextID))
+	raw, _ := json.Marshal(params)
+	c.send(&message{ID: &id, Method: method, Params: raw})
+
+	resp := c.read()
+	if resp.ID == nil || string(*resp.ID) != string(id) {
+		c.t.Fatalf("%s: got %+v, want response %s", method, resp, id)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		c.t.Fatalf("%s: decoding result %s: %v", method, resp.Result, err)
+	}
+	return nil
+}
+
+// open opens a document and returns the diagnostics published for it.
+func (c *client) open(uri, text string) []Diagnostic {
+	c.notify("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "probe", Version: 1, Text: text},
+	})
+	return c.diagnostics(uri)
+}
+
+func (c *client) diagnostics(uri string) []Diagnostic {
+	msg := c.read()
+	if msg.Method != "textDocument/publishDiagnostics" {
+		c.t.Fatalf("got %+v, want publishDiagnostics", msg)
+	}
+	var params PublishDiagnosticsParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		c.t.Fatal(err)
+	}
+	if params.URI != uri {
+		c.t.Fatalf("diagnostics for %s, want %s", params.URI, uri)
+	}
+	return params.Diagnostics
+}
+
+func (c *client) close() {
+	var result interface{}
+	if err := c.call("shutdown", nil, &result); err != nil {
+		c.t.Fatalf("shutdown: %v", err)
+	}
+	c.notify("exit", nil)
+	if err := <-c.done; err != nil {
+		c.t.Fatalf("Run: %v", err)
+	}
+}
+
+func at(line, char int) TextDocumentPositionParams {
+	return TextDocumentPositionParams{
+		TextDocument: TextDocumentIdentifier{URI: testURI},
+		Position:     Position{Line: line, Character: char},
+	}
+}
+
+func rng(line, start, end int) Range {
+	return Range{Start: Position{line, start}, End: Position{line, end}}
+}
+
+const testURI = "file:///work/counter.probe"
+
+const testSource = `struct Point { x: u64, y: u64 }
+
+resource Coin { value: u64 }
+
+agent Counter {
+    state { count: u64 }
+    msg bump(by: u64) { self.count += by; }
+}
+
+fn add(a: u64, b: u64) -> u64 {
+    a + b
+}
+
+fn main() -> u64 {
+    let total = add(1, 2);
+    total
+}
+`
+
+func TestDiagnostics(t *testing.T) {
+	c := newClient(t)
+	defer c.close()
+
+	if diags := c.open(testURI, testSource); len(diags) != 0 {
+		t.Errorf("valid source: diagnostics %+v", diags)
+	}
+
+	// Parse errors are reported at their token.
+	diags := c.open("file:///work/parse.probe", "fn f() {\n    let = 1;\n}")
+	if len(diags) == 0 {
+		t.Fatal("parse error: no diagnostics")
+	}
+	if diags[0].Range.Start != (Position{1, 8}) || diags[0].Severity != SeverityError || diags[0].Source != "probe" {
+		t.Errorf("parse error: diagnostic %+v", diags[0])
+	}
+	if strings.HasPrefix(diags[0].Message, "/work/parse.probe") {
+		t.Errorf("parse error: message %q repeats the position", diags[0].Message)
+	}
+
+	// Type errors replace them once the document parses.
+	c.notify("textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument:   VersionedTextDocumentIdentifier{URI: "file:///work/parse.probe", Version: 2},
+		ContentChanges: []TextDocumentContentChangeEvent{{Text: "fn f() -> u64 {\n    missing\n}"}},
+	})
+	diags = c.diagnostics("file:///work/parse.probe")
+	if len(diags) != 1 || diags[0].Range != rng(1, 4, 11) || !strings.Contains(diags[0].Message, "undefined: missing") {
+		t.Errorf("type error: diagnostics %+v", diags)
+	}
+
+	// Closing a document clears its diagnostics.
+	c.notify("textDocument/didClose", DidCloseTextDocumentParams{
+		TextDocument: TextDocumentIdentifier{URI: "file:///work/parse.probe"},
+	})
+	if diags := c.diagnostics("file:///work/parse.probe"); len(diags) != 0 {
+		t.Errorf("closed document: diagnostics %+v", diags)
+	}
+}
+
+func TestHover(t *testing.T) {
+	c := newClient(t)
+	defer c.close()
+	c.open(testURI, testSource)
+
+	tests := []struct {
+		line, char int
+		want       string
+	}{
+		{15, 6, "total: u64"},                     // use of a local
+		{14, 9, "total: u64"},                     // its declaration
+		{10, 4, "a: u64"},                         // use of a parameter
+		{14, 17, "fn add(a: u64, b: u64) -> u64"}, // call
+		{9, 4, "fn add(a: u64, b: u64) -> u64"},   // declared name
+		{4, 8, "agent Counter"},
+		{6, 9, "msg Counter::bump(by: u64)"},
+	}
+	for _, tt := range tests {
+		var hover Hover
+		if err := c.call("textDocument/hover", at(tt.line, tt.char), &hover); err != nil {
+			t.Fatalf("hover %d:%d: %v", tt.line, tt.char, err)
+		}
+		if want := "```probe\n" + tt.want + "\n```"; hover.Contents.Value != want {
+			t.Errorf("hover %d:%d = %q, want %q", tt.line, tt.char, hover.Contents.Value, want)
+		}
+	}
+
+	var hover *Hover
+	if err := c.call("textDocument/hover", at(1, 0), &hover); err != nil || hover != nil {
+		t.Errorf("hover on a blank line = %+v, %v; want null", hover, err)
+	}
+}
+
+func TestDefinition(t *testing.T) {
+	c := newClient(t)
+	defer c.close()
+	c.open(testURI, testSource)
+
+	tests := []struct {
+		line, char int
+		want       Range
+	}{
+		{15, 4, rng(14, 8, 13)}, // local
+		{10, 8, rng(9, 15, 16)}, // parameter
+		{14, 16, rng(9, 3, 6)},  // function
+	}
+	for _, tt := range tests {
+		var loc *Location
+		if err := c.call("textDocument/definition", at(tt.line, tt.char), &loc); err != nil {
+			t.Fatalf("definition %d:%d: %v", tt.line, tt.char, err)
+		}
+		if loc == nil || loc.URI != testURI || loc.Range != tt.want {
+			t.Errorf("definition %d:%d = %+v, want %+v", tt.line, tt.char, loc, tt.want)
+		}
+	}
+}
+
+func TestDocumentSymbols(t *testing.T) {
+	c := newClient(t)
+	defer c.close()
+	c.open(testURI, testSource)
+
+	var syms []DocumentSymbol
+	if err := c.call("textDocument/documentSymbol", DocumentSymbolParams{TextDocument: TextDocumentIdentifier{URI: testURI}}, &syms); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name string
+		kind SymbolKind
+		sel  Range
+	}{
+		{"Point", SymbolStruct, rng(0, 7, 12)},
+		{"Coin", SymbolStruct, rng(2, 9, 13)},
+		{"Counter", SymbolClass, rng(4, 6, 13)},
+		{"add", SymbolFunction, rng(9, 3, 6)},
+		{"main", SymbolFunction, rng(13, 3, 7)},
+	}
+	if len(syms) != len(want) {
+		t.Fatalf("got %d symbols, want %d: %+v", len(syms), len(want), syms)
+	}
+	for i, w := range want {
+		if s := syms[i]; s.Name != w.name || s.Kind != w.kind || s.SelectionRange != w.sel {
+			t.Errorf("symbol %d = %s kind %d at %+v, want %s kind %d at %+v", i, s.Name, s.Kind, s.SelectionRange, w.name, w.kind, w.sel)
+		}
+	}
+	if d := syms[1].Detail; d != "resource Coin" {
+		t.Errorf("Coin detail = %q", d)
+	}
+	agent := syms[2]
+	if len(agent.Children) != 2 || agent.Children[0].Name != "count" || agent.Children[0].Kind != SymbolField ||
+		agent.Children[1].Name != "bump" || agent.Children[1].Kind != SymbolMethod {
+		t.Errorf("Counter children = %+v", agent.Children)
+	}
+	if agent.Range.Start != (Position{4, 0}) || agent.Range.End != (Position{6, 12}) {
+		t.Errorf("Counter range = %+v", agent.Range)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	c := newClient(t)
+	defer c.close()
+	c.open(testURI, "fn helper() {}\n\nfn main() {\n    chain::b\n    he\n}")
+
+	complete := func(line, char int) []CompletionItem {
+		var list CompletionList
+		if err := c.call("textDocument/completion", at(line, char), &list); err != nil {
+			t.Fatalf("completion %d:%d: %v", line, char, err)
+		}
+		return list.Items
+	}
+	labels := func(items []CompletionItem) string {
+		var names []string
+		for _, item := range items {
+			names = append(names, item.Label)
+		}
+		return strings.Join(names, " ")
+	}
+
+	items := complete(3, 12)
+	if got := labels(items); got != "balance block_number block_timestamp" {
+		t.Errorf("chain::b completions = %s", got)
+	}
+	if items[0].Kind != CompletionFunction || items[0].Detail != "fn chain::balance(address) -> u64" {
+		t.Errorf("balance item = %+v", items[0])
+	}
+	if got := labels(complete(3, 11)); !strings.Contains(got, "storage_load") || !strings.Contains(got, "caller") {
+		t.Errorf("chain:: completions = %s", got)
+	}
+	items = complete(4, 6)
+	if got := labels(items); got != "helper" || items[0].Kind != CompletionFunction {
+		t.Errorf("he completions = %+v", items)
+	}
+	if got := labels(complete(4, 4)); got != "chain crypto helper main" {
+		t.Errorf("completions = %s", got)
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	c := newClient(t)
+	defer c.close()
+
+	var result interface{}
+	err := c.call("workspace/symbol", map[string]string{"query": ""}, &result)
+	if err == nil || err.Code != codeMethodNotFound {
+		t.Errorf("error = %v, want method not found", err)
+	}
+}
@@ -47,6 +47,7 @@ import (
 	"github.com/probechain/go-probe/p2p/dnsdisc"
 	"github.com/probechain/go-probe/p2p/enode"
 	"github.com/probechain/go-probe/params"
+	"github.com/probechain/go-probe/probe-lang/integration"
 	"github.com/probechain/go-probe/probe/downloader"
 	"github.com/probechain/go-probe/probe/filters"
 	"github.com/probechain/go-probe/probe/gasprice"
@@ -244,8 +245,7 @@ func New(stack *node.Node, config *probeconfig.Config) (*Probeum, error) {
 	}
 
 	// Initialize Superlight DEX if configured
-	if chainConfig.Superlight != nil && chainConfig.Superlight.Enabled {
-		probe.superlightDEX = superlight.NewManager(chainConfig.Superlight)
+	if probe.superlightDEX = probe.blockchain.Superlight(); probe.superlightDEX != nil {
 		log.Info("Superlight DEX initialized")
 	}
 
@@ -380,6 +380,14 @@ func (s *Probeum) APIs() []rpc.API {
 		},
 	}...)
 
+	// Register the PROBE language compiler and simulator API
+	apis = append(apis, rpc.API{
+		Namespace: "probelang",
+		Version:   "1.0",
+		Service:   integration.NewProbeLanguageAPI(),
+		Public:    true,
+	})
+
 	// Register Superlight DEX API if enabled
 	if s.superlightDEX != nil {
 		apis = append(apis, rpc.API{
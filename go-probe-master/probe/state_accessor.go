@@ -155,6 +155,9 @@ func (probe *Probeum) stateAtTransaction(block *types.Block, txIndex int, reexec
 	if err != nil {
 		return nil, vm.BlockContext{}, nil, err
 	}
+	// Deliver the agent messages due at the start of the block
+	core.ApplyAgentMessages(probe.blockchain.Config(), probe.blockchain, nil, statedb, block.Header(), vm.Config{})
+
 	if txIndex == 0 && len(block.Transactions()) == 0 {
 		return nil, vm.BlockContext{}, statedb, nil
 	}
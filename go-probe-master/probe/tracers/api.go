@@ -262,6 +262,9 @@ func (api *API) traceChain(ctx context.Context, start, end *types.Block, config
 			for task := range tasks {
 				signer := types.MakeSigner(api.backend.ChainConfig(), task.block.Number())
 				blockCtx := core.NewEVMBlockContext(task.block.Header(), api.chainContext(localctx), nil)
+				// Deliver the agent messages due at the start of the block
+				core.ApplyAgentMessages(api.backend.ChainConfig(), api.chainContext(localctx), nil, task.statedb, task.block.Header(), vm.Config{})
+
 				// Trace all the transactions contained within
 				for i, tx := range task.block.Transactions() {
 					msg, _ := tx.AsMessage(signer, task.block.BaseFee())
@@ -510,6 +513,10 @@ func (api *API) traceBlock(ctx context.Context, block *types.Block, config *Trac
 	}
 	blockCtx := core.NewEVMBlockContext(block.Header(), api.chainContext(ctx), nil)
 	blockHash := block.Hash()
+
+	// Deliver the agent messages due at the start of the block
+	core.ApplyAgentMessages(api.backend.ChainConfig(), api.chainContext(ctx), nil, statedb, block.Header(), vm.Config{})
+
 	for th := 0; th < threads; th++ {
 		pend.Add(1)
 		go func() {
@@ -620,6 +627,9 @@ func (api *API) standardTraceBlockToFile(ctx context.Context, block *types.Block
 			canon = false
 		}
 	}
+	// Deliver the agent messages due at the start of the block
+	core.ApplyAgentMessages(chainConfig, api.chainContext(ctx), nil, statedb, block.Header(), vm.Config{})
+
 	for i, tx := range block.Transactions() {
 		// Prepare the trasaction for un-traced execution
 		var (
@@ -836,6 +846,7 @@ func (api *API) traceTx(ctx context.Context, message core.Message, txctx *Contex
 			Failed:      result.Failed(),
 			ReturnValue: returnVal,
 			StructLogs:  probeapi.FormatLogs(tracer.StructLogs()),
+			ProbeLogs:   probeapi.FormatProbeLogs(tracer.ProbeLogs()),
 		}, nil
 
 	case *Tracer:
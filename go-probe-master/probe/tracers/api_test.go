@@ -38,9 +38,13 @@ import (
 	"github.com/probechain/go-probe/core/state"
 	"github.com/probechain/go-probe/core/types"
 	"github.com/probechain/go-probe/core/vm"
-	"github.com/probechain/go-probe/probedb"
 	"github.com/probechain/go-probe/internal/probeapi"
 	"github.com/probechain/go-probe/params"
+	"github.com/probechain/go-probe/probe-lang/integration"
+	"github.com/probechain/go-probe/probe-lang/lang/codegen"
+	"github.com/probechain/go-probe/probe-lang/lang/lower"
+	"github.com/probechain/go-probe/probe-lang/lang/parser"
+	"github.com/probechain/go-probe/probedb"
 	"github.com/probechain/go-probe/rpc"
 )
 
@@ -154,6 +158,8 @@ func (b *testBackend) StateAtTransaction(ctx context.Context, block *types.Block
 	if err != nil {
 		return nil, vm.BlockContext{}, nil, errStateNotFound
 	}
+	core.ApplyAgentMessages(b.chainConfig, b.chain, nil, statedb, block.Header(), vm.Config{})
+
 	if txIndex == 0 && len(block.Transactions()) == 0 {
 		return nil, vm.BlockContext{}, statedb, nil
 	}
@@ -590,6 +596,168 @@ func TestTraceBlock(t *testing.T) {
 	}
 }
 
+// generatedBackend is a tracing backend serving generated blocks and their
+// states straight from the generator's database, without importing them.
+type generatedBackend struct {
+	chainConfig *params.ChainConfig
+	engine      consensus.Engine
+	chaindb     probedb.Database
+	blocks      []*types.Block
+}
+
+func newGeneratedBackend(n int, gspec *core.Genesis, generator func(i int, b *core.BlockGen)) (*generatedBackend, []types.Receipts) {
+	backend := &generatedBackend{
+		chainConfig: gspec.Config,
+		engine:      pob.NewFaker(),
+		chaindb:     rawdb.NewMemoryDatabase(),
+	}
+	genesis := gspec.MustCommit(backend.chaindb)
+	blocks, receipts := core.GenerateChain(backend.chainConfig, genesis, backend.engine, backend.chaindb, n, generator)
+	backend.blocks = append([]*types.Block{genesis}, blocks...)
+	return backend, receipts
+}
+
+func (b *generatedBackend) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	if block, _ := b.BlockByHash(ctx, hash); block != nil {
+		return block.Header(), nil
+	}
+	return nil, errBlockNotFound
+}
+
+func (b *generatedBackend) HeaderByNumber(ctx context.Context, number rpc.BlockNumber) (*types.Header, error) {
+	if block, _ := b.BlockByNumber(ctx, number); block != nil {
+		return block.Header(), nil
+	}
+	return nil, errBlockNotFound
+}
+
+func (b *generatedBackend) BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
+	for _, block := range b.blocks {
+		if block.Hash() == hash {
+			return block, nil
+		}
+	}
+	return nil, errBlockNotFound
+}
+
+func (b *generatedBackend) BlockByNumber(ctx context.Context, number rpc.BlockNumber) (*types.Block, error) {
+	if number == rpc.PendingBlockNumber || number == rpc.LatestBlockNumber {
+		return b.blocks[len(b.blocks)-1], nil
+	}
+	if int(number) >= len(b.blocks) {
+		return nil, errBlockNotFound
+	}
+	return b.blocks[number], nil
+}
+
+func (b *generatedBackend) GetTransaction(ctx context.Context, txHash common.Hash) (*types.Transaction, common.Hash, uint64, uint64, error) {
+	for _, block := range b.blocks {
+		for i, tx := range block.Transactions() {
+			if tx.Hash() == txHash {
+				return tx, block.Hash(), block.NumberU64(), uint64(i), nil
+			}
+		}
+	}
+	return nil, common.Hash{}, 0, 0, errTransactionNotFound
+}
+
+func (b *generatedBackend) RPCGasCap() uint64                { return 25000000 }
+func (b *generatedBackend) ChainConfig() *params.ChainConfig { return b.chainConfig }
+func (b *generatedBackend) Engine() consensus.Engine         { return b.engine }
+func (b *generatedBackend) ChainDb() probedb.Database        { return b.chaindb }
+
+func (b *generatedBackend) StateAtBlock(ctx context.Context, block *types.Block, reexec uint64, base *state.StateDB, checkLive bool) (*state.StateDB, error) {
+	statedb, err := state.New(block.Root(), state.NewDatabase(b.chaindb), nil)
+	if err != nil {
+		return nil, errStateNotFound
+	}
+	return statedb, nil
+}
+
+func (b *generatedBackend) StateAtTransaction(ctx context.Context, block *types.Block, txIndex int, reexec uint64) (core.Message, vm.BlockContext, *state.StateDB, error) {
+	return nil, vm.BlockContext{}, nil, errStateNotFound
+}
+
+const probeAgentSource = `
+agent Counter {
+    state {
+        count: u64,
+    }
+
+    msg increment(by: u64) {
+        self.count += by;
+    }
+}
+
+fn start(n: u64) {
+    let c = spawn Counter { count: 0 };
+    let mut i = 0;
+    while i < n {
+        c.increment(1);
+        i += 1;
+    }
+}
+`
+
+// Tests that tracing a block delivers the PROBE agent messages due at its start
+// before running the transactions, so the traces match the receipts.
+func TestTraceAgentMessages(t *testing.T) {
+	t.Parallel()
+
+	prog, errs := parser.Parse("agents.probe", probeAgentSource)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	irProg, err := lower.Lower(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := codegen.New().Generate(irProg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry uint32
+	for _, f := range bc.Functions {
+		if f.Name == "start" {
+			entry = uint32(f.Offset)
+		}
+	}
+	config := *params.TestChainConfig
+	config.ProbeLangBlock = new(big.Int)
+
+	// Fill the contract's message queue in every block, which only succeeds
+	// if the messages of the previous block were delivered ahead of it
+	accounts := newAccounts(1)
+	contract := common.HexToAddress("0x00000000000000000000000000000000deadbeef")
+	genesis := &core.Genesis{
+		Config:   &config,
+		GasLimit: 30000000,
+		Alloc: core.GenesisAlloc{
+			accounts[0].addr: {Balance: big.NewInt(params.Probeer)},
+			contract:         {Balance: new(big.Int), Code: integration.EncodePROBEContract(bc.Code, bc.Constants)},
+		},
+	}
+	backend, receipts := newGeneratedBackend(2, genesis, func(i int, b *core.BlockGen) {
+		data := integration.EncodeCallData(entry, integration.MaxPendingMessages)
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), contract, new(big.Int), 20000000, b.BaseFee(), data), types.HomesteadSigner{}, accounts[0].key)
+		b.AddTx(tx)
+	})
+	receipt := receipts[1][0]
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		t.Fatalf("agent transaction failed")
+	}
+	results, err := NewAPI(backend).TraceBlockByNumber(context.Background(), rpc.BlockNumber(2), nil)
+	if err != nil {
+		t.Fatalf("failed to trace block: %v", err)
+	}
+	if results[0].Error != "" {
+		t.Fatalf("failed to trace transaction: %v", results[0].Error)
+	}
+	if res := results[0].Result.(*probeapi.ExecutionResult); res.Failed || res.Gas != receipt.GasUsed {
+		t.Errorf("trace mismatch: have gas %d failed %v, want gas %d", res.Gas, res.Failed, receipt.GasUsed)
+	}
+}
+
 type Account struct {
 	key  *probe.PrivateKey
 	addr common.Address